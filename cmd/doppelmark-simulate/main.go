@@ -0,0 +1,102 @@
+// Copyright 2019 Grail Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+/*
+  doppelmark-simulate writes a coordinate sorted BAM of duplicate
+  readpairs, and a truth file of its duplicates, for benchmarking and
+  testing doppelmark. For more information, see
+  github.com/Schaudge/doppelmark/simulate
+*/
+
+import (
+	"flag"
+	"os"
+	"strings"
+
+	"github.com/Schaudge/doppelmark/simulate"
+	"github.com/Schaudge/grailbase/grail"
+	"github.com/Schaudge/grailbase/log"
+)
+
+var (
+	defaults                 = simulate.DefaultOpts
+	output                   = flag.String("output", "", "path of the output BAM")
+	truth                    = flag.String("truth", "", "path of the tab separated truth file, with a row per readpair: its name, the index and size of its duplicate set, and whether it is a duplicate, an optical duplicate, and has a UMI error")
+	seed                     = flag.Int64("seed", defaults.Seed, "seed of the random numbers, the same seed and parameters generate the same BAM")
+	pairs                    = flag.Int("pairs", defaults.Pairs, "number of readpairs")
+	references               = flag.Int("references", defaults.References, "number of references")
+	referenceLength          = flag.Int("reference-length", defaults.ReferenceLength, "length of the references")
+	readLength               = flag.Int("read-length", defaults.ReadLength, "length of the reads")
+	duplicationRate          = flag.Float64("duplication-rate", defaults.DuplicationRate, "expected fraction of the readpairs that are duplicates")
+	setSizeMean              = flag.Float64("set-size-mean", defaults.SetSizeMean, "mean size of the duplicate sets of more than one readpair, geometrically distributed above 2")
+	setSizeMax               = flag.Int("set-size-max", defaults.SetSizeMax, "maximum size of the duplicate sets")
+	opticalFraction          = flag.Float64("optical-fraction", defaults.OpticalFraction, "fraction of the duplicates that are optical duplicates")
+	opticalDistance          = flag.Int("optical-distance", defaults.OpticalDistance, "pixel distance within which the optical duplicates are of their representative")
+	interchromosomalFraction = flag.Float64("interchromosomal-fraction", defaults.InterchromosomalFraction, "fraction of the duplicate sets whose reads are on different references")
+	umiLength                = flag.Int("umi-length", defaults.UMILength, "length of the UMIs in the RX tag, 0 for no UMIs")
+	umiErrorRate             = flag.Float64("umi-error-rate", defaults.UMIErrorRate, "probability that a UMI base of a readpair differs from that of its duplicate set")
+	nameFormat               = flag.String("name-format", defaults.NameFormat, "format of the read names, one of "+strings.Join(simulate.NameFormats, ", "))
+	secondaryFraction        = flag.Float64("secondary-fraction", defaults.SecondaryFraction, "fraction of the readpairs with a secondary record")
+	supplementaryFraction    = flag.Float64("supplementary-fraction", defaults.SupplementaryFraction, "fraction of the readpairs with a supplementary record")
+)
+
+func main() {
+	shutdown := grail.Init()
+	defer shutdown()
+
+	if *output == "" || *truth == "" {
+		log.Fatalf("output and truth must be set")
+	}
+	opts := simulate.Opts{
+		Seed:                     *seed,
+		Pairs:                    *pairs,
+		References:               *references,
+		ReferenceLength:          *referenceLength,
+		ReadLength:               *readLength,
+		DuplicationRate:          *duplicationRate,
+		SetSizeMean:              *setSizeMean,
+		SetSizeMax:               *setSizeMax,
+		OpticalFraction:          *opticalFraction,
+		OpticalDistance:          *opticalDistance,
+		InterchromosomalFraction: *interchromosomalFraction,
+		UMILength:                *umiLength,
+		UMIErrorRate:             *umiErrorRate,
+		NameFormat:               *nameFormat,
+		SecondaryFraction:        *secondaryFraction,
+		SupplementaryFraction:    *supplementaryFraction,
+	}
+	if err := opts.Validate(); err != nil {
+		log.Fatal(err)
+	}
+
+	out, err := os.Create(*output)
+	if err != nil {
+		log.Fatal(err)
+	}
+	truthFile, err := os.Create(*truth)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := simulate.Generate(opts, out, truthFile); err != nil {
+		log.Fatal(err)
+	}
+	if err := out.Close(); err != nil {
+		log.Fatal(err)
+	}
+	if err := truthFile.Close(); err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("wrote %d readpairs to %s and their truth to %s", opts.Pairs, *output, *truth)
+}
@@ -6,6 +6,7 @@ require (
 	github.com/Schaudge/grailbase v0.0.0-20240223061707-44c758a471c0
 	github.com/Schaudge/grailbio v0.0.0-20240301093411-9ba24aa9aa62
 	github.com/Schaudge/hts v0.0.0-20240223063651-737b4d69d68c
+	github.com/aws/aws-sdk-go v1.50.29
 	github.com/grailbio/testutil v0.0.3
 	github.com/stretchr/testify v1.8.4
 )
@@ -13,7 +14,6 @@ require (
 require (
 	blainsmith.com/go/seahash v1.2.1 // indirect
 	github.com/DataDog/zstd v1.5.5 // indirect
-	github.com/aws/aws-sdk-go v1.50.29 // indirect
 	github.com/biogo/store v0.0.0-20201120204734-aad293a2328f // indirect
 	github.com/bytedance/sonic v1.11.2 // indirect
 	github.com/chenzhuoyu/base64x v0.0.0-20230717121745-296ad89f973d // indirect
@@ -20,9 +20,17 @@ package main
 */
 
 import (
+	"errors"
 	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"regexp"
 	"runtime"
+	"strconv"
 	"strings"
+	"syscall"
+	"time"
 
 	md "github.com/Schaudge/doppelmark/markduplicates"
 	"github.com/Schaudge/grailbase/grail"
@@ -32,42 +40,145 @@ import (
 	"github.com/Schaudge/grailbio/encoding/bamprovider"
 )
 
+// defaultReadNameRegex selects the built-in read name parsing, the
+// same way picard's READ_NAME_REGEX default does.
+const defaultReadNameRegex = "<optimized capture of last three ':' separated fields as numeric values>"
+
 var (
-	bamFile              = flag.String("bam", "", "Input BAM filename")
 	indexFile            = flag.String("index", "", "Input BAM index filename. By default, set to input BAM filename + .bai")
-	outputPath           = flag.String("output", "", "Output filename")
+	inputOrder           = flag.String("input-order", "", "order of the input BAM, 'coordinate' or 'queryname' for queryname grouped input such as aligner output, which is marked without an index and written in the same order. If empty, it is taken from the SO and GO fields of the header")
+	outputPath           = flag.String("output", "", "Output filename, or - or empty for stdout")
 	format               = flag.String("format", "bam", "Output format. Value is either 'bam' or 'pam'.")
+	outputIndexFormat    = flag.String("output-index-format", "", "format of the index written next to the coordinate sorted BAM output, 'bai', 'csi', or 'none' to skip indexing. By default it is csi if a reference is longer than 2^29, and bai otherwise")
 	metricsFile          = flag.String("metrics", "", "Output metrics file")
+	metricsOnly          = flag.Bool("metrics-only", false, "mark the duplicates and write the metrics, histograms, and reports, but no output BAM or PAM. Much faster when only the duplication rate is needed. Cannot be used with output or duplicates-output")
+	maxDupSetSize        = flag.Int("max-duplicate-set-size", 50000, "most readpairs of a duplicate set that are compared for optical duplicates and the optical histogram. Larger sets are flagged as usual, but only a sample of them is checked for optical duplicates. Use 0 for no limit")
+	dupSetSizeMax        = flag.Int("duplicate-set-size-max", 1000, "largest duplicate set size reported individually in the metrics, larger sets are reported together")
+	metricsFormat        = flag.String("metrics-format", "text", "Format of the metrics file. Value is either 'text' or 'json'.")
+	protectedRegionsBED  = flag.String("protected-regions-bed", "", "BED file of regions, e.g. validated variants, where no evidence is removed: duplicates whose alignment overlaps a region are tagged but not flagged or removed, and are counted as protected duplicates in the metrics")
+	metricsRegionsBED    = flag.String("metrics-regions-bed", "", "BED file of regions of interest, e.g. the capture regions of a panel. If set, the metrics also report duplication for just the reads whose unclipped 5' position, clamped to the reference, is in a region.")
+	regions              = flag.String("regions", "", "process only these regions, a BED file ending with .bed, or comma separated samtools style regions, e.g. chr1:1000-2000,chr2. Requires an indexed input. Mates outside the regions are read through the index, but are not output or counted")
+	insertSizeBins       = flag.String("insert-size-bins", "100,200,300,400,500,600,700,800,900,1000", "comma separated upper bounds of the insert size bins in the metrics, the last bin has no upper bound")
+	perReferenceMetrics  = flag.Bool("per-reference-metrics", false, "add a table of the duplication rate of each reference to the metrics")
+	gcMetrics            = flag.Bool("gc-metrics", false, "add a table of the duplication rate of the templates by GC content, in 5% bins, to the metrics")
+	gcReference          = flag.String("gc-reference", "", "indexed FASTA of the references, from which gc-metrics counts the GC content of the reads whose sequence is '*'")
+	flagstat             = flag.Bool("flagstat", false, "add samtools flagstat style counts of the input and output records to the metrics, and fail if records are lost or added, or flags other than the duplicate flag are changed")
 	highCovFile          = flag.String("high-cov-regions", "", "Output high coverage regions file")
 	tileSizeFile         = flag.String("tile-size", "", "Output width and height of tile to file")
 	scratchDir           = flag.String("scratch-dir", "/tmp", "Directory to put scratch files")
+	s3Endpoint           = flag.String("s3-endpoint", "", "endpoint of the s3:// URLs of the inputs and outputs, e.g. of a MinIO or LocalStack server. By default, the endpoint of the AWS region of the bucket")
+	gcsEndpoint          = flag.String("gcs-endpoint", "", "endpoint of the gs:// URLs of the inputs and outputs, which are signed with the HMAC key in GCS_HMAC_ACCESS_ID and GCS_HMAC_SECRET. By default, the XML API of GCS")
 	parallelism          = flag.Int("parallelism", runtime.NumCPU(), "Number of parallel computations to run during the markdup phase")
+	readParallelism      = flag.Int("read-parallelism", 0, "number of goroutines that read and inflate the shards of the input for the BAM output, 0 for a quarter of GOMAXPROCS")
+	computeParallelism   = flag.Int("compute-parallelism", 0, "number of goroutines that mark the duplicates of the shards for the BAM output, 0 for parallelism")
+	writeParallelism     = flag.Int("write-parallelism", 0, "number of goroutines that compress the shards of the BAM output, 0 for half of GOMAXPROCS")
 	queueLength          = flag.Int("queue-length", runtime.NumCPU()*5, "Number shards to queue while waiting for flush")
+	compressionLevel     = flag.Int("compression-level", -1, "gzip level of the BAM output, from 0 for uncompressed BGZF to 9, or -1 for the default level")
+	compressionThreads   = flag.Int("compression-threads", 1, "number of goroutines that compress each shard of the BAM output")
+	noFlagPatch          = flag.Bool("no-flag-patch", false, "encode every record of the BAM output, instead of patching the duplicate flags of the raw input records when no tags change")
 	shardSize            = flag.Int("shard-size", 5000000, "approx shard size in bytes")
+	targetReadsPerShard  = flag.Int("target-reads-per-shard", 0, "if positive, size the shards to have about this many reads each, estimated from the bai index, instead of by shard-size, so that regions of extreme coverage are split into more shards")
 	maxDepth             = flag.Int("max-depth", 3000000, "maximum coverage depth at a position, set to 0 to disable")
 	minBases             = flag.Int("min-bases", 5000, "minimum number of bases per shard")
 	padding              = flag.Int("clip-padding", 251, "padding in bp, this must be larger than the largest per-read clipping distance")
 	clearExisting        = flag.Bool("clear-existing", false, "clear existing duplicate flag before marking")
+	existingDups         = flag.String("existing-duplicate-handling", "", "what to do with the duplicate flags and tags of the input: 'clear' them (like clear-existing), 'preserve' the flagged reads and only mark the others, or 'union' the old and new flags. If empty, the input is kept as is, unless clear-existing is set")
+	clearTags            = flag.String("clear-tags", "DI,DL,DS,DT,DU", "comma separated aux tags to clear from the input records when clearing existing duplicates")
 	removeDups           = flag.Bool("remove-dups", false, "remove duplicates instead of flagging them")
+	splitOutput          = flag.String("split-output-by-reference", "", "template of the paths of a BAM file per reference to write the output to instead of output, e.g. out/{ref}.bam, with {ref} replaced by the reference name, 'other' for the shortest references beyond split-output-max-files, or 'unmapped'. Reads are in the file of their own reference, so mates may be in different files. Requires coordinate sorted input")
+	splitOutputMaxFiles  = flag.Int("split-output-max-files", 64, "most files written by split-output-by-reference, including the other and unmapped files")
+	duplicatesOutput     = flag.String("duplicates-output", "", "BAM file to write the duplicates removed by remove-dups to, flagged and tagged, with the header of the output. Requires tag-duplicates")
 	tagDups              = flag.Bool("tag-duplicates", false, "tag duplicates as DT:Z:SQ (optical) or DT:Z:LB (pcr), and include DI and DS tags")
+	taggingPolicy        = flag.String("tagging-policy", "", "duplicate tags to write, like picard's TAGGING_POLICY: 'none' for only the duplicate flags, 'optical' for DT:Z:SQ on optical duplicates, or 'all' for the DI, DS, DL, DU and DT tags. If empty, 'all' with tag-duplicates and 'none' otherwise")
+	tagOnly              = flag.Bool("tag-only", false, "group reads into duplicate sets and write the duplicate and MI tags and metrics, but do not set the duplicate flag, e.g. for consensus callers")
+	tagOnlyClearFlags    = flag.Bool("tag-only-clear-flags", false, "with tag-only, make clear-existing also clear the existing duplicate flags instead of keeping them")
 	useUmis              = flag.Bool("use-umis", false, "use Umi information in read names for grouping duplicates")
 	umiFile              = flag.String("umi-file", "", "perform UMI error correction with the known UMIs in this file")
 	scavengeUmis         = flag.Int("scavenge-umis", -1, "scavenge UMIs with at most this edit distance")
+	umiTag               = flag.String("umi-tag", "RX", "group duplicates by the UMIs in this aux tag as well as by position, set to the empty string to disable. A tag holds the UMI of its read, or the R1 and R2 UMIs separated by '-' or '+'. use-umis takes precedence")
+	umiSource            = flag.String("umi-source", "tag", "where to read UMIs from, 'tag' for the umi-tag tag, or 'qname' for the UMI field of 8 field Illumina read names")
+	umiCorrection        = flag.String("umi-correction", "none", "merge UMIs at the same position that differ by sequencing errors: 'none', 'cluster' for UMIs at Hamming distance 1, or 'directional' to merge a UMI with count n only into a UMI at Hamming distance 1 with count at least 2n-1, like umi_tools")
+	umiAllowlist         = flag.String("umi-allowlist", "", "file of the valid UMIs, one per line. UMIs at Hamming distance 1 from exactly one of them are corrected to it")
+	umiUnmatchedPolicy   = flag.String("umi-unmatched-policy", "raw", "what to do with UMIs that do not match umi-allowlist: 'raw' to group them by their value, or 'drop' to group them like reads without UMIs")
+	requireUMI           = flag.Bool("require-umi", false, "exclude reads without UMIs from duplicate sets instead of grouping them under an empty UMI")
+	duplexUMI            = flag.Bool("duplex-umi", false, "group the two strands of duplex molecules by sorting the R1 and R2 UMIs of each readpair, so 'AAA-CCC' and 'CCC-AAA' are one family")
+	emitMITag            = flag.Bool("emit-mi-tag", false, "tag every record of the templates of a duplicate set with the set's molecule ID as MI:i, for consensus callers")
+	duplexMITag          = flag.Bool("duplex-mi-tag", false, "write the MI tags of emit-mi-tag as MI:Z with a /A or /B suffix for the strand of R1")
+	addMateTags          = flag.Bool("add-mate-tags", false, "tag both reads of every readpair with the CIGAR and mapping quality of their mate, as MC:Z and MQ:i")
+	overwriteMateTags    = flag.Bool("overwrite-mate-tags", false, "replace the MC and MQ tags that reads already have with those of add-mate-tags")
+	addMateScoreTag      = flag.Bool("add-mate-score-tag", false, "tag both reads of every readpair with the sum of the base qualities >= 15 of their mate as ms:i, like samtools fixmate -m")
+	cellBarcodeTag       = flag.String("cell-barcode-tag", "", "if non-empty, e.g. 'CB', only group reads with the same cell barcode in this aux tag as duplicates; set umi-tag to 'UB' to also group by UMI")
+	cellMetricsMax       = flag.Int("cell-metrics-max", 0, "if > 0, add a table of the reads and duplicates of this many cell barcodes with the most reads to the metrics")
+	ignoreQCFail         = flag.Bool("ignore-qc-fail", false, "exclude readpairs with a read that failed vendor quality checks (0x200) from duplicate marking")
+	minMAPQForDup        = flag.Int("min-mapq-for-dup", 0, "if > 0, exclude readpairs with a read whose mapping quality is below this from duplicate marking; 1 excludes MAPQ 0 multimappers")
+	filterExpression     = flag.String("filter-expression", "", "if non-empty, an expression like those of samtools view --expr, e.g. 'mapq >= 20 && !flag.qcfail', over the fields and [XX] aux tags of each read; the reads for which it is false are dropped before duplicate marking, and the mates of dropped reads are marked as fragments")
+	defaultLibrary       = flag.String("default-library", "", "library of the read groups without an LB field, and of the reads without a read group; the default is 'Unknown Library'")
+	libraryMapFile       = flag.String("library-map", "", "file of read groups and their libraries, one whitespace separated pair per line, overriding the LB fields of the header")
+	strictTemplates      = flag.Bool("strict-templates", false, "fail on templates with more than two primary records, instead of passing the extra records through unflagged")
+	failOnMateMismatch   = flag.Bool("fail-on-mate-mismatch", false, "fail on records with the same name that are not mates of each other, instead of passing them through unflagged")
+	flagUnmappedMates    = flag.Bool("flag-unmapped-mates", false, "also flag the placed unmapped mates of duplicate reads as duplicates, like picard")
+	flagSecondaryDups    = flag.Bool("flag-secondary-dups", false, "also flag the secondary and supplementary records of duplicate reads as duplicates, even in other shards; this scans the input twice more if there are any")
+	primarySelection     = flag.String("primary-selection", "fileidx", "how to choose the primary of a duplicate set among the templates with the highest primary-scorer score: 'fileidx' for the first in the input, or 'baseq' for the smallest read name, like picard")
+	primaryScorer        = flag.String("primary-scorer", "baseq", "how to score the templates of a duplicate set to choose its primary: 'baseq' for the sum of base qualities >= 15, 'fileidx' to choose the first in the input, 'mapq' for the sum of mapping qualities, 'mapped-length' for the aligned reference length, or 'nm' for the fewest NM edits")
 	separateSingletons   = flag.Bool("separate-singletons", false, "keep singletons separate from pairs, don't bag them together")
+	tagRepresentative    = flag.Bool("tag-representative", false, "also write the DI and DS tags on mate-unmapped reads, so that every duplicate set can be rebuilt by grouping the reads by DI; requires tag-duplicates or tagging-policy all")
 	intDI                = flag.Bool("int-di", false, "use integer formatting for DI tags, sets the maximum number of reads to 2147483647 (use for testing only)")
-	opticalDistance      = flag.Int("optical-distance", 2500, "pixel distance threshold for optical duplicates, use -1 to disable")
+	opticalDistance      = flag.Int("optical-distance", 100, "pixel distance threshold for optical duplicates, like picard's OPTICAL_DUPLICATE_PIXEL_DISTANCE, use -1 to disable. Use 2500 for patterned flowcells.")
+	opticalDistanceMap   = flag.String("optical-distance-map", "", "file of read groups and their optical pixel distances, one whitespace separated pair per line, overriding optical-distance for those read groups")
+	opticalFromPlatform  = flag.Bool("optical-distance-from-platform", false, "use an optical pixel distance of 2500 for the read groups whose @RG PM or PL field names an instrument with patterned flowcells, such as NovaSeq or HiSeq X")
 	diskMateShards       = flag.Int("disk-mate-shards", 0, "number of disk shards to use for distant mate storage, use 0 to keep mates in memory.  A value of 1000 is a reasonable choice when using disk, but will require an increase in file descriptor limit, e.g. 'ulimit -n 2000'.")
+	maxDistantMateMemMB  = flag.Int("max-distant-mate-memory-mb", 0, "memory budget in MB of the distant mates, if disk-mate-shards is 0. If they would exceed it, they are kept in disk shards in scratch-dir instead. Use 0 to always keep them in memory")
+	maxMemoryMB          = flag.Int("max-memory-mb", 0, "memory budget in MB of the buffered shard records, the distant mates and the pending output. When it is reached, no new shards are read until the buffered ones are written, and distant mates beyond half of it are kept in scratch-dir. Use 0 for no budget")
 	emitUnmodifiedFields = flag.Bool("emit-unmodified-fields", false, "Write fields that are not modified. This flag is meaningful only when --format=pam.")
 	strandSpecific       = flag.Bool("strand-specific", false, "mark reads only if their r1 strands match")
 	opticalHistogram     = flag.String("optical-histogram", "", "path to optical distance histogram output file")
+	opticalHistFile      = flag.String("optical-histogram-file", "", "path to a machine readable optical distance histogram output file, with one row per non-empty bin")
+	dupSetReport         = flag.String("duplicate-set-report", "", "path to a tab separated report of the records of each duplicate set, with the DI and DS of its set. Gzip compressed if the path ends with .gz")
+	shardManifest        = flag.String("shard-manifest", "", "path to a tab separated manifest of the shards of coordinate sorted input, with the boundaries, records, duplicates and wall time of each shard")
+	shardManifestInput   = flag.String("shard-manifest-input", "", "path to a shard manifest written by -shard-manifest, whose shards are used instead of generating them, to shard the input like the run that wrote it")
+	hotspotBED           = flag.String("hotspot-bed", "", "path to a BED file of the loci of the duplicate sets larger than hotspot-min-set-size, with their size, library, and whether they are predominantly optical. Overlapping and adjacent loci are merged")
+	hotspotMinSetSize    = flag.Int("hotspot-min-set-size", 100, "smallest duplicate set size, exclusive, written to hotspot-bed")
+	progressInterval     = flag.Duration("progress-interval", time.Minute, "interval at which to log the progress: the shards marked, the records read and written, the current position, the records per second, and an ETA if the input has a BAI index. Use 0 to disable")
+	logLevel             = flag.String("log-level", "", "level of the log messages, off, error, info, or debug, for all the components and as component=level for one of io, shard, distantmates, optical, and metrics, e.g. info,distantmates=debug. If empty, the level of -log")
+	verifyAgainst        = flag.String("verify-against", "", "path to a coordinate sorted BAM of the same reads with their duplicates already marked, e.g. by picard, to compare the duplicate flags of the output with. Logs the agreement of the flags, and the disagreements by duplicate set size and by cause")
+	verifyDisagreements  = flag.String("verify-disagreements", "", "path to a tab separated list of the records whose duplicate flags disagree with verify-against")
+	logFormat            = flag.String("log-format", "text", "format of the log messages, text or json. The json messages have the component, and the shard ID and genomic range of the messages about a shard")
+	opticalScatterFile   = flag.String("optical-scatter", "", "path to output file with the flowcell locations of duplicate readpairs, sampled like the optical histogram")
+	opticalHistFormat    = flag.String("optical-histogram-format", "tsv", "format of the optical-histogram-file, tsv or json")
 	// The default opticalHistogramMax is set to 2000. Experimentally, the runtimes with 2000 seem reasonable, and it will still consider many duplicate pairs.
 	// The histograms looked the same between the full set of duplicate pairs and when capped at 2000.
-	opticalHistogramMax = flag.Int("optical-histogram-max", 2000, "maximum number of bag entries to compare when computing optical histogram. Setting to -1 reports for all bag entries.")
+	opticalHistogramMax        = flag.Int("optical-histogram-max", 2000, "maximum number of bag entries to compare when computing optical histogram. Setting to -1 reports for all bag entries.")
+	opticalHistogramSeed       = flag.Int64("optical-histogram-seed", 0, "seed for sampling bag entries when optical-histogram-max is reached. If 0, the sample depends on the input order.")
+	opticalHistogramMaxDist    = flag.Int("optical-histogram-max-distance", 0, "if > 0, only add distances below this to the optical histogram and count the rest in an overflow row. This is much faster for libraries with large duplicate sets.")
+	opticalDistanceMetric      = flag.String("optical-distance-metric", "", "how to measure the distance between duplicates, 'euclidean' or 'per-axis' (like picard). By default the optical histogram is euclidean and optical duplicate detection is per-axis.")
+	opticalAdjacentTiles       = flag.Bool("optical-adjacent-tiles", false, "also compare duplicates on adjacent tiles when computing the optical histogram, e.g. for patterned flowcells")
+	readNameRegex              = flag.String("read-name-regex", defaultReadNameRegex, "regular expression with three capture groups for tile, x, and y used to parse read names for optical duplicate analysis. Set to the empty string to disable optical duplicate analysis.")
+	maxUnparseableNameFraction = flag.Float64("max-unparseable-name-fraction", 0.01, "maximum fraction of read names that may fail to parse when computing the optical histogram before failing the run")
 )
 
+// bamFileList is the value of -bam, which may be repeated.
+type bamFileList []string
+
+func (l *bamFileList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *bamFileList) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
+var bamFiles bamFileList
+
+func init() {
+	flag.Var(&bamFiles, "bam", "Input BAM filename, or - for stdin. Several coordinate sorted inputs, such as the BAMs of the lanes of a library, are merged as they are read; pass them as a comma separated list or repeat -bam")
+}
+
 func main() {
 	shutdown := grail.Init()
 	defer shutdown()
+	md.RegisterS3(*s3Endpoint)
+	md.RegisterGCS(*gcsEndpoint)
 
 	// Validate parameters.
 	if flag.NArg() > 0 {
@@ -76,55 +187,208 @@ func main() {
 	}
 
 	opts := md.Opts{
-		BamFile:                  *bamFile,
-		IndexFile:                *indexFile,
-		MetricsFile:              *metricsFile,
-		HighCoverageIntervalFile: *highCovFile,
-		TileSizeFile:             *tileSizeFile,
-		Format:                   *format,
-		CoverageMax:              *maxDepth,
-		ShardSize:                *shardSize,
-		MinBases:                 *minBases,
-		Padding:                  *padding,
-		DiskMateShards:           *diskMateShards,
-		ScratchDir:               *scratchDir,
-		Parallelism:              *parallelism,
-		QueueLength:              *queueLength,
-		ClearExisting:            *clearExisting,
-		RemoveDups:               *removeDups,
-		TagDups:                  *tagDups,
-		IntDI:                    *intDI,
-		UseUmis:                  *useUmis,
-		UmiFile:                  *umiFile,
-		ScavengeUmis:             *scavengeUmis,
-		EmitUnmodifiedFields:     *emitUnmodifiedFields,
-		SeparateSingletons:       *separateSingletons,
-		OutputPath:               *outputPath,
-		StrandSpecific:           *strandSpecific,
-		OpticalHistogram:         *opticalHistogram,
-		OpticalHistogramMax:      *opticalHistogramMax,
+		BamFile:                     bamFiles.String(),
+		CommandLine:                 strings.Join(os.Args, " "),
+		IndexFile:                   *indexFile,
+		InputOrder:                  *inputOrder,
+		MetricsFile:                 *metricsFile,
+		MetricsFormat:               *metricsFormat,
+		MetricsRegionsBED:           *metricsRegionsBED,
+		ProtectedRegionsBED:         *protectedRegionsBED,
+		Regions:                     *regions,
+		PerReferenceMetrics:         *perReferenceMetrics,
+		GCMetrics:                   *gcMetrics,
+		GCReference:                 *gcReference,
+		Flagstat:                    *flagstat,
+		DuplicateSetSizeMax:         *dupSetSizeMax,
+		MaxDuplicateSetSize:         *maxDupSetSize,
+		HighCoverageIntervalFile:    *highCovFile,
+		TileSizeFile:                *tileSizeFile,
+		Format:                      *format,
+		CoverageMax:                 *maxDepth,
+		ShardSize:                   *shardSize,
+		TargetReadsPerShard:         *targetReadsPerShard,
+		MinBases:                    *minBases,
+		Padding:                     *padding,
+		DiskMateShards:              *diskMateShards,
+		MaxDistantMateMemoryMB:      *maxDistantMateMemMB,
+		MaxMemoryMB:                 *maxMemoryMB,
+		ScratchDir:                  *scratchDir,
+		Parallelism:                 *parallelism,
+		ReadParallelism:             *readParallelism,
+		ComputeParallelism:          *computeParallelism,
+		WriteParallelism:            *writeParallelism,
+		QueueLength:                 *queueLength,
+		CompressionLevel:            *compressionLevel,
+		Uncompressed:                *compressionLevel == 0,
+		CompressionThreads:          *compressionThreads,
+		NoFlagPatch:                 *noFlagPatch,
+		ClearExisting:               *clearExisting,
+		ExistingDuplicateHandling:   *existingDups,
+		RemoveDups:                  *removeDups,
+		DuplicatesOutput:            *duplicatesOutput,
+		SplitOutputByReference:      *splitOutput,
+		SplitOutputMaxFiles:         *splitOutputMaxFiles,
+		TagDups:                     *tagDups,
+		TaggingPolicy:               *taggingPolicy,
+		TagOnlyMode:                 *tagOnly,
+		TagOnlyClearFlags:           *tagOnlyClearFlags,
+		IntDI:                       *intDI,
+		TagRepresentative:           *tagRepresentative,
+		UseUmis:                     *useUmis,
+		UmiFile:                     *umiFile,
+		ScavengeUmis:                *scavengeUmis,
+		UMITag:                      *umiTag,
+		UMISource:                   *umiSource,
+		UMICorrection:               *umiCorrection,
+		UMIAllowlistFile:            *umiAllowlist,
+		UMIUnmatchedPolicy:          *umiUnmatchedPolicy,
+		RequireUMI:                  *requireUMI,
+		DuplexUMI:                   *duplexUMI,
+		EmitMITag:                   *emitMITag,
+		DuplexMITag:                 *duplexMITag,
+		AddMateTags:                 *addMateTags,
+		OverwriteMateTags:           *overwriteMateTags,
+		AddMateScoreTag:             *addMateScoreTag,
+		CellBarcodeTag:              *cellBarcodeTag,
+		CellMetricsMax:              *cellMetricsMax,
+		FlagSecondaryDups:           *flagSecondaryDups,
+		FlagUnmappedMates:           *flagUnmappedMates,
+		IgnoreQCFail:                *ignoreQCFail,
+		MinMAPQForDup:               *minMAPQForDup,
+		FilterExpression:            *filterExpression,
+		StrictTemplates:             *strictTemplates,
+		FailOnMateMismatch:          *failOnMateMismatch,
+		DefaultLibrary:              *defaultLibrary,
+		LibraryMapFile:              *libraryMapFile,
+		OpticalDistanceMapFile:      *opticalDistanceMap,
+		OpticalDistanceFromPlatform: *opticalFromPlatform,
+		PrimarySelection:            *primarySelection,
+		PrimaryScorer:               *primaryScorer,
+		EmitUnmodifiedFields:        *emitUnmodifiedFields,
+		SeparateSingletons:          *separateSingletons,
+		OutputPath:                  *outputPath,
+		MetricsOnly:                 *metricsOnly,
+		IndexFormat:                 *outputIndexFormat,
+		StrandSpecific:              *strandSpecific,
+		OpticalHistogram:            *opticalHistogram,
+		OpticalHistogramFile:        *opticalHistFile,
+		OpticalHistogramFormat:      *opticalHistFormat,
+		OpticalHistogramMax:         *opticalHistogramMax,
+		OpticalScatterFile:          *opticalScatterFile,
+		DuplicateSetReport:          *dupSetReport,
+		HotspotBED:                  *hotspotBED,
+		HotspotMinSetSize:           *hotspotMinSetSize,
+		ShardManifestFile:           *shardManifest,
+		ShardManifestInput:          *shardManifestInput,
+		ProgressInterval:            *progressInterval,
+		LogLevel:                    *logLevel,
+		LogFormat:                   *logFormat,
+		VerifyAgainst:               *verifyAgainst,
+		VerifyDisagreements:         *verifyDisagreements,
+		OpticalHistogramMaxDistance: *opticalHistogramMaxDist,
+		OpticalHistogramSeed:        *opticalHistogramSeed,
+		OpticalDistanceMetric:       md.DistanceMetric(*opticalDistanceMetric),
+		OpticalAdjacentTiles:        *opticalAdjacentTiles,
+		MaxUnparseableNameFraction:  *maxUnparseableNameFraction,
 	}
 
-	// Create the provider.
-	bamOpts := bamprovider.ProviderOpts{Index: opts.IndexFile}
-	if !opts.EmitUnmodifiedFields {
-		bamOpts.DropFields = []gbam.FieldType{
-			gbam.FieldMapq,
-			gbam.FieldTempLen,
+	opts.ClearTags = []string{}
+	for _, tag := range strings.Split(*clearTags, ",") {
+		if tag = strings.TrimSpace(tag); tag != "" {
+			opts.ClearTags = append(opts.ClearTags, tag)
+		}
+	}
+
+	// The problems of the flags that are parsed here are reported
+	// together with those of opts.Validate.
+	var problems []error
+	if *insertSizeBins != "" {
+		for _, bound := range strings.Split(*insertSizeBins, ",") {
+			b, err := strconv.Atoi(strings.TrimSpace(bound))
+			if err != nil {
+				problems = append(problems, fmt.Errorf("invalid insert-size-bins %q: %v", *insertSizeBins, err))
+				break
+			}
+			opts.InsertSizeBins = append(opts.InsertSizeBins, b)
+		}
+	}
+
+	// Compile the read name regex, if any. An empty regex disables
+	// optical duplicate analysis.
+	disableOptical := *readNameRegex == ""
+	if !disableOptical && *readNameRegex != defaultReadNameRegex {
+		re, err := regexp.Compile(*readNameRegex)
+		if err != nil {
+			problems = append(problems, fmt.Errorf("invalid read-name-regex %q: %v", *readNameRegex, err))
+		} else if re.NumSubexp() != 3 {
+			problems = append(problems, fmt.Errorf("read-name-regex %q must have 3 capture groups for tile, x, and y, found %d",
+				*readNameRegex, re.NumSubexp()))
+		} else {
+			opts.LocationParser = &md.RegexLocationParser{Regex: re}
 		}
 	}
-	provider := bamprovider.NewProvider(*bamFile, bamOpts)
+	if disableOptical {
+		log.Printf("read-name-regex is empty, disabling optical duplicate analysis")
+		opts.OpticalHistogram = ""
+		opts.OpticalHistogramFile = ""
+		opts.OpticalScatterFile = ""
+	}
 
 	// Create optical duplicate detector if necessary.
-	if *opticalDistance >= 0 {
+	if *opticalDistance >= 0 && !disableOptical {
+		opts.OpticalDuplicatePixelDistance = *opticalDistance
 		opts.OpticalDetector = &md.TileOpticalDetector{
 			OpticalDistance: *opticalDistance,
+			DistanceMetric:  opts.OpticalDistanceMetric,
+			LocationParser:  opts.LocationParser,
+		}
+	}
+
+	// Validate the options before reading any input, and report all
+	// their problems at once.
+	if err := opts.Validate(); err != nil {
+		var optsErr *md.OptsError
+		if !errors.As(err, &optsErr) {
+			log.Fatal(err)
 		}
+		problems = append(problems, optsErr.Problems...)
+	}
+	if len(problems) > 0 {
+		log.Fatal(&md.OptsError{Problems: problems})
 	}
 
-	ctx := vcontext.Background()
+	// Create the provider.
+	provider := bamprovider.NewProvider(opts.BamFile, providerOpts(&opts))
+
+	// SIGINT and SIGTERM cancel the marking, which removes the partial
+	// outputs. A second signal terminates doppelmark right away.
+	ctx, stop := signal.NotifyContext(vcontext.Background(), os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-ctx.Done()
+		stop()
+	}()
 	if err := md.SetupAndMark(ctx, provider, &opts); err != nil {
 		log.Fatalf(err.Error())
 	}
 	log.Debug.Printf("exiting")
 }
+
+// providerOpts returns the options of the provider of the input. The
+// mapping qualities and template lengths of a PAM input are not read
+// unless opts.EmitUnmodifiedFields is set, or they are used: the
+// mapping qualities to exclude reads, to choose primaries or to add MQ
+// tags, and both by a filter expression.
+func providerOpts(opts *md.Opts) bamprovider.ProviderOpts {
+	bamOpts := bamprovider.ProviderOpts{Index: opts.IndexFile}
+	if opts.EmitUnmodifiedFields || opts.FilterExpression != "" {
+		return bamOpts
+	}
+	bamOpts.DropFields = []gbam.FieldType{
+		gbam.FieldTempLen,
+	}
+	if opts.MinMAPQForDup == 0 && opts.PrimaryScorer != "mapq" && !opts.AddMateTags {
+		bamOpts.DropFields = append(bamOpts.DropFields, gbam.FieldMapq)
+	}
+	return bamOpts
+}
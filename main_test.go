@@ -0,0 +1,44 @@
+// Copyright 2019 Grail Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"testing"
+
+	md "github.com/Schaudge/doppelmark/markduplicates"
+	gbam "github.com/Schaudge/grailbio/encoding/bam"
+	"github.com/stretchr/testify/assert"
+)
+
+// Test that the fields that the options use are read from the input.
+func TestProviderOpts(t *testing.T) {
+	for _, test := range []struct {
+		name     string
+		opts     md.Opts
+		expected []gbam.FieldType
+	}{
+		{"default", md.Opts{}, []gbam.FieldType{gbam.FieldTempLen, gbam.FieldMapq}},
+		{"emit unmodified fields", md.Opts{EmitUnmodifiedFields: true}, nil},
+		{"min mapq for dup", md.Opts{MinMAPQForDup: 1}, []gbam.FieldType{gbam.FieldTempLen}},
+		{"mapq scorer", md.Opts{PrimaryScorer: "mapq"}, []gbam.FieldType{gbam.FieldTempLen}},
+		{"baseq scorer", md.Opts{PrimaryScorer: "baseq"}, []gbam.FieldType{gbam.FieldTempLen, gbam.FieldMapq}},
+		{"mate tags", md.Opts{AddMateTags: true}, []gbam.FieldType{gbam.FieldTempLen}},
+		{"filter expression", md.Opts{FilterExpression: "mapq >= 20 && tlen < 1000"}, nil},
+	} {
+		test.opts.IndexFile = "input.bam.bai"
+		bamOpts := providerOpts(&test.opts)
+		assert.Equal(t, "input.bam.bai", bamOpts.Index, test.name)
+		assert.Equal(t, test.expected, bamOpts.DropFields, test.name)
+	}
+}
@@ -0,0 +1,137 @@
+// Copyright 2019 Grail Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package markduplicates
+
+import (
+	"context"
+	"strings"
+
+	"github.com/Schaudge/grailbase/errors"
+	"github.com/Schaudge/grailbase/file"
+	gbam "github.com/Schaudge/grailbio/encoding/bam"
+	"github.com/Schaudge/hts/bam"
+	"github.com/Schaudge/hts/bgzf"
+	"github.com/Schaudge/hts/sam"
+)
+
+// With Opts.TargetReadsPerShard, the shards are sized by the density
+// of the reads instead of by Opts.ShardSize, so that a region of
+// extreme coverage, like chrM or an amplification, is split into many
+// shards. The number of reads of each window of adaptiveWindow bases
+// is estimated from the BAI index of the input: the compressed bytes
+// between the linear index offsets of the window and of the next one,
+// divided by the average compressed bytes of a read of the reference.
+// Windows are added to a shard until it has about TargetReadsPerShard
+// reads and at least Opts.MinBases bases. The shards are padded by
+// Opts.Padding like the fixed size shards, so the output is the same;
+// only the work of each shard changes.
+
+// adaptiveWindow is the size of the windows of the linear index of a
+// BAI index, the finest resolution of the estimated read density.
+const adaptiveWindow = 1 << 14
+
+// readIndex reads the BAI index at path.
+func readIndex(ctx context.Context, path string) (index *bam.Index, err error) {
+	if strings.HasSuffix(path, "."+indexFormatCSI) {
+		return nil, errors.E(errors.NotSupported, "target-reads-per-shard requires a BAI index, not", path)
+	}
+	in, err := file.Open(ctx, path)
+	if err != nil {
+		return nil, errors.E(err, "couldn't open index", path)
+	}
+	defer func() {
+		if err2 := in.Close(ctx); err == nil && err2 != nil {
+			err = err2
+		}
+	}()
+	if index, err = bam.ReadIndex(in.Reader(ctx)); err != nil {
+		return nil, errors.E(err, "couldn't read index", path)
+	}
+	return index, nil
+}
+
+// windowReads returns the estimated number of reads that start in each
+// window of ref, from index.
+func windowReads(index *bam.Index, ref *sam.Reference) []float64 {
+	numWindows := (ref.Len() + adaptiveWindow - 1) / adaptiveWindow
+	reads := make([]float64, numWindows)
+	stats, ok := index.ReferenceStats(ref.ID())
+	if !ok || stats.Mapped+stats.Unmapped == 0 {
+		return reads
+	}
+	// offsets[w] is the offset of the first read that overlaps window
+	// w, or of the next window if none does.
+	offsets := make([]bgzf.Offset, numWindows+1)
+	offsets[numWindows] = stats.Chunk.End
+	for w := numWindows - 1; w >= 0; w-- {
+		offsets[w] = offsets[w+1]
+		end := min((w+1)*adaptiveWindow, ref.Len())
+		chunks, err := index.Chunks(ref, w*adaptiveWindow, end)
+		if err != nil {
+			continue
+		}
+		for _, chunk := range chunks {
+			if chunk.Begin.File < offsets[w].File {
+				offsets[w] = chunk.Begin
+			}
+		}
+	}
+	bytes := stats.Chunk.End.File - stats.Chunk.Begin.File
+	if bytes <= 0 {
+		// All the reads are in one BGZF block.
+		reads[0] = float64(stats.Mapped + stats.Unmapped)
+		return reads
+	}
+	bytesPerRead := float64(bytes) / float64(stats.Mapped+stats.Unmapped)
+	for w := range reads {
+		reads[w] = float64(offsets[w+1].File-offsets[w].File) / bytesPerRead
+	}
+	return reads
+}
+
+// adaptiveShards returns the shards of the references of header with
+// about Opts.TargetReadsPerShard reads each, estimated from the index
+// Opts.IndexFile, followed by the unmapped shard.
+func adaptiveShards(ctx context.Context, opts *Opts, header *sam.Header) ([]gbam.Shard, error) {
+	index, err := readIndex(ctx, opts.IndexFile)
+	if err != nil {
+		return nil, err
+	}
+	var shards []gbam.Shard
+	addShard := func(ref *sam.Reference, start, end int) {
+		shards = append(shards, gbam.Shard{
+			StartRef: ref,
+			EndRef:   ref,
+			Start:    start,
+			End:      end,
+			Padding:  opts.Padding,
+			ShardIdx: len(shards),
+		})
+	}
+	for _, ref := range header.Refs() {
+		start := 0
+		var shardReads float64
+		for w, reads := range windowReads(index, ref) {
+			shardReads += reads
+			end := min((w+1)*adaptiveWindow, ref.Len())
+			if shardReads >= float64(opts.TargetReadsPerShard) && end-start >= opts.MinBases && end < ref.Len() {
+				addShard(ref, start, end)
+				start, shardReads = end, 0
+			}
+		}
+		addShard(ref, start, ref.Len())
+	}
+	shardLog.Printf("split the references into %d shards of about %d reads", len(shards), opts.TargetReadsPerShard)
+	return withUnmappedShard(shards, opts.Padding), nil
+}
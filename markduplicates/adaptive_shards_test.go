@@ -0,0 +1,175 @@
+// Copyright 2019 Grail Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package markduplicates
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"path/filepath"
+	"sort"
+	"testing"
+
+	gbam "github.com/Schaudge/grailbio/encoding/bam"
+	"github.com/Schaudge/grailbio/encoding/bamprovider"
+	"github.com/Schaudge/hts/sam"
+	"github.com/grailbio/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+const (
+	// highCoverageStart and highCoverageEnd are the 1Mb region of
+	// ultra-high coverage of highCoverageRecords.
+	highCoverageStart = 2000000
+	highCoverageEnd   = 3000000
+)
+
+// highCoverageRecords returns a readpair every 2000 bases of ref, and
+// densePairs readpairs in [highCoverageStart, highCoverageEnd), many
+// of them duplicates, sorted by position, and an unmapped readpair.
+func highCoverageRecords(ref *sam.Reference, densePairs int) []*sam.Record {
+	rnd := rand.New(rand.NewSource(1))
+	var records []*sam.Record
+	addPair := func(name string, pos int) {
+		matePos := pos + 100 + rnd.Intn(400)
+		records = append(records,
+			NewRecord(name, ref, pos, r1F, matePos, ref, cigar0),
+			NewRecord(name, ref, matePos, r2R, pos, ref, cigar0))
+	}
+	for i := 0; i < ref.Len()/2000; i++ {
+		addPair(fmt.Sprintf("L%d:::1:10:%d:%d", i, rnd.Intn(5000), rnd.Intn(5000)), rnd.Intn(ref.Len()-1000))
+	}
+	for i := 0; i < densePairs; i++ {
+		pos := highCoverageStart + rnd.Intn(highCoverageEnd-highCoverageStart-1000)
+		addPair(fmt.Sprintf("H%d:::1:10:%d:%d", i, rnd.Intn(5000), rnd.Intn(5000)), pos)
+	}
+	sort.SliceStable(records, func(i, j int) bool {
+		return records[i].Pos < records[j].Pos
+	})
+	return append(records,
+		NewRecord("U:::1:10:1:1", nil, -1, up1, -1, nil, nil),
+		NewRecord("U:::1:10:1:1", nil, -1, up2, -1, nil, nil))
+}
+
+// writeHighCoverageBAM writes an indexed BAM of highCoverageRecords to
+// dir, and returns its header and path.
+func writeHighCoverageBAM(tb testing.TB, dir string, densePairs int) (*sam.Header, string) {
+	ref, err := sam.NewReference("chrH", "", "", 5000000, nil, nil)
+	assert.NoError(tb, err)
+	h, err := sam.NewHeader([]byte("@HD\tVN:1.6\tSO:coordinate\n"), []*sam.Reference{ref})
+	assert.NoError(tb, err)
+	path := filepath.Join(dir, fmt.Sprintf("high-coverage-%d.bam", densePairs))
+	records := highCoverageRecords(ref, densePairs)
+	iter := bamprovider.NewFakeProvider(h, records).NewIterator(gbam.UniversalShard(h))
+	assert.NoError(tb, writeIndexedBAM(h, iter, path))
+	return h, path
+}
+
+// markHighCoverage marks the BAM file path, with adaptive shards if
+// targetReads > 0, and returns the output path and the metrics.
+func markHighCoverage(tb testing.TB, path string, targetReads int) (string, *MetricsCollection) {
+	opts := defaultOpts
+	opts.BamFile = path
+	opts.IndexFile = path + ".bai"
+	opts.OutputPath = fmt.Sprintf("%s.out-%d.bam", path, targetReads)
+	opts.Format = "bam"
+	opts.IndexFormat = indexFormatNone
+	opts.ShardSize = 100000
+	opts.Padding = 1000
+	opts.MinBases = 1000
+	opts.Parallelism = 4
+	opts.TargetReadsPerShard = targetReads
+	provider := bamprovider.NewProvider(path, bamprovider.ProviderOpts{Index: opts.IndexFile})
+	defer func() {
+		assert.NoError(tb, provider.Close())
+	}()
+	markDuplicates := &MarkDuplicates{
+		Provider: provider,
+		Opts:     &opts,
+	}
+	metrics, err := markDuplicates.Mark(nil)
+	assert.NoError(tb, err)
+	return opts.OutputPath, metrics
+}
+
+func TestAdaptiveShards(t *testing.T) {
+	tempDir, cleanup := testutil.TempDir(t, "", "")
+	defer cleanup()
+	h, path := writeHighCoverageBAM(t, tempDir, 20000)
+
+	opts := defaultOpts
+	opts.IndexFile = path + ".bai"
+	opts.TargetReadsPerShard = 2000
+	opts.MinBases = 1000
+	shards, err := adaptiveShards(context.Background(), &opts, h)
+	assert.NoError(t, err)
+
+	// The shards cover the reference, and end with the unmapped shard.
+	ref := h.Refs()[0]
+	assert.Nil(t, shards[len(shards)-1].StartRef)
+	start := 0
+	var dense, sparse int
+	for i, shard := range shards[:len(shards)-1] {
+		assert.Equal(t, i, shard.ShardIdx)
+		assert.Equal(t, ref, shard.StartRef)
+		assert.Equal(t, start, shard.Start)
+		assert.Equal(t, 10, shard.Padding)
+		start = shard.End
+		if shard.Start >= highCoverageStart && shard.End <= highCoverageEnd {
+			dense++
+		} else {
+			sparse++
+		}
+	}
+	assert.Equal(t, ref.Len(), start)
+	// The high coverage region has most of the reads, so it is split
+	// into more shards than the rest of the reference.
+	assert.True(t, dense > sparse, "dense %d sparse %d", dense, sparse)
+
+	// The output is the same as with fixed size shards.
+	fixedPath, fixedMetrics := markHighCoverage(t, path, 0)
+	adaptivePath, adaptiveMetrics := markHighCoverage(t, path, 2000)
+	fixed, adaptive := ReadRecords(t, fixedPath), ReadRecords(t, adaptivePath)
+	assert.Equal(t, len(fixed), len(adaptive))
+	for i := range fixed {
+		assert.Equal(t, fixed[i].String(), adaptive[i].String())
+	}
+	assert.Equal(t, *fixedMetrics.LibraryMetrics["Unknown Library"], *adaptiveMetrics.LibraryMetrics["Unknown Library"])
+
+	opts = defaultOpts
+	opts.BamFile = "in.bam"
+	opts.MinBases = 1
+	opts.Format = "bam"
+	opts.ScavengeUmis = -1
+	opts.TargetReadsPerShard = 1000
+	assert.NoError(t, validate(&opts))
+	opts.BamFile = "a.bam,b.bam"
+	assert.Error(t, validate(&opts))
+	opts.BamFile = "in.bam"
+	opts.TargetReadsPerShard = -1
+	assert.Error(t, validate(&opts))
+}
+
+func BenchmarkAdaptiveShards(b *testing.B) {
+	tempDir, cleanup := testutil.TempDir(b, "", "")
+	defer cleanup()
+	_, path := writeHighCoverageBAM(b, tempDir, 500000)
+	for _, targetReads := range []int{0, 20000} {
+		b.Run(fmt.Sprintf("target-reads=%d", targetReads), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				markHighCoverage(b, path, targetReads)
+			}
+		})
+	}
+}
@@ -0,0 +1,113 @@
+// Copyright 2019 Grail Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package markduplicates
+
+import (
+	"context"
+	"io"
+	"runtime"
+
+	"github.com/Schaudge/grailbio/encoding/bamprovider"
+)
+
+// Run marks the duplicates of the BAM stream in, writes the output BAM
+// to out, and returns the metrics. Queryname grouped input is marked
+// as it is read, and coordinate sorted input is read into memory
+// first.
+//
+// Run and RunProvider mark duplicates from Go code, without the
+// doppelmark command: they return errors instead of exiting, return
+// the metrics, and write the BAM output to an io.Writer. Opts.BamFile,
+// Opts.OutputPath, and Opts.IndexFormat are ignored, so the output is
+// not indexed, and the options that the command requires take its
+// defaults if they are not set, see apiOpts. The metrics, histogram,
+// and report files of opts are written if they are set; if none are,
+// and the input is read by Run, nothing is read from or written to the
+// filesystem. They stop with an error wrapping ErrCancelled when ctx
+// is done, see MarkContext. opts is not modified.
+func Run(ctx context.Context, opts *Opts, in io.Reader, out io.Writer) (*MetricsCollection, error) {
+	runOpts := apiOpts(opts)
+	runOpts.BamFile = stdioPath
+	m := &MarkDuplicates{Opts: runOpts, output: out}
+	return m.run(ctx, func() (func(), error) {
+		return m.openStream(in, true)
+	})
+}
+
+// RunProvider is Run, but marks the duplicates of the input of
+// provider. Queryname grouped input is read from the file of provider,
+// which must then be a BAMProvider.
+func RunProvider(ctx context.Context, opts *Opts, provider bamprovider.Provider, out io.Writer) (*MetricsCollection, error) {
+	runOpts := apiOpts(opts)
+	if runOpts.BamFile == "" {
+		// The input is read from provider, but opts must name it.
+		runOpts.BamFile = "provider"
+	}
+	m := &MarkDuplicates{Provider: provider, Opts: runOpts, output: out}
+	return m.run(ctx, func() (func(), error) {
+		return func() {}, nil
+	})
+}
+
+// apiOpts returns a copy of opts for Run and RunProvider, whose output
+// is BAM to a writer. The options that the command requires, and that
+// are not set, take the defaults of the command.
+func apiOpts(opts *Opts) *Opts {
+	runOpts := *opts
+	runOpts.OutputPath = stdioPath
+	runOpts.IndexFormat = indexFormatNone
+	if runOpts.Format == "" {
+		runOpts.Format = "bam"
+	}
+	if runOpts.ShardSize == 0 {
+		runOpts.ShardSize = 5000000
+	}
+	if runOpts.MinBases == 0 {
+		runOpts.MinBases = 5000
+	}
+	if runOpts.Padding == 0 {
+		runOpts.Padding = 251
+	}
+	if runOpts.Parallelism == 0 {
+		runOpts.Parallelism = runtime.NumCPU()
+	}
+	if runOpts.QueueLength == 0 {
+		runOpts.QueueLength = runtime.NumCPU() * 5
+	}
+	return &runOpts
+}
+
+// run prepares m.Opts, opens the input with open, marks the
+// duplicates, and writes the metrics files.
+func (m *MarkDuplicates) run(ctx context.Context, open func() (cleanup func(), err error)) (*MetricsCollection, error) {
+	if err := cancelled(ctx); err != nil {
+		return nil, err
+	}
+	if err := prepareOpts(ctx, m.Opts); err != nil {
+		return nil, err
+	}
+	cleanup, err := open()
+	if err != nil {
+		return nil, err
+	}
+	defer cleanup()
+	globalMetrics, err := m.MarkContext(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	if err := m.writeMetricsFiles(ctx, globalMetrics); err != nil {
+		return nil, err
+	}
+	return globalMetrics, nil
+}
@@ -0,0 +1,168 @@
+// Copyright 2019 Grail Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package markduplicates_test
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	md "github.com/Schaudge/doppelmark/markduplicates"
+	"github.com/Schaudge/grailbio/encoding/bamprovider"
+	"github.com/Schaudge/hts/bam"
+	"github.com/Schaudge/hts/sam"
+	"github.com/grailbio/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+// apiOpts returns the options of the API tests.
+func apiOpts() *md.Opts {
+	return &md.Opts{
+		ShardSize:    1000,
+		Padding:      10,
+		MinBases:     1,
+		Parallelism:  2,
+		QueueLength:  10,
+		TagDups:      true,
+		ScavengeUmis: -1,
+		Format:       "bam",
+	}
+}
+
+// readBAM returns the records of the BAM data.
+func readBAM(t *testing.T, data []byte) []*sam.Record {
+	reader, err := bam.NewReader(bytes.NewReader(data), 1)
+	assert.NoError(t, err)
+	var records []*sam.Record
+	for {
+		r, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		assert.NoError(t, err)
+		records = append(records, r)
+	}
+	assert.NoError(t, reader.Close())
+	return records
+}
+
+func TestRun(t *testing.T) {
+	tempDir, cleanup := testutil.TempDir(t, "", "")
+	defer cleanup()
+	cigar := []sam.CigarOp{sam.NewCigarOp(sam.CigarMatch, 10)}
+	r1F := sam.Paired | sam.Read1
+	r2R := sam.Paired | sam.Read2 | sam.Reverse
+
+	for _, test := range []struct {
+		hd      string
+		records func(*sam.Reference) []*sam.Record
+	}{
+		{
+			"@HD\tVN:1.6\tSO:coordinate\n",
+			func(ref *sam.Reference) []*sam.Record {
+				return []*sam.Record{
+					md.NewRecord("A:::1:10:1:1", ref, 0, r1F, 100, ref, cigar),
+					md.NewRecord("B:::1:10:1:1", ref, 0, r1F, 100, ref, cigar),
+					md.NewRecord("A:::1:10:1:1", ref, 100, r2R, 0, ref, cigar),
+					md.NewRecord("B:::1:10:1:1", ref, 100, r2R, 0, ref, cigar),
+				}
+			},
+		},
+		{
+			"@HD\tVN:1.6\tSO:queryname\n",
+			func(ref *sam.Reference) []*sam.Record {
+				return []*sam.Record{
+					md.NewRecord("A:::1:10:1:1", ref, 0, r1F, 100, ref, cigar),
+					md.NewRecord("A:::1:10:1:1", ref, 100, r2R, 0, ref, cigar),
+					md.NewRecord("B:::1:10:1:1", ref, 0, r1F, 100, ref, cigar),
+					md.NewRecord("B:::1:10:1:1", ref, 100, r2R, 0, ref, cigar),
+				}
+			},
+		},
+	} {
+		ref, err := sam.NewReference("chr1", "", "", 1000, nil, nil)
+		assert.NoError(t, err)
+		h, err := sam.NewHeader([]byte(test.hd), []*sam.Reference{ref})
+		assert.NoError(t, err)
+		records := test.records(ref)
+
+		// The input and the output are in memory.
+		var in bytes.Buffer
+		writer, err := bam.NewWriter(&in, h, 1)
+		assert.NoError(t, err)
+		for _, r := range records {
+			assert.NoError(t, writer.Write(r))
+		}
+		assert.NoError(t, writer.Close())
+		data := append([]byte(nil), in.Bytes()...)
+
+		opts := apiOpts()
+		var out bytes.Buffer
+		metrics, err := md.Run(context.Background(), opts, &in, &out)
+		assert.NoError(t, err, "header %q", test.hd)
+		assert.Equal(t, "", opts.OutputPath, "opts are not modified")
+
+		output := readBAM(t, out.Bytes())
+		assert.Equal(t, len(records), len(output), "header %q", test.hd)
+		for _, r := range output {
+			assert.Equal(t, r.Name[0] == 'B', (r.Flags&sam.Duplicate) != 0, "record %v", r)
+		}
+		lib := metrics.LibraryMetrics["Unknown Library"]
+		assert.Equal(t, 4, lib.ReadPairsExamined, "header %q", test.hd)
+		assert.Equal(t, 2, lib.ReadPairDups, "header %q", test.hd)
+
+		// The input can also be a provider, whose queryname grouped
+		// input is read from its file.
+		provider := bamprovider.NewFakeProvider(h, test.records(ref))
+		if h.SortOrder == sam.QueryName {
+			path := filepath.Join(tempDir, "queryname.bam")
+			assert.NoError(t, ioutil.WriteFile(path, data, 0644))
+			provider = bamprovider.NewProvider(path)
+		}
+		out.Reset()
+		metrics, err = md.RunProvider(context.Background(), opts, provider, &out)
+		assert.NoError(t, err, "header %q", test.hd)
+		assert.Equal(t, len(records), len(readBAM(t, out.Bytes())), "header %q", test.hd)
+		assert.Equal(t, 2, metrics.LibraryMetrics["Unknown Library"].ReadPairDups, "header %q", test.hd)
+	}
+
+	// The options that are not set take their defaults.
+	ref, err := sam.NewReference("chr1", "", "", 1000, nil, nil)
+	assert.NoError(t, err)
+	h, err := sam.NewHeader([]byte("@HD\tVN:1.6\tSO:coordinate\n"), []*sam.Reference{ref})
+	assert.NoError(t, err)
+	var in bytes.Buffer
+	writer, err := bam.NewWriter(&in, h, 1)
+	assert.NoError(t, err)
+	assert.NoError(t, writer.Close())
+	var out bytes.Buffer
+	_, err = md.Run(context.Background(), &md.Opts{}, &in, &out)
+	assert.NoError(t, err)
+	assert.Empty(t, readBAM(t, out.Bytes()))
+
+	// Errors are returned.
+	opts := apiOpts()
+	opts.ShardSize = -1
+	_, err = md.Run(context.Background(), opts, bytes.NewReader(nil), ioutil.Discard)
+	assert.Error(t, err)
+	_, err = md.Run(context.Background(), apiOpts(), bytes.NewReader([]byte("not a bam")), ioutil.Discard)
+	assert.Error(t, err)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = md.Run(ctx, apiOpts(), bytes.NewReader(nil), ioutil.Discard)
+	assert.Error(t, err)
+}
@@ -0,0 +1,59 @@
+// Copyright 2019 Grail Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package markduplicates
+
+import (
+	"context"
+
+	"github.com/Schaudge/grailbase/errors"
+	"github.com/Schaudge/grailbio/encoding/bam"
+	"github.com/Schaudge/hts/sam"
+)
+
+// MarkContext stops when its context is done, e.g. when the doppelmark
+// command gets SIGINT or SIGTERM: the scans of the input check the
+// context every cancelCheckInterval records, and the workers check it
+// before each shard. The shards that are not processed yet are written
+// empty, the outputs are closed and removed, and MarkContext returns an
+// error wrapping ErrCancelled, so no truncated output is left behind.
+
+// cancelCheckInterval is the number of records between the checks of
+// the context while a shard is scanned.
+const cancelCheckInterval = 1000
+
+// cancelled returns an error wrapping ErrCancelled if ctx is done, and
+// nil otherwise.
+func cancelled(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return errors.E(errors.Canceled, ErrCancelled, err.Error())
+	}
+	return nil
+}
+
+// cancelCheck is a bampair.RecordProcessor that stops the scan of
+// bampair.GetDistantMates when ctx is done.
+type cancelCheck struct {
+	ctx     context.Context
+	records int
+}
+
+func (c *cancelCheck) Process(_ bam.Shard, _ *sam.Record) error {
+	c.records++
+	if c.records%cancelCheckInterval != 0 {
+		return nil
+	}
+	return cancelled(c.ctx)
+}
+
+func (c *cancelCheck) Close(_ bam.Shard) {}
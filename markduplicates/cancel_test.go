@@ -0,0 +1,114 @@
+// Copyright 2019 Grail Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package markduplicates
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"os"
+	"sort"
+	"sync/atomic"
+	"testing"
+
+	gbam "github.com/Schaudge/grailbio/encoding/bam"
+	"github.com/Schaudge/grailbio/encoding/bamprovider"
+	"github.com/Schaudge/hts/sam"
+	"github.com/grailbio/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+// cancelProvider is a provider that calls cancel once its iterators
+// have read cancelAfter records.
+type cancelProvider struct {
+	bamprovider.Provider
+	cancel      func()
+	cancelAfter int64
+	records     int64
+}
+
+func (p *cancelProvider) NewIterator(shard gbam.Shard) bamprovider.Iterator {
+	return &cancelIterator{Iterator: p.Provider.NewIterator(shard), provider: p}
+}
+
+type cancelIterator struct {
+	bamprovider.Iterator
+	provider *cancelProvider
+}
+
+func (it *cancelIterator) Scan() bool {
+	if atomic.AddInt64(&it.provider.records, 1) == it.provider.cancelAfter {
+		it.provider.cancel()
+	}
+	return it.Iterator.Scan()
+}
+
+func TestCancel(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	var records []*sam.Record
+	for i := 0; i < 2000; i++ {
+		name := fmt.Sprintf("T%d:::1:10:%d:%d", i, rnd.Intn(5000), rnd.Intn(5000))
+		pos := rnd.Intn(chr1.Len() - 100)
+		records = append(records,
+			NewRecord(name, chr1, pos, r1F, pos+50, chr1, cigar0),
+			NewRecord(name, chr1, pos+50, r2R, pos, chr1, cigar0))
+	}
+	sort.SliceStable(records, func(i, j int) bool {
+		return records[i].Pos < records[j].Pos
+	})
+
+	tempDir, cleanup := testutil.TempDir(t, "", "")
+	defer cleanup()
+	testIdx := 0
+	// The input is cancelled while the distant mates are scanned, and
+	// while the shards are marked.
+	for _, cancelAfter := range []int{100, 3 * len(records) / 2} {
+		for _, format := range []string{"bam", "pam"} {
+			opts := defaultOpts
+			opts.OutputPath = NewTestOutput(tempDir, testIdx, format)
+			opts.Format = format
+			testIdx++
+			ctx, cancel := context.WithCancel(context.Background())
+			markDuplicates := &MarkDuplicates{
+				Provider: &cancelProvider{
+					Provider:    bamprovider.NewFakeProvider(header, records),
+					cancel:      cancel,
+					cancelAfter: int64(cancelAfter),
+				},
+				Opts: &opts,
+			}
+			_, err := markDuplicates.MarkContext(ctx, nil)
+			cancel()
+			assert.ErrorIs(t, err, ErrCancelled, "cancel after %d format %s", cancelAfter, format)
+			assert.ErrorIs(t, err, context.Canceled, "cancel after %d format %s", cancelAfter, format)
+			if format == "bam" {
+				// No partial output is left.
+				_, err = os.Stat(opts.OutputPath)
+				assert.True(t, os.IsNotExist(err), "cancel after %d", cancelAfter)
+			}
+		}
+	}
+
+	// Without cancellation, the same input is marked.
+	opts := defaultOpts
+	opts.OutputPath = NewTestOutput(tempDir, testIdx, "bam")
+	opts.Format = "bam"
+	markDuplicates := &MarkDuplicates{
+		Provider: bamprovider.NewFakeProvider(header, records),
+		Opts:     &opts,
+	}
+	_, err := markDuplicates.MarkContext(context.Background(), nil)
+	assert.NoError(t, err)
+	assert.Equal(t, len(records), len(ReadRecords(t, opts.OutputPath)))
+}
@@ -0,0 +1,117 @@
+// Copyright 2019 Grail Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package markduplicates
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/Schaudge/hts/sam"
+)
+
+// CellMetrics contains the duplication metrics of a cell barcode.
+type CellMetrics struct {
+	// ReadsExamined is the number of primary reads examined.
+	ReadsExamined int64
+
+	// Duplicates is the number of those reads that were marked as
+	// duplicates.
+	Duplicates int64
+}
+
+// Rate returns the fraction of the reads examined that are
+// duplicates.
+func (m *CellMetrics) Rate() float64 {
+	if m.ReadsExamined == 0 {
+		return 0
+	}
+	return float64(m.Duplicates) / float64(m.ReadsExamined)
+}
+
+// cellBarcode returns the cell barcode of r in opts.CellBarcodeTag,
+// or "" if r has none or opts.CellBarcodeTag is not set.
+func cellBarcode(opts *Opts, r *sam.Record) string {
+	if opts.CellBarcodeTag == "" {
+		return ""
+	}
+	aux := r.AuxFields.Get(sam.NewTag(opts.CellBarcodeTag))
+	if aux == nil {
+		return ""
+	}
+	return fmt.Sprint(aux.Value())
+}
+
+// pairCellBarcode returns the cell barcode of the readpair of a and
+// b. Both reads normally have the same barcode; if only one has a
+// barcode, it is used.
+func pairCellBarcode(opts *Opts, a, b *sam.Record) string {
+	if cell := cellBarcode(opts, a); cell != "" {
+		return cell
+	}
+	return cellBarcode(opts, b)
+}
+
+// Cell returns CellMetrics for the given cell barcode. If there is no
+// CellMetrics for the barcode yet, create one and return it.
+func (mc *MetricsCollection) Cell(barcode string) *CellMetrics {
+	m, found := mc.CellMetrics[barcode]
+	if found {
+		return m
+	}
+	m = &CellMetrics{}
+	mc.CellMetrics[barcode] = m
+	return m
+}
+
+// TrimCells removes all but the max cells with the most reads
+// examined from mc.CellMetrics. Ties are broken by barcode.
+func (mc *MetricsCollection) TrimCells(max int) {
+	mc.mutex.Lock()
+	defer mc.mutex.Unlock()
+	if len(mc.CellMetrics) <= max {
+		return
+	}
+	for _, barcode := range sortedCells(mc.CellMetrics)[max:] {
+		delete(mc.CellMetrics, barcode)
+	}
+}
+
+// sortedCells returns the barcodes of cells by decreasing reads
+// examined, and then by barcode.
+func sortedCells(cells map[string]*CellMetrics) []string {
+	barcodes := make([]string, 0, len(cells))
+	for barcode := range cells {
+		barcodes = append(barcodes, barcode)
+	}
+	sort.Slice(barcodes, func(i, j int) bool {
+		a, b := cells[barcodes[i]], cells[barcodes[j]]
+		if a.ReadsExamined != b.ReadsExamined {
+			return a.ReadsExamined > b.ReadsExamined
+		}
+		return barcodes[i] < barcodes[j]
+	})
+	return barcodes
+}
+
+// cellMetricsString returns the per-cell metrics as a tab separated
+// table sorted by decreasing reads examined, the order used for
+// knee-point cell calling.
+func cellMetricsString(cells map[string]*CellMetrics) string {
+	s := "CELL_BARCODE\tREADS_EXAMINED\tDUPLICATES\tPERCENT_DUPLICATION\n"
+	for _, barcode := range sortedCells(cells) {
+		m := cells[barcode]
+		s += fmt.Sprintf("%s\t%d\t%d\t%0.6f\n", barcode, m.ReadsExamined, m.Duplicates, 100*m.Rate())
+	}
+	return s
+}
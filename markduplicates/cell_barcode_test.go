@@ -0,0 +1,124 @@
+// Copyright 2019 Grail Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package markduplicates
+
+import (
+	"testing"
+
+	"github.com/Schaudge/grailbio/encoding/bamprovider"
+	"github.com/Schaudge/hts/sam"
+	"github.com/grailbio/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+// cellBarcodeRecords returns readpairs at the same position. A, B and
+// C are from cell AAAC, and C has a different UB UMI than A and B. D
+// is from cell GGGT, and E and F have no cell barcode.
+func cellBarcodeRecords() []*sam.Record {
+	var records []*sam.Record
+	for _, read := range []struct {
+		flags   sam.Flags
+		pos     int
+		matePos int
+	}{
+		{r1F, 0, 10},
+		{r2R, 10, 0},
+	} {
+		for _, template := range []struct {
+			name, cell, umi string
+		}{
+			{"A:::1:10:1:1", "AAAC", "TTT"},
+			{"B:::1:10:1:1", "AAAC", "TTT"},
+			{"C:::1:10:1:1", "AAAC", "GGG"},
+			{"D:::1:10:1:1", "GGGT", "TTT"},
+			{"E:::1:10:1:1", "", "TTT"},
+			{"F:::1:10:1:1", "", "TTT"},
+		} {
+			r := NewRecordAux(template.name, chr1, read.pos, read.flags, read.matePos, chr1, cigar0,
+				NewAux("UB", template.umi))
+			if template.cell != "" {
+				r.AuxFields = append(r.AuxFields, NewAux("CB", template.cell))
+			}
+			records = append(records, r)
+		}
+	}
+	return records
+}
+
+func TestCellBarcode(t *testing.T) {
+	position := defaultOpts
+	cell := defaultOpts
+	cell.CellBarcodeTag = "CB"
+	cellUMI := cell
+	cellUMI.UMITag = "UB"
+
+	for _, test := range []struct {
+		opts Opts
+		dups []bool
+	}{
+		// Without a cell barcode tag, all readpairs are duplicates of A.
+		{position, []bool{false, true, true, true, true, true}},
+		// D is in another cell, and E and F are in the no-barcode
+		// bucket.
+		{cell, []bool{false, true, true, false, false, true}},
+		// C also has another UMI.
+		{cellUMI, []bool{false, true, false, false, false, true}},
+	} {
+		var trecords []TestRecord
+		for i, r := range cellBarcodeRecords() {
+			trecords = append(trecords, TestRecord{R: r, DupFlag: test.dups[i%len(test.dups)]})
+		}
+		RunTestCases(t, header, []TestCase{{trecords, test.opts}})
+	}
+}
+
+func TestCellMetrics(t *testing.T) {
+	tempDir, cleanup := testutil.TempDir(t, "", "")
+	defer cleanup()
+	for testIdx, format := range []string{"bam", "pam"} {
+		opts := defaultOpts
+		opts.OutputPath = NewTestOutput(tempDir, testIdx, format)
+		opts.Format = format
+		opts.CellBarcodeTag = "CB"
+		opts.CellMetricsMax = 1
+
+		markDuplicates := &MarkDuplicates{
+			Provider: bamprovider.NewFakeProvider(header, cellBarcodeRecords()),
+			Opts:     &opts,
+		}
+		actualMetrics, err := markDuplicates.Mark(nil)
+		assert.NoError(t, err)
+		assert.Equal(t, int64(4), actualMetrics.CellBarcodeMissingReads, "format %s", format)
+		// Cell GGGT has fewer reads than AAAC, so it is trimmed.
+		assert.Equal(t, map[string]*CellMetrics{
+			"AAAC": {ReadsExamined: 6, Duplicates: 4},
+		}, actualMetrics.CellMetrics, "format %s", format)
+		assert.Equal(t, "CELL_BARCODE\tREADS_EXAMINED\tDUPLICATES\tPERCENT_DUPLICATION\n"+
+			"AAAC\t6\t4\t66.666667\n", cellMetricsString(actualMetrics.CellMetrics), "format %s", format)
+	}
+}
+
+func TestTrimCells(t *testing.T) {
+	mc := NewMetricsCollection()
+	mc.Cell("AAAC").ReadsExamined = 2
+	mc.Cell("CCCA").ReadsExamined = 5
+	mc.Cell("GGGT").ReadsExamined = 2
+	mc.Cell("TTTG").ReadsExamined = 1
+	assert.Equal(t, []string{"CCCA", "AAAC", "GGGT", "TTTG"}, sortedCells(mc.CellMetrics))
+
+	mc.TrimCells(2)
+	assert.Equal(t, []string{"CCCA", "AAAC"}, sortedCells(mc.CellMetrics))
+	mc.TrimCells(5)
+	assert.Equal(t, 2, len(mc.CellMetrics))
+}
@@ -0,0 +1,402 @@
+// Copyright 2019 Grail Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package markduplicates
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+	"sync"
+
+	"github.com/Schaudge/grailbase/syncqueue"
+	"github.com/Schaudge/grailbio/encoding/bgzf"
+	"github.com/Schaudge/hts/bam"
+	"github.com/Schaudge/hts/sam"
+)
+
+// The BAM output is written by a bamWriter, which compresses the
+// BGZF blocks of each of its shards with the bamCompressor that adds
+// the shard's records, and writes the shards in the order of their
+// indexes, like the ShardedBAMWriter of grailbio. So a shard of the
+// output can be compressed by several goroutines: its records are
+// split into Opts.CompressionThreads consecutive parts, and part i of
+// shard s is shard s*CompressionThreads+i of the writer, which keeps
+// the records in order. For Opts.Uncompressed, the blocks are stored
+// without compression, which libdeflate cannot do. The writer always
+// ends the output with the BGZF EOF marker block.
+
+// bgzfEOF is the BGZF EOF marker block.
+var bgzfEOF = []byte{
+	0x1f, 0x8b, 0x08, 0x04, 0x00, 0x00, 0x00, 0x00, 0x00, 0xff, 0x06, 0x00, 0x42, 0x43,
+	0x02, 0x00, 0x1b, 0x00, 0x03, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+}
+
+// compressionLevel returns the gzip level of the BAM output:
+// Opts.CompressionLevel, where 0 is the default level, or
+// gzip.NoCompression for Opts.Uncompressed.
+func (o *Opts) compressionLevel() int {
+	if o.Uncompressed {
+		return 0
+	}
+	if o.CompressionLevel == 0 {
+		return -1
+	}
+	return o.CompressionLevel
+}
+
+// compressionThreads returns the number of goroutines that compress
+// each shard of the output, at least 1.
+func (o *Opts) compressionThreads() int {
+	if o.CompressionThreads < 1 {
+		return 1
+	}
+	return o.CompressionThreads
+}
+
+// newBAMWriter returns a bamWriter of the output with
+// Opts.CompressionLevel, whose queue holds Opts.QueueLength shards,
+// and the unmapped shard, that are split into Opts.CompressionThreads
+// parts, see shardWindow.
+func newBAMWriter(opts *Opts, out io.Writer, header *sam.Header) (*bamWriter, error) {
+	w := &bamWriter{
+		w:     out,
+		level: opts.compressionLevel(),
+		queue: syncqueue.NewOrderedQueue((opts.QueueLength + 1) * opts.compressionThreads()),
+	}
+	// The header is shard -1, see bamCompressor.StartShard.
+	c := w.GetCompressor()
+	if err := c.StartShard(-1); err != nil {
+		return nil, err
+	}
+	if err := header.EncodeBinary(c.bgzf); err != nil {
+		return nil, err
+	}
+	if err := c.CloseShard(); err != nil {
+		return nil, err
+	}
+	w.wg.Add(1)
+	go func() {
+		defer w.wg.Done()
+		w.writeShards()
+	}()
+	return w, nil
+}
+
+// bamWriter writes the shards of the BAM output that its
+// bamCompressors compress, in the order of their indexes.
+type bamWriter struct {
+	w     io.Writer
+	level int
+	queue *syncqueue.OrderedQueue
+	wg    sync.WaitGroup
+	err   error
+}
+
+// bamShard is the compressed output of a shard.
+type bamShard struct {
+	buf      bytes.Buffer
+	shardIdx int
+}
+
+// GetCompressor returns a new compressor of the shards of w.
+func (w *bamWriter) GetCompressor() *bamCompressor {
+	return &bamCompressor{writer: w}
+}
+
+// writeShards writes the shards of the queue in order, until the
+// queue is closed.
+func (w *bamWriter) writeShards() {
+	for {
+		entry, ok, err := w.queue.Next()
+		if err != nil {
+			w.err = err
+			return
+		}
+		if !ok {
+			return
+		}
+		if _, err := entry.(*bamShard).buf.WriteTo(w.w); err != nil {
+			w.err = err
+			w.queue.Close(err) // nolint: errcheck
+			return
+		}
+	}
+}
+
+// Close writes the remaining shards, which must all be added, and the
+// BGZF EOF marker block.
+func (w *bamWriter) Close() error {
+	err := w.queue.Close(nil)
+	w.wg.Wait()
+	if w.err != nil {
+		return w.err
+	}
+	if err != nil {
+		return err
+	}
+	_, err = w.w.Write(bgzfEOF)
+	return err
+}
+
+// blockWriter writes the BGZF blocks of a shard.
+type blockWriter interface {
+	io.Writer
+	// CloseWithoutTerminator writes the last block of the shard.
+	CloseWithoutTerminator() error
+}
+
+// bamCompressor compresses the records of a shard of a bamWriter.
+type bamCompressor struct {
+	writer *bamWriter
+	shard  *bamShard
+	bgzf   blockWriter
+	buf    bytes.Buffer
+}
+
+// StartShard starts shard shardIdx of the output. The indexes of the
+// shards start at 0; -1 is the header.
+func (c *bamCompressor) StartShard(shardIdx int) error {
+	// The queue starts at 0.
+	c.shard = &bamShard{shardIdx: shardIdx + 1}
+	if c.writer.level == 0 {
+		c.bgzf = &storedBlockWriter{w: &c.shard.buf}
+		return nil
+	}
+	var err error
+	c.bgzf, err = bgzf.NewWriter(&c.shard.buf, c.writer.level)
+	return err
+}
+
+// AddRecord adds r to the current shard.
+func (c *bamCompressor) AddRecord(r *sam.Record) error {
+	if err := bam.Marshal(r, &c.buf); err != nil {
+		return err
+	}
+	_, err := c.buf.WriteTo(c.bgzf)
+	return err
+}
+
+// CloseShard compresses the rest of the current shard, and adds it to
+// the queue of the writer. It blocks while the queue is full.
+func (c *bamCompressor) CloseShard() error {
+	if err := c.bgzf.CloseWithoutTerminator(); err != nil {
+		return err
+	}
+	shard := c.shard
+	c.shard, c.bgzf = nil, nil
+	return c.writer.queue.Insert(shard.shardIdx, shard)
+}
+
+// storedBlockWriter writes BGZF blocks whose deflate payload is a
+// single stored block, without compression.
+type storedBlockWriter struct {
+	w     io.Writer
+	block []byte
+}
+
+// storedBlockOverhead is the size of a stored BGZF block without its
+// data: the gzip header with the BGZF extra field, the stored block
+// header, and the gzip trailer.
+const storedBlockOverhead = 18 + 5 + 8
+
+func (s *storedBlockWriter) Write(p []byte) (int, error) {
+	n := len(p)
+	for len(p) > 0 {
+		m := bgzf.DefaultUncompressedBlockSize - len(s.block)
+		if m > len(p) {
+			m = len(p)
+		}
+		s.block = append(s.block, p[:m]...)
+		p = p[m:]
+		if len(s.block) == bgzf.DefaultUncompressedBlockSize {
+			if err := s.flush(); err != nil {
+				return n - len(p), err
+			}
+		}
+	}
+	return n, nil
+}
+
+// CloseWithoutTerminator implements blockWriter.
+func (s *storedBlockWriter) CloseWithoutTerminator() error {
+	if len(s.block) == 0 {
+		return nil
+	}
+	return s.flush()
+}
+
+// Close writes the last block, and the BGZF end of file marker, as the
+// end of a whole BGZF file.
+func (s *storedBlockWriter) Close() error {
+	if err := s.CloseWithoutTerminator(); err != nil {
+		return err
+	}
+	_, err := s.w.Write(bgzfEOF)
+	return err
+}
+
+// flush writes the pending data as a block.
+func (s *storedBlockWriter) flush() error {
+	size := len(s.block)
+	b := make([]byte, 0, size+storedBlockOverhead)
+	b = append(b, 0x1f, 0x8b, 0x08, 0x04, 0, 0, 0, 0, 0, 0xff, 0x06, 0, 'B', 'C', 0x02, 0)
+	b = appendUint16(b, uint16(size+storedBlockOverhead-1))
+	// BFINAL, and BTYPE 00 for a stored block.
+	b = append(b, 0x01)
+	b = appendUint16(b, uint16(size))
+	b = appendUint16(b, ^uint16(size))
+	b = append(b, s.block...)
+	b = appendUint32(b, crc32.ChecksumIEEE(s.block))
+	b = appendUint32(b, uint32(size))
+	s.block = s.block[:0]
+	_, err := s.w.Write(b)
+	return err
+}
+
+func appendUint16(b []byte, v uint16) []byte {
+	var buf [2]byte
+	binary.LittleEndian.PutUint16(buf[:], v)
+	return append(b, buf[:]...)
+}
+
+func appendUint32(b []byte, v uint32) []byte {
+	var buf [4]byte
+	binary.LittleEndian.PutUint32(buf[:], v)
+	return append(b, buf[:]...)
+}
+
+// recordCompressor compresses the records of the shards of a writer
+// of the pipeline: a shardCompressor, or a splitCompressor for
+// Opts.SplitOutputByReference.
+type recordCompressor interface {
+	startShard(shardIdx int, stream bool) error
+	addRecord(r *sam.Record) error
+	closeShard() error
+}
+
+// shardCompressor compresses the output of the shards of a worker with
+// one bamCompressor per part of a shard.
+type shardCompressor struct {
+	compressors []*bamCompressor
+	shardIdx    int
+	// stream is true if the records of the shard are compressed as
+	// they are added, as a single part.
+	stream  bool
+	records []*sam.Record
+}
+
+// newShardCompressor returns a shardCompressor that compresses the
+// shards of writer with threads goroutines.
+func newShardCompressor(writer *bamWriter, threads int) *shardCompressor {
+	c := &shardCompressor{compressors: make([]*bamCompressor, threads)}
+	for i := range c.compressors {
+		c.compressors[i] = writer.GetCompressor()
+	}
+	return c
+}
+
+// startShard starts the output of shardIdx. If stream is true, or
+// there is a single compression thread, the records are compressed as
+// they are added, so that they are not held in memory, as for the
+// unmapped shard.
+func (c *shardCompressor) startShard(shardIdx int, stream bool) error {
+	c.shardIdx = shardIdx
+	c.stream = stream || len(c.compressors) == 1
+	c.records = c.records[:0]
+	if c.stream {
+		return c.compressors[0].StartShard(c.partIdx(0))
+	}
+	return nil
+}
+
+// partIdx returns the index of the writer shard of part i of the
+// current shard.
+func (c *shardCompressor) partIdx(i int) int {
+	return c.shardIdx*len(c.compressors) + i
+}
+
+// addRecord adds r to the output of the current shard. r is returned
+// to the free pool once it is compressed, and must not be used after
+// addRecord.
+func (c *shardCompressor) addRecord(r *sam.Record) error {
+	checkRecord(r)
+	if c.stream {
+		if err := c.compressors[0].AddRecord(r); err != nil {
+			return err
+		}
+		putRecord(r)
+		return nil
+	}
+	c.records = append(c.records, r)
+	return nil
+}
+
+// closeShard compresses the parts of the current shard that are not
+// compressed yet. It blocks while the queue of the writer is full.
+func (c *shardCompressor) closeShard() error {
+	if c.stream {
+		if err := c.compressors[0].CloseShard(); err != nil {
+			return err
+		}
+		// The other parts are empty.
+		for i := 1; i < len(c.compressors); i++ {
+			if err := c.compressors[0].StartShard(c.partIdx(i)); err != nil {
+				return err
+			}
+			if err := c.compressors[0].CloseShard(); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	threads := len(c.compressors)
+	partSize := (len(c.records) + threads - 1) / threads
+	errs := make([]error, threads)
+	var wg sync.WaitGroup
+	for i := 0; i < threads; i++ {
+		start, end := i*partSize, (i+1)*partSize
+		if start > len(c.records) {
+			start = len(c.records)
+		}
+		if end > len(c.records) {
+			end = len(c.records)
+		}
+		wg.Add(1)
+		go func(i int, records []*sam.Record) {
+			defer wg.Done()
+			compressor := c.compressors[i]
+			if errs[i] = compressor.StartShard(c.partIdx(i)); errs[i] != nil {
+				return
+			}
+			for j, r := range records {
+				if errs[i] = compressor.AddRecord(r); errs[i] != nil {
+					return
+				}
+				putRecord(r)
+				records[j] = nil
+			}
+			errs[i] = compressor.CloseShard()
+		}(i, c.records[start:end])
+	}
+	wg.Wait()
+	c.records = c.records[:0]
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,166 @@
+// Copyright 2019 Grail Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package markduplicates
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"path/filepath"
+	"sort"
+	"testing"
+
+	"github.com/Schaudge/grailbio/encoding/bamprovider"
+	"github.com/Schaudge/hts/sam"
+	"github.com/grailbio/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+// compressionRecords returns n readpairs of 100 bases on ref, sorted by
+// position, and an unmapped readpair.
+func compressionRecords(ref *sam.Reference, n int) []*sam.Record {
+	rnd := rand.New(rand.NewSource(1))
+	bases := func() (string, string) {
+		seq, qual := make([]byte, 100), make([]byte, 100)
+		for i := range seq {
+			seq[i] = "ACGT"[rnd.Intn(4)]
+			qual[i] = byte(20 + rnd.Intn(20))
+		}
+		return string(seq), string(qual)
+	}
+	var records []*sam.Record
+	for i := 0; i < n; i++ {
+		pos := rnd.Intn(ref.Len() - 1000)
+		matePos := pos + rnd.Intn(500)
+		name := fmt.Sprintf("T%d:::1:10:%d:%d", i, rnd.Intn(5000), rnd.Intn(5000))
+		seq1, qual1 := bases()
+		seq2, qual2 := bases()
+		records = append(records,
+			NewRecordSeq(name, ref, pos, r1F, matePos, ref, cigar100M, seq1, qual1),
+			NewRecordSeq(name, ref, matePos, r2R, pos, ref, cigar100M, seq2, qual2))
+	}
+	sort.SliceStable(records, func(i, j int) bool {
+		return records[i].Pos < records[j].Pos
+	})
+	return append(records,
+		NewRecord("U:::1:10:1:1", nil, -1, up1, -1, nil, nil),
+		NewRecord("U:::1:10:1:1", nil, -1, up2, -1, nil, nil))
+}
+
+// markCompressed marks records with level and threads, or without
+// compression if uncompressed is true, and returns the output path.
+func markCompressed(tb testing.TB, dir string, h *sam.Header, records []*sam.Record, level, threads int,
+	uncompressed bool) string {
+	opts := defaultOpts
+	opts.ShardSize = 10000
+	opts.Padding = 1000
+	opts.Parallelism = 4
+	opts.OutputPath = filepath.Join(dir, fmt.Sprintf("out-%d-%d-%v.bam", level, threads, uncompressed))
+	opts.Format = "bam"
+	opts.IndexFormat = indexFormatNone
+	opts.CompressionLevel = level
+	opts.CompressionThreads = threads
+	opts.Uncompressed = uncompressed
+	markDuplicates := &MarkDuplicates{
+		Provider: bamprovider.NewFakeProvider(h, records),
+		Opts:     &opts,
+	}
+	_, err := markDuplicates.Mark(nil)
+	assert.NoError(tb, err)
+	return opts.OutputPath
+}
+
+func TestCompression(t *testing.T) {
+	ref, err := sam.NewReference("chrC", "", "", 100000, nil, nil)
+	assert.NoError(t, err)
+	h, err := sam.NewHeader(nil, []*sam.Reference{ref})
+	assert.NoError(t, err)
+
+	tempDir, cleanup := testutil.TempDir(t, "", "")
+	defer cleanup()
+	var expected []*sam.Record
+	sizes := make(map[int]int)
+	var uncompressedSize int
+	// Level -2 stands for uncompressed output.
+	for _, level := range []int{-1, 0, 1, 6, 9, -2} {
+		for _, threads := range []int{1, 4, 16} {
+			uncompressed := level == -2
+			if uncompressed {
+				level = 0
+			}
+			path := markCompressed(t, tempDir, h, compressionRecords(ref, 500), level, threads, uncompressed)
+			data, err := ioutil.ReadFile(path)
+			assert.NoError(t, err)
+			assert.True(t, bytes.HasSuffix(data, bgzfEOF), "level %d threads %d", level, threads)
+			if uncompressed {
+				uncompressedSize = len(data)
+			} else {
+				sizes[level] = len(data)
+			}
+
+			// The records are the same, in the same order.
+			actual := ReadRecords(t, path)
+			if expected == nil {
+				expected = actual
+				continue
+			}
+			assert.Equal(t, len(expected), len(actual), "level %d threads %d", level, threads)
+			for i := range actual {
+				assert.Equal(t, expected[i].String(), actual[i].String(), "level %d threads %d", level, threads)
+			}
+		}
+	}
+	// Level 0 is the default level, and uncompressed output is larger
+	// than the records.
+	assert.Equal(t, sizes[-1], sizes[0])
+	assert.True(t, uncompressedSize > sizes[1], "uncompressed %d, sizes %v", uncompressedSize, sizes)
+	assert.True(t, uncompressedSize > 1000*200, "uncompressed %d", uncompressedSize)
+
+	opts := defaultOpts
+	opts.BamFile = "in.bam"
+	opts.MinBases = 1
+	opts.CompressionLevel = 10
+	assert.Error(t, validate(&opts))
+	opts.CompressionLevel = 6
+	opts.Uncompressed = true
+	assert.Error(t, validate(&opts))
+	opts.CompressionLevel = 0
+	opts.CompressionThreads = -1
+	assert.Error(t, validate(&opts))
+}
+
+func BenchmarkCompression(b *testing.B) {
+	ref, err := sam.NewReference("chrC", "", "", 10000000, nil, nil)
+	assert.NoError(b, err)
+	h, err := sam.NewHeader(nil, []*sam.Reference{ref})
+	assert.NoError(b, err)
+	tempDir, cleanup := testutil.TempDir(b, "", "")
+	defer cleanup()
+
+	const numPairs = 50000
+	for _, level := range []int{1, 6} {
+		for _, threads := range []int{1, 4, 16} {
+			b.Run(fmt.Sprintf("level=%d/threads=%d", level, threads), func(b *testing.B) {
+				b.SetBytes(numPairs * 2 * 200)
+				for i := 0; i < b.N; i++ {
+					b.StopTimer()
+					records := compressionRecords(ref, numPairs)
+					b.StartTimer()
+					markCompressed(b, tempDir, h, records, level, threads, false)
+				}
+			})
+		}
+	}
+}
@@ -0,0 +1,154 @@
+// Copyright 2019 Grail Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package markduplicates
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"sync"
+	"sync/atomic"
+
+	"github.com/Schaudge/grailbase/errors"
+	"github.com/Schaudge/grailbio/encoding/bam"
+	"github.com/Schaudge/grailbio/encoding/bampair"
+	"github.com/Schaudge/grailbio/encoding/bamprovider"
+	"github.com/Schaudge/hts/sam"
+)
+
+// The distant mate table holds the mates of the readpairs whose reads
+// are not in the same padded shard, in memory unless
+// Opts.DiskMateShards is set. With Opts.MaxDistantMateMemoryMB, or
+// Opts.MaxMemoryMB, the input is first scanned to estimate the memory
+// of the table, stopping as soon as it exceeds the budget. If it does,
+// the table is kept in distantMateSpillShards disk shards instead,
+// partitioned by the shard of the mate, so that each partition is read
+// back when its shard is processed. The disk shards are written to a
+// temporary directory in Opts.ScratchDir, which is removed when Mark is
+// done or cancelled. The output is the same either way.
+
+// distantMateSpillShards is the largest number of disk shards of the
+// distant mate table when it exceeds its budget.
+const distantMateSpillShards = 1000
+
+// isDistantMate returns true if r is saved in the distant mate table
+// while shard is scanned: a mapped primary read of shard whose mapped
+// mate is outside the padded shard.
+func isDistantMate(shard *bam.Shard, r *sam.Record) bool {
+	return (r.Flags&(sam.Secondary|sam.Supplementary|sam.Unmapped)) == 0 && !bam.HasNoMappedMate(r) &&
+		shard.RecordInShard(r) && !mateInPaddedShard(shard, r)
+}
+
+// distantMatesExceed scans shards with parallelism goroutines, and
+// returns true as soon as the estimated memory of their distant mates
+// exceeds limit bytes. Otherwise, it returns their estimated memory.
+// It stops with an error if ctx is done.
+func distantMatesExceed(ctx context.Context, provider bamprovider.Provider, shards []bam.Shard, parallelism int,
+	limit int64) (int64, bool, error) {
+	var total int64
+	var exceeded int32
+	shardChannel := make(chan bam.Shard, len(shards))
+	for _, shard := range shards {
+		// The unmapped shard has no distant mates.
+		if shard.StartRef != nil {
+			shardChannel <- shard
+		}
+	}
+	close(shardChannel)
+
+	e := errors.Once{}
+	wg := sync.WaitGroup{}
+	for wi := 0; wi < parallelism; wi++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for shard := range shardChannel {
+				if atomic.LoadInt32(&exceeded) != 0 || e.Err() != nil {
+					return
+				}
+				iter := provider.NewIterator(shard)
+				for n := 0; iter.Scan(); n++ {
+					if n%cancelCheckInterval == 0 {
+						if err := cancelled(ctx); err != nil {
+							e.Set(err)
+							break
+						}
+					}
+					r := iter.Record()
+					if isDistantMate(&shard, r) && atomic.AddInt64(&total, recordBytes(r)) > limit {
+						atomic.StoreInt32(&exceeded, 1)
+						break
+					}
+				}
+				e.Set(iter.Close())
+			}
+		}()
+	}
+	wg.Wait()
+	return atomic.LoadInt64(&total), atomic.LoadInt32(&exceeded) != 0, e.Err()
+}
+
+// distantMatesLimit returns the memory budget in bytes of the distant
+// mate table: Opts.MaxDistantMateMemoryMB, or else half of
+// Opts.MaxMemoryMB, or 0 for no budget.
+func (o *Opts) distantMatesLimit() int64 {
+	if o.MaxDistantMateMemoryMB > 0 {
+		return int64(o.MaxDistantMateMemoryMB) << 20
+	}
+	return int64(o.MaxMemoryMB) << 20 / 2
+}
+
+// setupDistantMates decides whether the distant mate table of
+// m.shardList is kept in memory or on disk, see distantMatesLimit, and
+// accounts the table to m.memory if it is kept in memory. It returns a
+// function that removes the disk shards of a spilled table.
+func (m *MarkDuplicates) setupDistantMates(ctx context.Context) (cleanup func(), err error) {
+	m.diskMateShards, m.mateScratchDir = m.Opts.DiskMateShards, m.Opts.ScratchDir
+	cleanup = func() {}
+	limit := m.Opts.distantMatesLimit()
+	if m.diskMateShards > 0 || limit <= 0 {
+		return cleanup, nil
+	}
+	total, exceeded, err := distantMatesExceed(ctx, m.Provider, m.shardList, m.Opts.Parallelism, limit)
+	if err != nil {
+		return cleanup, err
+	}
+	if !exceeded {
+		m.memory.add(distantMatesMemory, total)
+		return cleanup, nil
+	}
+
+	dir, err := ioutil.TempDir(m.Opts.ScratchDir, "distant-mates")
+	if err != nil {
+		return cleanup, errors.E(err, "couldn't create a directory for the distant mates in", m.Opts.ScratchDir)
+	}
+	m.diskMateShards = min(len(m.shardList), distantMateSpillShards)
+	m.mateScratchDir = dir
+	distantMatesLog.Printf("distant mates exceed %.1f MB, keeping them in %d disk shards in %s",
+		float64(limit)/(1<<20), m.diskMateShards, dir)
+	return func() {
+		if err := os.RemoveAll(dir); err != nil {
+			distantMatesLog.Errorf("couldn't remove %s: %v", dir, err)
+		}
+	}, nil
+}
+
+// distantMatesOpts returns the options of the distant mate table.
+func (m *MarkDuplicates) distantMatesOpts() *bampair.Opts {
+	return &bampair.Opts{
+		Parallelism: m.Opts.Parallelism,
+		DiskShards:  m.diskMateShards,
+		ScratchDir:  m.mateScratchDir,
+	}
+}
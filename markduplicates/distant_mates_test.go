@@ -0,0 +1,117 @@
+// Copyright 2019 Grail Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package markduplicates
+
+import (
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+
+	gbam "github.com/Schaudge/grailbio/encoding/bam"
+	"github.com/Schaudge/grailbio/encoding/bamprovider"
+	"github.com/Schaudge/hts/sam"
+	"github.com/grailbio/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+// distantMateRecords returns n readpairs whose reads are on different
+// references, sorted by position. Every tenth readpair is a duplicate
+// of the one before it.
+func distantMateRecords(ref1, ref2 *sam.Reference, n int) []*sam.Record {
+	rnd := rand.New(rand.NewSource(1))
+	var records []*sam.Record
+	var pos1, pos2 int
+	for i := 0; i < n; i++ {
+		if i%10 != 9 {
+			pos1, pos2 = rnd.Intn(ref1.Len()-100), rnd.Intn(ref2.Len()-100)
+		}
+		name := fmt.Sprintf("T%d:::1:10:%d:%d", i, rnd.Intn(5000), rnd.Intn(5000))
+		records = append(records,
+			NewRecord(name, ref1, pos1, r1F, pos2, ref2, cigar0),
+			NewRecord(name, ref2, pos2, r2R, pos1, ref1, cigar0))
+	}
+	sort.SliceStable(records, func(i, j int) bool {
+		if records[i].Ref.ID() != records[j].Ref.ID() {
+			return records[i].Ref.ID() < records[j].Ref.ID()
+		}
+		return records[i].Pos < records[j].Pos
+	})
+	return records
+}
+
+func TestDistantMateMemory(t *testing.T) {
+	ref1, err := sam.NewReference("chrA", "", "", 1000000, nil, nil)
+	assert.NoError(t, err)
+	ref2, err := sam.NewReference("chrB", "", "", 1000000, nil, nil)
+	assert.NoError(t, err)
+	h, err := sam.NewHeader(nil, []*sam.Reference{ref1, ref2})
+	assert.NoError(t, err)
+
+	tempDir, cleanup := testutil.TempDir(t, "", "")
+	defer cleanup()
+	scratchDir := filepath.Join(tempDir, "scratch")
+	assert.NoError(t, os.Mkdir(scratchDir, 0755))
+
+	var outputs [][]*sam.Record
+	var metrics []*MetricsCollection
+	for testIdx, maxMemoryMB := range []int{0, 1} {
+		opts := defaultOpts
+		opts.OutputPath = NewTestOutput(tempDir, testIdx, "bam")
+		opts.Format = "bam"
+		opts.ShardSize = 10000
+		opts.Padding = 100
+		opts.Parallelism = 4
+		opts.ScratchDir = scratchDir
+		opts.MaxDistantMateMemoryMB = maxMemoryMB
+		markDuplicates := &MarkDuplicates{
+			Provider: bamprovider.NewFakeProvider(h, distantMateRecords(ref1, ref2, 4000)),
+			Opts:     &opts,
+		}
+		// The fake provider has a single shard, without distant mates.
+		shards, err := gbam.GetPositionBasedShards(h, opts.ShardSize, opts.Padding, true)
+		assert.NoError(t, err)
+		m, err := markDuplicates.Mark(shards)
+		assert.NoError(t, err, "max memory %d MB", maxMemoryMB)
+		if maxMemoryMB > 0 {
+			assert.True(t, markDuplicates.diskMateShards > 0)
+		} else {
+			assert.Equal(t, 0, markDuplicates.diskMateShards)
+		}
+		outputs = append(outputs, ReadRecords(t, opts.OutputPath))
+		metrics = append(metrics, m)
+
+		// The disk shards are removed.
+		entries, err := ioutil.ReadDir(scratchDir)
+		assert.NoError(t, err)
+		assert.Empty(t, entries, "max memory %d MB", maxMemoryMB)
+	}
+
+	// The output and the metrics are the same with the mates on disk.
+	assert.Equal(t, len(outputs[0]), len(outputs[1]))
+	for i := range outputs[0] {
+		assert.Equal(t, outputs[0][i].String(), outputs[1][i].String())
+	}
+	assert.Equal(t, *metrics[0].LibraryMetrics["Unknown Library"], *metrics[1].LibraryMetrics["Unknown Library"])
+	assert.True(t, metrics[0].LibraryMetrics["Unknown Library"].ReadPairDups > 0)
+
+	opts := defaultOpts
+	opts.BamFile = "in.bam"
+	opts.MinBases = 1
+	opts.MaxDistantMateMemoryMB = -1
+	assert.Error(t, validate(&opts))
+}
@@ -28,10 +28,24 @@
     3) read direction (orientation)
   are ALL identical.
 
+  The unclipped 5' position is computed like picard's
+  getUnclippedStart and getUnclippedEnd: the alignment start of a
+  forward read minus its leading soft and hard clips, or the last
+  aligned position of a reverse read plus its trailing soft and hard
+  clips. Only the clips next to the read's ends are counted, and
+  insertions and paddings do not move the position, so 5H3I95M at
+  position 100 has an unclipped 5' position of 95.  The clips of a read
+  with more CIGAR operations than BAM can hold are those of the CIGAR
+  in its CG tag, not of its kSmN placeholder CIGAR.
+
   Two pairs P1 and P2 are considered duplicates of each other, if
   isDuplicate(P1.leftRead, P2.leftRead) and isDuplicate(P1.rightRead,
-  P2.rightRead).  Left vs right is determined by the unclipped 5'
-  position of each read in the pair.
+  P2.rightRead).  Left vs right is determined by the reference and
+  unclipped 5' position of each read in the pair, not by which read is
+  R1, so an FF pair is a duplicate of the FF pair with R1 and R2
+  swapped, but never of an RR pair at the same positions.  When both
+  reads are at the same position, the pair is FR whichever read is
+  reverse, like picard.
 
   Mapped pairs vs. Mapped-Unmapped pairs: For some read pairs, both
   reads will be mapped (mapped pairs).  For other read pairs, only one
@@ -53,8 +67,14 @@
   After identifying the duplicates, this tool will select a primary
   pair or read for each set of duplicates.  The primary will be the
   duplicate with the highest score based on the sum of its base
-  qualities.  To break ties, a higher priority is given to reads that
-  appear earlier in the bam input.
+  qualities.  Like picard, the reads without base qualities score 0.
+  To break ties, a higher priority is given to reads that appear
+  earlier in the bam input.
+
+  The file index of a read is its position in the whole input, not in
+  its shard, and the entries of each duplicate set are ordered by file
+  index before the primary is chosen.  So the duplicates do not depend
+  on the shard size or the parallelism.
 
   In choosing a primary, pairs are given priority over mate-unmapped
   reads.  So if a mate-unmapped read is found to be a duplicate of one
@@ -89,6 +109,63 @@
   DT is set on duplicate pairs (not the primary) and mate-unmapped
   reads.  It is set to "SQ" for optical duplicates, and "LB" for all
   other duplicates.
+  In a duplicate set larger than "max-duplicate-set-size", only a
+  sample of that many pairs is checked for optical duplicates, so the
+  other pairs of the set are "LB" duplicates.
+
+  If the caller specifies the "add-mate-tags" parameter, both reads of
+  each pair are also tagged with the CIGAR of their mate as MC, and its
+  mapping quality as MQ.  Mate-unmapped reads are not tagged.  With
+  "add-mate-score-tag", they are tagged with the ms score of their mate,
+  like samtools fixmate -m, for samtools markdup.
+
+  With "hotspot-bed", the loci of the duplicate sets larger than
+  "hotspot-min-set-size" are written to a BED file, with overlapping
+  and adjacent loci merged, to find the loci that drive the
+  duplication.
+
+  With "protected-regions-bed", the duplicates whose alignment
+  overlaps a region of the BED file keep their DI, DS, DL and DT tags,
+  but are not flagged or removed, so that no evidence is lost in those
+  regions.  Each record is checked on its own, so a protected read may
+  have a flagged mate.  They are counted as protected duplicates in the
+  metrics, and still as duplicates in the library metrics.
+
+  With "filter-expression", the reads for which an expression like
+  those of samtools view --expr is false, e.g. "mapq >= 20 &&
+  !flag.qcfail" or "[NM] <= 5", are dropped as they are read: they are
+  neither marked nor written, and are counted as reads removed by the
+  filter expression in the metrics.  The expression is evaluated on
+  each record on its own, so a read may be dropped while its mate is
+  kept; the mate is then marked as a fragment, like a read whose mate
+  is unmapped, but its flags are not changed.  The option cannot be
+  used with "regions".
+
+  With "gc-metrics", the metrics have a table of the duplicate and
+  non-duplicate templates by the GC content of their reads, in 5% bins,
+  to show the PCR bias against high or low GC fragments.  The GC
+  content is counted from the sequences of the reads, or, for the reads
+  whose sequence is "*", from the reference bases under their alignment
+  in the indexed FASTA "gc-reference".  Without it, those templates are
+  counted in a separate "missing" row.
+
+  With "flagstat", the records are counted like samtools flagstat as
+  they are read and as they are written, and the metrics have a table
+  of the total, mapped, paired, proper pair, duplicate, secondary and
+  supplementary records of the input, of the output, and of the records
+  removed by "remove-dups", "filter-expression" or "coverage-max", or
+  written to "duplicates-output".  The run fails, and its outputs are
+  removed, if the input is not the output and the removed records, or
+  if a flag other than the duplicate flag is changed.  It cannot be
+  used with "metrics-only".
+
+  With "split-output-by-reference", the output is written to a BAM
+  file per reference, each with the full header and its own index, and
+  the unmapped reads to an "unmapped" file.  A read is written to the
+  file of its own reference, so the mates of a pair on different
+  references are in different files.  When the header has more
+  references than "split-output-max-files" allows, the shortest ones
+  share an "other" file.  The metrics are those of the whole input.
 
   Implementation:
 
@@ -160,6 +237,18 @@
   deterministic, shard1 and shard2 agree on which read to mark as
   duplicate.
 
+  At the ends of a reference, the 5' position of a read clipped at its
+  first or last base is before 0 or beyond the length of the
+  reference.  The shards place reads by their alignment start, which is
+  always within the reference, so the clip-padding, cut at the ends of
+  the reference, still reaches the duplicates of such reads, and their
+  duplicate keys keep the unclipped position.  The 5' position is only
+  clamped to the reference to place a read in the regions of
+  "metrics-regions-bed".  The distance between the alignment start and
+  the 5' position of every read is checked against the clip-padding,
+  or against the padding of the shards of "shard-manifest-input" if it
+  is smaller, and the run fails if it is exceeded.
+
   Clip-padding and pair-padding serve different purposes.
   Clip-padding is for correctness and must exceed the largest clip
   distance in the input file.  Pair-padding is a memory optization.
@@ -178,5 +267,25 @@
   and when full only allows a worker to insert the shard that the writer
   currently needs.  This ensures that the queue does not grow too long
   when a worker takes a long time to process a particular shard.
+
+  The shards of a run, with the records, duplicates and wall time of
+  each, can be written to a manifest with -shard-manifest, and a
+  manifest can be passed to -shard-manifest-input to shard a later run
+  identically, e.g. to find the shard whose output differs between two
+  versions.
+
+  Remote files:
+
+  The input bam, its index, the output, the duplicates output, the
+  metrics and the histograms may be s3:// or gs:// URLs. The input is
+  read with ranged requests, so it can be sharded through its index
+  without being downloaded first, and the outputs are streamed as
+  multipart uploads, whose sizes are checked when they complete. Failed
+  requests, and reads that fail midway, are retried with backoff. The
+  credentials of s3:// URLs are those of the default AWS chain, and
+  -s3-endpoint sends the requests to another server such as MinIO.
+  gs:// URLs are read and written through the XML API of GCS, with the
+  HMAC key in GCS_HMAC_ACCESS_ID and GCS_HMAC_SECRET. The scratch files
+  and the reports written while the shards are marked stay local.
 */
 package markduplicates
@@ -0,0 +1,134 @@
+// Copyright 2019 Grail Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package markduplicates
+
+import (
+	"bufio"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/Schaudge/grailbase/errors"
+	"github.com/Schaudge/grailbio/encoding/bam"
+	"github.com/Schaudge/hts/sam"
+)
+
+// dupSetReportHeader is the header line of Opts.DuplicateSetReport.
+const dupSetReportHeader = "set_id\tset_size\tqname\tis_representative\tis_optical\tref\tunclipped_pos\torientation\tlibrary\n"
+
+// dupSetReportWriter writes a tab separated row for each record of a
+// duplicate set of more than one template to Opts.DuplicateSetReport,
+// gzip compressed if its path ends with ".gz". set_id is the DI tag of
+// the set, and set_size its DS tag: the number of readpairs of the
+// set, or of mate-unmapped reads if it has no readpairs. unclipped_pos
+// is 0-based. The rows of each set are written as the set is flagged,
+// so the report is not held in memory. It is safe for concurrent use.
+type dupSetReportWriter struct {
+	path  string
+	f     *os.File
+	gz    *gzip.Writer
+	w     *bufio.Writer
+	err   error
+	mutex sync.Mutex
+}
+
+// newDupSetReportWriter creates the report at path and writes its
+// header.
+func newDupSetReportWriter(path string) (*dupSetReportWriter, error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, errors.E(err, "Couldn't create duplicate set report:", path)
+	}
+	s := &dupSetReportWriter{path: path, f: f}
+	var w io.Writer = f
+	if strings.HasSuffix(path, ".gz") {
+		s.gz = gzip.NewWriter(f)
+		w = s.gz
+	}
+	s.w = bufio.NewWriter(w)
+	_, s.err = s.w.WriteString(dupSetReportHeader)
+	return s, nil
+}
+
+// write writes the rows of the records of dupSet that are in shard.
+// optDups are the names of the optical duplicates of dupSet.
+func (s *dupSetReportWriter) write(shard *bam.Shard, readGroups *readGroupTable, dupSet *duplicateSet,
+	optDups map[string]bool, singlesByName, pairsByName map[string]*readPair) {
+	if len(dupSet.pairs)+len(dupSet.singles) < 2 {
+		return
+	}
+	var setID uint64
+	setSize := len(dupSet.pairs)
+	if len(dupSet.pairs) > 0 {
+		setID = pairsByName[dupSet.pairs[0]].leftFileIdx
+	} else {
+		setID = singlesByName[dupSet.singles[0]].leftFileIdx
+		setSize = len(dupSet.singles)
+	}
+
+	var b strings.Builder
+	row := func(r *sam.Record, representative, optical bool) {
+		if !shard.RecordInShard(r) {
+			return
+		}
+		orientation := "F"
+		if bam.IsReversedRead(r) {
+			orientation = "R"
+		}
+		fmt.Fprintf(&b, "%d\t%d\t%s\t%t\t%t\t%s\t%d\t%s\t%s\n", setID, setSize, r.Name, representative, optical,
+			r.Ref.Name(), unclippedFivePrimePosition(r), orientation, readGroups.get(r).library)
+	}
+	for i, qname := range dupSet.pairs {
+		p := pairsByName[qname]
+		row(p.left, i == 0, optDups[qname])
+		row(p.right, i == 0, optDups[qname])
+	}
+	for i, qname := range dupSet.singles {
+		row(singlesByName[qname].left, len(dupSet.pairs) == 0 && i == 0, false)
+	}
+	if b.Len() == 0 {
+		return
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.err == nil {
+		_, s.err = s.w.WriteString(b.String())
+	}
+}
+
+// Close flushes and closes the report, and returns the first error
+// encountered while writing it.
+func (s *dupSetReportWriter) Close() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.err == nil {
+		s.err = s.w.Flush()
+	}
+	if s.gz != nil {
+		if err := s.gz.Close(); s.err == nil {
+			s.err = err
+		}
+	}
+	if err := s.f.Close(); s.err == nil {
+		s.err = err
+	}
+	if s.err != nil {
+		return errors.E(s.err, "error writing to duplicate set report:", s.path)
+	}
+	return nil
+}
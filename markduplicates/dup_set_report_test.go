@@ -0,0 +1,117 @@
+// Copyright 2019 Grail Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package markduplicates
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/Schaudge/grailbio/encoding/bamprovider"
+	"github.com/Schaudge/hts/sam"
+	"github.com/grailbio/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDuplicateSetReport(t *testing.T) {
+	// A, B, and C are duplicates, B an optical duplicate of A or A of
+	// B. E is not a duplicate. S1 and S2 are mate-unmapped duplicates.
+	records := []*sam.Record{
+		NewRecord("A:::1:1101:1:1", chr1, 0, r1F, 100, chr1, cigar0),
+		NewRecord("B:::1:1101:1:10", chr1, 0, r1F, 100, chr1, cigar0),
+		NewRecord("C:::1:1102:1:1", chr1, 0, r1F, 100, chr1, cigar0),
+		NewRecord("A:::1:1101:1:1", chr1, 100, r2R, 0, chr1, cigar0),
+		NewRecord("B:::1:1101:1:10", chr1, 100, r2R, 0, chr1, cigar0),
+		NewRecord("C:::1:1102:1:1", chr1, 100, r2R, 0, chr1, cigar0),
+		NewRecord("E:::1:1103:1:1", chr1, 300, r1F, 400, chr1, cigar0),
+		NewRecord("E:::1:1103:1:1", chr1, 400, r2R, 300, chr1, cigar0),
+		NewRecord("S1:::1:1104:1:1", chr1, 500, s1F, 500, chr1, cigar0),
+		NewRecord("S1:::1:1104:1:1", chr1, 500, u2, 500, chr1, cigar0),
+		NewRecord("S2:::1:1105:1:1", chr1, 500, s1F, 500, chr1, cigar0),
+		NewRecord("S2:::1:1105:1:1", chr1, 500, u2, 500, chr1, cigar0),
+	}
+
+	tempDir, cleanup := testutil.TempDir(t, "", "")
+	defer cleanup()
+	for testIdx, ext := range []string{"tsv", "tsv.gz"} {
+		opts := defaultOpts
+		opts.OutputPath = NewTestOutput(tempDir, testIdx, "bam")
+		opts.Format = "bam"
+		opts.DuplicateSetReport = filepath.Join(tempDir, fmt.Sprintf("report%d.%s", testIdx, ext))
+		markDuplicates := &MarkDuplicates{
+			Provider: bamprovider.NewFakeProvider(header, records),
+			Opts:     &opts,
+		}
+		_, err := markDuplicates.Mark(nil)
+		assert.NoError(t, err, "ext %s", ext)
+
+		f, err := os.Open(opts.DuplicateSetReport)
+		assert.NoError(t, err)
+		var r io.Reader = f
+		if strings.HasSuffix(ext, ".gz") {
+			gz, err := gzip.NewReader(f)
+			assert.NoError(t, err)
+			r = gz
+		}
+		contents, err := ioutil.ReadAll(r)
+		assert.NoError(t, err)
+		assert.NoError(t, f.Close())
+		lines := strings.Split(strings.TrimSuffix(string(contents), "\n"), "\n")
+		assert.Equal(t, strings.TrimSuffix(dupSetReportHeader, "\n"), lines[0])
+		assert.Equal(t, 8, len(lines)-1, "ext %s", ext)
+
+		// Each row agrees with the flags and tags of its record.
+		output := make(map[string]*sam.Record)
+		for _, r := range ReadRecords(t, opts.OutputPath) {
+			if (r.Flags & sam.Unmapped) == 0 {
+				output[fmt.Sprintf("%s/%d", r.Name, unclippedFivePrimePosition(r))] = r
+			}
+		}
+		optical := 0
+		for _, line := range lines[1:] {
+			fields := strings.Split(line, "\t")
+			assert.Equal(t, 9, len(fields), "line %s", line)
+			assert.Equal(t, "chr1", fields[5], "line %s", line)
+			assert.Equal(t, "Unknown Library", fields[8], "line %s", line)
+			record := output[fields[2]+"/"+fields[6]]
+			if !assert.NotNil(t, record, "line %s", line) {
+				continue
+			}
+			assert.Equal(t, (record.Flags&sam.Duplicate) == 0, fields[3] == "true", "line %s", line)
+			if fields[4] == "true" {
+				optical++
+			}
+			if di := record.AuxFields.Get(diTag); di != nil {
+				assert.Equal(t, fmt.Sprint(di.Value()), fields[0], "line %s", line)
+			}
+			if ds := record.AuxFields.Get(dsTag); ds != nil {
+				assert.Equal(t, fmt.Sprint(ds.Value()), fields[1], "line %s", line)
+			}
+			if strings.HasPrefix(fields[2], "S") {
+				assert.Equal(t, "2", fields[1], "line %s", line)
+			} else {
+				assert.Equal(t, "3", fields[1], "line %s", line)
+				_, err := strconv.ParseUint(fields[0], 10, 64)
+				assert.NoError(t, err, "line %s", line)
+			}
+		}
+		assert.Equal(t, 2, optical, "ext %s", ext)
+	}
+}
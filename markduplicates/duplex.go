@@ -0,0 +1,91 @@
+// Copyright 2019 Grail Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package markduplicates
+
+import (
+	"github.com/Schaudge/grailbio/encoding/bam"
+	"github.com/Schaudge/hts/sam"
+)
+
+// readPairUmis returns the R1 and R2 UMIs of p, which may be a
+// single. found is false if a read of p has no UMI.
+func readPairUmis(opts *Opts, p *readPair) (r1Umi, r2Umi string, found bool) {
+	if p.right == nil {
+		return recordUmis(opts, p.left)
+	}
+	r1, r2 := p.left, p.right
+	if (r1.Flags & sam.Read1) == 0 {
+		r1, r2 = r2, r1
+	}
+	r1Umi, _, r1Found := recordUmis(opts, r1)
+	_, r2Umi, r2Found := recordUmis(opts, r2)
+	return r1Umi, r2Umi, r1Found && r2Found
+}
+
+// isBStrand returns true if p is from the B strand of its molecule.
+// With opts.DuplexUMI, the A strand is the one whose R1 UMI sorts
+// before its R2 UMI, which is the order of the UMIs in the duplicate
+// key. Otherwise, or if p does not have both UMIs, the A strand is the
+// one whose R1 is on the forward strand.
+func isBStrand(opts *Opts, p *readPair) bool {
+	if opts.DuplexUMI {
+		r1Umi, r2Umi, found := readPairUmis(opts, p)
+		if found && r1Umi != "" && r2Umi != "" {
+			return r1Umi > r2Umi
+		}
+	}
+	// The strand of R1 is that of the left read, or the opposite of
+	// it if the left read is R2. r1Strand is not used, since it is 0
+	// if the mate flags of the left read do not say the reads point
+	// in opposite directions.
+	if bam.IsRead1(p.left) {
+		return p.left.Strand() < 0
+	}
+	return p.left.Strand() > 0
+}
+
+// addDuplexFamily counts dupSet in the duplex family metrics of mc, if
+// its primary's left read is in shard. A family with one template is
+// a singleton, and a family with more is duplex if it has templates
+// from both strands, and single-strand otherwise.
+func (mc *MetricsCollection) addDuplexFamily(opts *Opts, shard *bam.Shard, dupSet *duplicateSet,
+	singlesByName map[string]*readPair, pairsByName map[string]*readPair) {
+	templates := make([]*readPair, 0, len(dupSet.pairs)+len(dupSet.singles))
+	for _, qname := range dupSet.pairs {
+		templates = append(templates, pairsByName[qname])
+	}
+	for _, qname := range dupSet.singles {
+		templates = append(templates, singlesByName[qname])
+	}
+	if len(templates) == 0 || !templates[0].countedIn(shard) {
+		return
+	}
+	if len(templates) == 1 {
+		mc.SingletonFamilies++
+		return
+	}
+	var a, b bool
+	for _, p := range templates {
+		if isBStrand(opts, p) {
+			b = true
+		} else {
+			a = true
+		}
+	}
+	if a && b {
+		mc.DuplexFamilies++
+	} else {
+		mc.SingleStrandFamilies++
+	}
+}
@@ -16,8 +16,10 @@ package markduplicates
 import (
 	"fmt"
 	"regexp"
+	"sort"
 	"strings"
 
+	"github.com/Schaudge/grailbase/errors"
 	"github.com/Schaudge/grailbase/log"
 	"github.com/Schaudge/grailbio/encoding/bam"
 	"github.com/Schaudge/grailbio/umi"
@@ -27,6 +29,18 @@ import (
 
 var umiRe = regexp.MustCompile(`([ACGTNacgtn]+)\+([ACGTNacgtn]+)`)
 
+// Values of Opts.UMISource.
+const (
+	umiSourceTag   = "tag"
+	umiSourceQname = "qname"
+)
+
+// Values of Opts.PrimarySelection.
+const (
+	primarySelectionFileIdx = "fileidx"
+	primarySelectionBaseQ   = "baseq"
+)
+
 // If the set has any pairs, the primary will be in pairs[0],
 // otherwise, the primary will be in singles[0].  Each name in
 // opticals will also be in pairs.  This is the externally visible
@@ -36,6 +50,10 @@ type duplicateSet struct {
 	singles   []string
 	opticals  []string
 	corrected map[string]string
+	// umiRescued is true if grouping by position alone would have
+	// merged this set into another set, so its primary would have been
+	// a duplicate.
+	umiRescued bool
 }
 
 type DuplicateEntry interface {
@@ -56,8 +74,8 @@ type IndexedSingle struct {
 // ref, pos, and orientation are compared for determining positional
 // duplicates.
 func (s *IndexedSingle) lessThan(other IndexedSingle) bool {
-	sPos := bam.UnclippedFivePrimePosition(s.R)
-	otherPos := bam.UnclippedFivePrimePosition(other.R)
+	sPos := unclippedFivePrimePosition(s.R)
+	otherPos := unclippedFivePrimePosition(other.R)
 	sOrientation := orientationByteSingle(bam.IsReversedRead(s.R))
 	otherOrientation := orientationByteSingle(bam.IsReversedRead(other.R))
 
@@ -82,6 +100,10 @@ func (s IndexedSingle) FileIdx() uint64 {
 type IndexedPair struct {
 	Left  IndexedSingle
 	Right IndexedSingle
+
+	// loc caches the parsed physical location of the pair. It is a
+	// pointer so that all copies of the pair share the cache.
+	loc *locationCache
 }
 
 func (p IndexedPair) Name() string {
@@ -100,6 +122,23 @@ func (p IndexedPair) FileIdx() uint64 {
 	return p.Left.FileIdx_
 }
 
+// location returns the physical location of p, parsed from p's name
+// with parser as in parseLocation. If p was created with a cache, the
+// name is parsed at most once with the parser of the first call; the
+// other parsers, e.g. of a TileOpticalDetector that differs from
+// Opts.LocationParser, parse it on every call.
+func (p IndexedPair) location(parser LocationParser) (PhysicalLocation, error) {
+	if p.loc == nil || (p.loc.parsed && !sameParser(p.loc.parser, parser)) {
+		return parseLocation(parser, p.Name())
+	}
+	if !p.loc.parsed {
+		p.loc.location, p.loc.err = parseLocation(parser, p.Name())
+		p.loc.parser = parser
+		p.loc.parsed = true
+	}
+	return p.loc.location, p.loc.err
+}
+
 func (p IndexedPair) GetR1R2() (r1 *sam.Record, r2 *sam.Record) {
 	if bam.IsRead1(p.Left.R) {
 		return p.Left.R, p.Right.R
@@ -108,9 +147,10 @@ func (p IndexedPair) GetR1R2() (r1 *sam.Record, r2 *sam.Record) {
 }
 
 type IntermediateDuplicateSet struct {
-	Pairs     []DuplicateEntry
-	Singles   []DuplicateEntry
-	Corrected map[string]string // Maps read name to corrected UMI pair: "GAC+GAG"
+	Pairs        []DuplicateEntry
+	Singles      []DuplicateEntry
+	Corrected    map[string]string // Maps read name to corrected UMI pair: "GAC+GAG"
+	RescuedByUmi bool              // True if only a distinct UMI separates this set from another.
 }
 
 type umiKey struct {
@@ -120,17 +160,61 @@ type umiKey struct {
 	rightPos    int
 	Orientation Orientation
 	Strand      strand
+	cell        string
+	library     string
 	leftUmi     string
 	rightUmi    string
+	// missing is true for entries without UMIs when opts.RequireUMI
+	// is set. They are not grouped with other entries.
+	missing bool
 }
 
 func (k *umiKey) isSingle() bool {
 	return k.Orientation == f || k.Orientation == r
 }
 
+// position returns the duplicateKey of k, without the UMIs.
+func (k *umiKey) position() duplicateKey {
+	return duplicateKey{k.leftRefId, k.leftPos, k.rightRefId, k.rightPos, k.Orientation, k.Strand, k.cell, k.library}
+}
+
+// less orders umiKeys at the same position by UMI.
+func (k *umiKey) less(other *umiKey) bool {
+	if k.leftUmi != other.leftUmi {
+		return k.leftUmi < other.leftUmi
+	}
+	if k.rightUmi != other.rightUmi {
+		return k.rightUmi < other.rightUmi
+	}
+	return !k.missing && other.missing
+}
+
+// sortedUmiKeys returns the keys of groups ordered by position, and
+// then by UMI.
+func sortedUmiKeys(groups map[umiKey][]DuplicateEntry) []umiKey {
+	keys := make([]umiKey, 0, len(groups))
+	for k := range groups {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		a, b := keys[i].position(), keys[j].position()
+		if a != b {
+			return a.less(&b)
+		}
+		return keys[i].less(&keys[j])
+	})
+	return keys
+}
+
+// isSplit returns true if the entries of k are each put in their own
+// set, because one of its UMIs contains N or is missing.
+func (k *umiKey) isSplit() bool {
+	return k.missing || strings.ContainsAny(k.leftUmi, "Nn") || strings.ContainsAny(k.rightUmi, "Nn")
+}
+
 func (k *umiKey) distance(other *umiKey) int {
 	if k.isSingle() != other.isSingle() {
-		log.Fatalf("Compared single key with pair key %v %v", k, other)
+		panic(fmt.Sprintf("compared single key with pair key %v %v", k, other))
 	}
 	dist := 0
 	if len(k.leftUmi) > 0 {
@@ -145,11 +229,15 @@ func (k *umiKey) distance(other *umiKey) int {
 // duplicateIndex contains the logic used to resolve duplicates.
 type duplicateIndex struct {
 	worker           int
-	entries          map[duplicateKey][]DuplicateEntry
+	entries          *duplicateEntries
 	readGroupLibrary map[string]string
+	readGroups       *readGroupTable
+	noLocationRGs    map[string]bool
 	queue            []*duplicateSet
 	umiCorrector     *umi.SnapCorrector
+	umiAllowlist     *umiAllowlist
 	opts             *Opts
+	scatter          *opticalScatterWriter
 	bagProcessors    []BagProcessor
 	startedRemoving  bool
 }
@@ -162,15 +250,23 @@ func newDuplicateIndex(
 	worker int,
 	header *sam.Header,
 	readGroupLibrary map[string]string,
+	readGroups *readGroupTable,
+	noLocationRGs map[string]bool,
 	opts *Opts,
-	umiCorrector *umi.SnapCorrector) *duplicateIndex {
+	umiCorrector *umi.SnapCorrector,
+	umiAllowlist *umiAllowlist,
+	scatter *opticalScatterWriter) *duplicateIndex {
 	di := &duplicateIndex{
 		worker:           worker,
-		entries:          make(map[duplicateKey][]DuplicateEntry),
+		entries:          newDuplicateEntries(),
 		readGroupLibrary: readGroupLibrary,
+		readGroups:       readGroups,
+		noLocationRGs:    noLocationRGs,
 		queue:            make([]*duplicateSet, 0),
 		umiCorrector:     umiCorrector,
+		umiAllowlist:     umiAllowlist,
 		opts:             opts,
+		scatter:          scatter,
 	}
 
 	for i := range opts.BagProcessorFactories {
@@ -182,49 +278,94 @@ func newDuplicateIndex(
 // insert a record that is mate-unmapped, sometimes called a singleton.
 func (d *duplicateIndex) insertSingleton(r *sam.Record, fileIdx uint64) {
 	if d.startedRemoving {
-		log.Fatalf("cannot insert after started removing")
+		panic("cannot insert after started removing")
 	}
 
-	fivePosition := bam.UnclippedFivePrimePosition(r)
+	fivePosition := unclippedFivePrimePosition(r)
 	orientation := orientationByteSingle(bam.IsReversedRead(r))
 	var s strand
 	if d.opts.StrandSpecific {
 		s = r1Strand(r)
 	}
-	key := duplicateKey{r.Ref.ID(), fivePosition, -1, -1, orientation, s}
-	d.entries[key] = append(d.entries[key], IndexedSingle{r, fileIdx})
+	key := duplicateKey{r.Ref.ID(), fivePosition, -1, -1, orientation, s, cellBarcode(d.opts, r),
+		d.readGroups.get(r).library}
+	d.entries.add(key, IndexedSingle{r, fileIdx})
 }
 
 // insert a read pair.  a and b need not be in any particular order;
 // insertPair will order them in a canonical order internally.
 func (d *duplicateIndex) insertPair(a, b *sam.Record, aFileIdx, bFileIdx uint64) {
 	if d.startedRemoving {
-		log.Fatalf("cannot insert after started removing")
+		panic("cannot insert after started removing")
 	}
 
-	aIndexed := IndexedSingle{a, aFileIdx}
-	bIndexed := IndexedSingle{b, bFileIdx}
-	var left, right IndexedSingle
-	if aIndexed.lessThan(bIndexed) {
-		left = IndexedSingle{a, aFileIdx}
-		right = IndexedSingle{b, bFileIdx}
-	} else {
-		left = IndexedSingle{b, bFileIdx}
-		right = IndexedSingle{a, aFileIdx}
-	}
+	left, right := orderPair(IndexedSingle{a, aFileIdx}, IndexedSingle{b, bFileIdx})
 
 	// Update duplicate set.
 	var s strand
 	if d.opts.StrandSpecific {
 		s = r1Strand(a)
 	}
-	key := duplicateKey{
-		left.R.Ref.ID(), bam.UnclippedFivePrimePosition(left.R),
-		right.R.Ref.ID(), bam.UnclippedFivePrimePosition(right.R),
-		orientationBytePair(bam.IsReversedRead(left.R), bam.IsReversedRead(right.R)),
+	key := pairKey(left.R, right.R, s, pairCellBarcode(d.opts, left.R, right.R),
+		d.readGroups.get(left.R).library)
+	d.entries.add(key, IndexedPair{left, right, &locationCache{}})
+}
+
+// orderPair returns the reads a and b of a readpair as its left and
+// right reads, in the order of IndexedSingle.lessThan: by reference ID
+// first, and then by unclipped 5' position. The order depends only on
+// the reads, so a trans readpair, with reads on chr1:100 and chr5:200,
+// has the same left read whichever of them is read first, even when
+// the read on the higher reference has the lower position.
+func orderPair(a, b IndexedSingle) (left, right IndexedSingle) {
+	if a.lessThan(b) {
+		return a, b
+	}
+	return b, a
+}
+
+// pairKey returns the duplicateKey of the readpair with the reads left
+// and right, ordered by orderPair. The key has the reference ID and
+// unclipped 5' position of both reads, so the readpairs of a duplicate
+// set have both reads at the same positions, on the same references
+// for trans readpairs.
+func pairKey(left, right *sam.Record, s strand, cell, library string) duplicateKey {
+	return duplicateKey{
+		left.Ref.ID(), unclippedFivePrimePosition(left),
+		right.Ref.ID(), unclippedFivePrimePosition(right),
+		pairOrientation(left, right),
 		s,
+		cell,
+		library,
 	}
-	d.entries[key] = append(d.entries[key], IndexedPair{left, right})
+}
+
+// pairOrientation returns the canonicalOrientation of the readpair
+// with the reads left and right, ordered by orderPair.
+func pairOrientation(left, right *sam.Record) Orientation {
+	samePosition := left.Ref.ID() == right.Ref.ID() &&
+		unclippedFivePrimePosition(left) == unclippedFivePrimePosition(right)
+	return canonicalOrientation(samePosition, bam.IsReversedRead(left), bam.IsReversedRead(right))
+}
+
+// sortedKeys returns the keys of entries in the order of
+// duplicateKey.less.
+func sortedKeys(entries *duplicateEntries) []duplicateKey {
+	keys := entries.keys()
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i].less(&keys[j])
+	})
+	return keys
+}
+
+// sortByFileIdx sorts entries by file index. The entries of a
+// duplicate set are inserted in the order that a shard reads them,
+// which depends on the shard boundaries, so they are sorted before
+// the set is resolved.
+func sortByFileIdx(entries []DuplicateEntry) {
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].FileIdx() < entries[j].FileIdx()
+	})
 }
 
 func ChoosePrimary(entries []DuplicateEntry) int {
@@ -243,6 +384,39 @@ func ChoosePrimary(entries []DuplicateEntry) int {
 	return bestIndex
 }
 
+// choosePrimary returns the index of the primary of entries, the
+// entry with the highest opts.PairScorer score, or BaseQScorer score
+// if it is nil. With opts.PrimarySelection "baseq", ties are broken by
+// read name like picard, and then always by file index.
+func choosePrimary(opts *Opts, entries []DuplicateEntry) int {
+	scorer := opts.PairScorer
+	if scorer == nil {
+		scorer = BaseQScorer{}
+	}
+	byName := opts.PrimarySelection == primarySelectionBaseQ
+	bestIndex := -1
+	var bestScore int64
+	for i, entry := range entries {
+		currentScore := scoreEntry(scorer, entry)
+		if bestIndex < 0 || currentScore > bestScore {
+			bestIndex, bestScore = i, currentScore
+			continue
+		}
+		if currentScore < bestScore {
+			continue
+		}
+		best := entries[bestIndex]
+		if byName && entry.Name() != best.Name() {
+			if entry.Name() < best.Name() {
+				bestIndex = i
+			}
+		} else if entry.FileIdx() < best.FileIdx() {
+			bestIndex = i
+		}
+	}
+	return bestIndex
+}
+
 // The user should call computeDupSets() after inserting all
 // singletons and pairs with insertSingle() or insertPair(), and
 // before calling nextDupSet().  Do not call insertSingle() or
@@ -254,12 +428,15 @@ func ChoosePrimary(entries []DuplicateEntry) int {
 //       b) exact position matches + exact match umi.
 //     In the future, this may contain matches like fuzzy umi matches.
 //  2) Decides the primary, and computes opticals based on the IntermediateDuplicateSet groups.
+//     If a group has any pairs, the primary is always a pair and all
+//     its singles are duplicates; a single is only the primary of a
+//     group without pairs.
 func (d *duplicateIndex) computeDupSets(metrics *MetricsCollection) {
 	d.startedRemoving = true
 
 	// Create groups according to opts.
 	var groups []*IntermediateDuplicateSet
-	if d.opts.UseUmis {
+	if d.opts.umiGrouping() {
 		groups = d.groupByPositionAndUmi()
 	} else {
 		groups = d.groupByPosition()
@@ -272,11 +449,12 @@ func (d *duplicateIndex) computeDupSets(metrics *MetricsCollection) {
 	// Choose primary & compute opticals.
 	for _, g := range groups {
 		set := duplicateSet{
-			corrected: g.Corrected,
+			corrected:  g.Corrected,
+			umiRescued: g.RescuedByUmi,
 		}
 
 		if len(g.Pairs) > 0 {
-			bestIndex := ChoosePrimary(g.Pairs)
+			bestIndex := choosePrimary(d.opts, g.Pairs)
 			set.pairs = append(set.pairs, g.Pairs[bestIndex].(IndexedPair).Left.R.Name)
 			for i, pair := range g.Pairs {
 				if i != bestIndex {
@@ -286,14 +464,32 @@ func (d *duplicateIndex) computeDupSets(metrics *MetricsCollection) {
 			for _, single := range g.Singles {
 				set.singles = append(set.singles, single.(IndexedSingle).R.Name)
 			}
+			// The optical analysis of a set larger than
+			// Opts.MaxDuplicateSetSize is done on a sample of it.
+			sample, sampleBest := g.Pairs, bestIndex
+			opticalAnalysis := d.opts.OpticalDetector != nil || d.opts.opticalHistogramEnabled() || d.scatter != nil
+			if max := d.opts.MaxDuplicateSetSize; opticalAnalysis && max > 0 && len(g.Pairs) > max {
+				sample, sampleBest = capDuplicateSet(d.opts, g.Pairs, bestIndex)
+				metrics.CappedDuplicateSets++
+				metrics.CappedDuplicatePairs += int64(len(g.Pairs))
+				best := g.Pairs[bestIndex].(IndexedPair).Left.R
+				opticalLog.Printf("capped duplicate set of %d readpairs at %s:%d, the optical duplicates are "+
+					"detected in a sample of %d readpairs", len(g.Pairs), best.Ref.Name(), best.Pos, len(sample))
+			}
 			if d.opts.OpticalDetector != nil {
-				set.opticals = d.opts.OpticalDetector.Detect(d.readGroupLibrary, g.Pairs, bestIndex)
+				if t, ok := d.opts.OpticalDetector.(*TileOpticalDetector); ok {
+					set.opticals = t.detect(d.readGroups, sample, sampleBest)
+				} else {
+					set.opticals = d.opts.OpticalDetector.Detect(d.readGroupLibrary, sample, sampleBest)
+				}
+				addTileMetrics(d.opts, g.Pairs, bestIndex, set.opticals, metrics)
 			}
-			if len(d.opts.OpticalHistogram) > 0 {
-				addOpticalDistances(d.opts, d.readGroupLibrary, g.Pairs, metrics)
+			if d.opts.opticalHistogramEnabled() || d.scatter != nil {
+				addSampledOpticalDistances(d.opts, d.readGroups, d.noLocationRGs, len(g.Pairs), sample,
+					set.opticals, d.scatter, metrics)
 			}
 		} else {
-			bestIndex := ChoosePrimary(g.Singles)
+			bestIndex := choosePrimary(d.opts, g.Singles)
 			set.singles = append(set.singles, g.Singles[bestIndex].(IndexedSingle).R.Name)
 			for i, single := range g.Singles {
 				if i != bestIndex {
@@ -307,11 +503,10 @@ func (d *duplicateIndex) computeDupSets(metrics *MetricsCollection) {
 }
 
 func (d *duplicateIndex) groupByPosition() []*IntermediateDuplicateSet {
-	getDupSingles := func(refId, pos int, orientation Orientation, strand strand) []DuplicateEntry {
-		k := duplicateKey{refId, pos, -1, -1, orientation, strand}
-		singles, ok := d.entries[k]
+	getDupSingles := func(k duplicateKey) []DuplicateEntry {
+		singles, ok := d.entries.get(k)
 		if ok {
-			delete(d.entries, k)
+			d.entries.remove(k)
 			return singles
 		}
 		return []DuplicateEntry{}
@@ -319,28 +514,36 @@ func (d *duplicateIndex) groupByPosition() []*IntermediateDuplicateSet {
 
 	groups := make([]*IntermediateDuplicateSet, 0)
 
-	for k, duplicates := range d.entries {
-		if !k.isSingle() {
+	// A fragment may match the left read of one key and the right read
+	// of another, so the keys are visited in order for the fragment to
+	// always join the same set.
+	keys := sortedKeys(d.entries)
+	for _, k := range keys {
+		duplicates, ok := d.entries.get(k)
+		if ok && !k.isSingle() {
 			singles := make([]DuplicateEntry, 0)
 			if !d.opts.SeparateSingletons {
-				singles = append(getDupSingles(k.leftRefId, k.leftPos, leftOrientation(k.Orientation), k.Strand),
-					getDupSingles(k.rightRefId, k.rightPos, rightOrientation(k.Orientation), k.Strand)...)
+				singles = append(getDupSingles(k.leftFragment()), getDupSingles(k.rightFragment())...)
 			}
+			sortByFileIdx(duplicates)
+			sortByFileIdx(singles)
 
 			groups = append(groups, &IntermediateDuplicateSet{
 				Pairs:   duplicates,
 				Singles: singles,
 			})
-			delete(d.entries, k)
+			d.entries.remove(k)
 		}
 	}
 
-	for k, duplicates := range d.entries {
-		if k.isSingle() {
+	for _, k := range keys {
+		duplicates, ok := d.entries.get(k)
+		if ok && k.isSingle() {
+			sortByFileIdx(duplicates)
 			groups = append(groups, &IntermediateDuplicateSet{
 				Singles: duplicates,
 			})
-			delete(d.entries, k)
+			d.entries.remove(k)
 		}
 	}
 	return groups
@@ -368,15 +571,15 @@ func (d *duplicateIndex) groupByPositionAndUmi() []*IntermediateDuplicateSet {
 			// If there is exactly one knownUmi bag that is within
 			// the scavenge distance, then combine those two bags.
 			if numCloseEnough == 1 {
-				log.Debug.Printf("scavenge success for %v to %v", key, closeEnough)
+				shardLog.Debugf("scavenge success for %v to %v", key, closeEnough)
 				umiToGroup[closeEnough] = append(umiToGroup[closeEnough], umiToGroup[key]...)
 				delete(umiToGroup, key)
 			} else {
 				// Note that this does not attempt to error correct a scavengeCandiate against another scavengeCandiate.
 				// We could add that later if we think it would be helpful.
-				if log.At(log.Debug) {
+				if shardLog.at(log.Debug) {
 					for _, s := range umiToGroup[key] {
-						log.Debug.Printf("could not scavenge %s", s.(IndexedSingle).R.Name)
+						shardLog.Debugf("could not scavenge %s", s.(IndexedSingle).R.Name)
 					}
 				}
 			}
@@ -386,23 +589,30 @@ func (d *duplicateIndex) groupByPositionAndUmi() []*IntermediateDuplicateSet {
 	// For each position-based group, further split pairs and singles by umi.
 	umiToGroup := map[umiKey][]DuplicateEntry{}
 
-	for k, entries := range d.entries {
+	for _, k := range sortedKeys(d.entries) {
+		entries, _ := d.entries.get(k)
 		scavengeCandidates := map[umiKey]bool{}
 		knownUmis := map[umiKey]bool{}
+		positionKeys := map[umiKey]bool{}
 
 		for _, e := range entries {
-			leftUmi, rightUmi, fullyCorrected, correctedSome := d.tryCorrectUmis(e)
+			leftUmi, rightUmi, fullyCorrected, correctedSome, found := d.tryCorrectUmis(e)
 			// If the resulting UMIs are both known umis, then save the corrected umi values.
-			if d.opts.TagDups && fullyCorrected && correctedSome {
-				log.Debug.Printf("snap correcting %s", e.Name())
+			if d.opts.tagDupSets() && fullyCorrected && correctedSome {
+				shardLog.Debugf("snap correcting %s", e.Name())
 			}
 
 			// Put each pair into the duplicate umi map.
 			key := umiKey{k.leftRefId, k.leftPos, k.rightRefId, k.rightPos, k.Orientation,
-				k.Strand, leftUmi, rightUmi}
+				k.Strand, k.cell, k.library, leftUmi, rightUmi, !found && d.opts.RequireUMI}
 			umiToGroup[key] = append(umiToGroup[key], e)
+			positionKeys[key] = true
 
-			// remember which keys were not fully corrected.
+			// remember which keys were not fully corrected. Entries
+			// without UMIs are not scavenged.
+			if !found {
+				continue
+			}
 			if !fullyCorrected {
 				scavengeCandidates[key] = true
 			} else {
@@ -414,11 +624,15 @@ func (d *duplicateIndex) groupByPositionAndUmi() []*IntermediateDuplicateSet {
 			// Attempt to match scavengeCandidates against bags that have known umis.
 			scavenge(scavengeCandidates, knownUmis, umiToGroup)
 		}
-		delete(d.entries, k)
+		if d.opts.UMICorrection == umiCorrectionCluster || d.opts.UMICorrection == umiCorrectionDirectional {
+			clusterUmis(d.opts.UMICorrection, positionKeys, umiToGroup)
+		}
+		d.entries.remove(k)
 	}
 
-	getDupSingles := func(refId, pos int, orientation Orientation, strand strand, umi string) []DuplicateEntry {
-		k := umiKey{refId, pos, -1, -1, orientation, strand, umi, ""}
+	getDupSingles := func(fragment duplicateKey, umi string) []DuplicateEntry {
+		k := umiKey{fragment.leftRefId, fragment.leftPos, -1, -1, fragment.Orientation, fragment.Strand,
+			fragment.cell, fragment.library, umi, "", false}
 		singles, ok := umiToGroup[k]
 		if ok {
 			delete(umiToGroup, k)
@@ -427,12 +641,15 @@ func (d *duplicateIndex) groupByPositionAndUmi() []*IntermediateDuplicateSet {
 	}
 
 	// attach the relevant corrections and return a IntermediateDuplicateSet.
-	createDupSetInternal := func(key umiKey, pairs []DuplicateEntry, singles []DuplicateEntry) *IntermediateDuplicateSet {
+	createDupSetInternal := func(key umiKey, pairs []DuplicateEntry, singles []DuplicateEntry,
+		rescued bool) *IntermediateDuplicateSet {
 		corrected := map[string]string{}
-		if d.opts.TagDups {
+		// Entries whose UMIs were dropped by the allowlist have a key
+		// without UMIs, and are not corrected.
+		if (d.opts.tagDupSets() || d.opts.umiCorrectionEnabled()) && (key.leftUmi != "" || key.rightUmi != "") {
 			for _, p := range pairs {
-				left, right, swapped := getCanonicalUmis(p.(IndexedPair))
-				if left != key.leftUmi || right != key.rightUmi {
+				left, right, swapped, found := getCanonicalUmis(d.opts, p.(IndexedPair))
+				if found && (left != key.leftUmi || right != key.rightUmi) {
 					if swapped {
 						corrected[p.Name()] = fmt.Sprintf("%s+%s", key.rightUmi, key.leftUmi)
 					} else {
@@ -442,12 +659,15 @@ func (d *duplicateIndex) groupByPositionAndUmi() []*IntermediateDuplicateSet {
 			}
 			for _, single := range singles {
 				s := single.(IndexedSingle)
-				umi, mateUmi, swapped := getCanonicalUmi(s)
+				umi, mateUmi, swapped, found := getCanonicalUmi(d.opts, s)
+				if !found {
+					continue
+				}
 
 				if s.R.Ref.ID() == key.leftRefId && s.R.Pos == key.leftPos &&
 					((key.isSingle() && orientationByteSingle(bam.IsReversedRead(s.R)) == key.Orientation) ||
 						!key.isSingle() && orientationByteSingle(bam.IsReversedRead(s.R)) == leftOrientation(key.Orientation)) &&
-					umi != key.leftUmi {
+					umi != key.leftUmi && !(d.opts.DuplexUMI && umi == key.rightUmi) {
 					// key.leftUmi is the corrected value.
 					if swapped {
 						corrected[s.Name()] = fmt.Sprintf("%s+%s", mateUmi, key.leftUmi)
@@ -457,7 +677,7 @@ func (d *duplicateIndex) groupByPositionAndUmi() []*IntermediateDuplicateSet {
 				} else if s.R.Ref.ID() == key.rightRefId && s.R.Pos == key.rightPos &&
 					((key.isSingle() && orientationByteSingle(bam.IsReversedRead(s.R)) == key.Orientation) ||
 						!key.isSingle() && orientationByteSingle(bam.IsReversedRead(s.R)) == rightOrientation(key.Orientation)) &&
-					umi != key.rightUmi {
+					umi != key.rightUmi && !(d.opts.DuplexUMI && umi == key.leftUmi) {
 					// key.rightUmi is the corrected value.
 					if swapped {
 						corrected[s.Name()] = fmt.Sprintf("%s+%s", mateUmi, key.rightUmi)
@@ -468,70 +688,123 @@ func (d *duplicateIndex) groupByPositionAndUmi() []*IntermediateDuplicateSet {
 			}
 		}
 		return &IntermediateDuplicateSet{
-			Pairs:     pairs,
-			Singles:   singles,
-			Corrected: corrected,
+			Pairs:        pairs,
+			Singles:      singles,
+			Corrected:    corrected,
+			RescuedByUmi: rescued,
 		}
 	}
 
+	// Grouping by position alone would have merged the sets of all
+	// the keys at a position. Count all but the set of the first key
+	// as rescued by their UMIs.
+	firstKeys := map[duplicateKey]umiKey{}
+	for k := range umiToGroup {
+		first, ok := firstKeys[k.position()]
+		if !ok || k.less(&first) {
+			firstKeys[k.position()] = k
+		}
+	}
+	isRescued := func(k umiKey) bool {
+		return firstKeys[k.position()] != k
+	}
+
 	// The following code is the same as groupByPosition() except for
 	// the addition of umis to the lookup key.  It would be nice to
 	// use a common piece of code for this.
 	groups := make([]*IntermediateDuplicateSet, 0)
-	for k, pairs := range umiToGroup {
+	umiKeys := sortedUmiKeys(umiToGroup)
+	for _, k := range umiKeys {
+		pairs := umiToGroup[k]
 		if k.isSingle() {
 			continue
 		}
+		sortByFileIdx(pairs)
 
 		// Find singles that match on position and umi.
 		singles := make([]DuplicateEntry, 0)
 		// Find singles that match on position and umi.
-		if !d.opts.SeparateSingletons {
+		if !d.opts.SeparateSingletons && !k.missing {
+			position := k.position()
+			leftUmis, rightUmis := []string{k.leftUmi}, []string{k.rightUmi}
+			if d.opts.DuplexUMI && k.leftUmi != k.rightUmi {
+				// The UMIs of k are sorted, not ordered by position,
+				// so a single may match either of them.
+				leftUmis = []string{k.leftUmi, k.rightUmi}
+				rightUmis = leftUmis
+			}
 			// Collect matching singles for each read who's umi lacks N.
-			if !strings.ContainsAny(k.leftUmi, "Nn") {
-				singles = append(singles, getDupSingles(k.leftRefId, k.leftPos, leftOrientation(k.Orientation),
-					k.Strand, k.leftUmi)...)
+			for _, umi := range leftUmis {
+				if !strings.ContainsAny(umi, "Nn") {
+					singles = append(singles, getDupSingles(position.leftFragment(), umi)...)
+				}
 			}
-			if !strings.ContainsAny(k.rightUmi, "Nn") {
-				singles = append(singles, getDupSingles(k.rightRefId, k.rightPos, rightOrientation(k.Orientation),
-					k.Strand, k.rightUmi)...)
+			for _, umi := range rightUmis {
+				if !strings.ContainsAny(umi, "Nn") {
+					singles = append(singles, getDupSingles(position.rightFragment(), umi)...)
+				}
 			}
 		}
 
-		// If either umi contains N, split each pair into a separate
-		// group.  The first group should contain any singletons that
-		// matched this k.
-		if strings.ContainsAny(k.leftUmi, "Nn") || strings.ContainsAny(k.rightUmi, "Nn") {
+		sortByFileIdx(singles)
+
+		// If either umi contains N or is missing, split each pair into
+		// a separate group.  The first group should contain any
+		// singletons that matched this k.
+		if k.isSplit() {
 			for i, p := range pairs {
-				groups = append(groups, createDupSetInternal(k, []DuplicateEntry{p}, singles))
+				groups = append(groups, createDupSetInternal(k, []DuplicateEntry{p}, singles, i == 0 && isRescued(k)))
 				if i == 0 {
 					// We attach the singles only to pairs[0].
 					singles = []DuplicateEntry{}
 				}
 			}
 		} else {
-			groups = append(groups, createDupSetInternal(k, pairs, singles))
+			groups = append(groups, createDupSetInternal(k, pairs, singles, isRescued(k)))
 		}
 		delete(umiToGroup, k)
 	}
 
-	for k, singles := range umiToGroup {
-		if strings.ContainsAny(k.leftUmi, "Nn") {
-			for _, s := range singles {
-				groups = append(groups, createDupSetInternal(k, []DuplicateEntry{}, []DuplicateEntry{s}))
+	for _, k := range umiKeys {
+		singles, ok := umiToGroup[k]
+		if !ok {
+			continue
+		}
+		sortByFileIdx(singles)
+		if k.isSplit() {
+			for i, s := range singles {
+				groups = append(groups, createDupSetInternal(k, []DuplicateEntry{}, []DuplicateEntry{s},
+					i == 0 && isRescued(k)))
 			}
 		} else {
-			groups = append(groups, createDupSetInternal(k, []DuplicateEntry{}, singles))
+			groups = append(groups, createDupSetInternal(k, []DuplicateEntry{}, singles, isRescued(k)))
 		}
 		delete(umiToGroup, k)
 	}
 	return groups
 }
 
-func (d *duplicateIndex) tryCorrectUmis(e DuplicateEntry) (leftUmi, rightUmi string, fullyCorrected, correctedSome bool) {
+// tryCorrectUmis returns the canonical UMIs of e, corrected by
+// d.umiCorrector or d.umiAllowlist if they are set. found is false if
+// e has no UMIs, or if d.umiAllowlist drops them.
+func (d *duplicateIndex) tryCorrectUmis(e DuplicateEntry) (leftUmi, rightUmi string, fullyCorrected, correctedSome,
+	found bool) {
 	switch v := e.(type) {
 	case IndexedPair:
-		leftUmi, rightUmi, _ = getCanonicalUmis(v)
+		leftUmi, rightUmi, _, found = getCanonicalUmis(d.opts, v)
+		if !found {
+			return
+		}
+		if d.umiAllowlist != nil {
+			corrected, ok := d.umiAllowlist.correct(d.opts, leftUmi, rightUmi)
+			if !ok {
+				return "", "", false, false, false
+			}
+			leftUmi, rightUmi = corrected[0], corrected[1]
+			if d.opts.DuplexUMI && leftUmi > rightUmi {
+				leftUmi, rightUmi = rightUmi, leftUmi
+			}
+		}
 		if d.umiCorrector != nil {
 			correctedLeftUmi, leftDist, correctedLeft := d.umiCorrector.CorrectUMI(leftUmi)
 			correctedRightUmi, rightDist, correctedRight := d.umiCorrector.CorrectUMI(rightUmi)
@@ -545,7 +818,17 @@ func (d *duplicateIndex) tryCorrectUmis(e DuplicateEntry) (leftUmi, rightUmi str
 			correctedSome = false
 		}
 	case IndexedSingle:
-		leftUmi, _, _ = getCanonicalUmi(v)
+		leftUmi, _, _, found = getCanonicalUmi(d.opts, v)
+		if !found {
+			return
+		}
+		if d.umiAllowlist != nil {
+			corrected, ok := d.umiAllowlist.correct(d.opts, leftUmi)
+			if !ok {
+				return "", "", false, false, false
+			}
+			leftUmi = corrected[0]
+		}
 		if d.umiCorrector != nil {
 			correctedUmi, dist, corrected := d.umiCorrector.CorrectUMI(leftUmi)
 
@@ -561,12 +844,72 @@ func (d *duplicateIndex) tryCorrectUmis(e DuplicateEntry) (leftUmi, rightUmi str
 	return
 }
 
-func getUmiField(name string) string {
+// qnameUmis returns the R1 and R2 UMIs of the last field of name, e.g.
+// "AAC+CCG", see Opts.UseUmis. ok is false if they cannot be parsed.
+func qnameUmis(name string) (r1Umi, r2Umi string, ok bool) {
 	idx := strings.LastIndexByte(name, ':')
 	if idx < 0 {
-		log.Fatalf("Could not parse UMI in qname: %s", name)
+		return "", "", false
 	}
-	return name[idx:]
+	umis := umiRe.FindStringSubmatch(name[idx:])
+	if umis == nil {
+		return "", "", false
+	}
+	return umis[1], umis[2], true
+}
+
+// checkUmis returns an error wrapping ErrMalformedUMI if the UMIs of
+// r, a primary mapped record, cannot be parsed from its name with
+// Opts.UseUmis. The records are checked as they are read, so
+// recordUmis, which has no error to return, can rely on their UMIs.
+func checkUmis(opts *Opts, r *sam.Record) error {
+	if !opts.UseUmis || (r.Flags&(sam.Unmapped|sam.Secondary|sam.Supplementary)) != 0 {
+		return nil
+	}
+	if _, _, ok := qnameUmis(r.Name); !ok {
+		return errors.E(ErrMalformedUMI, r.Name)
+	}
+	return nil
+}
+
+// recordUmis returns the R1 and R2 UMIs of r's readpair. With
+// opts.UseUmis, they are parsed from the last field of r's name, e.g.
+// "AAC+CCG". Otherwise they are read from r's opts.UMITag tag, or from
+// the UMI field of r's 8 field Illumina name if opts.UMISource is
+// "qname", and uppercased: a value with two UMIs separated by '-' or
+// '+' holds the R1 and R2 UMIs, and a value with one UMI holds the
+// UMI of r, which is returned as r1Umi if r is R1 and as r2Umi
+// otherwise. found is false if r has no UMI.
+func recordUmis(opts *Opts, r *sam.Record) (r1Umi, r2Umi string, found bool) {
+	var value string
+	switch {
+	case opts.umiFromTag():
+		aux := r.AuxFields.Get(sam.NewTag(opts.UMITag))
+		if aux == nil {
+			return "", "", false
+		}
+		value = fmt.Sprint(aux.Value())
+	case opts.umiFromQname():
+		// The UMI is set even if the tile or coordinates cannot be
+		// parsed, so the error is ignored.
+		location, _ := ParseLocation(r.Name)
+		if location.UMI == "" {
+			return "", "", false
+		}
+		value = location.UMI
+	default:
+		// checkUmis has rejected the names without UMIs.
+		return qnameUmis(r.Name)
+	}
+
+	value = strings.ToUpper(value)
+	if idx := strings.IndexAny(value, "-+"); idx >= 0 {
+		return value[:idx], value[idx+1:], true
+	}
+	if (r.Flags & sam.Read1) != 0 {
+		return value, "", true
+	}
+	return "", value, true
 }
 
 // getCanonicalUmis returns the 'left' and 'right' umis for a given
@@ -576,43 +919,54 @@ func getUmiField(name string) string {
 // orientations are equal for both reads in a pair.  In those cases,
 // getCanonicalUmis must order the umis canonically, and it does so
 // based on this criteria: (refid, pos, orientation, umi) which
-// ignores the R1 and R2 flags.  Also returns a boolean that is true
-// if leftUmi came from R2.
-func getCanonicalUmis(pair IndexedPair) (leftUmi string, rightUmi string, swapped bool) {
-	umis := umiRe.FindStringSubmatch(getUmiField(pair.Left.R.Name))
-	if umis == nil {
-		log.Fatalf("Could not parse UMI in qname: %s", pair.Left.R.Name)
+// ignores the R1 and R2 flags.  With opts.DuplexUMI, the umis are
+// always sorted, so leftUmi need not be the umi of the left read.
+// Also returns a boolean that is true if leftUmi came from R2, and one
+// that is false if either read has no UMIs.
+func getCanonicalUmis(opts *Opts, pair IndexedPair) (leftUmi string, rightUmi string, swapped, found bool) {
+	r1, r2 := pair.GetR1R2()
+	r1Umi, _, r1Found := recordUmis(opts, r1)
+	_, r2Umi, r2Found := recordUmis(opts, r2)
+	if !r1Found || !r2Found {
+		return "", "", false, false
+	}
+
+	// Both strands of a duplex molecule have the same UMIs in opposite
+	// orders, so sort them to group the strands together.
+	if opts.DuplexUMI {
+		if r1Umi <= r2Umi {
+			return r1Umi, r2Umi, false, true
+		}
+		return r2Umi, r1Umi, true, true
 	}
 
 	// If it's a tie based on ref, pos, and orientation, then order by umi value.
 	if pair.Left.R.Ref.ID() == pair.Right.R.Ref.ID() &&
-		bam.UnclippedFivePrimePosition(pair.Left.R) == bam.UnclippedFivePrimePosition(pair.Right.R) &&
+		unclippedFivePrimePosition(pair.Left.R) == unclippedFivePrimePosition(pair.Right.R) &&
 		bam.IsReversedRead(pair.Left.R) == bam.IsReversedRead(pair.Right.R) {
-		if strings.Compare(umis[1], umis[2]) < 0 {
-			return umis[1], umis[2], false
+		if strings.Compare(r1Umi, r2Umi) < 0 {
+			return r1Umi, r2Umi, false, true
 		}
-		return umis[2], umis[1], true
+		return r2Umi, r1Umi, true, true
 	}
 
 	// Otheriwse keep the left/right order as given by the pair.
 	if (pair.Left.R.Flags & sam.Read1) != 0 {
-		return umis[1], umis[2], false
+		return r1Umi, r2Umi, false, true
 	}
-	return umis[2], umis[1], true
+	return r2Umi, r1Umi, true, true
 }
 
 // getCanonicalUmi returns the UMI associated with read, and also the
 // UMI associated with the read's mate.  The third return value is
-// true if umi is from R2.
-func getCanonicalUmi(read IndexedSingle) (umi string, mateUmi string, swapped bool) {
-	umis := umiRe.FindStringSubmatch(getUmiField(read.R.Name))
-	if umis == nil {
-		log.Fatalf("Could not parse UMI in qname: %s", read.R.Name)
-	}
+// true if umi is from R2, and the fourth is false if read has no
+// UMIs.
+func getCanonicalUmi(opts *Opts, read IndexedSingle) (umi string, mateUmi string, swapped, found bool) {
+	r1Umi, r2Umi, found := recordUmis(opts, read.R)
 	if (read.R.Flags & sam.Read1) != 0 {
-		return umis[1], umis[2], false
+		return r1Umi, r2Umi, false, found
 	}
-	return umis[2], umis[1], true
+	return r2Umi, r1Umi, true, found
 }
 
 // This is the method for outside users.  This will remove and return
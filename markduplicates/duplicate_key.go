@@ -15,8 +15,6 @@ package markduplicates
 
 import (
 	"fmt"
-
-	"github.com/Schaudge/grailbase/log"
 )
 
 type Orientation uint8
@@ -30,10 +28,26 @@ const (
 	rr = iota // Reverse, Reverse
 )
 
+// orientationNames are the names of the Orientations, the strand of
+// the left read first for a readpair.
+var orientationNames = []string{f: "F", r: "R", ff: "FF", fr: "FR", rf: "RF", rr: "RR"}
+
+func (o Orientation) String() string {
+	if int(o) < len(orientationNames) {
+		return orientationNames[o]
+	}
+	return fmt.Sprintf("Orientation(%d)", o)
+}
+
 // duplicateKey is a unique key for each group of duplicates.  If both
 // left and right are populated, the left most unclipped 5' position will
 // reside in left.  If only one read is populated, it will reside in left,
 // and .isSingle() returns true.
+//
+// Like picard, fragments (mate-unmapped reads) are duplicates of the
+// readpairs that have a read at the same position and orientation in
+// the same library, the keys returned by leftFragment() and
+// rightFragment(), but readpairs are never duplicates of fragments.
 type duplicateKey struct {
 	leftRefId   int
 	leftPos     int
@@ -41,11 +55,52 @@ type duplicateKey struct {
 	rightPos    int
 	Orientation Orientation
 	Strand      strand
+	// cell is the cell barcode of the entries with
+	// Opts.CellBarcodeTag, or "" if they have none.
+	cell string
+	// library is the library of the read group of the entries.
+	library string
 }
 
 func (k *duplicateKey) String() string {
-	return fmt.Sprintf("(%d,%d,%d,%d,0x%x,%d)", k.leftRefId, k.leftPos,
-		k.rightRefId, k.rightPos, k.Orientation, k.Strand)
+	return fmt.Sprintf("(%d,%d,%d,%d,%s,%d,%s,%s)", k.leftRefId, k.leftPos,
+		k.rightRefId, k.rightPos, k.Orientation, k.Strand, k.cell, k.library)
+}
+
+// leftFragment returns the key of the fragments that are duplicates of
+// the left reads of the readpairs of k.
+func (k *duplicateKey) leftFragment() duplicateKey {
+	return duplicateKey{k.leftRefId, k.leftPos, -1, -1, leftOrientation(k.Orientation), k.Strand, k.cell, k.library}
+}
+
+// rightFragment returns the key of the fragments that are duplicates
+// of the right reads of the readpairs of k.
+func (k *duplicateKey) rightFragment() duplicateKey {
+	return duplicateKey{k.rightRefId, k.rightPos, -1, -1, rightOrientation(k.Orientation), k.Strand, k.cell, k.library}
+}
+
+// less orders duplicateKeys by position, and then by their other
+// fields. duplicateIndex builds its duplicate sets in this order, so
+// that they do not depend on the order in which the keys were
+// inserted.
+func (k *duplicateKey) less(other *duplicateKey) bool {
+	switch {
+	case k.leftRefId != other.leftRefId:
+		return k.leftRefId < other.leftRefId
+	case k.leftPos != other.leftPos:
+		return k.leftPos < other.leftPos
+	case k.rightRefId != other.rightRefId:
+		return k.rightRefId < other.rightRefId
+	case k.rightPos != other.rightPos:
+		return k.rightPos < other.rightPos
+	case k.Orientation != other.Orientation:
+		return k.Orientation < other.Orientation
+	case k.Strand != other.Strand:
+		return k.Strand < other.Strand
+	case k.cell != other.cell:
+		return k.cell < other.cell
+	}
+	return k.library < other.library
 }
 
 func (k *duplicateKey) isSingle() bool {
@@ -61,8 +116,7 @@ func orientationByteSingle(reversed bool) Orientation {
 
 func leftOrientation(o Orientation) Orientation {
 	if o == f || o == r {
-		log.Fatal("expected pair orientation, got single fragment orientation")
-		return r
+		panic("expected pair orientation, got single fragment orientation")
 	} else if o == ff || o == fr {
 		return f
 	} else {
@@ -72,8 +126,7 @@ func leftOrientation(o Orientation) Orientation {
 
 func rightOrientation(o Orientation) Orientation {
 	if o == f || o == r {
-		log.Fatal("expected pair orientation, got single fragment orientation")
-		return r
+		panic("expected pair orientation, got single fragment orientation")
 	} else if o == ff || o == rf {
 		return f
 	} else {
@@ -81,6 +134,23 @@ func rightOrientation(o Orientation) Orientation {
 	}
 }
 
+// canonicalOrientation returns the Orientation of a readpair from the
+// strands of its left and right reads, ordered by reference and
+// unclipped 5' position, as picard computes it after ordering the
+// ends of a pair. FF and RR readpairs, with both reads on one strand,
+// keep their own orientations, so an FF readpair is never a duplicate
+// of an RR readpair at the same positions. When both reads are at the
+// same position, the order of the reads is arbitrary, and an RF
+// readpair is FR, so that the orientation does not depend on which
+// read is left.
+func canonicalOrientation(samePosition, leftReversed, rightReversed bool) Orientation {
+	o := orientationBytePair(leftReversed, rightReversed)
+	if samePosition && o == rf {
+		return fr
+	}
+	return o
+}
+
 func orientationBytePair(leftReversed, rightReversed bool) Orientation {
 	if leftReversed {
 		if rightReversed {
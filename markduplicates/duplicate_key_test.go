@@ -0,0 +1,150 @@
+// Copyright 2019 Grail Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package markduplicates
+
+import (
+	"testing"
+
+	"github.com/Schaudge/grailbio/encoding/bamprovider"
+	"github.com/Schaudge/hts/sam"
+	"github.com/grailbio/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOrientationString(t *testing.T) {
+	tests := []struct {
+		o    Orientation
+		name string
+	}{
+		{f, "F"},
+		{r, "R"},
+		{ff, "FF"},
+		{fr, "FR"},
+		{rf, "RF"},
+		{rr, "RR"},
+		{Orientation(8), "Orientation(8)"},
+	}
+	for _, test := range tests {
+		assert.Equal(t, test.name, test.o.String())
+	}
+	k := duplicateKey{0, 10, 0, 20, fr, 0, "", "lib"}
+	assert.Equal(t, "(0,10,0,20,FR,0,,lib)", k.String())
+}
+
+func TestCanonicalOrientation(t *testing.T) {
+	tests := []struct {
+		samePosition, leftReversed, rightReversed bool
+		o                                         Orientation
+	}{
+		{false, false, false, ff},
+		{false, false, true, fr},
+		{false, true, false, rf},
+		{false, true, true, rr},
+		{true, false, false, ff},
+		{true, false, true, fr},
+		{true, true, false, fr},
+		{true, true, true, rr},
+	}
+	for _, test := range tests {
+		assert.Equal(t, test.o, canonicalOrientation(test.samePosition, test.leftReversed, test.rightReversed),
+			"test %+v", test)
+	}
+}
+
+// Test the orientation of the keys of readpairs with each combination
+// of strands, with read 1 on the left or on the right, and whichever
+// read is inserted first.
+func TestPairKeyOrientation(t *testing.T) {
+	// A reversed read at 91 has its unclipped 5' position at 100, like
+	// a forward read at 100.
+	tests := []struct {
+		name   string
+		r1, r2 *sam.Record
+		o      Orientation
+	}{
+		{"FF", NewRecord("A", chr1, 100, r1F, 300, chr1, cigar0), NewRecord("A", chr1, 300, r2F, 100, chr1, cigar0), ff},
+		{"FR", NewRecord("A", chr1, 100, r1F, 300, chr1, cigar0), NewRecord("A", chr1, 300, r2R, 100, chr1, cigar0), fr},
+		{"RF", NewRecord("A", chr1, 100, r1R, 300, chr1, cigar0), NewRecord("A", chr1, 300, r2F, 100, chr1, cigar0), rf},
+		{"RR", NewRecord("A", chr1, 100, r1R, 300, chr1, cigar0), NewRecord("A", chr1, 300, r2R, 100, chr1, cigar0), rr},
+		{"FF, read 2 left", NewRecord("A", chr1, 300, r1F, 100, chr1, cigar0), NewRecord("A", chr1, 100, r2F, 300, chr1, cigar0), ff},
+		{"FR, read 2 left", NewRecord("A", chr1, 300, r1R, 100, chr1, cigar0), NewRecord("A", chr1, 100, r2F, 300, chr1, cigar0), fr},
+		{"RF, read 2 left", NewRecord("A", chr1, 300, r1F, 100, chr1, cigar0), NewRecord("A", chr1, 100, r2R, 300, chr1, cigar0), rf},
+		{"RR, read 2 left", NewRecord("A", chr1, 300, r1R, 100, chr1, cigar0), NewRecord("A", chr1, 100, r2R, 300, chr1, cigar0), rr},
+		{"FF, same position", NewRecord("A", chr1, 100, r1F, 100, chr1, cigar0), NewRecord("A", chr1, 100, r2F, 100, chr1, cigar0), ff},
+		{"FR, same position", NewRecord("A", chr1, 100, r1F, 91, chr1, cigar0), NewRecord("A", chr1, 91, r2R, 100, chr1, cigar0), fr},
+		{"RF, same position", NewRecord("A", chr1, 91, r1R, 100, chr1, cigar0), NewRecord("A", chr1, 100, r2F, 91, chr1, cigar0), fr},
+		{"RR, same position", NewRecord("A", chr1, 91, r1R, 91, chr1, cigar0), NewRecord("A", chr1, 91, r2R, 91, chr1, cigar0), rr},
+	}
+	for _, test := range tests {
+		for _, reads := range [][2]*sam.Record{{test.r1, test.r2}, {test.r2, test.r1}} {
+			left, right := orderPair(IndexedSingle{reads[0], 1}, IndexedSingle{reads[1], 2})
+			key := pairKey(left.R, right.R, 0, "", "lib")
+			assert.Equal(t, test.o, key.Orientation, "test %s, first read %v", test.name, reads[0])
+		}
+	}
+}
+
+// Test that like picard, an FF readpair is a duplicate of the FF
+// readpairs at the same positions whichever read is read 1, but not of
+// the RR readpair at the same positions.
+func TestSameStrandDuplicates(t *testing.T) {
+	// A and B are FF readpairs with read 1 of B on the right. C and D
+	// are RR readpairs with the same unclipped 5' positions as A and
+	// B. The readpairs are on different tiles, so none are optical
+	// duplicates.
+	records := []*sam.Record{
+		NewRecord("C:::1:30:1:1", chr1, 91, r1R, 291, chr1, cigar0),
+		NewRecord("D:::1:40:1:1", chr1, 91, r1R, 291, chr1, cigar0),
+		NewRecord("A:::1:10:1:1", chr1, 100, r1F, 300, chr1, cigar0),
+		NewRecord("B:::1:20:1:1", chr1, 100, r2F, 300, chr1, cigar0),
+		NewRecord("C:::1:30:1:1", chr1, 291, r2R, 91, chr1, cigar0),
+		NewRecord("D:::1:40:1:1", chr1, 291, r2R, 91, chr1, cigar0),
+		NewRecord("A:::1:10:1:1", chr1, 300, r2F, 100, chr1, cigar0),
+		NewRecord("B:::1:20:1:1", chr1, 300, r1F, 100, chr1, cigar0),
+	}
+	sets := [][]string{{"A", "B"}, {"C", "D"}}
+
+	tempDir, cleanup := testutil.TempDir(t, "", "")
+	defer cleanup()
+	for testIdx, format := range []string{"bam", "pam"} {
+		opts := defaultOpts
+		opts.OutputPath = NewTestOutput(tempDir, testIdx, format)
+		opts.Format = format
+		opts.ShardSize = 1000
+
+		markDuplicates := &MarkDuplicates{
+			Provider: bamprovider.NewFakeProvider(header, records),
+			Opts:     &opts,
+		}
+		actualMetrics, err := markDuplicates.Mark(nil)
+		if !assert.NoError(t, err, "format %s", format) {
+			continue
+		}
+
+		duplicates := map[string]bool{}
+		for _, r := range ReadRecords(t, opts.OutputPath) {
+			duplicates[r.Name[:1]] = duplicates[r.Name[:1]] || r.Flags&sam.Duplicate != 0
+		}
+		for _, set := range sets {
+			representatives := 0
+			for _, name := range set {
+				if !duplicates[name] {
+					representatives++
+				}
+			}
+			assert.Equal(t, 1, representatives, "format %s, set %v", format, set)
+		}
+		assert.Equal(t, 4, actualMetrics.LibraryMetrics["Unknown Library"].ReadPairDups, "format %s", format)
+	}
+}
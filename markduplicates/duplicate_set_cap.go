@@ -0,0 +1,67 @@
+// Copyright 2019 Grail Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package markduplicates
+
+import (
+	"sort"
+)
+
+// Capped duplicate sets
+//
+// The optical detection and the optical histogram compare the
+// readpairs of a duplicate set pairwise, so a PCR blow-up at one locus,
+// with millions of readpairs in one set, would take practically
+// forever. With Opts.MaxDuplicateSetSize > 0, the optical duplicates,
+// the optical distances and the scatter of a larger set of readpairs
+// are computed on a sample of Opts.MaxDuplicateSetSize of its
+// readpairs, which always has the primary. The other readpairs are
+// flagged as duplicates like those of any set, but never as optical
+// duplicates. The sample is chosen with samplePriority and the seed of
+// opticalHistogramSeed, so it does not depend on the sharding or the
+// order of the input. The capped sets are logged and counted in
+// MetricsCollection.CappedDuplicateSets.
+
+// capDuplicateSet returns a sample of opts.MaxDuplicateSetSize of
+// pairs, which has the primary at bestIndex, and the index of the
+// primary in the sample. The sample is in the order of pairs.
+func capDuplicateSet(opts *Opts, pairs []DuplicateEntry, bestIndex int) ([]DuplicateEntry, int) {
+	seed := opticalHistogramSeed(opts, pairs)
+	others := make([]int, 0, len(pairs)-1)
+	priorities := make([]uint64, len(pairs))
+	for i, pair := range pairs {
+		if i != bestIndex {
+			others = append(others, i)
+			priorities[i] = samplePriority(seed, pair.Name())
+		}
+	}
+	sort.Slice(others, func(i, j int) bool {
+		a, b := others[i], others[j]
+		if priorities[a] != priorities[b] {
+			return priorities[a] < priorities[b]
+		}
+		return pairs[a].FileIdx() < pairs[b].FileIdx()
+	})
+	sampled := append(others[:opts.MaxDuplicateSetSize-1], bestIndex)
+	sort.Ints(sampled)
+
+	sample := make([]DuplicateEntry, len(sampled))
+	sampleBest := 0
+	for i, idx := range sampled {
+		sample[i] = pairs[idx]
+		if idx == bestIndex {
+			sampleBest = i
+		}
+	}
+	return sample, sampleBest
+}
@@ -0,0 +1,137 @@
+// Copyright 2019 Grail Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package markduplicates
+
+import (
+	"fmt"
+	"sort"
+	"testing"
+
+	"github.com/Schaudge/grailbio/encoding/bamprovider"
+	"github.com/Schaudge/hts/sam"
+	"github.com/grailbio/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCapDuplicateSet(t *testing.T) {
+	var pairs []DuplicateEntry
+	for i := 0; i < 100; i++ {
+		name := fmt.Sprintf("P%d:::1:10:%d:1000", i, 1000+i)
+		pairs = append(pairs, IndexedPair{
+			Left:  IndexedSingle{NewRecord(name, chr1, 0, r1F, 100, chr1, cigar0), uint64(2 * i)},
+			Right: IndexedSingle{NewRecord(name, chr1, 100, r2R, 0, chr1, cigar0), uint64(2*i + 1)},
+		})
+	}
+	sampleNames := func(sample []DuplicateEntry) []string {
+		names := make([]string, len(sample))
+		for i, pair := range sample {
+			names[i] = pair.Name()
+		}
+		return names
+	}
+
+	opts := Opts{MaxDuplicateSetSize: 10}
+	sample, sampleBest := capDuplicateSet(&opts, pairs, 37)
+	assert.Equal(t, 10, len(sample))
+	assert.Equal(t, "P37:::1:10:1037:1000", sample[sampleBest].Name())
+	assert.True(t, sort.SliceIsSorted(sample, func(i, j int) bool {
+		return sample[i].FileIdx() < sample[j].FileIdx()
+	}))
+
+	// The sample does not depend on the order of the pairs.
+	reversed := make([]DuplicateEntry, len(pairs))
+	for i, pair := range pairs {
+		reversed[len(pairs)-1-i] = pair
+	}
+	reversedSample, reversedBest := capDuplicateSet(&opts, reversed, 62)
+	assert.Equal(t, "P37:::1:10:1037:1000", reversedSample[reversedBest].Name())
+	names, reversedNames := sampleNames(sample), sampleNames(reversedSample)
+	sort.Strings(names)
+	sort.Strings(reversedNames)
+	assert.Equal(t, names, reversedNames)
+
+	// A sample of 1 is just the primary.
+	opts.MaxDuplicateSetSize = 1
+	sample, sampleBest = capDuplicateSet(&opts, pairs, 5)
+	assert.Equal(t, []string{"P5:::1:10:1005:1000"}, sampleNames(sample))
+	assert.Equal(t, 0, sampleBest)
+}
+
+// Test that every readpair of a capped duplicate set is flagged, that
+// only the readpairs of the sample are optical duplicates, and that
+// the capped set is counted in the metrics.
+func TestMaxDuplicateSetSize(t *testing.T) {
+	// The 20 readpairs are optical duplicates of each other, 10 pixels
+	// apart on the same tile.
+	newRecords := func() []*sam.Record {
+		var records []*sam.Record
+		for _, pos := range [][2]int{{0, 100}, {100, 0}} {
+			flags := r1F
+			if pos[0] == 100 {
+				flags = r2R
+			}
+			for i := 0; i < 20; i++ {
+				name := fmt.Sprintf("P%d:::1:10:%d:1000", i, 1000+10*i)
+				records = append(records, NewRecord(name, chr1, pos[0], flags, pos[1], chr1, cigar0))
+			}
+		}
+		return records
+	}
+
+	tests := []struct {
+		maxSetSize  int
+		opticals    int
+		cappedSets  int64
+		cappedPairs int64
+	}{
+		{0, 38, 0, 0},
+		{20, 38, 0, 0},
+		{19, 36, 1, 20},
+		{5, 8, 1, 20},
+	}
+
+	tempDir, cleanup := testutil.TempDir(t, "", "")
+	defer cleanup()
+	for testIdx, test := range tests {
+		opts := defaultOpts
+		opts.OutputPath = NewTestOutput(tempDir, testIdx, "bam")
+		opts.Format = "bam"
+		opts.MaxDuplicateSetSize = test.maxSetSize
+
+		markDuplicates := &MarkDuplicates{
+			Provider: bamprovider.NewFakeProvider(header, newRecords()),
+			Opts:     &opts,
+		}
+		actualMetrics, err := markDuplicates.Mark(nil)
+		if !assert.NoError(t, err, "max set size %d", test.maxSetSize) {
+			continue
+		}
+
+		duplicates, opticals := 0, 0
+		for _, r := range ReadRecords(t, opts.OutputPath) {
+			if r.Flags&sam.Duplicate != 0 {
+				duplicates++
+			}
+			if aux := r.AuxFields.Get(dtTag); aux != nil && aux.Value().(string) == "SQ" {
+				opticals++
+			}
+		}
+		assert.Equal(t, 38, duplicates, "max set size %d", test.maxSetSize)
+		assert.Equal(t, test.opticals, opticals, "max set size %d", test.maxSetSize)
+		assert.Equal(t, test.cappedSets, actualMetrics.CappedDuplicateSets, "max set size %d", test.maxSetSize)
+		assert.Equal(t, test.cappedPairs, actualMetrics.CappedDuplicatePairs, "max set size %d", test.maxSetSize)
+		doc := newJSONMetricsDocument(&opts, actualMetrics)
+		assert.Equal(t, test.cappedSets, doc.Global.CappedDuplicateSets, "max set size %d", test.maxSetSize)
+	}
+}
@@ -0,0 +1,101 @@
+// Copyright 2019 Grail Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package markduplicates
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/Schaudge/hts/sam"
+)
+
+// With Opts.RemoveDups and Opts.DuplicatesOutput, the duplicates that
+// are removed from the output are written to the BAM file
+// Opts.DuplicatesOutput instead, flagged and tagged like they would be
+// in the output. Each worker writes the duplicates of a shard to the
+// same shard of the duplicates output, so it is coordinate sorted like
+// the output, and together the two outputs have all the records of
+// the input.
+
+// duplicatesProgramID is the ID of the @PG line that the header of
+// Opts.DuplicatesOutput adds to the header of the output.
+const duplicatesProgramID = "doppelmark.duplicates"
+
+// duplicatesHeader returns header with the @PG line of the duplicates
+// output, whose previous program is the last one of header.
+func duplicatesHeader(header *sam.Header) (*sam.Header, error) {
+	text, err := header.MarshalText()
+	if err != nil {
+		return nil, err
+	}
+	pg := []string{"@PG", "ID:" + duplicatesProgramID, "PN:doppelmark"}
+	var previous string
+	for _, line := range strings.Split(string(text), "\n") {
+		if strings.HasPrefix(line, "@PG\t") {
+			for _, field := range strings.Split(line, "\t")[1:] {
+				if strings.HasPrefix(field, "ID:") {
+					previous = field[len("ID:"):]
+				}
+			}
+		}
+	}
+	if previous != "" {
+		pg = append(pg, "PP:"+previous)
+	}
+	pg = append(pg, "DS:duplicates removed from the output")
+	text = append(text, []byte(strings.Join(pg, "\t")+"\n")...)
+	return sam.NewHeader(text, nil)
+}
+
+// duplicatesOutput writes the BAM file Opts.DuplicatesOutput.
+type duplicatesOutput struct {
+	path   string
+	out    *outputFile
+	writer *bamWriter
+}
+
+// newDuplicatesOutput creates Opts.DuplicatesOutput, with the header
+// of the output.
+func newDuplicatesOutput(ctx context.Context, opts *Opts, header *sam.Header) (*duplicatesOutput, error) {
+	dupHeader, err := duplicatesHeader(header)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't create the header of %s: %v", opts.DuplicatesOutput, err)
+	}
+	out, err := createOutput(ctx, opts.DuplicatesOutput)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't create duplicates output %s: %v", opts.DuplicatesOutput, err)
+	}
+	writer, err := newBAMWriter(opts, out, dupHeader)
+	if err != nil {
+		out.Close(ctx) // nolint: errcheck
+		return nil, fmt.Errorf("couldn't create bam writer for %s: %v", opts.DuplicatesOutput, err)
+	}
+	return &duplicatesOutput{path: opts.DuplicatesOutput, out: out, writer: writer}, nil
+}
+
+// newCompressor returns a shardCompressor of the duplicates output,
+// whose shards are those of the output.
+func (d *duplicatesOutput) newCompressor() *shardCompressor {
+	return newShardCompressor(d.writer, 1)
+}
+
+// close waits for the duplicates to be written, and closes the file.
+func (d *duplicatesOutput) close(ctx context.Context) error {
+	if err := d.writer.Close(); err != nil {
+		d.out.Close(ctx) // nolint: errcheck
+		return fmt.Errorf("couldn't write %s: %v", d.path, err)
+	}
+	return d.out.Close(ctx)
+}
@@ -0,0 +1,118 @@
+// Copyright 2019 Grail Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package markduplicates
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+
+	"github.com/Schaudge/grailbio/encoding/bamprovider"
+	"github.com/Schaudge/hts/bam"
+	"github.com/Schaudge/hts/sam"
+	"github.com/grailbio/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+// assertCoordinateSorted asserts that records are sorted by reference
+// and position.
+func assertCoordinateSorted(t *testing.T, records []*sam.Record, path string) {
+	for i := 1; i < len(records); i++ {
+		prev, r := records[i-1], records[i]
+		assert.True(t, prev.Ref.ID() < r.Ref.ID() || (prev.Ref.ID() == r.Ref.ID() && prev.Pos <= r.Pos),
+			"%s: %v after %v", path, r, prev)
+	}
+}
+
+func TestDuplicatesOutput(t *testing.T) {
+	ref, err := sam.NewReference("chrD", "", "", 3000000, nil, nil)
+	assert.NoError(t, err)
+	dupHeader, err := sam.NewHeader([]byte("@PG\tID:bwa\tPN:bwa\n"), []*sam.Reference{ref})
+	assert.NoError(t, err)
+	input := shardingRecords(ref)
+	var inputNames []string
+	for _, r := range input {
+		inputNames = append(inputNames, r.Name)
+	}
+
+	tempDir, cleanup := testutil.TempDir(t, "", "")
+	defer cleanup()
+	for testIdx, parallelism := range []int{1, 8} {
+		opts := defaultOpts
+		opts.OutputPath = NewTestOutput(tempDir, testIdx, "bam")
+		opts.DuplicatesOutput = filepath.Join(tempDir, "duplicates.bam")
+		opts.Format = "bam"
+		opts.ShardSize = 100000
+		opts.Parallelism = parallelism
+		opts.RemoveDups = true
+
+		markDuplicates := &MarkDuplicates{
+			Provider: bamprovider.NewFakeProvider(dupHeader, shardingRecords(ref)),
+			Opts:     &opts,
+		}
+		_, err := markDuplicates.Mark(nil)
+		assert.NoError(t, err, "parallelism %d", parallelism)
+
+		output := ReadRecords(t, opts.OutputPath)
+		duplicates := ReadRecords(t, opts.DuplicatesOutput)
+		assert.NotEmpty(t, duplicates, "parallelism %d", parallelism)
+		assertCoordinateSorted(t, output, opts.OutputPath)
+		assertCoordinateSorted(t, duplicates, opts.DuplicatesOutput)
+
+		// Together the outputs have all the records of the input.
+		assert.Equal(t, len(input), len(output)+len(duplicates), "parallelism %d", parallelism)
+		var names []string
+		for _, r := range output {
+			assert.Equal(t, sam.Flags(0), r.Flags&sam.Duplicate, "record %v", r)
+			names = append(names, r.Name)
+		}
+		for _, r := range duplicates {
+			assert.NotEqual(t, sam.Flags(0), r.Flags&sam.Duplicate, "record %v", r)
+			assert.NotNil(t, r.AuxFields.Get(dtTag), "record %v", r)
+			if (r.Flags & sam.MateUnmapped) == 0 {
+				assert.NotNil(t, r.AuxFields.Get(diTag), "record %v", r)
+				assert.NotNil(t, r.AuxFields.Get(dsTag), "record %v", r)
+			}
+			names = append(names, r.Name)
+		}
+		sort.Strings(names)
+		sort.Strings(inputNames)
+		assert.Equal(t, inputNames, names, "parallelism %d", parallelism)
+
+		// The header of the duplicates output has its own @PG line.
+		in, err := os.Open(opts.DuplicatesOutput)
+		assert.NoError(t, err)
+		reader, err := bam.NewReader(in, 1)
+		assert.NoError(t, err)
+		text, err := reader.Header().MarshalText()
+		assert.NoError(t, err)
+		assert.Contains(t, string(text), "@PG\tID:bwa\tPN:bwa\n")
+		assert.Contains(t, string(text), "@PG\tID:doppelmark.duplicates\tPN:doppelmark\tPP:doppelmark")
+		assert.NoError(t, reader.Close())
+		assert.NoError(t, in.Close())
+	}
+
+	opts := defaultOpts
+	opts.BamFile = "in.bam"
+	opts.Format = "bam"
+	opts.MinBases = 1
+	opts.ScavengeUmis = -1
+	opts.DuplicatesOutput = "duplicates.bam"
+	assert.Error(t, validate(&opts))
+	opts.RemoveDups = true
+	assert.NoError(t, validate(&opts))
+	opts.TagDups = false
+	assert.Error(t, validate(&opts))
+}
@@ -0,0 +1,43 @@
+// Copyright 2019 Grail Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package markduplicates
+
+import (
+	"github.com/Schaudge/grailbase/errors"
+)
+
+// The errors of malformed input, and of cancellation. The errors
+// returned by Mark, Run, and RunProvider for them wrap one of these, so
+// they can be tested with the standard library's errors.Is.
+var (
+	// ErrMissingMate is returned when the mate of a paired read is not
+	// in the input.
+	ErrMissingMate = errors.New("mate not found")
+	// ErrMalformedTemplate is returned when a template has more than
+	// two primary records with Opts.StrictTemplates, records of the
+	// same name are not mates with Opts.FailOnMateMismatch, or a
+	// readpair has reads that are both R1 or both R2.
+	ErrMalformedTemplate = errors.New("malformed template")
+	// ErrMalformedUMI is returned when the UMIs of a read cannot be
+	// parsed from its name with Opts.UseUmis.
+	ErrMalformedUMI = errors.New("could not parse UMI in qname")
+	// ErrFlagstat is returned with Opts.Flagstat when the records of
+	// the output are not those of the input.
+	ErrFlagstat = errors.New("output records differ from input")
+
+	// ErrCancelled is returned when the context of MarkContext, Run,
+	// or RunProvider is done before the output is complete. The error
+	// is also of kind errors.Canceled.
+	ErrCancelled = errors.New("cancelled")
+)
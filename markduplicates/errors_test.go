@@ -0,0 +1,110 @@
+// Copyright 2019 Grail Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package markduplicates
+
+import (
+	"os"
+	"testing"
+
+	"github.com/Schaudge/grailbio/encoding/bamprovider"
+	"github.com/Schaudge/hts/sam"
+	"github.com/grailbio/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMarkErrors(t *testing.T) {
+	strict := defaultOpts
+	strict.StrictTemplates = true
+	useUmis := defaultOpts
+	useUmis.UseUmis = true
+	failOnMateMismatch := defaultOpts
+	failOnMateMismatch.FailOnMateMismatch = true
+
+	tests := []struct {
+		name     string
+		records  []*sam.Record
+		opts     Opts
+		expected error
+	}{
+		{
+			"extra primary record",
+			[]*sam.Record{
+				NewRecord("A:::1:10:1:1", chr1, 0, r1F, 50, chr1, cigar0),
+				NewRecord("A:::1:10:1:1", chr1, 0, r1F, 50, chr1, cigar0),
+				NewRecord("A:::1:10:1:1", chr1, 50, r2R, 0, chr1, cigar0),
+			},
+			strict,
+			ErrMalformedTemplate,
+		},
+		{
+			"mismatched mates",
+			[]*sam.Record{
+				NewRecord("A:::1:10:1:1", chr1, 0, r1F, 50, chr1, cigar0),
+				NewRecord("A:::1:10:1:1", chr1, 30, r2R, 300, chr1, cigar0),
+			},
+			failOnMateMismatch,
+			ErrMalformedTemplate,
+		},
+		{
+			"missing mate",
+			[]*sam.Record{
+				NewRecord("A:::1:10:1:1", chr1, 0, r1F, 50, chr1, cigar0),
+				NewRecord("B:::1:10:1:1", chr1, 10, r1F, 60, chr1, cigar0),
+				NewRecord("B:::1:10:1:1", chr1, 60, r2R, 10, chr1, cigar0),
+			},
+			defaultOpts,
+			ErrMissingMate,
+		},
+		{
+			"missing distant mate",
+			[]*sam.Record{
+				NewRecord("A:::1:10:1:1", chr1, 0, r1F, 500, chr2, cigar0),
+			},
+			defaultOpts,
+			ErrMissingMate,
+		},
+		{
+			"name without UMIs",
+			[]*sam.Record{
+				NewRecord("A:::1:10:1:1", chr1, 0, r1F, 50, chr1, cigar0),
+				NewRecord("A:::1:10:1:1", chr1, 50, r2R, 0, chr1, cigar0),
+			},
+			useUmis,
+			ErrMalformedUMI,
+		},
+	}
+
+	tempDir, cleanup := testutil.TempDir(t, "", "")
+	defer cleanup()
+	testIdx := 0
+	for _, test := range tests {
+		for _, format := range []string{"bam", "pam"} {
+			opts := test.opts
+			opts.OutputPath = NewTestOutput(tempDir, testIdx, format)
+			opts.Format = format
+			testIdx++
+			markDuplicates := &MarkDuplicates{
+				Provider: bamprovider.NewFakeProvider(header, test.records),
+				Opts:     &opts,
+			}
+			_, err := markDuplicates.Mark(nil)
+			assert.ErrorIs(t, err, test.expected, "test %s format %s", test.name, format)
+			if format == "bam" {
+				// The partial output is removed.
+				_, err = os.Stat(opts.OutputPath)
+				assert.True(t, os.IsNotExist(err), "test %s", test.name)
+			}
+		}
+	}
+}
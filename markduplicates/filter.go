@@ -0,0 +1,551 @@
+// Copyright 2019 Grail Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package markduplicates
+
+import (
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/Schaudge/hts/sam"
+)
+
+// Filter expressions
+//
+// Opts.FilterExpression selects the reads that Mark keeps, with the
+// subset of the expressions of samtools view --expr that applies to a
+// single record. The reads for which it is false are dropped as they
+// are read: they are not marked, counted in the duplicate metrics, or
+// written, see filter_input.go.
+//
+// An expression combines these operands:
+//
+//	flag, mapq, tlen, ncigar       the fields of the record
+//	pos, endpos, mpos              1-based positions, as in SAM
+//	qlen, rlen                     the lengths of the query and of the
+//	                               alignment on the reference
+//	qname, rname, mrname           the read name and the references
+//	flag.paired, flag.proper_pair, flag.unmap, flag.munmap,
+//	flag.reverse, flag.mreverse, flag.read1, flag.read2,
+//	flag.secondary, flag.qcfail, flag.dup, flag.supplementary
+//	                               1 if the flag is set, 0 otherwise
+//	[XX]                           the value of the aux tag XX
+//	12, 0x400, 1.5, "str"          number and string literals
+//
+// with these operators, by increasing precedence, as in C:
+//
+//	||   &&   |   ^   &   == != =~ !~   < <= > >=   + -   * / %
+//	and the unary ! - ~
+//
+// A record without a tag has no value for it: an arithmetic operation
+// on a missing value is missing, a comparison with one is false, and
+// a missing value is false, so "[AS] >= 20" drops the reads without an
+// AS tag, and "![AS] || [AS] >= 20" keeps them. Numbers are true when
+// they are not zero, and strings always. The comparisons and ! give 1
+// or 0, and "=~" and "!~" match a string with a regular expression
+// literal, in the RE2 syntax of Go rather than POSIX. Bitwise
+// operations are on the integer part of numbers.
+
+// filterValue is the value of a filter expression: missing, a number,
+// or a string.
+type filterValue struct {
+	kind filterKind
+	num  float64
+	str  string
+}
+
+type filterKind int
+
+const (
+	filterMissing filterKind = iota
+	filterNumber
+	filterString
+)
+
+func numberValue(n float64) filterValue { return filterValue{kind: filterNumber, num: n} }
+
+func boolValue(b bool) filterValue {
+	if b {
+		return numberValue(1)
+	}
+	return numberValue(0)
+}
+
+// truth returns the truth of v.
+func (v filterValue) truth() bool {
+	switch v.kind {
+	case filterNumber:
+		return v.num != 0
+	case filterString:
+		return true
+	}
+	return false
+}
+
+// filterNode is a node of the syntax tree of a filter expression.
+type filterNode interface {
+	eval(r *sam.Record) filterValue
+}
+
+// recordFilter is a parsed filter expression. It is safe for concurrent
+// use.
+type recordFilter struct {
+	expr string
+	root filterNode
+}
+
+// parseFilter parses a filter expression, see Opts.FilterExpression.
+func parseFilter(expr string) (*recordFilter, error) {
+	p := &filterParser{expr: expr}
+	if err := p.next(); err != nil {
+		return nil, err
+	}
+	if p.tok.kind == tokenEnd {
+		return nil, fmt.Errorf("filter expression is empty")
+	}
+	root, err := p.parseBinary(0)
+	if err != nil {
+		return nil, err
+	}
+	if p.tok.kind != tokenEnd {
+		return nil, p.errorf("unexpected %q", p.tok.text)
+	}
+	return &recordFilter{expr: expr, root: root}, nil
+}
+
+// keep returns true if the expression is true for r.
+func (f *recordFilter) keep(r *sam.Record) bool {
+	return f.root.eval(r).truth()
+}
+
+type tokenKind int
+
+const (
+	tokenEnd tokenKind = iota
+	tokenNumber
+	tokenString
+	tokenIdent
+	tokenTag
+	tokenOperator
+	tokenLeftParen
+	tokenRightParen
+)
+
+type filterToken struct {
+	kind tokenKind
+	text string
+	num  float64
+	pos  int
+}
+
+// filterParser is a recursive descent parser of filter expressions.
+type filterParser struct {
+	expr string
+	pos  int
+	tok  filterToken
+}
+
+func (p *filterParser) errorf(format string, args ...interface{}) error {
+	return fmt.Errorf("filter expression %q, at %d: %s", p.expr, p.tok.pos+1, fmt.Sprintf(format, args...))
+}
+
+// filterOperators are the operators of the tokenizer, with the two
+// character ones first.
+var filterOperators = []string{"||", "&&", "==", "!=", "=~", "!~", "<=", ">=",
+	"|", "^", "&", "<", ">", "+", "-", "*", "/", "%", "!", "~"}
+
+// next reads the next token into p.tok.
+func (p *filterParser) next() error {
+	for p.pos < len(p.expr) && (p.expr[p.pos] == ' ' || p.expr[p.pos] == '\t' || p.expr[p.pos] == '\n') {
+		p.pos++
+	}
+	start := p.pos
+	p.tok = filterToken{pos: start}
+	if p.pos == len(p.expr) {
+		p.tok.kind = tokenEnd
+		return nil
+	}
+	c := p.expr[p.pos]
+	switch {
+	case c == '(' || c == ')':
+		p.tok.kind, p.tok.text = tokenLeftParen, string(c)
+		if c == ')' {
+			p.tok.kind = tokenRightParen
+		}
+		p.pos++
+	case c == '"' || c == '\'':
+		end := strings.IndexByte(p.expr[p.pos+1:], c)
+		if end < 0 {
+			return p.errorf("unterminated string")
+		}
+		p.tok.kind, p.tok.text = tokenString, p.expr[p.pos+1:p.pos+1+end]
+		p.pos += end + 2
+	case c == '[':
+		end := strings.IndexByte(p.expr[p.pos:], ']')
+		if end < 0 {
+			return p.errorf("unterminated tag")
+		}
+		tag := p.expr[p.pos+1 : p.pos+end]
+		if !validTag(tag) {
+			return p.errorf("invalid tag [%s]", tag)
+		}
+		p.tok.kind, p.tok.text = tokenTag, tag
+		p.pos += end + 1
+	case c >= '0' && c <= '9' || c == '.':
+		for p.pos < len(p.expr) && (isFilterIdentChar(p.expr[p.pos]) || p.expr[p.pos] == '.') {
+			p.pos++
+		}
+		text := p.expr[start:p.pos]
+		p.tok.kind, p.tok.text = tokenNumber, text
+		if n, err := strconv.ParseInt(text, 0, 64); err == nil {
+			p.tok.num = float64(n)
+		} else if f, err := strconv.ParseFloat(text, 64); err == nil {
+			p.tok.num = f
+		} else {
+			return p.errorf("invalid number %s", text)
+		}
+	case c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z':
+		for p.pos < len(p.expr) && (isFilterIdentChar(p.expr[p.pos]) || p.expr[p.pos] == '.') {
+			p.pos++
+		}
+		p.tok.kind, p.tok.text = tokenIdent, p.expr[start:p.pos]
+	default:
+		for _, op := range filterOperators {
+			if strings.HasPrefix(p.expr[p.pos:], op) {
+				p.tok.kind, p.tok.text = tokenOperator, op
+				p.pos += len(op)
+				return nil
+			}
+		}
+		return p.errorf("unexpected %q", string(c))
+	}
+	return nil
+}
+
+func isFilterIdentChar(c byte) bool {
+	return c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9'
+}
+
+// filterPrecedence are the binary operators by increasing precedence.
+var filterPrecedence = [][]string{
+	{"||"},
+	{"&&"},
+	{"|"},
+	{"^"},
+	{"&"},
+	{"==", "!=", "=~", "!~"},
+	{"<", "<=", ">", ">="},
+	{"+", "-"},
+	{"*", "/", "%"},
+}
+
+// parseBinary parses the operators of filterPrecedence[level] and
+// above, left associatively.
+func (p *filterParser) parseBinary(level int) (filterNode, error) {
+	if level == len(filterPrecedence) {
+		return p.parseUnary()
+	}
+	left, err := p.parseBinary(level + 1)
+	if err != nil {
+		return nil, err
+	}
+	for p.tok.kind == tokenOperator && containsString(filterPrecedence[level], p.tok.text) {
+		op := p.tok.text
+		if err := p.next(); err != nil {
+			return nil, err
+		}
+		if op == "=~" || op == "!~" {
+			if p.tok.kind != tokenString {
+				return nil, p.errorf("%s requires a regular expression string", op)
+			}
+			re, err := regexp.Compile(p.tok.text)
+			if err != nil {
+				return nil, p.errorf("invalid regular expression: %v", err)
+			}
+			if err := p.next(); err != nil {
+				return nil, err
+			}
+			left = &matchNode{left: left, re: re, negate: op == "!~"}
+			continue
+		}
+		right, err := p.parseBinary(level + 1)
+		if err != nil {
+			return nil, err
+		}
+		left = &binaryNode{op: op, left: left, right: right}
+	}
+	return left, nil
+}
+
+func (p *filterParser) parseUnary() (filterNode, error) {
+	if p.tok.kind == tokenOperator && (p.tok.text == "!" || p.tok.text == "-" || p.tok.text == "~") {
+		op := p.tok.text
+		if err := p.next(); err != nil {
+			return nil, err
+		}
+		operand, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return &unaryNode{op: op, operand: operand}, nil
+	}
+	return p.parsePrimary()
+}
+
+func (p *filterParser) parsePrimary() (filterNode, error) {
+	tok := p.tok
+	var node filterNode
+	switch tok.kind {
+	case tokenNumber:
+		node = constNode(numberValue(tok.num))
+	case tokenString:
+		node = constNode(filterValue{kind: filterString, str: tok.text})
+	case tokenTag:
+		node = tagNode(sam.NewTag(tok.text))
+	case tokenIdent:
+		field, ok := filterFields[tok.text]
+		if !ok {
+			return nil, p.errorf("unknown field %s", tok.text)
+		}
+		node = field
+	case tokenLeftParen:
+		if err := p.next(); err != nil {
+			return nil, err
+		}
+		inner, err := p.parseBinary(0)
+		if err != nil {
+			return nil, err
+		}
+		if p.tok.kind != tokenRightParen {
+			return nil, p.errorf("missing )")
+		}
+		node = inner
+	case tokenEnd:
+		return nil, p.errorf("unexpected end of expression")
+	default:
+		return nil, p.errorf("unexpected %q", tok.text)
+	}
+	if err := p.next(); err != nil {
+		return nil, err
+	}
+	return node, nil
+}
+
+func containsString(values []string, s string) bool {
+	for _, v := range values {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+type constNode filterValue
+
+func (n constNode) eval(*sam.Record) filterValue { return filterValue(n) }
+
+// fieldNode is a field of the record.
+type fieldNode func(r *sam.Record) filterValue
+
+func (n fieldNode) eval(r *sam.Record) filterValue { return n(r) }
+
+func flagField(flag sam.Flags) fieldNode {
+	return func(r *sam.Record) filterValue { return boolValue((r.Flags & flag) != 0) }
+}
+
+func refName(ref *sam.Reference) filterValue {
+	if ref == nil {
+		return filterValue{kind: filterString, str: "*"}
+	}
+	return filterValue{kind: filterString, str: ref.Name()}
+}
+
+// filterFields are the fields of the records by name.
+var filterFields = map[string]fieldNode{
+	"flag":   func(r *sam.Record) filterValue { return numberValue(float64(r.Flags)) },
+	"mapq":   func(r *sam.Record) filterValue { return numberValue(float64(r.MapQ)) },
+	"tlen":   func(r *sam.Record) filterValue { return numberValue(float64(r.TempLen)) },
+	"ncigar": func(r *sam.Record) filterValue { return numberValue(float64(len(r.Cigar))) },
+	"pos":    func(r *sam.Record) filterValue { return numberValue(float64(r.Pos + 1)) },
+	"endpos": func(r *sam.Record) filterValue { return numberValue(float64(r.End())) },
+	"mpos":   func(r *sam.Record) filterValue { return numberValue(float64(r.MatePos + 1)) },
+	"qlen":   func(r *sam.Record) filterValue { return numberValue(float64(r.Seq.Length)) },
+	"rlen":   func(r *sam.Record) filterValue { return numberValue(float64(r.Len())) },
+	"qname":  func(r *sam.Record) filterValue { return filterValue{kind: filterString, str: r.Name} },
+	"rname":  func(r *sam.Record) filterValue { return refName(r.Ref) },
+	"mrname": func(r *sam.Record) filterValue { return refName(r.MateRef) },
+
+	"flag.paired":        flagField(sam.Paired),
+	"flag.proper_pair":   flagField(sam.ProperPair),
+	"flag.unmap":         flagField(sam.Unmapped),
+	"flag.munmap":        flagField(sam.MateUnmapped),
+	"flag.reverse":       flagField(sam.Reverse),
+	"flag.mreverse":      flagField(sam.MateReverse),
+	"flag.read1":         flagField(sam.Read1),
+	"flag.read2":         flagField(sam.Read2),
+	"flag.secondary":     flagField(sam.Secondary),
+	"flag.qcfail":        flagField(sam.QCFail),
+	"flag.dup":           flagField(sam.Duplicate),
+	"flag.supplementary": flagField(sam.Supplementary),
+}
+
+// tagNode is the value of an aux tag: a number for the integer and
+// float types, a string for the A, Z and H types, and missing if the
+// record does not have the tag or it is an array.
+type tagNode sam.Tag
+
+func (n tagNode) eval(r *sam.Record) filterValue {
+	aux := r.AuxFields.Get(sam.Tag(n))
+	if aux == nil {
+		return filterValue{}
+	}
+	switch aux.Type() {
+	case 'A':
+		return filterValue{kind: filterString, str: string(aux[3])}
+	case 'H':
+		return filterValue{kind: filterString, str: string(aux[3 : len(aux)-1])}
+	}
+	switch v := aux.Value().(type) {
+	case int8:
+		return numberValue(float64(v))
+	case uint8:
+		return numberValue(float64(v))
+	case int16:
+		return numberValue(float64(v))
+	case uint16:
+		return numberValue(float64(v))
+	case int32:
+		return numberValue(float64(v))
+	case uint32:
+		return numberValue(float64(v))
+	case float32:
+		return numberValue(float64(v))
+	case string:
+		return filterValue{kind: filterString, str: v}
+	}
+	return filterValue{}
+}
+
+type unaryNode struct {
+	op      string
+	operand filterNode
+}
+
+func (n *unaryNode) eval(r *sam.Record) filterValue {
+	v := n.operand.eval(r)
+	if n.op == "!" {
+		return boolValue(!v.truth())
+	}
+	if v.kind != filterNumber {
+		return filterValue{}
+	}
+	if n.op == "-" {
+		return numberValue(-v.num)
+	}
+	return numberValue(float64(^int64(v.num)))
+}
+
+type binaryNode struct {
+	op          string
+	left, right filterNode
+}
+
+func (n *binaryNode) eval(r *sam.Record) filterValue {
+	switch n.op {
+	case "||":
+		return boolValue(n.left.eval(r).truth() || n.right.eval(r).truth())
+	case "&&":
+		return boolValue(n.left.eval(r).truth() && n.right.eval(r).truth())
+	}
+	left, right := n.left.eval(r), n.right.eval(r)
+	switch n.op {
+	case "==", "!=", "<", "<=", ">", ">=":
+		var cmp int
+		switch {
+		case left.kind == filterNumber && right.kind == filterNumber:
+			cmp = compareNumbers(left.num, right.num)
+		case left.kind == filterString && right.kind == filterString:
+			cmp = strings.Compare(left.str, right.str)
+		default:
+			return boolValue(false)
+		}
+		switch n.op {
+		case "==":
+			return boolValue(cmp == 0)
+		case "!=":
+			return boolValue(cmp != 0)
+		case "<":
+			return boolValue(cmp < 0)
+		case "<=":
+			return boolValue(cmp <= 0)
+		case ">":
+			return boolValue(cmp > 0)
+		}
+		return boolValue(cmp >= 0)
+	}
+	if left.kind != filterNumber || right.kind != filterNumber {
+		return filterValue{}
+	}
+	a, b := left.num, right.num
+	switch n.op {
+	case "+":
+		return numberValue(a + b)
+	case "-":
+		return numberValue(a - b)
+	case "*":
+		return numberValue(a * b)
+	case "/":
+		if b == 0 {
+			return filterValue{}
+		}
+		return numberValue(a / b)
+	case "%":
+		if b == 0 {
+			return filterValue{}
+		}
+		return numberValue(math.Mod(a, b))
+	case "&":
+		return numberValue(float64(int64(a) & int64(b)))
+	case "|":
+		return numberValue(float64(int64(a) | int64(b)))
+	}
+	return numberValue(float64(int64(a) ^ int64(b)))
+}
+
+func compareNumbers(a, b float64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+// matchNode matches a string with a regular expression.
+type matchNode struct {
+	left   filterNode
+	re     *regexp.Regexp
+	negate bool
+}
+
+func (n *matchNode) eval(r *sam.Record) filterValue {
+	v := n.left.eval(r)
+	if v.kind != filterString {
+		return boolValue(false)
+	}
+	return boolValue(n.re.MatchString(v.str) != n.negate)
+}
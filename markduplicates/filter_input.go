@@ -0,0 +1,219 @@
+// Copyright 2019 Grail Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package markduplicates
+
+import (
+	"sync"
+
+	"github.com/Schaudge/grailbio/encoding/bam"
+	"github.com/Schaudge/grailbio/encoding/bamprovider"
+	"github.com/Schaudge/hts/sam"
+)
+
+// Filtered input
+//
+// With Opts.FilterExpression, the records of coordinate sorted input
+// are read through a filterProvider, which drops the records that the
+// expression rejects from every scan of the input: the scan for the
+// distant mates, the marking, and the secondary duplicates pass. Every
+// scan sees the same records, so the file indexes of the shards stay
+// consistent. The scan for the distant mates, which reads every shard
+// once, also collects the filtered reads in a filterCollector: it
+// counts them in MetricsCollection.FilteredReads, and keeps the names of the filtered
+// primary reads whose mate is mapped, so that the surviving mate, if
+// any, is marked as a fragment, like a read whose mate is unmapped.
+// Its flags and mate fields are written unchanged. The names are kept
+// in memory until Mark returns.
+//
+// Queryname grouped input is read once, through a
+// groupFilterIterator, which filters the records of a template before
+// the first of them is processed, so the mates of the filtered reads
+// are known as they are read.
+
+// filterCollector collects the filtered reads. add is safe for
+// concurrent use, and mateFiltered may be called concurrently once the
+// collection is complete.
+type filterCollector struct {
+	mutex sync.Mutex
+	// counts are the flagstat counts of the filtered reads.
+	counts FlagstatCounts
+	names  map[string]bool
+}
+
+func newFilterCollector() *filterCollector {
+	return &filterCollector{names: make(map[string]bool)}
+}
+
+// add adds the names of the filtered primary reads with a mapped mate,
+// and the counts of the filtered reads, to c.
+func (c *filterCollector) add(names []string, counts *FlagstatCounts) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	for _, name := range names {
+		c.names[name] = true
+	}
+	c.counts.merge(counts)
+}
+
+// mateFiltered returns true if r is a primary read whose mate was
+// filtered.
+func (c *filterCollector) mateFiltered(r *sam.Record) bool {
+	return c != nil && (r.Flags&(sam.Secondary|sam.Supplementary)) == 0 && c.names[r.Name]
+}
+
+// hasNoMappedMate returns true if r is marked as a fragment: its mate is
+// unmapped or missing, or was filtered.
+func (m *MarkDuplicates) hasNoMappedMate(r *sam.Record) bool {
+	return bam.HasNoMappedMate(r) || m.filtered.mateFiltered(r)
+}
+
+// pairedMate returns true if r is a filtered read whose mate must then
+// be marked as a fragment.
+func pairedMate(r *sam.Record) bool {
+	return (r.Flags&(sam.Secondary|sam.Supplementary|sam.Unmapped)) == 0 && !bam.HasNoMappedMate(r)
+}
+
+// filterProvider is a bamprovider.Provider whose iterators drop the
+// records that filter rejects, and add them to collector if it is not
+// nil.
+type filterProvider struct {
+	bamprovider.Provider
+	filter    *recordFilter
+	collector *filterCollector
+}
+
+// NewIterator implements bamprovider.Provider.
+func (p *filterProvider) NewIterator(shard bam.Shard) bamprovider.Iterator {
+	return &filterIterator{
+		Iterator:  p.Provider.NewIterator(shard),
+		filter:    p.filter,
+		collector: p.collector,
+		shard:     shard,
+	}
+}
+
+// filterIterator is an iterator of a filterProvider.
+type filterIterator struct {
+	bamprovider.Iterator
+	filter    *recordFilter
+	collector *filterCollector
+	shard     bam.Shard
+	record    *sam.Record
+	// names and counts are the filtered reads of the shard, which are
+	// added to the collector when the iterator is closed.
+	names  []string
+	counts FlagstatCounts
+}
+
+// Scan moves to the next record that the filter keeps, and returns
+// false at the end.
+func (it *filterIterator) Scan() bool {
+	for it.Iterator.Scan() {
+		r := it.Iterator.Record()
+		if it.filter.keep(r) {
+			it.record = r
+			return true
+		}
+		if it.collector != nil {
+			if it.shard.RecordInShard(r) {
+				it.counts.add(r)
+			}
+			if pairedMate(r) {
+				it.names = append(it.names, r.Name)
+			}
+		}
+		putRecord(r)
+	}
+	return false
+}
+
+// Record returns the record of the last Scan.
+func (it *filterIterator) Record() *sam.Record { return it.record }
+
+// Close implements bamprovider.Iterator.
+func (it *filterIterator) Close() error {
+	if it.collector != nil {
+		it.collector.add(it.names, &it.counts)
+		it.names, it.counts = nil, FlagstatCounts{}
+	}
+	return it.Iterator.Close()
+}
+
+// groupFilterIterator filters the records of queryname grouped input
+// one template at a time.
+type groupFilterIterator struct {
+	recordIterator
+	filter    *recordFilter
+	collector *filterCollector
+	// group are the kept records of the current template, and next
+	// the first record of the next template, if it has been read.
+	group  []*sam.Record
+	next   *sam.Record
+	end    bool
+	record *sam.Record
+}
+
+// Scan moves to the next record that the filter keeps, and returns
+// false at the end.
+func (it *groupFilterIterator) Scan() bool {
+	for len(it.group) == 0 {
+		if it.next == nil {
+			if it.end || !it.recordIterator.Scan() {
+				return false
+			}
+			it.next = it.recordIterator.Record()
+		}
+		name := it.next.Name
+		it.addRecord(it.next)
+		it.next = nil
+		for it.next == nil {
+			if !it.recordIterator.Scan() {
+				it.end = true
+				break
+			}
+			if r := it.recordIterator.Record(); r.Name == name {
+				it.addRecord(r)
+			} else {
+				it.next = r
+			}
+		}
+	}
+	it.record = it.group[0]
+	it.group[0] = nil
+	it.group = it.group[1:]
+	return true
+}
+
+// addRecord adds r to the current template if the filter keeps it.
+// The name of a filtered record is read before it is returned to the
+// free pool.
+func (it *groupFilterIterator) addRecord(r *sam.Record) {
+	if it.filter.keep(r) {
+		it.group = append(it.group, r)
+		return
+	}
+	var (
+		names  []string
+		counts FlagstatCounts
+	)
+	if pairedMate(r) {
+		names = []string{r.Name}
+	}
+	counts.add(r)
+	it.collector.add(names, &counts)
+	putRecord(r)
+}
+
+// Record returns the record of the last Scan.
+func (it *groupFilterIterator) Record() *sam.Record { return it.record }
@@ -0,0 +1,165 @@
+// Copyright 2019 Grail Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package markduplicates
+
+import (
+	"sort"
+	"testing"
+
+	"github.com/Schaudge/hts/sam"
+	"github.com/grailbio/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseFilterErrors(t *testing.T) {
+	for _, test := range []struct {
+		expr     string
+		expected string
+	}{
+		{"", "filter expression is empty"},
+		{"mapq >", "unexpected end of expression"},
+		{"(mapq > 1", "missing )"},
+		{"mapq > 1)", `unexpected ")"`},
+		{"mapq $ 1", `unexpected "$"`},
+		{"mapping_quality > 1", "unknown field mapping_quality"},
+		{"[N] > 1", "invalid tag [N]"},
+		{"[NM > 1", "unterminated tag"},
+		{"qname == 'A", "unterminated string"},
+		{"0x1g > 1", "invalid number 0x1g"},
+		{"qname =~ rname", "=~ requires a regular expression string"},
+		{`qname =~ "("`, "invalid regular expression"},
+	} {
+		_, err := parseFilter(test.expr)
+		if assert.Error(t, err, "expr %q", test.expr) {
+			assert.Contains(t, err.Error(), test.expected, "expr %q", test.expr)
+		}
+	}
+}
+
+func TestFilterKeep(t *testing.T) {
+	// r is a proper pair read1 at SAM position 100, with its mate at
+	// 200, and NM and RG tags but no AS tag.
+	r := NewRecordAux("A:::1:10:1:1", chr1, 99, r1F|sam.ProperPair, 199, chr1, cigar0, NewAux("NM", 3))
+	r.AuxFields = append(r.AuxFields, NewAux("RG", "rg1"))
+	r.MapQ = 40
+	r.TempLen = 110
+
+	for _, test := range []struct {
+		expr     string
+		expected bool
+	}{
+		{"mapq >= 30 && flag.proper_pair", true},
+		{"mapq >= 50", false},
+		{"flag.dup || flag.secondary", false},
+		{"flag & 0x10", false},
+		{"flag & 0x40", true},
+		{"[NM] >= 5", false},
+		{"[NM] < 5", true},
+		{`[RG] == "rg1"`, true},
+		{"[AS] >= 20", false},
+		{"[AS] < 20", false},
+		{"![AS] || [AS] >= 20", true},
+		{"[AS] + 1", false},
+		{`qname =~ "^A:"`, true},
+		{"qname !~ '^A:'", false},
+		{"mapq =~ '4'", false},
+		{`rname == "chr1" && mrname == "chr1"`, true},
+		{"rname == 1", false},
+		{"pos == 100 && mpos == 200 && endpos == 109", true},
+		{"tlen > 100 || tlen < -100", true},
+		{"ncigar == 1 && rlen == 10 && qlen == 0", true},
+		{"1 + 2 * 3 == 7 && (1 + 2) * 3 == 9", true},
+		{"7 % 4 == 3 && 7 / 2 == 3.5", true},
+		{"1 / 0 != 1", false},
+		{"-mapq < 0 && ~0 == -1 && !0", true},
+		{"(3 | 4) == 7 && (0x41 ^ 0x1) == 0x40", true},
+		{"3 | 4 == 7", true},
+		{"0", false},
+		{"'str'", true},
+	} {
+		f, err := parseFilter(test.expr)
+		if assert.NoError(t, err, "expr %q", test.expr) {
+			assert.Equal(t, test.expected, f.keep(r), "expr %q", test.expr)
+		}
+	}
+}
+
+func TestFilterExpression(t *testing.T) {
+	// B and D have a read with a low AS that is filtered, so their
+	// other reads are fragments. D's mates are in different shards.
+	as := func(score int) sam.Aux { return NewAux("AS", score) }
+	coordinateRecords := func() []*sam.Record {
+		return []*sam.Record{
+			NewRecordAux("A:::1:10:1:1", chr1, 0, r1F, 105, chr1, cigar0, as(30)),
+			NewRecordAux("B:::1:10:2:2", chr1, 0, r1F, 105, chr1, cigar0, as(10)),
+			NewRecordAux("A:::1:10:1:1", chr1, 105, r2R, 0, chr1, cigar0, as(30)),
+			NewRecordAux("B:::1:10:2:2", chr1, 105, r2R, 0, chr1, cigar0, as(30)),
+			NewRecordAux("D:::1:10:3:3", chr1, 300, r1F, 500, chr1, cigar0, as(5)),
+			NewRecordAux("D:::1:10:3:3", chr1, 500, r2R, 300, chr1, cigar0, as(30)),
+		}
+	}
+	querynameRecords := func() []*sam.Record {
+		records := coordinateRecords()
+		return []*sam.Record{records[0], records[2], records[1], records[3], records[4], records[5]}
+	}
+
+	tempDir, cleanup := testutil.TempDir(t, "", "")
+	defer cleanup()
+	testIdx := 0
+	for _, test := range []struct {
+		name    string
+		header  *sam.Header
+		records func() []*sam.Record
+	}{
+		{"coordinate", header, coordinateRecords},
+		{"queryname", querynameHeader(t, "@HD\tVN:1.6\tSO:queryname\n"), querynameRecords},
+	} {
+		formats := []string{"bam", "pam"}
+		if test.name == "queryname" {
+			formats = formats[:1]
+		}
+		for _, format := range formats {
+			opts := defaultOpts
+			opts.OutputPath = NewTestOutput(tempDir, testIdx, format)
+			opts.Format = format
+			opts.FilterExpression = "![AS] || [AS] >= 20"
+			testIdx++
+
+			markDuplicates := &MarkDuplicates{
+				Provider: newTestProvider(t, test.header, test.records()),
+				Opts:     &opts,
+			}
+			actualMetrics, err := markDuplicates.Mark(nil)
+			if !assert.NoError(t, err, "%s, format %s", test.name, format) {
+				continue
+			}
+			assert.Equal(t, int64(2), actualMetrics.FilteredReads, "%s, format %s", test.name, format)
+			libraryMetrics := actualMetrics.Get("Unknown Library")
+			assert.Equal(t, 2, libraryMetrics.UnpairedReads, "%s, format %s", test.name, format)
+			assert.Equal(t, 2, libraryMetrics.ReadPairsExamined, "%s, format %s", test.name, format)
+
+			// The filtered reads are not written, and the flags of the
+			// fragments are not changed.
+			var names []string
+			for _, r := range ReadRecords(t, opts.OutputPath) {
+				names = append(names, r.Name[:1])
+				assert.Equal(t, sam.Flags(0), r.Flags&sam.MateUnmapped, "%s, format %s, record %v", test.name,
+					format, r)
+				assert.NotEqual(t, sam.Flags(0), r.Flags&sam.Paired, "%s, format %s, record %v", test.name, format, r)
+			}
+			sort.Strings(names)
+			assert.Equal(t, []string{"A", "A", "B", "D"}, names, "%s, format %s", test.name, format)
+		}
+	}
+}
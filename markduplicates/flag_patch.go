@@ -0,0 +1,302 @@
+// Copyright 2019 Grail Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package markduplicates
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/Schaudge/grailbase/errors"
+	"github.com/Schaudge/grailbase/file"
+	"github.com/Schaudge/grailbio/encoding/bam"
+	"github.com/Schaudge/grailbio/encoding/bamprovider"
+	htsbam "github.com/Schaudge/hts/bam"
+	"github.com/Schaudge/hts/bgzf"
+	"github.com/Schaudge/hts/sam"
+)
+
+// When the output differs from the input only in the duplicate flags,
+// which is the case with the "none" TaggingPolicy, and without the
+// options that add tags or drop records, generateBAM does not encode
+// the records of the output. Instead, it patches the flags of the raw
+// records of the input:
+//
+//  1. The shards are marked as for Opts.MetricsOnly, and the duplicate
+//     flag of each record of the output is kept in a bitset of its
+//     shard, in the order of the input. The few records whose
+//     existing duplicate tags are cleared, see Opts.clearExisting, are
+//     encoded as usual instead, and kept whole.
+//  2. The input is read again as a stream of raw records, from its
+//     uncompressed BGZF payload, and the flag of each record is set or
+//     cleared in place, at its fixed offset in the core of the record,
+//     or the record is replaced by its encoding. The records are then
+//     compressed into new BGZF blocks.
+//
+// The output is the same as that of the slow path byte for byte, but
+// for the boundaries of its BGZF blocks, as long as the input records
+// are encoded as hts encodes them. Opts.NoFlagPatch disables it.
+
+// rawFlagOffset is the offset of the flag in a raw BAM record, after
+// its block_size: refID, pos, l_read_name, mapq, bin, n_cigar_op and
+// flag.
+const rawFlagOffset = 4 + 4 + 1 + 1 + 2 + 2
+
+// flagPatchInput returns the path of the input BAM if the output can
+// be written by patching the flags of its raw records, or "". Since
+// Opts.CoverageMax only drops records in the high coverage intervals
+// that it finds, it takes the slow path only if there are any.
+func (m *MarkDuplicates) flagPatchInput() string {
+	provider, ok := m.Provider.(*bamprovider.BAMProvider)
+	opts := m.Opts
+	if !ok || opts.NoFlagPatch || opts.Regions != "" || opts.taggingPolicy() != taggingPolicyNone ||
+		opts.TagOnlyMode || opts.EmitMITag || opts.addsMateTags() || opts.RemoveDups || opts.DuplicatesOutput != "" ||
+		len(m.highCoverageMap) > 0 || opts.SplitOutputByReference != "" || opts.ProtectedRegionsBED != "" ||
+		opts.FilterExpression != "" || opts.Flagstat {
+		return ""
+	}
+	return provider.Path
+}
+
+// patchedShard holds the output of a shard for patching, see
+// markPatchedShards.
+type patchedShard struct {
+	numReads uint64
+	// n is the number of records of the output so far.
+	n uint64
+	// duplicates is a bitset of the duplicate flags of the records.
+	duplicates []uint64
+	// encoded are the records whose tags are cleared, by their index
+	// in the shard, encoded with their block_size.
+	encoded map[uint64][]byte
+	// cleared are the records read whose tags are cleared, see
+	// clearingIterator.
+	cleared map[*sam.Record]bool
+	buf     bytes.Buffer
+}
+
+func newPatchedShard(numReads uint64) *patchedShard {
+	return &patchedShard{
+		numReads:   numReads,
+		duplicates: make([]uint64, (numReads+63)/64),
+		encoded:    make(map[uint64][]byte),
+		cleared:    make(map[*sam.Record]bool),
+	}
+}
+
+// add records the duplicate flag of r, the next record of the output
+// of the shard, and returns it to the free pool. It is the write
+// callback of processShard.
+func (s *patchedShard) add(r *sam.Record) error {
+	checkRecord(r)
+	if s.n >= s.numReads {
+		return fmt.Errorf("shard has more than its %d records", s.numReads)
+	}
+	if (r.Flags & sam.Duplicate) != 0 {
+		s.duplicates[s.n/64] |= 1 << (s.n % 64)
+	}
+	if s.cleared[r] {
+		delete(s.cleared, r)
+		s.buf.Reset()
+		if err := htsbam.Marshal(r, &s.buf); err != nil {
+			return errors.E(err, fmt.Sprintf("couldn't encode %s", r.Name))
+		}
+		s.encoded[s.n] = append([]byte(nil), s.buf.Bytes()...)
+	}
+	s.n++
+	putRecord(r)
+	return nil
+}
+
+// duplicate returns true if record i of the shard is a duplicate.
+func (s *patchedShard) duplicate(i uint64) bool {
+	return s.duplicates[i/64]&(1<<(i%64)) != 0
+}
+
+// clearingIterator clears the existing duplicate flags and tags of the
+// records of an iterator, as processShard does, so that the records
+// whose tags are cleared are known.
+type clearingIterator struct {
+	bamprovider.Iterator
+	opts   *Opts
+	shard  *patchedShard
+	record *sam.Record
+}
+
+// Scan moves to the next record, and returns false at the end.
+func (it *clearingIterator) Scan() bool {
+	if !it.Iterator.Scan() {
+		return false
+	}
+	r := it.Iterator.Record()
+	n := len(r.AuxFields)
+	it.opts.clearExisting(r)
+	// A record of an earlier Scan may be reused from the free pool.
+	if len(r.AuxFields) != n {
+		it.shard.cleared[r] = true
+	} else {
+		delete(it.shard.cleared, r)
+	}
+	it.record = r
+	return true
+}
+
+// Record returns the record of the last Scan.
+func (it *clearingIterator) Record() *sam.Record { return it.record }
+
+// markPatchedShards marks the duplicates of the shards, and returns
+// their output for patching, by shard index.
+func (m *MarkDuplicates) markPatchedShards(ctx context.Context) ([]*patchedShard, error) {
+	shards := make([]*patchedShard, m.shardInfo.Len())
+	shardChannel := make(chan bam.Shard, len(m.shardList))
+	for _, shard := range m.shardList {
+		shardChannel <- shard
+	}
+	close(shardChannel)
+
+	e := errors.Once{}
+	wg := sync.WaitGroup{}
+	for wi := 0; wi < m.Opts.computeParallelism(); wi++ {
+		wg.Add(1)
+		go func(worker int) {
+			defer wg.Done()
+			for shard := range shardChannel {
+				// After an error, the remaining shards are skipped.
+				e.Set(cancelled(ctx))
+				if e.Err() != nil {
+					continue
+				}
+				ps := newPatchedShard(m.shardInfo.GetInfoByIdx(shard.ShardIdx).NumReads)
+				iter := &clearingIterator{Iterator: m.Provider.NewIterator(shard), opts: m.Opts, shard: ps}
+				if err := m.processShard(ctx, iter, shard, worker, ps.add); err != nil {
+					e.Set(err)
+				} else if ps.n != ps.numReads {
+					e.Set(fmt.Errorf("shard %d has %d records of its %d", shard.ShardIdx, ps.n, ps.numReads))
+				}
+				e.Set(iter.Close())
+				ps.cleared = nil
+				shards[shard.ShardIdx] = ps
+			}
+		}(wi)
+	}
+	wg.Wait()
+	return shards, e.Err()
+}
+
+// writePatchedBAM marks the duplicates of the input BAM at path, and
+// writes it to out with header, with the flags of its raw records
+// patched.
+func (m *MarkDuplicates) writePatchedBAM(ctx context.Context, path string, header *sam.Header, out io.Writer) (err error) {
+	shards, err := m.markPatchedShards(ctx)
+	// Close distantMates to clean up any files it may have created.
+	if err2 := m.distantMates.Close(); err == nil && err2 != nil {
+		err = fmt.Errorf("error while closing distant mates: %v", err2)
+	}
+	if err != nil {
+		return err
+	}
+
+	in, err := file.Open(ctx, path)
+	if err != nil {
+		return err
+	}
+	defer in.Close(ctx) // nolint: errcheck
+	reader, err := bgzf.NewReader(in.Reader(ctx), m.Opts.readParallelism())
+	if err != nil {
+		return err
+	}
+	defer reader.Close() // nolint: errcheck
+	inHeader, err := sam.NewHeader(nil, nil)
+	if err != nil {
+		return err
+	}
+	if err := inHeader.DecodeBinary(reader); err != nil {
+		return errors.E(err, "couldn't read the header of", path)
+	}
+	// The BGZF writer does not write stored blocks, so the uncompressed
+	// output is written as in newBAMWriter.
+	var writer io.WriteCloser = &storedBlockWriter{w: out}
+	if !m.Opts.Uncompressed {
+		if writer, err = bgzf.NewWriterLevel(out, m.Opts.compressionLevel(), m.Opts.writeParallelism()); err != nil {
+			return err
+		}
+	}
+	closed := false
+	defer func() {
+		if !closed {
+			writer.Close() // nolint: errcheck
+		}
+	}()
+	if err := header.EncodeBinary(writer); err != nil {
+		return err
+	}
+
+	// The records of the shards are in the order of the input.
+	var (
+		size   [4]byte
+		record []byte
+		n      uint64
+	)
+	for _, shard := range shards {
+		for i := uint64(0); i < shard.numReads; i++ {
+			if n%cancelCheckInterval == 0 {
+				if err := cancelled(ctx); err != nil {
+					return err
+				}
+			}
+			n++
+			if _, err := io.ReadFull(reader, size[:]); err != nil {
+				return errors.E(err, fmt.Sprintf("couldn't read record %d of %s", n, path))
+			}
+			sz := int(binary.LittleEndian.Uint32(size[:]))
+			if cap(record) < sz {
+				record = make([]byte, sz)
+			}
+			record = record[:sz]
+			if _, err := io.ReadFull(reader, record); err != nil {
+				return errors.E(err, fmt.Sprintf("couldn't read record %d of %s", n, path))
+			}
+			if encoded, ok := shard.encoded[i]; ok {
+				if _, err := writer.Write(encoded); err != nil {
+					return err
+				}
+				continue
+			}
+			if sz < rawFlagOffset+2 {
+				return fmt.Errorf("record %d of %s is truncated", n, path)
+			}
+			flag := binary.LittleEndian.Uint16(record[rawFlagOffset:])
+			if shard.duplicate(i) {
+				flag |= uint16(sam.Duplicate)
+			} else {
+				flag &^= uint16(sam.Duplicate)
+			}
+			binary.LittleEndian.PutUint16(record[rawFlagOffset:], flag)
+			if _, err := writer.Write(size[:]); err != nil {
+				return err
+			}
+			if _, err := writer.Write(record); err != nil {
+				return err
+			}
+		}
+	}
+	if _, err := io.ReadFull(reader, size[:]); err != io.EOF {
+		return fmt.Errorf("%s has more records than its %d shards", path, len(shards))
+	}
+	closed = true
+	return writer.Close()
+}
@@ -0,0 +1,186 @@
+// Copyright 2019 Grail Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package markduplicates
+
+import (
+	"compress/gzip"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/Schaudge/doppelmark/simulate"
+	gbam "github.com/Schaudge/grailbio/encoding/bam"
+	"github.com/Schaudge/grailbio/encoding/bamprovider"
+	"github.com/Schaudge/hts/bgzf"
+	"github.com/grailbio/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+// readUncompressed returns the uncompressed BGZF payload of the BAM at
+// path.
+func readUncompressed(t *testing.T, path string) []byte {
+	in, err := os.Open(path)
+	assert.NoError(t, err)
+	defer in.Close() // nolint: errcheck
+	reader, err := bgzf.NewReader(in, 1)
+	assert.NoError(t, err)
+	payload, err := ioutil.ReadAll(reader)
+	assert.NoError(t, err)
+	assert.NoError(t, reader.Close())
+	return payload
+}
+
+// markFile marks the BAM at path with opts, and returns the
+// MarkDuplicates.
+func markFile(t *testing.T, path string, opts Opts) *MarkDuplicates {
+	opts.BamFile = path
+	opts.IndexFile = path + ".bai"
+	opts.Format = "bam"
+	provider := bamprovider.NewProvider(path, bamprovider.ProviderOpts{Index: opts.IndexFile})
+	defer func() {
+		assert.NoError(t, provider.Close())
+	}()
+	markDuplicates := &MarkDuplicates{
+		Provider: provider,
+		Opts:     &opts,
+	}
+	_, err := markDuplicates.Mark(nil)
+	assert.NoError(t, err)
+	return markDuplicates
+}
+
+func TestFlagPatch(t *testing.T) {
+	tempDir, cleanup := testutil.TempDir(t, "", "")
+	defer cleanup()
+	simOpts := simulate.DefaultOpts
+	simOpts.Pairs = 5000
+	simOpts.InterchromosomalFraction = 0.1
+	simOpts.SecondaryFraction = 0.05
+	simOpts.SupplementaryFraction = 0.05
+	simulatedPath, _, _ := simulated(t, tempDir, simOpts)
+	h, records := readSimulated(t, simulatedPath)
+	input := filepath.Join(tempDir, "input.bam")
+	iter := bamprovider.NewFakeProvider(h, records).NewIterator(gbam.UniversalShard(h))
+	assert.NoError(t, writeIndexedBAM(h, iter, input))
+
+	opts := defaultOpts
+	opts.ShardSize = 100000
+	opts.Padding = 1000
+	opts.TagDups = false
+	opts.OpticalDetector = nil
+	opts.OpticalDuplicatePixelDistance = simOpts.OpticalDistance
+
+	// An input marked with tags, whose tags are cleared, and whose
+	// records are encoded instead of patched.
+	marked := opts
+	marked.OutputPath = filepath.Join(tempDir, "marked.bam")
+	marked.TaggingPolicy = taggingPolicyAll
+	markFile(t, input, marked)
+
+	tests := []struct {
+		name   string
+		input  string
+		modify func(*Opts)
+	}{
+		{"plain", input, func(*Opts) {}},
+		{"secondary dups", input, func(o *Opts) { o.FlagSecondaryDups = true }},
+		{"unmapped mates", input, func(o *Opts) { o.FlagUnmappedMates = true }},
+		{"marked", marked.OutputPath, func(*Opts) {}},
+		{"marked cleared", marked.OutputPath, func(o *Opts) { o.ClearExisting = true }},
+		{"compression", input, func(o *Opts) { o.CompressionLevel = 1 }},
+		{"uncompressed", input, func(o *Opts) { o.Uncompressed = true }},
+		{"max depth not reached", input, func(o *Opts) { o.CoverageMax = 3000000 }},
+	}
+	for testIdx, test := range tests {
+		slow := opts
+		test.modify(&slow)
+		slow.NoFlagPatch = true
+		slow.OutputPath = filepath.Join(tempDir, test.name+"-slow.bam")
+		markFile(t, test.input, slow)
+
+		fast := slow
+		fast.NoFlagPatch = false
+		fast.OutputPath = NewTestOutput(tempDir, testIdx, "bam")
+		assert.NotEmpty(t, markFile(t, test.input, fast).flagPatchInput(), "test %s", test.name)
+
+		assert.Equal(t, readUncompressed(t, slow.OutputPath), readUncompressed(t, fast.OutputPath), "test %s",
+			test.name)
+	}
+
+	// The options that change tags or drop records take the slow path.
+	for _, modify := range []func(*Opts){
+		func(o *Opts) { o.NoFlagPatch = true },
+		func(o *Opts) { o.TaggingPolicy = taggingPolicyAll },
+		func(o *Opts) { o.EmitMITag = true },
+		func(o *Opts) { o.AddMateTags = true },
+		func(o *Opts) { o.AddMateScoreTag = true },
+		func(o *Opts) { o.RemoveDups = true },
+	} {
+		o := opts
+		modify(&o)
+		m := &MarkDuplicates{Provider: bamprovider.NewProvider(input), Opts: &o}
+		assert.Empty(t, m.flagPatchInput())
+	}
+	m := &MarkDuplicates{Provider: bamprovider.NewFakeProvider(h, records), Opts: &opts}
+	assert.Empty(t, m.flagPatchInput())
+
+	// A max depth that drops reads in high coverage intervals takes
+	// the slow path.
+	deep := opts
+	deep.CoverageMax = 1
+	deep.OutputPath = filepath.Join(tempDir, "deep.bam")
+	m = markFile(t, input, deep)
+	assert.NotEmpty(t, m.highCoverageMap)
+	assert.Empty(t, m.flagPatchInput())
+}
+
+// TestFlagPatchCommandLineDefaults checks that the options of the
+// command line defaults, with their max depth, take the fast path.
+func TestFlagPatchCommandLineDefaults(t *testing.T) {
+	tempDir, cleanup := testutil.TempDir(t, "", "")
+	defer cleanup()
+	simOpts := simulate.DefaultOpts
+	simOpts.Pairs = 2000
+	simulatedPath, _, _ := simulated(t, tempDir, simOpts)
+	h, records := readSimulated(t, simulatedPath)
+	input := filepath.Join(tempDir, "input.bam")
+	iter := bamprovider.NewFakeProvider(h, records).NewIterator(gbam.UniversalShard(h))
+	assert.NoError(t, writeIndexedBAM(h, iter, input))
+
+	opts := Opts{
+		ShardSize:                     5000000,
+		MinBases:                      5000,
+		Padding:                       251,
+		Parallelism:                   1,
+		QueueLength:                   10,
+		CompressionLevel:              gzip.DefaultCompression,
+		CompressionThreads:            1,
+		CoverageMax:                   3000000,
+		SplitOutputMaxFiles:           64,
+		ClearTags:                     []string{"DI", "DL", "DS", "DT", "DU"},
+		UMITag:                        "RX",
+		UMISource:                     "tag",
+		UMICorrection:                 "none",
+		UMIUnmatchedPolicy:            "raw",
+		ScavengeUmis:                  -1,
+		PrimarySelection:              "fileidx",
+		PrimaryScorer:                 "baseq",
+		OpticalDuplicatePixelDistance: 100,
+		OutputPath:                    filepath.Join(tempDir, "output.bam"),
+	}
+	m := markFile(t, input, opts)
+	assert.Empty(t, m.highCoverageMap)
+	assert.Equal(t, input, m.flagPatchInput())
+}
@@ -0,0 +1,178 @@
+// Copyright 2019 Grail Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package markduplicates
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/Schaudge/grailbase/errors"
+	"github.com/Schaudge/hts/sam"
+)
+
+// Flagstat summaries
+//
+// With Opts.Flagstat, Mark counts the records like samtools flagstat
+// three times in the same run: as they are read from the input, as
+// they are added to the output by the writers, and as they are removed
+// on the way, by Opts.RemoveDups, Opts.DuplicatesOutput,
+// Opts.FilterExpression or Opts.CoverageMax. Each record is counted in
+// the shard that it belongs to, not in the padding of the others.
+//
+// Since the duplicate flag is the only one that Mark changes, every
+// count but the duplicates of the input must be the sum of those of
+// the output and of the removed records, and so must a checksum of the
+// names, positions and other flags of the records, which catches a
+// record that is lost and another that is duplicated, or a flag that
+// is changed. Otherwise Mark fails with ErrFlagstat, after the output
+// is written, and removes it like after any error.
+
+// FlagstatCounts counts records like samtools flagstat.
+type FlagstatCounts struct {
+	// Total is the number of records, primary or not.
+	Total int64 `json:"total"`
+	// Mapped is the number of the records that are mapped.
+	Mapped int64 `json:"mapped"`
+	// Paired is the number of the primary records that are paired,
+	// and ProperPairs of those that are mapped in a proper pair.
+	Paired      int64 `json:"paired"`
+	ProperPairs int64 `json:"proper_pairs"`
+	// Duplicates is the number of the records that are flagged as
+	// duplicates.
+	Duplicates    int64 `json:"duplicates"`
+	Secondary     int64 `json:"secondary"`
+	Supplementary int64 `json:"supplementary"`
+	// Checksum is the sum of the recordChecksum of the records.
+	Checksum uint64 `json:"-"`
+}
+
+// jsonFlagstat is the flagstat section of the JSON metrics.
+type jsonFlagstat struct {
+	Input   FlagstatCounts `json:"input"`
+	Output  FlagstatCounts `json:"output"`
+	Removed FlagstatCounts `json:"removed"`
+}
+
+// add counts r.
+func (c *FlagstatCounts) add(r *sam.Record) {
+	c.Total++
+	if (r.Flags & sam.Unmapped) == 0 {
+		c.Mapped++
+	}
+	switch {
+	case (r.Flags & sam.Secondary) != 0:
+		c.Secondary++
+	case (r.Flags & sam.Supplementary) != 0:
+		c.Supplementary++
+	case (r.Flags & sam.Paired) != 0:
+		c.Paired++
+		if (r.Flags & (sam.ProperPair | sam.Unmapped)) == sam.ProperPair {
+			c.ProperPairs++
+		}
+	}
+	if (r.Flags & sam.Duplicate) != 0 {
+		c.Duplicates++
+	}
+	c.Checksum += recordChecksum(r)
+}
+
+// merge adds the counts in other to c.
+func (c *FlagstatCounts) merge(other *FlagstatCounts) {
+	c.Total += other.Total
+	c.Mapped += other.Mapped
+	c.Paired += other.Paired
+	c.ProperPairs += other.ProperPairs
+	c.Duplicates += other.Duplicates
+	c.Secondary += other.Secondary
+	c.Supplementary += other.Supplementary
+	c.Checksum += other.Checksum
+}
+
+// recordChecksum returns an FNV-1a hash of the name, the position and
+// the flags but the duplicate flag of r.
+func recordChecksum(r *sam.Record) uint64 {
+	const prime = 1099511628211
+	h := uint64(14695981039346656037)
+	for i := 0; i < len(r.Name); i++ {
+		h ^= uint64(r.Name[i])
+		h *= prime
+	}
+	refID := -1
+	if r.Ref != nil {
+		refID = r.Ref.ID()
+	}
+	h ^= uint64(uint32(refID))<<32 | uint64(uint32(r.Pos))
+	h *= prime
+	h ^= uint64(r.Flags &^ sam.Duplicate)
+	h *= prime
+	return h
+}
+
+// mergeOutputFlagstat adds the counts of the records that a writer
+// added to the output, and removed, to mc.
+func (mc *MetricsCollection) mergeOutputFlagstat(output, removed *FlagstatCounts) {
+	mc.mutex.Lock()
+	defer mc.mutex.Unlock()
+	mc.OutputFlagstat.merge(output)
+	mc.RemovedFlagstat.merge(removed)
+}
+
+// checkFlagstat returns an error of kind ErrFlagstat if the input of
+// globalMetrics is not the sum of its output and removed records.
+func checkFlagstat(globalMetrics *MetricsCollection) error {
+	in, out, removed := &globalMetrics.InputFlagstat, &globalMetrics.OutputFlagstat, &globalMetrics.RemovedFlagstat
+	var problems []string
+	for _, count := range []struct {
+		name                 string
+		input, output, other int64
+	}{
+		{"records", in.Total, out.Total, removed.Total},
+		{"mapped records", in.Mapped, out.Mapped, removed.Mapped},
+		{"paired records", in.Paired, out.Paired, removed.Paired},
+		{"proper pairs", in.ProperPairs, out.ProperPairs, removed.ProperPairs},
+		{"secondary records", in.Secondary, out.Secondary, removed.Secondary},
+		{"supplementary records", in.Supplementary, out.Supplementary, removed.Supplementary},
+	} {
+		if count.input != count.output+count.other {
+			problems = append(problems, fmt.Sprintf("the input has %d %s, but the output %d and %d are removed",
+				count.input, count.name, count.output, count.other))
+		}
+	}
+	if len(problems) == 0 && in.Checksum != out.Checksum+removed.Checksum {
+		problems = append(problems, "the names, positions or flags other than duplicate of the output differ from the input")
+	}
+	if len(problems) == 0 {
+		return nil
+	}
+	return errors.E(ErrFlagstat, strings.Join(problems, "; "))
+}
+
+// flagstatString returns the flagstat summaries as a tab separated
+// table.
+func flagstatString(globalMetrics *MetricsCollection) string {
+	s := "FLAGSTAT\tTOTAL\tMAPPED\tPAIRED\tPROPER_PAIRS\tDUPLICATES\tSECONDARY\tSUPPLEMENTARY\n"
+	for _, row := range []struct {
+		name   string
+		counts *FlagstatCounts
+	}{
+		{"input", &globalMetrics.InputFlagstat},
+		{"output", &globalMetrics.OutputFlagstat},
+		{"removed", &globalMetrics.RemovedFlagstat},
+	} {
+		c := row.counts
+		s += fmt.Sprintf("%s\t%d\t%d\t%d\t%d\t%d\t%d\t%d\n", row.name, c.Total, c.Mapped, c.Paired, c.ProperPairs,
+			c.Duplicates, c.Secondary, c.Supplementary)
+	}
+	return s
+}
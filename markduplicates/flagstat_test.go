@@ -0,0 +1,141 @@
+// Copyright 2019 Grail Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package markduplicates
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/Schaudge/hts/sam"
+	"github.com/grailbio/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCheckFlagstat(t *testing.T) {
+	newRecord := func(name string, flags sam.Flags) *sam.Record {
+		return NewRecord(name, chr1, 0, flags, 105, chr1, cigar0)
+	}
+	for _, test := range []struct {
+		name     string
+		input    []*sam.Record
+		output   []*sam.Record
+		removed  []*sam.Record
+		expected string
+	}{
+		{"duplicate flagged", []*sam.Record{newRecord("A", r1F)}, []*sam.Record{newRecord("A", r1F|sam.Duplicate)},
+			nil, ""},
+		{"duplicate removed", []*sam.Record{newRecord("A", r1F), newRecord("B", r1F)},
+			[]*sam.Record{newRecord("A", r1F)}, []*sam.Record{newRecord("B", r1F|sam.Duplicate)}, ""},
+		{"record lost", []*sam.Record{newRecord("A", r1F), newRecord("B", r1F)}, []*sam.Record{newRecord("A", r1F)},
+			nil, "the input has 2 records, but the output 1 and 0 are removed"},
+		{"proper pair flag changed", []*sam.Record{newRecord("A", r1F)},
+			[]*sam.Record{newRecord("A", r1F|sam.ProperPair)}, nil,
+			"the input has 0 proper pairs, but the output 1 and 0 are removed"},
+		{"qcfail flag changed", []*sam.Record{newRecord("A", r1F)}, []*sam.Record{newRecord("A", r1F|sam.QCFail)},
+			nil, "flags other than duplicate"},
+		{"record replaced", []*sam.Record{newRecord("A", r1F), newRecord("B", r1F)},
+			[]*sam.Record{newRecord("A", r1F), newRecord("A", r1F)}, nil, "names, positions or flags"},
+	} {
+		mc := NewMetricsCollection()
+		for _, r := range test.input {
+			mc.InputFlagstat.add(r)
+		}
+		for _, r := range test.output {
+			mc.OutputFlagstat.add(r)
+		}
+		for _, r := range test.removed {
+			mc.RemovedFlagstat.add(r)
+		}
+		err := checkFlagstat(mc)
+		if test.expected == "" {
+			assert.NoError(t, err, "test %s", test.name)
+			continue
+		}
+		if assert.ErrorIs(t, err, ErrFlagstat, "test %s", test.name) {
+			assert.Contains(t, err.Error(), test.expected, "test %s", test.name)
+		}
+	}
+}
+
+func TestFlagstat(t *testing.T) {
+	// A and B are duplicates, C has an unmapped mate and a secondary
+	// alignment, and E is filtered.
+	coordinateRecords := func() []*sam.Record {
+		return []*sam.Record{
+			NewRecord("A:::1:10:1:1", chr1, 0, r1F, 105, chr1, cigar0),
+			NewRecord("B:::1:11:1:1", chr1, 0, r1F, 105, chr1, cigar0),
+			NewRecord("A:::1:10:1:1", chr1, 105, r2R, 0, chr1, cigar0),
+			NewRecord("B:::1:11:1:1", chr1, 105, r2R, 0, chr1, cigar0),
+			NewRecord("C:::1:10:1:1", chr1, 300, s1F, 300, chr1, cigar0),
+			NewRecord("C:::1:10:1:1", chr1, 300, u2, 300, chr1, cigar0),
+			NewRecord("C:::1:10:1:1", chr1, 400, s1F|sam.Secondary, 300, chr1, cigar0),
+			NewRecord("E:::1:10:1:1", chr1, 500, r1F, 600, chr1, cigar0),
+			NewRecord("E:::1:10:1:1", chr1, 600, r2R, 500, chr1, cigar0),
+		}
+	}
+	querynameRecords := func() []*sam.Record {
+		records := coordinateRecords()
+		return []*sam.Record{records[0], records[2], records[1], records[3], records[4], records[5], records[6],
+			records[7], records[8]}
+	}
+
+	tempDir, cleanup := testutil.TempDir(t, "", "")
+	defer cleanup()
+	testIdx := 0
+	for _, test := range []struct {
+		name    string
+		header  *sam.Header
+		records func() []*sam.Record
+	}{
+		{"coordinate", header, coordinateRecords},
+		{"queryname", querynameHeader(t, "@HD\tVN:1.6\tSO:queryname\n"), querynameRecords},
+	} {
+		formats := []string{"bam", "pam"}
+		if test.name == "queryname" {
+			formats = formats[:1]
+		}
+		for _, format := range formats {
+			opts := defaultOpts
+			opts.OutputPath = NewTestOutput(tempDir, testIdx, format)
+			opts.Format = format
+			opts.RemoveDups = true
+			opts.FilterExpression = `qname !~ "^E"`
+			opts.Flagstat = true
+			testIdx++
+
+			markDuplicates := &MarkDuplicates{
+				Provider: newTestProvider(t, test.header, test.records()),
+				Opts:     &opts,
+			}
+			actualMetrics, err := markDuplicates.Mark(nil)
+			if !assert.NoError(t, err, "%s, format %s", test.name, format) {
+				continue
+			}
+			input, output, removed := actualMetrics.InputFlagstat, actualMetrics.OutputFlagstat,
+				actualMetrics.RemovedFlagstat
+			input.Checksum, output.Checksum, removed.Checksum = 0, 0, 0
+			assert.Equal(t, FlagstatCounts{Total: 9, Mapped: 8, Paired: 8, Secondary: 1}, input,
+				"%s, format %s", test.name, format)
+			assert.Equal(t, FlagstatCounts{Total: 5, Mapped: 4, Paired: 4, Secondary: 1}, output,
+				"%s, format %s", test.name, format)
+			assert.Equal(t, FlagstatCounts{Total: 4, Mapped: 4, Paired: 4, Duplicates: 2}, removed,
+				"%s, format %s", test.name, format)
+			assert.Len(t, ReadRecords(t, opts.OutputPath), 5, "%s, format %s", test.name, format)
+
+			table := flagstatString(actualMetrics)
+			assert.True(t, strings.HasPrefix(table, "FLAGSTAT\tTOTAL\tMAPPED\tPAIRED\tPROPER_PAIRS\tDUPLICATES\t"+
+				"SECONDARY\tSUPPLEMENTARY\ninput\t9\t8\t8\t0\t0\t1\t0\n"), "%s, format %s", test.name, format)
+		}
+	}
+}
@@ -0,0 +1,211 @@
+// Copyright 2019 Grail Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package markduplicates
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/Schaudge/grailbase/errors"
+	"github.com/Schaudge/grailbase/file"
+	"github.com/Schaudge/grailbio/encoding/fasta"
+	"github.com/Schaudge/hts/sam"
+)
+
+// GC content metrics
+//
+// With Opts.GCMetrics, every template that is examined for duplicates
+// is counted as a duplicate or not in the bin of its GC content in
+// MetricsCollection.GCContent, to show the PCR bias against high or
+// low GC fragments. Like the insert sizes, a readpair is counted once,
+// and a read whose mate is unmapped on its own.
+//
+// The GC content of a template is the fraction of the A, C, G and T
+// bases of its reads that are G or C, counted from the packed
+// sequences of the records as the duplicate sets are flagged, without
+// another pass over the input. A read whose sequence is "*" is counted
+// from the bases of the reference under its alignment if
+// Opts.GCReference is set. Otherwise, or if the reference does not
+// have the sequence of the read, its template is counted in
+// MetricsCollection.GCMissingSequence instead.
+
+// gcBins is the number of GC content bins, of 5% each. A template of
+// 100% GC is in the last bin.
+const gcBins = 20
+
+// gcBaseCodes and acgtBaseCodes are 1 for the 4 bit codes of the BAM
+// sequence alphabet "=ACMGRSVTWYHKDBN" of G or C, and of A, C, G or T.
+var (
+	gcBaseCodes   = [16]int{2: 1, 4: 1}
+	acgtBaseCodes = [16]int{1: 1, 2: 1, 4: 1, 8: 1}
+)
+
+// gcContent counts the GC content of templates, see
+// MetricsCollection.AddGCContent.
+type gcContent struct {
+	// reference, if non-nil, is the indexed Opts.GCReference, and
+	// refs is true for the references of the header, by ID, that it
+	// has.
+	reference fasta.Fasta
+	refs      []bool
+	in        file.File
+}
+
+// newGCContent returns the gcContent of Opts.GCMetrics. If path is not
+// empty, it is an indexed FASTA of the references of header, which is
+// kept open until close.
+func newGCContent(ctx context.Context, path string, header *sam.Header) (g *gcContent, err error) {
+	g = &gcContent{}
+	if path == "" {
+		return g, nil
+	}
+	index, err := file.Open(ctx, path+".fai")
+	if err != nil {
+		return nil, errors.E(err, "couldn't open the index of gc-reference:", path)
+	}
+	defer index.Close(ctx) // nolint: errcheck
+	if g.in, err = file.Open(ctx, path); err != nil {
+		return nil, errors.E(err, "couldn't open gc-reference:", path)
+	}
+	if g.reference, err = fasta.NewIndexed(g.in.Reader(ctx), index.Reader(ctx)); err != nil {
+		g.in.Close(ctx) // nolint: errcheck
+		return nil, errors.E(err, "couldn't read the index of gc-reference:", path)
+	}
+	g.refs = make([]bool, len(header.Refs()))
+	for _, ref := range header.Refs() {
+		length, err := g.reference.Len(ref.Name())
+		if err != nil {
+			continue
+		}
+		if length != uint64(ref.Len()) {
+			g.in.Close(ctx) // nolint: errcheck
+			return nil, fmt.Errorf("gc-reference %s: %s has length %d, but %d in the header", path, ref.Name(),
+				length, ref.Len())
+		}
+		g.refs[ref.ID()] = true
+	}
+	return g, nil
+}
+
+// close closes the reference, if any.
+func (g *gcContent) close(ctx context.Context) error {
+	if g.in == nil {
+		return nil
+	}
+	return g.in.Close(ctx)
+}
+
+// count returns the G or C bases and the A, C, G or T bases of r. ok
+// is false if r has no sequence, and it cannot be read from the
+// reference.
+func (g *gcContent) count(r *sam.Record) (gc, bases int, ok bool, err error) {
+	if r.Seq.Length > 0 {
+		for _, d := range r.Seq.Seq {
+			gc += gcBaseCodes[d>>4] + gcBaseCodes[d&0xf]
+			bases += acgtBaseCodes[d>>4] + acgtBaseCodes[d&0xf]
+		}
+		return gc, bases, true, nil
+	}
+	end := r.End()
+	if g.reference == nil || r.Ref == nil || !g.refs[r.Ref.ID()] || end <= r.Pos {
+		return 0, 0, false, nil
+	}
+	seq, err := g.reference.Get(r.Ref.Name(), uint64(r.Pos), uint64(end))
+	if err != nil {
+		return 0, 0, false, errors.E(err, "couldn't read the reference of", r.Name)
+	}
+	for i := 0; i < len(seq); i++ {
+		switch seq[i] {
+		case 'C', 'G', 'c', 'g':
+			gc++
+			bases++
+		case 'A', 'T', 'a', 't':
+			bases++
+		}
+	}
+	return gc, bases, true, nil
+}
+
+// AddGCContent counts the template of records, the reads of a readpair
+// or a read whose mate is unmapped, in the bin of its GC content, or in
+// GCMissingSequence.
+func (mc *MetricsCollection) AddGCContent(g *gcContent, records []*sam.Record, duplicate, optical bool) error {
+	var gc, bases int
+	for _, r := range records {
+		readGC, readBases, ok, err := g.count(r)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			mc.GCMissingSequence.add(duplicate, optical)
+			return nil
+		}
+		gc += readGC
+		bases += readBases
+	}
+	if bases == 0 {
+		mc.GCMissingSequence.add(duplicate, optical)
+		return nil
+	}
+	if len(mc.GCContent) < gcBins {
+		temp := make([]InsertSizeCounts, gcBins)
+		copy(temp, mc.GCContent)
+		mc.GCContent = temp
+	}
+	bin := gc * gcBins / bases
+	if bin == gcBins {
+		bin = gcBins - 1
+	}
+	mc.GCContent[bin].add(duplicate, optical)
+	return nil
+}
+
+// gcContentRow is a row of the GC content table.
+type gcContentRow struct {
+	GCContent         string  `json:"gc_content"`
+	Duplicates        int64   `json:"duplicates"`
+	OpticalDuplicates int64   `json:"optical_duplicates"`
+	NonDuplicates     int64   `json:"non_duplicates"`
+	Rate              float64 `json:"rate"`
+}
+
+// gcContentRows returns a row for each GC content bin, e.g. "40-45"
+// for the templates of at least 40% and less than 45% GC, followed by
+// the "missing" row for the templates without sequence.
+func gcContentRows(globalMetrics *MetricsCollection) []gcContentRow {
+	rows := make([]gcContentRow, 0, gcBins+1)
+	addRow := func(name string, c InsertSizeCounts) {
+		rows = append(rows, gcContentRow{name, c.Duplicates, c.OpticalDuplicates, c.NonDuplicates, c.Rate()})
+	}
+	for i := 0; i < gcBins; i++ {
+		var c InsertSizeCounts
+		if i < len(globalMetrics.GCContent) {
+			c = globalMetrics.GCContent[i]
+		}
+		addRow(fmt.Sprintf("%d-%d", i*100/gcBins, (i+1)*100/gcBins), c)
+	}
+	addRow("missing", globalMetrics.GCMissingSequence)
+	return rows
+}
+
+// gcContentString returns the GC content table as a tab separated
+// table.
+func gcContentString(globalMetrics *MetricsCollection) string {
+	s := "GC_CONTENT\tDUPLICATES\tOPTICAL_DUPLICATES\tNON_DUPLICATES\tPERCENT_DUPLICATION\n"
+	for _, row := range gcContentRows(globalMetrics) {
+		s += fmt.Sprintf("%s\t%d\t%d\t%d\t%0.6f\n", row.GCContent, row.Duplicates, row.OpticalDuplicates,
+			row.NonDuplicates, 100*row.Rate)
+	}
+	return s
+}
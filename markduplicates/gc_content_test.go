@@ -0,0 +1,133 @@
+// Copyright 2019 Grail Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package markduplicates
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/Schaudge/grailbio/encoding/bamprovider"
+	"github.com/Schaudge/hts/sam"
+	"github.com/grailbio/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+// writeFasta writes an indexed FASTA of one line per sequence to path.
+func writeFasta(t *testing.T, path string, names, seqs []string) {
+	var fa, fai strings.Builder
+	for i, name := range names {
+		fmt.Fprintf(&fai, "%s\t%d\t%d\t%d\t%d\n", name, len(seqs[i]), fa.Len()+len(name)+2, len(seqs[i]),
+			len(seqs[i])+1)
+		fmt.Fprintf(&fa, ">%s\n%s\n", name, seqs[i])
+	}
+	assert.NoError(t, ioutil.WriteFile(path, []byte(fa.String()), 0644))
+	assert.NoError(t, ioutil.WriteFile(path+".fai", []byte(fai.String()), 0644))
+}
+
+func TestGCContentCount(t *testing.T) {
+	tempDir, cleanup := testutil.TempDir(t, "", "")
+	defer cleanup()
+	ctx := context.Background()
+	// The reference has chr1, whose first 10 bases are 80% GC, but not
+	// chr2.
+	path := filepath.Join(tempDir, "ref.fa")
+	writeFasta(t, path, []string{"chr1"}, []string{"GGGGGCCCaa" + strings.Repeat("A", 990)})
+
+	withSeq := NewRecordSeq("A:::1:10:1:1", chr1, 0, r1F, 105, chr1, cigar0, "GGCNNAATTA", "IIIIIIIIII")
+	chr1NoSeq := NewRecord("B:::1:10:1:1", chr1, 0, r1F, 105, chr1, cigar0)
+	chr2NoSeq := NewRecord("C:::1:10:1:1", chr2, 0, r1F, 105, chr2, cigar0)
+	for _, test := range []struct {
+		reference string
+		r         *sam.Record
+		gc        int
+		bases     int
+		ok        bool
+	}{
+		{"", withSeq, 3, 8, true},
+		{"", chr1NoSeq, 0, 0, false},
+		{path, withSeq, 3, 8, true},
+		{path, chr1NoSeq, 8, 10, true},
+		{path, chr2NoSeq, 0, 0, false},
+	} {
+		g, err := newGCContent(ctx, test.reference, header)
+		if !assert.NoError(t, err) {
+			continue
+		}
+		gc, bases, ok, err := g.count(test.r)
+		assert.NoError(t, err, "reference %q, record %v", test.reference, test.r)
+		assert.Equal(t, test.gc, gc, "reference %q, record %v", test.reference, test.r)
+		assert.Equal(t, test.bases, bases, "reference %q, record %v", test.reference, test.r)
+		assert.Equal(t, test.ok, ok, "reference %q, record %v", test.reference, test.r)
+		assert.NoError(t, g.close(ctx))
+	}
+
+	// A reference of another length than in the header is another
+	// build.
+	otherPath := filepath.Join(tempDir, "other.fa")
+	writeFasta(t, otherPath, []string{"chr1"}, []string{strings.Repeat("A", 999)})
+	_, err := newGCContent(ctx, otherPath, header)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "chr1 has length 999")
+	}
+}
+
+func TestGCContentMetrics(t *testing.T) {
+	// A and B are 50% GC duplicates, C is a 100% GC read with an
+	// unmapped mate, and D has no sequence.
+	const qual = "IIIIIIIIII"
+	records := []*sam.Record{
+		NewRecordSeq("A:::1:10:1:1", chr1, 0, r1F, 105, chr1, cigar0, "GCGCGAAAAA", qual),
+		NewRecordSeq("B:::1:11:1:1", chr1, 0, r1F, 105, chr1, cigar0, "GCGCGAAAAA", qual),
+		NewRecordSeq("A:::1:10:1:1", chr1, 105, r2R, 0, chr1, cigar0, "TTTTTGCGCG", qual),
+		NewRecordSeq("B:::1:11:1:1", chr1, 105, r2R, 0, chr1, cigar0, "TTTTTGCGCG", qual),
+		NewRecordSeq("C:::1:10:1:1", chr1, 300, s1F, 300, chr1, cigar0, "GGGGGCCCCC", qual),
+		NewRecord("C:::1:10:1:1", chr1, 300, u2, 300, chr1, cigar0),
+		NewRecord("D:::1:10:1:1", chr1, 500, r1F, 600, chr1, cigar0),
+		NewRecord("D:::1:10:1:1", chr1, 600, r2R, 500, chr1, cigar0),
+	}
+
+	tempDir, cleanup := testutil.TempDir(t, "", "")
+	defer cleanup()
+	for testIdx, format := range []string{"bam", "pam"} {
+		provider := bamprovider.NewFakeProvider(header, records)
+		opts := defaultOpts
+		opts.OutputPath = NewTestOutput(tempDir, testIdx, format)
+		opts.Format = format
+		opts.GCMetrics = true
+
+		markDuplicates := &MarkDuplicates{
+			Provider: provider,
+			Opts:     &opts,
+		}
+		actualMetrics, err := markDuplicates.Mark(nil)
+		if !assert.NoError(t, err, "format %s", format) {
+			continue
+		}
+		expected := make([]InsertSizeCounts, gcBins)
+		expected[10] = InsertSizeCounts{1, 0, 1}
+		expected[19] = InsertSizeCounts{0, 0, 1}
+		assert.Equal(t, expected, actualMetrics.GCContent, "format %s", format)
+		assert.Equal(t, InsertSizeCounts{0, 0, 1}, actualMetrics.GCMissingSequence, "format %s", format)
+
+		table := gcContentString(actualMetrics)
+		assert.True(t, strings.HasPrefix(table, "GC_CONTENT\tDUPLICATES\tOPTICAL_DUPLICATES\tNON_DUPLICATES\t"+
+			"PERCENT_DUPLICATION\n0-5\t0\t0\t0\t0.000000\n"), "format %s", format)
+		assert.Contains(t, table, "\n50-55\t1\t0\t1\t50.000000\n", "format %s", format)
+		assert.Contains(t, table, "\n95-100\t0\t0\t1\t0.000000\nmissing\t0\t0\t1\t0.000000\n", "format %s", format)
+	}
+}
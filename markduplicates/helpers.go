@@ -14,7 +14,8 @@
 package markduplicates
 
 import (
-	"github.com/Schaudge/grailbase/log"
+	"fmt"
+
 	"github.com/Schaudge/grailbase/simd"
 	"github.com/Schaudge/grailbio/encoding/bam"
 	"github.com/Schaudge/hts/sam"
@@ -29,6 +30,11 @@ var (
 	dsTag = sam.Tag{'D', 'S'}
 	dtTag = sam.Tag{'D', 'T'}
 	duTag = sam.Tag{'D', 'U'}
+	miTag = sam.Tag{'M', 'I'}
+	mcTag = sam.Tag{'M', 'C'}
+	mqTag = sam.Tag{'M', 'Q'}
+	msTag = sam.Tag{'m', 's'}
+	cgTag = sam.Tag{'C', 'G'}
 )
 
 func mateInPaddedShard(shard *bam.Shard, r *sam.Record) bool {
@@ -49,8 +55,15 @@ func min(x, y int) int {
 	return y
 }
 
+// baseQScore returns the sum of the base qualities of r that are at
+// least 15, like picard's SUM_OF_BASE_QUALITIES scoring strategy. Like
+// picard, which reads them as no qualities, the missing qualities of
+// a read count as 0, see missingQuals.
 func baseQScore(r *sam.Record) int {
-	s := simd.Accumulate8Greater(r.Qual, 14)
+	s := 0
+	if !missingQuals(r) {
+		s = simd.Accumulate8Greater(r.Qual, 14)
+	}
 	s = min(s, 32767/2) // use the same clamping as picard
 	if bam.IsQCFailed(r) {
 		s -= (32768 / 2)
@@ -58,6 +71,13 @@ func baseQScore(r *sam.Record) int {
 	return s
 }
 
+// missingQuals returns true if the base qualities of r are missing,
+// '*' in SAM, and 0xff bytes in BAM, so that they are not summed as
+// qualities of 255.
+func missingQuals(r *sam.Record) bool {
+	return len(r.Qual) > 0 && r.Qual[0] == 0xff
+}
+
 func getReadGroup(r *sam.Record) (string, bool) {
 	aux := r.AuxFields.Get(rgTag)
 	if aux == nil {
@@ -66,46 +86,161 @@ func getReadGroup(r *sam.Record) (string, bool) {
 	return aux.Value().(string), true
 }
 
-// GetLibrary returns the library for the given record's read group.
-// If the library is not defined in readGroupLibrary, returns "Unknown
-// Library".
-func GetLibrary(readGroupLibrary map[string]string, record *sam.Record) string {
-	const unknown = "Unknown Library"
+// readGroupBytes is getReadGroup without the string allocation: it
+// returns the RG tag of r as a slice of its aux field, which must not
+// be modified.
+func readGroupBytes(r *sam.Record) ([]byte, bool) {
+	aux := r.AuxFields.Get(rgTag)
+	if aux == nil {
+		return nil, false
+	}
+	if aux.Type() != 'Z' {
+		return []byte(aux.Value().(string)), true
+	}
+	value := aux[3:]
+	if n := len(value); n > 0 && value[n-1] == 0 {
+		value = value[:n-1]
+	}
+	return value, true
+}
+
+// NoReadGroup is the read group that ReadGroupMetrics reports reads
+// without an RG tag under.
+const NoReadGroup = "No Read Group"
 
-	readGroup, found := getReadGroup(record)
+// readGroupOrDefault returns the read group of r, or NoReadGroup if r
+// has no RG tag.
+func readGroupOrDefault(r *sam.Record) string {
+	readGroup, found := getReadGroup(r)
 	if !found {
-		return unknown
+		return NoReadGroup
 	}
+	return readGroup
+}
 
-	library := readGroupLibrary[readGroup]
+// GetLibrary returns the library for the given record's read group,
+// or of NoReadGroup if it has none. If the library is not defined in
+// readGroupLibrary, returns "Unknown Library".
+func GetLibrary(readGroupLibrary map[string]string, record *sam.Record) string {
+	library := readGroupLibrary[readGroupOrDefault(record)]
 	if library == "" {
-		return unknown
+		return unknownLibrary
 	}
 	return library
 }
 
-func clearDupFlagTags(r *sam.Record) {
+// defaultClearTags are the duplicate tags that are cleared from the
+// input, unless Opts.ClearTags is set.
+var defaultClearTags = []sam.Tag{diTag, dlTag, dsTag, dtTag, duTag}
+
+func clearDupFlagTags(r *sam.Record, tags []sam.Tag) {
 	r.Flags &^= sam.Duplicate
+	clearDupTags(r, tags)
+}
 
-	tagsToRemove := []sam.Tag{diTag, dlTag, dsTag, dtTag, duTag}
-	bam.ClearAuxTags(r, tagsToRemove)
+// clearDupTags removes tags, the duplicate tags, from r, but keeps its
+// duplicate flag.
+func clearDupTags(r *sam.Record, tags []sam.Tag) {
+	bam.ClearAuxTags(r, tags)
 }
 
 // GetR1R2Orientation returns an orientation byte containing
-// orientations for both R1 and R2.
+// orientations for both R1 and R2. The reads of p must be an R1 and an
+// R2, which readPair.addRead ensures.
 func GetR1R2Orientation(p *IndexedPair) Orientation {
 	if p.Left.R.Flags&sam.Read1 == p.Right.R.Flags&sam.Read1 {
-		log.Fatalf("Both reads are first or second for pair: %v %d %d", p.Left.R.Name, p.Left.R.Flags, p.Right.R.Flags)
+		panic(fmt.Sprintf("both reads are first or second for pair: %v %d %d", p.Left.R.Name, p.Left.R.Flags, p.Right.R.Flags))
 	}
 
 	if p.Left.R.Flags&sam.Read1 != 0 {
 		return orientationBytePair(p.Left.R.Flags&sam.Reverse != 0, p.Right.R.Flags&sam.Reverse != 0)
 	} else if p.Right.R.Flags&sam.Read1 != 0 {
 		return orientationBytePair(p.Right.R.Flags&sam.Reverse != 0, p.Left.R.Flags&sam.Reverse != 0)
-	} else {
-		log.Fatalf("Could not find first read in pair: %v", p.Left.R.Name)
 	}
-	return 0
+	panic(fmt.Sprintf("could not find first read in pair: %v", p.Left.R.Name))
+}
+
+// unclippedFivePrimePosition returns the 0-based unclipped 5'
+// position of r, see doc.go. This is the unclipped start of a forward
+// read, and the unclipped end of a reverse read.
+func unclippedFivePrimePosition(r *sam.Record) int {
+	cigar := recordCigar(r)
+	if bam.IsReversedRead(r) {
+		pos := r.End() - 1
+		for i := len(cigar) - 1; i >= 0 && isClip(cigar[i]); i-- {
+			pos += cigar[i].Len()
+		}
+		return pos
+	}
+	pos := r.Pos
+	for i := 0; i < len(cigar) && isClip(cigar[i]); i++ {
+		pos -= cigar[i].Len()
+	}
+	return pos
+}
+
+// clampedFivePrimePosition returns the unclipped 5' position of r
+// clamped to its reference. A read clipped at the start of a reference
+// has a negative unclipped 5' position, and a reverse read clipped at
+// its last base one beyond its length. The clamped position places
+// such reads at the first or last base of the reference, e.g. in the
+// regions of Opts.MetricsRegionsBED, while the duplicate keys keep the
+// unclipped position, so that reads clipped by different lengths past
+// the end of a reference are not duplicates of each other.
+func clampedFivePrimePosition(r *sam.Record) int {
+	pos := unclippedFivePrimePosition(r)
+	if pos < 0 {
+		return 0
+	}
+	if r.Ref != nil && pos >= r.Ref.Len() {
+		return r.Ref.Len() - 1
+	}
+	return pos
+}
+
+// recordCigar returns the CIGAR of r. A read with more CIGAR operations
+// than a BAM record can hold has them in its CG:B,I tag, and a kSmN
+// placeholder CIGAR, where k is the length of the read and m the
+// length of its alignment, see the SAM spec. The placeholder has the
+// alignment end of the read, so only the code that walks the
+// operations needs the CIGAR of the tag.
+func recordCigar(r *sam.Record) sam.Cigar {
+	if !hasPlaceholderCigar(r) {
+		return r.Cigar
+	}
+	aux := r.AuxFields.Get(cgTag)
+	if aux == nil {
+		return r.Cigar
+	}
+	var cigar sam.Cigar
+	switch ops := aux.Value().(type) {
+	case []uint32:
+		cigar = make(sam.Cigar, len(ops))
+		for i, op := range ops {
+			cigar[i] = sam.CigarOp(op)
+		}
+	case []int32:
+		cigar = make(sam.Cigar, len(ops))
+		for i, op := range ops {
+			cigar[i] = sam.CigarOp(op)
+		}
+	default:
+		return r.Cigar
+	}
+	return cigar
+}
+
+// hasPlaceholderCigar returns true if the CIGAR of r is a kSmN
+// placeholder, see recordCigar.
+func hasPlaceholderCigar(r *sam.Record) bool {
+	return len(r.Cigar) == 2 &&
+		r.Cigar[0].Type() == sam.CigarSoftClipped && r.Cigar[0].Len() == r.Seq.Length &&
+		r.Cigar[1].Type() == sam.CigarSkipped
+}
+
+// isClip returns true if op is a soft or hard clip.
+func isClip(op sam.CigarOp) bool {
+	return op.Type() == sam.CigarSoftClipped || op.Type() == sam.CigarHardClipped
 }
 
 // r1Strand returns +1 or -1 depending on the strand if the reads
@@ -14,9 +14,12 @@
 package markduplicates
 
 import (
+	"strings"
 	"testing"
 
+	"github.com/Schaudge/grailbio/encoding/bamprovider"
 	"github.com/Schaudge/hts/sam"
+	"github.com/grailbio/testutil"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -37,7 +40,7 @@ func TestClearDupFlagTags(t *testing.T) {
 		r.AuxFields = append(r.AuxFields, aux)
 	}
 
-	clearDupFlagTags(r)
+	clearDupFlagTags(r, defaultClearTags)
 
 	// Verify flag 1024 has been cleared.
 	assert.Equal(t, r1F, r.Flags)
@@ -54,3 +57,251 @@ func TestClearDupFlagTags(t *testing.T) {
 		assert.Equal(t, aux, r.AuxFields[i])
 	}
 }
+
+func TestUnclippedFivePrimePosition(t *testing.T) {
+	tests := []struct {
+		cigar   string
+		forward int
+		reverse int
+	}{
+		{"10M", 100, 109},
+		{"2S8M", 98, 107},
+		{"8M2S", 100, 109},
+		{"5H2S8M", 93, 107},
+		{"8M2S5H", 100, 114},
+		// Insertions and paddings do not consume the reference, and
+		// end the leading and trailing clips.
+		{"5H3I95M", 95, 194},
+		{"5H2S3I90M", 93, 189},
+		{"3I97M", 100, 196},
+		{"2P3I95M", 100, 194},
+		{"3I2S95M", 100, 194},
+		{"90M3I5H", 100, 194},
+		{"90M2S3I5H", 100, 194},
+		{"10M5D10M", 100, 124},
+		{"5M100N5M", 100, 209},
+	}
+	for _, test := range tests {
+		cigar, err := sam.ParseCigar([]byte(test.cigar))
+		assert.NoError(t, err, "cigar %s", test.cigar)
+		forward := NewRecord("A", chr1, 100, r1F, 300, chr1, cigar)
+		assert.Equal(t, test.forward, unclippedFivePrimePosition(forward), "forward cigar %s", test.cigar)
+		reverse := NewRecord("A", chr1, 100, r2R, 0, chr1, cigar)
+		assert.Equal(t, test.reverse, unclippedFivePrimePosition(reverse), "reverse cigar %s", test.cigar)
+	}
+}
+
+func TestClampedFivePrimePosition(t *testing.T) {
+	chrT, err := sam.NewReference("chrT", "", "", 20, nil, nil)
+	assert.NoError(t, err)
+	tests := []struct {
+		pos       int
+		flags     sam.Flags
+		cigar     string
+		unclipped int
+		clamped   int
+	}{
+		{0, r1F, "3S7M", -3, 0},
+		{2, r1F, "5S5M", -3, 0},
+		{4, r1F, "3S7M", 1, 1},
+		{0, r2R, "3S7M", 6, 6},
+		{15, r2R, "5M4S", 23, 19},
+		{18, r2R, "1M1S", 19, 19},
+		{19, r1F, "1M4S", 19, 19},
+	}
+	for _, test := range tests {
+		cigar, err := sam.ParseCigar([]byte(test.cigar))
+		assert.NoError(t, err, "cigar %s", test.cigar)
+		r := NewRecord("A", chrT, test.pos, test.flags, 0, chrT, cigar)
+		assert.Equal(t, test.unclipped, unclippedFivePrimePosition(r), "pos %d, cigar %s", test.pos, test.cigar)
+		assert.Equal(t, test.clamped, clampedFivePrimePosition(r), "pos %d, cigar %s", test.pos, test.cigar)
+	}
+}
+
+// longReadCigar returns a CIGAR of 70000 operations, more than a BAM
+// record can hold, with 7 bases clipped before the alignment and 3
+// after it.
+func longReadCigar() sam.Cigar {
+	cigar := sam.Cigar{sam.NewCigarOp(sam.CigarSoftClipped, 7)}
+	for i := 0; i < 34999; i++ {
+		cigar = append(cigar, sam.NewCigarOp(sam.CigarMatch, 1), sam.NewCigarOp(sam.CigarDeletion, 1))
+	}
+	return append(cigar, sam.NewCigarOp(sam.CigarSoftClipped, 3))
+}
+
+// newLongRead returns a read with cigar stored in its CG tag, and the
+// kSmN placeholder CIGAR.
+func newLongRead(t *testing.T, name string, ref *sam.Reference, pos int, flags sam.Flags, matePos int,
+	cigar sam.Cigar) *sam.Record {
+	refLength, readLength := cigar.Lengths()
+	ops := make([]uint32, len(cigar))
+	for i, op := range cigar {
+		ops[i] = uint32(op)
+	}
+	cg, err := sam.NewAux(cgTag, ops)
+	assert.NoError(t, err)
+	r := NewRecordSeq(name, ref, pos, flags, matePos, ref, sam.Cigar{
+		sam.NewCigarOp(sam.CigarSoftClipped, readLength),
+		sam.NewCigarOp(sam.CigarSkipped, refLength),
+	}, strings.Repeat("A", readLength), strings.Repeat("I", readLength))
+	r.AuxFields = append(r.AuxFields, cg)
+	return r
+}
+
+func TestRecordCigar(t *testing.T) {
+	cigar := longReadCigar()
+	assert.Equal(t, 70000, len(cigar))
+	refLength, readLength := cigar.Lengths()
+	assert.Equal(t, 35009, readLength)
+	assert.Equal(t, 69998, refLength)
+
+	forward := newLongRead(t, "A", chr1, 100, r1F, 300, cigar)
+	reverse := newLongRead(t, "A", chr1, 100, r2R, 0, cigar)
+	assert.True(t, hasPlaceholderCigar(forward))
+	assert.Equal(t, cigar, recordCigar(forward))
+	assert.Equal(t, 100+refLength, forward.End())
+	assert.Equal(t, 93, unclippedFivePrimePosition(forward))
+	assert.Equal(t, 100+refLength-1+3, unclippedFivePrimePosition(reverse))
+
+	// Without the CG tag, or with a CIGAR that is not a placeholder,
+	// the CIGAR of the record is used.
+	noTag := newLongRead(t, "A", chr1, 100, r1F, 300, cigar)
+	noTag.AuxFields = nil
+	assert.Equal(t, noTag.Cigar, recordCigar(noTag))
+	assert.Equal(t, 100-readLength, unclippedFivePrimePosition(noTag))
+	notPlaceholder := newLongRead(t, "A", chr1, 100, r1F, 300, cigar)
+	notPlaceholder.Cigar = sam.Cigar{sam.NewCigarOp(sam.CigarSoftClipped, 9), sam.NewCigarOp(sam.CigarMatch, readLength-9)}
+	assert.False(t, hasPlaceholderCigar(notPlaceholder))
+	assert.Equal(t, 91, unclippedFivePrimePosition(notPlaceholder))
+	short := NewRecord("A", chr1, 100, r1F, 300, chr1, cigarSoft1)
+	assert.Equal(t, sam.Cigar(cigarSoft1), recordCigar(short))
+}
+
+// Test that readpairs of long reads with their CIGAR in the CG tag are
+// duplicates of the readpairs with the same unclipped 5' positions, on
+// both strands, and that their CG tags are written unchanged.
+func TestLongReadDuplicates(t *testing.T) {
+	chrL, err := sam.NewReference("chrL", "", "", 300000, nil, nil)
+	assert.NoError(t, err)
+	longHeader, err := sam.NewHeader(nil, []*sam.Reference{chrL})
+	assert.NoError(t, err)
+
+	// The unclipped 5' positions of A are 993 and 72000, like those of
+	// B. A has the higher base qualities, so it is the primary.
+	newRecords := func() []*sam.Record {
+		return []*sam.Record{
+			NewRecord("B:::1:20:1:1", chrL, 993, r1F, 71991, chrL, cigar0),
+			newLongRead(t, "A:::1:10:1:1", chrL, 1000, r1F, 2000, longReadCigar()),
+			newLongRead(t, "A:::1:10:1:1", chrL, 2000, r2R, 1000, longReadCigar()),
+			NewRecord("B:::1:20:1:1", chrL, 71991, r2R, 993, chrL, cigar0),
+		}
+	}
+
+	tempDir, cleanup := testutil.TempDir(t, "", "")
+	defer cleanup()
+	for testIdx, format := range []string{"bam", "pam"} {
+		records := newRecords()
+		expectedCG := records[1].AuxFields.Get(cgTag)
+		opts := defaultOpts
+		opts.OutputPath = NewTestOutput(tempDir, testIdx, format)
+		opts.Format = format
+		opts.ShardSize = 1000000
+		opts.Padding = 80000
+
+		markDuplicates := &MarkDuplicates{
+			Provider: bamprovider.NewFakeProvider(longHeader, records),
+			Opts:     &opts,
+		}
+		_, err := markDuplicates.Mark(nil)
+		if format == "pam" {
+			// PAM cannot store the array of the CG tag.
+			if assert.Error(t, err) {
+				assert.Contains(t, err.Error(), "pam output cannot store")
+			}
+			continue
+		}
+		if !assert.NoError(t, err, "format %s", format) {
+			continue
+		}
+
+		actualRecords := ReadRecords(t, opts.OutputPath)
+		assert.Equal(t, 4, len(actualRecords), "format %s", format)
+		for _, r := range actualRecords {
+			assert.Equal(t, r.Name[0] == 'B', r.Flags&sam.Duplicate != 0, "format %s, record %v", format, r.Name)
+			if r.Name[0] == 'A' {
+				assert.Equal(t, expectedCG, r.AuxFields.Get(cgTag), "format %s, record %v", format, r.Name)
+			}
+		}
+	}
+}
+
+func TestMissingQuals(t *testing.T) {
+	missing := NewRecordSeq("A", chr1, 100, r1F, 200, chr1, cigar0, "ACGTACGTAC", strings.Repeat("\xff", 10))
+	// The qualities of BAM records are not offset by 33 as in SAM: four
+	// of 15, five of 10 that are not summed, and one of 40.
+	normal := NewRecordSeq("B", chr1, 100, r1F, 200, chr1, cigar0, "ACGTACGTAC",
+		"\x0f\x0f\x0f\x0f\x0a\x0a\x0a\x0a\x0a\x28")
+	assert.True(t, missingQuals(missing))
+	assert.False(t, missingQuals(normal))
+	assert.False(t, missingQuals(NewRecord("C", chr1, 100, r1F, 200, chr1, cigar0)))
+	assert.Equal(t, 0, baseQScore(missing))
+	assert.Equal(t, 4*15+40, baseQScore(normal))
+	assert.Equal(t, 0, mateScore(missing))
+	assert.Equal(t, 4*15+40, mateScore(normal))
+	missing.Flags |= sam.QCFail
+	assert.Equal(t, -32768/2, baseQScore(missing))
+}
+
+// Test that the readpairs without base qualities score below those
+// with qualities >= 15 in the same duplicate set, and that the primary
+// of a set of readpairs without qualities is chosen the same way
+// whatever the sharding.
+func TestMissingQualityDuplicates(t *testing.T) {
+	noQuals := strings.Repeat("\xff", 10)
+	seq := "ACGTACGTAC"
+	// B is the only readpair with qualities in the set of A, B and C.
+	// D and E have no qualities.
+	newRecords := func() []*sam.Record {
+		return []*sam.Record{
+			NewRecordSeq("A:::1:10:1:1", chr1, 100, r1F, 200, chr1, cigar0, seq, noQuals),
+			NewRecordSeq("B:::1:20:1:1", chr1, 100, r1F, 200, chr1, cigar0, seq, "0000000000"),
+			NewRecordSeq("C:::1:30:1:1", chr1, 100, r1F, 200, chr1, cigar0, seq, noQuals),
+			NewRecordSeq("A:::1:10:1:1", chr1, 200, r2R, 100, chr1, cigar0, seq, noQuals),
+			NewRecordSeq("B:::1:20:1:1", chr1, 200, r2R, 100, chr1, cigar0, seq, "0000000000"),
+			NewRecordSeq("C:::1:30:1:1", chr1, 200, r2R, 100, chr1, cigar0, seq, noQuals),
+			NewRecordSeq("D:::1:40:1:1", chr1, 300, r1F, 400, chr1, cigar0, seq, noQuals),
+			NewRecordSeq("E:::1:50:1:1", chr1, 300, r1F, 400, chr1, cigar0, seq, noQuals),
+			NewRecordSeq("D:::1:40:1:1", chr1, 400, r2R, 300, chr1, cigar0, seq, noQuals),
+			NewRecordSeq("E:::1:50:1:1", chr1, 400, r2R, 300, chr1, cigar0, seq, noQuals),
+		}
+	}
+	expectedPrimaries := map[string]bool{"B": true, "D": true}
+
+	tempDir, cleanup := testutil.TempDir(t, "", "")
+	defer cleanup()
+	testIdx := 0
+	for _, format := range []string{"bam", "pam"} {
+		for _, sharding := range []struct{ shardSize, parallelism int }{{100, 1}, {1000, 1}, {50, 3}} {
+			opts := defaultOpts
+			opts.OutputPath = NewTestOutput(tempDir, testIdx, format)
+			opts.Format = format
+			opts.ShardSize = sharding.shardSize
+			opts.Parallelism = sharding.parallelism
+			testIdx++
+
+			markDuplicates := &MarkDuplicates{
+				Provider: bamprovider.NewFakeProvider(header, newRecords()),
+				Opts:     &opts,
+			}
+			actualMetrics, err := markDuplicates.Mark(nil)
+			if !assert.NoError(t, err, "format %s, sharding %+v", format, sharding) {
+				continue
+			}
+			assert.Equal(t, int64(8), actualMetrics.MissingQualityReads, "format %s, sharding %+v", format, sharding)
+			for _, r := range ReadRecords(t, opts.OutputPath) {
+				assert.Equal(t, !expectedPrimaries[r.Name[:1]], r.Flags&sam.Duplicate != 0,
+					"format %s, sharding %+v, record %v", format, sharding, r)
+			}
+		}
+	}
+}
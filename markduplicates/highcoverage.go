@@ -2,7 +2,6 @@ package markduplicates
 
 import (
 	"github.com/Schaudge/grailbase/intervalmap"
-	"github.com/Schaudge/grailbase/log"
 	"github.com/Schaudge/grailbio/encoding/bam"
 	"github.com/Schaudge/hts/sam"
 )
@@ -49,7 +48,7 @@ func (m *coverageCalculator) Process(shard bam.Shard, r *sam.Record) error {
 	// Unmapped reads do not contribute to coverage counts.
 	counted := 0
 	offset := 0
-	for _, co := range r.Cigar {
+	for _, co := range recordCigar(r) {
 		if co.Type().Consumes().Reference == 1 {
 			for i := 0; i < co.Len() && counted < basesInShard && pos+offset < r.Ref.Len(); i++ {
 				if offset >= basesPreShard {
@@ -75,7 +74,7 @@ func getHighCoverageIntervals(coverage map[int][]int, maxCoverage int) []coverag
 		var start, end, total int
 		for pos := range refCoverage {
 			if refCoverage[pos] > maxCoverage {
-				log.Printf("highcoverage ref %d pos %d depth %d", refId, pos, refCoverage[pos])
+				shardLog.Printf("highcoverage ref %d pos %d depth %d", refId, pos, refCoverage[pos])
 				if pos == 0 || (pos > 0 && refCoverage[pos-1] <= maxCoverage) {
 					start = pos
 					total = 0
@@ -89,7 +88,7 @@ func getHighCoverageIntervals(coverage map[int][]int, maxCoverage int) []coverag
 						end:          end,
 						meanCoverage: float64(total) / float64(end-start),
 					})
-					log.Printf("highcoverage range: %d %d-%d depth %f", refId, start, end,
+					shardLog.Printf("highcoverage range: %d %d-%d depth %f", refId, start, end,
 						float64(total)/float64(end-start))
 				}
 			}
@@ -102,7 +101,7 @@ func getHighCoverageIntervals(coverage map[int][]int, maxCoverage int) []coverag
 						end:          end,
 						meanCoverage: float64(total) / float64(end-start),
 					})
-					log.Printf("highcoverage range: %d %d-%d depth %f", refId, start, end,
+					shardLog.Printf("highcoverage range: %d %d-%d depth %f", refId, start, end,
 						float64(total)/float64(end-start))
 				}
 			}
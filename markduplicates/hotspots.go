@@ -0,0 +1,192 @@
+// Copyright 2019 Grail Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package markduplicates
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/Schaudge/grailbase/errors"
+	"github.com/Schaudge/grailbio/encoding/bam"
+	"github.com/Schaudge/hts/sam"
+)
+
+// Duplication hotspots
+//
+// With Opts.HotspotBED, the loci of the duplicate sets of more than
+// Opts.HotspotMinSetSize readpairs, or unpaired reads for sets without
+// readpairs, are written to a BED file. The interval of a set is the
+// position of its representative, the left read of its primary, plus
+// and minus the length of that read. Overlapping and adjacent
+// intervals are merged, and their counts summed, so a hotspot is
+// listed once however many sets it has. The columns after the interval
+// are the size of the sets, the number of sets, their libraries, and
+// whether they are predominantly optical: whether more than half of
+// their duplicates are optical duplicates.
+//
+// The sets are added by the shard of their representative as they are
+// flagged, the same place the DI and DS tags are set. Only the sets
+// above the threshold are kept, and they are sorted and merged when
+// the file is written at the end of Mark.
+
+// hotspotBEDHeader is the header line of Opts.HotspotBED.
+const hotspotBEDHeader = "#chrom\tstart\tend\tset_size\tsets\tlibrary\tpredominantly_optical\n"
+
+// hotspot is the interval of one or more duplicate sets.
+type hotspot struct {
+	ref        *sam.Reference
+	start, end int
+	// size is the number of readpairs, or unpaired reads, of the sets,
+	// and opticals the number of optical duplicates.
+	size, opticals int
+	sets           int
+	libraries      []string
+}
+
+// duplicates returns the number of duplicates of the sets of h, all
+// the entries except the representative of each set.
+func (h *hotspot) duplicates() int {
+	return h.size - h.sets
+}
+
+// merge adds the sets of other, which starts at or before the end of
+// h, to h.
+func (h *hotspot) merge(other *hotspot) {
+	if other.end > h.end {
+		h.end = other.end
+	}
+	h.size += other.size
+	h.opticals += other.opticals
+	h.sets += other.sets
+	for _, library := range other.libraries {
+		i := sort.SearchStrings(h.libraries, library)
+		if i == len(h.libraries) || h.libraries[i] != library {
+			h.libraries = append(h.libraries, "")
+			copy(h.libraries[i+1:], h.libraries[i:])
+			h.libraries[i] = library
+		}
+	}
+}
+
+// hotspotWriter collects the duplicate sets of more than minSetSize
+// entries, and writes their merged intervals to a BED file when it is
+// closed. It is safe for concurrent use.
+type hotspotWriter struct {
+	path       string
+	minSetSize int
+	f          *os.File
+	hotspots   []*hotspot
+	mutex      sync.Mutex
+}
+
+// newHotspotWriter creates the BED file at path.
+func newHotspotWriter(path string, minSetSize int) (*hotspotWriter, error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, errors.E(err, "Couldn't create hotspot BED:", path)
+	}
+	return &hotspotWriter{path: path, minSetSize: minSetSize, f: f}, nil
+}
+
+// add adds dupSet, if it has more than h.minSetSize entries and its
+// representative is in shard. optDups are the names of the optical
+// duplicates of dupSet.
+func (h *hotspotWriter) add(shard *bam.Shard, readGroups *readGroupTable, dupSet *duplicateSet,
+	optDups map[string]bool, singlesByName, pairsByName map[string]*readPair) {
+	var r *sam.Record
+	size := len(dupSet.pairs)
+	if size > 0 {
+		r = pairsByName[dupSet.pairs[0]].left
+	} else if len(dupSet.singles) > 0 {
+		r = singlesByName[dupSet.singles[0]].left
+		size = len(dupSet.singles)
+	}
+	if r == nil || size <= h.minSetSize || !shard.RecordInShard(r) {
+		return
+	}
+	length := r.Seq.Length
+	if length == 0 {
+		length, _ = recordCigar(r).Lengths()
+	}
+	start, end := r.Pos-length, r.Pos+length
+	if start < 0 {
+		start = 0
+	}
+	if end > r.Ref.Len() {
+		end = r.Ref.Len()
+	}
+
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.hotspots = append(h.hotspots, &hotspot{
+		ref:       r.Ref,
+		start:     start,
+		end:       end,
+		size:      size,
+		opticals:  len(optDups),
+		sets:      1,
+		libraries: []string{readGroups.get(r).library},
+	})
+}
+
+// Close merges the intervals of the sets, and writes them to the BED
+// file.
+func (h *hotspotWriter) Close() (err error) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	defer func() {
+		if err2 := h.f.Close(); err == nil && err2 != nil {
+			err = err2
+		}
+	}()
+	sort.Slice(h.hotspots, func(i, j int) bool {
+		a, b := h.hotspots[i], h.hotspots[j]
+		if a.ref.ID() != b.ref.ID() {
+			return a.ref.ID() < b.ref.ID()
+		}
+		return a.start < b.start
+	})
+	w := bufio.NewWriter(h.f)
+	if _, err = w.WriteString(hotspotBEDHeader); err != nil {
+		return err
+	}
+	write := func(s *hotspot) error {
+		_, err := fmt.Fprintf(w, "%s\t%d\t%d\t%d\t%d\t%s\t%t\n", s.ref.Name(), s.start, s.end, s.size, s.sets,
+			strings.Join(s.libraries, ","), 2*s.opticals > s.duplicates())
+		return err
+	}
+	var current *hotspot
+	for _, s := range h.hotspots {
+		if current != nil && s.ref == current.ref && s.start <= current.end {
+			current.merge(s)
+			continue
+		}
+		if current != nil {
+			if err = write(current); err != nil {
+				return err
+			}
+		}
+		current = s
+	}
+	if current != nil {
+		if err = write(current); err != nil {
+			return err
+		}
+	}
+	return w.Flush()
+}
@@ -0,0 +1,98 @@
+// Copyright 2019 Grail Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package markduplicates
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"testing"
+
+	"github.com/Schaudge/grailbio/encoding/bamprovider"
+	"github.com/Schaudge/hts/sam"
+	"github.com/grailbio/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+// Test that the duplicate sets above the minimum size are written to
+// the hotspot BED, with adjacent sets merged.
+func TestHotspotBED(t *testing.T) {
+	h := newTestHeader(t, "@RG\tID:rg1\tLB:libA\n@RG\tID:rg2\tLB:libB\n")
+	chr1, chr2 := h.Refs()[0], h.Refs()[1]
+	// X and Z are sets of optical duplicates, 10 pixels apart on one
+	// tile. The readpairs of Y are on different tiles. The interval of
+	// Y, chr1:110-130, is adjacent to the one of X, chr1:90-110. W is
+	// not larger than the minimum size.
+	sets := []struct {
+		name      string
+		ref       *sam.Reference
+		pos       int
+		readGroup string
+		pairs     int
+		optical   bool
+	}{
+		{"X", chr1, 100, "rg1", 3, true},
+		{"Y", chr1, 120, "rg2", 4, false},
+		{"W", chr1, 600, "rg1", 2, true},
+		{"Z", chr2, 500, "rg1", 3, true},
+	}
+	newRecords := func() []*sam.Record {
+		var records []*sam.Record
+		for _, set := range sets {
+			rg := NewAux("RG", set.readGroup)
+			for i := 0; i < set.pairs; i++ {
+				name := fmt.Sprintf("%s%d:::1:10:%d:1000", set.name, i, 1000+10*i)
+				if !set.optical {
+					name = fmt.Sprintf("%s%d:::1:%d:1:1", set.name, i, 11+i)
+				}
+				records = append(records,
+					NewRecordAux(name, set.ref, set.pos, r1F, set.pos+200, set.ref, cigar0, rg),
+					NewRecordAux(name, set.ref, set.pos+200, r2R, set.pos, set.ref, cigar0, rg))
+			}
+		}
+		sort.SliceStable(records, func(i, j int) bool {
+			if records[i].Ref.ID() != records[j].Ref.ID() {
+				return records[i].Ref.ID() < records[j].Ref.ID()
+			}
+			return records[i].Pos < records[j].Pos
+		})
+		return records
+	}
+
+	tempDir, cleanup := testutil.TempDir(t, "", "")
+	defer cleanup()
+	for testIdx, format := range []string{"bam", "pam"} {
+		opts := defaultOpts
+		opts.OutputPath = NewTestOutput(tempDir, testIdx, format)
+		opts.Format = format
+		opts.HotspotBED = filepath.Join(tempDir, format+".hotspots.bed")
+		opts.HotspotMinSetSize = 2
+
+		markDuplicates := &MarkDuplicates{
+			Provider: bamprovider.NewFakeProvider(h, newRecords()),
+			Opts:     &opts,
+		}
+		_, err := markDuplicates.Mark(nil)
+		if !assert.NoError(t, err, "format %s", format) {
+			continue
+		}
+		contents, err := ioutil.ReadFile(opts.HotspotBED)
+		assert.NoError(t, err, "format %s", format)
+		assert.Equal(t, hotspotBEDHeader+
+			"chr1\t90\t130\t7\t2\tlibA,libB\tfalse\n"+
+			"chr2\t490\t510\t3\t1\tlibA\ttrue\n",
+			string(contents), "format %s", format)
+	}
+}
@@ -0,0 +1,155 @@
+// Copyright 2019 Grail Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package markduplicates
+
+import (
+	"fmt"
+	"sort"
+)
+
+// defaultInsertSizeBins is the default Opts.InsertSizeBins.
+var defaultInsertSizeBins = []int{100, 200, 300, 400, 500, 600, 700, 800, 900, 1000}
+
+// InsertSizeCounts counts the duplicate and non-duplicate readpairs
+// in an insert size bin. OpticalDuplicates is the number of the
+// duplicates that are optical duplicates, the rest are PCR duplicates.
+type InsertSizeCounts struct {
+	Duplicates        int64
+	OpticalDuplicates int64
+	NonDuplicates     int64
+}
+
+// add counts one readpair.
+func (c *InsertSizeCounts) add(duplicate, optical bool) {
+	if duplicate {
+		c.Duplicates++
+		if optical {
+			c.OpticalDuplicates++
+		}
+	} else {
+		c.NonDuplicates++
+	}
+}
+
+// merge adds the counts in other to c.
+func (c *InsertSizeCounts) merge(other *InsertSizeCounts) {
+	c.Duplicates += other.Duplicates
+	c.OpticalDuplicates += other.OpticalDuplicates
+	c.NonDuplicates += other.NonDuplicates
+}
+
+// total returns the number of readpairs, duplicate or not.
+func (c *InsertSizeCounts) total() int64 {
+	return c.Duplicates + c.NonDuplicates
+}
+
+// Rate returns the fraction of the readpairs that are duplicates.
+func (c *InsertSizeCounts) Rate() float64 {
+	if c.total() == 0 {
+		return 0
+	}
+	return float64(c.Duplicates) / float64(c.total())
+}
+
+// insertSizeBins returns opts.InsertSizeBins, or the default bins if
+// it is empty.
+func insertSizeBins(opts *Opts) []int {
+	if len(opts.InsertSizeBins) == 0 {
+		return defaultInsertSizeBins
+	}
+	return opts.InsertSizeBins
+}
+
+// insertSizeBin returns the index of the bin that contains size. Bin
+// 0 is [0, bins[0]), bin i is [bins[i-1], bins[i]), and the last bin
+// is [bins[len(bins)-1], infinity).
+func insertSizeBin(bins []int, size int) int {
+	return sort.Search(len(bins), func(i int) bool { return bins[i] > size })
+}
+
+// insertSizeBinName returns a name for bin i, e.g. "100-200", or
+// "1000+" for the last bin.
+func insertSizeBinName(bins []int, i int) string {
+	lower := 0
+	if i > 0 {
+		lower = bins[i-1]
+	}
+	if i == len(bins) {
+		return fmt.Sprintf("%d+", lower)
+	}
+	return fmt.Sprintf("%d-%d", lower, bins[i])
+}
+
+// insertSize returns the distance between the unclipped 5' positions
+// of the reads of p. Both reads must be on the same reference.
+func insertSize(p *readPair) int {
+	return abs(unclippedFivePrimePosition(p.right) - unclippedFivePrimePosition(p.left))
+}
+
+// AddInsertSize counts a readpair in the insert size bin of p.
+// Readpairs on different references are counted in
+// TransInsertSizes.
+func (mc *MetricsCollection) AddInsertSize(bins []int, p *readPair, duplicate, optical bool) {
+	if p.left.Ref.ID() != p.right.Ref.ID() {
+		mc.TransInsertSizes.add(duplicate, optical)
+		return
+	}
+	if len(mc.InsertSizes) < len(bins)+1 {
+		temp := make([]InsertSizeCounts, len(bins)+1)
+		copy(temp, mc.InsertSizes)
+		mc.InsertSizes = temp
+	}
+	mc.InsertSizes[insertSizeBin(bins, insertSize(p))].add(duplicate, optical)
+}
+
+// insertSizeRow is a row of the insert size table.
+type insertSizeRow struct {
+	InsertSize        string  `json:"insert_size"`
+	Duplicates        int64   `json:"duplicates"`
+	OpticalDuplicates int64   `json:"optical_duplicates"`
+	NonDuplicates     int64   `json:"non_duplicates"`
+	Rate              float64 `json:"rate"`
+}
+
+// insertSizeRows returns a row for each insert size bin, followed by
+// the "trans" row for readpairs on different references and the
+// "unpaired" row for reads with an unmapped mate.
+func insertSizeRows(opts *Opts, globalMetrics *MetricsCollection) []insertSizeRow {
+	bins := insertSizeBins(opts)
+	rows := make([]insertSizeRow, 0, len(bins)+3)
+	addRow := func(name string, c InsertSizeCounts) {
+		rows = append(rows, insertSizeRow{name, c.Duplicates, c.OpticalDuplicates, c.NonDuplicates, c.Rate()})
+	}
+	for i := 0; i <= len(bins); i++ {
+		var c InsertSizeCounts
+		if i < len(globalMetrics.InsertSizes) {
+			c = globalMetrics.InsertSizes[i]
+		}
+		addRow(insertSizeBinName(bins, i), c)
+	}
+	addRow("trans", globalMetrics.TransInsertSizes)
+	addRow("unpaired", globalMetrics.UnpairedInsertSizes)
+	return rows
+}
+
+// insertSizeString returns the insert size table as a tab separated
+// table.
+func insertSizeString(opts *Opts, globalMetrics *MetricsCollection) string {
+	s := "INSERT_SIZE\tDUPLICATES\tOPTICAL_DUPLICATES\tNON_DUPLICATES\tPERCENT_DUPLICATION\n"
+	for _, row := range insertSizeRows(opts, globalMetrics) {
+		s += fmt.Sprintf("%s\t%d\t%d\t%d\t%0.6f\n", row.InsertSize, row.Duplicates, row.OpticalDuplicates,
+			row.NonDuplicates, 100*row.Rate)
+	}
+	return s
+}
@@ -0,0 +1,92 @@
+// Copyright 2019 Grail Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package markduplicates
+
+import (
+	"testing"
+
+	"github.com/Schaudge/grailbio/encoding/bamprovider"
+	"github.com/Schaudge/hts/sam"
+	"github.com/grailbio/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestInsertSizeBin(t *testing.T) {
+	bins := []int{100, 200, 1000}
+	tests := []struct {
+		size int
+		bin  int
+		name string
+	}{
+		{0, 0, "0-100"},
+		{99, 0, "0-100"},
+		{100, 1, "100-200"},
+		{999, 2, "200-1000"},
+		{1000, 3, "1000+"},
+		{100000, 3, "1000+"},
+	}
+	for _, test := range tests {
+		bin := insertSizeBin(bins, test.size)
+		assert.Equal(t, test.bin, bin, "size %d", test.size)
+		assert.Equal(t, test.name, insertSizeBinName(bins, bin), "size %d", test.size)
+	}
+}
+
+func TestInsertSizeMetrics(t *testing.T) {
+	// A and B are duplicates with an insert size above 100, C has an
+	// insert size below 50, T is on two references, and U has an
+	// unmapped mate.
+	records := []*sam.Record{
+		NewRecord("A:::1:10:1:1", chr1, 0, r1F, 105, chr1, cigar0),
+		NewRecord("B:::1:11:1:1", chr1, 0, r1F, 105, chr1, cigar0),
+		NewRecord("A:::1:10:1:1", chr1, 105, r2R, 0, chr1, cigar0),
+		NewRecord("B:::1:11:1:1", chr1, 105, r2R, 0, chr1, cigar0),
+		NewRecord("C:::1:10:1:1", chr1, 300, r1F, 330, chr1, cigar0),
+		NewRecord("C:::1:10:1:1", chr1, 330, r2R, 300, chr1, cigar0),
+		NewRecord("T:::1:10:1:1", chr1, 500, r1F, 10, chr2, cigar0),
+		NewRecord("U:::1:10:1:1", chr1, 600, s1F, 0, nil, cigar0),
+		NewRecord("U:::1:10:1:1", chr1, 600, u2, 0, nil, cigar0),
+		NewRecord("T:::1:10:1:1", chr2, 10, r2R, 500, chr1, cigar0),
+	}
+
+	tempDir, cleanup := testutil.TempDir(t, "", "")
+	defer cleanup()
+	for testIdx, format := range []string{"bam", "pam"} {
+		provider := bamprovider.NewFakeProvider(header, records)
+		opts := defaultOpts
+		opts.OutputPath = NewTestOutput(tempDir, testIdx, format)
+		opts.Format = format
+		opts.InsertSizeBins = []int{50, 100, 200}
+
+		markDuplicates := &MarkDuplicates{
+			Provider: provider,
+			Opts:     &opts,
+		}
+		actualMetrics, err := markDuplicates.Mark(nil)
+		assert.NoError(t, err)
+		assert.Equal(t, []InsertSizeCounts{{0, 0, 1}, {0, 0, 0}, {1, 0, 1}, {0, 0, 0}}, actualMetrics.InsertSizes,
+			"format %s", format)
+		assert.Equal(t, InsertSizeCounts{0, 0, 1}, actualMetrics.TransInsertSizes, "format %s", format)
+		assert.Equal(t, InsertSizeCounts{0, 0, 1}, actualMetrics.UnpairedInsertSizes, "format %s", format)
+
+		assert.Equal(t, "INSERT_SIZE\tDUPLICATES\tOPTICAL_DUPLICATES\tNON_DUPLICATES\tPERCENT_DUPLICATION\n"+
+			"0-50\t0\t0\t1\t0.000000\n"+
+			"50-100\t0\t0\t0\t0.000000\n"+
+			"100-200\t1\t0\t1\t50.000000\n"+
+			"200+\t0\t0\t0\t0.000000\n"+
+			"trans\t0\t0\t1\t0.000000\n"+
+			"unpaired\t0\t0\t1\t0.000000\n",
+			insertSizeString(&opts, actualMetrics), "format %s", format)
+	}
+}
@@ -0,0 +1,97 @@
+// Copyright 2019 Grail Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package markduplicates
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	"github.com/Schaudge/grailbase/errors"
+	"github.com/Schaudge/grailbase/file"
+	"github.com/Schaudge/hts/sam"
+)
+
+// unknownLibrary is the library of the reads without a library, unless
+// Opts.DefaultLibrary is set.
+const unknownLibrary = "Unknown Library"
+
+// readLibraryMap reads the library map file at path.
+func readLibraryMap(ctx context.Context, path string) (libraries map[string]string, err error) {
+	in, err := file.Open(ctx, path)
+	if err != nil {
+		return nil, errors.E(err, "couldn't open library map:", path)
+	}
+	defer func() {
+		if err2 := in.Close(ctx); err == nil && err2 != nil {
+			err = err2
+		}
+	}()
+	data, err := ioutil.ReadAll(in.Reader(ctx))
+	if err != nil {
+		return nil, errors.E(err, "couldn't read library map:", path)
+	}
+	libraries, err = parseLibraryMap(data)
+	if err != nil {
+		return nil, errors.E(err, "invalid library map:", path)
+	}
+	return libraries, nil
+}
+
+// parseLibraryMap returns the libraries of the read groups in data,
+// one read group and its library per line, separated by whitespace.
+// Empty lines are ignored.
+func parseLibraryMap(data []byte) (map[string]string, error) {
+	libraries := make(map[string]string)
+	for i, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("line %d (%s) must have a read group and a library", i+1, strings.TrimSpace(line))
+		}
+		if _, ok := libraries[fields[0]]; ok {
+			return nil, fmt.Errorf("duplicate read group %s", fields[0])
+		}
+		libraries[fields[0]] = fields[1]
+	}
+	return libraries, nil
+}
+
+// readGroupLibraries returns the libraries of the read groups of
+// header: their LB fields, overridden by opts.LibraryMap. The read
+// groups without a library, and NoReadGroup, are in
+// opts.DefaultLibrary.
+func readGroupLibraries(header *sam.Header, opts *Opts) map[string]string {
+	defaultLibrary := opts.DefaultLibrary
+	if defaultLibrary == "" {
+		defaultLibrary = unknownLibrary
+	}
+	readGroupLibrary := make(map[string]string)
+	for _, readGroup := range header.RGs() {
+		readGroupLibrary[readGroup.Name()] = readGroup.Library()
+	}
+	for readGroup, library := range opts.LibraryMap {
+		readGroupLibrary[readGroup] = library
+	}
+	for readGroup, library := range readGroupLibrary {
+		if library == "" {
+			readGroupLibrary[readGroup] = defaultLibrary
+		}
+	}
+	readGroupLibrary[NoReadGroup] = defaultLibrary
+	return readGroupLibrary
+}
@@ -28,10 +28,12 @@ import (
 	"errors"
 	"fmt"
 	"math"
-
-	"github.com/Schaudge/grailbase/log"
 )
 
+// errNoDuplicates is returned by estimateLibrarySize when there are no
+// duplicate read pairs, so the library size cannot be estimated.
+var errNoDuplicates = errors.New("no duplicates")
+
 /**
  * Estimates the size of a library based on the number of paired end molecules observed
  * and the number of unique pairs observed.
@@ -41,23 +43,27 @@ import (
  *   X = number of distinct molecules in library
  *   N = number of read pairs
  *   C = number of distinct fragments observed in read pairs
+ * Returns errNoDuplicates if there are no read pairs, or no duplicate
+ * read pairs, and an error if there are no unique read pairs.
  */
 func estimateLibrarySize(readPairs, uniqueReadPairs uint64) (uint64, error) {
 	f := func(x, c, n float64) float64 {
 		return c/x + math.Expm1(-n/x)
 	}
 
+	if uniqueReadPairs > readPairs {
+		return 0, fmt.Errorf("invalid values for pairs and unique pairs: %v, %v", readPairs, uniqueReadPairs)
+	}
 	readPairDuplicates := readPairs - uniqueReadPairs
 	if readPairs > 0 && readPairDuplicates > 0 {
+		if uniqueReadPairs == 0 {
+			return 0, fmt.Errorf("no unique read pairs among %v read pairs", readPairs)
+		}
 		n := float64(readPairs)
 		c := float64(uniqueReadPairs)
 		m := float64(1.0)
 		M := float64(100.0)
 
-		if c >= n || f(m*c, c, n) < 0 {
-			log.Fatalf("Invalid values for pairs and unique pairs: %v, %v", n, c)
-		}
-
 		// If c and n are large and almost equal, M can go to +Inf
 		// before f() becomes negative.  If that happens, break out,
 		// and set M to +Inf-1 to avoid looping indefinitely.  The
@@ -83,5 +89,5 @@ func estimateLibrarySize(readPairs, uniqueReadPairs uint64) (uint64, error) {
 		}
 		return uint64(c * (m + M) / 2.0), nil
 	}
-	return 0, errors.New("no duplicates")
+	return 0, errNoDuplicates
 }
@@ -27,6 +27,13 @@ func TestEstimateLibrarySize(t *testing.T) {
 	}{
 		{1000000, 800000, 2154184},
 		{171512300, 171512299, 14708234445116054},
+		// Solutions of C/X = 1 - exp(-N/X), computed by hand and
+		// truncated.
+		{10, 5, 6},
+		{100, 90, 466},
+		{1000, 999, 499666},
+		// All but one read pair are duplicates.
+		{2, 1, 1},
 	}
 
 	for _, test := range tests {
@@ -35,3 +42,18 @@ func TestEstimateLibrarySize(t *testing.T) {
 		assert.InEpsilon(t, test.expected, v, 0.0000000001)
 	}
 }
+
+func TestEstimateLibrarySizeErrors(t *testing.T) {
+	_, err := estimateLibrarySize(0, 0)
+	assert.Equal(t, errNoDuplicates, err)
+	_, err = estimateLibrarySize(100, 100)
+	assert.Equal(t, errNoDuplicates, err)
+
+	// All read pairs are duplicates.
+	_, err = estimateLibrarySize(100, 0)
+	assert.Error(t, err)
+	assert.NotEqual(t, errNoDuplicates, err)
+
+	_, err = estimateLibrarySize(100, 101)
+	assert.Error(t, err)
+}
@@ -0,0 +1,127 @@
+// Copyright 2019 Grail Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package markduplicates
+
+import (
+	"testing"
+
+	"github.com/Schaudge/hts/sam"
+	"github.com/stretchr/testify/assert"
+)
+
+// libraryHeader returns a header whose read groups rg1 and rg2 are in
+// the libraries lib1 and lib2, and rg3 has no library.
+func libraryHeader(t *testing.T) *sam.Header {
+	return newTestHeader(t, "@RG\tID:rg1\tLB:lib1\n@RG\tID:rg2\tLB:lib2\n@RG\tID:rg3\n")
+}
+
+func TestParseLibraryMap(t *testing.T) {
+	tests := []struct {
+		data     string
+		expected map[string]string
+		err      string
+	}{
+		{"rg1\tlib1\n\nrg2 lib1\r\n", map[string]string{"rg1": "lib1", "rg2": "lib1"}, ""},
+		{"", map[string]string{}, ""},
+		{"rg1\tlib1\nrg2\n", nil, "line 2 (rg2) must have a read group and a library"},
+		{"rg1\tlib1\nrg1\tlib2\n", nil, "duplicate read group rg1"},
+	}
+	for _, test := range tests {
+		libraries, err := parseLibraryMap([]byte(test.data))
+		if test.err != "" {
+			assert.Error(t, err, "data %q", test.data)
+			if err != nil {
+				assert.Contains(t, err.Error(), test.err, "data %q", test.data)
+			}
+			continue
+		}
+		assert.NoError(t, err, "data %q", test.data)
+		assert.Equal(t, test.expected, libraries, "data %q", test.data)
+	}
+}
+
+func TestReadGroupLibraries(t *testing.T) {
+	h := libraryHeader(t)
+	assert.Equal(t, map[string]string{
+		"rg1": "lib1", "rg2": "lib2", "rg3": "Unknown Library", NoReadGroup: "Unknown Library",
+	}, readGroupLibraries(h, &Opts{}))
+	assert.Equal(t, map[string]string{
+		"rg1": "lib1", "rg2": "lib1", "rg3": "libX", "rg4": "lib4", NoReadGroup: "libX",
+	}, readGroupLibraries(h, &Opts{
+		DefaultLibrary: "libX",
+		LibraryMap:     map[string]string{"rg2": "lib1", "rg4": "lib4"},
+	}))
+
+	readGroupLibrary := readGroupLibraries(h, &Opts{DefaultLibrary: "libX"})
+	assert.Equal(t, "lib2", GetLibrary(readGroupLibrary, NewRecordAux("A", chr1, 0, r1F, 10, chr1, cigar0,
+		NewAux("RG", "rg2"))))
+	assert.Equal(t, "libX", GetLibrary(readGroupLibrary, NewRecord("A", chr1, 0, r1F, 10, chr1, cigar0)))
+	assert.Equal(t, "Unknown Library", GetLibrary(readGroupLibrary, NewRecordAux("A", chr1, 0, r1F, 10, chr1,
+		cigar0, NewAux("RG", "rg5"))))
+}
+
+func TestLibraryDuplicates(t *testing.T) {
+	// A and C are in lib1, and B in lib2, at the same position. D has
+	// no read group, and E's read group has no library.
+	records := func() []*sam.Record {
+		var records []*sam.Record
+		for _, read := range []struct {
+			flags   sam.Flags
+			pos     int
+			matePos int
+		}{
+			{r1F, 0, 10},
+			{r2R, 10, 0},
+		} {
+			for _, template := range []struct {
+				name, readGroup string
+			}{
+				{"A:::1:10:1:1", "rg1"},
+				{"B:::1:10:1:1", "rg2"},
+				{"C:::1:10:1:1", "rg1"},
+				{"D:::1:10:1:1", ""},
+				{"E:::1:10:1:1", "rg3"},
+			} {
+				r := NewRecord(template.name, chr1, read.pos, read.flags, read.matePos, chr1, cigar0)
+				if template.readGroup != "" {
+					r.AuxFields = append(r.AuxFields, NewAux("RG", template.readGroup))
+				}
+				records = append(records, r)
+			}
+		}
+		return records
+	}
+	mapped := defaultOpts
+	mapped.LibraryMap = map[string]string{"rg2": "lib1", "rg3": "lib3"}
+	defaultLibrary := defaultOpts
+	defaultLibrary.DefaultLibrary = "lib1"
+
+	for _, test := range []struct {
+		opts Opts
+		dups []bool
+	}{
+		// B is alone in lib2, and D and E are in the unknown library.
+		{defaultOpts, []bool{false, false, true, false, true}},
+		// B is in lib1, and E in lib3.
+		{mapped, []bool{false, true, true, false, false}},
+		// D and E are in lib1.
+		{defaultLibrary, []bool{false, false, true, true, true}},
+	} {
+		var trecords []TestRecord
+		for i, r := range records() {
+			trecords = append(trecords, TestRecord{R: r, DupFlag: test.dups[i%len(test.dups)]})
+		}
+		RunTestCases(t, libraryHeader(t), []TestCase{{trecords, test.opts}})
+	}
+}
@@ -0,0 +1,89 @@
+// Copyright 2019 Grail Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package markduplicates
+
+import (
+	"fmt"
+	"regexp"
+)
+
+// LocationParser parses a read's physical location on the flowcell
+// from its name. Mark-duplicates uses the LocationParser in Opts for
+// the optical histogram, and TileOpticalDetector uses its own.
+type LocationParser interface {
+	Parse(qname string) (PhysicalLocation, error)
+}
+
+// DefaultLocationParser accepts every read name format known to
+// ParseLocation. It is used when no LocationParser is configured.
+type DefaultLocationParser struct{}
+
+// Parse implements LocationParser.
+func (DefaultLocationParser) Parse(qname string) (PhysicalLocation, error) {
+	return ParseLocation(qname)
+}
+
+// IlluminaLocationParser parses ':' separated Illumina read names
+// with 4 or 5 digit tile names, see ParseLocation.
+type IlluminaLocationParser struct{}
+
+// Parse implements LocationParser.
+func (IlluminaLocationParser) Parse(qname string) (PhysicalLocation, error) {
+	location, err := parseColonLocation(normalizeName(qname))
+	if err == nil && isGeneMindTile(location.TileName) {
+		return location, fmt.Errorf("could not parse name: %s, %s is not an Illumina tile name",
+			qname, location.TileName)
+	}
+	return location, err
+}
+
+// GeneMindLocationParser parses ':' separated GeneMind read names,
+// whose tile name is an FOV name of the form R###C###.
+type GeneMindLocationParser struct{}
+
+// Parse implements LocationParser.
+func (GeneMindLocationParser) Parse(qname string) (PhysicalLocation, error) {
+	location, err := parseColonLocation(normalizeName(qname))
+	if err == nil && !isGeneMindTile(location.TileName) {
+		return location, fmt.Errorf("could not parse name: %s, %s is not a GeneMind FOV name",
+			qname, location.TileName)
+	}
+	return location, err
+}
+
+// DNBSEQLocationParser parses MGI/DNBSEQ read names, see
+// parseDNBSEQLocation.
+type DNBSEQLocationParser struct{}
+
+// Parse implements LocationParser.
+func (DNBSEQLocationParser) Parse(qname string) (PhysicalLocation, error) {
+	qname = normalizeName(qname)
+	m := dnbseqRe.FindStringSubmatch(qname)
+	if m == nil {
+		return PhysicalLocation{}, fmt.Errorf("could not parse name: %s, not a DNBSEQ read name", qname)
+	}
+	return parseDNBSEQLocation(qname, m)
+}
+
+// RegexLocationParser parses read names with a regular expression
+// that has three capture groups for tileName, X and Y, see
+// ParseLocationRegex.
+type RegexLocationParser struct {
+	Regex *regexp.Regexp
+}
+
+// Parse implements LocationParser.
+func (p *RegexLocationParser) Parse(qname string) (PhysicalLocation, error) {
+	return ParseLocationRegex(p.Regex, qname)
+}
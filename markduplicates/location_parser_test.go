@@ -0,0 +1,134 @@
+// Copyright 2019 Grail Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package markduplicates
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLocationParsers(t *testing.T) {
+	illumina := "M1:100:FC1:2:12304:11:21"
+	geneMind := "G:1:R012C045:13:23"
+	dnbseq := "V300016728L1C001R0010001234"
+
+	tests := []struct {
+		parser   LocationParser
+		accepted []string
+		rejected []string
+	}{
+		{DefaultLocationParser{}, []string{illumina, geneMind, dnbseq}, []string{"A:B:C"}},
+		{IlluminaLocationParser{}, []string{illumina}, []string{geneMind, dnbseq}},
+		{GeneMindLocationParser{}, []string{geneMind}, []string{illumina, dnbseq}},
+		{DNBSEQLocationParser{}, []string{dnbseq, dnbseq + "/1"}, []string{illumina, geneMind}},
+	}
+	for _, test := range tests {
+		for _, qname := range test.accepted {
+			location, err := test.parser.Parse(qname)
+			assert.NoError(t, err, "%T %s", test.parser, qname)
+			expected, err := ParseLocation(qname)
+			assert.NoError(t, err)
+			assert.Equal(t, expected, location, "%T %s", test.parser, qname)
+		}
+		for _, qname := range test.rejected {
+			_, err := test.parser.Parse(qname)
+			assert.Error(t, err, "%T %s", test.parser, qname)
+		}
+	}
+}
+
+// inHouseParser parses names of the form "name|tile|x|y".
+type inHouseParser struct{}
+
+func (inHouseParser) Parse(qname string) (PhysicalLocation, error) {
+	fields := strings.Split(qname, "|")
+	if len(fields) != 4 {
+		return PhysicalLocation{}, fmt.Errorf("bad name %s", qname)
+	}
+	var location PhysicalLocation
+	var err error
+	location.TileName = fields[1]
+	if location.X, err = strconv.Atoi(fields[2]); err != nil {
+		return location, err
+	}
+	location.Y, err = strconv.Atoi(fields[3])
+	return location, err
+}
+
+func TestCustomLocationParser(t *testing.T) {
+	newPair := func(name, readGroup string, fileIdx uint64) IndexedPair {
+		rg := NewAux("RG", readGroup)
+		return IndexedPair{
+			Left:  IndexedSingle{NewRecordAux(name, chr1, 0, r1F, 100, chr1, cigar0, rg), fileIdx},
+			Right: IndexedSingle{NewRecordAux(name, chr1, 100, r2R, 0, chr1, cigar0, rg), fileIdx + 1},
+			loc:   &locationCache{},
+		}
+	}
+	pairs := []DuplicateEntry{
+		newPair("a|7|1|1", "rg1", 0),
+		newPair("b|7|1|5", "rg1", 2),
+		newPair("c:bad", "rg1", 4),
+		newPair("d:bad", "rg2", 6),
+	}
+	opts := Opts{
+		OpticalHistogram:    "optical-histogram.txt",
+		OpticalHistogramMax: -1,
+		LocationParser:      inHouseParser{},
+	}
+	metrics := NewMetricsCollection()
+	addOpticalDistances(&opts, nil, nil, pairs, nil, nil, metrics)
+
+	assert.Equal(t, int64(4), metrics.OpticalNamesExamined)
+	assert.Equal(t, int64(2), metrics.UnparseableNames)
+	assert.Equal(t, map[string]int64{"rg1": 1, "rg2": 1}, metrics.UnparseableNamesByReadGroup)
+	assert.Equal(t, int64(1), metrics.OpticalDistance[1][4])
+
+	merged := NewMetricsCollection()
+	merged.Merge(metrics)
+	merged.Merge(metrics)
+	assert.Equal(t, map[string]int64{"rg1": 2, "rg2": 2}, merged.UnparseableNamesByReadGroup)
+}
+
+// funcParser is a LocationParser whose values cannot be compared.
+type funcParser func(qname string) (PhysicalLocation, error)
+
+func (f funcParser) Parse(qname string) (PhysicalLocation, error) {
+	return f(qname)
+}
+
+func TestLocationCacheParsers(t *testing.T) {
+	pair := IndexedPair{
+		Left:  IndexedSingle{NewRecord("a|7|1|5", chr1, 0, r1F, 100, chr1, cigar0), 0},
+		Right: IndexedSingle{NewRecord("a|7|1|5", chr1, 100, r2R, 0, chr1, cigar0), 1},
+		loc:   &locationCache{},
+	}
+	expected := PhysicalLocation{TileName: "7", X: 1, Y: 5}
+	location, err := pair.location(inHouseParser{})
+	assert.NoError(t, err)
+	assert.Equal(t, expected, location)
+
+	// Another parser does not get the location cached for the first.
+	_, err = pair.location(nil)
+	assert.Error(t, err)
+	_, err = pair.location(funcParser(ParseLocation))
+	assert.Error(t, err)
+
+	location, err = pair.location(inHouseParser{})
+	assert.NoError(t, err)
+	assert.Equal(t, expected, location)
+}
@@ -0,0 +1,344 @@
+// Copyright 2019 Grail Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package markduplicates
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	golog "log"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/Schaudge/grailbase/log"
+	"github.com/Schaudge/grailbio/encoding/bam"
+)
+
+// The messages of Mark are logged by component: io for the input and
+// outputs, shard for the marking of the shards, distantmates for the
+// distant mates, optical for the optical duplicates, and metrics for
+// the metrics. The messages about a shard have its ID and range.
+//
+// By default, they go to the grailbase log at its level. With
+// Opts.LogLevel or with Opts.LogFormat "json", Mark logs to stderr at
+// the levels of Opts.LogLevel, e.g. "info,distantmates=debug", and the
+// grailbase log, including that of the libraries, goes to the same
+// place in the same format while Mark runs. The settings are process
+// wide, like the grailbase log.
+//
+// Messages that would be logged for every read, such as the read names
+// that cannot be parsed, are sampled: the first one is logged, and the
+// number of the others when Mark is done.
+
+// The formats of Opts.LogFormat.
+const (
+	logFormatText = "text"
+	logFormatJSON = "json"
+)
+
+// The components of the log messages.
+const (
+	componentIO           = "io"
+	componentShard        = "shard"
+	componentDistantMates = "distantmates"
+	componentOptical      = "optical"
+	componentMetrics      = "metrics"
+)
+
+var logComponents = []string{componentIO, componentShard, componentDistantMates, componentOptical, componentMetrics}
+
+// logger logs the messages of a component, and of a shard if shard is
+// non-nil.
+type logger struct {
+	component string
+	shard     *bam.Shard
+}
+
+var (
+	ioLog           = logger{component: componentIO}
+	shardLog        = logger{component: componentShard}
+	distantMatesLog = logger{component: componentDistantMates}
+	opticalLog      = logger{component: componentOptical}
+	metricsLog      = logger{component: componentMetrics}
+)
+
+// forShard returns l for the messages about shard.
+func (l logger) forShard(shard bam.Shard) logger {
+	l.shard = &shard
+	return l
+}
+
+// at returns true if l logs messages at level.
+func (l logger) at(level log.Level) bool {
+	if s := currentLogSink(); s != nil {
+		return level <= s.level(l.component)
+	}
+	return log.At(level)
+}
+
+// Printf logs an info message.
+func (l logger) Printf(format string, args ...interface{}) {
+	l.output(log.Info, format, args)
+}
+
+// Debugf logs a debug message.
+func (l logger) Debugf(format string, args ...interface{}) {
+	l.output(log.Debug, format, args)
+}
+
+// Errorf logs an error message.
+func (l logger) Errorf(format string, args ...interface{}) {
+	l.output(log.Error, format, args)
+}
+
+func (l logger) output(level log.Level, format string, args []interface{}) {
+	if !l.at(level) {
+		return
+	}
+	msg := fmt.Sprintf(format, args...)
+	if s := currentLogSink(); s != nil {
+		s.write(level, l, msg)
+		return
+	}
+	log.Output(3, level, l.text(msg)) // nolint: errcheck
+}
+
+// text returns msg as a text log line of l.
+func (l logger) text(msg string) string {
+	if l.shard == nil {
+		return fmt.Sprintf("[%s] %s", l.component, msg)
+	}
+	return fmt.Sprintf("[%s] %s (shard %d %s)", l.component, msg, l.shard.ShardIdx, shardRange(*l.shard))
+}
+
+// shardRange returns the genomic range of shard, with a 1-based start,
+// "ref:start-*" if it extends to the unmapped reads, or "*" for the
+// unmapped shard.
+func shardRange(shard bam.Shard) string {
+	switch {
+	case shard.StartRef == nil:
+		return "*"
+	case shard.EndRef == nil:
+		return fmt.Sprintf("%s:%d-*", shard.StartRef.Name(), shard.Start+1)
+	case shard.EndRef.ID() != shard.StartRef.ID():
+		return fmt.Sprintf("%s:%d-%s:%d", shard.StartRef.Name(), shard.Start+1, shard.EndRef.Name(), shard.End)
+	}
+	return fmt.Sprintf("%s:%d-%d", shard.StartRef.Name(), shard.Start+1, shard.End)
+}
+
+// logSampler logs the first of messages that would be logged for every
+// read, and counts the others.
+type logSampler struct {
+	logger logger
+	level  log.Level
+	// what describes the messages in the count.
+	what  string
+	count int64
+}
+
+var (
+	unparseableNameLog = &logSampler{logger: opticalLog, level: log.Info,
+		what: "read names that could not be parsed for the optical histogram"}
+	opticalLocationLog = &logSampler{logger: opticalLog, level: log.Debug,
+		what: "readpairs skipped by optical detection"}
+	malformedTemplateLog = &logSampler{logger: shardLog, level: log.Error,
+		what: "templates with more than two primary records"}
+	missingMateLog = &logSampler{logger: shardLog, level: log.Error,
+		what: "reads whose mates could not be found"}
+	mateMismatchLog = &logSampler{logger: shardLog, level: log.Error,
+		what: "templates whose records of the same name are not mates"}
+
+	logSamplers = []*logSampler{unparseableNameLog, opticalLocationLog, malformedTemplateLog, missingMateLog,
+		mateMismatchLog}
+)
+
+// printf logs the message with l if it is the first one of s.
+func (s *logSampler) printf(l logger, format string, args ...interface{}) {
+	if atomic.AddInt64(&s.count, 1) == 1 {
+		l.output(s.level, format, args)
+	}
+}
+
+// summarize logs the number of messages of s that were not logged, and
+// resets s.
+func (s *logSampler) summarize() {
+	if n := atomic.SwapInt64(&s.count, 0); n > 1 {
+		s.logger.output(s.level, "%d more %s were not logged", []interface{}{n - 1, s.what})
+	}
+}
+
+// reset forgets the messages of s, for the start of a Mark.
+func (s *logSampler) reset() {
+	atomic.StoreInt64(&s.count, 0)
+}
+
+// logSink is where the messages go with Opts.LogLevel or
+// Opts.LogFormat "json". It is also the outputter of the grailbase log
+// while Mark runs.
+type logSink struct {
+	// levels are the levels of the components, and "" of the others.
+	levels map[string]log.Level
+	json   bool
+	mutex  sync.Mutex
+	w      io.Writer
+	text   *golog.Logger
+}
+
+// logWriter is where a logSink writes.
+var logWriter io.Writer = os.Stderr
+
+var activeLogSink atomic.Value
+
+// currentLogSink returns the logSink of the running Mark, or nil if it
+// logs to the grailbase log.
+func currentLogSink() *logSink {
+	s, _ := activeLogSink.Load().(*logSink)
+	return s
+}
+
+// level returns the level of component.
+func (s *logSink) level(component string) log.Level {
+	if level, ok := s.levels[component]; ok {
+		return level
+	}
+	return s.levels[""]
+}
+
+// Level implements log.Outputter.
+func (s *logSink) Level() log.Level {
+	return s.levels[""]
+}
+
+// Output implements log.Outputter.
+func (s *logSink) Output(_ int, level log.Level, msg string) error {
+	if level > s.Level() {
+		return nil
+	}
+	s.write(level, logger{}, msg)
+	return nil
+}
+
+// logRecord is a log message in the "json" format.
+type logRecord struct {
+	Time      string `json:"time"`
+	Level     string `json:"level"`
+	Component string `json:"component,omitempty"`
+	Shard     *int   `json:"shard,omitempty"`
+	Range     string `json:"range,omitempty"`
+	Msg       string `json:"msg"`
+}
+
+// write writes msg of l at level.
+func (s *logSink) write(level log.Level, l logger, msg string) {
+	if !s.json {
+		if l.component != "" {
+			msg = l.text(msg)
+		}
+		s.text.Output(0, level.String()+" "+msg) // nolint: errcheck
+		return
+	}
+	record := logRecord{
+		Time:      time.Now().Format(time.RFC3339Nano),
+		Level:     level.String(),
+		Component: l.component,
+		Msg:       msg,
+	}
+	if l.shard != nil {
+		shardIdx := l.shard.ShardIdx
+		record.Shard = &shardIdx
+		record.Range = shardRange(*l.shard)
+	}
+	line, err := json.Marshal(record)
+	if err != nil {
+		line = []byte(fmt.Sprintf(`{"level":"error","msg":%q}`, err.Error()))
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.w.Write(append(line, '\n')) // nolint: errcheck
+}
+
+// parseLogLevel returns the levels of Opts.LogLevel, a comma separated
+// list of a level for all the components, and of component=level for
+// one of them. The default level of the components is level.
+func parseLogLevel(s string, level log.Level) (map[string]log.Level, error) {
+	levels := map[string]log.Level{"": level}
+	for _, field := range strings.Split(s, ",") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+		component := ""
+		if i := strings.Index(field, "="); i >= 0 {
+			component, field = field[:i], field[i+1:]
+			known := false
+			for _, c := range logComponents {
+				known = known || c == component
+			}
+			if !known {
+				return nil, fmt.Errorf("unknown log component %s in log-level, not one of %s",
+					component, strings.Join(logComponents, ", "))
+			}
+		}
+		switch field {
+		case "off":
+			levels[component] = log.Off
+		case "error":
+			levels[component] = log.Error
+		case "info":
+			levels[component] = log.Info
+		case "debug":
+			levels[component] = log.Debug
+		default:
+			return nil, fmt.Errorf("unknown log level %s in log-level, not off, error, info, or debug", field)
+		}
+	}
+	return levels, nil
+}
+
+// setupLogging sets up the logging of Mark with opts, and returns a
+// function that logs the counts of the samplers and restores the
+// grailbase log.
+func setupLogging(opts *Opts) (restore func(), err error) {
+	for _, s := range logSamplers {
+		s.reset()
+	}
+	summarize := func() {
+		for _, s := range logSamplers {
+			s.summarize()
+		}
+	}
+	if opts.LogLevel == "" && opts.LogFormat != logFormatJSON {
+		return summarize, nil
+	}
+	levels, err := parseLogLevel(opts.LogLevel, log.GetOutputter().Level())
+	if err != nil {
+		return nil, err
+	}
+	s := &logSink{
+		levels: levels,
+		json:   opts.LogFormat == logFormatJSON,
+		w:      logWriter,
+		text:   golog.New(logWriter, "", golog.LstdFlags),
+	}
+	previous := log.SetOutputter(s)
+	activeLogSink.Store(s)
+	return func() {
+		summarize()
+		activeLogSink.Store((*logSink)(nil))
+		log.SetOutputter(previous)
+	}, nil
+}
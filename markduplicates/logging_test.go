@@ -0,0 +1,160 @@
+// Copyright 2019 Grail Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package markduplicates
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/Schaudge/grailbase/log"
+	"github.com/Schaudge/grailbio/encoding/bam"
+	"github.com/Schaudge/grailbio/encoding/bamprovider"
+	"github.com/Schaudge/hts/sam"
+	"github.com/grailbio/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseLogLevel(t *testing.T) {
+	tests := []struct {
+		s        string
+		expected map[string]log.Level
+		err      bool
+	}{
+		{"", map[string]log.Level{"": log.Info}, false},
+		{"debug", map[string]log.Level{"": log.Debug}, false},
+		{"error, optical=debug", map[string]log.Level{"": log.Error, "optical": log.Debug}, false},
+		{"distantmates=off", map[string]log.Level{"": log.Info, "distantmates": log.Off}, false},
+		{"verbose", nil, true},
+		{"reads=debug", nil, true},
+	}
+	for _, test := range tests {
+		levels, err := parseLogLevel(test.s, log.Info)
+		if test.err {
+			assert.Error(t, err, "log level %q", test.s)
+			continue
+		}
+		assert.NoError(t, err, "log level %q", test.s)
+		assert.Equal(t, test.expected, levels, "log level %q", test.s)
+	}
+}
+
+// withLogWriter runs f with the logs written to the returned buffer.
+func withLogWriter(f func()) *bytes.Buffer {
+	var buf bytes.Buffer
+	saved := logWriter
+	logWriter = &buf
+	defer func() { logWriter = saved }()
+	f()
+	return &buf
+}
+
+func TestJSONLogging(t *testing.T) {
+	// Two unparseable names, a distant mate, and a readpair of the
+	// same position.
+	records := []*sam.Record{
+		NewRecord("A:::1:10:1:1", chr1, 0, r1F, 10, chr1, cigar0),
+		NewRecord("bad1", chr1, 0, r1F, 10, chr1, cigar0),
+		NewRecord("bad2", chr1, 0, r1F, 10, chr1, cigar0),
+		NewRecord("A:::1:10:1:1", chr1, 10, r2R, 0, chr1, cigar0),
+		NewRecord("bad1", chr1, 10, r2R, 0, chr1, cigar0),
+		NewRecord("bad2", chr1, 10, r2R, 0, chr1, cigar0),
+		NewRecord("C:::1:10:2:2", chr1, 20, r1F, 0, chr2, cigar0),
+		NewRecord("C:::1:10:2:2", chr2, 0, r2R, 20, chr1, cigar0),
+	}
+	tempDir, cleanup := testutil.TempDir(t, "", "")
+	defer cleanup()
+
+	opts := defaultOpts
+	opts.OutputPath = NewTestOutput(tempDir, 0, "bam")
+	opts.Format = "bam"
+	opts.OpticalHistogram = tempDir + "/histogram.txt"
+	opts.OpticalDetector = nil
+	opts.OpticalDuplicatePixelDistance = 100
+	opts.OpticalHistogramMax = -1
+	opts.MaxUnparseableNameFraction = 1
+	opts.LogLevel = "error,shard=debug,optical=info"
+	opts.LogFormat = logFormatJSON
+	var err error
+	buf := withLogWriter(func() {
+		markDuplicates := &MarkDuplicates{
+			Provider: bamprovider.NewFakeProvider(header, records),
+			Opts:     &opts,
+		}
+		_, err = markDuplicates.Mark(nil)
+	})
+	assert.NoError(t, err)
+	assert.Nil(t, currentLogSink())
+
+	var (
+		shardRecords, unparseable, summaries int
+		components                           = map[string]bool{}
+	)
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		var record logRecord
+		if !assert.NoError(t, json.Unmarshal([]byte(line), &record), "line %s", line) {
+			continue
+		}
+		components[record.Component] = true
+		if record.Shard != nil {
+			shardRecords++
+			assert.NotEmpty(t, record.Range, "line %s", line)
+		}
+		if strings.Contains(record.Msg, "excluding read from optical histogram") {
+			unparseable++
+		}
+		if strings.Contains(record.Msg, "more read names that could not be parsed") {
+			summaries++
+			assert.True(t, strings.HasPrefix(record.Msg, "1 more"), "line %s", line)
+		}
+	}
+	assert.True(t, shardRecords > 0)
+	assert.Equal(t, 1, unparseable)
+	assert.Equal(t, 1, summaries)
+	// The distant mates are below their level.
+	assert.False(t, components[componentDistantMates])
+	assert.True(t, components[componentShard])
+}
+
+func TestLogSampler(t *testing.T) {
+	opts := defaultOpts
+	opts.LogLevel = "info"
+	buf := withLogWriter(func() {
+		restore, err := setupLogging(&opts)
+		if !assert.NoError(t, err) {
+			return
+		}
+		sampler := &logSampler{logger: metricsLog, level: log.Info, what: "tests"}
+		shard := bam.Shard{StartRef: chr1, EndRef: chr1, Start: 100, End: 200, ShardIdx: 3}
+		for i := 0; i < 5; i++ {
+			sampler.printf(metricsLog.forShard(shard), "test %d", i)
+		}
+		sampler.summarize()
+		sampler.summarize()
+		restore()
+	})
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if assert.Len(t, lines, 2, buf.String()) {
+		assert.Contains(t, lines[0], "info [metrics] test 0 (shard 3 chr1:101-200)")
+		assert.Contains(t, lines[1], "info [metrics] 4 more tests were not logged")
+	}
+}
+
+func TestShardRange(t *testing.T) {
+	assert.Equal(t, "*", shardRange(bam.Shard{}))
+	assert.Equal(t, "chr1:1-*", shardRange(bam.UniversalShard(header)))
+	assert.Equal(t, "chr1:1-50", shardRange(bam.Shard{StartRef: chr1, EndRef: chr1, Start: 0, End: 50}))
+	assert.Equal(t, "chr1:11-chr2:50", shardRange(bam.Shard{StartRef: chr1, EndRef: chr2, Start: 10, End: 50}))
+}
@@ -15,7 +15,13 @@ package markduplicates
 
 import (
 	"bytes"
+	"compress/gzip"
 	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"path/filepath"
+	"regexp"
+	"sort"
 	"strings"
 	"sync"
 	"testing"
@@ -33,6 +39,7 @@ var (
 		Padding:              10,
 		Parallelism:          1,
 		QueueLength:          10,
+		CompressionLevel:     gzip.DefaultCompression,
 		ClearExisting:        false,
 		RemoveDups:           false,
 		TagDups:              true,
@@ -168,6 +175,21 @@ var (
 	overD2 = NewRecord("overD:::2:10:5:5", chr1, 149, r2F, 50, chr1, cigar0)
 )
 
+// newTestHeader returns a header with the given text, and references
+// like those of header. A reference belongs to a single header, so
+// they are new references with the same names and lengths.
+func newTestHeader(t *testing.T, text string) *sam.Header {
+	var refs []*sam.Reference
+	for _, ref := range header.Refs() {
+		r, err := sam.NewReference(ref.Name(), "", "", ref.Len(), nil, nil)
+		assert.NoError(t, err)
+		refs = append(refs, r)
+	}
+	h, err := sam.NewHeader([]byte(text), refs)
+	assert.NoError(t, err)
+	return h
+}
+
 func TestBasicDuplicates(t *testing.T) {
 	cases := []TestCase{
 		{
@@ -421,6 +443,42 @@ func TestTagDups(t *testing.T) {
 	RunTestCases(t, header, cases)
 }
 
+func TestPrimarySelection(t *testing.T) {
+	// B and A have the same quality, and B comes first. E has a higher
+	// quality than D, even though D comes first.
+	records := func() []*sam.Record {
+		return []*sam.Record{
+			NewRecordSeq("B:::1:10:1:1", chr1, 0, r1F, 10, chr1, cigar2M, "AC", "FF"),
+			NewRecordSeq("A:::1:10:1:1", chr1, 0, r1F, 10, chr1, cigar2M, "AC", "FF"),
+			NewRecordSeq("B:::1:10:1:1", chr1, 10, r2R, 0, chr1, cigar2M, "AC", "FF"),
+			NewRecordSeq("A:::1:10:1:1", chr1, 10, r2R, 0, chr1, cigar2M, "AC", "FF"),
+			NewRecordSeq("D:::1:10:1:1", chr1, 100, r1F, 110, chr1, cigar2M, "AC", "FF"),
+			NewRecordSeq("E:::1:10:1:1", chr1, 100, r1F, 110, chr1, cigar2M, "AC", "GG"),
+			NewRecordSeq("D:::1:10:1:1", chr1, 110, r2R, 100, chr1, cigar2M, "AC", "FF"),
+			NewRecordSeq("E:::1:10:1:1", chr1, 110, r2R, 100, chr1, cigar2M, "AC", "GG"),
+		}
+	}
+	fileIdx := defaultOpts
+	fileIdx.PrimarySelection = primarySelectionFileIdx
+	baseQ := defaultOpts
+	baseQ.PrimarySelection = primarySelectionBaseQ
+
+	for _, test := range []struct {
+		opts Opts
+		dups []bool
+	}{
+		{defaultOpts, []bool{false, true, false, true, true, false, true, false}},
+		{fileIdx, []bool{false, true, false, true, true, false, true, false}},
+		{baseQ, []bool{true, false, true, false, true, false, true, false}},
+	} {
+		var trecords []TestRecord
+		for i, r := range records() {
+			trecords = append(trecords, TestRecord{R: r, DupFlag: test.dups[i]})
+		}
+		RunTestCases(t, header, []TestCase{{trecords, test.opts}})
+	}
+}
+
 // Test that tags are not present when clear-existing is true.
 func TestClearExisting(t *testing.T) {
 	opts := defaultOpts
@@ -433,7 +491,7 @@ func TestClearExisting(t *testing.T) {
 	// exercise that the flag clearing works on distant mates.
 	a1 := NewRecord("A:::1:10:6:6", chr1, 50, r1F, 150, chr1, cigar0)
 	a2 := NewRecord("A:::1:10:6:6", chr1, 150, r2F, 50, chr1, cigar0)
-	b1 := NewRecord("B:::1:10:6:6", chr1, 50, r1F, 150, chr1, cigar0)
+	b1 := NewRecord("B:::1:10:6:6", chr1, 50, r1F, 151, chr1, cigar0)
 	b2 := NewRecord("B:::1:10:6:6", chr1, 151, r2F, 50, chr1, cigar0)
 
 	b1.Flags |= sam.Duplicate
@@ -466,6 +524,95 @@ func TestClearExisting(t *testing.T) {
 	RunTestCases(t, header, cases)
 }
 
+func TestExistingDuplicateHandling(t *testing.T) {
+	// The input was marked by picard: A is flagged as a duplicate, and
+	// has a site-specific XT tag, and D is flagged too. B is at the
+	// same position as A.
+	records := func() []*sam.Record {
+		marked := func(r *sam.Record, di string) *sam.Record {
+			r.Flags |= sam.Duplicate
+			r.AuxFields = append(r.AuxFields, NewAux("DI", di), NewAux("DT", "LB"))
+			return r
+		}
+		return []*sam.Record{
+			marked(NewRecordAux("A:::1:10:1:1", chr1, 0, r1F, 50, chr1, cigar0, NewAux("XT", "site")), "7"),
+			NewRecord("B:::1:10:9000:9000", chr1, 0, r1F, 50, chr1, cigar0),
+			marked(NewRecordAux("A:::1:10:1:1", chr1, 50, r2R, 0, chr1, cigar0, NewAux("XT", "site")), "7"),
+			NewRecord("B:::1:10:9000:9000", chr1, 50, r2R, 0, chr1, cigar0),
+			marked(NewRecord("D:::1:10:1:1", chr1, 200, r1F, 250, chr1, cigar0), "9"),
+			marked(NewRecord("D:::1:10:1:1", chr1, 250, r2R, 200, chr1, cigar0), "9"),
+		}
+	}
+	dt := sam.NewTag("DT")
+	xt := sam.NewTag("XT")
+
+	for _, test := range []struct {
+		handling  string
+		clearTags []string
+		// dups are the expected flags of A, B and D.
+		dups       []bool
+		aAuxs      []sam.Aux
+		aUnexpTags []sam.Tag
+	}{
+		{"clear", nil, []bool{false, true, false},
+			[]sam.Aux{NewAux("DI", "0"), NewAux("XT", "site")}, []sam.Tag{dt}},
+		{"clear", []string{"DI", "DL", "DS", "DT", "DU", "XT"}, []bool{false, true, false},
+			[]sam.Aux{NewAux("DI", "0")}, []sam.Tag{dt, xt}},
+		// A is still the primary, but keeps its flag.
+		{"union", nil, []bool{true, true, true},
+			[]sam.Aux{NewAux("DI", "0"), NewAux("XT", "site")}, []sam.Tag{dt}},
+		// A and D are kept as they are, and B is not a duplicate.
+		{"preserve", nil, []bool{true, false, true},
+			[]sam.Aux{NewAux("DI", "7"), NewAux("DT", "LB"), NewAux("XT", "site")}, nil},
+	} {
+		opts := defaultOpts
+		opts.ExistingDuplicateHandling = test.handling
+		opts.ClearTags = test.clearTags
+
+		var trecords []TestRecord
+		for _, r := range records() {
+			tr := TestRecord{R: r}
+			switch r.Name[:1] {
+			case "A":
+				tr.DupFlag = test.dups[0]
+				tr.ExpectedAuxs = test.aAuxs
+				tr.UnexpectedTags = test.aUnexpTags
+			case "B":
+				tr.DupFlag = test.dups[1]
+			case "D":
+				tr.DupFlag = test.dups[2]
+			}
+			trecords = append(trecords, tr)
+		}
+		RunTestCases(t, header, []TestCase{{trecords, opts}})
+	}
+}
+
+func TestLeadingInsertionDuplicates(t *testing.T) {
+	parseCigar := func(s string) sam.Cigar {
+		cigar, err := sam.ParseCigar([]byte(s))
+		assert.NoError(t, err)
+		return cigar
+	}
+	// The unclipped 5' positions of B's reads are 95 and 209, like
+	// those of A's, so B is a duplicate of A. The clips of B's reverse
+	// read reach 13 bases from its position, past the default padding.
+	opts := defaultOpts
+	opts.Padding = 20
+	cases := []TestCase{
+		{
+			[]TestRecord{
+				{R: NewRecord("A:::1:10:1:1", chr1, 95, r1F, 200, chr1, cigar100M), DupFlag: false},
+				{R: NewRecord("B:::1:10:1:1", chr1, 100, r1F, 196, chr1, parseCigar("5H3I95M")), DupFlag: true},
+				{R: NewRecord("B:::1:10:1:1", chr1, 196, r2R, 100, chr1, parseCigar("10M3I2S2H")), DupFlag: true},
+				{R: NewRecord("A:::1:10:1:1", chr1, 200, r2R, 95, chr1, cigar0), DupFlag: false},
+			},
+			opts,
+		},
+	}
+	RunTestCases(t, header, cases)
+}
+
 func TestExactUmis(t *testing.T) {
 	useUmis := defaultOpts
 	useUmis.UseUmis = true
@@ -702,6 +849,366 @@ func TestExactUmis(t *testing.T) {
 	RunTestCases(t, header, cases)
 }
 
+func TestUmiTag(t *testing.T) {
+	umiTag := defaultOpts
+	umiTag.UMITag = "RX"
+	requireUmi := umiTag
+	requireUmi.RequireUMI = true
+	useUmis := umiTag
+	useUmis.UseUmis = true
+
+	cases := []TestCase{
+		{
+			// Equal UMIs are duplicates, regardless of case.
+			[]TestRecord{
+				{R: NewRecordAux("A:::1:10:1:1", chr1, 0, r1F, 10, chr1, cigar0, NewAux("RX", "AAC")), DupFlag: false},
+				{R: NewRecordAux("B:::1:10:1:1", chr1, 0, r1F, 10, chr1, cigar0, NewAux("RX", "aac")), DupFlag: true},
+				{R: NewRecordAux("A:::1:10:1:1", chr1, 10, r2R, 0, chr1, cigar0, NewAux("RX", "AAC")), DupFlag: false},
+				{R: NewRecordAux("B:::1:10:1:1", chr1, 10, r2R, 0, chr1, cigar0, NewAux("RX", "AAC")), DupFlag: true},
+			},
+			umiTag,
+		},
+		{
+			// Distinct UMIs are distinct molecules.
+			[]TestRecord{
+				{R: NewRecordAux("A:::1:10:1:1", chr1, 0, r1F, 10, chr1, cigar0, NewAux("RX", "AAC")), DupFlag: false},
+				{R: NewRecordAux("B:::1:10:1:1", chr1, 0, r1F, 10, chr1, cigar0, NewAux("RX", "ACC")), DupFlag: false},
+				{R: NewRecordAux("A:::1:10:1:1", chr1, 10, r2R, 0, chr1, cigar0, NewAux("RX", "AAC")), DupFlag: false},
+				{R: NewRecordAux("B:::1:10:1:1", chr1, 10, r2R, 0, chr1, cigar0, NewAux("RX", "ACC")), DupFlag: false},
+			},
+			umiTag,
+		},
+		{
+			// Pair UMIs with either separator are the R1 and R2 UMIs.
+			[]TestRecord{
+				{R: NewRecordAux("A:::1:10:1:1", chr1, 0, r1F, 10, chr1, cigar0, NewAux("RX", "AAC-CCG")), DupFlag: false},
+				{R: NewRecordAux("B:::1:10:1:1", chr1, 0, r1F, 10, chr1, cigar0, NewAux("RX", "AAC+CCG")), DupFlag: true},
+				{R: NewRecordAux("C:::1:10:1:1", chr1, 0, r1F, 10, chr1, cigar0, NewAux("RX", "CCG-AAC")), DupFlag: false},
+				{R: NewRecordAux("A:::1:10:1:1", chr1, 10, r2R, 0, chr1, cigar0, NewAux("RX", "AAC-CCG")), DupFlag: false},
+				{R: NewRecordAux("B:::1:10:1:1", chr1, 10, r2R, 0, chr1, cigar0, NewAux("RX", "AAC+CCG")), DupFlag: true},
+				{R: NewRecordAux("C:::1:10:1:1", chr1, 10, r2R, 0, chr1, cigar0, NewAux("RX", "CCG-AAC")), DupFlag: false},
+			},
+			umiTag,
+		},
+		{
+			// Reads without the tag are grouped under an empty UMI.
+			[]TestRecord{
+				{R: NewRecord("A:::1:10:1:1", chr1, 0, r1F, 10, chr1, cigar0), DupFlag: false},
+				{R: NewRecord("B:::1:10:1:1", chr1, 0, r1F, 10, chr1, cigar0), DupFlag: true},
+				{R: NewRecord("A:::1:10:1:1", chr1, 10, r2R, 0, chr1, cigar0), DupFlag: false},
+				{R: NewRecord("B:::1:10:1:1", chr1, 10, r2R, 0, chr1, cigar0), DupFlag: true},
+			},
+			umiTag,
+		},
+		{
+			// With RequireUMI, reads without the tag are not duplicates.
+			[]TestRecord{
+				{R: NewRecord("A:::1:10:1:1", chr1, 0, r1F, 10, chr1, cigar0), DupFlag: false},
+				{R: NewRecord("B:::1:10:1:1", chr1, 0, r1F, 10, chr1, cigar0), DupFlag: false},
+				{R: NewRecord("A:::1:10:1:1", chr1, 10, r2R, 0, chr1, cigar0), DupFlag: false},
+				{R: NewRecord("B:::1:10:1:1", chr1, 10, r2R, 0, chr1, cigar0), DupFlag: false},
+			},
+			requireUmi,
+		},
+		{
+			// UseUmis reads the UMIs from the read names instead.
+			[]TestRecord{
+				{R: NewRecordAux("A:1:1:1:1:1:1:AAC+CCG", chr1, 0, r1F, 10, chr1, cigar0, NewAux("RX", "AAC")),
+					DupFlag: false},
+				{R: NewRecordAux("B:1:1:1:1:1:1:AAC+CCG", chr1, 0, r1F, 10, chr1, cigar0, NewAux("RX", "GGG")),
+					DupFlag: true},
+				{R: NewRecord("A:1:1:1:1:1:1:AAC+CCG", chr1, 10, r2R, 0, chr1, cigar0), DupFlag: false},
+				{R: NewRecord("B:1:1:1:1:1:1:AAC+CCG", chr1, 10, r2R, 0, chr1, cigar0), DupFlag: true},
+			},
+			useUmis,
+		},
+	}
+	RunTestCases(t, header, cases)
+}
+
+func TestUmiQname(t *testing.T) {
+	qname := defaultOpts
+	qname.UMISource = "qname"
+	requireUmi := qname
+	requireUmi.RequireUMI = true
+
+	cases := []TestCase{
+		{
+			// The UMIs in the 8th field of the names group the
+			// duplicates, without any aux tags.
+			[]TestRecord{
+				{R: NewRecord("M1:100:FC1:1:1101:10:20:AAC+CCG", chr1, 0, r1F, 10, chr1, cigar0), DupFlag: false},
+				{R: NewRecord("M1:100:FC1:1:1101:90:20:aac+ccg", chr1, 0, r1F, 10, chr1, cigar0), DupFlag: true},
+				{R: NewRecord("M1:100:FC1:1:1101:50:20:AAC+GGG", chr1, 0, r1F, 10, chr1, cigar0), DupFlag: false},
+				{R: NewRecord("M1:100:FC1:1:1101:10:20:AAC+CCG", chr1, 10, r2R, 0, chr1, cigar0), DupFlag: false},
+				{R: NewRecord("M1:100:FC1:1:1101:90:20:aac+ccg", chr1, 10, r2R, 0, chr1, cigar0), DupFlag: true},
+				{R: NewRecord("M1:100:FC1:1:1101:50:20:AAC+GGG", chr1, 10, r2R, 0, chr1, cigar0), DupFlag: false},
+			},
+			qname,
+		},
+		{
+			// Both reads of a pair at the same position and
+			// orientation order their UMIs canonically, so swapping
+			// R1 and R2 gives the same key.
+			[]TestRecord{
+				{R: NewRecord("M1:100:FC1:1:1101:10:20:AAA+CCC", chr1, 0, r1F, 0, chr1, cigar0), DupFlag: false},
+				{R: NewRecord("M1:100:FC1:1:1101:10:20:AAA+CCC", chr1, 0, r2F, 0, chr1, cigar0), DupFlag: false},
+				{R: NewRecord("M1:100:FC1:1:1101:90:20:CCC+AAA", chr1, 0, r1F, 0, chr1, cigar0), DupFlag: true},
+				{R: NewRecord("M1:100:FC1:1:1101:90:20:CCC+AAA", chr1, 0, r2F, 0, chr1, cigar0), DupFlag: true},
+			},
+			qname,
+		},
+		{
+			// Names without a UMI field are grouped under an empty UMI.
+			[]TestRecord{
+				{R: NewRecord("M1:100:FC1:1:1101:10:20", chr1, 0, r1F, 10, chr1, cigar0), DupFlag: false},
+				{R: NewRecord("M1:100:FC1:1:1101:90:20", chr1, 0, r1F, 10, chr1, cigar0), DupFlag: true},
+				{R: NewRecord("M1:100:FC1:1:1101:10:20", chr1, 10, r2R, 0, chr1, cigar0), DupFlag: false},
+				{R: NewRecord("M1:100:FC1:1:1101:90:20", chr1, 10, r2R, 0, chr1, cigar0), DupFlag: true},
+			},
+			qname,
+		},
+		{
+			// With RequireUMI, they are not duplicates.
+			[]TestRecord{
+				{R: NewRecord("M1:100:FC1:1:1101:10:20", chr1, 0, r1F, 10, chr1, cigar0), DupFlag: false},
+				{R: NewRecord("M1:100:FC1:1:1101:90:20", chr1, 0, r1F, 10, chr1, cigar0), DupFlag: false},
+				{R: NewRecord("M1:100:FC1:1:1101:10:20", chr1, 10, r2R, 0, chr1, cigar0), DupFlag: false},
+				{R: NewRecord("M1:100:FC1:1:1101:90:20", chr1, 10, r2R, 0, chr1, cigar0), DupFlag: false},
+			},
+			requireUmi,
+		},
+	}
+	RunTestCases(t, header, cases)
+}
+
+func TestMITag(t *testing.T) {
+	mi := defaultOpts
+	mi.EmitMITag = true
+	duplex := mi
+	duplex.DuplexMITag = true
+
+	cases := []TestCase{
+		{
+			// Every record of the templates of a set gets the file
+			// index of the primary's left read, including the
+			// mate-unmapped C, its unmapped mate, and the secondary
+			// record of A. An existing MI tag is replaced.
+			[]TestRecord{
+				{R: NewRecord("A:::1:10:1:1", chr1, 0, r1F, 10, chr1, cigar0), DupFlag: false,
+					ExpectedAuxs: []sam.Aux{NewAux("MI", 0)}},
+				{R: NewRecord("B:::1:10:1:1", chr1, 0, r1F, 10, chr1, cigar0), DupFlag: true,
+					ExpectedAuxs: []sam.Aux{NewAux("MI", 0)}},
+				{R: NewRecord("C:::1:10:1:1", chr1, 0, s1F, 0, chr1, cigar0), DupFlag: true,
+					ExpectedAuxs: []sam.Aux{NewAux("MI", 0)}},
+				{R: NewRecord("C:::1:10:1:1", chr1, 0, u2, 0, chr1, cigar0), DupFlag: false,
+					ExpectedAuxs: []sam.Aux{NewAux("MI", 0)}},
+				{R: NewRecord("A:::1:10:1:1", chr1, 10, r2R, 0, chr1, cigar0), DupFlag: false,
+					ExpectedAuxs: []sam.Aux{NewAux("MI", 0)}},
+				{R: NewRecord("B:::1:10:1:1", chr1, 10, r2R, 0, chr1, cigar0), DupFlag: true,
+					ExpectedAuxs: []sam.Aux{NewAux("MI", 0)}},
+				{R: NewRecord("A:::1:10:1:1", chr1, 20, sec, 10, chr1, cigar0), DupFlag: false,
+					ExpectedAuxs: []sam.Aux{NewAux("MI", 0)}},
+				{R: NewRecordAux("D:::1:10:1:1", chr1, 100, r1F, 110, chr1, cigar0, NewAux("MI", "old")),
+					DupFlag: false, ExpectedAuxs: []sam.Aux{NewAux("MI", 7)}},
+				{R: NewRecord("D:::1:10:1:1", chr1, 110, r2R, 100, chr1, cigar0), DupFlag: false,
+					ExpectedAuxs: []sam.Aux{NewAux("MI", 7)}},
+			},
+			mi,
+		},
+		{
+			// With DuplexMITag, the templates whose R1 is on the
+			// reverse strand get the /B suffix.
+			[]TestRecord{
+				{R: NewRecord("E:::1:10:1:1", chr1, 0, r1F, 10, chr1, cigar0), DupFlag: false,
+					ExpectedAuxs: []sam.Aux{NewAux("MI", "0/A")}},
+				{R: NewRecord("F:::1:10:1:1", chr1, 0, r2F, 10, chr1, cigar0), DupFlag: true,
+					ExpectedAuxs: []sam.Aux{NewAux("MI", "0/B")}},
+				{R: NewRecord("E:::1:10:1:1", chr1, 10, r2R, 0, chr1, cigar0), DupFlag: false,
+					ExpectedAuxs: []sam.Aux{NewAux("MI", "0/A")}},
+				{R: NewRecord("F:::1:10:1:1", chr1, 10, r1R, 0, chr1, cigar0), DupFlag: true,
+					ExpectedAuxs: []sam.Aux{NewAux("MI", "0/B")}},
+			},
+			duplex,
+		},
+		{
+			// Without EmitMITag, there are no MI tags.
+			[]TestRecord{
+				{R: NewRecord("E:::1:10:1:1", chr1, 0, r1F, 10, chr1, cigar0), DupFlag: false,
+					UnexpectedTags: []sam.Tag{miTag}},
+				{R: NewRecord("E:::1:10:1:1", chr1, 10, r2R, 0, chr1, cigar0), DupFlag: false,
+					UnexpectedTags: []sam.Tag{miTag}},
+			},
+			defaultOpts,
+		},
+	}
+	RunTestCases(t, header, cases)
+}
+
+func TestTagOnlyMode(t *testing.T) {
+	// B is a duplicate of A, and C was flagged as a duplicate in the
+	// input.
+	records := func() []*sam.Record {
+		return []*sam.Record{
+			NewRecord("A:::1:10:1:1", chr1, 0, r1F, 10, chr1, cigar0),
+			NewRecord("B:::1:10:1:1", chr1, 0, r1F, 10, chr1, cigar0),
+			NewRecord("A:::1:10:1:1", chr1, 10, r2R, 0, chr1, cigar0),
+			NewRecord("B:::1:10:1:1", chr1, 10, r2R, 0, chr1, cigar0),
+			NewRecord("C:::1:10:1:1", chr1, 100, r1F|sam.Duplicate, 110, chr1, cigar0),
+			NewRecord("C:::1:10:1:1", chr1, 110, r2R|sam.Duplicate, 100, chr1, cigar0),
+		}
+	}
+	inputFlags := []sam.Flags{}
+	for _, r := range records() {
+		inputFlags = append(inputFlags, r.Flags)
+	}
+
+	tempDir, cleanup := testutil.TempDir(t, "", "")
+	defer cleanup()
+	run := func(testIdx int, opts Opts) (*MetricsCollection, []*sam.Record) {
+		opts.OutputPath = NewTestOutput(tempDir, testIdx, "bam")
+		opts.Format = "bam"
+		opts.ClearExisting = true
+		opts.EmitMITag = true
+		markDuplicates := &MarkDuplicates{
+			Provider: bamprovider.NewFakeProvider(header, records()),
+			Opts:     &opts,
+		}
+		metrics, err := markDuplicates.Mark(nil)
+		assert.NoError(t, err)
+		return metrics, ReadRecords(t, opts.OutputPath)
+	}
+
+	normalMetrics, normal := run(0, defaultOpts)
+	tagOnly := defaultOpts
+	tagOnly.TagOnlyMode = true
+	tagOnlyMetrics, tagged := run(1, tagOnly)
+	tagOnly.TagOnlyClearFlags = true
+	clearMetrics, cleared := run(2, tagOnly)
+
+	assert.Equal(t, normalMetrics, tagOnlyMetrics)
+	assert.Equal(t, normalMetrics, clearMetrics)
+	assert.Equal(t, 6, len(tagged))
+	assert.Equal(t, 6, len(cleared))
+	for i := range tagged {
+		// The tags are the same as in a normal run, but the flags are
+		// the input flags, or the input flags without the duplicate
+		// flag with TagOnlyClearFlags.
+		assert.Equal(t, normal[i].AuxFields, tagged[i].AuxFields, "record %d", i)
+		assert.Equal(t, normal[i].AuxFields, cleared[i].AuxFields, "record %d", i)
+		assert.Equal(t, inputFlags[i], tagged[i].Flags, "record %d", i)
+		assert.Equal(t, inputFlags[i]&^sam.Duplicate, cleared[i].Flags, "record %d", i)
+		_, ok := tagged[i].Tag([]byte("MI"))
+		assert.True(t, ok, "record %d", i)
+	}
+	assert.True(t, normal[1].Flags&sam.Duplicate != 0)
+	assert.True(t, normal[4].Flags&sam.Duplicate == 0)
+}
+
+func TestUmiTagMetrics(t *testing.T) {
+	// B is rescued from A by its UMI, and D from C. E has no UMIs.
+	records := []*sam.Record{
+		NewRecordAux("A:::1:10:1:1", chr1, 0, r1F, 10, chr1, cigar0, NewAux("RX", "AAC")),
+		NewRecordAux("B:::1:10:1:1", chr1, 0, r1F, 10, chr1, cigar0, NewAux("RX", "ACC")),
+		NewRecordAux("A:::1:10:1:1", chr1, 10, r2R, 0, chr1, cigar0, NewAux("RX", "AAC")),
+		NewRecordAux("B:::1:10:1:1", chr1, 10, r2R, 0, chr1, cigar0, NewAux("RX", "ACC")),
+		NewRecordAux("C:::1:10:1:1", chr1, 100, s1F, 0, nil, cigar0, NewAux("RX", "AAC")),
+		NewRecordAux("C:::1:10:1:1", chr1, 100, u2, 0, nil, cigar0, NewAux("RX", "AAC")),
+		NewRecordAux("D:::1:10:1:1", chr1, 100, s1F, 0, nil, cigar0, NewAux("RX", "GGC")),
+		NewRecordAux("D:::1:10:1:1", chr1, 100, u2, 0, nil, cigar0, NewAux("RX", "GGC")),
+		NewRecord("E:::1:10:1:1", chr1, 200, r1F, 210, chr1, cigar0),
+		NewRecord("E:::1:10:1:1", chr1, 210, r2R, 200, chr1, cigar0),
+	}
+
+	tempDir, cleanup := testutil.TempDir(t, "", "")
+	defer cleanup()
+	for testIdx, format := range []string{"bam", "pam"} {
+		opts := defaultOpts
+		opts.OutputPath = NewTestOutput(tempDir, testIdx, format)
+		opts.Format = format
+		opts.UMITag = "RX"
+
+		markDuplicates := &MarkDuplicates{
+			Provider: bamprovider.NewFakeProvider(header, records),
+			Opts:     &opts,
+		}
+		actualMetrics, err := markDuplicates.Mark(nil)
+		assert.NoError(t, err)
+		assert.Equal(t, int64(2), actualMetrics.UMIMissingReads, "format %s", format)
+		assert.Equal(t, int64(1), actualMetrics.UMIRescuedPairs, "format %s", format)
+		assert.Equal(t, int64(1), actualMetrics.UMIRescuedUnpaired, "format %s", format)
+		assert.Equal(t, 0, actualMetrics.Get("Unknown Library").ReadPairDups, "format %s", format)
+	}
+}
+
+// duplexUmiRecords returns readpairs from both strands of molecule 0
+// (A, B and C), from one strand of molecule 6 (D and E), and the
+// singleton molecule 10 (F).
+func duplexUmiRecords() []*sam.Record {
+	return []*sam.Record{
+		NewRecordAux("A:::1:10:1:1", chr1, 0, r1F, 10, chr1, cigar0, NewAux("RX", "AAA-CCC")),
+		NewRecordAux("B:::1:10:1:1", chr1, 0, r2F, 10, chr1, cigar0, NewAux("RX", "CCC-AAA")),
+		NewRecordAux("C:::1:10:1:1", chr1, 0, r1F, 10, chr1, cigar0, NewAux("RX", "AAA-CCC")),
+		NewRecordAux("A:::1:10:1:1", chr1, 10, r2R, 0, chr1, cigar0, NewAux("RX", "AAA-CCC")),
+		NewRecordAux("B:::1:10:1:1", chr1, 10, r1R, 0, chr1, cigar0, NewAux("RX", "CCC-AAA")),
+		NewRecordAux("C:::1:10:1:1", chr1, 10, r2R, 0, chr1, cigar0, NewAux("RX", "AAA-CCC")),
+		NewRecordAux("D:::1:10:1:1", chr1, 100, r1F, 110, chr1, cigar0, NewAux("RX", "GGG-TTT")),
+		NewRecordAux("E:::1:10:1:1", chr1, 100, r1F, 110, chr1, cigar0, NewAux("RX", "GGG-TTT")),
+		NewRecordAux("D:::1:10:1:1", chr1, 110, r2R, 100, chr1, cigar0, NewAux("RX", "GGG-TTT")),
+		NewRecordAux("E:::1:10:1:1", chr1, 110, r2R, 100, chr1, cigar0, NewAux("RX", "GGG-TTT")),
+		NewRecordAux("F:::1:10:1:1", chr1, 200, r1F, 210, chr1, cigar0, NewAux("RX", "AAA-CCC")),
+		NewRecordAux("F:::1:10:1:1", chr1, 210, r2R, 200, chr1, cigar0, NewAux("RX", "AAA-CCC")),
+	}
+}
+
+func TestDuplexUmi(t *testing.T) {
+	opts := defaultOpts
+	opts.UMITag = "RX"
+	opts.DuplexUMI = true
+	opts.EmitMITag = true
+	opts.DuplexMITag = true
+
+	// B is from the other strand of A's molecule, so its UMIs are in
+	// the opposite order, and it gets the /B suffix.
+	expected := []struct {
+		dup bool
+		mi  string
+	}{
+		{false, "0/A"}, {true, "0/B"}, {true, "0/A"}, {false, "0/A"}, {true, "0/B"}, {true, "0/A"},
+		{false, "6/A"}, {true, "6/A"}, {false, "6/A"}, {true, "6/A"},
+		{false, "10/A"}, {false, "10/A"},
+	}
+	var trecords []TestRecord
+	for i, r := range duplexUmiRecords() {
+		trecords = append(trecords, TestRecord{R: r, DupFlag: expected[i].dup,
+			ExpectedAuxs: []sam.Aux{NewAux("MI", expected[i].mi)}})
+	}
+	RunTestCases(t, header, []TestCase{{trecords, opts}})
+}
+
+func TestDuplexUmiMetrics(t *testing.T) {
+	tempDir, cleanup := testutil.TempDir(t, "", "")
+	defer cleanup()
+	for testIdx, format := range []string{"bam", "pam"} {
+		opts := defaultOpts
+		opts.OutputPath = NewTestOutput(tempDir, testIdx, format)
+		opts.Format = format
+		opts.UMITag = "RX"
+		opts.DuplexUMI = true
+
+		markDuplicates := &MarkDuplicates{
+			Provider: bamprovider.NewFakeProvider(header, duplexUmiRecords()),
+			Opts:     &opts,
+		}
+		actualMetrics, err := markDuplicates.Mark(nil)
+		assert.NoError(t, err)
+		assert.Equal(t, int64(1), actualMetrics.DuplexFamilies, "format %s", format)
+		assert.Equal(t, int64(1), actualMetrics.SingleStrandFamilies, "format %s", format)
+		assert.Equal(t, int64(1), actualMetrics.SingletonFamilies, "format %s", format)
+		assert.Equal(t, 6, actualMetrics.Get("Unknown Library").ReadPairDups, "format %s", format)
+	}
+}
+
 func TestUmiSnapCorrection(t *testing.T) {
 	useUmis := defaultOpts
 	useUmis.UseUmis = true
@@ -1128,87 +1635,1122 @@ func TestOpticalHistogramMax(t *testing.T) {
 		fmt.Sprintf("%d is out of expected range (%d, %d)", actualMetrics.OpticalDistance[3][5], int64(10000*.9), int64(10000*1.1)))
 }
 
-func TestStrandSpecific(t *testing.T) {
-	notStrandSpecific := defaultOpts
-	strandSpecific := defaultOpts
-	strandSpecific.StrandSpecific = true
+func TestOpticalHistogramNoLocation(t *testing.T) {
+	records := []*sam.Record{
+		NewRecord("oA:::1:10:1:1", chr1, 0, r1F, 100, chr1, cigar0),
+		NewRecord("oB:::1:10:1:5", chr1, 0, r1F, 100, chr1, cigar0),
+		NewRecord("m64011_190830_220126/1/ccs", chr1, 0, r1F, 200, chr1, cigar0),
+		NewRecord("m64011_190830_220126/2/ccs", chr1, 0, r1F, 200, chr1, cigar0),
+		NewRecord("0a4c2bd2-8c2f-4e1d-9f4b-6a1f3e6c7d8e", chr1, 0, r1F, 200, chr1, cigar0),
+		NewRecord("oA:::1:10:1:1", chr1, 100, r2R, 0, chr1, cigar0),
+		NewRecord("oB:::1:10:1:5", chr1, 100, r2R, 0, chr1, cigar0),
+		NewRecord("m64011_190830_220126/1/ccs", chr1, 200, r2R, 0, chr1, cigar0),
+		NewRecord("m64011_190830_220126/2/ccs", chr1, 200, r2R, 0, chr1, cigar0),
+		NewRecord("0a4c2bd2-8c2f-4e1d-9f4b-6a1f3e6c7d8e", chr1, 200, r2R, 0, chr1, cigar0),
+	}
 
-	cases := []TestCase{
-		{
-			// A and B are from different strands, if strandSpecific =
-			// false, they should be duplicates.
-			[]TestRecord{
-				{R: NewRecord("A:1:1:1:1:1:1:AAC+CCG", chr1, 0, r1F, 10, chr1, cigar0), DupFlag: false},
-				{R: NewRecord("B:1:1:1:1:1:2:CCG+AAC", chr1, 0, r2F, 10, chr1, cigar0), DupFlag: true},
-				{R: NewRecord("A:1:1:1:1:1:1:AAC+CCG", chr1, 10, r2R, 0, chr1, cigar0), DupFlag: false},
-				{R: NewRecord("B:1:1:1:1:1:2:CCG+AAC", chr1, 10, r1R, 0, chr1, cigar0), DupFlag: true},
-			},
-			notStrandSpecific,
-		},
-		{
-			// A and B are from different strand, if strandSpecific =
-			// true, they should not be duplicates.
-			[]TestRecord{
-				{R: NewRecord("A:1:1:1:1:1:1:AAC+CCG", chr1, 0, r1F, 10, chr1, cigar0), DupFlag: false},
-				{R: NewRecord("B:1:1:1:1:1:2:CCG+AAC", chr1, 0, r2F, 10, chr1, cigar0), DupFlag: false},
-				{R: NewRecord("A:1:1:1:1:1:1:AAC+CCG", chr1, 10, r2R, 0, chr1, cigar0), DupFlag: false},
-				{R: NewRecord("B:1:1:1:1:1:2:CCG+AAC", chr1, 10, r1F, 0, chr1, cigar0), DupFlag: false},
-			},
-			strandSpecific,
-		},
-		{
-			// A and B are from the same strand, if strandSpecific =
-			// true, they should be duplicates.
-			[]TestRecord{
-				{R: NewRecord("A:1:1:1:1:1:1:AAC+CCG", chr1, 0, r1F, 10, chr1, cigar0), DupFlag: false},
-				{R: NewRecord("B:1:1:1:1:1:2:AAC+CCG", chr1, 0, r1F, 10, chr1, cigar0), DupFlag: true},
-				{R: NewRecord("A:1:1:1:1:1:1:AAC+CCG", chr1, 10, r2R, 0, chr1, cigar0), DupFlag: false},
-				{R: NewRecord("B:1:1:1:1:1:2:AAC+CCG", chr1, 10, r2R, 0, chr1, cigar0), DupFlag: true},
-			},
-			strandSpecific,
-		},
-		{
-			// Singleton S has a position match and a matching
-			// strand. If strandSpecific = true, they should be
-			// duplicates.
-			[]TestRecord{
-				{R: NewRecord("A:1:1:1:1:1:1:AAC+CCG", chr1, 0, r1F|sam.MateReverse, 10, chr1, cigar0), DupFlag: false},
-				{R: NewRecord("A:1:1:1:1:1:1:AAC+CCG", chr1, 10, r2R, 0, chr1, cigar0), DupFlag: false},
-				{R: NewRecord("S:1:1:1:1:1:1:AAC+CCG", chr1, 10, s2R, 10, chr1, cigar0), DupFlag: true},
-			},
-			strandSpecific,
-		},
-		{
-			// Singleton S has a position match but not a matching
-			// strand. If strandSpecific = true, they should not be
-			// duplicates.
-			[]TestRecord{
-				{R: NewRecord("A:1:1:1:1:1:1:AAC+CCG", chr1, 0, r1R|sam.MateReverse, 10, chr1, cigar0), DupFlag: false},
-				{R: NewRecord("A:1:1:1:1:1:1:AAC+CCG", chr1, 10, r2R|sam.MateReverse, 0, chr1, cigar0), DupFlag: false},
-				{R: NewRecord("S:1:1:1:1:1:1:AAC+CCG", chr1, 10, s2R, 10, chr1, cigar0), DupFlag: false},
-			},
-			strandSpecific,
-		},
+	tempDir, cleanup := testutil.TempDir(t, "", "")
+	defer cleanup()
+	for testIdx, format := range []string{"bam", "pam"} {
+		provider := bamprovider.NewFakeProvider(header, records)
+		opts := defaultOpts
+		opts.OutputPath = NewTestOutput(tempDir, testIdx, format)
+		opts.Format = format
+		opts.OpticalHistogram = "optical-histogram.txt"
+		opts.OpticalHistogramMax = -1
+
+		markDuplicates := &MarkDuplicates{
+			Provider: provider,
+			Opts:     &opts,
+		}
+		actualMetrics, err := markDuplicates.Mark(nil)
+		assert.NoError(t, err)
+		assert.Equal(t, int64(3), actualMetrics.NoLocationPairs)
+		assert.Equal(t, int64(2), actualMetrics.OpticalNamesExamined)
+		assert.Equal(t, int64(0), actualMetrics.UnparseableNames)
+		assert.Equal(t, int64(1), actualMetrics.OpticalDistance[0][4])
+
+		// PCR duplicates are still marked for reads without a location.
+		assert.Equal(t, 2*3, actualMetrics.LibraryMetrics["Unknown Library"].ReadPairDups)
 	}
-	for _, useUmis := range []bool{false, true} {
-		t.Logf("useUmis: %v", useUmis)
-		for i := range cases {
-			cases[i].Opts.UseUmis = useUmis
+}
+
+func TestReadGroupMetrics(t *testing.T) {
+	rg1 := NewAux("RG", "rg1")
+	rg2 := NewAux("RG", "rg2")
+	records := []*sam.Record{
+		NewRecordAux("A:::1:1101:1:1", chr1, 0, r1F, 100, chr1, cigar0, rg1),
+		NewRecordAux("B:::1:1101:1:10", chr1, 0, r1F, 100, chr1, cigar0, rg2),
+		NewRecord("C:::1:1101:1:20", chr1, 10, r1F, 150, chr1, cigar0),
+		NewRecordAux("A:::1:1101:1:1", chr1, 100, r2R, 0, chr1, cigar0, rg1),
+		NewRecordAux("B:::1:1101:1:10", chr1, 100, r2R, 0, chr1, cigar0, rg2),
+		NewRecord("C:::1:1101:1:20", chr1, 150, r2R, 10, chr1, cigar0),
+	}
+
+	tempDir, cleanup := testutil.TempDir(t, "", "")
+	defer cleanup()
+	for testIdx, format := range []string{"bam", "pam"} {
+		provider := bamprovider.NewFakeProvider(header, records)
+		opts := defaultOpts
+		opts.OutputPath = NewTestOutput(tempDir, testIdx, format)
+		opts.Format = format
+
+		markDuplicates := &MarkDuplicates{
+			Provider: provider,
+			Opts:     &opts,
 		}
-		RunTestCases(t, header, cases)
+		actualMetrics, err := markDuplicates.Mark(nil)
+		assert.NoError(t, err)
+
+		// Notes that ReadPairsExamined, ReadPairDups, and
+		// ReadPairLibraryDups are doubled here because they are
+		// halved when written to the metrics file. Like picard, only
+		// the pairs of the same read group are optical duplicates,
+		// so B is a library duplicate of A.
+		assert.Equal(t, map[string]*Metrics{
+			"rg1":       {ReadPairsExamined: 2},
+			"rg2":       {ReadPairsExamined: 2, ReadPairDups: 2, ReadPairLibraryDups: 2},
+			NoReadGroup: {ReadPairsExamined: 2},
+		}, actualMetrics.ReadGroupMetrics)
+		assert.Equal(t, Metrics{ReadPairsExamined: 6, ReadPairDups: 2, ReadPairLibraryDups: 2},
+			*actualMetrics.LibraryMetrics["Unknown Library"])
+
+		lines := strings.Split(metricsTableString("READ_GROUP", actualMetrics.ReadGroupMetrics), "\n")
+		assert.Equal(t, "No Read Group\t0\t1\t0\t0\t0\t0\t0\t0.000000\t", lines[1])
+		assert.Equal(t, "rg2\t0\t1\t0\t0\t0\t1\t0\t100.000000\t", lines[3])
 	}
 }
 
-// Test that BagIDs match when 1 read is in a shard that crosses
-// reference boundary, and there are records with a alignment less
-// than the shard start's alignment position in the second reference
-// in the shard.
-func TestBagID(t *testing.T) {
+func TestSecondarySupplementaryMetrics(t *testing.T) {
+	sup1 := r1F | sam.Supplementary
+	// A and B are split reads whose read1 has a supplementary
+	// alignment on chr2. B is a duplicate of A, and its supplementary
+	// record is already flagged as a duplicate in the input.
+	records := []*sam.Record{
+		NewRecordAux("A:::1:10:1:1", chr1, 0, r1F, 105, chr1, cigar0,
+			NewAux("SA", "chr2,51,+,5M5S,60,0;")),
+		NewRecordAux("B:::1:10:1:1", chr1, 0, r1F, 105, chr1, cigar0,
+			NewAux("SA", "chr2,51,+,5M5S,60,0;")),
+		NewRecord("A:::1:10:1:1", chr1, 105, r2R, 0, chr1, cigar0),
+		NewRecord("B:::1:10:1:1", chr1, 105, r2R, 0, chr1, cigar0),
+		NewRecordAux("A:::1:10:1:1", chr2, 50, sup1, 105, chr1, cigar0,
+			NewAux("SA", "chr1,1,+,5S5M,60,0;")),
+		NewRecordAux("B:::1:10:1:1", chr2, 50, sup1|sam.Duplicate, 105, chr1, cigar0,
+			NewAux("SA", "chr1,1,+,5S5M,60,0;")),
+		NewRecord("A:::1:10:1:1", chr2, 120, sec, 105, chr1, cigar0),
+	}
+
 	tempDir, cleanup := testutil.TempDir(t, "", "")
 	defer cleanup()
+	for testIdx, format := range []string{"bam", "pam"} {
+		provider := bamprovider.NewFakeProvider(header, records)
+		opts := defaultOpts
+		opts.OutputPath = NewTestOutput(tempDir, testIdx, format)
+		opts.Format = format
 
-	shards := []gbam.Shard{
-		gbam.Shard{
+		markDuplicates := &MarkDuplicates{
+			Provider: provider,
+			Opts:     &opts,
+		}
+		actualMetrics, err := markDuplicates.Mark(nil)
+		assert.NoError(t, err)
+		assert.Equal(t, int64(1), actualMetrics.SecondaryReads, "format %s", format)
+		assert.Equal(t, int64(2), actualMetrics.SupplementaryReads, "format %s", format)
+		assert.Equal(t, int64(1), actualMetrics.SecondarySupplementaryDups, "format %s", format)
+		assert.Equal(t, int64(3), actualMetrics.SecondarySupplementarySkipped, "format %s", format)
+		assert.Equal(t, 3, actualMetrics.Get("Unknown Library").SecondarySupplementary, "format %s", format)
+
+		// Secondary and supplementary records are passed through unchanged.
+		actualRecords := ReadRecords(t, opts.OutputPath)
+		assert.Equal(t, len(records), len(actualRecords))
+		for _, r := range actualRecords {
+			if (r.Flags & (sam.Secondary | sam.Supplementary)) == 0 {
+				continue
+			}
+			assert.Equal(t, r.Name == "B:::1:10:1:1", (r.Flags&sam.Duplicate) != 0, "record %v", r)
+		}
+	}
+}
+
+func TestFlagSecondaryDups(t *testing.T) {
+	sup1 := r1F | sam.Supplementary
+	sup2 := r2R | sam.Supplementary
+	// A and B are split reads, and B is a duplicate of A. The read1s
+	// have supplementary records on chr2, in another shard. B's read2
+	// has a supplementary record before its primary record, and a
+	// secondary record on chr2. C's supplementary record is on chr1,
+	// but C is not a duplicate.
+	records := []*sam.Record{
+		NewRecordAux("A:::1:10:1:1", chr1, 0, r1F, 105, chr1, cigar0,
+			NewAux("SA", "chr2,51,+,5M5S,60,0;")),
+		NewRecordAux("B:::1:10:1:1", chr1, 0, r1F, 105, chr1, cigar0,
+			NewAux("SA", "chr2,51,+,5M5S,60,0;")),
+		NewRecordAux("B:::1:10:1:1", chr1, 80, sup2, 0, chr1, cigar0,
+			NewAux("SA", "chr1,106,-,5S5M,60,0;")),
+		NewRecord("A:::1:10:1:1", chr1, 105, r2R, 0, chr1, cigar0),
+		NewRecordAux("B:::1:10:1:1", chr1, 105, r2R, 0, chr1, cigar0,
+			NewAux("SA", "chr1,81,-,5M5S,60,0;")),
+		NewRecordAux("C:::1:10:1:1", chr1, 300, sup1, 500, chr2, cigar0,
+			NewAux("SA", "chr2,11,+,5S5M,60,0;")),
+		NewRecordAux("C:::1:10:1:1", chr2, 10, r1F, 500, chr2, cigar0,
+			NewAux("SA", "chr1,301,+,5M5S,60,0;")),
+		NewRecordAux("A:::1:10:1:1", chr2, 50, sup1, 105, chr1, cigar0,
+			NewAux("SA", "chr1,1,+,5S5M,60,0;")),
+		NewRecordAux("B:::1:10:1:1", chr2, 50, sup1, 105, chr1, cigar0,
+			NewAux("SA", "chr1,1,+,5S5M,60,0;")),
+		NewRecord("B:::1:10:1:1", chr2, 120, r2R|sam.Secondary, 0, chr1, cigar0),
+		NewRecord("C:::1:10:1:1", chr2, 500, r2R, 10, chr2, cigar0),
+	}
+
+	tempDir, cleanup := testutil.TempDir(t, "", "")
+	defer cleanup()
+	for testIdx, format := range []string{"bam", "pam"} {
+		for _, flagSecondaryDups := range []bool{false, true} {
+			provider := bamprovider.NewFakeProvider(header, records)
+			opts := defaultOpts
+			opts.OutputPath = NewTestOutput(tempDir, 2*testIdx, format)
+			if flagSecondaryDups {
+				opts.OutputPath = NewTestOutput(tempDir, 2*testIdx+1, format)
+			}
+			opts.Format = format
+			opts.FlagSecondaryDups = flagSecondaryDups
+
+			markDuplicates := &MarkDuplicates{
+				Provider: provider,
+				Opts:     &opts,
+			}
+			actualMetrics, err := markDuplicates.Mark(nil)
+			assert.NoError(t, err)
+
+			actualRecords := ReadRecords(t, opts.OutputPath)
+			assert.Equal(t, len(records), len(actualRecords))
+			for _, r := range actualRecords {
+				expected := r.Name == "B:::1:10:1:1"
+				if (r.Flags & (sam.Secondary | sam.Supplementary)) != 0 {
+					expected = expected && flagSecondaryDups
+				}
+				assert.Equal(t, expected, (r.Flags&sam.Duplicate) != 0, "flag-secondary-dups %v record %v",
+					flagSecondaryDups, r)
+			}
+			expectedDups := int64(0)
+			if flagSecondaryDups {
+				expectedDups = 3
+			}
+			assert.Equal(t, expectedDups, actualMetrics.SecondarySupplementaryDups, "format %s", format)
+		}
+	}
+}
+
+func TestFlagUnmappedMates(t *testing.T) {
+	cigarSoft2 := []sam.CigarOp{
+		sam.NewCigarOp(sam.CigarSoftClipped, 2),
+		sam.NewCigarOp(sam.CigarMatch, 8),
+	}
+	flagUnmapped := defaultOpts
+	flagUnmapped.FlagUnmappedMates = true
+
+	// B is a duplicate of A, and C of the readpair P. E is a duplicate
+	// of D in the next shard, where D is in the padding. F is a
+	// readpair with both reads unmapped.
+	records := []*sam.Record{
+		NewRecord("A:::1:10:1:1", chr1, 0, s1F, 0, chr1, cigar0),
+		NewRecord("A:::1:10:1:1", chr1, 0, u2, 0, chr1, cigar0),
+		NewRecord("B:::1:10:1:1", chr1, 0, s1F, 0, chr1, cigar0),
+		NewRecord("B:::1:10:1:1", chr1, 0, u2, 0, chr1, cigar0),
+		NewRecord("D:::1:10:1:1", chr1, 98, s1F, 98, chr1, cigar0),
+		NewRecord("D:::1:10:1:1", chr1, 98, u2, 98, chr1, cigar0),
+		NewRecord("E:::1:10:1:1", chr1, 100, s1F, 100, chr1, cigarSoft2),
+		NewRecord("E:::1:10:1:1", chr1, 100, u2, 100, chr1, cigar0),
+		NewRecord("P:::1:10:1:1", chr1, 200, r1F, 210, chr1, cigar0),
+		NewRecord("C:::1:10:1:1", chr1, 200, s1F, 200, chr1, cigar0),
+		NewRecord("C:::1:10:1:1", chr1, 200, u2, 200, chr1, cigar0),
+		NewRecord("P:::1:10:1:1", chr1, 210, r2R, 200, chr1, cigar0),
+		NewRecord("F:::1:10:1:1", chr1, 300, up1, 300, chr1, cigar0),
+		NewRecord("F:::1:10:1:1", chr1, 300, up2, 300, chr1, cigar0),
+	}
+	for _, test := range []struct {
+		opts Opts
+		dups []bool
+	}{
+		{defaultOpts, []bool{false, false, true, false, false, false, true, false, false, true, false, false, false, false}},
+		{flagUnmapped, []bool{false, false, true, true, false, false, true, true, false, true, true, false, false, false}},
+	} {
+		var trecords []TestRecord
+		for i, r := range records {
+			c := *r
+			trecords = append(trecords, TestRecord{R: &c, DupFlag: test.dups[i]})
+		}
+		RunTestCases(t, header, []TestCase{{trecords, test.opts}})
+	}
+}
+
+func TestFragmentDuplicates(t *testing.T) {
+	libraryHeader := newTestHeader(t, "@RG\tID:rg1\tLB:lib1\n@RG\tID:rg2\tLB:lib2\n")
+	rg1 := NewAux("RG", "rg1")
+	rg2 := NewAux("RG", "rg2")
+
+	// The fragments A and B are duplicates of the readpair P, and Q of
+	// the readpair R. D is a duplicate of the fragment C, and E of the
+	// readpair G in the same library, but F is in another library. The
+	// mate of U is in another shard, so U is only paired with it from
+	// the distant mates, and V is a duplicate of U.
+	records := []*sam.Record{
+		NewRecord("P:::1:10:1:1", chr1, 0, r1F, 50, chr1, cigar0),
+		NewRecord("A:::1:10:1:1", chr1, 0, s1F, 0, chr1, cigar0),
+		NewRecord("B:::1:10:1:1", chr1, 0, s1F, 0, chr1, cigar0),
+		NewRecord("P:::1:10:1:1", chr1, 50, r2R, 0, chr1, cigar0),
+		NewRecord("Q:::1:10:1:1", chr1, 200, r1F, 250, chr1, cigar0),
+		NewRecord("R:::1:10:1:1", chr1, 200, r1F, 250, chr1, cigar0),
+		NewRecord("Q:::1:10:1:1", chr1, 250, r2R, 200, chr1, cigar0),
+		NewRecord("R:::1:10:1:1", chr1, 250, r2R, 200, chr1, cigar0),
+		NewRecord("C:::1:10:1:1", chr1, 300, s1F, 300, chr1, cigar0),
+		NewRecord("D:::1:10:1:1", chr1, 300, s1F, 300, chr1, cigar0),
+		NewRecordAux("G:::1:10:1:1", chr1, 400, r1F, 450, chr1, cigar0, rg1),
+		NewRecordAux("E:::1:10:1:1", chr1, 400, s1F, 400, chr1, cigar0, rg1),
+		NewRecordAux("F:::1:10:1:1", chr1, 400, s1F, 400, chr1, cigar0, rg2),
+		NewRecordAux("G:::1:10:1:1", chr1, 450, r2R, 400, chr1, cigar0, rg1),
+		NewRecord("V:::1:10:1:1", chr1, 500, s1F, 500, chr1, cigar0),
+		NewRecord("U:::1:10:1:1", chr1, 500, r1F, 100, chr2, cigar0),
+		NewRecord("U:::1:10:1:1", chr2, 100, r2R, 500, chr1, cigar0),
+	}
+	dups := map[string]bool{"A": true, "B": true, "R": true, "D": true, "E": true, "V": true}
+
+	tempDir, cleanup := testutil.TempDir(t, "", "")
+	defer cleanup()
+	for testIdx, format := range []string{"bam", "pam"} {
+		provider := bamprovider.NewFakeProvider(libraryHeader, records)
+		opts := defaultOpts
+		opts.OutputPath = NewTestOutput(tempDir, testIdx, format)
+		opts.Format = format
+
+		markDuplicates := &MarkDuplicates{
+			Provider: provider,
+			Opts:     &opts,
+		}
+		actualMetrics, err := markDuplicates.Mark(nil)
+		assert.NoError(t, err)
+
+		actualRecords := ReadRecords(t, opts.OutputPath)
+		assert.Equal(t, len(records), len(actualRecords))
+		for _, r := range actualRecords {
+			assert.Equal(t, dups[r.Name[:1]], (r.Flags&sam.Duplicate) != 0, "record %v", r)
+		}
+
+		// Fragments are counted in UNPAIRED_READ_DUPLICATES, and
+		// readpairs in READ_PAIR_DUPLICATES.
+		unknown := actualMetrics.LibraryMetrics["Unknown Library"]
+		assert.Equal(t, 4, unknown.UnpairedDups, "format %s", format)
+		assert.Equal(t, 2, unknown.ReadPairDups, "format %s", format)
+		assert.Equal(t, 1, actualMetrics.LibraryMetrics["lib1"].UnpairedDups, "format %s", format)
+		assert.Equal(t, 0, actualMetrics.LibraryMetrics["lib1"].ReadPairDups, "format %s", format)
+		assert.Equal(t, 0, actualMetrics.LibraryMetrics["lib2"].UnpairedDups, "format %s", format)
+	}
+}
+
+func TestExcludedFromDups(t *testing.T) {
+	withMapQ := func(r *sam.Record, mapQ byte) *sam.Record {
+		r.MapQ = mapQ
+		return r
+	}
+	// Q, M and F come before P at the same position, and D before E.
+	// Q's read1 failed vendor quality checks, M's read2 and F have
+	// MAPQ 0, and so does D's read2 in another shard.
+	records := []*sam.Record{
+		withMapQ(NewRecord("Q:::1:10:1:1", chr1, 0, r1F|sam.QCFail, 50, chr1, cigar0), 60),
+		withMapQ(NewRecord("M:::1:10:1:1", chr1, 0, r1F, 50, chr1, cigar0), 60),
+		withMapQ(NewRecord("F:::1:10:1:1", chr1, 0, s1F, 0, chr1, cigar0), 0),
+		withMapQ(NewRecord("P:::1:10:1:1", chr1, 0, r1F, 50, chr1, cigar0), 60),
+		withMapQ(NewRecord("Q:::1:10:1:1", chr1, 50, r2R, 0, chr1, cigar0), 60),
+		withMapQ(NewRecord("M:::1:10:1:1", chr1, 50, r2R, 0, chr1, cigar0), 0),
+		withMapQ(NewRecord("P:::1:10:1:1", chr1, 50, r2R, 0, chr1, cigar0), 60),
+		withMapQ(NewRecord("D:::1:10:1:1", chr1, 200, r1F, 100, chr2, cigar0), 60),
+		withMapQ(NewRecord("E:::1:10:1:1", chr1, 200, r1F, 100, chr2, cigar0), 60),
+		withMapQ(NewRecord("D:::1:10:1:1", chr2, 100, r2R, 200, chr1, cigar0), 0),
+		withMapQ(NewRecord("E:::1:10:1:1", chr2, 100, r2R, 200, chr1, cigar0), 60),
+	}
+
+	tempDir, cleanup := testutil.TempDir(t, "", "")
+	defer cleanup()
+	for testIdx, format := range []string{"bam", "pam"} {
+		for _, exclude := range []bool{false, true} {
+			provider := bamprovider.NewFakeProvider(header, records)
+			opts := defaultOpts
+			opts.OutputPath = NewTestOutput(tempDir, 2*testIdx, format)
+			if exclude {
+				opts.OutputPath = NewTestOutput(tempDir, 2*testIdx+1, format)
+				opts.IgnoreQCFail = true
+				opts.MinMAPQForDup = 1
+			}
+			opts.Format = format
+
+			markDuplicates := &MarkDuplicates{
+				Provider: provider,
+				Opts:     &opts,
+			}
+			actualMetrics, err := markDuplicates.Mark(nil)
+			assert.NoError(t, err)
+
+			// Without exclusion, M and D are the primaries, since the
+			// failed vendor quality check of Q lowers its score like
+			// in picard. With it, the excluded readpairs cannot be
+			// primaries, and are not flagged, so P and E are the
+			// primaries.
+			dups := map[string]bool{"Q": true, "F": true, "P": true, "E": true}
+			expectedExcluded := int64(0)
+			if exclude {
+				dups = map[string]bool{}
+				expectedExcluded = 7
+			}
+			actualRecords := ReadRecords(t, opts.OutputPath)
+			assert.Equal(t, len(records), len(actualRecords))
+			for _, r := range actualRecords {
+				assert.Equal(t, dups[r.Name[:1]], (r.Flags&sam.Duplicate) != 0, "exclude %v record %v", exclude, r)
+			}
+			assert.Equal(t, expectedExcluded, actualMetrics.ExcludedFromDupAnalysis, "format %s", format)
+		}
+	}
+}
+
+func TestMalformedTemplates(t *testing.T) {
+	// B is a duplicate of A, and its read1 has two primary records, so
+	// the second one is passed through unflagged.
+	records := []*sam.Record{
+		NewRecord("A:::1:10:1:1", chr1, 0, r1F, 50, chr1, cigar0),
+		NewRecord("B:::1:10:1:1", chr1, 0, r1F, 50, chr1, cigar0),
+		NewRecord("B:::1:10:1:1", chr1, 0, r1F, 50, chr1, cigar0),
+		NewRecord("A:::1:10:1:1", chr1, 50, r2R, 0, chr1, cigar0),
+		NewRecord("B:::1:10:1:1", chr1, 50, r2R, 0, chr1, cigar0),
+	}
+	expectedDups := []bool{false, true, false, false, true}
+
+	tempDir, cleanup := testutil.TempDir(t, "", "")
+	defer cleanup()
+	for testIdx, format := range []string{"bam", "pam"} {
+		provider := bamprovider.NewFakeProvider(header, records)
+		opts := defaultOpts
+		opts.OutputPath = NewTestOutput(tempDir, testIdx, format)
+		opts.Format = format
+
+		markDuplicates := &MarkDuplicates{
+			Provider: provider,
+			Opts:     &opts,
+		}
+		actualMetrics, err := markDuplicates.Mark(nil)
+		assert.NoError(t, err)
+		assert.Equal(t, int64(1), actualMetrics.MalformedTemplateReads, "format %s", format)
+
+		actualRecords := ReadRecords(t, opts.OutputPath)
+		assert.Equal(t, len(records), len(actualRecords))
+		for i, r := range actualRecords {
+			assert.Equal(t, expectedDups[i], (r.Flags&sam.Duplicate) != 0, "record %v", r)
+		}
+	}
+}
+
+func TestMismatchedMates(t *testing.T) {
+	// B is a duplicate of A. The records of X are of two templates
+	// given the same name, with the read 2 at 30 of a template whose
+	// read 1 is at 300, so they are passed through unflagged instead
+	// of being paired. The records of Y are on different references,
+	// and the mate position of its read 2 is not that of its read 1,
+	// so they are not paired through the distant mates either.
+	records := []*sam.Record{
+		NewRecord("A:::1:10:1:1", chr1, 0, r1F, 50, chr1, cigar0),
+		NewRecord("B:::1:20:1:1", chr1, 0, r1F, 50, chr1, cigar0),
+		NewRecord("X:::1:30:1:1", chr1, 0, r1F, 50, chr1, cigar0),
+		NewRecord("Y:::1:40:1:1", chr1, 10, r1F, 100, chr2, cigar0),
+		NewRecord("X:::1:30:1:1", chr1, 30, r2R, 300, chr1, cigar0),
+		NewRecord("A:::1:10:1:1", chr1, 50, r2R, 0, chr1, cigar0),
+		NewRecord("B:::1:20:1:1", chr1, 50, r2R, 0, chr1, cigar0),
+		NewRecord("Y:::1:40:1:1", chr2, 100, r2R, 20, chr1, cigar0),
+	}
+	expectedDups := []bool{false, true, false, false, false, false, true, false}
+
+	tempDir, cleanup := testutil.TempDir(t, "", "")
+	defer cleanup()
+	for testIdx, format := range []string{"bam", "pam"} {
+		opts := defaultOpts
+		opts.OutputPath = NewTestOutput(tempDir, testIdx, format)
+		opts.Format = format
+
+		markDuplicates := &MarkDuplicates{
+			Provider: bamprovider.NewFakeProvider(header, records),
+			Opts:     &opts,
+		}
+		actualMetrics, err := markDuplicates.Mark(nil)
+		if !assert.NoError(t, err, "format %s", format) {
+			continue
+		}
+		assert.Equal(t, int64(4), actualMetrics.MateMismatchReads, "format %s", format)
+		assert.Equal(t, 2, actualMetrics.LibraryMetrics["Unknown Library"].ReadPairDups, "format %s", format)
+
+		actualRecords := ReadRecords(t, opts.OutputPath)
+		assert.Equal(t, len(records), len(actualRecords), "format %s", format)
+		for i, r := range actualRecords {
+			assert.Equal(t, expectedDups[i], (r.Flags&sam.Duplicate) != 0, "format %s, record %v", format, r)
+		}
+	}
+
+	// With queryname grouped input, X is passed through the same way.
+	opts := defaultOpts
+	opts.OutputPath = NewTestOutput(tempDir, 2, "bam")
+	opts.Format = "bam"
+	markDuplicates := &MarkDuplicates{
+		Provider: newTestProvider(t, newTestHeader(t, "@HD\tVN:1.6\tSO:queryname\n"), []*sam.Record{
+			NewRecord("A:::1:10:1:1", chr1, 0, r1F, 50, chr1, cigar0),
+			NewRecord("A:::1:10:1:1", chr1, 50, r2R, 0, chr1, cigar0),
+			NewRecord("X:::1:30:1:1", chr1, 0, r1F, 50, chr1, cigar0),
+			NewRecord("X:::1:30:1:1", chr1, 30, r2R, 300, chr1, cigar0),
+		}),
+		Opts: &opts,
+	}
+	actualMetrics, err := markDuplicates.Mark(nil)
+	if assert.NoError(t, err) {
+		assert.Equal(t, int64(2), actualMetrics.MateMismatchReads)
+		for _, r := range ReadRecords(t, opts.OutputPath) {
+			assert.Equal(t, sam.Flags(0), r.Flags&sam.Duplicate, "record %v", r)
+		}
+	}
+}
+
+func TestRegionMetrics(t *testing.T) {
+	// A and B are duplicates whose read1 is in the region, C and D are
+	// duplicates outside of it.
+	records := []*sam.Record{
+		NewRecord("A:::1:10:1:1", chr1, 0, r1F, 105, chr1, cigar0),
+		NewRecord("B:::1:11:1:1", chr1, 0, r1F, 105, chr1, cigar0),
+		NewRecord("A:::1:10:1:1", chr1, 105, r2R, 0, chr1, cigar0),
+		NewRecord("B:::1:11:1:1", chr1, 105, r2R, 0, chr1, cigar0),
+		NewRecord("C:::1:10:1:1", chr1, 300, r1F, 400, chr1, cigar0),
+		NewRecord("D:::1:11:1:1", chr1, 300, r1F, 400, chr1, cigar0),
+		NewRecord("C:::1:10:1:1", chr1, 400, r2R, 300, chr1, cigar0),
+		NewRecord("D:::1:11:1:1", chr1, 400, r2R, 300, chr1, cigar0),
+	}
+
+	tempDir, cleanup := testutil.TempDir(t, "", "")
+	defer cleanup()
+	bedPath := filepath.Join(tempDir, "regions.bed")
+	assert.NoError(t, ioutil.WriteFile(bedPath, []byte("chr1\t0\t50\ttarget\nchr1\t40\t60\nchrX\t0\t1000\n"), 0644))
+
+	for testIdx, format := range []string{"bam", "pam"} {
+		provider := bamprovider.NewFakeProvider(header, records)
+		opts := defaultOpts
+		opts.OutputPath = NewTestOutput(tempDir, testIdx, format)
+		opts.Format = format
+		opts.MetricsRegionsBED = bedPath
+
+		markDuplicates := &MarkDuplicates{
+			Provider: provider,
+			Opts:     &opts,
+		}
+		actualMetrics, err := markDuplicates.Mark(nil)
+		assert.NoError(t, err)
+		assert.Equal(t, Metrics{
+			ReadPairsExamined:   8,
+			ReadPairDups:        4,
+			ReadPairLibraryDups: 4,
+		}, *actualMetrics.Get("Unknown Library"), "format %s", format)
+		assert.Equal(t, 1, len(actualMetrics.RegionMetrics), "format %s", format)
+		assert.Equal(t, Metrics{
+			ReadPairsExamined:   2,
+			ReadPairDups:        1,
+			ReadPairLibraryDups: 1,
+		}, *actualMetrics.RegionMetrics["Unknown Library"], "format %s", format)
+
+		// Duplicate marking does not depend on the regions.
+		dups := 0
+		for _, r := range ReadRecords(t, opts.OutputPath) {
+			if (r.Flags & sam.Duplicate) != 0 {
+				dups++
+			}
+		}
+		assert.Equal(t, 4, dups, "format %s", format)
+	}
+
+	opts := defaultOpts
+	opts.MetricsRegionsBED = filepath.Join(tempDir, "missing.bed")
+	markDuplicates := &MarkDuplicates{
+		Provider: bamprovider.NewFakeProvider(header, records),
+		Opts:     &opts,
+	}
+	_, err := markDuplicates.Mark(nil)
+	assert.Error(t, err)
+}
+
+func TestProtectedRegions(t *testing.T) {
+	// The duplicate of A and B is flagged, but of the duplicate of C
+	// and D, only the read that does not overlap the protected region
+	// is flagged.
+	records := []*sam.Record{
+		NewRecord("A:::1:10:1:1", chr1, 0, r1F, 105, chr1, cigar0),
+		NewRecord("B:::1:11:1:1", chr1, 0, r1F, 105, chr1, cigar0),
+		NewRecord("A:::1:10:1:1", chr1, 105, r2R, 0, chr1, cigar0),
+		NewRecord("B:::1:11:1:1", chr1, 105, r2R, 0, chr1, cigar0),
+		NewRecord("C:::1:10:1:1", chr1, 300, r1F, 400, chr1, cigar0),
+		NewRecord("D:::1:11:1:1", chr1, 300, r1F, 400, chr1, cigar0),
+		NewRecord("C:::1:10:1:1", chr1, 400, r2R, 300, chr1, cigar0),
+		NewRecord("D:::1:11:1:1", chr1, 400, r2R, 300, chr1, cigar0),
+	}
+
+	tempDir, cleanup := testutil.TempDir(t, "", "")
+	defer cleanup()
+	bedPath := filepath.Join(tempDir, "protected.bed")
+	assert.NoError(t, ioutil.WriteFile(bedPath, []byte("chr1\t405\t406\n"), 0644))
+
+	testIdx := 0
+	for _, format := range []string{"bam", "pam"} {
+		for _, removeDups := range []bool{false, true} {
+			provider := bamprovider.NewFakeProvider(header, records)
+			opts := defaultOpts
+			opts.OutputPath = NewTestOutput(tempDir, testIdx, format)
+			opts.Format = format
+			opts.RemoveDups = removeDups
+			opts.ProtectedRegionsBED = bedPath
+			testIdx++
+
+			markDuplicates := &MarkDuplicates{
+				Provider: provider,
+				Opts:     &opts,
+			}
+			actualMetrics, err := markDuplicates.Mark(nil)
+			if !assert.NoError(t, err, "format %s, remove dups %v", format, removeDups) {
+				continue
+			}
+			assert.Equal(t, int64(1), actualMetrics.ProtectedDuplicates, "format %s, remove dups %v", format,
+				removeDups)
+			// The protected duplicate is still a duplicate in the
+			// library metrics.
+			assert.Equal(t, Metrics{
+				ReadPairsExamined:   8,
+				ReadPairDups:        4,
+				ReadPairLibraryDups: 4,
+			}, *actualMetrics.Get("Unknown Library"), "format %s, remove dups %v", format, removeDups)
+
+			dups, protected := 0, 0
+			output := ReadRecords(t, opts.OutputPath)
+			for _, r := range output {
+				if (r.Flags & sam.Duplicate) != 0 {
+					dups++
+				} else if r.Pos == 400 && r.AuxFields.Get(dtTag) != nil {
+					protected++
+				}
+			}
+			assert.Equal(t, 1, protected, "format %s, remove dups %v", format, removeDups)
+			if removeDups {
+				assert.Equal(t, 0, dups, "format %s, remove dups %v", format, removeDups)
+				assert.Equal(t, 5, len(output), "format %s, remove dups %v", format, removeDups)
+			} else {
+				assert.Equal(t, 3, dups, "format %s, remove dups %v", format, removeDups)
+			}
+		}
+	}
+}
+
+func TestReferenceMetrics(t *testing.T) {
+	// B is a duplicate of A on chr1, and E of D on chr2. T's reads are
+	// on chr1 and chr2, and U is unmapped.
+	records := []*sam.Record{
+		NewRecord("A:::1:10:1:1", chr1, 0, r1F, 105, chr1, cigar0),
+		NewRecord("B:::1:11:1:1", chr1, 0, r1F, 105, chr1, cigar0),
+		NewRecord("A:::1:10:1:1", chr1, 105, r2R, 0, chr1, cigar0),
+		NewRecord("B:::1:11:1:1", chr1, 105, r2R, 0, chr1, cigar0),
+		NewRecord("C:::1:10:1:1", chr1, 300, r1F, 330, chr1, cigar0),
+		NewRecord("C:::1:10:1:1", chr1, 330, r2R, 300, chr1, cigar0),
+		NewRecord("T:::1:10:1:1", chr1, 500, r1F, 10, chr2, cigar0),
+		NewRecord("T:::1:10:1:1", chr2, 10, r2R, 500, chr1, cigar0),
+		NewRecord("A:::1:10:1:1", chr2, 50, sec, 105, chr1, cigar0),
+		NewRecord("D:::1:10:1:1", chr2, 100, r1F, 200, chr2, cigar0),
+		NewRecord("E:::1:11:1:1", chr2, 100, r1F, 200, chr2, cigar0),
+		NewRecord("D:::1:10:1:1", chr2, 200, r2R, 100, chr2, cigar0),
+		NewRecord("E:::1:11:1:1", chr2, 200, r2R, 100, chr2, cigar0),
+		NewRecord("U:::2:11:1:1", nil, -1, up1, -1, nil, cigar0),
+		NewRecord("U:::2:11:1:1", nil, -1, up2, -1, nil, cigar0),
+	}
+
+	tempDir, cleanup := testutil.TempDir(t, "", "")
+	defer cleanup()
+	for testIdx, format := range []string{"bam", "pam"} {
+		provider := bamprovider.NewFakeProvider(header, records)
+		opts := defaultOpts
+		opts.OutputPath = NewTestOutput(tempDir, testIdx, format)
+		opts.Format = format
+		opts.PerReferenceMetrics = true
+
+		markDuplicates := &MarkDuplicates{
+			Provider: provider,
+			Opts:     &opts,
+		}
+		actualMetrics, err := markDuplicates.Mark(nil)
+		assert.NoError(t, err)
+		assert.Equal(t, map[string]*ReferenceMetrics{
+			"chr1": {ReadsExamined: 8, Duplicates: 2},
+			"chr2": {ReadsExamined: 4, Duplicates: 2},
+			"*":    {ReadsExamined: 2},
+		}, actualMetrics.ReferenceMetrics, "format %s", format)
+		assert.Equal(t, "REFERENCE\tREADS_EXAMINED\tDUPLICATES\tOPTICAL_DUPLICATES\tPERCENT_DUPLICATION\n"+
+			"chr1\t8\t2\t0\t25.000000\n"+
+			"chr2\t4\t2\t0\t50.000000\n"+
+			"*\t2\t0\t0\t0.000000\n",
+			referenceMetricsString(actualMetrics.ReferenceMetrics), "format %s", format)
+	}
+
+	// Without PerReferenceMetrics, the references are not counted.
+	opts := defaultOpts
+	opts.OutputPath = NewTestOutput(tempDir, 2, "bam")
+	markDuplicates := &MarkDuplicates{
+		Provider: bamprovider.NewFakeProvider(header, records),
+		Opts:     &opts,
+	}
+	actualMetrics, err := markDuplicates.Mark(nil)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, len(actualMetrics.ReferenceMetrics))
+}
+
+// Test that each readpair is counted once, in the shard of its left
+// read, as mated within the shard or through the distant mate table.
+func TestShardMetrics(t *testing.T) {
+	shards := []gbam.Shard{
+		{StartRef: chr1, EndRef: chr1, Start: 0, End: 500, Padding: 10, ShardIdx: 0},
+		{StartRef: chr1, EndRef: chr1, Start: 500, End: 1000, Padding: 10, ShardIdx: 1},
+		{StartRef: chr2, EndRef: chr2, Start: 0, End: 2000, Padding: 10, ShardIdx: 2},
+		{StartRef: nil, EndRef: nil, Start: 0, End: 0, Padding: 10, ShardIdx: 3},
+	}
+	// A is within shard 0. P's mate is in the padding of shard 0. D's
+	// reads are 300 bases apart in shards 0 and 1, and T's reads are
+	// on chr1 and chr2.
+	records := []*sam.Record{
+		NewRecord("A:::1:10:1:1", chr1, 10, r1F, 100, chr1, cigar0),
+		NewRecord("A:::1:10:1:1", chr1, 100, r2R, 10, chr1, cigar0),
+		NewRecord("D:::1:10:1:1", chr1, 400, r1F, 700, chr1, cigar0),
+		NewRecord("P:::1:10:1:1", chr1, 495, r1F, 505, chr1, cigar0),
+		NewRecord("P:::1:10:1:1", chr1, 505, r2R, 495, chr1, cigar0),
+		NewRecord("D:::1:10:1:1", chr1, 700, r2R, 400, chr1, cigar0),
+		NewRecord("T:::1:10:1:1", chr1, 800, r1F, 100, chr2, cigar0),
+		NewRecord("V:::1:10:1:1", chr2, 50, r1F, 60, chr2, cigar0),
+		NewRecord("V:::1:10:1:1", chr2, 60, r2R, 50, chr2, cigar0),
+		NewRecord("T:::1:10:1:1", chr2, 100, r2R, 800, chr1, cigar0),
+	}
+
+	tempDir, cleanup := testutil.TempDir(t, "", "")
+	defer cleanup()
+	for testIdx, format := range []string{"bam", "pam"} {
+		opts := defaultOpts
+		opts.OutputPath = NewTestOutput(tempDir, testIdx, format)
+		opts.Format = format
+
+		markDuplicates := &MarkDuplicates{
+			Provider: bamprovider.NewFakeProvider(header, records),
+			Opts:     &opts,
+		}
+		actualMetrics, err := markDuplicates.Mark(shards)
+		assert.NoError(t, err)
+		assert.Equal(t, map[int]*ShardMetrics{
+			0: {WithinShardPairs: 2, DistantMatePairs: 1},
+			1: {DistantMatePairs: 1},
+			2: {WithinShardPairs: 1},
+		}, actualMetrics.ShardMetrics, "format %s", format)
+		assert.Equal(t, []int64{0, 0, 1}, actualMetrics.DistantMateDistances, "format %s", format)
+		assert.Equal(t, int64(1), actualMetrics.DistantMateTransPairs, "format %s", format)
+		assert.Equal(t, "# sharding\n"+
+			"SHARD\tWITHIN_SHARD_PAIRS\tDISTANT_MATE_PAIRS\n"+
+			"0\t2\t1\n"+
+			"1\t0\t1\n"+
+			"2\t1\t0\n"+
+			"ALL\t3\t2\n"+
+			"\n"+
+			"DISTANT_MATE_DISTANCE\tPAIRS\n"+
+			"100-999\t1\n"+
+			"trans\t1\n",
+			shardingString(actualMetrics), "format %s", format)
+	}
+
+	assert.Equal(t, 0, distanceDecade(0))
+	assert.Equal(t, 0, distanceDecade(9))
+	assert.Equal(t, 1, distanceDecade(10))
+	assert.Equal(t, 3, distanceDecade(1000))
+	assert.Equal(t, "0-9", distanceDecadeName(0))
+	assert.Equal(t, "1000-9999", distanceDecadeName(3))
+}
+
+// Test that every metrics output splits the duplicates into optical
+// and PCR duplicates like the DT tags, and that the library metrics
+// match picard's.
+func TestOpticalMetricsSplit(t *testing.T) {
+	// P1, P2, and P3 are optical duplicates of each other, and P4 is a
+	// PCR duplicate on the same tile.
+	names := []string{"P1:::1:10:1000:1000", "P2:::1:10:1050:1000", "P3:::1:10:1000:1100",
+		"P4:::1:10:9000:9000"}
+	records := []*sam.Record{}
+	for _, name := range names {
+		records = append(records, NewRecord(name, chr1, 0, r1F, 105, chr1, cigar0))
+	}
+	for _, name := range names {
+		records = append(records, NewRecord(name, chr1, 105, r2R, 0, chr1, cigar0))
+	}
+
+	tempDir, cleanup := testutil.TempDir(t, "", "")
+	defer cleanup()
+	for testIdx, format := range []string{"bam", "pam"} {
+		provider := bamprovider.NewFakeProvider(header, records)
+		opts := defaultOpts
+		opts.OutputPath = NewTestOutput(tempDir, testIdx, format)
+		opts.Format = format
+		opts.TagDups = true
+		opts.PerReferenceMetrics = true
+
+		markDuplicates := &MarkDuplicates{
+			Provider: provider,
+			Opts:     &opts,
+		}
+		actualMetrics, err := markDuplicates.Mark(nil)
+		assert.NoError(t, err)
+
+		dtTags := map[string]int{}
+		for _, r := range ReadRecords(t, opts.OutputPath) {
+			if aux := r.AuxFields.Get(sam.Tag{'D', 'T'}); aux != nil {
+				dtTags[aux.Value().(string)]++
+			}
+		}
+		assert.Equal(t, map[string]int{"SQ": 4, "LB": 2}, dtTags, "format %s", format)
+
+		expected := Metrics{
+			ReadPairsExamined:   8,
+			ReadPairDups:        6,
+			ReadPairOpticalDups: 4,
+			ReadPairLibraryDups: 2,
+		}
+		assert.Equal(t, expected, *actualMetrics.Get("Unknown Library"), "format %s", format)
+		assert.Equal(t, expected, *actualMetrics.ReadGroup(NoReadGroup), "format %s", format)
+		// picard reports READ_PAIRS_EXAMINED=4, READ_PAIR_DUPLICATES=3,
+		// READ_PAIR_OPTICAL_DUPLICATES=2, and estimates the library
+		// size from the 2 non-optical readpairs and 1 unique readpair.
+		librarySize, err := estimateLibrarySize(2, 1)
+		assert.NoError(t, err)
+		assert.Equal(t, fmt.Sprintf("0\t4\t0\t0\t0\t3\t2\t75.000000\t%d", librarySize),
+			actualMetrics.Get("Unknown Library").String(), "format %s", format)
+
+		assert.Equal(t, &ReferenceMetrics{ReadsExamined: 8, Duplicates: 6, OpticalDuplicates: 4},
+			actualMetrics.ReferenceMetrics["chr1"], "format %s", format)
+		assert.Equal(t, InsertSizeCounts{Duplicates: 3, OpticalDuplicates: 2, NonDuplicates: 1},
+			actualMetrics.InsertSizes[1], "format %s", format)
+		var tiles TileMetrics
+		for _, m := range actualMetrics.TileMetrics {
+			tiles.DuplicatePairs += m.DuplicatePairs
+			tiles.OpticalPairs += m.OpticalPairs
+		}
+		assert.Equal(t, TileMetrics{DuplicatePairs: 3, OpticalPairs: 2}, tiles, "format %s", format)
+	}
+}
+
+func TestDuplicateSetSizes(t *testing.T) {
+	// X has 3 readpairs, Y 1, and Z 2. F is a set of 2 mate-unmapped
+	// reads.
+	records := []*sam.Record{
+		NewRecord("X1:::1:1101:1:1", chr1, 0, r1F, 100, chr1, cigar0),
+		NewRecord("X2:::1:1101:1:5000", chr1, 0, r1F, 100, chr1, cigar0),
+		NewRecord("X3:::1:1101:1:9000", chr1, 0, r1F, 100, chr1, cigar0),
+		NewRecord("Y:::1:1101:1:1", chr1, 10, r1F, 150, chr1, cigar0),
+		NewRecord("Z1:::1:1101:1:1", chr1, 20, r1F, 160, chr1, cigar0),
+		NewRecord("Z2:::1:1101:1:5000", chr1, 20, r1F, 160, chr1, cigar0),
+		NewRecord("X1:::1:1101:1:1", chr1, 100, r2R, 0, chr1, cigar0),
+		NewRecord("X2:::1:1101:1:5000", chr1, 100, r2R, 0, chr1, cigar0),
+		NewRecord("X3:::1:1101:1:9000", chr1, 100, r2R, 0, chr1, cigar0),
+		NewRecord("Y:::1:1101:1:1", chr1, 150, r2R, 10, chr1, cigar0),
+		NewRecord("Z1:::1:1101:1:1", chr1, 160, r2R, 20, chr1, cigar0),
+		NewRecord("Z2:::1:1101:1:5000", chr1, 160, r2R, 20, chr1, cigar0),
+		NewRecord("F1:::1:1101:1:1", chr1, 300, s1F, 0, nil, cigar0),
+		NewRecord("F1:::1:1101:1:1", chr1, 300, u2, 0, nil, cigar0),
+		NewRecord("F2:::1:1101:1:5000", chr1, 300, s1F, 0, nil, cigar0),
+		NewRecord("F2:::1:1101:1:5000", chr1, 300, u2, 0, nil, cigar0),
+	}
+
+	tempDir, cleanup := testutil.TempDir(t, "", "")
+	defer cleanup()
+	tests := []struct {
+		max      int
+		sizes    []int64
+		overflow int64
+	}{
+		{0, []int64{0, 1, 2, 1}, 0},
+		{2, []int64{0, 1, 2}, 1},
+	}
+	for testIdx, test := range tests {
+		provider := bamprovider.NewFakeProvider(header, records)
+		opts := defaultOpts
+		opts.OutputPath = NewTestOutput(tempDir, testIdx, "bam")
+		opts.Format = "bam"
+		opts.DuplicateSetSizeMax = test.max
+
+		markDuplicates := &MarkDuplicates{
+			Provider: provider,
+			Opts:     &opts,
+		}
+		actualMetrics, err := markDuplicates.Mark(nil)
+		assert.NoError(t, err)
+		assert.Equal(t, test.sizes, actualMetrics.DuplicateSetSizes, "max %d", test.max)
+		assert.Equal(t, test.overflow, actualMetrics.DuplicateSetSizeOverflow, "max %d", test.max)
+	}
+
+	metrics := NewMetricsCollection()
+	metrics.AddDuplicateSetSize(1, 2)
+	metrics.AddDuplicateSetSize(3, 2)
+	assert.Equal(t, "DUPLICATE_SET_SIZE\tCOUNT\n1\t1\n>2\t1\n",
+		duplicateSetSizesString(&Opts{DuplicateSetSizeMax: 2}, metrics))
+}
+
+func TestReadNameRegex(t *testing.T) {
+	re := regexp.MustCompile(`^anon-[A-Z]+-([0-9]+)-([0-9]+)-([0-9]+)$`)
+	records := []*sam.Record{
+		NewRecord("anon-A-1203-1-1", chr1, 0, r1F, 100, chr1, cigar0),
+		NewRecord("anon-B-1203-1-5", chr1, 0, r1F, 100, chr1, cigar0),
+		NewRecord("anon-C-12304-1-1", chr1, 0, r1F, 100, chr1, cigar0),
+		NewRecord("anon-A-1203-1-1", chr1, 100, r2R, 0, chr1, cigar0),
+		NewRecord("anon-B-1203-1-5", chr1, 100, r2R, 0, chr1, cigar0),
+		NewRecord("anon-C-12304-1-1", chr1, 100, r2R, 0, chr1, cigar0),
+	}
+
+	tempDir, cleanup := testutil.TempDir(t, "", "")
+	defer cleanup()
+	for testIdx, format := range []string{"bam", "pam"} {
+		provider := bamprovider.NewFakeProvider(header, records)
+		opts := defaultOpts
+		opts.OutputPath = NewTestOutput(tempDir, testIdx, format)
+		opts.Format = format
+		opts.OpticalHistogram = "optical-histogram.txt"
+		opts.OpticalHistogramMax = -1
+		opts.LocationParser = &RegexLocationParser{Regex: re}
+		opts.OpticalDetector = &TileOpticalDetector{
+			OpticalDistance: 2500,
+			LocationParser:  opts.LocationParser,
+		}
+
+		markDuplicates := &MarkDuplicates{
+			Provider: provider,
+			Opts:     &opts,
+		}
+		actualMetrics, err := markDuplicates.Mark(nil)
+		assert.NoError(t, err)
+		assert.Equal(t, int64(3), actualMetrics.OpticalNamesExamined)
+		assert.Equal(t, int64(0), actualMetrics.UnparseableNames)
+		assert.Equal(t, int64(1), actualMetrics.OpticalDistance[1][4])
+		assert.Equal(t, int64(2), actualMetrics.CrossTilePairsSkipped)
+
+		// A and B are on tile 1203, C is on tile 12304, so only one
+		// of A and B is an optical duplicate.
+		metrics := actualMetrics.LibraryMetrics["Unknown Library"]
+		assert.Equal(t, 2*2, metrics.ReadPairDups)
+		assert.Equal(t, 2*1, metrics.ReadPairOpticalDups)
+	}
+}
+
+func TestOpticalHistogramFlowcells(t *testing.T) {
+	records := []*sam.Record{
+		NewRecord("M1:1:FCA:1:1101:1:1", chr1, 0, r1F, 100, chr1, cigar0),
+		NewRecord("M1:2:FCB:1:1101:1:5", chr1, 0, r1F, 100, chr1, cigar0),
+		NewRecord("M1:2:FCB:1:1101:1:8", chr1, 0, r1F, 100, chr1, cigar0),
+		NewRecord("M1:1:FCA:1:1101:1:1", chr1, 100, r2R, 0, chr1, cigar0),
+		NewRecord("M1:2:FCB:1:1101:1:5", chr1, 100, r2R, 0, chr1, cigar0),
+		NewRecord("M1:2:FCB:1:1101:1:8", chr1, 100, r2R, 0, chr1, cigar0),
+	}
+
+	tempDir, cleanup := testutil.TempDir(t, "", "")
+	defer cleanup()
+	for testIdx, format := range []string{"bam", "pam"} {
+		provider := bamprovider.NewFakeProvider(header, records)
+		opts := defaultOpts
+		opts.OutputPath = NewTestOutput(tempDir, testIdx, format)
+		opts.Format = format
+		opts.OpticalHistogram = "optical-histogram.txt"
+		opts.OpticalHistogramMax = -1
+
+		markDuplicates := &MarkDuplicates{
+			Provider: provider,
+			Opts:     &opts,
+		}
+		actualMetrics, err := markDuplicates.Mark(nil)
+		assert.NoError(t, err)
+
+		// Only the two FCB pairs are compared with each other.
+		var total int64
+		for _, count := range actualMetrics.OpticalDistance[1] {
+			total += count
+		}
+		assert.Equal(t, int64(1), total)
+		assert.Equal(t, int64(1), actualMetrics.OpticalDistance[1][3])
+
+		// FCB:1:8 is an optical duplicate of FCB:1:5, but not of the
+		// primary on FCA.
+		metrics := actualMetrics.LibraryMetrics["Unknown Library"]
+		assert.Equal(t, 2*2, metrics.ReadPairDups)
+		assert.Equal(t, 2*1, metrics.ReadPairOpticalDups)
+	}
+}
+
+func TestOpticalHistogramNoFlowcell(t *testing.T) {
+	// The names have no flowcell, so the readpairs of the read group
+	// are compared across lanes.
+	records := []*sam.Record{
+		NewRecord("M1:1:1101:1:1", chr1, 0, r1F, 100, chr1, cigar0),
+		NewRecord("M2:2:1101:1:5", chr1, 0, r1F, 100, chr1, cigar0),
+		NewRecord("M1:1:1101:1:1", chr1, 100, r2R, 0, chr1, cigar0),
+		NewRecord("M2:2:1101:1:5", chr1, 100, r2R, 0, chr1, cigar0),
+	}
+
+	tempDir, cleanup := testutil.TempDir(t, "", "")
+	defer cleanup()
+	for testIdx, format := range []string{"bam", "pam"} {
+		provider := bamprovider.NewFakeProvider(header, records)
+		opts := defaultOpts
+		opts.OutputPath = NewTestOutput(tempDir, testIdx, format)
+		opts.Format = format
+		opts.OpticalHistogram = "optical-histogram.txt"
+		opts.OpticalHistogramMax = -1
+
+		markDuplicates := &MarkDuplicates{
+			Provider: provider,
+			Opts:     &opts,
+		}
+		actualMetrics, err := markDuplicates.Mark(nil)
+		assert.NoError(t, err)
+		// The bag of two readpairs is counted in the first bagsize row.
+		var total int64
+		for _, count := range actualMetrics.OpticalDistance[0] {
+			total += count
+		}
+		assert.Equal(t, int64(1), total, "format %s", format)
+		assert.Equal(t, int64(1), actualMetrics.OpticalDistance[0][4], "format %s", format)
+	}
+}
+
+func TestOpticalHistogramTiles(t *testing.T) {
+	// A and B are on tile 1101, C on the adjacent tile 1102, and D on
+	// the distant tile 2216.
+	records := []*sam.Record{
+		NewRecord("tA:::1:1101:1:1", chr1, 0, r1F, 100, chr1, cigar0),
+		NewRecord("tB:::1:1101:1:4", chr1, 0, r1F, 100, chr1, cigar0),
+		NewRecord("tC:::1:1102:1:9", chr1, 0, r1F, 100, chr1, cigar0),
+		NewRecord("tD:::1:2216:1:17", chr1, 0, r1F, 100, chr1, cigar0),
+		NewRecord("tA:::1:1101:1:1", chr1, 100, r2R, 0, chr1, cigar0),
+		NewRecord("tB:::1:1101:1:4", chr1, 100, r2R, 0, chr1, cigar0),
+		NewRecord("tC:::1:1102:1:9", chr1, 100, r2R, 0, chr1, cigar0),
+		NewRecord("tD:::1:2216:1:17", chr1, 100, r2R, 0, chr1, cigar0),
+	}
+	tests := []struct {
+		adjacentTiles bool
+		expectedHist  map[int]int
+		expectedSkips int64
+	}{
+		{false, map[int]int{3: 1}, 5},
+		{true, map[int]int{3: 1, 5: 1, 8: 1}, 3},
+	}
+
+	tempDir, cleanup := testutil.TempDir(t, "", "")
+	defer cleanup()
+	for testIdx, test := range tests {
+		for _, format := range []string{"bam", "pam"} {
+			provider := bamprovider.NewFakeProvider(header, records)
+			opts := defaultOpts
+			opts.OutputPath = NewTestOutput(tempDir, testIdx, format)
+			opts.Format = format
+			opts.OpticalHistogram = "optical-histogram.txt"
+			opts.OpticalHistogramMax = -1
+			opts.OpticalAdjacentTiles = test.adjacentTiles
+
+			markDuplicates := &MarkDuplicates{
+				Provider: provider,
+				Opts:     &opts,
+			}
+			actualMetrics, err := markDuplicates.Mark(nil)
+			assert.NoError(t, err)
+			assert.Equal(t, test.expectedSkips, actualMetrics.CrossTilePairsSkipped)
+			for j, count := range actualMetrics.OpticalDistance[1] {
+				assert.Equal(t, int64(test.expectedHist[j]), count, "distance %d", j)
+			}
+		}
+	}
+}
+
+func TestStrandSpecific(t *testing.T) {
+	notStrandSpecific := defaultOpts
+	strandSpecific := defaultOpts
+	strandSpecific.StrandSpecific = true
+
+	cases := []TestCase{
+		{
+			// A and B are from different strands, if strandSpecific =
+			// false, they should be duplicates.
+			[]TestRecord{
+				{R: NewRecord("A:1:1:1:1:1:1:AAC+CCG", chr1, 0, r1F, 10, chr1, cigar0), DupFlag: false},
+				{R: NewRecord("B:1:1:1:1:1:2:CCG+AAC", chr1, 0, r2F, 10, chr1, cigar0), DupFlag: true},
+				{R: NewRecord("A:1:1:1:1:1:1:AAC+CCG", chr1, 10, r2R, 0, chr1, cigar0), DupFlag: false},
+				{R: NewRecord("B:1:1:1:1:1:2:CCG+AAC", chr1, 10, r1R, 0, chr1, cigar0), DupFlag: true},
+			},
+			notStrandSpecific,
+		},
+		{
+			// A and B are from different strand, if strandSpecific =
+			// true, they should not be duplicates.
+			[]TestRecord{
+				{R: NewRecord("A:1:1:1:1:1:1:AAC+CCG", chr1, 0, r1F, 10, chr1, cigar0), DupFlag: false},
+				{R: NewRecord("B:1:1:1:1:1:2:CCG+AAC", chr1, 0, r2F, 10, chr1, cigar0), DupFlag: false},
+				{R: NewRecord("A:1:1:1:1:1:1:AAC+CCG", chr1, 10, r2R, 0, chr1, cigar0), DupFlag: false},
+				{R: NewRecord("B:1:1:1:1:1:2:CCG+AAC", chr1, 10, r1F, 0, chr1, cigar0), DupFlag: false},
+			},
+			strandSpecific,
+		},
+		{
+			// A and B are from the same strand, if strandSpecific =
+			// true, they should be duplicates.
+			[]TestRecord{
+				{R: NewRecord("A:1:1:1:1:1:1:AAC+CCG", chr1, 0, r1F, 10, chr1, cigar0), DupFlag: false},
+				{R: NewRecord("B:1:1:1:1:1:2:AAC+CCG", chr1, 0, r1F, 10, chr1, cigar0), DupFlag: true},
+				{R: NewRecord("A:1:1:1:1:1:1:AAC+CCG", chr1, 10, r2R, 0, chr1, cigar0), DupFlag: false},
+				{R: NewRecord("B:1:1:1:1:1:2:AAC+CCG", chr1, 10, r2R, 0, chr1, cigar0), DupFlag: true},
+			},
+			strandSpecific,
+		},
+		{
+			// Singleton S has a position match and a matching
+			// strand. If strandSpecific = true, they should be
+			// duplicates.
+			[]TestRecord{
+				{R: NewRecord("A:1:1:1:1:1:1:AAC+CCG", chr1, 0, r1F|sam.MateReverse, 10, chr1, cigar0), DupFlag: false},
+				{R: NewRecord("A:1:1:1:1:1:1:AAC+CCG", chr1, 10, r2R, 0, chr1, cigar0), DupFlag: false},
+				{R: NewRecord("S:1:1:1:1:1:1:AAC+CCG", chr1, 10, s2R, 10, chr1, cigar0), DupFlag: true},
+			},
+			strandSpecific,
+		},
+		{
+			// Singleton S has a position match but not a matching
+			// strand. If strandSpecific = true, they should not be
+			// duplicates.
+			[]TestRecord{
+				{R: NewRecord("A:1:1:1:1:1:1:AAC+CCG", chr1, 0, r1R|sam.MateReverse, 10, chr1, cigar0), DupFlag: false},
+				{R: NewRecord("A:1:1:1:1:1:1:AAC+CCG", chr1, 10, r2R|sam.MateReverse, 0, chr1, cigar0), DupFlag: false},
+				{R: NewRecord("S:1:1:1:1:1:1:AAC+CCG", chr1, 10, s2R, 10, chr1, cigar0), DupFlag: false},
+			},
+			strandSpecific,
+		},
+	}
+	for _, useUmis := range []bool{false, true} {
+		t.Logf("useUmis: %v", useUmis)
+		for i := range cases {
+			cases[i].Opts.UseUmis = useUmis
+		}
+		RunTestCases(t, header, cases)
+	}
+}
+
+// Test that BagIDs match when 1 read is in a shard that crosses
+// reference boundary, and there are records with a alignment less
+// than the shard start's alignment position in the second reference
+// in the shard.
+func TestBagID(t *testing.T) {
+	tempDir, cleanup := testutil.TempDir(t, "", "")
+	defer cleanup()
+
+	shards := []gbam.Shard{
+		gbam.Shard{
 			StartRef: chr1,
 			EndRef:   chr1,
 			Start:    0,
@@ -1382,6 +2924,7 @@ func TestOpticalDetector(t *testing.T) {
 						ReadPairsExamined:   4,
 						ReadPairDups:        2,
 						ReadPairOpticalDups: 0,
+						ReadPairLibraryDups: 2,
 					},
 				},
 			},
@@ -1402,6 +2945,7 @@ func TestOpticalDetector(t *testing.T) {
 						ReadPairsExamined:   4,
 						ReadPairDups:        2,
 						ReadPairOpticalDups: 0,
+						ReadPairLibraryDups: 2,
 					},
 				},
 			},
@@ -1454,7 +2998,7 @@ func TestOpticalDetector(t *testing.T) {
 			[]*sam.Record{
 				NewRecord("oG:::1:10:1:1", chr1, 50, r1F, 150, chr1, cigar0),
 				NewRecord("oH:::1:10:3000:5", chr1, 50, r1F, 151, chr1, cigar0),
-				NewRecord("oI:::1:10:4000:5", chr1, 51, r1F, 151, chr1, cigarSoft1),
+				NewRecord("oI:::1:10:4000:5", chr1, 51, r1F, 150, chr1, cigarSoft1),
 				NewRecord("oI:::1:10:4000:5", chr1, 150, r2R, 51, chr1, cigar0),
 				NewRecord("oG:::1:10:1:1", chr1, 150, r2R, 50, chr1, cigar0),
 				NewRecord("oH:::1:10:3000:5", chr1, 151, r2R, 50, chr1, cigarSoft1),
@@ -1466,6 +3010,7 @@ func TestOpticalDetector(t *testing.T) {
 						ReadPairsExamined:   6,
 						ReadPairDups:        4,
 						ReadPairOpticalDups: 2,
+						ReadPairLibraryDups: 2,
 					},
 				},
 			},
@@ -1501,7 +3046,7 @@ func TestOpticalDetector(t *testing.T) {
 			[]*sam.Record{
 				NewRecord("oG:::1:10:1:1", chr1, 50, r1F, 150, chr1, cigar0),
 				NewRecord("oH:::1:10:3000:5", chr1, 50, r1F, 151, chr1, cigar0),
-				NewRecord("oI:::1:10:4000:5", chr1, 51, r1F, 151, chr1, cigarSoft1),
+				NewRecord("oI:::1:10:4000:5", chr1, 51, r1F, 150, chr1, cigarSoft1),
 				NewRecord("oI:::1:10:4000:5", chr1, 150, r2R, 51, chr1, cigar0),
 				NewRecord("oG:::1:10:1:1", chr1, 150, r2R, 50, chr1, cigar0),
 				NewRecord("oH:::1:10:3000:5", chr1, 151, r2R, 50, chr1, cigarSoft1),
@@ -1510,8 +3055,9 @@ func TestOpticalDetector(t *testing.T) {
 			&MetricsCollection{
 				LibraryMetrics: map[string]*Metrics{
 					"Unknown Library": &Metrics{
-						ReadPairsExamined: 6,
-						ReadPairDups:      4,
+						ReadPairsExamined:   6,
+						ReadPairDups:        4,
+						ReadPairLibraryDups: 4,
 					},
 				},
 			},
@@ -1576,6 +3122,7 @@ func TestOpticalDetector(t *testing.T) {
 						ReadPairsExamined:   4,
 						ReadPairDups:        2,
 						ReadPairOpticalDups: 0,
+						ReadPairLibraryDups: 2,
 					},
 				},
 			},
@@ -1596,6 +3143,7 @@ func TestOpticalDetector(t *testing.T) {
 						ReadPairsExamined:   4,
 						ReadPairDups:        2,
 						ReadPairOpticalDups: 0,
+						ReadPairLibraryDups: 2,
 					},
 				},
 			},
@@ -1653,6 +3201,272 @@ func TestOpticalDetector(t *testing.T) {
 	}
 }
 
+// Test that optical duplicates are clustered transitively, like
+// picard's OPTICAL_DUPLICATE_PIXEL_DISTANCE.
+func TestOpticalDuplicatePixelDistance(t *testing.T) {
+	// A, B and C are chained within 100 pixels of each other, although
+	// A and C are 179 pixels apart, so picard puts them in one optical
+	// cluster and keeps A, the primary. D is on the same tile but too
+	// far away, and E is on a different tile.
+	records := []*sam.Record{
+		NewRecord("pA:::1:1101:1:1", chr1, 0, r1F, 100, chr1, cigar0),
+		NewRecord("pB:::1:1101:1:90", chr1, 0, r1F, 100, chr1, cigar0),
+		NewRecord("pC:::1:1101:1:180", chr1, 0, r1F, 100, chr1, cigar0),
+		NewRecord("pD:::1:1101:1:500", chr1, 0, r1F, 100, chr1, cigar0),
+		NewRecord("pE:::1:1102:1:1", chr1, 0, r1F, 100, chr1, cigar0),
+		NewRecord("pA:::1:1101:1:1", chr1, 100, r2R, 0, chr1, cigar0),
+		NewRecord("pB:::1:1101:1:90", chr1, 100, r2R, 0, chr1, cigar0),
+		NewRecord("pC:::1:1101:1:180", chr1, 100, r2R, 0, chr1, cigar0),
+		NewRecord("pD:::1:1101:1:500", chr1, 100, r2R, 0, chr1, cigar0),
+		NewRecord("pE:::1:1102:1:1", chr1, 100, r2R, 0, chr1, cigar0),
+	}
+	expectedDupType := []string{"", "SQ", "SQ", "LB", "LB", "", "SQ", "SQ", "LB", "LB"}
+
+	tempDir, cleanup := testutil.TempDir(t, "", "")
+	defer cleanup()
+	for testIdx, format := range []string{"bam", "pam"} {
+		provider := bamprovider.NewFakeProvider(header, records)
+		outputPath := NewTestOutput(tempDir, testIdx, format)
+		opts := defaultOpts
+		opts.OutputPath = outputPath
+		opts.Format = format
+		opts.OpticalDetector = nil
+		opts.OpticalDuplicatePixelDistance = 100
+
+		markDuplicates := &MarkDuplicates{
+			Provider: provider,
+			Opts:     &opts,
+		}
+		actualMetrics, err := markDuplicates.Mark(nil)
+		assert.NoError(t, err)
+
+		// The primary is never an optical duplicate.
+		assert.Equal(t, Metrics{
+			ReadPairsExamined:   10,
+			ReadPairDups:        8,
+			ReadPairOpticalDups: 4,
+			ReadPairLibraryDups: 4,
+		}, *actualMetrics.LibraryMetrics["Unknown Library"])
+
+		actualRecords := ReadRecords(t, outputPath)
+		assert.Equal(t, len(expectedDupType), len(actualRecords))
+		for i, r := range actualRecords {
+			aux := r.AuxFields.Get(sam.Tag{'D', 'T'})
+			if aux == nil {
+				assert.Equal(t, expectedDupType[i], "", "record %d", i)
+			} else {
+				assert.Equal(t, expectedDupType[i], aux.Value().(string), "record %d", i)
+			}
+		}
+	}
+}
+
+func TestOpticalDistanceMetric(t *testing.T) {
+	// A and B are 90 pixels apart on each axis, so they are within
+	// 100 pixels with PerAxisDistance, but 127 pixels apart with
+	// EuclideanDistance.
+	records := []*sam.Record{
+		NewRecord("A:::1:1101:0:0", chr1, 0, r1F, 100, chr1, cigar0),
+		NewRecord("B:::1:1101:90:90", chr1, 0, r1F, 100, chr1, cigar0),
+		NewRecord("A:::1:1101:0:0", chr1, 100, r2R, 0, chr1, cigar0),
+		NewRecord("B:::1:1101:90:90", chr1, 100, r2R, 0, chr1, cigar0),
+	}
+
+	tempDir, cleanup := testutil.TempDir(t, "", "")
+	defer cleanup()
+	tests := []struct {
+		metric      DistanceMetric
+		opticalDups int
+	}{
+		{"", 2},
+		{PerAxisDistance, 2},
+		{EuclideanDistance, 0},
+	}
+	for testIdx, test := range tests {
+		provider := bamprovider.NewFakeProvider(header, records)
+		opts := defaultOpts
+		opts.OutputPath = NewTestOutput(tempDir, testIdx, "bam")
+		opts.Format = "bam"
+		opts.OpticalDetector = nil
+		opts.OpticalDuplicatePixelDistance = 100
+		opts.OpticalDistanceMetric = test.metric
+
+		markDuplicates := &MarkDuplicates{
+			Provider: provider,
+			Opts:     &opts,
+		}
+		actualMetrics, err := markDuplicates.Mark(nil)
+		assert.NoError(t, err)
+		assert.Equal(t, test.opticalDups,
+			actualMetrics.LibraryMetrics["Unknown Library"].ReadPairOpticalDups, "metric %q", test.metric)
+	}
+}
+
+func TestOpticalHistogramSeed(t *testing.T) {
+	var names []string
+	for i := 0; i < 6; i++ {
+		names = append(names, fmt.Sprintf("P%d:::1:1101:%d:%d", i, 1+i*i*10, 1+i*7))
+	}
+	newRecords := func(order []int) []*sam.Record {
+		var records []*sam.Record
+		for _, i := range order {
+			records = append(records, NewRecord(names[i], chr1, 0, r1F, 100, chr1, cigar0))
+		}
+		for _, i := range order {
+			records = append(records, NewRecord(names[i], chr1, 100, r2R, 0, chr1, cigar0))
+		}
+		return records
+	}
+
+	tempDir, cleanup := testutil.TempDir(t, "", "")
+	defer cleanup()
+	var histograms [][][]int64
+	for testIdx, order := range [][]int{{0, 1, 2, 3, 4, 5}, {5, 3, 1, 4, 0, 2}} {
+		provider := bamprovider.NewFakeProvider(header, newRecords(order))
+		opts := defaultOpts
+		opts.OutputPath = NewTestOutput(tempDir, testIdx, "bam")
+		opts.Format = "bam"
+		opts.OpticalHistogram = "unused"
+		opts.OpticalHistogramMax = 3
+		opts.OpticalHistogramSeed = 42
+
+		markDuplicates := &MarkDuplicates{
+			Provider: provider,
+			Opts:     &opts,
+		}
+		actualMetrics, err := markDuplicates.Mark(nil)
+		assert.NoError(t, err)
+
+		// Only 3 of the 6 readpairs are sampled, so there are 3
+		// distances instead of 15.
+		var total int64
+		for _, count := range actualMetrics.OpticalDistance[2] {
+			total += count
+		}
+		assert.Equal(t, int64(3), total)
+		histograms = append(histograms, actualMetrics.OpticalDistance)
+	}
+	assert.Equal(t, histograms[0], histograms[1])
+}
+
+func TestOpticalScatter(t *testing.T) {
+	records := []*sam.Record{
+		NewRecord("A:::1:1101:1:1", chr1, 0, r1F, 100, chr1, cigar0),
+		NewRecord("B:::1:1101:1:10", chr1, 0, r1F, 100, chr1, cigar0),
+		NewRecord("C:::1:1101:1:20", chr1, 0, r1F, 100, chr1, cigar0),
+		NewRecord("D:::1:1102:1:1", chr1, 0, r1F, 100, chr1, cigar0),
+		NewRecord("E:::1:1102:1:1", chr1, 10, r1F, 150, chr1, cigar0),
+		NewRecord("F:::1:1103:5000:5000", chr1, 10, r1F, 150, chr1, cigar0),
+		NewRecord("A:::1:1101:1:1", chr1, 100, r2R, 0, chr1, cigar0),
+		NewRecord("B:::1:1101:1:10", chr1, 100, r2R, 0, chr1, cigar0),
+		NewRecord("C:::1:1101:1:20", chr1, 100, r2R, 0, chr1, cigar0),
+		NewRecord("D:::1:1102:1:1", chr1, 100, r2R, 0, chr1, cigar0),
+		NewRecord("E:::1:1102:1:1", chr1, 150, r2R, 10, chr1, cigar0),
+		NewRecord("F:::1:1103:5000:5000", chr1, 150, r2R, 10, chr1, cigar0),
+	}
+	expected := []string{
+		"1\t1101\t1\t1\t1\t1\t4\tfalse",
+		"1\t1101\t1\t1\t1\t10\t4\ttrue",
+		"1\t1101\t1\t1\t1\t20\t4\ttrue",
+		"1\t1102\t1\t1\t1\t1\t4\tfalse",
+		"1\t1102\t1\t1\t1\t1\t2\tfalse",
+		"1\t1103\t1\t1\t5000\t5000\t2\tfalse",
+	}
+	sort.Strings(expected)
+
+	tempDir, cleanup := testutil.TempDir(t, "", "")
+	defer cleanup()
+	for testIdx, format := range []string{"bam", "pam"} {
+		provider := bamprovider.NewFakeProvider(header, records)
+		opts := defaultOpts
+		opts.OutputPath = NewTestOutput(tempDir, testIdx, format)
+		opts.Format = format
+		opts.OpticalHistogramMax = -1
+		opts.OpticalScatterFile = filepath.Join(tempDir, fmt.Sprintf("scatter%d.tsv", testIdx))
+
+		markDuplicates := &MarkDuplicates{
+			Provider: provider,
+			Opts:     &opts,
+		}
+		_, err := markDuplicates.Mark(nil)
+		assert.NoError(t, err)
+
+		contents, err := ioutil.ReadFile(opts.OpticalScatterFile)
+		assert.NoError(t, err)
+		lines := strings.Split(strings.TrimSuffix(string(contents), "\n"), "\n")
+		assert.Equal(t, "lane\ttile\tsurface\tswath\tx\ty\tduplicate_set_size\toptical", lines[0])
+		sort.Strings(lines[1:])
+		assert.Equal(t, expected, lines[1:])
+	}
+}
+
+func TestTileMetrics(t *testing.T) {
+	// Tile 1101 has two optical duplicates of A. D is a duplicate of A
+	// on another tile, and F a duplicate of E on another tile, so
+	// neither is optical.
+	records := []*sam.Record{
+		NewRecord("A:::1:1101:1:1", chr1, 0, r1F, 100, chr1, cigar0),
+		NewRecord("B:::1:1101:1:10", chr1, 0, r1F, 100, chr1, cigar0),
+		NewRecord("C:::1:1101:1:20", chr1, 0, r1F, 100, chr1, cigar0),
+		NewRecord("D:::1:1102:1:1", chr1, 0, r1F, 100, chr1, cigar0),
+		NewRecord("E:::1:1102:1:1", chr1, 10, r1F, 150, chr1, cigar0),
+		NewRecord("F:::1:1103:5000:5000", chr1, 10, r1F, 150, chr1, cigar0),
+		NewRecord("A:::1:1101:1:1", chr1, 100, r2R, 0, chr1, cigar0),
+		NewRecord("B:::1:1101:1:10", chr1, 100, r2R, 0, chr1, cigar0),
+		NewRecord("C:::1:1101:1:20", chr1, 100, r2R, 0, chr1, cigar0),
+		NewRecord("D:::1:1102:1:1", chr1, 100, r2R, 0, chr1, cigar0),
+		NewRecord("E:::1:1102:1:1", chr1, 150, r2R, 10, chr1, cigar0),
+		NewRecord("F:::1:1103:5000:5000", chr1, 150, r2R, 10, chr1, cigar0),
+	}
+
+	tempDir, cleanup := testutil.TempDir(t, "", "")
+	defer cleanup()
+	for testIdx, format := range []string{"bam", "pam"} {
+		provider := bamprovider.NewFakeProvider(header, records)
+		opts := defaultOpts
+		opts.OutputPath = NewTestOutput(tempDir, testIdx, format)
+		opts.Format = format
+
+		markDuplicates := &MarkDuplicates{
+			Provider: provider,
+			Opts:     &opts,
+		}
+		actualMetrics, err := markDuplicates.Mark(nil)
+		assert.NoError(t, err)
+
+		assert.Equal(t, map[TileKey]*TileMetrics{
+			{"1", 1, 1, "1101"}: {DuplicatePairs: 2, OpticalPairs: 2},
+			{"1", 1, 1, "1102"}: {DuplicatePairs: 1, OpticalPairs: 0},
+			{"1", 1, 1, "1103"}: {DuplicatePairs: 1, OpticalPairs: 0},
+		}, actualMetrics.TileMetrics)
+		assert.Equal(t, "LANE\tSURFACE\tSWATH\tTILE\tREADS\tOPTICAL_PAIRS\tRATE\n"+
+			"1\t1\t1\t1101\t2\t2\t1.000000\n"+
+			"1\t1\t1\t1102\t1\t0\t0.000000\n"+
+			"1\t1\t1\t1103\t1\t0\t0.000000\n",
+			tileMetricsString(actualMetrics.TileMetrics))
+	}
+}
+
+func TestSortedTileKeys(t *testing.T) {
+	tiles := map[TileKey]*TileMetrics{}
+	for _, key := range []TileKey{
+		{"10", 1, 1, "1101"},
+		{"2", 1, 1, "1102"},
+		{"2", 1, 1, "1101"},
+		{"1", 1, 1, "1101"},
+		{"", 1, 1, "1101"},
+	} {
+		tiles[key] = &TileMetrics{}
+	}
+	assert.Equal(t, []TileKey{
+		{"", 1, 1, "1101"},
+		{"1", 1, 1, "1101"},
+		{"2", 1, 1, "1101"},
+		{"2", 1, 1, "1102"},
+		{"10", 1, 1, "1101"},
+	}, sortedTileKeys(tiles))
+}
+
 // Test the Metrics that markDuplicates() returns.
 func TestMetrics(t *testing.T) {
 	// Notes that ReadPairsExamined, ReadPairDups, and
@@ -1698,6 +3512,7 @@ func TestMetrics(t *testing.T) {
 						UnpairedDups:           0,
 						ReadPairDups:           2,
 						ReadPairOpticalDups:    0,
+						ReadPairLibraryDups:    2,
 					},
 				},
 			},
@@ -1721,6 +3536,7 @@ func TestMetrics(t *testing.T) {
 						UnpairedDups:           0,
 						ReadPairDups:           4,
 						ReadPairOpticalDups:    2,
+						ReadPairLibraryDups:    2,
 					},
 				},
 			},
@@ -1866,6 +3682,27 @@ func TestMetricsString(t *testing.T) {
 	}
 
 	assert.Equal(t, "2\t4\t2\t1\t2\t2\t1\t60.000000\t3", m.String())
+
+	// Without read pair duplicates, the library size is left empty.
+	m = Metrics{ReadPairsExamined: 8}
+	assert.Equal(t, "0\t4\t0\t0\t0\t0\t0\t0.000000\t", m.String())
+	m = Metrics{UnpairedReads: 4, UnpairedDups: 2}
+	assert.Equal(t, "4\t0\t0\t0\t2\t0\t0\t50.000000\t", m.String())
+}
+
+func TestMetricsTotal(t *testing.T) {
+	mc := NewMetricsCollection()
+	*mc.Get("lib1") = Metrics{ReadPairsExamined: 2000000, ReadPairDups: 400000}
+	*mc.Get("lib2") = Metrics{UnpairedReads: 10, UnpairedDups: 4}
+	total := mc.Total()
+	assert.Equal(t, Metrics{UnpairedReads: 10, ReadPairsExamined: 2000000, UnpairedDups: 4,
+		ReadPairDups: 400000}, total)
+	librarySize, ok := total.EstimatedLibrarySize()
+	assert.True(t, ok)
+	assert.Equal(t, uint64(2154184), librarySize)
+
+	_, ok = mc.LibraryMetrics["lib2"].EstimatedLibrarySize()
+	assert.False(t, ok)
 }
 
 func TestAlignDistCheck(t *testing.T) {
@@ -1884,6 +3721,7 @@ func TestAlignDistCheck(t *testing.T) {
 		ShardIdx: 0,
 	}
 	c := maxAlignDistCheck{
+		opts:               &Opts{},
 		padding:            10,
 		globalMaxAlignDist: &max,
 		mutex:              &m,
@@ -1967,6 +3805,114 @@ func TestAlignDistCheckIntegration(t *testing.T) {
 	assert.Error(t, err, "alignment distance(%d) exceeds padding(%d) on read: %v", 13, 10, "A")
 }
 
+// Test that the reads clipped at the first and last bases of a tiny
+// reference are marked in the shards of either of their duplicates.
+func TestContigEdgeDuplicates(t *testing.T) {
+	chrT, err := sam.NewReference("chrT", "", "", 20, nil, nil)
+	assert.NoError(t, err)
+	tinyHeader, err := sam.NewHeader(nil, []*sam.Reference{chrT})
+	assert.NoError(t, err)
+	parseCigar := func(s string) sam.Cigar {
+		cigar, err := sam.ParseCigar([]byte(s))
+		assert.NoError(t, err)
+		return cigar
+	}
+	// A and B are forward reads whose unclipped 5' position is -3, and
+	// C and D reverse reads whose unclipped 5' position is 23, beyond
+	// the end of chrT. Each pair has a read in each shard, and their
+	// mates are unmapped.
+	newRecords := func() []*sam.Record {
+		return []*sam.Record{
+			NewRecord("A:::1:10:1:1", chrT, 0, s1F, 0, chrT, parseCigar("3S7M")),
+			NewRecord("A:::1:10:1:1", chrT, 0, u2, 0, chrT, nil),
+			NewRecord("D:::1:13:1:1", chrT, 8, s2R, 8, chrT, parseCigar("12M4S")),
+			NewRecord("D:::1:13:1:1", chrT, 8, u1, 8, chrT, nil),
+			NewRecord("B:::1:11:1:1", chrT, 10, s1F, 10, chrT, parseCigar("13S5M")),
+			NewRecord("B:::1:11:1:1", chrT, 10, u2, 10, chrT, nil),
+			NewRecord("C:::1:12:1:1", chrT, 19, s2R, 19, chrT, parseCigar("1M4S")),
+			NewRecord("C:::1:12:1:1", chrT, 19, u1, 19, chrT, nil),
+		}
+	}
+	newShards := func(padding int) []gbam.Shard {
+		return []gbam.Shard{
+			{StartRef: chrT, EndRef: chrT, Start: 0, End: 10, Padding: padding, ShardIdx: 0},
+			{StartRef: chrT, EndRef: chrT, Start: 10, End: 20, Padding: padding, ShardIdx: 1},
+			{StartRef: nil, EndRef: nil, Start: 0, End: 0, Padding: padding, ShardIdx: 2},
+		}
+	}
+
+	tempDir, cleanup := testutil.TempDir(t, "", "")
+	defer cleanup()
+	bedPath := filepath.Join(tempDir, "edges.bed")
+	assert.NoError(t, ioutil.WriteFile(bedPath, []byte("chrT\t0\t1\nchrT\t19\t20\n"), 0644))
+	testIdx := 0
+	for _, format := range []string{"bam", "pam"} {
+		// The duplicates are the same with the tiny shards, and with
+		// the shards of the whole reference.
+		var expectedDups []string
+		for _, shards := range [][]gbam.Shard{nil, newShards(15)} {
+			opts := defaultOpts
+			opts.OutputPath = NewTestOutput(tempDir, testIdx, format)
+			opts.Format = format
+			opts.Padding = 15
+			opts.MetricsRegionsBED = bedPath
+			testIdx++
+
+			markDuplicates := &MarkDuplicates{
+				Provider: bamprovider.NewFakeProvider(tinyHeader, newRecords()),
+				Opts:     &opts,
+			}
+			actualMetrics, err := markDuplicates.Mark(shards)
+			if !assert.NoError(t, err, "format %s, shards %v", format, shards) {
+				continue
+			}
+			assert.Equal(t, Metrics{
+				UnpairedReads: 4,
+				UnmappedReads: 4,
+				UnpairedDups:  2,
+			}, *actualMetrics.Get("Unknown Library"), "format %s, shards %v", format, shards)
+			// The clipped reads are in the regions of the first and
+			// last bases.
+			assert.Equal(t, Metrics{
+				UnpairedReads: 4,
+				UnpairedDups:  2,
+			}, *actualMetrics.RegionMetrics["Unknown Library"], "format %s, shards %v", format, shards)
+
+			var dups []string
+			for _, r := range ReadRecords(t, opts.OutputPath) {
+				if (r.Flags & sam.Duplicate) != 0 {
+					dups = append(dups, r.Name[:1])
+				}
+			}
+			sort.Strings(dups)
+			if assert.Len(t, dups, 2, "format %s, shards %v", format, shards) {
+				assert.Contains(t, []string{"A", "B"}, dups[0], "format %s, shards %v", format, shards)
+				assert.Contains(t, []string{"C", "D"}, dups[1], "format %s, shards %v", format, shards)
+			}
+			if expectedDups == nil {
+				expectedDups = dups
+			} else {
+				assert.Equal(t, expectedDups, dups, "format %s", format)
+			}
+		}
+	}
+
+	// Shards whose padding is smaller than the clip distances of the
+	// reads, as in a manifest of another run, fail the check.
+	opts := defaultOpts
+	opts.OutputPath = NewTestOutput(tempDir, testIdx, "bam")
+	opts.Format = "bam"
+	opts.Padding = 15
+	markDuplicates := &MarkDuplicates{
+		Provider: bamprovider.NewFakeProvider(tinyHeader, newRecords()),
+		Opts:     &opts,
+	}
+	_, err = markDuplicates.Mark(newShards(5))
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "exceeds padding(5)")
+	}
+}
+
 func TestMetricsCollection(t *testing.T) {
 	m := MetricsCollection{
 		OpticalDistance: make([][]int64, 1),
@@ -1974,3 +3920,241 @@ func TestMetricsCollection(t *testing.T) {
 	m.OpticalDistance[0] = make([]int64, 10)
 	m.AddDistance(2, 10)
 }
+
+// shardingRecords returns readpairs and mate-unmapped reads in
+// clusters at the same positions, with equal scores so that the
+// primaries are chosen by file index. The clusters straddle the
+// boundaries of 1kb and 1Mb shards, and some readpairs have mates
+// that are more than a shard away.
+func shardingRecords(ref *sam.Reference) []*sam.Record {
+	rnd := rand.New(rand.NewSource(1))
+	var records []*sam.Record
+	for i := 0; i < 400; i++ {
+		pos := (rnd.Intn(10)*250000 + 995 + rnd.Intn(3)) % ref.Len()
+		name := fmt.Sprintf("T%d:::1:10:%d:%d", i, rnd.Intn(5000), rnd.Intn(5000))
+		if rnd.Intn(5) == 0 {
+			records = append(records,
+				NewRecord(name, ref, pos, s1F, pos, ref, cigar0),
+				NewRecord(name, ref, pos, u2, pos, ref, cigar0))
+			continue
+		}
+		matePos := pos + []int{20, 500, 3000, 1000050}[rnd.Intn(4)]
+		if matePos >= ref.Len() {
+			matePos = pos + 20
+		}
+		records = append(records,
+			NewRecord(name, ref, pos, r1F, matePos, ref, cigar0),
+			NewRecord(name, ref, matePos, r2R, pos, ref, cigar0))
+	}
+	sort.SliceStable(records, func(i, j int) bool {
+		return records[i].Pos < records[j].Pos
+	})
+	return records
+}
+
+func TestShardingDeterminism(t *testing.T) {
+	ref, err := sam.NewReference("chrD", "", "", 3000000, nil, nil)
+	assert.NoError(t, err)
+	shardingHeader, err := sam.NewHeader(nil, []*sam.Reference{ref})
+	assert.NoError(t, err)
+
+	tempDir, cleanup := testutil.TempDir(t, "", "")
+	defer cleanup()
+	testIdx := 0
+	for _, format := range []string{"bam", "pam"} {
+		var expected []string
+		for _, shardSize := range []int{1000, 1000000, ref.Len()} {
+			for _, parallelism := range []int{1, 8} {
+				opts := defaultOpts
+				opts.OutputPath = NewTestOutput(tempDir, testIdx, format)
+				opts.Format = format
+				opts.ShardSize = shardSize
+				opts.Parallelism = parallelism
+				testIdx++
+
+				markDuplicates := &MarkDuplicates{
+					Provider: bamprovider.NewFakeProvider(shardingHeader, shardingRecords(ref)),
+					Opts:     &opts,
+				}
+				_, err := markDuplicates.Mark(nil)
+				assert.NoError(t, err)
+
+				var actual []string
+				for _, r := range ReadRecords(t, opts.OutputPath) {
+					actual = append(actual, fmt.Sprintf("%s %d %d %v", r.Name, r.Pos, r.Flags, r.AuxFields))
+				}
+				if expected == nil {
+					expected = actual
+					continue
+				}
+				assert.Equal(t, expected, actual, "format %s shard size %d parallelism %d", format, shardSize,
+					parallelism)
+			}
+		}
+	}
+}
+
+func TestTaggingPolicy(t *testing.T) {
+	// A, B and C are duplicates, and B is an optical duplicate of A.
+	// D comes first, so DI, the file index of A's read1, is 1, and D
+	// is a set of its own.
+	records := func() []*sam.Record {
+		return []*sam.Record{
+			NewRecord("D:::1:10:9000:9000", chr1, 0, r1F, 500, chr1, cigar0),
+			NewRecord("A:::1:10:1:1", chr1, 95, r1F, 105, chr1, cigar0),
+			NewRecord("B:::1:10:1:2", chr1, 95, r1F, 105, chr1, cigar0),
+			NewRecord("C:::1:10:5000:5000", chr1, 95, r1F, 105, chr1, cigar0),
+			NewRecord("A:::1:10:1:1", chr1, 105, r2R, 95, chr1, cigar0),
+			NewRecord("B:::1:10:1:2", chr1, 105, r2R, 95, chr1, cigar0),
+			NewRecord("C:::1:10:5000:5000", chr1, 105, r2R, 95, chr1, cigar0),
+			NewRecord("D:::1:10:9000:9000", chr1, 500, r2R, 0, chr1, cigar0),
+		}
+	}
+	dupSet := []sam.Aux{NewAux("DI", "1"), NewAux("DS", 3), NewAux("DL", 2)}
+	dupSetTags := []sam.Tag{diTag, dsTag, dlTag}
+	allTags := append(dupSetTags, dtTag)
+	untagged := TestRecord{UnexpectedTags: allTags}
+	tagged := []TestRecord{
+		{ExpectedAuxs: []sam.Aux{NewAux("DI", "0"), NewAux("DS", 1), NewAux("DL", 1)}, UnexpectedTags: []sam.Tag{dtTag}},
+		{ExpectedAuxs: dupSet, UnexpectedTags: []sam.Tag{dtTag}},
+		{ExpectedAuxs: append(dupSet, NewAux("DT", "SQ"))},
+		{ExpectedAuxs: append(dupSet, NewAux("DT", "LB"))},
+	}
+	optical := []TestRecord{
+		untagged,
+		untagged,
+		{ExpectedAuxs: []sam.Aux{NewAux("DT", "SQ")}, UnexpectedTags: dupSetTags},
+		untagged,
+	}
+
+	tagDups := defaultOpts
+	all := defaultOpts
+	all.TagDups = false
+	all.TaggingPolicy = "all"
+	wholeChromosome := all
+	wholeChromosome.ShardSize = 1000
+	opticalOnly := all
+	opticalOnly.TaggingPolicy = "optical"
+	none := all
+	none.TaggingPolicy = "none"
+
+	for _, test := range []struct {
+		opts     Opts
+		expected []TestRecord
+	}{
+		{tagDups, tagged},
+		{all, tagged},
+		// DI does not depend on the shards.
+		{wholeChromosome, tagged},
+		{opticalOnly, optical},
+		{none, []TestRecord{untagged, untagged, untagged, untagged}},
+	} {
+		var trecords []TestRecord
+		for i, r := range records() {
+			// The reads of each template have the same tags.
+			tr := test.expected[[]int{0, 1, 2, 3, 1, 2, 3, 0}[i]]
+			tr.R = r
+			tr.DupFlag = i == 2 || i == 3 || i == 5 || i == 6
+			trecords = append(trecords, tr)
+		}
+		RunTestCases(t, header, []TestCase{{trecords, test.opts}})
+	}
+}
+
+func TestTagRepresentative(t *testing.T) {
+	// A and B are a readpair set with distant mates, and S is a
+	// mate-unmapped duplicate of A. F and G are a set of mate-unmapped
+	// reads.
+	records := []*sam.Record{
+		NewRecord("A:::1:10:1:1", chr1, 0, r1F, 500, chr1, cigar0),
+		NewRecord("B:::1:10:1:1", chr1, 0, r1F, 500, chr1, cigar0),
+		NewRecord("S:::1:10:1:1", chr1, 0, s1F, 0, chr1, cigar0),
+		NewRecord("S:::1:10:1:1", chr1, 0, u2, 0, chr1, cigar0),
+		NewRecord("F:::1:10:1:1", chr1, 300, s1F, 300, chr1, cigar0),
+		NewRecord("F:::1:10:1:1", chr1, 300, u2, 300, chr1, cigar0),
+		NewRecord("G:::1:10:1:1", chr1, 300, s1F, 300, chr1, cigar0),
+		NewRecord("G:::1:10:1:1", chr1, 300, u2, 300, chr1, cigar0),
+		NewRecord("A:::1:10:1:1", chr1, 500, r2R, 0, chr1, cigar0),
+		NewRecord("B:::1:10:1:1", chr1, 500, r2R, 0, chr1, cigar0),
+	}
+
+	tempDir, cleanup := testutil.TempDir(t, "", "")
+	defer cleanup()
+	for testIdx, format := range []string{"bam", "pam"} {
+		opts := defaultOpts
+		opts.OutputPath = NewTestOutput(tempDir, testIdx, format)
+		opts.Format = format
+		opts.TagRepresentative = true
+
+		markDuplicates := &MarkDuplicates{
+			Provider: bamprovider.NewFakeProvider(header, records),
+			Opts:     &opts,
+		}
+		_, err := markDuplicates.Mark(nil)
+		assert.NoError(t, err)
+
+		// Group the reads by DI.
+		sets := map[string][]string{}
+		for _, r := range ReadRecords(t, opts.OutputPath) {
+			di := r.AuxFields.Get(diTag)
+			if di == nil {
+				assert.True(t, (r.Flags&sam.Unmapped) != 0, "record %v", r)
+				continue
+			}
+			assert.Equal(t, NewAux("DS", 2), r.AuxFields.Get(dsTag), "record %v", r)
+			if (r.Flags & sam.Duplicate) == 0 {
+				assert.Nil(t, r.AuxFields.Get(dtTag), "record %v", r)
+				assert.Nil(t, r.AuxFields.Get(duTag), "record %v", r)
+			}
+			sets[di.Value().(string)] = append(sets[di.Value().(string)], r.Name)
+		}
+		assert.Equal(t, map[string][]string{
+			"0": {"A:::1:10:1:1", "B:::1:10:1:1", "S:::1:10:1:1", "A:::1:10:1:1", "B:::1:10:1:1"},
+			"4": {"F:::1:10:1:1", "G:::1:10:1:1"},
+		}, sets, "format %s", format)
+	}
+}
+
+func TestUnmappedInput(t *testing.T) {
+	unaligned, err := sam.NewHeader([]byte("@HD\tVN:1.6\tSO:unsorted\n@RG\tID:rg1\tSM:s1\n"), nil)
+	assert.NoError(t, err)
+	headers := []*sam.Header{
+		// An unaligned BAM, without references.
+		unaligned,
+		// A coordinate sorted BAM without mapped reads.
+		newTestHeader(t, "@HD\tVN:1.6\tSO:coordinate\n@RG\tID:rg1\tSM:s1\n"),
+	}
+	var records []*sam.Record
+	for i := 0; i < 5; i++ {
+		name := fmt.Sprintf("U%d:::1:10:1:%d", i, i)
+		records = append(records,
+			NewRecord(name, nil, -1, up1, -1, nil, nil),
+			NewRecord(name, nil, -1, up2, -1, nil, nil))
+	}
+
+	tempDir, cleanup := testutil.TempDir(t, "", "")
+	defer cleanup()
+	for testIdx, h := range headers {
+		opts := defaultOpts
+		opts.OutputPath = NewTestOutput(tempDir, testIdx, "bam")
+		opts.Format = "bam"
+		markDuplicates := &MarkDuplicates{
+			Provider: bamprovider.NewFakeProvider(h, records),
+			Opts:     &opts,
+		}
+		metrics, err := markDuplicates.Mark(nil)
+		assert.NoError(t, err, "header %d", testIdx)
+
+		// The records are passed through, in order.
+		output := ReadRecords(t, opts.OutputPath)
+		assert.Equal(t, len(records), len(output), "header %d", testIdx)
+		for i, r := range output {
+			assert.Equal(t, records[i].Name, r.Name, "header %d", testIdx)
+			assert.Equal(t, records[i].Flags, r.Flags, "header %d", testIdx)
+		}
+		lib := metrics.LibraryMetrics["Unknown Library"]
+		assert.Equal(t, len(records), lib.UnmappedReads, "header %d", testIdx)
+		assert.Equal(t, 0, lib.ReadPairsExamined, "header %d", testIdx)
+		assert.Equal(t, 0, lib.ReadPairDups, "header %d", testIdx)
+	}
+}
@@ -14,7 +14,6 @@
 package markduplicates
 
 import (
-	"compress/gzip"
 	"context"
 	"encoding/binary"
 	"fmt"
@@ -24,6 +23,7 @@ import (
 	"math"
 	"os"
 	"strconv"
+	"strings"
 	"sync"
 	"time"
 
@@ -76,39 +76,573 @@ type OpticalDetector interface {
 // Opts for mark-duplicates.
 type Opts struct {
 	// Commandline options.
-	BamFile                  string
-	IndexFile                string
+	// BamFile is the input, "-" for stdin, or a comma separated list
+	// of coordinate sorted inputs that are merged, see mergeInputs.
+	BamFile   string
+	IndexFile string
+	// InputOrder is the order of the input, "coordinate" or
+	// "queryname" for queryname grouped input, see inputOrder. If
+	// empty, it is taken from the SO and GO fields of the header.
+	InputOrder               string
 	MetricsFile              string
 	HighCoverageIntervalFile string
 	TileSizeFile             string
 	Format                   string
 	CoverageMax              int
 	ShardSize                int
-	MinBases                 int
-	Padding                  int
-	DiskMateShards           int
-	ScratchDir               string
-	Parallelism              int
-	QueueLength              int
-	ClearExisting            bool
-	RemoveDups               bool
-	TagDups                  bool
-	IntDI                    bool
-	UseUmis                  bool
-	UmiFile                  string
-	ScavengeUmis             int
-	EmitUnmodifiedFields     bool
-	SeparateSingletons       bool
-	OutputPath               string
-	StrandSpecific           bool
-	OpticalHistogram         string
-	OpticalHistogramMax      int
-	Seed                     int64
-
-	// Data and operators derived from commandline options.
-	BagProcessorFactories []BagProcessorFactory
-	OpticalDetector       OpticalDetector
-	KnownUmis             []byte
+	// TargetReadsPerShard, if > 0, sizes the shards to have about
+	// this many reads each, estimated from the BAI index IndexFile,
+	// instead of by ShardSize, see adaptiveShards.
+	TargetReadsPerShard int
+	MinBases            int
+	Padding             int
+	DiskMateShards      int
+	// MaxDistantMateMemoryMB, if > 0 and DiskMateShards is 0, is the
+	// memory budget of the distant mate table. If the table would
+	// exceed it, it is kept in disk shards in ScratchDir instead, see
+	// setupDistantMates.
+	MaxDistantMateMemoryMB int
+	// MaxMemoryMB, if > 0, is the memory budget of the major consumers
+	// of Mark. The pipeline of the BAM output stops reading new shards
+	// when it is reached, and the distant mate table is kept on disk if
+	// it would exceed half of it, see memory_budget.go.
+	MaxMemoryMB int
+	ScratchDir  string
+	Parallelism int
+	// ReadParallelism, ComputeParallelism and WriteParallelism are
+	// the goroutines of the stages of the BAM output that read the
+	// shards, mark their duplicates, and compress them, see
+	// pipeline.go. If 0, ComputeParallelism is Parallelism, and the
+	// others are derived from GOMAXPROCS.
+	ReadParallelism    int
+	ComputeParallelism int
+	WriteParallelism   int
+	QueueLength        int
+	// CompressionLevel is the gzip level of the BGZF blocks of the
+	// BAM output, from 1 to 9, or 0 or -1 for the default level.
+	CompressionLevel int
+	// Uncompressed writes the BGZF blocks of the BAM output without
+	// compression, for piping to another tool, instead of at
+	// CompressionLevel.
+	Uncompressed bool
+	// CompressionThreads is the number of goroutines that compress
+	// each shard of the BAM output, see shardCompressor. If it is
+	// less than 2, a shard is compressed by the writer that adds it.
+	CompressionThreads int
+	// NoFlagPatch encodes every record of the BAM output, even if only
+	// its duplicate flag changes, instead of patching the flags of the
+	// raw records of the input, see flag_patch.go.
+	NoFlagPatch bool
+	// ClearExisting clears the duplicate flags and tags of the input.
+	// It is the same as ExistingDuplicateHandling "clear".
+	ClearExisting bool
+	// ExistingDuplicateHandling is what to do with the duplicate flags
+	// and tags of the input: "clear" clears them, "preserve" keeps
+	// the flagged reads and their tags as they are, and only marks
+	// the templates without flagged reads, and "union" keeps the flags
+	// but replaces the tags, so that the flagged reads are the union
+	// of the old and new duplicates. If empty, the input is kept as is
+	// unless ClearExisting is set.
+	ExistingDuplicateHandling string
+	// ClearTags are the aux tags that are cleared from the input,
+	// e.g. to also clear site-specific tags. The default is DI, DL,
+	// DS, DT and DU.
+	ClearTags  []string
+	RemoveDups bool
+	// DuplicatesOutput is the path of a BAM file that the duplicates
+	// removed by RemoveDups are written to, see duplicatesOutput.
+	DuplicatesOutput string
+	// SplitOutputByReference, if non-empty, is the template of the
+	// paths of a BAM file per reference that the output is written to
+	// instead of OutputPath, with "{ref}" replaced by the name of the
+	// reference, "other", or "unmapped", see split_output.go.
+	// SplitOutputMaxFiles is the most files it writes, including the
+	// other and unmapped files, or 64 if it is zero.
+	SplitOutputByReference string
+	SplitOutputMaxFiles    int
+	TagDups                bool
+	// TaggingPolicy chooses the duplicate tags that are written, like
+	// picard's TAGGING_POLICY: "none" writes only the duplicate flags,
+	// "optical" writes DT:Z:SQ on optical duplicates, and "all" writes
+	// DI, DS, DL and DU on the reads of duplicate sets and DT:Z:SQ or
+	// DT:Z:LB on all duplicates. DI is the file index of the left read
+	// of the primary, so it is the same in every run, and DS is the
+	// number of readpairs in the set. If empty, it is "all" if TagDups
+	// is set, or "none" otherwise.
+	TaggingPolicy string
+	// TagOnlyMode groups reads into duplicate sets, and writes the
+	// duplicate and MI tags and the metrics as usual, but does not set
+	// the duplicate flag, so that consensus callers see all reads.
+	TagOnlyMode bool
+	// TagOnlyClearFlags makes ClearExisting clear the existing
+	// duplicate flags in TagOnlyMode. Otherwise TagOnlyMode keeps the
+	// input flags, and ClearExisting only clears the duplicate tags.
+	TagOnlyClearFlags bool
+	IntDI             bool
+	// TagRepresentative also writes the DI and DS tags on the
+	// mate-unmapped reads, so that every duplicate set can be rebuilt
+	// by grouping the reads by DI. The reads of readpairs always have
+	// them. A mate-unmapped read that is a duplicate of a readpair gets
+	// the DI and DS of its set, and the reads of a set of mate-unmapped
+	// reads get the file index of the representative as DI and the
+	// number of reads as DS. The representative never has DT or DU
+	// tags. It requires the "all" TaggingPolicy.
+	TagRepresentative bool
+	UseUmis           bool
+	UmiFile           string
+	// ScavengeUmis, if positive, is the largest edit distance at
+	// which the UMIs that are not in UmiFile are matched to its UMIs.
+	ScavengeUmis int
+	// UMITag, if non-empty, groups duplicates by the UMIs in this aux
+	// tag, e.g. "RX", as well as by position. A tag holds the UMI of
+	// its read, or the R1 and R2 UMIs separated by '-' or '+'. UseUmis
+	// and UMISource "qname" take precedence and read the UMIs from the
+	// read names instead.
+	UMITag string
+	// UMISource is where UMIs are read from, "tag" (the default) for
+	// the UMITag tag, or "qname" for the UMI field of 8 field Illumina
+	// read names, see PhysicalLocation.UMI. "qname" groups duplicates
+	// by UMI even if UMITag is empty. The UMI field holds one UMI for
+	// both reads, or the R1 and R2 UMIs separated by '-' or '+'.
+	UMISource string
+	// UMICorrection is how UMIs at the same position that differ by
+	// sequencing errors are merged before grouping: "none" (the
+	// default), "cluster" to merge UMIs at Hamming distance 1, or
+	// "directional" to merge a UMI with count n only into a UMI at
+	// Hamming distance 1 with count at least 2n-1, like umi_tools.
+	UMICorrection string
+	// UMIAllowlistFile, if non-empty, is a file of the valid UMIs,
+	// one per line, all of the same length. UMIs at Hamming distance 1
+	// from exactly one of them are corrected to it before grouping.
+	UMIAllowlistFile string
+	// UMIUnmatchedPolicy is what to do with UMIs that are not in
+	// UMIAllowlistFile and cannot be corrected to it: "raw" (the
+	// default) groups them by their value, and "drop" groups them like
+	// reads without UMIs, see RequireUMI.
+	UMIUnmatchedPolicy string
+	// RequireUMI excludes mapped reads without UMIs in their UMISource
+	// from duplicate sets. Otherwise they are grouped under an empty
+	// UMI.
+	RequireUMI bool
+	// DuplexUMI groups the two strands of duplex molecules by sorting
+	// the R1 and R2 UMIs of each readpair, so "AAA-CCC" and "CCC-AAA"
+	// have the same key. The original order labels the strand, see
+	// isBStrand.
+	DuplexUMI bool
+	// EmitMITag tags every record of the templates of a duplicate set
+	// with the set's molecule ID, as MI:i, for consensus callers. See
+	// molecule_id.go for how the IDs are numbered.
+	EmitMITag bool
+	// DuplexMITag writes the MI tags of EmitMITag as MI:Z with a /A or
+	// /B suffix for the strand of the template's R1.
+	DuplexMITag bool
+	// AddMateTags tags both reads of every readpair with the CIGAR and
+	// mapping quality of their mate, as MC:Z and MQ:i, see
+	// mate_tags.go. Reads that already have the tags keep them.
+	AddMateTags bool
+	// OverwriteMateTags replaces the MC and MQ tags that reads already
+	// have with those of AddMateTags.
+	OverwriteMateTags bool
+	// AddMateScoreTag tags both reads of every readpair with the sum of
+	// the base qualities >= 15 of their mate as ms:i, like samtools
+	// fixmate -m, see mate_tags.go.
+	AddMateScoreTag bool
+	// CellBarcodeTag, if non-empty, e.g. "CB", groups only reads with
+	// the same cell barcode in this aux tag into duplicate sets, for
+	// single-cell data. Reads without the tag are grouped together,
+	// like reads of one more cell. Set UMITag to "UB" to also group by
+	// the UMIs of the cells.
+	CellBarcodeTag string
+	// CellMetricsMax, if > 0, counts the reads and duplicates of the
+	// CellMetricsMax cell barcodes with the most reads in
+	// MetricsCollection.CellMetrics. To bound memory, the cells are
+	// trimmed to the 2*CellMetricsMax with the most reads after each
+	// shard, so the counts of the cells near the cutoff may be low.
+	CellMetricsMax int
+	// FlagSecondaryDups also flags the secondary and supplementary
+	// records of duplicate reads as duplicates, even if they are in
+	// other shards than their primary reads. If the input has any
+	// secondary or supplementary records, Mark first marks duplicates
+	// without writing them, which scans the input twice more. See
+	// secondary_dups.go.
+	FlagSecondaryDups bool
+	// FlagUnmappedMates also flags the placed unmapped mate of a
+	// duplicate mate-unmapped read as a duplicate, like picard does.
+	// Readpairs with both reads unmapped are never flagged.
+	FlagUnmappedMates bool
+	// IgnoreQCFail excludes the templates with a read that failed
+	// vendor quality checks (0x200) from duplicate marking.
+	IgnoreQCFail bool
+	// MinMAPQForDup, if > 0, excludes the templates with a read whose
+	// mapping quality is below MinMAPQForDup from duplicate marking,
+	// e.g. 1 excludes the MAPQ 0 multimappers. Excluded reads are
+	// passed through unflagged, and are counted in
+	// MetricsCollection.ExcludedFromDupAnalysis.
+	MinMAPQForDup int
+	// FilterExpression, if non-empty, is an expression over the fields
+	// and aux tags of a record, like those of samtools view --expr, see
+	// filter.go. The reads for which it is false are dropped as they
+	// are read, so they are neither marked nor written, and are counted
+	// in MetricsCollection.FilteredReads. The mate of a filtered read
+	// is marked as a fragment, see filter_input.go.
+	FilterExpression string
+	// StrictTemplates makes Mark fail with ErrMalformedTemplate on
+	// templates with more than two primary records, e.g. duplicated
+	// records from some aligners. Otherwise, the first read1 and read2
+	// records are used, and the extra records are passed through
+	// unflagged, and counted in MetricsCollection.MalformedTemplateReads.
+	StrictTemplates bool
+	// FailOnMateMismatch makes Mark fail with ErrMalformedTemplate on
+	// records with the same name that are not mates of each other,
+	// e.g. the reads of two templates given the same name. Otherwise,
+	// both records are passed through unflagged, and counted in
+	// MetricsCollection.MateMismatchReads.
+	FailOnMateMismatch bool
+	// DefaultLibrary is the library of the read groups without an LB
+	// field, and of the reads without a read group. Duplicates are
+	// only marked within a library. The default is "Unknown Library".
+	DefaultLibrary string
+	// LibraryMapFile, if non-empty, is a file of read groups and their
+	// libraries, one whitespace separated pair per line, that
+	// overrides the LB fields of the header.
+	LibraryMapFile string
+	// PrimarySelection is how the primary of a duplicate set is
+	// chosen among the templates with the highest PrimaryScorer score:
+	// "fileidx" (the default) chooses the one that comes first in the
+	// input, and "baseq" the one with the smallest read name, which
+	// matches picard's choice.
+	PrimarySelection string
+	// PrimaryScorer names the built-in PairScorer that scores the
+	// templates of duplicate sets to choose their primaries, see
+	// ParsePairScorer. The default is "baseq", the sum of the base
+	// qualities >= 15.
+	PrimaryScorer        string
+	EmitUnmodifiedFields bool
+	SeparateSingletons   bool
+	OutputPath           string
+	// MetricsOnly marks the duplicates, including the distant mates and
+	// the optical duplicates, but writes no output BAM or PAM, only
+	// the metrics, histograms, and reports. The records of the output
+	// are not tagged or compressed, which makes it much faster when
+	// only the duplication rate is needed.
+	MetricsOnly bool
+	// IndexFormat is the format of the index that is written next to
+	// the coordinate sorted BAM output, "bai", "csi", or "none" to
+	// not index it. If empty, it is "csi" if a reference is longer
+	// than 2^29, and "bai" otherwise, see outputIndexFormat.
+	IndexFormat         string
+	StrandSpecific      bool
+	OpticalHistogram    string
+	OpticalHistogramMax int
+	// DuplicateSetSizeMax is the largest duplicate set size counted
+	// individually in MetricsCollection.DuplicateSetSizes. Larger sets
+	// are counted in MetricsCollection.DuplicateSetSizeOverflow. If
+	// <= 0, defaultDuplicateSetSizeMax is used.
+	DuplicateSetSizeMax int
+	// MaxDuplicateSetSize, if > 0, is the most readpairs of a
+	// duplicate set that are compared for optical duplicates and
+	// distances. Larger sets are flagged as usual, but their optical
+	// analysis is done on a sample, see capDuplicateSet.
+	MaxDuplicateSetSize int
+	// MetricsRegionsBED, if non-empty, is a BED file of regions of
+	// interest, e.g. the capture regions of a targeted panel. Mark
+	// then also reports metrics for just the reads whose unclipped 5'
+	// position, clamped to the reference, overlaps a region. It does
+	// not change which reads are marked as duplicates.
+	MetricsRegionsBED string
+	// ProtectedRegionsBED, if non-empty, is a BED file of regions in
+	// which no evidence may be removed, e.g. validated variants. The
+	// duplicates are found as usual, and tagged, but a record whose
+	// alignment overlaps a region is not flagged or removed as a
+	// duplicate. Such records are counted in
+	// MetricsCollection.ProtectedDuplicates, and are still duplicates
+	// in the library metrics.
+	ProtectedRegionsBED string
+	// Regions, if non-empty, restricts Mark to regions of the genome,
+	// a BED file if it ends with ".bed", or a comma separated list of
+	// samtools style regions, e.g. "chr1:1000-2000,chr2". The output
+	// and the metrics have just the reads of the regions; mates
+	// outside the regions are read through the index, see
+	// regionShards.
+	Regions string
+	// InsertSizeBins are the upper bounds of the insert size bins of
+	// MetricsCollection.InsertSizes, in increasing order. The last bin
+	// has no upper bound. If empty, the bins are 0-100, 100-200, ...,
+	// 1000+.
+	InsertSizeBins []int
+	// PerReferenceMetrics adds a table of the duplication rate of each
+	// reference to the metrics, e.g. to see the duplication of chrM.
+	PerReferenceMetrics bool
+	// GCMetrics adds a table of the duplication rate of the templates
+	// by their GC content to the metrics, see gc_content.go.
+	GCMetrics bool
+	// GCReference, if non-empty, is an indexed FASTA of the references,
+	// from which GCMetrics counts the GC content of the reads without
+	// a sequence.
+	GCReference string
+	// Flagstat counts the records of the input and of the output like
+	// samtools flagstat, adds both to the metrics, and makes Mark fail
+	// with ErrFlagstat if a record is lost or added, or a flag other
+	// than the duplicate flag is changed, see flagstat.go.
+	Flagstat bool
+	// MetricsFormat is the format of MetricsFile, "text" or "json".
+	// The default is "text".
+	MetricsFormat string
+	// OpticalHistogramFile, if non-empty, is where the optical
+	// histogram is written in a machine readable format, with one row
+	// per non-empty distance bin and bagsize range.
+	OpticalHistogramFile string
+	// OpticalHistogramFormat is the format of OpticalHistogramFile,
+	// "tsv" or "json". The default is "tsv".
+	OpticalHistogramFormat string
+	// OpticalHistogramSeed seeds the sampling of readpairs when
+	// OpticalHistogramMax limits the readpairs in the optical
+	// histogram. If 0, each duplicate set is sampled with its first
+	// file index as the seed, so the sample changes when the input is
+	// resharded or trimmed.
+	OpticalHistogramSeed int64
+	// OpticalScatterFile, if non-empty, is where the flowcell
+	// locations of duplicate readpairs are written, one line per
+	// readpair, for plotting. Like the optical histogram, at most
+	// OpticalHistogramMax readpairs are written per grouping key.
+	OpticalScatterFile string
+	// DuplicateSetReport, if non-empty, is where a tab separated row
+	// is written for each record of a duplicate set of more than one
+	// template, with the DI and DS of its set, for comparing the
+	// duplicate sets of different tools. It is gzip compressed if the
+	// path ends with ".gz".
+	DuplicateSetReport string
+	// HotspotBED, if non-empty, is where the merged intervals of the
+	// duplicate sets of more than HotspotMinSetSize entries are
+	// written, see hotspots.go.
+	HotspotBED        string
+	HotspotMinSetSize int
+	// ShardManifestFile, if non-empty, is where a tab separated row is
+	// written for each shard of coordinate sorted input, with its
+	// boundaries, records, duplicates and wall time, see
+	// shard_manifest.go.
+	ShardManifestFile string
+	// ShardManifestInput, if non-empty, is a shard manifest whose
+	// shards are used instead of generated, to shard the input like
+	// the run that wrote it.
+	ShardManifestInput string
+	// ProgressInterval, if > 0, is the interval at which Mark logs its
+	// progress, see Progress.
+	ProgressInterval time.Duration
+	// LogLevel, if non-empty, is the level of the log messages of
+	// Mark, as a comma separated list of a level for all the
+	// components, and of component=level for one of them, e.g.
+	// "info,distantmates=debug". The levels are off, error, info, and
+	// debug, and the components are io, shard, distantmates, optical,
+	// and metrics. If empty, the messages go to the grailbase log at
+	// its level.
+	LogLevel string
+	// LogFormat is the format of the log messages, text or json. The
+	// json messages go to stderr like those of LogLevel, and have the
+	// component, and the shard ID and genomic range of the messages
+	// about a shard.
+	LogFormat string
+	// VerifyAgainst, if non-empty, is the path of a coordinate sorted
+	// BAM of the same reads with their duplicates already marked,
+	// e.g. by picard. When Mark is done, the duplicate flags of the
+	// output are compared with it, see Verification.
+	VerifyAgainst string
+	// VerifyDisagreements, if non-empty, is the path of a tab
+	// separated list of the records whose duplicate flags disagree
+	// with VerifyAgainst.
+	VerifyDisagreements string
+	// OpticalHistogramMaxDistance, if > 0, limits the optical
+	// histogram to distances below it. Pairs of readpairs that are
+	// further apart are counted in
+	// MetricsCollection.OpticalDistanceOverflow, which lets the
+	// histogram be computed with a grid search instead of comparing
+	// all pairs.
+	OpticalHistogramMaxDistance int
+	// OpticalDuplicatePixelDistance is the maximum X and Y pixel
+	// distance between two duplicate pairs on the same tile for them
+	// to be optical duplicates, like picard's
+	// OPTICAL_DUPLICATE_PIXEL_DISTANCE. If it is > 0 and
+	// OpticalDetector is nil, Mark uses a TileOpticalDetector with
+	// this distance.
+	OpticalDuplicatePixelDistance int
+	// OpticalDistanceMapFile, if non-empty, is a file of read groups
+	// and their optical pixel distances, one whitespace separated pair
+	// per line, that override the distance of the TileOpticalDetector
+	// for their read groups, see optical_distance.go.
+	OpticalDistanceMapFile string
+	// OpticalDistanceFromPlatform gives the read groups whose @RG PM
+	// or PL field names an instrument with patterned flowcells, such
+	// as a NovaSeq or a HiSeq X, an optical pixel distance of 2500,
+	// unless OpticalDistanceMapFile has their distance.
+	OpticalDistanceFromPlatform bool
+	// OpticalDistanceMetric is how distances between readpairs are
+	// measured, both for the optical histogram and for the default
+	// optical detector. EuclideanDistance and PerAxisDistance differ
+	// for readpairs that are offset on both axes; picard uses
+	// PerAxisDistance. If empty, the optical histogram uses
+	// EuclideanDistance and the optical detector PerAxisDistance.
+	OpticalDistanceMetric DistanceMetric
+	// OpticalAdjacentTiles makes the optical histogram also compare
+	// readpairs on adjacent tiles, not just on the same tile.
+	OpticalAdjacentTiles bool
+	// MaxUnparseableNameFraction is the largest fraction of read
+	// names that may fail to parse for the optical histogram before
+	// Mark returns an error. If 0,
+	// defaultMaxUnparseableNameFraction is used.
+	MaxUnparseableNameFraction float64
+	Seed                       int64
+	// CommandLine is the command line of the run, which is the CL
+	// field of the @PG line that Mark adds to the output header.
+	CommandLine string
+
+	// Data and operators derived from commandline options. These are
+	// not included in the JSON metrics.
+	BagProcessorFactories []BagProcessorFactory `json:"-"`
+	OpticalDetector       OpticalDetector       `json:"-"`
+	KnownUmis             []byte                `json:"-"`
+	// UMIAllowlist holds the UMIs of UMIAllowlistFile. It is read from
+	// the file by SetupAndMark.
+	UMIAllowlist []string `json:"-"`
+	// LocationParser, if non-nil, replaces ParseLocation when parsing
+	// read names for the optical histogram.
+	LocationParser LocationParser `json:"-"`
+	// PairScorer, if non-nil, replaces the PrimaryScorer scorer, e.g.
+	// with a custom PairScorer when using the package as a library.
+	PairScorer PairScorer `json:"-"`
+	// LibraryMap holds the libraries of the read groups in
+	// LibraryMapFile. It is read from the file by SetupAndMark.
+	LibraryMap map[string]string `json:"-"`
+	// OpticalPixelDistanceByReadGroup holds the optical pixel distances
+	// of the read groups in OpticalDistanceMapFile. It is read from the
+	// file by SetupAndMark.
+	OpticalPixelDistanceByReadGroup map[string]int `json:"-"`
+	// ProgressFunc, if non-nil, is called with the progress of Mark
+	// every ProgressInterval, and when Mark is done.
+	ProgressFunc func(Progress) `json:"-"`
+}
+
+// opticalHistogramEnabled returns true if the optical histogram
+// should be computed.
+func (o *Opts) opticalHistogramEnabled() bool {
+	return o.OpticalHistogram != "" || o.OpticalHistogramFile != ""
+}
+
+// Values of Opts.ExistingDuplicateHandling.
+const (
+	existingDupsClear    = "clear"
+	existingDupsPreserve = "preserve"
+	existingDupsUnion    = "union"
+)
+
+// Values of Opts.TaggingPolicy.
+const (
+	taggingPolicyNone    = "none"
+	taggingPolicyOptical = "optical"
+	taggingPolicyAll     = "all"
+)
+
+// taggingPolicy returns the TaggingPolicy, or the policy implied by
+// TagDups if it is not set.
+func (o *Opts) taggingPolicy() string {
+	switch {
+	case o.TaggingPolicy != "":
+		return o.TaggingPolicy
+	case o.TagDups:
+		return taggingPolicyAll
+	}
+	return taggingPolicyNone
+}
+
+// tagDupSets returns true if the DI, DS, DL and DU tags are written.
+func (o *Opts) tagDupSets() bool {
+	return o.taggingPolicy() == taggingPolicyAll
+}
+
+// existingDups returns the ExistingDuplicateHandling, "clear" if only
+// ClearExisting is set, or "" if the input is kept as is.
+func (o *Opts) existingDups() string {
+	if o.ExistingDuplicateHandling == "" && o.ClearExisting {
+		return existingDupsClear
+	}
+	return o.ExistingDuplicateHandling
+}
+
+// clearTags returns the ClearTags, or defaultClearTags if it is not
+// set.
+func (o *Opts) clearTags() []sam.Tag {
+	if o.ClearTags == nil {
+		return defaultClearTags
+	}
+	tags := make([]sam.Tag, len(o.ClearTags))
+	for i, tag := range o.ClearTags {
+		tags[i] = sam.NewTag(tag)
+	}
+	return tags
+}
+
+// clearExisting clears the existing duplicate flag and tags of r as
+// configured by ExistingDuplicateHandling. With "clear", the flag is
+// kept in TagOnlyMode, unless TagOnlyClearFlags is set.
+func (o *Opts) clearExisting(r *sam.Record) {
+	switch o.existingDups() {
+	case existingDupsClear:
+		if o.keepDupFlags() {
+			clearDupTags(r, o.clearTags())
+		} else {
+			clearDupFlagTags(r, o.clearTags())
+		}
+	case existingDupsUnion:
+		clearDupTags(r, o.clearTags())
+	case existingDupsPreserve:
+		if (r.Flags & sam.Duplicate) == 0 {
+			clearDupTags(r, o.clearTags())
+		}
+	}
+}
+
+// excludedFromDups returns true if r, and so its whole template, is
+// excluded from duplicate marking by IgnoreQCFail, MinMAPQForDup, or
+// because it is flagged as a duplicate with ExistingDuplicateHandling
+// "preserve".
+func (o *Opts) excludedFromDups(r *sam.Record) bool {
+	return (o.IgnoreQCFail && (r.Flags&sam.QCFail) != 0) || int(r.MapQ) < o.MinMAPQForDup ||
+		(o.ExistingDuplicateHandling == existingDupsPreserve && (r.Flags&sam.Duplicate) != 0)
+}
+
+// keepDupFlags returns true if the duplicate flags of the input are
+// kept as they are.
+func (o *Opts) keepDupFlags() bool {
+	return o.TagOnlyMode && !o.TagOnlyClearFlags
+}
+
+// umiGrouping returns true if duplicates are grouped by UMI as well
+// as by position.
+func (o *Opts) umiGrouping() bool {
+	return o.UseUmis || o.UMITag != "" || o.UMISource == umiSourceQname
+}
+
+// umiFromTag returns true if UMIs are read from the UMITag tag.
+func (o *Opts) umiFromTag() bool {
+	return !o.UseUmis && o.UMISource != umiSourceQname && o.UMITag != ""
+}
+
+// umiFromQname returns true if UMIs are read from the UMI field of 8
+// field Illumina read names.
+func (o *Opts) umiFromQname() bool {
+	return !o.UseUmis && o.UMISource == umiSourceQname
+}
+
+// umiCorrectionEnabled returns true if UMIs are grouped and corrected,
+// with KnownUmis, UMIAllowlist or UMICorrection.
+func (o *Opts) umiCorrectionEnabled() bool {
+	return o.umiGrouping() && (o.KnownUmis != nil || o.UmiFile != "" || o.UMIAllowlist != nil ||
+		o.UMICorrection == umiCorrectionCluster || o.UMICorrection == umiCorrectionDirectional)
+}
+
+// umiCanBeMissing returns true if UMI grouping allows reads without
+// UMIs. With UseUmis, every read name must hold UMIs.
+func (o *Opts) umiCanBeMissing() bool {
+	return o.umiFromTag() || o.umiFromQname()
 }
 
 type duplicateMatcher interface {
@@ -119,7 +653,7 @@ type duplicateMatcher interface {
 }
 
 type maxAlignDistCheck struct {
-	clearExisting      bool
+	opts               *Opts
 	padding            int
 	maxAlignDist       int
 	globalMaxAlignDist *int
@@ -127,11 +661,9 @@ type maxAlignDistCheck struct {
 }
 
 func (m *maxAlignDistCheck) Process(_ bam.Shard, r *sam.Record) error {
-	if m.clearExisting {
-		clearDupFlagTags(r)
-	}
+	m.opts.clearExisting(r)
 
-	d := r.Pos - bam.UnclippedFivePrimePosition(r)
+	d := r.Pos - unclippedFivePrimePosition(r)
 	if d < 0 {
 		d = -d
 	}
@@ -144,8 +676,25 @@ func (m *maxAlignDistCheck) Process(_ bam.Shard, r *sam.Record) error {
 	return nil
 }
 
+// alignDistPadding returns the padding that the 5' alignment distance
+// of every read must not exceed: Opts.Padding, or the smallest padding
+// of the mapped shards if it is smaller, as in a shard manifest of
+// another run. The alignments of the duplicates of a read are within
+// the largest distance of its own, so each shard of any of them reads
+// all of them in its padding, also at the ends of the references,
+// where the padding is cut but the alignments cannot go further.
+func (m *MarkDuplicates) alignDistPadding() int {
+	padding := m.Opts.Padding
+	for _, shard := range m.shardList {
+		if shard.StartRef != nil && shard.Padding < padding {
+			padding = shard.Padding
+		}
+	}
+	return padding
+}
+
 func (m *maxAlignDistCheck) Close(_ bam.Shard) {
-	log.Debug.Printf("maximum alignment distance: %d", m.maxAlignDist)
+	shardLog.Debugf("maximum alignment distance: %d", m.maxAlignDist)
 	m.mutex.Lock()
 	defer m.mutex.Unlock()
 	if m.maxAlignDist > *m.globalMaxAlignDist {
@@ -155,27 +704,271 @@ func (m *maxAlignDistCheck) Close(_ bam.Shard) {
 
 // MarkDuplicates implements duplicate marking.
 type MarkDuplicates struct {
-	Provider           bamprovider.Provider
-	Opts               *Opts
-	shardList          []bam.Shard
-	highCoverageMap    coverageMap
-	readGroupLibrary   map[string]string
+	Provider         bamprovider.Provider
+	Opts             *Opts
+	stream           *bamStream
+	shardList        []bam.Shard
+	highCoverageMap  coverageMap
+	readGroupLibrary map[string]string
+	readGroups       *readGroupTable
+	metricsRegions   regionMap
+	protectedRegions regionMap
+	filter           *recordFilter
+	filtered         *filterCollector
+	noLocationRGs    map[string]bool
+	scatter          *opticalScatterWriter
+	dupSetReport     *dupSetReportWriter
+	hotspots         *hotspotWriter
+	gc               *gcContent
+	split            *splitOutput
+	progress         *progressTracker
+	memory           *memoryBudget
+	// output, if non-nil, is where the BAM output is written instead
+	// of Opts.OutputPath, see Run.
+	output             io.Writer
 	umiCorrector       *umi.SnapCorrector
+	umiAllowlist       *umiAllowlist
+	secondaryDups      *secondaryDupTable
 	distantMates       *bampair.DistantMateTable
+	diskMateShards     int
+	mateScratchDir     string
 	shardInfo          *bampair.ShardInfo
 	globalMetrics      *MetricsCollection
 	globalMaxAlignDist int
-	mutex              sync.Mutex
+	// shardStats are the statistics of each shard index for
+	// Opts.ShardManifestFile.
+	shardStats map[int]shardStats
+	mutex      sync.Mutex
 }
 
 // Mark marks the duplicates, and returns metrics, and an error if encountered.
 func (m *MarkDuplicates) Mark(shards []bam.Shard) (*MetricsCollection, error) {
-	header, err := m.Provider.GetHeader()
+	return m.MarkContext(context.Background(), shards)
+}
+
+// MarkContext is Mark, but stops and returns an error wrapping
+// ErrCancelled when ctx is done.
+func (m *MarkDuplicates) MarkContext(ctx context.Context, shards []bam.Shard) (*MetricsCollection, error) {
+	restoreLogging, err := setupLogging(m.Opts)
 	if err != nil {
 		return nil, err
 	}
+	defer restoreLogging()
 
-	if shards == nil {
+	header, err := m.getHeader()
+	if err != nil {
+		return nil, err
+	}
+
+	order, err := inputOrder(m.Opts, header)
+	if err != nil {
+		return nil, err
+	}
+	if m.Opts.VerifyAgainst != "" && (order != inputOrderCoordinate || m.output != nil) {
+		return nil, fmt.Errorf("verify-against requires coordinate sorted input and output to a bam file")
+	}
+	if (m.Opts.ShardManifestFile != "" || m.Opts.ShardManifestInput != "") && order != inputOrderCoordinate {
+		return nil, fmt.Errorf("shard manifests require coordinate sorted input")
+	}
+	if m.Opts.SplitOutputByReference != "" && (order != inputOrderCoordinate || m.output != nil) {
+		return nil, fmt.Errorf("split-output-by-reference requires coordinate sorted input and no output writer")
+	}
+
+	// Collect some info from the bam header
+	m.readGroupLibrary = readGroupLibraries(header, m.Opts)
+	m.readGroups = newReadGroupTable(m.readGroupLibrary)
+	m.noLocationRGs = readGroupsWithoutLocation(header)
+	if m.Opts.MetricsRegionsBED != "" {
+		if m.metricsRegions, err = readRegionsBED(ctx, m.Opts.MetricsRegionsBED, header); err != nil {
+			return nil, err
+		}
+	}
+	if m.Opts.ProtectedRegionsBED != "" {
+		if m.protectedRegions, err = readRegionsBED(ctx, m.Opts.ProtectedRegionsBED, header); err != nil {
+			return nil, err
+		}
+	}
+	if m.Opts.FilterExpression != "" {
+		if m.filter, err = parseFilter(m.Opts.FilterExpression); err != nil {
+			return nil, err
+		}
+		m.filtered = newFilterCollector()
+	}
+
+	// Create the default optical detector.
+	if m.Opts.OpticalDetector == nil && m.Opts.OpticalDuplicatePixelDistance > 0 {
+		m.Opts.OpticalDetector = &TileOpticalDetector{
+			OpticalDistance: m.Opts.OpticalDuplicatePixelDistance,
+			DistanceMetric:  m.Opts.OpticalDistanceMetric,
+			LocationParser:  m.Opts.LocationParser,
+		}
+	}
+
+	// Create the primary scorer.
+	if m.Opts.PairScorer == nil {
+		if m.Opts.PairScorer, err = ParsePairScorer(m.Opts.PrimaryScorer); err != nil {
+			return nil, err
+		}
+	}
+
+	// Create umi corrector.
+	if m.Opts.KnownUmis != nil {
+		m.umiCorrector = umi.NewSnapCorrector(m.Opts.KnownUmis)
+	}
+	if m.Opts.UMIAllowlist != nil {
+		if err := checkUMIAllowlist(m.Opts.UMIAllowlist); err != nil {
+			return nil, err
+		}
+		m.umiAllowlist = newUMIAllowlist(m.Opts.UMIAllowlist)
+	}
+
+	m.globalMetrics = NewMetricsCollection()
+	if t, ok := m.Opts.OpticalDetector.(*TileOpticalDetector); ok {
+		// The detector may be shared with other runs, so the distances
+		// of this header are set on a copy.
+		distances := readGroupOpticalDistances(header, m.Opts)
+		if t.OpticalDistanceByReadGroup == nil && len(distances) > 0 {
+			withDistances := *t
+			withDistances.OpticalDistanceByReadGroup = distances
+			t = &withDistances
+			m.Opts.OpticalDetector = t
+		}
+		m.globalMetrics.OpticalPixelDistances = appliedOpticalDistances(header, t)
+	}
+
+	if m.Opts.OpticalScatterFile != "" {
+		if m.scatter, err = newOpticalScatterWriter(m.Opts.OpticalScatterFile); err != nil {
+			return nil, err
+		}
+	}
+	if m.Opts.DuplicateSetReport != "" {
+		if m.dupSetReport, err = newDupSetReportWriter(m.Opts.DuplicateSetReport); err != nil {
+			return nil, err
+		}
+	}
+	if m.Opts.HotspotBED != "" {
+		if m.hotspots, err = newHotspotWriter(m.Opts.HotspotBED, m.Opts.HotspotMinSetSize); err != nil {
+			return nil, err
+		}
+	}
+	if m.Opts.GCMetrics {
+		if m.gc, err = newGCContent(ctx, m.Opts.GCReference, header); err != nil {
+			return nil, err
+		}
+	}
+
+	stopProgress := m.startProgress(ctx)
+	stopMemoryBudget := m.startMemoryBudget()
+	if order == inputOrderQueryname {
+		err = m.markQueryname(ctx, header)
+	} else if m.stream != nil {
+		err = fmt.Errorf("coordinate sorted input cannot be streamed")
+	} else {
+		err = m.markCoordinateSorted(ctx, header, shards)
+	}
+	if m.filtered != nil {
+		m.globalMetrics.FilteredReads = m.filtered.counts.Total
+		if m.Opts.Flagstat {
+			// The filtered reads are input that is removed.
+			m.globalMetrics.InputFlagstat.merge(&m.filtered.counts)
+			m.globalMetrics.RemovedFlagstat.merge(&m.filtered.counts)
+		}
+	}
+	stopMemoryBudget()
+	stopProgress()
+	if m.scatter != nil {
+		if err2 := m.scatter.Close(); err == nil {
+			err = err2
+		}
+	}
+	if m.dupSetReport != nil {
+		if err2 := m.dupSetReport.Close(); err == nil {
+			err = err2
+		}
+	}
+	if m.hotspots != nil {
+		if err2 := m.hotspots.Close(); err == nil {
+			err = err2
+		}
+	}
+	if m.gc != nil {
+		if err2 := m.gc.close(ctx); err == nil {
+			err = err2
+		}
+	}
+	if err == nil && m.Opts.Flagstat {
+		err = checkFlagstat(m.globalMetrics)
+	}
+	if err != nil {
+		m.removeOutputs()
+		return nil, err
+	}
+	if err = checkUnparseableNames(m.Opts, m.globalMetrics); err != nil {
+		return nil, err
+	}
+	if m.Opts.CellMetricsMax > 0 {
+		m.globalMetrics.TrimCells(m.Opts.CellMetricsMax)
+	}
+	if m.Opts.VerifyAgainst != "" {
+		if m.globalMetrics.Verification, err = verify(ctx, m.Opts); err != nil {
+			return nil, err
+		}
+	}
+	return m.globalMetrics, nil
+}
+
+// removeOutputs removes the outputs of m after an error, so that no
+// partial output is mistaken for a complete one. The output written to
+// m.output or stdout is not removed.
+func (m *MarkDuplicates) removeOutputs() {
+	ctx := context.Background()
+	var paths []string
+	if m.output == nil && !isStdout(m.Opts.OutputPath) && !m.Opts.MetricsOnly {
+		if bamprovider.ParseFileType(m.Opts.Format) == bamprovider.PAM {
+			if err := file.RemoveAll(ctx, m.Opts.OutputPath); err != nil {
+				ioLog.Errorf("couldn't remove %s: %v", m.Opts.OutputPath, err)
+			}
+		} else {
+			paths = append(paths, m.Opts.OutputPath,
+				m.Opts.OutputPath+"."+indexFormatBAI, m.Opts.OutputPath+"."+indexFormatCSI)
+		}
+	}
+	paths = append(paths, m.Opts.DuplicatesOutput, m.Opts.OpticalScatterFile, m.Opts.DuplicateSetReport,
+		m.Opts.HotspotBED)
+	if m.split != nil {
+		paths = append(paths, m.split.paths()...)
+	}
+	for _, path := range paths {
+		if path == "" {
+			continue
+		}
+		if err := file.Remove(ctx, path); err != nil && !errors.Is(errors.NotExist, err) {
+			ioLog.Errorf("couldn't remove %s: %v", path, err)
+		}
+	}
+}
+
+// markCoordinateSorted marks the duplicates of coordinate sorted
+// input, shard by shard, and writes the output.
+func (m *MarkDuplicates) markCoordinateSorted(ctx context.Context, header *sam.Header, shards []bam.Shard) error {
+	var err error
+	// With a filter, every scan of the input drops the filtered reads.
+	input := m.Provider
+	if m.filter != nil {
+		m.Provider = &filterProvider{Provider: input, filter: m.filter}
+	}
+	if shards == nil && m.Opts.ShardManifestInput != "" {
+		m.shardList, err = readShardManifest(ctx, m.Opts.ShardManifestInput, header)
+		m.shardList = withUnmappedShard(m.shardList, m.Opts.Padding)
+	} else if shards == nil && m.Opts.Regions != "" {
+		m.shardList, err = regionShards(ctx, m.Opts, header)
+	} else if shards == nil && len(header.Refs()) == 0 {
+		// Without references, as in an unaligned BAM, all the reads
+		// are in the unmapped shard.
+		m.shardList = withUnmappedShard(nil, m.Opts.Padding)
+	} else if shards == nil && m.Opts.TargetReadsPerShard > 0 {
+		m.shardList, err = adaptiveShards(ctx, m.Opts, header)
+	} else if shards == nil {
 		m.shardList, err = m.Provider.GenerateShards(bamprovider.GenerateShardsOpts{
 			Strategy:                           bamprovider.ByteBased,
 			Padding:                            m.Opts.Padding,
@@ -186,42 +979,35 @@ func (m *MarkDuplicates) Mark(shards []bam.Shard) (*MetricsCollection, error) {
 			SplitMappedCoords:                  false,
 			AlwaysSplitMappedAndUnmappedCoords: true,
 		})
+		m.shardList = withUnmappedShard(m.shardList, m.Opts.Padding)
 	} else {
 		m.shardList = shards
 	}
 	if err != nil {
-		return nil, err
-	}
-	// Collect some info from the bam header
-	m.readGroupLibrary = make(map[string]string)
-	for _, readGroup := range header.RGs() {
-		m.readGroupLibrary[readGroup.Name()] = readGroup.Library()
+		return err
 	}
-
-	// Create umi corrector.
-	if m.Opts.KnownUmis != nil {
-		m.umiCorrector = umi.NewSnapCorrector(m.Opts.KnownUmis)
+	cleanup, err := m.setupDistantMates(ctx)
+	if err != nil {
+		return err
 	}
-
-	m.globalMetrics = newMetricsCollection()
-
+	defer cleanup()
 	// Scan the file once to find each distant mate, and save them to distantMates.
-	log.Debug.Printf("Scanning %d shards", len(m.shardList))
-	distantMatesOpts := &bampair.Opts{
-		Parallelism: m.Opts.Parallelism,
-		DiskShards:  m.Opts.DiskMateShards,
-		ScratchDir:  m.Opts.ScratchDir,
-	}
+	distantMatesLog.Debugf("Scanning %d shards", len(m.shardList))
+	distantMatesOpts := m.distantMatesOpts()
 	coverageCounts := make(map[int][]int, len(header.Refs()))
 	for _, ref := range header.Refs() {
 		coverageCounts[ref.ID()] = make([]int, ref.Len())
 	}
+	alignDistPadding := m.alignDistPadding()
 	// distantMates creates one of each of these RecordProcessors to process each shard.
 	recordProcessors := []func() bampair.RecordProcessor{
+		func() bampair.RecordProcessor {
+			return &cancelCheck{ctx: ctx}
+		},
 		func() bampair.RecordProcessor {
 			return &maxAlignDistCheck{
-				clearExisting:      m.Opts.ClearExisting,
-				padding:            m.Opts.Padding,
+				opts:               m.Opts,
+				padding:            alignDistPadding,
 				globalMaxAlignDist: &m.globalMaxAlignDist,
 				mutex:              &m.mutex,
 			}
@@ -235,11 +1021,31 @@ func (m *MarkDuplicates) Mark(shards []bam.Shard) (*MetricsCollection, error) {
 	if m.Opts.OpticalDetector != nil {
 		recordProcessors = append(recordProcessors, m.Opts.OpticalDetector.GetRecordProcessor)
 	}
+	if m.Opts.FlagSecondaryDups {
+		m.secondaryDups = newSecondaryDupTable()
+		recordProcessors = append(recordProcessors, func() bampair.RecordProcessor {
+			return &secondaryScanner{table: m.secondaryDups}
+		})
+	}
 
-	distantMates, shardInfo, err := bampair.GetDistantMates(m.Provider, m.shardList,
+	// The scan for the distant mates also collects the filtered reads.
+	distantMatesProvider := m.Provider
+	if m.filter != nil {
+		distantMatesProvider = &filterProvider{Provider: input, filter: m.filter, collector: m.filtered}
+	}
+	if m.Opts.Regions != "" {
+		distantMatesProvider = &regionMatesProvider{Provider: distantMatesProvider, shards: m.shardList}
+	}
+	distantMates, shardInfo, err := bampair.GetDistantMates(distantMatesProvider, m.shardList,
 		distantMatesOpts, recordProcessors)
+	if cancelErr := cancelled(ctx); cancelErr != nil {
+		if err == nil {
+			distantMates.Close() // nolint: errcheck
+		}
+		return cancelErr
+	}
 	if err != nil {
-		return nil, fmt.Errorf("failed while scanning for distant mates: %v", err)
+		return fmt.Errorf("failed while scanning for distant mates: %v", err)
 	}
 	m.distantMates = distantMates
 	m.shardInfo = shardInfo
@@ -252,7 +1058,7 @@ func (m *MarkDuplicates) Mark(shards []bam.Shard) (*MetricsCollection, error) {
 	if m.Opts.CoverageMax > 0 {
 		highCovIntervals := getHighCoverageIntervals(coverageCounts, m.Opts.CoverageMax)
 		for _, interval := range highCovIntervals {
-			log.Debug.Printf("high coverage interval: %v", interval)
+			shardLog.Debugf("high coverage interval: %v", interval)
 			m.globalMetrics.AddHighCovInterval(interval)
 		}
 		m.highCoverageMap = getCoverageMap(highCovIntervals)
@@ -260,19 +1066,44 @@ func (m *MarkDuplicates) Mark(shards []bam.Shard) (*MetricsCollection, error) {
 	coverageCounts = make(map[int][]int) // free memory
 
 	for i := 0; i < m.shardInfo.Len(); i++ {
-		log.Printf("shard[%d] info: %v", i, m.shardInfo.GetInfoByIdx(i))
+		shardLog.Printf("shard[%d] info: %v", i, m.shardInfo.GetInfoByIdx(i))
 	}
 
+	if m.secondaryDups != nil && len(m.secondaryDups.templates) > 0 {
+		if err = m.resolveSecondaryDups(ctx); err != nil {
+			return err
+		}
+	}
+
+	m.progress.setShards(len(m.shardList))
+	if m.Opts.MetricsOnly {
+		if err = m.generateMetrics(ctx); err != nil {
+			return err
+		}
+		return m.writeShardManifest()
+	}
 	switch bamprovider.ParseFileType(m.Opts.Format) {
 	case bamprovider.BAM:
-		err = m.generateBAM()
+		err = m.generateBAM(ctx)
 	case bamprovider.PAM:
-		err = m.generatePAM()
+		err = m.generatePAM(ctx)
 	}
 	if err != nil {
-		return nil, err
+		return err
 	}
-	return m.globalMetrics, nil
+	return m.writeShardManifest()
+}
+
+// withUnmappedShard returns shards ending with the shard of the
+// unmapped reads at the end of coordinate sorted input, which
+// generateBAM expects, and adds it if it is missing. The reads of the
+// unmapped shard are passed through to the output, and counted as
+// unmapped reads in the metrics.
+func withUnmappedShard(shards []bam.Shard, padding int) []bam.Shard {
+	if n := len(shards); n > 0 && shards[n-1].StartRef == nil && shards[n-1].EndRef == nil {
+		return shards
+	}
+	return append(shards, bam.Shard{End: math.MaxInt32, Padding: padding, ShardIdx: len(shards)})
 }
 
 type pamOutputShard struct {
@@ -300,7 +1131,7 @@ func newPAMShardsWriter(header *sam.Header, fileShards []bam.Shard, readShards [
 				break
 			}
 			if !ps.fileRange.ContainsRange(readRange) {
-				log.Fatalf("fileRange %v, readrange %v", ps.fileRange, readRange)
+				return nil, fmt.Errorf("fileRange %v does not contain readrange %v", ps.fileRange, readRange)
 			}
 			r = append(r, readShards[j])
 			j++
@@ -311,16 +1142,19 @@ func newPAMShardsWriter(header *sam.Header, fileShards []bam.Shard, readShards [
 		ps.remaining = r
 	}
 	if j != len(readShards) {
-		log.Fatalf("fileShards %v does not cover the entire readshards range %v", fileShards, readShards)
+		return nil, fmt.Errorf("fileShards %v does not cover the entire readshards range %v", fileShards, readShards)
 	}
 	return s, nil
 }
 
-func (m *MarkDuplicates) generatePAM() error {
+func (m *MarkDuplicates) generatePAM(ctx context.Context) error {
 	header, err := m.Provider.GetHeader()
 	if err != nil {
 		return err
 	}
+	if header, err = programHeader(header, m.Opts.CommandLine); err != nil {
+		return err
+	}
 	fileShards, err := m.Provider.GetFileShards()
 	if err != nil {
 		return err
@@ -340,7 +1174,7 @@ func (m *MarkDuplicates) generatePAM() error {
 		outShardCh <- outputShards[i]
 	}
 	close(outShardCh)
-	for wi := 0; wi < m.Opts.Parallelism; wi++ {
+	for wi := 0; wi < m.Opts.computeParallelism(); wi++ {
 		wg.Add(1)
 		go func() {
 			defer wg.Done()
@@ -358,20 +1192,37 @@ func (m *MarkDuplicates) generatePAM() error {
 						bam.FieldQual}
 				}
 				writer := pam.NewWriter(opts, header, m.Opts.OutputPath)
-				for len(outShard.remaining) > 0 {
+				var flagstatOutput FlagstatCounts
+				// After an error, the remaining shards are skipped.
+				for len(outShard.remaining) > 0 && e.Err() == nil {
 					bs := outShard.remaining[0]
 					outShard.remaining = outShard.remaining[1:]
-					log.Debug.Printf("file %d: starting shard %s, %d remaining", outShard.index, bs.String(), len(outShard.remaining))
+					if err := cancelled(ctx); err != nil {
+						e.Set(err)
+						break
+					}
+					shardLog.forShard(bs).Debugf("file %d: starting shard, %d remaining", outShard.index, len(outShard.remaining))
 					iter := m.Provider.NewIterator(bs)
-					m.processShard(iter, bs, outShard.index, func(r *sam.Record) {
+					e.Set(m.processShard(ctx, iter, bs, outShard.index, func(r *sam.Record) error {
+						checkRecord(r)
+						if err := checkPAMTags(r); err != nil {
+							return err
+						}
+						if m.Opts.Flagstat {
+							flagstatOutput.add(r)
+						}
 						writer.Write(r)
-						sam.PutInFreePool(r)
-					})
+						putRecord(r)
+						return nil
+					}))
 					e.Set(iter.Close())
-					log.Debug.Printf("file %d: finished shard %s, %d remaining", outShard.index, bs.String(), len(outShard.remaining))
+					shardLog.forShard(bs).Debugf("file %d: finished shard, %d remaining", outShard.index, len(outShard.remaining))
 				}
 				e.Set(writer.Close())
-				log.Debug.Printf("file %d: all done", outShard.index)
+				if m.Opts.Flagstat {
+					m.globalMetrics.mergeOutputFlagstat(&flagstatOutput, &FlagstatCounts{})
+				}
+				shardLog.Debugf("file %d: all done", outShard.index)
 			}
 		}()
 	}
@@ -379,119 +1230,256 @@ func (m *MarkDuplicates) generatePAM() error {
 	return e.Err()
 }
 
-func (m *MarkDuplicates) generateBAM() error {
+// checkPAMTags returns an error if r has a tag that the PAM writer
+// cannot store, such as the array of the CG tag of long reads, which it
+// panics on.
+func checkPAMTags(r *sam.Record) error {
+	for _, aux := range r.AuxFields {
+		if len(aux) < 3 || strings.IndexByte("AcCsSiIfZH", aux[2]) < 0 {
+			return fmt.Errorf("record %s has tag %s, which pam output cannot store, use bam output instead",
+				r.Name, aux)
+		}
+	}
+	return nil
+}
+
+func (m *MarkDuplicates) generateBAM(cancelCtx context.Context) (err error) {
+	// The outputs are written and closed with ctx, which is not
+	// cancelled, so that they are closed cleanly after cancelCtx is.
 	ctx := vcontext.Background()
+	header, err := m.Provider.GetHeader()
+	if err != nil {
+		return fmt.Errorf("could not read header from provider %s: %v", m.Provider, err)
+	}
+	if header, err = programHeader(header, m.Opts.CommandLine); err != nil {
+		return err
+	}
 	// Prepare outputs.
 	var outputStream io.Writer
-	if m.Opts.OutputPath == "" {
+	var indexer *outputIndexer
+	if m.Opts.SplitOutputByReference != "" {
+		if m.split, err = newSplitOutput(ctx, m.Opts, header); err != nil {
+			return err
+		}
+	} else if m.output != nil {
+		outputStream = m.output
+	} else if isStdout(m.Opts.OutputPath) {
 		outputStream = os.Stdout
 	} else {
-		out, err := file.Create(ctx, m.Opts.OutputPath)
+		out, err := createOutput(ctx, m.Opts.OutputPath)
 		if err != nil {
-			log.Fatalf("Couldn't create output file %s: %v", m.Opts.OutputPath, err)
+			return fmt.Errorf("couldn't create output file %s: %v", m.Opts.OutputPath, err)
 		}
 		defer func() {
-			if err := out.Close(ctx); err != nil {
-				log.Fatalf("close %s: %v", m.Opts.OutputPath, err)
+			if err2 := out.Close(ctx); err == nil && err2 != nil {
+				err = fmt.Errorf("close %s: %v", m.Opts.OutputPath, err2)
 			}
 		}()
-		outputStream = out.Writer(ctx)
+		outputStream = out
+		if format := outputIndexFormat(m.Opts, header); format != indexFormatNone {
+			indexer = newOutputIndexer(format, m.Opts.OutputPath+"."+format, header)
+			outputStream = indexer.Writer(outputStream)
+		}
 	}
-	header, err := m.Provider.GetHeader()
-	if err != nil {
-		log.Fatalf("Could not read header from provider %s: %s", m.Provider, err)
+	closeIndexer := func() error {
+		if indexer == nil {
+			return nil
+		}
+		// The output is valid without an index, so failing to index
+		// it is only an error if the index was asked for.
+		if err := indexer.Close(); err != nil {
+			if m.Opts.IndexFormat != "" {
+				return err
+			}
+			ioLog.Errorf("%v, the output is not indexed", err)
+		}
+		return nil
 	}
-	var writer *bam.ShardedBAMWriter
-	if writer, err = bam.NewShardedBAMWriter(outputStream, gzip.DefaultCompression,
-		m.Opts.QueueLength, header); err != nil {
-		log.Fatalf("Couldn't create bam writer for %s: %v", m.Opts.OutputPath, err)
+	if input := m.flagPatchInput(); input != "" {
+		if err := m.writePatchedBAM(cancelCtx, input, header, outputStream); err != nil {
+			if indexer != nil {
+				indexer.Close() // nolint: errcheck
+			}
+			return err
+		}
+		return closeIndexer()
 	}
 
-	// Create workers to process shards off the shardChannel.
-	t0 := time.Now()
-	var workerGroup sync.WaitGroup
-	shardChannel := make(chan bam.Shard, len(m.shardList))
-	// The last shard is the unmapped (which can be very large), so
-	// move it to the front to process it first.
-	unmappedShard := m.shardList[len(m.shardList)-1]
-	m.shardList = m.shardList[0 : len(m.shardList)-1]
-	if unmappedShard.EndRef != nil {
-		log.Fatalf("expected unmapped shard to be last, instead got %v", unmappedShard)
+	var writer *bamWriter
+	closeWriter := func() error {
+		if m.split != nil {
+			return m.split.close(ctx)
+		}
+		if err := writer.Close(); err != nil {
+			return fmt.Errorf("error while closing bam: %v", err)
+		}
+		return nil
 	}
-	shardChannel <- unmappedShard
-	for _, shard := range m.shardList {
-		shardChannel <- shard
+	if m.split == nil {
+		if writer, err = newBAMWriter(m.Opts, outputStream, header); err != nil {
+			return fmt.Errorf("couldn't create bam writer for %s: %v", m.Opts.OutputPath, err)
+		}
+	}
+	var dups *duplicatesOutput
+	if m.Opts.DuplicatesOutput != "" {
+		if dups, err = newDuplicatesOutput(ctx, m.Opts, header); err != nil {
+			closeWriter() // nolint: errcheck
+			return err
+		}
 	}
-	close(shardChannel)
 
-	log.Debug.Printf("Creating %d workers", m.Opts.Parallelism)
-	for i := 0; i < m.Opts.Parallelism; i++ {
-		workerGroup.Add(1)
-		go func(worker int) {
-			defer workerGroup.Done()
-			compressor := writer.GetCompressor()
-			for {
-				shard, ok := <-shardChannel
-				if !ok {
-					break
-				}
-				log.Debug.Printf("starting shard %s", shard.String())
-				if err := compressor.StartShard(shard.ShardIdx); err != nil {
-					log.Fatalf("could not create bam shard: %v", err)
-				}
-				iter := m.Provider.NewIterator(shard)
-				m.processShard(iter, shard, worker, func(r *sam.Record) {
-					if err := compressor.AddRecord(r); err != nil {
-						panic(err)
-					}
-				})
-				if err := iter.Close(); err != nil {
-					log.Fatalf("close shard %d: %s", shard.ShardIdx, err)
-				}
-				// Close the shard (this will block if the queue is full)
-				if err := compressor.CloseShard(); err != nil {
-					log.Fatalf("close shard compressor %d: %v", shard.ShardIdx, err)
-				}
-			}
-		}(i)
+	// The last shard is the unmapped (which can be very large), so
+	// it is processed first. The shards of Opts.Regions have no
+	// unmapped shard.
+	t0 := time.Now()
+	shards := m.shardList
+	var unmappedShard *bam.Shard
+	if m.Opts.Regions == "" {
+		unmappedShard = &shards[len(shards)-1]
+		shards = shards[:len(shards)-1]
+		if unmappedShard.EndRef != nil {
+			return fmt.Errorf("expected unmapped shard to be last, instead got %v", *unmappedShard)
+		}
 	}
-	workerGroup.Wait()
+	markErr := m.markShards(cancelCtx, writer, dups, unmappedShard, shards)
 	t1 := time.Now()
-	log.Debug.Printf("workers all done in %v", t1.Sub(t0))
+	shardLog.Debugf("workers all done in %v", t1.Sub(t0))
+	if err := markErr; err != nil {
+		// The partial outputs are closed here, and removed by Mark.
+		m.distantMates.Close() // nolint: errcheck
+		closeWriter()          // nolint: errcheck
+		if dups != nil {
+			dups.close(ctx) // nolint: errcheck
+		}
+		if indexer != nil {
+			indexer.Close() // nolint: errcheck
+		}
+		return err
+	}
 
 	// Close distantMates to clean up any files it may have created.
 	if err := m.distantMates.Close(); err != nil {
-		log.Fatalf("Error while closing distant mates: %v", err)
+		return fmt.Errorf("error while closing distant mates: %v", err)
 	}
 
 	// Wait for the writer to finish writing and then close.
-	if err := writer.Close(); err != nil {
-		log.Fatalf("Error while closing bam: %v", err)
+	if err := closeWriter(); err != nil {
+		return err
+	}
+	if dups != nil {
+		if err := dups.close(ctx); err != nil {
+			return err
+		}
+	}
+	if err := closeIndexer(); err != nil {
+		return err
 	}
 	t2 := time.Now()
-	log.Debug.Printf("closed writer in %v ms", t2.Sub(t1))
+	ioLog.Debugf("closed writer in %v ms", t2.Sub(t1))
 
 	return nil
 }
 
-func updateMetrics(readGroupLibrary map[string]string, MetricsCollection *MetricsCollection, record *sam.Record) {
-	library := GetLibrary(readGroupLibrary, record)
-	metrics := MetricsCollection.Get(library)
+// generateMetrics marks the duplicates of each shard for
+// Opts.MetricsOnly, and merges their metrics without writing an output.
+func (m *MarkDuplicates) generateMetrics(ctx context.Context) error {
+	shardChannel := make(chan bam.Shard, len(m.shardList))
+	for _, shard := range m.shardList {
+		shardChannel <- shard
+	}
+	close(shardChannel)
 
-	if (record.Flags & sam.Unmapped) != 0 {
-		metrics.UnmappedReads++
-	} else if bam.HasNoMappedMate(record) &&
-		(record.Flags&sam.Secondary) == 0 && (record.Flags&sam.Supplementary) == 0 {
-		metrics.UnpairedReads++
+	e := errors.Once{}
+	wg := sync.WaitGroup{}
+	for wi := 0; wi < m.Opts.computeParallelism(); wi++ {
+		wg.Add(1)
+		go func(worker int) {
+			defer wg.Done()
+			for shard := range shardChannel {
+				// After an error, the remaining shards are skipped.
+				e.Set(cancelled(ctx))
+				if e.Err() != nil {
+					continue
+				}
+				iter := m.Provider.NewIterator(shard)
+				e.Set(m.processShard(ctx, iter, shard, worker, func(*sam.Record) error { return nil }))
+				e.Set(iter.Close())
+			}
+		}(wi)
+	}
+	wg.Wait()
+	// Close distantMates to clean up any files it may have created.
+	if err := m.distantMates.Close(); err != nil {
+		e.Set(fmt.Errorf("error while closing distant mates: %v", err))
+	}
+	return e.Err()
+}
+
+func updateMetrics(opts *Opts, readGroups *readGroupTable, regions regionMap, allowlist *umiAllowlist,
+	filtered *filterCollector, MetricsCollection *MetricsCollection, record *sam.Record) {
+	// A read whose mate was filtered is counted as unpaired.
+	mateFiltered := filtered.mateFiltered(record)
+	recordMetrics, n := MetricsCollection.forRecord(readGroups, regions, record)
+	for _, metrics := range recordMetrics[:n] {
+		if (record.Flags & sam.Unmapped) != 0 {
+			metrics.UnmappedReads++
+		} else if (bam.HasNoMappedMate(record) || mateFiltered) &&
+			(record.Flags&sam.Secondary) == 0 && (record.Flags&sam.Supplementary) == 0 {
+			metrics.UnpairedReads++
+		}
+
+		if (record.Flags&sam.Paired) != 0 && !mateFiltered &&
+			(record.Flags&sam.Unmapped) == 0 && (record.Flags&sam.MateUnmapped) == 0 &&
+			(record.Flags&sam.Secondary) == 0 && (record.Flags&sam.Supplementary) == 0 {
+			metrics.ReadPairsExamined++
+		}
+		if (record.Flags&sam.Secondary) != 0 || (record.Flags&sam.Supplementary) != 0 {
+			metrics.SecondarySupplementary++
+		}
 	}
 
-	if (record.Flags&sam.Paired) != 0 &&
-		(record.Flags&sam.Unmapped) == 0 && (record.Flags&sam.MateUnmapped) == 0 &&
+	if opts.PerReferenceMetrics &&
 		(record.Flags&sam.Secondary) == 0 && (record.Flags&sam.Supplementary) == 0 {
-		metrics.ReadPairsExamined++
+		MetricsCollection.Reference(leftmostReferenceName(record)).ReadsExamined++
+	}
+	if opts.CellBarcodeTag != "" &&
+		(record.Flags&sam.Secondary) == 0 && (record.Flags&sam.Supplementary) == 0 {
+		if cell := cellBarcode(opts, record); cell == "" {
+			MetricsCollection.CellBarcodeMissingReads++
+		} else if opts.CellMetricsMax > 0 {
+			MetricsCollection.Cell(cell).ReadsExamined++
+		}
+	}
+	if (record.Flags&sam.Secondary) == 0 && (record.Flags&sam.Supplementary) == 0 && missingQuals(record) {
+		MetricsCollection.MissingQualityReads++
+	}
+	if (record.Flags & sam.Secondary) != 0 {
+		MetricsCollection.SecondaryReads++
+	}
+	if (record.Flags & sam.Supplementary) != 0 {
+		MetricsCollection.SupplementaryReads++
+	}
+	if opts.umiGrouping() && (record.Flags&sam.Unmapped) == 0 &&
+		(record.Flags&sam.Secondary) == 0 && (record.Flags&sam.Supplementary) == 0 {
+		r1Umi, r2Umi, found := recordUmis(opts, record)
+		umi := r1Umi
+		if (record.Flags & sam.Read1) == 0 {
+			umi = r2Umi
+		}
+		if !found {
+			MetricsCollection.UMIMissingReads++
+		} else if umi != "" {
+			MetricsCollection.UMIReads[umi]++
+			if allowlist != nil {
+				allowlist.count(MetricsCollection, umi)
+			}
+		}
 	}
 	if (record.Flags&sam.Secondary) != 0 || (record.Flags&sam.Supplementary) != 0 {
-		metrics.SecondarySupplementary++
+		MetricsCollection.SecondarySupplementarySkipped++
+		if (record.Flags & sam.Duplicate) != 0 {
+			MetricsCollection.SecondarySupplementaryDups++
+		}
 	}
 }
 
@@ -556,28 +1544,45 @@ func recOrMateInHighCovInterval(highCoverageMap coverageMap, r *sam.Record) (boo
 	return coverage > 0, coverage
 }
 
+// processShard marks the duplicates of shard, and writes its records
+// with writeCallback. If writeCallback is nil, it only saves the
+// duplicate templates of m.secondaryDups, see resolveSecondaryDups. It
+// returns the first error of writeCallback, or an error wrapping one
+// of the errors of malformed input or ErrCancelled if ctx is done, and
+// then the metrics of the shard are not merged.
 func (m *MarkDuplicates) processShard(
+	ctx context.Context,
 	iter bamprovider.Iterator,
 	shard bam.Shard,
 	worker int,
-	writeCallback func(*sam.Record)) {
+	writeCallback func(*sam.Record) error) error {
 	header, err := m.Provider.GetHeader()
 	if err != nil {
-		log.Fatalf("error getting header: %v", err)
+		return fmt.Errorf("error getting header: %v", err)
 	}
 
 	if err := m.distantMates.OpenShard(shard.ShardIdx); err != nil {
-		log.Fatalf("error opening distant mate shard: %v", err)
+		return fmt.Errorf("error opening distant mate shard %d: %v", shard.ShardIdx, err)
 	}
 	defer m.distantMates.CloseShard(shard.ShardIdx)
+	shardLogger, mateLogger := shardLog.forShard(shard), distantMatesLog.forShard(shard)
 	t0 := time.Now()
 	orderedReads := []*sam.Record{}
 	pairsByName := make(map[string]*readPair)
 	singlesByName := make(map[string]*readPair)
 
-	var matcher duplicateMatcher = newDuplicateIndex(worker, header, m.readGroupLibrary, m.Opts, m.umiCorrector)
-	MetricsCollection := newMetricsCollection()
+	scatter, dupSetReport, hotspots, gc := m.scatter, m.dupSetReport, m.hotspots, m.gc
+	if writeCallback == nil {
+		scatter, dupSetReport, hotspots, gc = nil, nil, nil, nil
+	}
+	var matcher duplicateMatcher = newDuplicateIndex(worker, header, m.readGroupLibrary, m.readGroups, m.noLocationRGs,
+		m.Opts, m.umiCorrector, m.umiAllowlist, scatter)
+	// The metrics of this shard are accumulated without locking, and
+	// merged into m.globalMetrics once the shard is done.
+	MetricsCollection := NewMetricsCollection()
 	pending := make(map[string]bool)
+	malformed := make(map[string]bool)
+	mismatched := make(map[string]bool)
 	readCount := 0
 
 	// readIdx is the index of each read, zeroed at the start of
@@ -587,10 +1592,33 @@ func (m *MarkDuplicates) processShard(
 	readIdx := uint64(0)
 	missingReads := 0
 	hasher := fnv.New32()
+	// The records of the secondary duplicates pass are not counted.
+	progress := &shardProgress{}
+	if writeCallback != nil {
+		progress.tracker = m.progress
+	}
+	// stats are the statistics of the shard for Opts.ShardManifestFile.
+	var stats shardStats
+	// flagstat is true if the records are counted for Opts.Flagstat,
+	// once, in the marking pass.
+	flagstat := m.Opts.Flagstat && writeCallback != nil
 	for iter.Scan() {
+		if readIdx%cancelCheckInterval == 0 {
+			if err := cancelled(ctx); err != nil {
+				return err
+			}
+		}
 		record := iter.Record()
-		if m.Opts.ClearExisting {
-			clearDupFlagTags(record)
+		if shard.RecordInShard(record) {
+			progress.addRead(record)
+			stats.records++
+			if flagstat {
+				MetricsCollection.InputFlagstat.add(record)
+			}
+		}
+		m.Opts.clearExisting(record)
+		if err := checkUmis(m.Opts, record); err != nil {
+			return err
 		}
 
 		// If either end of the readpair is in a high-coverage interval.
@@ -601,10 +1629,10 @@ func (m *MarkDuplicates) processShard(
 			// read pair.
 			hasher.Reset()
 			if _, err := hasher.Write([]byte(record.Name)); err != nil {
-				log.Fatalf("failed to compute hash1 on read %s: %v", record.Name, err)
+				return fmt.Errorf("failed to compute hash1 on read %s: %v", record.Name, err)
 			}
 			if err := binary.Write(hasher, binary.LittleEndian, m.Opts.Seed); err != nil {
-				log.Fatalf("failed to compute hash2 on read %s: %v", record.Name, err)
+				return fmt.Errorf("failed to compute hash2 on read %s: %v", record.Name, err)
 			}
 			hashBytes := hasher.Sum(nil)
 
@@ -614,10 +1642,13 @@ func (m *MarkDuplicates) processShard(
 			// in the intersecting high-coverage region.
 			x := float64(binary.BigEndian.Uint32(hashBytes[:])) / float64(math.MaxUint32)
 			if x > float64(m.Opts.CoverageMax)/coverage {
-				sam.PutInFreePool(record)
 				if shard.RecordInShard(record) {
 					missingReads++
+					if flagstat {
+						MetricsCollection.RemovedFlagstat.add(record)
+					}
 				}
+				putRecord(record)
 				readIdx++
 				continue
 			}
@@ -625,27 +1656,39 @@ func (m *MarkDuplicates) processShard(
 
 		// In the unmapped shard (record.Ref == nil), all records are in the shard.
 		if shard.RecordInShard(record) {
-			updateMetrics(m.readGroupLibrary, MetricsCollection, record)
+			updateMetrics(m.Opts, m.readGroups, m.metricsRegions, m.umiAllowlist, m.filtered, MetricsCollection, record)
 		}
 
 		// Compress reads in the unmapped shard right away instead
 		// of storing in orderedReads to limit memory consumption.
 		if record.Ref == nil && shard.RecordInShard(record) {
-			writeCallback(record)
+			if m.Opts.MetricsOnly {
+				putRecord(record)
+			} else {
+				if err := writeCallback(record); err != nil {
+					return err
+				}
+				progress.written++
+			}
 			readIdx++
 			continue
 		}
 		orderedReads = append(orderedReads, record)
 
 		if (record.Flags&sam.Secondary) != 0 || (record.Flags&sam.Supplementary) != 0 {
-			log.Debug.Printf("Ignoring secondary or supplementary read: %s", record.Name)
+			shardLogger.Debugf("Ignoring secondary or supplementary read: %s", record.Name)
 		} else if (record.Flags & sam.Unmapped) != 0 {
 			// Pass through Secondary alignments and Unmapped records.
-			log.Debug.Printf("Ignoring unmapped read: %s", record.Name)
+			shardLogger.Debugf("Ignoring unmapped read: %s", record.Name)
 		} else if !shard.RecordInPaddedShard(record) &&
 			!mateInPaddedShard(&shard, record) {
-			log.Debug.Printf("Ignoring read outside of padding: %s", record.Name)
-		} else if bam.HasNoMappedMate(record) {
+			shardLogger.Debugf("Ignoring read outside of padding: %s", record.Name)
+		} else if m.hasNoMappedMate(record) && m.Opts.excludedFromDups(record) {
+			shardLogger.Debugf("Ignoring excluded read: %s", record.Name)
+			if shard.RecordInShard(record) {
+				MetricsCollection.ExcludedFromDupAnalysis++
+			}
+		} else if m.hasNoMappedMate(record) {
 			// Handle reads with an unmapped mate differently.
 			info := m.shardInfo.GetInfoByShard(&shard)
 			singlesByName[record.Name] = &readPair{
@@ -654,6 +1697,13 @@ func (m *MarkDuplicates) processShard(
 			}
 			matcher.insertSingleton(record, readIdx+info.PaddingStartFileIdx)
 			record = nil // Don't put back in the free pool.
+		} else if mismatched[record.Name] {
+			// The name is of records that are not mates, so the
+			// other records of the name are not paired either.
+			shardLogger.Debugf("Ignoring read of mismatched mates: %s", record.Name)
+			if shard.RecordInShard(record) {
+				MetricsCollection.MateMismatchReads++
+			}
 		} else {
 			// If we reach here, this read is mapped, it is in the
 			// padded shard, and it also has a mapped mate, so we
@@ -661,6 +1711,8 @@ func (m *MarkDuplicates) processShard(
 			var pair *readPair
 			var ok bool
 			completedPair := false
+			distantMate := false
+			fetchedMate := false
 
 			// Get info by shard even if this record is not in
 			// shard.  This is ok because we will correct for
@@ -668,110 +1720,319 @@ func (m *MarkDuplicates) processShard(
 			info := m.shardInfo.GetInfoByShard(&shard)
 
 			if mateInPaddedShard(&shard, record) {
-				log.Debug.Printf("read %s should be within shard %v info %v", record.Name, shard, info)
+				shardLogger.Debugf("read %s should be within the shard, info %v", record.Name, info)
 				// Mate is in this shard including padding, so check if we saw it already
 				pair, ok = pairsByName[record.Name]
-				if ok {
-					log.Debug.Printf("Found second read %s %v local readIdx %d", record.Name,
-						record.Start(), readIdx)
-					pair.addRead(record, readIdx+info.PaddingStartFileIdx)
-					completedPair = true
-					delete(pending, record.Name)
+				if ok && pair.isExtra(record) {
+					if err := m.extraRead(&shard, record, MetricsCollection, malformed); err != nil {
+						return err
+					}
+				} else if ok {
+					if mismatch := mateMismatch(pair.left, record); mismatch != "" {
+						if err := m.mismatchedMates(&shard, pair.left, record, mismatch, MetricsCollection, mismatched); err != nil {
+							return err
+						}
+						delete(pairsByName, record.Name)
+						delete(pending, record.Name)
+					} else {
+						shardLogger.Debugf("Found second read %s %v local readIdx %d", record.Name,
+							record.Start(), readIdx)
+						if err := pair.addRead(record, readIdx+info.PaddingStartFileIdx); err != nil {
+							return err
+						}
+						completedPair = true
+						delete(pending, record.Name)
+					}
 				} else {
-					log.Debug.Printf("Found first read %s %v local readIdx %d", record.Name,
+					shardLogger.Debugf("Found first read %s %v local readIdx %d", record.Name,
 						record.Start(), readIdx)
-					pairsByName[record.Name] = &readPair{record, nil, readIdx + info.PaddingStartFileIdx, 0}
+					pairsByName[record.Name] = &readPair{left: record, leftFileIdx: readIdx + info.PaddingStartFileIdx}
 					pending[record.Name] = true
 				}
+			} else if pair, ok = pairsByName[record.Name]; ok {
+				// The read of the name waits for a mate in this
+				// padded shard, so unless record is an extra read,
+				// it is not that mate.
+				if mismatch := mateMismatch(pair.left, record); !pair.isExtra(record) && mismatch != "" {
+					if err := m.mismatchedMates(&shard, pair.left, record, mismatch, MetricsCollection, mismatched); err != nil {
+						return err
+					}
+					delete(pairsByName, record.Name)
+					delete(pending, record.Name)
+				} else if err := m.extraRead(&shard, record, MetricsCollection, malformed); err != nil {
+					return err
+				}
 			} else {
 				// Mate is in another ref or is outside this padded
 				// shard, so its mate should be in distantMates.
-				log.Debug.Printf("read %s has distant mate: different ref %v, distance %v",
+				mateLogger.Debugf("read %s has distant mate: different ref %v, distance %v",
 					record.Name, record.Ref.ID() != record.MateRef.ID(), abs(record.Pos-record.MatePos))
 				mate, mateFileIdx := m.distantMates.GetMate(shard.ShardIdx, record)
+				if mate == nil && m.Opts.Regions != "" {
+					// The mate is outside the regions.
+					if mate, err = m.fetchMate(record); err != nil {
+						return err
+					}
+					mateFileIdx, fetchedMate = readIdx+info.PaddingStartFileIdx, true
+				}
 				if mate == nil {
-					log.Fatalf("record %v, is missing distant mate, check that both reads are present and "+
-						"bai index is valid", record)
+					return errors.E(ErrMissingMate, fmt.Sprintf("record %v is missing its distant mate, check that "+
+						"both reads are present and the bai index is valid", record))
+				}
+				if mismatch := mateMismatch(record, mate); mismatch != "" {
+					if err := m.mismatchedMates(&shard, record, mate, mismatch, MetricsCollection, mismatched); err != nil {
+						return err
+					}
+					readIdx++
+					continue
 				}
 
-				if m.Opts.ClearExisting {
-					clearDupFlagTags(mate)
+				m.Opts.clearExisting(mate)
+				if err := checkUmis(m.Opts, mate); err != nil {
+					return err
 				}
 
 				// Make sure to clone the record below from
 				// distantPairs because flagDuplicates() will
 				// modify the record and make DistantMateTable
-				// misbehave.
+				// misbehave. The clone shares its fields with the
+				// record of the table, so it is not returned to
+				// the free pool, and growAux copies its tags
+				// before they are appended to.
 				clone := *mate
-				log.Debug.Printf("adding distant mate as pair for %s", record.Name)
-				pair = &readPair{record, nil, readIdx + info.PaddingStartFileIdx, 0}
-				pair.addRead(&clone, mateFileIdx)
+				mateLogger.Debugf("adding distant mate as pair for %s", record.Name)
+				pair = &readPair{left: record, leftFileIdx: readIdx + info.PaddingStartFileIdx, fetched: fetchedMate}
+				if err := pair.addRead(&clone, mateFileIdx); err != nil {
+					return err
+				}
 
 				completedPair = true
+				distantMate = true
 				pairsByName[record.Name] = pair
-				log.Debug.Printf("pair is now %s", pair)
+				mateLogger.Debugf("pair is now %s", pair)
 			}
 
-			if completedPair {
+			if completedPair && m.Opts.addsMateTags() {
+				if err := addPairMateTags(m.Opts, &shard, pair); err != nil {
+					return err
+				}
+			}
+			if completedPair && (m.Opts.excludedFromDups(pair.left) || m.Opts.excludedFromDups(pair.right)) {
+				// Exclude the whole readpair if either read is
+				// excluded, in the shards of both reads.
+				shardLogger.Debugf("Ignoring excluded readpair: %s", record.Name)
+				for _, r := range []*sam.Record{pair.left, pair.right} {
+					if shard.RecordInShard(r) {
+						MetricsCollection.ExcludedFromDupAnalysis++
+					}
+				}
+			} else if completedPair {
 				matcher.insertPair(pair.left, pair.right, pair.leftFileIdx, pair.rightFileIdx)
+				// Count each readpair once, in the shard of its left read.
+				if pair.countedIn(&shard) {
+					MetricsCollection.addMatedPair(shard.ShardIdx, pair, distantMate)
+				}
 			}
 		}
 		readIdx++
 	}
 	if missingReads > 0 {
-		log.Printf("Ignoring %d reads in shard %d, %s:%d - %s:%d because mate is in high coverage shard",
-			missingReads, shard.ShardIdx, shard.StartRef.Name(), shard.Start, shard.EndRef.Name(), shard.End)
+		shardLogger.Printf("Ignoring %d reads because mate is in high coverage shard", missingReads)
 	}
 	for name := range pending {
-		log.Error.Printf("Could not find mate for pending read: %v in shard %d, %s:%d - %s:%d", name, shard.ShardIdx, shard.StartRef.Name(), shard.Start, shard.EndRef.Name(), shard.End)
+		missingMateLog.printf(shardLogger, "Could not find mate for pending read: %v", name)
 	}
 	if len(pending) > 0 {
-		log.Fatalf("Could not find mate for some reads")
+		return errors.E(ErrMissingMate, fmt.Sprintf("could not find the mate of %d reads in shard %d", len(pending), shard.ShardIdx))
 	}
 	t1 := time.Now()
 
 	// Detect and mark duplicates.
-	dupMetrics := flagDuplicates(m.Opts, &shard, m.readGroupLibrary, singlesByName, pairsByName, matcher)
+	var molecules map[string]sam.Aux
+	if m.Opts.EmitMITag && !m.Opts.MetricsOnly {
+		molecules = make(map[string]sam.Aux)
+	}
+	var duplicates map[string]bool
+	if writeCallback == nil {
+		duplicates = make(map[string]bool)
+	}
+	var unmappedMateDups map[string]bool
+	if m.Opts.FlagUnmappedMates {
+		unmappedMateDups = make(map[string]bool)
+	}
+	dupMetrics, err := flagDuplicates(m.Opts, &shard, m.readGroups, m.metricsRegions, singlesByName, pairsByName,
+		matcher, molecules, duplicates, unmappedMateDups, dupSetReport, hotspots, gc)
+	if err != nil {
+		return err
+	}
+	if writeCallback == nil {
+		m.secondaryDups.addDuplicates(duplicates)
+		for _, r := range orderedReads {
+			putRecord(r)
+		}
+		return nil
+	}
 	MetricsCollection.Merge(dupMetrics)
 	t2 := time.Now()
 
-	// Compress and write records.
-	for _, r := range orderedReads {
-		if r.Ref == nil {
+	// Compress and write records. The writer returns the records it
+	// writes to the free pool, and the others are returned here.
+	readCount += len(orderedReads)
+	for i, r := range orderedReads {
+		orderedReads[i] = nil
+		if r.Ref == nil || !shard.RecordInShard(r) {
+			putRecord(r)
+			continue
+		}
+		if (r.Flags & sam.Duplicate) != 0 {
+			stats.duplicates++
+		}
+		if m.secondaryDups != nil && (r.Flags&(sam.Secondary|sam.Supplementary)) != 0 {
+			m.secondaryDups.flag(m.Opts, r, MetricsCollection)
+		}
+		m.protectDuplicate(r, MetricsCollection)
+		if m.Opts.MetricsOnly {
+			putRecord(r)
 			continue
 		}
-		if shard.RecordInShard(r) {
-			if !m.Opts.RemoveDups || (r.Flags&sam.Duplicate) == 0 {
-				writeCallback(r)
+		// Tag all records of the template, including secondary,
+		// supplementary and unmapped records.
+		if tag, ok := molecules[r.Name]; ok {
+			setMoleculeTag(r, tag)
+		}
+		if unmappedMateDups[r.Name] {
+			flagUnmappedMate(m.Opts, r)
+		}
+		// The removed duplicates are written to the duplicates
+		// output, if any.
+		if !m.Opts.RemoveDups || (r.Flags&sam.Duplicate) == 0 || m.Opts.DuplicatesOutput != "" {
+			if err := writeCallback(r); err != nil {
+				return err
+			}
+			progress.written++
+		} else {
+			if flagstat {
+				MetricsCollection.RemovedFlagstat.add(r)
 			}
+			putRecord(r)
 		}
 	}
-	readCount += len(orderedReads)
 	t3 := time.Now()
 
+	if m.Opts.ShardManifestFile != "" && writeCallback != nil {
+		stats.wallTime = t3.Sub(t0)
+		m.addShardStats(shard.ShardIdx, stats)
+	}
+
 	// Update global metrics.
 	m.globalMetrics.Merge(MetricsCollection)
+	if m.Opts.CellMetricsMax > 0 {
+		m.globalMetrics.TrimCells(2 * m.Opts.CellMetricsMax)
+	}
+	progress.flush(nil)
+	progress.tracker.shardDone()
 	t4 := time.Now()
 
-	log.Debug.Printf("worker %d finished shard %s, reads %d, process %v , mark %v, compress %v, metrics %v, total %v",
-		worker, shard.String(), readCount, t1.Sub(t0), t2.Sub(t1), t3.Sub(t2), t4.Sub(t3), t4.Sub(t0))
+	shardLogger.Debugf("worker %d finished shard, reads %d, process %v , mark %v, compress %v, metrics %v, total %v",
+		worker, readCount, t1.Sub(t0), t2.Sub(t1), t3.Sub(t2), t4.Sub(t3), t4.Sub(t0))
+	return nil
+}
+
+// extraRead handles r, an extra primary record of a template, see
+// Opts.StrictTemplates. r is not added to any readpair, and the
+// template is logged once per shard in malformed. With
+// Opts.StrictTemplates, it returns an error wrapping
+// ErrMalformedTemplate instead.
+func (m *MarkDuplicates) extraRead(shard *bam.Shard, r *sam.Record, mc *MetricsCollection, malformed map[string]bool) error {
+	if m.Opts.StrictTemplates {
+		return errors.E(ErrMalformedTemplate, fmt.Sprintf("template %s has more than two primary records, found %v", r.Name, r))
+	}
+	if shard.RecordInShard(r) {
+		mc.MalformedTemplateReads++
+	}
+	if !malformed[r.Name] {
+		malformedTemplateLog.printf(shardLog.forShard(*shard),
+			"template %s has more than two primary records, passing %v through unflagged", r.Name, r)
+		malformed[r.Name] = true
+	}
+	return nil
+}
+
+// mismatchedMates handles r and mate, records of the same name that are
+// not mates of each other, see mateMismatch. Neither is added to a
+// readpair, so both are passed through unflagged, and those in shard
+// are counted in MetricsCollection.MateMismatchReads. The name is added
+// to mismatched, so that the other records of the name in shard are
+// not paired either, and logged once per shard. With
+// Opts.FailOnMateMismatch, it returns an error wrapping
+// ErrMalformedTemplate instead.
+func (m *MarkDuplicates) mismatchedMates(shard *bam.Shard, r, mate *sam.Record, mismatch string, mc *MetricsCollection,
+	mismatched map[string]bool) error {
+	if m.Opts.FailOnMateMismatch {
+		return errors.E(ErrMalformedTemplate, fmt.Sprintf("records %v and %v of template %s are not mates: %s",
+			r, mate, r.Name, mismatch))
+	}
+	for _, read := range []*sam.Record{r, mate} {
+		if shard.RecordInShard(read) {
+			mc.MateMismatchReads++
+		}
+	}
+	if !mismatched[r.Name] {
+		mateMismatchLog.printf(shardLog.forShard(*shard),
+			"records of template %s are not mates: %s, passing %v and %v through unflagged", r.Name, mismatch, r, mate)
+		mismatched[r.Name] = true
+	}
+	return nil
+}
+
+// flagUnmappedMate flags r as a duplicate if it is the placed unmapped
+// mate of a mapped read, see Opts.FlagUnmappedMates.
+func flagUnmappedMate(opts *Opts, r *sam.Record) {
+	if opts.TagOnlyMode || (r.Flags&sam.Unmapped) == 0 || (r.Flags&sam.MateUnmapped) != 0 ||
+		(r.Flags&(sam.Secondary|sam.Supplementary)) != 0 {
+		return
+	}
+	r.Flags |= sam.Duplicate
 }
 
+// protectDuplicate clears the duplicate flag of r if its alignment
+// overlaps a region of Opts.ProtectedRegionsBED, and counts it in
+// mc.ProtectedDuplicates. Its tags are kept.
+func (m *MarkDuplicates) protectDuplicate(r *sam.Record, mc *MetricsCollection) {
+	if m.protectedRegions == nil || (r.Flags&sam.Duplicate) == 0 || !m.protectedRegions.overlapsRecord(r) {
+		return
+	}
+	r.Flags &^= sam.Duplicate
+	mc.ProtectedDuplicates++
+}
+
+// flagReadTags is the most tags that flagRead adds to a record: DI, DS,
+// DL, DU and DT.
+const flagReadTags = 5
+
+// flagRead tags r with its duplicate set, and flags it as a duplicate
+// unless it is the primary. It returns an error if a tag cannot be
+// created.
 func flagRead(opts *Opts, r *sam.Record, primary, optical bool, dupSetId uint64, dupSetSize, pcrDupSetSize int,
-	corrected string) {
-	if opts.TagDups && dupSetSize >= 0 {
+	corrected string) error {
+	checkRecord(r)
+	policy := opts.taggingPolicy()
+	if policy != taggingPolicyNone {
+		r.AuxFields = growAux(r.AuxFields, flagReadTags)
+	}
+	if policy == taggingPolicyAll && dupSetSize >= 0 {
 		var tag sam.Aux
 		var err error
 		if dupSetSize >= 0 {
 			if opts.IntDI {
 				tag, err = sam.NewAux(diTag, int(dupSetId))
 				if err != nil {
-					log.Fatalf("error creating DI:i:%d tag: %v", dupSetId, err)
+					return errors.E(err, fmt.Sprintf("error creating DI:i:%d tag", dupSetId))
 				}
 			} else {
 				tag, err = sam.NewAux(diTag, strconv.FormatUint(dupSetId, 10))
 				if err != nil {
-					log.Fatalf("error creating DI:Z:%d tag: %v", dupSetId, err)
+					return errors.E(err, fmt.Sprintf("error creating DI:Z:%d tag", dupSetId))
 				}
 			}
 			r.AuxFields = append(r.AuxFields, tag)
@@ -780,49 +2041,85 @@ func flagRead(opts *Opts, r *sam.Record, primary, optical bool, dupSetId uint64,
 		if dupSetSize >= 0 {
 			tag, err = sam.NewAux(dsTag, dupSetSize)
 			if err != nil {
-				log.Fatalf("error creating DS:i:%d tag: %v", dupSetSize, err)
+				return errors.E(err, fmt.Sprintf("error creating DS:i:%d tag", dupSetSize))
 			}
 			r.AuxFields = append(r.AuxFields, tag)
 		}
 		if pcrDupSetSize >= 0 {
 			tag, err = sam.NewAux(dlTag, pcrDupSetSize)
 			if err != nil {
-				log.Fatalf("error creating DL:i:%d tag: %v", pcrDupSetSize, err)
+				return errors.E(err, fmt.Sprintf("error creating DL:i:%d tag", pcrDupSetSize))
 			}
 			r.AuxFields = append(r.AuxFields, tag)
 		}
 
-		if opts.TagDups && dupSetSize > 1 && len(corrected) > 0 {
+		if dupSetSize > 1 && len(corrected) > 0 && !(primary && opts.TagRepresentative) {
 			tag, err = sam.NewAux(duTag, corrected)
 			if err != nil {
-				log.Fatalf("error creating DU:Z:%s tag: %v", corrected, err)
+				return errors.E(err, fmt.Sprintf("error creating DU:Z:%s tag", corrected))
 			}
 			r.AuxFields = append(r.AuxFields, tag)
 		}
 	}
 	if !primary {
-		r.Flags |= sam.Duplicate
-		if opts.TagDups && opts.OpticalDetector != nil {
+		if !opts.TagOnlyMode {
+			r.Flags |= sam.Duplicate
+		}
+		if policy != taggingPolicyNone && opts.OpticalDetector != nil {
 			if optical {
 				tag, err := sam.NewAux(dtTag, "SQ")
 				if err != nil {
-					log.Fatalf("error creating DT:z:SQ tag: %v", err)
+					return errors.E(err, "error creating DT:z:SQ tag")
 				}
 				r.AuxFields = append(r.AuxFields, tag)
-			} else {
+			} else if policy == taggingPolicyAll {
 				tag, err := sam.NewAux(dtTag, "LB")
 				if err != nil {
-					log.Fatalf("error creating DT:z:LB tag: %v", err)
+					return errors.E(err, "error creating DT:z:LB tag")
 				}
 				r.AuxFields = append(r.AuxFields, tag)
 			}
 		}
 	}
+	return nil
 }
 
 // SetupAndMark does some minimal setup for validating opts, and
 // creating provider and then runs mark().
 func SetupAndMark(ctx context.Context, provider bamprovider.Provider, opts *Opts) error {
+	if err := prepareOpts(ctx, opts); err != nil {
+		return err
+	}
+
+	// Mark/remove those duplicates.
+	markDuplicates := &MarkDuplicates{
+		Provider: provider,
+		Opts:     opts,
+	}
+	if paths := inputPaths(opts.BamFile); len(paths) > 1 {
+		cleanup, err := markDuplicates.mergeInputs(ctx, paths)
+		if err != nil {
+			return err
+		}
+		defer cleanup()
+	} else if isStdin(opts.BamFile) {
+		cleanup, err := markDuplicates.openStdin()
+		if err != nil {
+			return err
+		}
+		defer cleanup()
+	}
+	globalMetrics, err := markDuplicates.MarkContext(ctx, nil)
+	if err != nil {
+		log.Debug.Printf("Error marking duplicates: %v", err)
+		return err
+	}
+	return markDuplicates.writeMetricsFiles(ctx, globalMetrics)
+}
+
+// prepareOpts validates opts, and reads the UMI, UMI allowlist, and
+// library map files of opts.
+func prepareOpts(ctx context.Context, opts *Opts) error {
 	if err := validate(opts); err != nil {
 		return err
 	}
@@ -832,40 +2129,53 @@ func SetupAndMark(ctx context.Context, provider bamprovider.Provider, opts *Opts
 		var err error
 		umiReader, err := file.Open(ctx, opts.UmiFile)
 		if err != nil {
-			log.Debug.Printf("Could not read umi file %s: %s", opts.UmiFile, err)
+			ioLog.Debugf("Could not read umi file %s: %s", opts.UmiFile, err)
 			return err
 		}
 		defer umiReader.Close(ctx) // nolint: errcheck
 		opts.KnownUmis, err = ioutil.ReadAll(umiReader.Reader(ctx))
 		if err != nil {
-			log.Debug.Printf("Could not read umi file %s: %s", opts.UmiFile, err)
+			ioLog.Debugf("Could not read umi file %s: %s", opts.UmiFile, err)
 			return err
 		}
 		if len(opts.KnownUmis) == 0 {
-			log.Debug.Printf("UMI list is empty: %s", opts.UmiFile)
+			ioLog.Debugf("UMI list is empty: %s", opts.UmiFile)
 			return err
 		}
 	}
-
-	// Mark/remove those duplicates.
-	markDuplicates := &MarkDuplicates{
-		Provider: provider,
-		Opts:     opts,
+	if opts.UMIAllowlistFile != "" {
+		var err error
+		if opts.UMIAllowlist, err = readUMIAllowlist(ctx, opts.UMIAllowlistFile); err != nil {
+			return err
+		}
 	}
-	globalMetrics, err := markDuplicates.Mark(nil)
-	if err != nil {
-		log.Debug.Printf("Error marking duplicates: %v", err)
-		return err
+	if opts.LibraryMapFile != "" {
+		var err error
+		if opts.LibraryMap, err = readLibraryMap(ctx, opts.LibraryMapFile); err != nil {
+			return err
+		}
+	}
+	if opts.OpticalDistanceMapFile != "" {
+		var err error
+		if opts.OpticalPixelDistanceByReadGroup, err = readOpticalDistanceMap(ctx, opts.OpticalDistanceMapFile); err != nil {
+			return err
+		}
 	}
+	return nil
+}
 
-	// Output metric and histogram files.
+// writeMetricsFiles writes globalMetrics to the metrics, high
+// coverage, tile size, and optical histogram files of m.Opts that are
+// set.
+func (m *MarkDuplicates) writeMetricsFiles(ctx context.Context, globalMetrics *MetricsCollection) error {
+	opts := m.Opts
 	if opts.MetricsFile != "" {
-		if err := writeMetrics(ctx, opts, globalMetrics); err != nil {
+		if err := WriteMetrics(ctx, opts, globalMetrics); err != nil {
 			return err
 		}
 	}
 	if opts.HighCoverageIntervalFile != "" {
-		header, err := provider.GetHeader()
+		header, err := m.getHeader()
 		if err != nil {
 			return err
 		}
@@ -883,12 +2193,26 @@ func SetupAndMark(ctx context.Context, provider bamprovider.Provider, opts *Opts
 			return err
 		}
 	}
+	if opts.OpticalHistogramFile != "" {
+		if err := writeOpticalHistogramFile(ctx, opts, globalMetrics); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
-func flagDuplicates(opts *Opts, shard *bam.Shard, readGroupLibrary map[string]string, singlesByName map[string]*readPair,
-	pairsByName map[string]*readPair, matcher duplicateMatcher) *MetricsCollection {
-	dupMetrics := newMetricsCollection()
+// flagDuplicates marks the duplicates of the duplicate sets of matcher
+// in shard, and returns their metrics. If molecules is non-nil, the MI
+// tag of every template in a duplicate set is added to it. If report
+// is non-nil, the rows of the duplicate sets are written to it, if
+// hotspots is non-nil, the duplicate sets are added to it, and if gc
+// is non-nil, the templates are counted by GC content.
+func flagDuplicates(opts *Opts, shard *bam.Shard, readGroups *readGroupTable, regions regionMap,
+	singlesByName map[string]*readPair, pairsByName map[string]*readPair, matcher duplicateMatcher,
+	molecules map[string]sam.Aux, duplicates, unmappedMateDups map[string]bool, report *dupSetReportWriter,
+	hotspots *hotspotWriter, gc *gcContent) (*MetricsCollection, error) {
+	dupMetrics := NewMetricsCollection()
+	bins := insertSizeBins(opts)
 
 	matcher.computeDupSets(dupMetrics)
 	for {
@@ -896,11 +2220,28 @@ func flagDuplicates(opts *Opts, shard *bam.Shard, readGroupLibrary map[string]st
 		if !ok {
 			break
 		}
+		if molecules != nil {
+			if err := addMoleculeTags(opts, molecules, dupSet, singlesByName, pairsByName); err != nil {
+				return nil, err
+			}
+		}
+		if opts.DuplexUMI {
+			dupMetrics.addDuplexFamily(opts, shard, dupSet, singlesByName, pairsByName)
+		}
+		if opts.umiGrouping() {
+			dupMetrics.addUMIFamily(opts, shard, readGroups, dupSet, singlesByName, pairsByName)
+		}
 
 		optDups := map[string]bool{}
 		for _, name := range dupSet.opticals {
 			optDups[name] = true
 		}
+		if report != nil {
+			report.write(shard, readGroups, dupSet, optDups, singlesByName, pairsByName)
+		}
+		if hotspots != nil {
+			hotspots.add(shard, readGroups, dupSet, optDups, singlesByName, pairsByName)
+		}
 
 		dupSetId := uint64(0)
 		for i, qname := range dupSet.pairs {
@@ -909,42 +2250,129 @@ func flagDuplicates(opts *Opts, shard *bam.Shard, readGroupLibrary map[string]st
 				dupSetId = p.leftFileIdx
 			}
 
+			// Count each readpair once, in the shard of its left read.
+			if p.countedIn(shard) {
+				dupMetrics.AddInsertSize(bins, p, i > 0, optDups[qname])
+				if gc != nil {
+					if err := dupMetrics.AddGCContent(gc, []*sam.Record{p.left, p.right}, i > 0, optDups[qname]); err != nil {
+						return nil, err
+					}
+				}
+				if i == 0 && dupSet.umiRescued {
+					dupMetrics.UMIRescuedPairs++
+				}
+			}
+
 			// The pair may contain a read from a different shard, so
 			// verify the read is inShard before marking and counting.
 			for _, r := range []*sam.Record{p.left, p.right} {
 				if shard.RecordInShard(r) {
+					if _, corrected := dupSet.corrected[r.Name]; corrected {
+						dupMetrics.UMICorrectedReads++
+					}
 					if i == 0 {
-						log.Debug.Printf("marking %s as primary of DI %d", r.Name, dupSetId)
-						flagRead(opts, r, true, false, dupSetId, len(dupSet.pairs), len(dupSet.pairs)-len(optDups),
-							dupSet.corrected[r.Name])
+						if r == p.left {
+							dupMetrics.AddDuplicateSetSize(len(dupSet.pairs), opts.DuplicateSetSizeMax)
+						}
+						shardLog.forShard(*shard).Debugf("marking %s as primary of DI %d", r.Name, dupSetId)
+						if err := flagRead(opts, r, true, false, dupSetId, len(dupSet.pairs), len(dupSet.pairs)-len(optDups),
+							dupSet.corrected[r.Name]); err != nil {
+							return nil, err
+						}
 					} else {
-						log.Debug.Printf("marking %s as duplicate of DI %d optical %v", r.Name, dupSetId, optDups[qname])
-						flagRead(opts, r, false, optDups[qname], dupSetId, len(dupSet.pairs), len(dupSet.pairs)-len(optDups),
-							dupSet.corrected[r.Name])
-						metrics := dupMetrics.Get(GetLibrary(readGroupLibrary, r))
-						metrics.ReadPairDups++
-						if optDups[qname] {
-							metrics.ReadPairOpticalDups++
+						shardLog.forShard(*shard).Debugf("marking %s as duplicate of DI %d optical %v", r.Name, dupSetId, optDups[qname])
+						if err := flagRead(opts, r, false, optDups[qname], dupSetId, len(dupSet.pairs), len(dupSet.pairs)-len(optDups),
+							dupSet.corrected[r.Name]); err != nil {
+							return nil, err
+						}
+						if duplicates != nil {
+							duplicates[templateKey(r)] = true
+						}
+						if opts.PerReferenceMetrics {
+							m := dupMetrics.Reference(p.left.Ref.Name())
+							m.Duplicates++
+							if optDups[qname] {
+								m.OpticalDuplicates++
+							}
+						}
+						if cell := cellBarcode(opts, r); cell != "" && opts.CellMetricsMax > 0 {
+							dupMetrics.Cell(cell).Duplicates++
+						}
+						recordMetrics, n := dupMetrics.forRecord(readGroups, regions, r)
+						for _, metrics := range recordMetrics[:n] {
+							metrics.ReadPairDups++
+							if optDups[qname] {
+								metrics.ReadPairOpticalDups++
+							} else {
+								metrics.ReadPairLibraryDups++
+							}
 						}
 					}
 				}
 			}
 		}
+		dupSetSize := len(dupSet.pairs)
+		if len(dupSet.pairs) == 0 && len(dupSet.singles) > 0 {
+			dupSetId = singlesByName[dupSet.singles[0]].leftFileIdx
+			dupSetSize = len(dupSet.singles)
+		}
 		for i, qname := range dupSet.singles {
 			p := singlesByName[qname]
 			if shard.RecordInShard(p.left) {
+				if _, corrected := dupSet.corrected[p.left.Name]; corrected {
+					dupMetrics.UMICorrectedReads++
+				}
 				// A mate-unmapped read cannot be an optical dup.  A
 				// mate-unmapped read cannot be associated with a
 				// particular dupSetId, or dupSetSize, even if the
 				// only duplicates are also mate-unmapped (this
-				// behavior is copied from picard).
-				flagRead(opts, p.left, len(dupSet.pairs) == 0 && i == 0, false, 0, -1, -1, dupSet.corrected[p.left.Name])
-				if len(dupSet.pairs) == 0 && i > 0 || len(dupSet.pairs) > 0 {
-					metrics := dupMetrics.Get(GetLibrary(readGroupLibrary, p.left))
-					metrics.UnpairedDups++
+				// behavior is copied from picard), unless
+				// opts.TagRepresentative is set.
+				if opts.TagRepresentative {
+					if err := flagRead(opts, p.left, len(dupSet.pairs) == 0 && i == 0, false, dupSetId, dupSetSize, -1,
+						dupSet.corrected[p.left.Name]); err != nil {
+						return nil, err
+					}
+				} else {
+					if err := flagRead(opts, p.left, len(dupSet.pairs) == 0 && i == 0, false, 0, -1, -1, dupSet.corrected[p.left.Name]); err != nil {
+						return nil, err
+					}
+				}
+				if len(dupSet.pairs) == 0 && i == 0 {
+					dupMetrics.AddDuplicateSetSize(len(dupSet.singles), opts.DuplicateSetSizeMax)
+					if dupSet.umiRescued {
+						dupMetrics.UMIRescuedUnpaired++
+					}
+				}
+				duplicate := len(dupSet.pairs) == 0 && i > 0 || len(dupSet.pairs) > 0
+				dupMetrics.UnpairedInsertSizes.add(duplicate, false)
+				if gc != nil {
+					if err := dupMetrics.AddGCContent(gc, []*sam.Record{p.left}, duplicate, false); err != nil {
+						return nil, err
+					}
 				}
+				if duplicate {
+					if duplicates != nil {
+						duplicates[templateKey(p.left)] = true
+					}
+					if opts.PerReferenceMetrics {
+						dupMetrics.Reference(p.left.Ref.Name()).Duplicates++
+					}
+					if cell := cellBarcode(opts, p.left); cell != "" && opts.CellMetricsMax > 0 {
+						dupMetrics.Cell(cell).Duplicates++
+					}
+					recordMetrics, n := dupMetrics.forRecord(readGroups, regions, p.left)
+					for _, metrics := range recordMetrics[:n] {
+						metrics.UnpairedDups++
+					}
+				}
+			}
+			// The unmapped mate has the same position as p.left, but
+			// it may be in this shard while p.left is in the padding.
+			if unmappedMateDups != nil && (len(dupSet.pairs) > 0 || i > 0) {
+				unmappedMateDups[p.left.Name] = true
 			}
 		}
 	}
-	return dupMetrics
+	return dupMetrics, nil
 }
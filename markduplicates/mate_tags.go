@@ -0,0 +1,127 @@
+// Copyright 2019 Grail Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package markduplicates
+
+import (
+	"fmt"
+
+	"github.com/Schaudge/grailbase/errors"
+	"github.com/Schaudge/grailbase/simd"
+	"github.com/Schaudge/grailbio/encoding/bam"
+	"github.com/Schaudge/hts/sam"
+)
+
+// Mate tags
+//
+// With Opts.AddMateTags, both reads of every readpair are tagged with
+// the CIGAR of their mate as MC:Z, and its mapping quality as MQ:i,
+// like samtools fixmate -m, for tools such as samtools markdup and
+// GATK. Mark already has the mate of every read when it completes its
+// readpair, within the shard or through the distant mates, so the
+// reads are tagged then, by the shard that writes them. A read keeps
+// the tags it already has unless Opts.OverwriteMateTags is set. Reads
+// with an unmapped mate, and records that are not paired, are not
+// tagged.
+//
+// With Opts.AddMateScoreTag, the reads are also tagged with the score
+// of their mate as ms:i, which samtools markdup uses to choose its
+// primaries. The score is computed like samtools fixmate -m, as the sum
+// of the base qualities of the mate that are at least 15, without the
+// clamping and the QC fail penalty of baseQScore. Like fixmate, the ms
+// tag that a read already has is replaced. Unlike fixmate, the reads
+// with an unmapped mate are not tagged, since Mark does not pair them.
+
+// mateTags is the most tags that addMateTags adds to a record.
+const mateTags = 2
+
+// addsMateTags returns true if Mark tags the reads of readpairs with
+// tags of their mate.
+func (o *Opts) addsMateTags() bool {
+	return o.AddMateTags || o.AddMateScoreTag
+}
+
+// addMateTags tags r with the CIGAR and mapping quality of its mate.
+func addMateTags(opts *Opts, r, mate *sam.Record) error {
+	checkRecord(r)
+	if opts.OverwriteMateTags {
+		bam.ClearAuxTags(r, []sam.Tag{mcTag, mqTag})
+	}
+	addMC, addMQ := r.AuxFields.Get(mcTag) == nil, r.AuxFields.Get(mqTag) == nil
+	if !addMC && !addMQ {
+		return nil
+	}
+	r.AuxFields = growAux(r.AuxFields, mateTags)
+	if addMC {
+		tag, err := sam.NewAux(mcTag, mate.Cigar.String())
+		if err != nil {
+			return errors.E(err, fmt.Sprintf("error creating MC:Z:%v tag", mate.Cigar))
+		}
+		r.AuxFields = append(r.AuxFields, tag)
+	}
+	if addMQ {
+		tag, err := sam.NewAux(mqTag, int(mate.MapQ))
+		if err != nil {
+			return errors.E(err, fmt.Sprintf("error creating MQ:i:%d tag", mate.MapQ))
+		}
+		r.AuxFields = append(r.AuxFields, tag)
+	}
+	return nil
+}
+
+// mateScore returns the ms score of r, like calc_mate_score of
+// samtools fixmate. Missing qualities score 0, like they do in
+// baseQScore.
+func mateScore(r *sam.Record) int {
+	if missingQuals(r) {
+		return 0
+	}
+	return simd.Accumulate8Greater(r.Qual, 14)
+}
+
+// addMateScoreTag tags r with the ms score of its mate, replacing the
+// ms tag it may have.
+func addMateScoreTag(r, mate *sam.Record) error {
+	checkRecord(r)
+	bam.ClearAuxTags(r, []sam.Tag{msTag})
+	score := mateScore(mate)
+	tag, err := sam.NewAux(msTag, score)
+	if err != nil {
+		return errors.E(err, fmt.Sprintf("error creating ms:i:%d tag", score))
+	}
+	r.AuxFields = append(growAux(r.AuxFields, 1), tag)
+	return nil
+}
+
+// addPairMateTags adds the tags of Opts.AddMateTags and
+// Opts.AddMateScoreTag to the reads of p that are in shard. The others
+// are tagged by the shards that write them.
+func addPairMateTags(opts *Opts, shard *bam.Shard, p *readPair) error {
+	for _, reads := range [2][2]*sam.Record{{p.left, p.right}, {p.right, p.left}} {
+		r, mate := reads[0], reads[1]
+		if !shard.RecordInShard(r) {
+			continue
+		}
+		if opts.AddMateTags {
+			if err := addMateTags(opts, r, mate); err != nil {
+				return err
+			}
+		}
+		if opts.AddMateScoreTag {
+			if err := addMateScoreTag(r, mate); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,208 @@
+// Copyright 2019 Grail Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package markduplicates
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"testing"
+
+	"github.com/Schaudge/grailbio/encoding/bam"
+	"github.com/Schaudge/grailbio/encoding/bamprovider"
+	"github.com/Schaudge/hts/sam"
+	"github.com/grailbio/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+// Test the mate tags of readpairs mated within a shard, through the
+// distant mates on the same and on another reference, and of queryname
+// grouped input.
+func TestMateTags(t *testing.T) {
+	newRecord := func(name string, ref *sam.Reference, pos int, flags sam.Flags, matePos int, mateRef *sam.Reference,
+		cigar sam.Cigar, mapQ byte, aux ...sam.Aux) *sam.Record {
+		r := NewRecord(name, ref, pos, flags, matePos, mateRef, cigar)
+		r.MapQ = mapQ
+		r.AuxFields = append(r.AuxFields, aux...)
+		return r
+	}
+	// A is mated within its shard, B through the distant mates, and T
+	// is a trans readpair. Read 1 of C already has mate tags. S has an
+	// unmapped mate.
+	newRecords := func() map[string]*sam.Record {
+		return map[string]*sam.Record{
+			"A1": newRecord("A:::1:10:1:1", chr1, 100, r1F, 150, chr1, cigarSoft1, 60),
+			"A2": newRecord("A:::1:10:1:1", chr1, 150, r2R, 100, chr1, cigar0, 30),
+			"B1": newRecord("B:::1:20:1:1", chr1, 120, r1F, 700, chr1, cigar0, 20),
+			"B2": newRecord("B:::1:20:1:1", chr1, 700, r2R, 120, chr1, cigar100M, 40),
+			"T1": newRecord("T:::1:30:1:1", chr1, 130, r1F, 50, chr2, cigar0, 50),
+			"T2": newRecord("T:::1:30:1:1", chr2, 50, r2R, 130, chr1, cigarHard1, 10),
+			"C1": newRecord("C:::1:40:1:1", chr1, 200, r1F, 250, chr1, cigar0, 60, NewAux("MC", "5M"), NewAux("MQ", 7)),
+			"C2": newRecord("C:::1:40:1:1", chr1, 250, r2R, 200, chr1, cigar0, 60),
+			"S1": newRecord("S:::1:50:1:1", chr1, 300, s1F, 300, chr1, cigar0, 60),
+			"S2": newRecord("S:::1:50:1:1", chr1, 300, up2, 300, chr1, nil, 0),
+		}
+	}
+	coordinateOrder := []string{"A1", "B1", "T1", "A2", "C1", "C2", "S1", "S2", "B2", "T2"}
+	querynameOrder := []string{"A1", "A2", "B1", "B2", "C1", "C2", "S1", "S2", "T1", "T2"}
+
+	tests := []struct {
+		overwrite bool
+		tags      map[string]string
+	}{
+		{
+			false,
+			map[string]string{
+				"A1": "10M 30", "A2": "1S8M1S 60",
+				"B1": "100M 40", "B2": "10M 20",
+				"T1": "1H8M1H 10", "T2": "10M 50",
+				"C1": "5M 7", "C2": "10M 60",
+			},
+		},
+		{
+			true,
+			map[string]string{
+				"A1": "10M 30", "A2": "1S8M1S 60",
+				"B1": "100M 40", "B2": "10M 20",
+				"T1": "1H8M1H 10", "T2": "10M 50",
+				"C1": "10M 60", "C2": "10M 60",
+			},
+		},
+	}
+
+	tempDir, cleanup := testutil.TempDir(t, "", "")
+	defer cleanup()
+	testIdx := 0
+	for _, test := range tests {
+		for _, input := range []struct {
+			name, format string
+			header       *sam.Header
+			order        []string
+		}{
+			{"coordinate", "bam", header, coordinateOrder},
+			{"coordinate", "pam", header, coordinateOrder},
+			{"queryname", "bam", newTestHeader(t, "@HD\tVN:1.6\tSO:queryname\n"), querynameOrder},
+		} {
+			byName := newRecords()
+			records := make([]*sam.Record, len(input.order))
+			for i, name := range input.order {
+				records[i] = byName[name]
+			}
+			opts := defaultOpts
+			opts.OutputPath = NewTestOutput(tempDir, testIdx, input.format)
+			opts.Format = input.format
+			// The padding covers the 100M alignment of B1.
+			opts.Padding = 100
+			opts.AddMateTags = true
+			opts.OverwriteMateTags = test.overwrite
+			testIdx++
+
+			markDuplicates := &MarkDuplicates{
+				Provider: newTestProvider(t, input.header, records),
+				Opts:     &opts,
+			}
+			_, err := markDuplicates.Mark(nil)
+			if !assert.NoError(t, err, "overwrite %v, input %s %s", test.overwrite, input.name, input.format) {
+				continue
+			}
+
+			actualRecords := ReadRecords(t, opts.OutputPath)
+			if !assert.Equal(t, len(records), len(actualRecords)) {
+				continue
+			}
+			names := make([]string, len(actualRecords))
+			for i, r := range actualRecords {
+				names[i] = r.Name[:1] + "2"
+				if r.Flags&sam.Read1 != 0 {
+					names[i] = r.Name[:1] + "1"
+				}
+				tags := ""
+				mc, mq := r.AuxFields.Get(mcTag), r.AuxFields.Get(mqTag)
+				if mc != nil && mq != nil {
+					tags = fmt.Sprintf("%v %v", mc.Value(), mq.Value())
+				} else if mc != nil || mq != nil {
+					tags = "MC or MQ alone"
+				}
+				assert.Equal(t, test.tags[names[i]], tags, "overwrite %v, input %s %s, record %v",
+					test.overwrite, input.name, input.format, r)
+			}
+			sort.Strings(names)
+			assert.Equal(t, querynameOrder, names, "overwrite %v, input %s %s", test.overwrite, input.name, input.format)
+		}
+	}
+}
+
+// Test that the ms tags match those of samtools fixmate -m, in
+// testdata/fixmate_ms.sam, for readpairs mated within a shard, through
+// the distant mates, on another reference, with bases below Q15, and
+// QC failed.
+func TestMateScoreTag(t *testing.T) {
+	readFixture := func() (*sam.Header, []*sam.Record) {
+		f, err := os.Open("testdata/fixmate_ms.sam")
+		assert.NoError(t, err)
+		defer f.Close() // nolint: errcheck
+		reader, err := sam.NewReader(f)
+		assert.NoError(t, err)
+		var records []*sam.Record
+		for {
+			r, err := reader.Read()
+			if err == io.EOF {
+				break
+			}
+			assert.NoError(t, err)
+			records = append(records, r)
+		}
+		return reader.Header(), records
+	}
+	recordKey := func(r *sam.Record) string {
+		return fmt.Sprintf("%s/%d", r.Name, r.Flags&(sam.Read1|sam.Read2))
+	}
+
+	tempDir, cleanup := testutil.TempDir(t, "", "")
+	defer cleanup()
+	for testIdx, format := range []string{"bam", "pam"} {
+		fixmateHeader, records := readFixture()
+		expected := map[string]interface{}{}
+		for _, r := range records {
+			expected[recordKey(r)] = r.AuxFields.Get(msTag).Value()
+			bam.ClearAuxTags(r, []sam.Tag{msTag})
+		}
+		opts := defaultOpts
+		opts.OutputPath = NewTestOutput(tempDir, testIdx, format)
+		opts.Format = format
+		// The padding covers the 150M alignments of the fixture.
+		opts.Padding = 150
+		opts.AddMateScoreTag = true
+
+		markDuplicates := &MarkDuplicates{
+			Provider: bamprovider.NewFakeProvider(fixmateHeader, records),
+			Opts:     &opts,
+		}
+		_, err := markDuplicates.Mark(nil)
+		if !assert.NoError(t, err, "format %s", format) {
+			continue
+		}
+
+		actualRecords := ReadRecords(t, opts.OutputPath)
+		assert.Equal(t, len(expected), len(actualRecords), "format %s", format)
+		for _, r := range actualRecords {
+			ms := r.AuxFields.Get(msTag)
+			if assert.NotNil(t, ms, "format %s, record %v", format, r) {
+				assert.Equal(t, fmt.Sprint(expected[recordKey(r)]), fmt.Sprint(ms.Value()),
+					"format %s, record %v", format, r)
+			}
+		}
+	}
+}
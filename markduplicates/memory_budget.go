@@ -0,0 +1,201 @@
+// Copyright 2019 Grail Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package markduplicates
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Schaudge/hts/sam"
+)
+
+// With Opts.MaxMemoryMB, Mark accounts the estimated memory of its
+// major consumers against a budget, instead of leaving it to the
+// garbage collector to keep up with them:
+//
+//   - The records of the shards in the pipeline of the BAM output, from
+//     when a reader reads them until a writer adds them to the output,
+//     see markShards.
+//   - The distant mate table, which is kept in disk shards instead if
+//     it would exceed half of the budget, or Opts.MaxDistantMateMemoryMB
+//     if it is set, see setupDistantMates.
+//   - The compressed shards that the writers added to the output, and
+//     that wait in its queue for an earlier shard, or for the end of the
+//     output, as the unmapped shard does.
+//
+// When the budget is reached, the pipeline stops reading new shards
+// until the shards in it are written. It always lets a shard in when
+// it has none, so that Mark completes, a shard at a time, with a budget
+// smaller than a shard. The accounting is logged every
+// Opts.ProgressInterval, or every memoryLogInterval without it.
+
+// memoryLogInterval is the interval of the memory log lines without
+// Opts.ProgressInterval.
+const memoryLogInterval = time.Minute
+
+// recordOverhead is the estimated memory of a record, besides its
+// variable length fields.
+const recordOverhead = 256
+
+// outputCompression is the estimated ratio of the memory of the records
+// of a shard to the size of its compressed output.
+const outputCompression = 4
+
+// recordBytes returns the estimated memory of r.
+func recordBytes(r *sam.Record) int64 {
+	n := recordOverhead + len(r.Name) + len(r.Seq.Seq) + len(r.Qual) + 4*len(r.Cigar)
+	for _, aux := range r.AuxFields {
+		n += len(aux)
+	}
+	return int64(n)
+}
+
+// memoryConsumer is a consumer of memory accounted by a memoryBudget.
+type memoryConsumer int
+
+const (
+	shardRecordsMemory memoryConsumer = iota
+	distantMatesMemory
+	pendingOutputMemory
+	numMemoryConsumers
+)
+
+var memoryConsumerNames = [numMemoryConsumers]string{"shard records", "distant mates", "pending output"}
+
+// memoryBudget accounts the memory of the consumers of Mark against
+// Opts.MaxMemoryMB. A nil *memoryBudget accounts nothing and never
+// waits. It is safe for concurrent use.
+type memoryBudget struct {
+	limit int64
+	mutex sync.Mutex
+	cond  *sync.Cond
+	used  [numMemoryConsumers]int64
+	// shards is the number of shards in the pipeline, and pauses the
+	// number of times that admitShard waited for the budget.
+	shards int
+	pauses int
+}
+
+// newMemoryBudget returns a budget of limitMB MB, or nil if limitMB is
+// 0.
+func newMemoryBudget(limitMB int) *memoryBudget {
+	if limitMB <= 0 {
+		return nil
+	}
+	b := &memoryBudget{limit: int64(limitMB) << 20}
+	b.cond = sync.NewCond(&b.mutex)
+	return b
+}
+
+// total returns the memory of all the consumers. b.mutex must be held.
+func (b *memoryBudget) total() int64 {
+	var total int64
+	for _, n := range b.used {
+		total += n
+	}
+	return total
+}
+
+// add adds n bytes, which may be negative, to the memory of c.
+func (b *memoryBudget) add(c memoryConsumer, n int64) {
+	if b == nil || n == 0 {
+		return
+	}
+	b.mutex.Lock()
+	b.used[c] += n
+	if n < 0 {
+		b.cond.Broadcast()
+	}
+	b.mutex.Unlock()
+}
+
+// admitShard waits until the budget is not reached, or the pipeline has
+// no shards, and then counts a shard into the pipeline.
+func (b *memoryBudget) admitShard() {
+	if b == nil {
+		return
+	}
+	b.mutex.Lock()
+	paused := false
+	for b.shards > 0 && b.total() >= b.limit {
+		if !paused {
+			b.pauses++
+			paused = true
+		}
+		b.cond.Wait()
+	}
+	b.shards++
+	b.mutex.Unlock()
+}
+
+// shardDone counts a shard out of the pipeline.
+func (b *memoryBudget) shardDone() {
+	if b == nil {
+		return
+	}
+	b.mutex.Lock()
+	b.shards--
+	b.cond.Broadcast()
+	b.mutex.Unlock()
+}
+
+// String returns the accounting of b, as in "memory 900/1024 MB: shard
+// records 600 MB, distant mates 250 MB, pending output 50 MB, 3 pauses".
+func (b *memoryBudget) String() string {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	parts := make([]string, 0, numMemoryConsumers+1)
+	for c, n := range b.used {
+		parts = append(parts, fmt.Sprintf("%s %d MB", memoryConsumerNames[c], n>>20))
+	}
+	parts = append(parts, fmt.Sprintf("%d pauses", b.pauses))
+	return fmt.Sprintf("memory %d/%d MB: %s", b.total()>>20, b.limit>>20, strings.Join(parts, ", "))
+}
+
+// startMemoryBudget sets up the budget of Opts.MaxMemoryMB, and logs
+// its accounting periodically. It returns a function that stops the
+// log, and logs the final accounting.
+func (m *MarkDuplicates) startMemoryBudget() (stop func()) {
+	m.memory = newMemoryBudget(m.Opts.MaxMemoryMB)
+	if m.memory == nil {
+		return func() {}
+	}
+	interval := memoryLogInterval
+	if m.Opts.ProgressInterval > 0 {
+		interval = m.Opts.ProgressInterval
+	}
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				shardLog.Printf("%v", m.memory)
+			case <-done:
+				return
+			}
+		}
+	}()
+	return func() {
+		close(done)
+		wg.Wait()
+		shardLog.Printf("%v", m.memory)
+	}
+}
@@ -0,0 +1,115 @@
+// Copyright 2019 Grail Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package markduplicates
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/Schaudge/doppelmark/simulate"
+	gbam "github.com/Schaudge/grailbio/encoding/bam"
+	"github.com/Schaudge/grailbio/encoding/bamprovider"
+	"github.com/grailbio/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMemoryBudget(t *testing.T) {
+	assert.Nil(t, newMemoryBudget(0))
+	var none *memoryBudget
+	none.add(shardRecordsMemory, 1<<30)
+	none.admitShard()
+	none.shardDone()
+
+	b := newMemoryBudget(1)
+	// A shard is admitted over the budget when there is none in the
+	// pipeline.
+	b.add(distantMatesMemory, 2<<20)
+	b.admitShard()
+	b.add(shardRecordsMemory, 1<<20)
+	admitted := make(chan bool)
+	go func() {
+		b.admitShard()
+		admitted <- true
+	}()
+	select {
+	case <-admitted:
+		t.Fatal("shard admitted over the budget")
+	case <-time.After(10 * time.Millisecond):
+	}
+	b.add(shardRecordsMemory, -1<<20)
+	b.add(pendingOutputMemory, 1<<20)
+	b.shardDone()
+	assert.True(t, <-admitted)
+	assert.Equal(t, "memory 3/1 MB: shard records 0 MB, distant mates 2 MB, pending output 1 MB, 1 pauses", b.String())
+}
+
+func TestMaxMemory(t *testing.T) {
+	tempDir, cleanup := testutil.TempDir(t, "", "")
+	defer cleanup()
+	simOpts := simulate.DefaultOpts
+	simOpts.InterchromosomalFraction = 0.2
+	input, _, _ := simulated(t, tempDir, simOpts)
+	h, records := readSimulated(t, input)
+
+	// The output with a budget of a tenth of the input is the same as
+	// without one.
+	var expected []string
+	for testIdx, maxMemoryMB := range []int{0, 1} {
+		opts := defaultOpts
+		opts.OutputPath = NewTestOutput(tempDir, testIdx, "bam")
+		opts.Format = "bam"
+		opts.ShardSize = 100000
+		opts.Padding = 1000
+		opts.ScratchDir = tempDir
+		// The readers get ahead of the marker, so that the budget is
+		// reached.
+		opts.ReadParallelism = 4
+		opts.ComputeParallelism = 1
+		opts.WriteParallelism = 1
+		opts.MaxMemoryMB = maxMemoryMB
+		markDuplicates := &MarkDuplicates{
+			Provider: bamprovider.NewFakeProvider(h, records),
+			Opts:     &opts,
+		}
+		// The fake provider has a single shard, which is the budget.
+		shards, err := gbam.GetPositionBasedShards(h, opts.ShardSize, opts.Padding, true)
+		assert.NoError(t, err)
+		_, err = markDuplicates.Mark(shards)
+		if !assert.NoError(t, err, "max memory %d", maxMemoryMB) {
+			continue
+		}
+
+		var actual []string
+		for _, r := range ReadRecords(t, opts.OutputPath) {
+			actual = append(actual, fmt.Sprintf("%s %d %d %v", r.Name, r.Pos, r.Flags, r.AuxFields))
+		}
+		if expected == nil {
+			assert.Nil(t, markDuplicates.memory)
+			assert.Equal(t, 2*simOpts.Pairs, len(actual))
+			expected = actual
+			continue
+		}
+		assert.Equal(t, expected, actual, "max memory %d", maxMemoryMB)
+		memory := markDuplicates.memory
+		assert.True(t, memory.pauses > 0, "max memory %d", maxMemoryMB)
+		assert.Equal(t, 0, memory.shards, "max memory %d", maxMemoryMB)
+		assert.Equal(t, int64(0), memory.used[shardRecordsMemory], "max memory %d", maxMemoryMB)
+		assert.Equal(t, int64(0), memory.used[pendingOutputMemory], "max memory %d", maxMemoryMB)
+		// The distant mates exceed half of the budget, and are kept on
+		// disk.
+		assert.Equal(t, int64(0), memory.used[distantMatesMemory], "max memory %d", maxMemoryMB)
+		assert.True(t, markDuplicates.diskMateShards > 0, "max memory %d", maxMemoryMB)
+	}
+}
@@ -0,0 +1,348 @@
+// Copyright 2019 Grail Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package markduplicates
+
+import (
+	"bytes"
+	"container/heap"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/Schaudge/grailbase/file"
+	"github.com/Schaudge/grailbio/encoding/bamprovider"
+	"github.com/Schaudge/hts/bam"
+	"github.com/Schaudge/hts/sam"
+)
+
+// Opts.BamFile may be a comma separated list of coordinate sorted
+// inputs, such as the BAMs of the lanes of a library, so that the
+// duplicates across the inputs are marked without merging them first.
+// The inputs are merged by position into an indexed BAM file in
+// Opts.ScratchDir, which is then marked like a single input and
+// removed when Mark is done.
+//
+// The inputs must have the same references in the same order. The
+// merged header has the @HD and @SQ lines of the first input, and the
+// @RG, @PG and @CO lines of all the inputs. A read group or program
+// ID that is already used by an earlier input is renamed to
+// ID-<input index>, and so are the RG and PG tags of its records and
+// the PP fields that refer to it.
+//
+// Records at the same position are merged in the order of the inputs,
+// so the file index of a record, its position in the merged input,
+// orders it by position, then by input, then by its position in its
+// input. The duplicates do not depend on anything but the inputs and
+// their order.
+
+// inputPaths returns the paths of the inputs in bamFile, a comma
+// separated list.
+func inputPaths(bamFile string) []string {
+	var paths []string
+	for _, path := range strings.Split(bamFile, ",") {
+		if path = strings.TrimSpace(path); path != "" {
+			paths = append(paths, path)
+		}
+	}
+	return paths
+}
+
+// mergeInput is an input of the merge, and its next record.
+type mergeInput struct {
+	idx    int
+	stream *bamStream
+	closer func() error
+	// renames maps the renamed read group and program IDs of the
+	// input to their IDs in the merged header.
+	renames map[string]map[string]string
+}
+
+// mergeIterator merges coordinate sorted inputs by position.
+type mergeIterator struct {
+	inputs []*mergeInput
+	// pending are the inputs that have a next record, ordered by
+	// the position of that record.
+	pending mergeHeap
+	record  *sam.Record
+	err     error
+}
+
+// mergeHeap is a heap of the inputs of a merge, ordered by the
+// position of their next record and then by their index. Unmapped
+// records without a reference come last.
+type mergeHeap []*mergeInput
+
+func (h mergeHeap) Len() int { return len(h) }
+
+func (h mergeHeap) Less(i, j int) bool {
+	ri, rj := h[i].stream.record, h[j].stream.record
+	refi, refj := ri.Ref.ID(), rj.Ref.ID()
+	switch {
+	case refi != refj && (refi < 0 || refj < 0):
+		return refj < 0
+	case refi != refj:
+		return refi < refj
+	case ri.Pos != rj.Pos:
+		return ri.Pos < rj.Pos
+	}
+	return h[i].idx < h[j].idx
+}
+
+func (h mergeHeap) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
+
+func (h *mergeHeap) Push(x interface{}) { *h = append(*h, x.(*mergeInput)) }
+
+func (h *mergeHeap) Pop() interface{} {
+	old := *h
+	x := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return x
+}
+
+// Scan reads the next record of the merge, and returns false at the
+// end of the inputs or on error.
+func (it *mergeIterator) Scan() bool {
+	if it.record != nil {
+		// Advance the input of the last record.
+		input := it.pending[0]
+		if input.stream.Scan() {
+			heap.Fix(&it.pending, 0)
+		} else {
+			heap.Pop(&it.pending)
+		}
+		it.record = nil
+	}
+	if len(it.pending) == 0 {
+		return false
+	}
+	input := it.pending[0]
+	it.record = input.stream.Record()
+	if err := renameAux(it.record, input.renames); err != nil {
+		it.err = fmt.Errorf("input %d: %v", input.idx, err)
+		it.record, it.pending = nil, nil
+		return false
+	}
+	return true
+}
+
+// Record returns the last record read by Scan.
+func (it *mergeIterator) Record() *sam.Record {
+	return it.record
+}
+
+// Close closes the inputs, and returns the first error of Scan or
+// Close, if any.
+func (it *mergeIterator) Close() error {
+	for _, input := range it.inputs {
+		if err := input.stream.Close(); err != nil && it.err == nil {
+			it.err = fmt.Errorf("input %d: %v", input.idx, err)
+		}
+		if err := input.closer(); err != nil && it.err == nil {
+			it.err = err
+		}
+	}
+	return it.err
+}
+
+// renameAux renames the read group and program of r with renames, see
+// mergeInput.
+func renameAux(r *sam.Record, renames map[string]map[string]string) error {
+	for i, aux := range r.AuxFields {
+		ids := renames[aux.Tag().String()]
+		if ids == nil {
+			continue
+		}
+		id, ok := aux.Value().(string)
+		if !ok {
+			continue
+		}
+		if renamed, ok := ids[id]; ok {
+			tag, err := sam.NewAux(aux.Tag(), renamed)
+			if err != nil {
+				return fmt.Errorf("error creating %s:Z:%s tag: %v", aux.Tag(), renamed, err)
+			}
+			r.AuxFields[i] = tag
+		}
+	}
+	return nil
+}
+
+// mergeHeaders returns the header of the merge of inputs with headers,
+// and for each input, the renamed read group and program IDs, see
+// mergeInput.
+func mergeHeaders(headers []*sam.Header) (*sam.Header, []map[string]map[string]string, error) {
+	refs := headers[0].Refs()
+	for i, h := range headers[1:] {
+		other := h.Refs()
+		if len(other) != len(refs) {
+			return nil, nil, fmt.Errorf("input %d has %d references, but input 0 has %d", i+1, len(other), len(refs))
+		}
+		for j, ref := range refs {
+			if other[j].Name() != ref.Name() || other[j].Len() != ref.Len() {
+				return nil, nil, fmt.Errorf("reference %d of input %d is %s:%d, but it is %s:%d in input 0",
+					j, i+1, other[j].Name(), other[j].Len(), ref.Name(), ref.Len())
+			}
+		}
+	}
+
+	var text bytes.Buffer
+	used := map[string]map[string]bool{"@RG": {}, "@PG": {}}
+	allRenames := make([]map[string]map[string]string, len(headers))
+	for i, h := range headers {
+		hText, err := h.MarshalText()
+		if err != nil {
+			return nil, nil, err
+		}
+		lines := strings.Split(strings.TrimSuffix(string(hText), "\n"), "\n")
+
+		// Rename the IDs that are already used by earlier inputs.
+		renames := map[string]map[string]string{"@RG": {}, "@PG": {}}
+		for _, line := range lines {
+			fields := strings.Split(line, "\t")
+			ids, ok := renames[fields[0]]
+			if !ok {
+				continue
+			}
+			for _, field := range fields[1:] {
+				if !strings.HasPrefix(field, "ID:") {
+					continue
+				}
+				id := field[len("ID:"):]
+				renamed := id
+				for used[fields[0]][renamed] {
+					renamed += "-" + strconv.Itoa(i)
+				}
+				used[fields[0]][renamed] = true
+				if renamed != id {
+					ids[id] = renamed
+				}
+			}
+		}
+
+		for _, line := range lines {
+			fields := strings.Split(line, "\t")
+			switch fields[0] {
+			case "@HD", "@SQ":
+				if i > 0 {
+					continue
+				}
+			case "@RG", "@PG":
+				for j, field := range fields[1:] {
+					if strings.HasPrefix(field, "ID:") {
+						if renamed, ok := renames[fields[0]][field[len("ID:"):]]; ok {
+							fields[j+1] = "ID:" + renamed
+						}
+					}
+					if fields[0] == "@PG" && strings.HasPrefix(field, "PP:") {
+						if renamed, ok := renames["@PG"][field[len("PP:"):]]; ok {
+							fields[j+1] = "PP:" + renamed
+						}
+					}
+				}
+			case "":
+				continue
+			}
+			text.WriteString(strings.Join(fields, "\t"))
+			text.WriteByte('\n')
+		}
+		if len(renames["@RG"]) > 0 || len(renames["@PG"]) > 0 {
+			allRenames[i] = map[string]map[string]string{"RG": renames["@RG"], "PG": renames["@PG"]}
+		}
+	}
+	header, err := sam.NewHeader(text.Bytes(), nil)
+	if err != nil {
+		return nil, nil, fmt.Errorf("couldn't merge the input headers: %v", err)
+	}
+	return header, allRenames, nil
+}
+
+// mergeInputs merges the coordinate sorted inputs paths into an indexed
+// BAM file, and sets m.Provider to read it. cleanup removes the merged
+// file.
+func (m *MarkDuplicates) mergeInputs(ctx context.Context, paths []string) (cleanup func(), err error) {
+	var inputs []*mergeInput
+	closeInputs := func() {
+		for _, input := range inputs {
+			input.closer() // nolint: errcheck
+		}
+	}
+	var headers []*sam.Header
+	for i, path := range paths {
+		if isStdin(path) {
+			closeInputs()
+			return nil, fmt.Errorf("stdin cannot be one of several inputs")
+		}
+		in, err := file.Open(ctx, path)
+		if err != nil {
+			closeInputs()
+			return nil, fmt.Errorf("couldn't open input %s: %v", path, err)
+		}
+		reader, err := bam.NewReader(in.Reader(ctx), 1)
+		if err != nil {
+			in.Close(ctx) // nolint: errcheck
+			closeInputs()
+			return nil, fmt.Errorf("couldn't read bam %s: %v", path, err)
+		}
+		inputs = append(inputs, &mergeInput{
+			idx:    i,
+			stream: &bamStream{reader: reader},
+			closer: func() error { return in.Close(ctx) },
+		})
+		order, err := inputOrder(m.Opts, reader.Header())
+		if err == nil && order != inputOrderCoordinate {
+			err = fmt.Errorf("its order is %s", order)
+		}
+		if err != nil {
+			closeInputs()
+			return nil, fmt.Errorf("several inputs must be coordinate sorted, but %s is not: %v", path, err)
+		}
+		headers = append(headers, reader.Header())
+	}
+	header, renames, err := mergeHeaders(headers)
+	if err != nil {
+		closeInputs()
+		return nil, err
+	}
+
+	iter := &mergeIterator{inputs: inputs}
+	for i, input := range inputs {
+		input.renames = renames[i]
+		if input.stream.Scan() {
+			iter.pending = append(iter.pending, input)
+		}
+	}
+	heap.Init(&iter.pending)
+
+	dir, err := ioutil.TempDir(m.Opts.ScratchDir, "merge")
+	if err != nil {
+		iter.Close() // nolint: errcheck
+		return nil, err
+	}
+	path := filepath.Join(dir, "input.bam")
+	ioLog.Printf("merging %d inputs to %s", len(paths), path)
+	if err := writeIndexedBAM(header, iter, path); err != nil {
+		os.RemoveAll(dir) // nolint: errcheck
+		return nil, err
+	}
+	m.Provider = bamprovider.NewProvider(path, bamprovider.ProviderOpts{Index: path + ".bai"})
+	return func() {
+		if err := os.RemoveAll(dir); err != nil {
+			ioLog.Errorf("couldn't remove %s: %v", dir, err)
+		}
+	}, nil
+}
@@ -0,0 +1,154 @@
+// Copyright 2019 Grail Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package markduplicates
+
+import (
+	"context"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/Schaudge/grailbio/encoding/bamprovider"
+	"github.com/Schaudge/hts/sam"
+	"github.com/grailbio/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestInputPaths(t *testing.T) {
+	assert.Equal(t, []string{"a.bam"}, inputPaths("a.bam"))
+	assert.Equal(t, []string{"a.bam", "b.bam"}, inputPaths("a.bam,b.bam"))
+	assert.Equal(t, []string{"a.bam", "b.bam"}, inputPaths(" a.bam, b.bam,"))
+}
+
+func TestMergeHeaders(t *testing.T) {
+	h0 := newTestHeader(t, "@HD\tVN:1.6\tSO:coordinate\n@RG\tID:rg1\tLB:lib1\n@PG\tID:bwa\tPN:bwa\n")
+	h1 := newTestHeader(t, "@HD\tVN:1.6\tSO:coordinate\n@RG\tID:rg1\tLB:lib1\n@RG\tID:rg2\tLB:lib1\n"+
+		"@PG\tID:bwa\tPN:bwa\n@PG\tID:sort\tPN:samtools\tPP:bwa\n")
+	merged, renames, err := mergeHeaders([]*sam.Header{h0, h1})
+	assert.NoError(t, err)
+	assert.Equal(t, sam.Coordinate, merged.SortOrder)
+	assert.Equal(t, len(header.Refs()), len(merged.Refs()))
+
+	var rgs []string
+	for _, rg := range merged.RGs() {
+		rgs = append(rgs, rg.Name())
+	}
+	assert.Equal(t, []string{"rg1", "rg1-1", "rg2"}, rgs)
+	text, err := merged.MarshalText()
+	assert.NoError(t, err)
+	assert.Contains(t, string(text), "@PG\tID:bwa-1\tPN:bwa\n")
+	assert.Contains(t, string(text), "@PG\tID:sort\tPN:samtools\tPP:bwa-1\n")
+
+	assert.Nil(t, renames[0])
+	assert.Equal(t, map[string]map[string]string{
+		"RG": {"rg1": "rg1-1"},
+		"PG": {"bwa": "bwa-1"},
+	}, renames[1])
+
+	// The references must match.
+	ref, err := sam.NewReference("chr1", "", "", 999, nil, nil)
+	assert.NoError(t, err)
+	h2, err := sam.NewHeader(nil, []*sam.Reference{ref})
+	assert.NoError(t, err)
+	_, _, err = mergeHeaders([]*sam.Header{h0, h2})
+	assert.Error(t, err)
+}
+
+func TestMergeInputs(t *testing.T) {
+	// The same molecule is sequenced in two lanes: B in lane 2 is a
+	// duplicate of A in lane 1.
+	rg1 := NewAux("RG", "rg1")
+	lane1 := []*sam.Record{
+		NewRecordAux("A:::1:10:1:1", chr1, 0, r1F, 50, chr1, cigar0, rg1),
+		NewRecordAux("A:::1:10:1:1", chr1, 50, r2R, 0, chr1, cigar0, rg1),
+		NewRecordAux("C:::1:10:5:5", chr1, 200, r1F, 300, chr1, cigar0, rg1),
+		NewRecordAux("C:::1:10:5:5", chr1, 300, r2R, 200, chr1, cigar0, rg1),
+	}
+	lane2 := []*sam.Record{
+		NewRecordAux("B:::2:10:1:1", chr1, 0, r1F, 50, chr1, cigar0, rg1),
+		NewRecordAux("B:::2:10:1:1", chr1, 50, r2R, 0, chr1, cigar0, rg1),
+	}
+	expected := []struct {
+		name string
+		rg   string
+		dup  bool
+	}{
+		{"A:::1:10:1:1", "rg1", false},
+		{"B:::2:10:1:1", "rg1-1", true},
+		{"A:::1:10:1:1", "rg1", false},
+		{"B:::2:10:1:1", "rg1-1", true},
+		{"C:::1:10:5:5", "rg1", false},
+		{"C:::1:10:5:5", "rg1", false},
+	}
+
+	tempDir, cleanup := testutil.TempDir(t, "", "")
+	defer cleanup()
+	hd := "@HD\tVN:1.6\tSO:coordinate\n@RG\tID:rg1\tLB:lib1\n@PG\tID:bwa\tPN:bwa\n"
+	path1 := filepath.Join(tempDir, "lane1.bam")
+	path2 := filepath.Join(tempDir, "lane2.bam")
+	writeTestBAM(t, path1, newTestHeader(t, hd+"@CO\tlane 1\n"), lane1)
+	writeTestBAM(t, path2, newTestHeader(t, hd+"@CO\tlane 2\n"), lane2)
+
+	opts := defaultOpts
+	opts.BamFile = strings.Join([]string{path1, path2}, ",")
+	opts.OutputPath = NewTestOutput(tempDir, 0, "bam")
+	opts.Format = "bam"
+	opts.ScratchDir = tempDir
+	opts.MinBases = 1
+	assert.NoError(t, SetupAndMark(context.Background(), nil, &opts))
+
+	// The output is coordinate sorted, with the read groups, programs
+	// and comments of both inputs.
+	p := bamprovider.NewProvider(opts.OutputPath)
+	h, err := p.GetHeader()
+	assert.NoError(t, err)
+	assert.NoError(t, p.Close())
+	assert.Equal(t, sam.Coordinate, h.SortOrder)
+	var rgs []string
+	for _, rg := range h.RGs() {
+		rgs = append(rgs, rg.Name())
+		assert.Equal(t, "lib1", rg.Library(), "read group %s", rg.Name())
+	}
+	assert.Equal(t, []string{"rg1", "rg1-1"}, rgs)
+	var progs []string
+	for _, pg := range h.Progs() {
+		progs = append(progs, pg.UID())
+	}
+	assert.Subset(t, progs, []string{"bwa", "bwa-1"})
+	assert.Equal(t, []string{"lane 1", "lane 2"}, h.Comments)
+
+	actualRecords := ReadRecords(t, opts.OutputPath)
+	assert.Equal(t, len(expected), len(actualRecords))
+	for i, r := range actualRecords {
+		if i > 0 {
+			assert.True(t, actualRecords[i-1].Pos <= r.Pos, "record %v", r)
+		}
+		assert.Equal(t, expected[i].name, r.Name)
+		assert.Equal(t, expected[i].dup, (r.Flags&sam.Duplicate) != 0, "record %v", r)
+		aux := r.AuxFields.Get(sam.NewTag("RG"))
+		if assert.NotNil(t, aux, "record %v", r) {
+			assert.Equal(t, expected[i].rg, aux.Value(), "record %v", r)
+		}
+	}
+
+	// Several inputs must be coordinate sorted.
+	path3 := filepath.Join(tempDir, "queryname.bam")
+	writeTestBAM(t, path3, newTestHeader(t, "@HD\tVN:1.6\tSO:queryname\n"), lane2)
+	opts = defaultOpts
+	opts.BamFile = strings.Join([]string{path1, path3}, ",")
+	opts.OutputPath = NewTestOutput(tempDir, 1, "bam")
+	opts.ScratchDir = tempDir
+	opts.MinBases = 1
+	assert.Error(t, SetupAndMark(context.Background(), nil, &opts))
+}
@@ -17,12 +17,15 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"os"
+	"path/filepath"
 	"sort"
+	"strconv"
 	"sync"
 
 	"github.com/Schaudge/grailbase/errors"
-	"github.com/Schaudge/grailbase/log"
 	"github.com/Schaudge/hts/sam"
 )
 
@@ -48,6 +51,8 @@ type Metrics struct {
 	UnmappedReads int
 
 	// UnpairedDups is the number of fragments that were marked as duplicates.
+	// Fragments cannot be optical duplicates, so these are all PCR
+	// duplicates.
 	UnpairedDups int
 
 	// ReadPairDups is the number of read pairs that were marked as duplicates.
@@ -58,19 +63,39 @@ type Metrics struct {
 	// READ_PAIR_DUPLICATES, which counts all duplicates regardless of
 	// source.
 	ReadPairOpticalDups int
+
+	// ReadPairLibraryDups is the number of read pair duplicates that
+	// were not optical duplicates, i.e. PCR or library duplicates.
+	// ReadPairOpticalDups + ReadPairLibraryDups == ReadPairDups.
+	ReadPairLibraryDups int
 }
 
-// String returns a string representation of the metrics contained in
-// m. The string can be used as metrics file output.
-func (m *Metrics) String() string {
-	librarySizeStr := "0"
+// EstimatedLibrarySize returns picard's ESTIMATED_LIBRARY_SIZE, the
+// Lander-Waterman estimate of the number of distinct molecules in the
+// library. It is estimated from the read pairs examined, less the
+// optical duplicates, and the read pairs that are not duplicates.
+// EstimatedLibrarySize returns false if the library size cannot be
+// estimated, e.g. because there are no read pairs or no duplicates.
+func (m *Metrics) EstimatedLibrarySize() (uint64, bool) {
 	a := uint64((m.ReadPairsExamined / 2) - (m.ReadPairOpticalDups / 2))
 	b := uint64((m.ReadPairsExamined / 2) - (m.ReadPairDups / 2))
 	librarySize, err := estimateLibrarySize(a, b)
-	if err == nil {
+	if err != nil {
+		if err != errNoDuplicates {
+			metricsLog.Errorf("error in estimateLibrarySize(%v, %v): %v, ", a, b, err)
+		}
+		return 0, false
+	}
+	return librarySize, true
+}
+
+// String returns a string representation of the metrics contained in
+// m. The string can be used as metrics file output. Like picard, the
+// library size is left empty if it cannot be estimated.
+func (m *Metrics) String() string {
+	librarySizeStr := ""
+	if librarySize, ok := m.EstimatedLibrarySize(); ok {
 		librarySizeStr = fmt.Sprintf("%v", librarySize)
-	} else {
-		log.Error.Printf("error in estimateLibrarySize(%v, %v): %v, ", a, b, err)
 	}
 
 	return fmt.Sprintf("%d\t%d\t%d\t%d\t%d\t%d\t%d\t%0.6f\t%v", m.UnpairedReads, m.ReadPairsExamined/2,
@@ -89,9 +114,16 @@ func (m *Metrics) Add(other *Metrics) {
 	m.UnpairedDups += other.UnpairedDups
 	m.ReadPairDups += other.ReadPairDups
 	m.ReadPairOpticalDups += other.ReadPairOpticalDups
+	m.ReadPairLibraryDups += other.ReadPairLibraryDups
 }
 
 // MetricsCollection contains metrics computed by Mark.
+//
+// The counters and the Add methods other than AddHighCovInterval are
+// not synchronized, so that the per-read paths do not take a lock.
+// Concurrent workers should each accumulate into a private
+// MetricsCollection, and merge it into a shared one with Merge, which
+// is safe for concurrent use.
 type MetricsCollection struct {
 	// Global metrics
 	maxAlignDist int
@@ -102,20 +134,254 @@ type MetricsCollection struct {
 	// have the given Euclidean distance.
 	OpticalDistance [][]int64
 
+	// OpticalDistanceOverflow stores, for each bagsize range in
+	// OpticalDistance, the number of duplicate read pairs that are at
+	// least Opts.OpticalHistogramMaxDistance apart.
+	OpticalDistanceOverflow []int64
+
+	// OpticalNamesExamined is the number of readpair names considered
+	// for the optical distance histogram.
+	OpticalNamesExamined int64
+
+	// UnparseableNames is the number of readpair names that were
+	// excluded from the optical distance histogram because
+	// ParseLocation could not parse them.
+	UnparseableNames int64
+
+	// UnparseableNamesByReadGroup breaks UnparseableNames down by
+	// read group. Readpairs without a read group are counted under
+	// the empty string.
+	UnparseableNamesByReadGroup map[string]int64
+
+	// NoLocationPairs is the number of duplicate readpairs that were
+	// excluded from the optical distance histogram because they were
+	// sequenced on a platform whose read names carry no physical
+	// location, e.g. PacBio or Oxford Nanopore.
+	NoLocationPairs int64
+
+	// CrossTilePairsSkipped is the number of pairs of duplicate
+	// readpairs that were not added to the optical distance histogram
+	// because they were on different tiles.
+	CrossTilePairsSkipped int64
+
+	// CappedDuplicateSets is the number of duplicate sets larger than
+	// Opts.MaxDuplicateSetSize, whose optical duplicates and distances
+	// were computed on a sample, and CappedDuplicatePairs the number of
+	// readpairs in them.
+	CappedDuplicateSets  int64
+	CappedDuplicatePairs int64
+
+	// SecondaryReads is the number of secondary (0x100) records.
+	SecondaryReads int64
+
+	// SupplementaryReads is the number of supplementary (0x800)
+	// records, e.g. the split parts of chimeric alignments.
+	SupplementaryReads int64
+
+	// SecondarySupplementaryDups is the number of secondary or
+	// supplementary records that carry the duplicate flag. Unless
+	// Opts.FlagSecondaryDups is set, Mark does not propagate the
+	// duplicate flag of a primary alignment to its secondary or
+	// supplementary records, so these flags come from the input and
+	// are only kept when Opts.ClearExisting is false.
+	SecondarySupplementaryDups int64
+
+	// SecondarySupplementarySkipped is the number of secondary or
+	// supplementary records that were excluded from duplicate key
+	// construction. Duplicate keys are built from primary alignments
+	// only.
+	SecondarySupplementarySkipped int64
+
+	// ExcludedFromDupAnalysis is the number of primary mapped reads
+	// that were excluded from duplicate marking by Opts.IgnoreQCFail,
+	// Opts.MinMAPQForDup, or Opts.ExistingDuplicateHandling
+	// "preserve", including the mates of excluded reads.
+	ExcludedFromDupAnalysis int64
+
+	// MalformedTemplateReads is the number of extra primary records of
+	// templates with more than two, which were passed through
+	// unflagged, see Opts.StrictTemplates.
+	MalformedTemplateReads int64
+
+	// ProtectedDuplicates is the number of records that were
+	// duplicates, but overlap Opts.ProtectedRegionsBED, so their
+	// duplicate flag is not set.
+	ProtectedDuplicates int64
+
+	// FilteredReads is the number of records that were dropped from
+	// the input by Opts.FilterExpression.
+	FilteredReads int64
+
+	// MateMismatchReads is the number of primary records that were not
+	// paired with the record of the same name because they are not
+	// mates of each other, and were passed through unflagged, see
+	// Opts.FailOnMateMismatch.
+	MateMismatchReads int64
+
+	// MissingQualityReads is the number of primary records without
+	// base qualities, which score 0 to choose the primaries, see
+	// baseQScore.
+	MissingQualityReads int64
+
+	// UMIMissingReads is the number of primary mapped reads without
+	// UMIs in their Opts.UMISource, the Opts.UMITag tag or the read
+	// name.
+	UMIMissingReads int64
+
+	// UMIRescuedPairs and UMIRescuedUnpaired are the number of
+	// duplicate sets of readpairs and of unpaired reads that grouping
+	// by position alone would have merged into another set, i.e. the
+	// primaries that would have been duplicates without their distinct
+	// UMIs.
+	UMIRescuedPairs    int64
+	UMIRescuedUnpaired int64
+
+	// DuplexFamilies, SingleStrandFamilies and SingletonFamilies are
+	// the number of duplicate sets with Opts.DuplexUMI that have
+	// templates from both strands, more than one template from one
+	// strand, and just one template.
+	DuplexFamilies       int64
+	SingleStrandFamilies int64
+	SingletonFamilies    int64
+
+	// UMIFamilySizes contains the family size histogram of each
+	// library when grouping by UMI.
+	UMIFamilySizes map[string]*UMIFamilySizes
+
+	// UMIReads is the number of primary mapped reads with each UMI
+	// when grouping by UMI. It has an entry per distinct UMI, so it
+	// grows with the UMI length when the UMIs are random.
+	UMIReads map[string]int64
+
+	// UMIAllowlistExact, UMIAllowlistCorrected,
+	// UMIAllowlistAmbiguous and UMIAllowlistUnmatched are the number
+	// of primary mapped reads whose UMI is in Opts.UMIAllowlistFile,
+	// is at Hamming distance 1 from exactly one allowlist UMI, is at
+	// distance 1 from several, and is further from all of them.
+	UMIAllowlistExact     int64
+	UMIAllowlistCorrected int64
+	UMIAllowlistAmbiguous int64
+	UMIAllowlistUnmatched int64
+
+	// UMICorrectedReads is the number of primary mapped reads whose
+	// readpair's UMIs were corrected, with Opts.KnownUmis,
+	// Opts.UMIAllowlistFile or Opts.UMICorrection.
+	UMICorrectedReads int64
+
+	// DuplicateSetSizes[n] is the number of duplicate sets of n
+	// readpairs, or of n reads for sets without readpairs. Sets of
+	// size 1 are reads without duplicates.
+	DuplicateSetSizes []int64
+
+	// DuplicateSetSizeOverflow is the number of duplicate sets larger
+	// than Opts.DuplicateSetSizeMax.
+	DuplicateSetSizeOverflow int64
+
+	// InsertSizes[i] counts the duplicate and non-duplicate readpairs
+	// in insert size bin i of Opts.InsertSizeBins. The insert size is
+	// the distance between the unclipped 5' positions of the reads.
+	InsertSizes []InsertSizeCounts
+
+	// TransInsertSizes counts the readpairs whose reads are on
+	// different references.
+	TransInsertSizes InsertSizeCounts
+
+	// UnpairedInsertSizes counts the mapped reads whose mate is
+	// unmapped.
+	UnpairedInsertSizes InsertSizeCounts
+
+	// GCContent[i] counts the duplicate and non-duplicate templates
+	// whose bases are i*5% to (i+1)*5% G or C, with Opts.GCMetrics.
+	GCContent []InsertSizeCounts
+
+	// GCMissingSequence counts the templates with a read without
+	// sequence, which are not in GCContent.
+	GCMissingSequence InsertSizeCounts
+
+	// InputFlagstat, OutputFlagstat and RemovedFlagstat count the
+	// records of the input, those written to the output, and those
+	// removed from it, with Opts.Flagstat.
+	InputFlagstat   FlagstatCounts
+	OutputFlagstat  FlagstatCounts
+	RemovedFlagstat FlagstatCounts
+
+	// ShardMetrics counts, per shard index, the readpairs that were
+	// mated within the shard and through the distant mate table. The
+	// counts should not change between runs on the same input with
+	// the same shards.
+	ShardMetrics map[int]*ShardMetrics
+
+	// DistantMateDistances[i] is the number of readpairs mated through
+	// the distant mate table whose reads are on the same reference,
+	// between 10^i and 10^(i+1) bases apart.
+	DistantMateDistances []int64
+
+	// DistantMateTransPairs is the number of readpairs mated through
+	// the distant mate table whose reads are on different references.
+	DistantMateTransPairs int64
+
+	// TileMetrics contains per-tile optical duplicate metrics.
+	TileMetrics map[TileKey]*TileMetrics
+
 	// LibraryMetrics contains per-library metrics.
 	LibraryMetrics map[string]*Metrics
 
+	// ReadGroupMetrics contains the same metrics as LibraryMetrics,
+	// but per read group. Reads without a read group are counted
+	// under NoReadGroup.
+	ReadGroupMetrics map[string]*Metrics
+
+	// RegionMetrics contains the same metrics as LibraryMetrics, but
+	// only for reads whose unclipped 5' position overlaps a region in
+	// Opts.MetricsRegionsBED. Each read is counted separately, so a
+	// readpair with one read in a region counts as half a readpair.
+	RegionMetrics map[string]*Metrics
+
+	// ReferenceMetrics contains per-reference duplication metrics,
+	// keyed by the reference name of the leftmost read of each
+	// readpair, if Opts.PerReferenceMetrics is set. Unmapped reads are
+	// counted under "*".
+	ReferenceMetrics map[string]*ReferenceMetrics
+
+	// CellBarcodeMissingReads is the number of primary reads without
+	// an Opts.CellBarcodeTag tag.
+	CellBarcodeMissingReads int64
+
+	// CellMetrics contains per-cell duplication metrics, keyed by the
+	// Opts.CellBarcodeTag barcode, if Opts.CellMetricsMax is set.
+	CellMetrics map[string]*CellMetrics
+
 	// High coverage intervals and read counts.
 	HighCoverageIntervals []coverageInterval
 
+	// OpticalPixelDistances holds the optical pixel distance of each
+	// read group, when they are not all that of the optical detector,
+	// see optical_distance.go.
+	OpticalPixelDistances map[string]int
+
+	// Verification compares the duplicate flags of the output with
+	// those of Opts.VerifyAgainst, if it is set.
+	Verification *Verification
+
 	mutex sync.Mutex
 }
 
-func newMetricsCollection() *MetricsCollection {
+// NewMetricsCollection returns an empty MetricsCollection.
+func NewMetricsCollection() *MetricsCollection {
 	mc := &MetricsCollection{
-		LibraryMetrics:        make(map[string]*Metrics),
-		OpticalDistance:       make([][]int64, 4),
-		HighCoverageIntervals: make([]coverageInterval, 0),
+		LibraryMetrics:              make(map[string]*Metrics),
+		ReadGroupMetrics:            make(map[string]*Metrics),
+		RegionMetrics:               make(map[string]*Metrics),
+		ReferenceMetrics:            make(map[string]*ReferenceMetrics),
+		CellMetrics:                 make(map[string]*CellMetrics),
+		ShardMetrics:                make(map[int]*ShardMetrics),
+		UnparseableNamesByReadGroup: make(map[string]int64),
+		TileMetrics:                 make(map[TileKey]*TileMetrics),
+		UMIFamilySizes:              make(map[string]*UMIFamilySizes),
+		UMIReads:                    make(map[string]int64),
+		OpticalDistance:             make([][]int64, 4),
+		OpticalDistanceOverflow:     make([]int64, 4),
+		HighCoverageIntervals:       make([]coverageInterval, 0),
 	}
 	for i := range mc.OpticalDistance {
 		mc.OpticalDistance[i] = make([]int64, 60000)
@@ -135,12 +401,90 @@ func (mc *MetricsCollection) Get(library string) *Metrics {
 	return m
 }
 
-// Merge per-library and optical distance metrics from other
-// into mc.
+// ReadGroup returns Metrics for the given read group. If there is no
+// Metrics for readGroup yet, create one and return it.
+func (mc *MetricsCollection) ReadGroup(readGroup string) *Metrics {
+	m, found := mc.ReadGroupMetrics[readGroup]
+	if found {
+		return m
+	}
+	m = &Metrics{}
+	mc.ReadGroupMetrics[readGroup] = m
+	return m
+}
+
+// Region returns the in-region Metrics for the given library. If there
+// is no in-region Metrics for library yet, create one and return it.
+func (mc *MetricsCollection) Region(library string) *Metrics {
+	m, found := mc.RegionMetrics[library]
+	if found {
+		return m
+	}
+	m = &Metrics{}
+	mc.RegionMetrics[library] = m
+	return m
+}
+
+// forRecord returns the library and read group Metrics for r, and the
+// in-region Metrics of the library if r is in regions, in the first n
+// elements of metrics. It returns an array so that counting a record
+// does not allocate.
+func (mc *MetricsCollection) forRecord(readGroups *readGroupTable, regions regionMap,
+	r *sam.Record) (metrics [3]*Metrics, n int) {
+	readGroup := readGroups.get(r)
+	metrics[0], metrics[1] = mc.Get(readGroup.library), mc.ReadGroup(readGroup.name)
+	n = 2
+	if regions.containsRecord(r) {
+		metrics[n] = mc.Region(readGroup.library)
+		n++
+	}
+	return metrics, n
+}
+
+// Total returns the sum of the per-library metrics.
+func (mc *MetricsCollection) Total() Metrics {
+	total := Metrics{}
+	for _, m := range mc.LibraryMetrics {
+		total.Add(m)
+	}
+	return total
+}
+
+// Tile returns TileMetrics for the given tile. If there is no
+// TileMetrics for the tile yet, create one and return it.
+func (mc *MetricsCollection) Tile(key TileKey) *TileMetrics {
+	m, found := mc.TileMetrics[key]
+	if found {
+		return m
+	}
+	m = &TileMetrics{}
+	mc.TileMetrics[key] = m
+	return m
+}
+
+// Merge adds all the metrics in other to mc, e.g. to combine the
+// metrics of runs on different parts of the same input. Counters and
+// histogram bins are summed, and per-library, per-read group, and
+// per-tile metrics are combined by key. Derived values such as
+// ESTIMATED_LIBRARY_SIZE and PERCENT_DUPLICATION are not stored, so
+// they are computed from the merged counters. mc must have been
+// created by NewMetricsCollection or DecodeMetricsCollection. Merge
+// may be called concurrently on the same mc, but other must not be
+// modified until Merge returns.
 func (mc *MetricsCollection) Merge(other *MetricsCollection) {
 	mc.mutex.Lock()
 	defer mc.mutex.Unlock()
 
+	if other.maxAlignDist > mc.maxAlignDist {
+		mc.maxAlignDist = other.maxAlignDist
+	}
+	if other.maxX > mc.maxX {
+		mc.maxX = other.maxX
+	}
+	if other.maxY > mc.maxY {
+		mc.maxY = other.maxY
+	}
+
 	for library, otherMetrics := range other.LibraryMetrics {
 		existing, found := mc.LibraryMetrics[library]
 		if found {
@@ -151,7 +495,117 @@ func (mc *MetricsCollection) Merge(other *MetricsCollection) {
 			mc.LibraryMetrics[library] = &new
 		}
 	}
+	for readGroup, otherMetrics := range other.ReadGroupMetrics {
+		mc.ReadGroup(readGroup).Add(otherMetrics)
+	}
+	for library, otherMetrics := range other.RegionMetrics {
+		mc.Region(library).Add(otherMetrics)
+	}
+	for name, otherMetrics := range other.ReferenceMetrics {
+		m := mc.Reference(name)
+		m.ReadsExamined += otherMetrics.ReadsExamined
+		m.Duplicates += otherMetrics.Duplicates
+		m.OpticalDuplicates += otherMetrics.OpticalDuplicates
+	}
+	mc.CellBarcodeMissingReads += other.CellBarcodeMissingReads
+	for barcode, otherMetrics := range other.CellMetrics {
+		m := mc.Cell(barcode)
+		m.ReadsExamined += otherMetrics.ReadsExamined
+		m.Duplicates += otherMetrics.Duplicates
+	}
+	for shardIdx, otherMetrics := range other.ShardMetrics {
+		m := mc.Shard(shardIdx)
+		m.WithinShardPairs += otherMetrics.WithinShardPairs
+		m.DistantMatePairs += otherMetrics.DistantMatePairs
+	}
+	if len(mc.DistantMateDistances) < len(other.DistantMateDistances) {
+		temp := make([]int64, len(other.DistantMateDistances))
+		copy(temp, mc.DistantMateDistances)
+		mc.DistantMateDistances = temp
+	}
+	for bin, count := range other.DistantMateDistances {
+		mc.DistantMateDistances[bin] += count
+	}
+	mc.DistantMateTransPairs += other.DistantMateTransPairs
+	for key, otherMetrics := range other.TileMetrics {
+		m := mc.Tile(key)
+		m.DuplicatePairs += otherMetrics.DuplicatePairs
+		m.OpticalPairs += otherMetrics.OpticalPairs
+	}
 	mc.HighCoverageIntervals = append(mc.HighCoverageIntervals, other.HighCoverageIntervals...)
+	mc.OpticalNamesExamined += other.OpticalNamesExamined
+	mc.UnparseableNames += other.UnparseableNames
+	if mc.OpticalPixelDistances == nil {
+		mc.OpticalPixelDistances = other.OpticalPixelDistances
+	}
+	for readGroup, count := range other.UnparseableNamesByReadGroup {
+		mc.UnparseableNamesByReadGroup[readGroup] += count
+	}
+	mc.NoLocationPairs += other.NoLocationPairs
+	mc.CrossTilePairsSkipped += other.CrossTilePairsSkipped
+	mc.CappedDuplicateSets += other.CappedDuplicateSets
+	mc.CappedDuplicatePairs += other.CappedDuplicatePairs
+	for i := range mc.OpticalDistanceOverflow {
+		mc.OpticalDistanceOverflow[i] += other.OpticalDistanceOverflow[i]
+	}
+	if len(mc.DuplicateSetSizes) < len(other.DuplicateSetSizes) {
+		temp := make([]int64, len(other.DuplicateSetSizes))
+		copy(temp, mc.DuplicateSetSizes)
+		mc.DuplicateSetSizes = temp
+	}
+	for size, count := range other.DuplicateSetSizes {
+		mc.DuplicateSetSizes[size] += count
+	}
+	mc.DuplicateSetSizeOverflow += other.DuplicateSetSizeOverflow
+	if len(mc.InsertSizes) < len(other.InsertSizes) {
+		temp := make([]InsertSizeCounts, len(other.InsertSizes))
+		copy(temp, mc.InsertSizes)
+		mc.InsertSizes = temp
+	}
+	for i := range other.InsertSizes {
+		mc.InsertSizes[i].merge(&other.InsertSizes[i])
+	}
+	mc.TransInsertSizes.merge(&other.TransInsertSizes)
+	mc.UnpairedInsertSizes.merge(&other.UnpairedInsertSizes)
+	if len(mc.GCContent) < len(other.GCContent) {
+		temp := make([]InsertSizeCounts, len(other.GCContent))
+		copy(temp, mc.GCContent)
+		mc.GCContent = temp
+	}
+	for i := range other.GCContent {
+		mc.GCContent[i].merge(&other.GCContent[i])
+	}
+	mc.GCMissingSequence.merge(&other.GCMissingSequence)
+	mc.InputFlagstat.merge(&other.InputFlagstat)
+	mc.OutputFlagstat.merge(&other.OutputFlagstat)
+	mc.RemovedFlagstat.merge(&other.RemovedFlagstat)
+	mc.SecondaryReads += other.SecondaryReads
+	mc.SupplementaryReads += other.SupplementaryReads
+	mc.SecondarySupplementaryDups += other.SecondarySupplementaryDups
+	mc.SecondarySupplementarySkipped += other.SecondarySupplementarySkipped
+	mc.ExcludedFromDupAnalysis += other.ExcludedFromDupAnalysis
+	mc.MalformedTemplateReads += other.MalformedTemplateReads
+	mc.MateMismatchReads += other.MateMismatchReads
+	mc.ProtectedDuplicates += other.ProtectedDuplicates
+	mc.FilteredReads += other.FilteredReads
+	mc.MissingQualityReads += other.MissingQualityReads
+	mc.UMIMissingReads += other.UMIMissingReads
+	mc.UMIRescuedPairs += other.UMIRescuedPairs
+	mc.UMIRescuedUnpaired += other.UMIRescuedUnpaired
+	mc.DuplexFamilies += other.DuplexFamilies
+	mc.SingleStrandFamilies += other.SingleStrandFamilies
+	mc.SingletonFamilies += other.SingletonFamilies
+	for library, h := range other.UMIFamilySizes {
+		mc.UMIFamily(library).merge(h)
+	}
+	for umi, count := range other.UMIReads {
+		mc.UMIReads[umi] += count
+	}
+	mc.UMICorrectedReads += other.UMICorrectedReads
+	mc.UMIAllowlistExact += other.UMIAllowlistExact
+	mc.UMIAllowlistCorrected += other.UMIAllowlistCorrected
+	mc.UMIAllowlistAmbiguous += other.UMIAllowlistAmbiguous
+	mc.UMIAllowlistUnmatched += other.UMIAllowlistUnmatched
 	for i := range mc.OpticalDistance {
 		if len(mc.OpticalDistance[i]) < len(other.OpticalDistance[i]) {
 			temp := make([]int64, len(other.OpticalDistance[i]))
@@ -181,32 +635,142 @@ func (mc *MetricsCollection) AddDistance(bagSize, distance int) {
 		}
 	}
 
+	mc.OpticalDistance[bagSizeRange(bagSize)][distance]++
+}
+
+// defaultDuplicateSetSizeMax is the default Opts.DuplicateSetSizeMax.
+const defaultDuplicateSetSizeMax = 1000
+
+// AddDuplicateSetSize counts a duplicate set of the given size, in
+// DuplicateSetSizeOverflow if size is larger than max.
+func (mc *MetricsCollection) AddDuplicateSetSize(size, max int) {
+	if max <= 0 {
+		max = defaultDuplicateSetSizeMax
+	}
+	if size > max {
+		mc.DuplicateSetSizeOverflow++
+		return
+	}
+	if size >= len(mc.DuplicateSetSizes) {
+		temp := make([]int64, size+1)
+		copy(temp, mc.DuplicateSetSizes)
+		mc.DuplicateSetSizes = temp
+	}
+	mc.DuplicateSetSizes[size]++
+}
+
+// AddDistanceOverflow adds n to the overflow counter for the given
+// bagsize.
+func (mc *MetricsCollection) AddDistanceOverflow(bagSize int, n int64) {
+	mc.OpticalDistanceOverflow[bagSizeRange(bagSize)] += n
+}
+
+// bagSizeRangeNames are the names of the bagsize ranges of the
+// OpticalDistance histograms.
+var bagSizeRangeNames = []string{"bagsize-2", "bagsize3-4", "bagsize5-7", "bagsize8-"}
+
+// bagSizeRange returns the index of the OpticalDistance histogram
+// that holds distances for the given bagsize.
+func bagSizeRange(bagSize int) int {
 	if bagSize <= 2 {
-		mc.OpticalDistance[0][distance]++
-	} else if bagSize >= 3 && bagSize <= 4 {
-		mc.OpticalDistance[1][distance]++
-	} else if bagSize >= 5 && bagSize <= 7 {
-		mc.OpticalDistance[2][distance]++
-	} else if bagSize >= 8 {
-		mc.OpticalDistance[3][distance]++
+		return 0
+	} else if bagSize <= 4 {
+		return 1
+	} else if bagSize <= 7 {
+		return 2
 	}
+	return 3
 }
 
-func writeMetrics(ctx context.Context, opts *Opts, globalMetrics *MetricsCollection) (err error) {
-	var f *os.File
-	f, err = os.Create(opts.MetricsFile)
+// WriteMetrics writes globalMetrics to opts.MetricsFile in
+// opts.MetricsFormat. SetupAndMark calls it after Mark, and it can also
+// write metrics merged from several runs.
+func WriteMetrics(ctx context.Context, opts *Opts, globalMetrics *MetricsCollection) (err error) {
+	if opts.MetricsFormat == "json" {
+		return writeJSONMetrics(ctx, opts, globalMetrics)
+	}
+	var f *outputFile
+	f, err = createOutput(ctx, opts.MetricsFile)
 	if err != nil {
 		return errors.E(err, "Couldn't create metrics file:", opts.MetricsFile)
 	}
 	defer func() {
-		if err2 := f.Close(); err == nil && err2 != nil {
+		if err2 := f.Close(ctx); err == nil && err2 != nil {
 			err = err2
 		}
 	}()
 
 	s := "# bio-mark-duplicates\n" +
 		"# maximum 5' alignment distance: " + fmt.Sprintf("%d", globalMetrics.maxAlignDist) + "\n" +
-		"LIBRARY\tUNPAIRED_READS_EXAMINED\tREAD_PAIRS_EXAMINED\t" +
+		"# unparseable read names: " + fmt.Sprintf("%d of %d", globalMetrics.UnparseableNames,
+		globalMetrics.OpticalNamesExamined) + "\n" +
+		"# readpairs without physical location: " + fmt.Sprintf("%d", globalMetrics.NoLocationPairs) + "\n" +
+		"# cross-tile readpair comparisons skipped: " + fmt.Sprintf("%d", globalMetrics.CrossTilePairsSkipped) + "\n" +
+		"# capped duplicate sets: " + fmt.Sprintf("%d, with %d readpairs", globalMetrics.CappedDuplicateSets,
+		globalMetrics.CappedDuplicatePairs) + "\n" +
+		"# secondary reads: " + fmt.Sprintf("%d", globalMetrics.SecondaryReads) + "\n" +
+		"# supplementary reads: " + fmt.Sprintf("%d", globalMetrics.SupplementaryReads) + "\n" +
+		"# secondary or supplementary reads flagged as duplicates: " +
+		fmt.Sprintf("%d", globalMetrics.SecondarySupplementaryDups) + "\n" +
+		"# secondary or supplementary reads skipped for duplicate keys: " +
+		fmt.Sprintf("%d", globalMetrics.SecondarySupplementarySkipped) + "\n" +
+		"# extra primary reads of malformed templates: " +
+		fmt.Sprintf("%d", globalMetrics.MalformedTemplateReads) + "\n" +
+		"# reads with mismatched mates: " + fmt.Sprintf("%d", globalMetrics.MateMismatchReads) + "\n" +
+		"# reads without base qualities: " + fmt.Sprintf("%d", globalMetrics.MissingQualityReads) + "\n" +
+		"# trans readpairs: " + fmt.Sprintf("%d examined, %d duplicates",
+		globalMetrics.TransInsertSizes.total(), globalMetrics.TransInsertSizes.Duplicates) + "\n"
+	if opts.umiFromTag() {
+		s += fmt.Sprintf("# reads without %s tag: %d\n", opts.UMITag, globalMetrics.UMIMissingReads)
+	} else if opts.umiFromQname() {
+		s += fmt.Sprintf("# reads without read name UMI: %d\n", globalMetrics.UMIMissingReads)
+	}
+	if opts.IgnoreQCFail || opts.MinMAPQForDup > 0 {
+		s += fmt.Sprintf("# reads excluded from duplicate marking: %d\n", globalMetrics.ExcludedFromDupAnalysis)
+	}
+	if opts.ProtectedRegionsBED != "" {
+		s += fmt.Sprintf("# protected duplicates: %d\n", globalMetrics.ProtectedDuplicates)
+	}
+	if opts.FilterExpression != "" {
+		s += fmt.Sprintf("# reads removed by filter expression: %d\n", globalMetrics.FilteredReads)
+	}
+	if opts.CellBarcodeTag != "" {
+		s += fmt.Sprintf("# reads without %s tag: %d\n", opts.CellBarcodeTag, globalMetrics.CellBarcodeMissingReads)
+	}
+	if opts.umiGrouping() {
+		s += fmt.Sprintf("# duplicate sets rescued by UMIs: %d readpair, %d unpaired\n",
+			globalMetrics.UMIRescuedPairs, globalMetrics.UMIRescuedUnpaired)
+	}
+	if opts.DuplexUMI {
+		s += fmt.Sprintf("# duplex families: %d duplex, %d single-strand, %d singleton\n",
+			globalMetrics.DuplexFamilies, globalMetrics.SingleStrandFamilies, globalMetrics.SingletonFamilies)
+	}
+	if opts.opticalHistogramEnabled() {
+		if opts.OpticalHistogramSeed != 0 {
+			s += fmt.Sprintf("# optical histogram seed: %d\n", opts.OpticalHistogramSeed)
+		} else {
+			s += "# optical histogram seed: 0 (first file index of each duplicate set)\n"
+		}
+	}
+	readGroups := make([]string, 0, len(globalMetrics.UnparseableNamesByReadGroup))
+	for readGroup := range globalMetrics.UnparseableNamesByReadGroup {
+		readGroups = append(readGroups, readGroup)
+	}
+	sort.Strings(readGroups)
+	for _, readGroup := range readGroups {
+		s += fmt.Sprintf("# unparseable read names in read group '%s': %d\n", readGroup,
+			globalMetrics.UnparseableNamesByReadGroup[readGroup])
+	}
+	readGroups = readGroups[:0]
+	for readGroup := range globalMetrics.OpticalPixelDistances {
+		readGroups = append(readGroups, readGroup)
+	}
+	sort.Strings(readGroups)
+	for _, readGroup := range readGroups {
+		s += fmt.Sprintf("# optical pixel distance of read group '%s': %d\n", readGroup,
+			globalMetrics.OpticalPixelDistances[readGroup])
+	}
+	s += "LIBRARY\tUNPAIRED_READS_EXAMINED\tREAD_PAIRS_EXAMINED\t" +
 		"SECONDARY_OR_SUPPLEMENTARY_RDS\tUNMAPPED_READS\tUNPAIRED_READ_DUPLICATES\t" +
 		"READ_PAIR_DUPLICATES\tREAD_PAIR_OPTICAL_DUPLICATES\tPERCENT_DUPLICATION\t" +
 		"ESTIMATED_LIBRARY_SIZE\n"
@@ -214,23 +778,133 @@ func writeMetrics(ctx context.Context, opts *Opts, globalMetrics *MetricsCollect
 	for library, metrics := range globalMetrics.LibraryMetrics {
 		s += library + "\t" + metrics.String() + "\n"
 	}
+	// With several libraries, also report all libraries together.
+	if len(globalMetrics.LibraryMetrics) > 1 {
+		total := globalMetrics.Total()
+		s += "ALL\t" + total.String() + "\n"
+	}
+	s += "\n" + duplicateSetSizesString(opts, globalMetrics)
+	s += "\n" + insertSizeString(opts, globalMetrics)
+	if opts.GCMetrics {
+		s += "\n" + gcContentString(globalMetrics)
+	}
+	if opts.Flagstat {
+		s += "\n" + flagstatString(globalMetrics)
+	}
+	if opts.umiGrouping() {
+		s += "\n" + umiFamilyString(opts, globalMetrics)
+	}
+	if opts.MetricsRegionsBED != "" {
+		s += "\n# metrics restricted to regions in " + opts.MetricsRegionsBED + "\n" +
+			metricsTableString("REGION_LIBRARY", globalMetrics.RegionMetrics)
+	}
+	if len(globalMetrics.ReadGroupMetrics) > 0 {
+		s += "\n" + metricsTableString("READ_GROUP", globalMetrics.ReadGroupMetrics)
+	}
+	if opts.PerReferenceMetrics {
+		s += "\n" + referenceMetricsString(globalMetrics.ReferenceMetrics)
+	}
+	if opts.CellMetricsMax > 0 {
+		s += "\n" + cellMetricsString(globalMetrics.CellMetrics)
+	}
+	if len(globalMetrics.TileMetrics) > 0 {
+		s += "\n" + tileMetricsString(globalMetrics.TileMetrics)
+	}
+	s += "\n" + shardingString(globalMetrics)
 	if _, err = f.Write([]byte(s)); err != nil {
 		return errors.E(err, "error writing to metrics file:", opts.MetricsFile)
 	}
 	return nil
 }
 
+// duplicateSetSizesString returns the histogram of duplicate set sizes
+// as a tab separated table, with a last row for sets larger than
+// opts.DuplicateSetSizeMax.
+func duplicateSetSizesString(opts *Opts, globalMetrics *MetricsCollection) string {
+	max := opts.DuplicateSetSizeMax
+	if max <= 0 {
+		max = defaultDuplicateSetSizeMax
+	}
+	s := "DUPLICATE_SET_SIZE\tCOUNT\n"
+	for size, count := range globalMetrics.DuplicateSetSizes {
+		if count > 0 {
+			s += fmt.Sprintf("%d\t%d\n", size, count)
+		}
+	}
+	s += fmt.Sprintf(">%d\t%d\n", max, globalMetrics.DuplicateSetSizeOverflow)
+	return s
+}
+
+// metricsTableString returns the metrics in byName, e.g. per read
+// group, as a tab separated table with the same columns as the
+// per-library metrics, sorted by name. nameColumn is the header of the
+// first column.
+func metricsTableString(nameColumn string, byName map[string]*Metrics) string {
+	names := make([]string, 0, len(byName))
+	for name := range byName {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	s := nameColumn + "\tUNPAIRED_READS_EXAMINED\tREAD_PAIRS_EXAMINED\t" +
+		"SECONDARY_OR_SUPPLEMENTARY_RDS\tUNMAPPED_READS\tUNPAIRED_READ_DUPLICATES\t" +
+		"READ_PAIR_DUPLICATES\tREAD_PAIR_OPTICAL_DUPLICATES\tPERCENT_DUPLICATION\t" +
+		"ESTIMATED_LIBRARY_SIZE\n"
+	for _, name := range names {
+		s += name + "\t" + byName[name].String() + "\n"
+	}
+	return s
+}
+
+// tileMetricsString returns the per-tile metrics as a tab separated
+// table, sorted by lane and tile. READS is the number of duplicate
+// readpairs on the tile, and RATE the fraction of them that are
+// optical duplicates.
+func tileMetricsString(tiles map[TileKey]*TileMetrics) string {
+	keys := sortedTileKeys(tiles)
+	s := "LANE\tSURFACE\tSWATH\tTILE\tREADS\tOPTICAL_PAIRS\tRATE\n"
+	for _, key := range keys {
+		m := tiles[key]
+		s += fmt.Sprintf("%s\t%d\t%d\t%s\t%d\t%d\t%0.6f\n", key.Lane, key.Surface, key.Swath, key.TileName,
+			m.DuplicatePairs, m.OpticalPairs, m.Rate())
+	}
+	return s
+}
+
+// sortedTileKeys returns the keys of tiles sorted by lane and tile.
+// Lanes are sorted by number, so that lane 10 comes after lane 2, and
+// lanes that are not numeric come first, by name.
+func sortedTileKeys(tiles map[TileKey]*TileMetrics) []TileKey {
+	keys := make([]TileKey, 0, len(tiles))
+	laneNumbers := make(map[string]int)
+	for key := range tiles {
+		keys = append(keys, key)
+		if _, found := laneNumbers[key.Lane]; !found {
+			laneNumbers[key.Lane], _ = strconv.Atoi(key.Lane)
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if li, lj := laneNumbers[keys[i].Lane], laneNumbers[keys[j].Lane]; li != lj {
+			return li < lj
+		}
+		if keys[i].Lane != keys[j].Lane {
+			return keys[i].Lane < keys[j].Lane
+		}
+		return keys[i].TileName < keys[j].TileName
+	})
+	return keys
+}
+
 // writeHighCoverageIntervals writes positions as 1-based.
 func writeHighCoverageIntervals(ctx context.Context, opts *Opts, header *sam.Header,
 	globalMetrics *MetricsCollection) (err error) {
-	var f *os.File
-	f, err = os.Create(opts.HighCoverageIntervalFile)
+	var f *outputFile
+	f, err = createOutput(ctx, opts.HighCoverageIntervalFile)
 	if err != nil {
 		return errors.E(err, "Couldn't create high coverage intervals file:",
 			opts.HighCoverageIntervalFile)
 	}
 	defer func() {
-		if err2 := f.Close(); err == nil && err2 != nil {
+		if err2 := f.Close(ctx); err == nil && err2 != nil {
 			err = err2
 		}
 	}()
@@ -257,13 +931,13 @@ func writeHighCoverageIntervals(ctx context.Context, opts *Opts, header *sam.Hea
 }
 
 func writeTileSize(ctx context.Context, opts *Opts, globalMetrics *MetricsCollection) (err error) {
-	var f *os.File
-	f, err = os.Create(opts.TileSizeFile)
+	var f *outputFile
+	f, err = createOutput(ctx, opts.TileSizeFile)
 	if err != nil {
 		return errors.E(err, "Couldn't create tile size file:", opts.TileSizeFile)
 	}
 	defer func() {
-		if err2 := f.Close(); err == nil && err2 != nil {
+		if err2 := f.Close(ctx); err == nil && err2 != nil {
 			err = err2
 		}
 	}()
@@ -275,13 +949,13 @@ func writeTileSize(ctx context.Context, opts *Opts, globalMetrics *MetricsCollec
 }
 
 func writeOpticalHistogram(ctx context.Context, opts *Opts, globalMetrics *MetricsCollection) (err error) {
-	var f *os.File
-	f, err = os.Create(opts.OpticalHistogram)
+	var f *outputFile
+	f, err = createOutput(ctx, opts.OpticalHistogram)
 	if err != nil {
 		return errors.E(err, "Couldn't create optical histogram file:", opts.OpticalHistogram)
 	}
 	defer func() {
-		if err2 := f.Close(); err == nil && err2 != nil {
+		if err2 := f.Close(ctx); err == nil && err2 != nil {
 			err = err2
 		}
 	}()
@@ -289,12 +963,106 @@ func writeOpticalHistogram(ctx context.Context, opts *Opts, globalMetrics *Metri
 	if _, err = fmt.Fprintf(f, "#bag_size_range\toptical_dist\tcount\n"); err != nil {
 		return errors.E(err, "error writing to optical histogram file:", opts.OpticalHistogram)
 	}
-	for i, prefix := range []string{"bagsize-2", "bagsize3-4", "bagsize5-7", "bagsize8-"} {
+	for i, prefix := range bagSizeRangeNames {
 		for dist, count := range globalMetrics.OpticalDistance[i] {
 			if _, err = fmt.Fprintf(f, "%s\t%d\t%d\n", prefix, dist, count); err != nil {
 				return errors.E(err, "error writing to optical histogram file:", opts.OpticalHistogram)
 			}
 		}
+		if opts.OpticalHistogramMaxDistance > 0 {
+			if _, err = fmt.Fprintf(f, "%s\t>=%d\t%d\n", prefix, opts.OpticalHistogramMaxDistance,
+				globalMetrics.OpticalDistanceOverflow[i]); err != nil {
+				return errors.E(err, "error writing to optical histogram file:", opts.OpticalHistogram)
+			}
+		}
+	}
+	return nil
+}
+
+// opticalHistogramRow is a row of the optical histogram file. Bins
+// cover distances in [BinLower, BinUpper). The overflow bin of
+// distances at or beyond Opts.OpticalHistogramMaxDistance has a
+// BinUpper of -1.
+type opticalHistogramRow struct {
+	BinLower         int    `json:"bin_lower"`
+	BinUpper         int    `json:"bin_upper"`
+	Count            int64  `json:"count"`
+	BagSizeRangeName string `json:"duplicate_set_size_bucket"`
+}
+
+// opticalHistogramRows returns the non-empty bins of the optical
+// histograms, ordered by bagsize range and then by distance.
+func opticalHistogramRows(opts *Opts, globalMetrics *MetricsCollection) []opticalHistogramRow {
+	rows := []opticalHistogramRow{}
+	for i, name := range bagSizeRangeNames {
+		for dist, count := range globalMetrics.OpticalDistance[i] {
+			if count > 0 {
+				rows = append(rows, opticalHistogramRow{dist, dist + 1, count, name})
+			}
+		}
+		if opts.OpticalHistogramMaxDistance > 0 && globalMetrics.OpticalDistanceOverflow[i] > 0 {
+			rows = append(rows, opticalHistogramRow{opts.OpticalHistogramMaxDistance, -1,
+				globalMetrics.OpticalDistanceOverflow[i], name})
+		}
+	}
+	return rows
+}
+
+// writeOpticalHistogramFile writes the optical histograms to
+// opts.OpticalHistogramFile, as TSV or as a JSON array depending on
+// opts.OpticalHistogramFormat. The file is written to a temporary
+// file first and then renamed, so readers never see a partial file. A
+// remote file is uploaded directly, since it is not visible until the
+// upload is complete.
+func writeOpticalHistogramFile(ctx context.Context, opts *Opts, globalMetrics *MetricsCollection) (err error) {
+	var f io.Writer
+	if isRemotePath(opts.OpticalHistogramFile) {
+		var out *outputFile
+		if out, err = createOutput(ctx, opts.OpticalHistogramFile); err != nil {
+			return errors.E(err, "Couldn't create optical histogram file:", opts.OpticalHistogramFile)
+		}
+		defer func() {
+			if err2 := out.Close(ctx); err == nil && err2 != nil {
+				err = err2
+			}
+		}()
+		f = out
+	} else {
+		var tmp *os.File
+		tmp, err = ioutil.TempFile(filepath.Dir(opts.OpticalHistogramFile),
+			filepath.Base(opts.OpticalHistogramFile)+".tmp")
+		if err != nil {
+			return errors.E(err, "Couldn't create optical histogram file:", opts.OpticalHistogramFile)
+		}
+		defer func() {
+			if err2 := tmp.Close(); err == nil && err2 != nil {
+				err = err2
+			}
+			if err == nil {
+				err = os.Rename(tmp.Name(), opts.OpticalHistogramFile)
+			}
+			if err != nil {
+				os.Remove(tmp.Name()) // nolint: errcheck
+			}
+		}()
+		f = tmp
+	}
+
+	rows := opticalHistogramRows(opts, globalMetrics)
+	if opts.OpticalHistogramFormat == "json" {
+		if err = json.NewEncoder(f).Encode(rows); err != nil {
+			return errors.E(err, "error writing to optical histogram file:", opts.OpticalHistogramFile)
+		}
+		return nil
+	}
+	if _, err = fmt.Fprintf(f, "bin_lower\tbin_upper\tcount\tduplicate_set_size_bucket\n"); err != nil {
+		return errors.E(err, "error writing to optical histogram file:", opts.OpticalHistogramFile)
+	}
+	for _, row := range rows {
+		if _, err = fmt.Fprintf(f, "%d\t%d\t%d\t%s\n", row.BinLower, row.BinUpper, row.Count,
+			row.BagSizeRangeName); err != nil {
+			return errors.E(err, "error writing to optical histogram file:", opts.OpticalHistogramFile)
+		}
 	}
 	return nil
 }
@@ -0,0 +1,156 @@
+// Copyright 2019 Grail Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package markduplicates
+
+import (
+	"bytes"
+	"encoding/gob"
+	"io"
+
+	"github.com/Schaudge/grailbase/errors"
+)
+
+// metricsCollectionFields has the same fields as MetricsCollection,
+// but not its methods, so gob encodes its exported fields without
+// calling MetricsCollection.GobEncode.
+type metricsCollectionFields MetricsCollection
+
+// metricsCollectionGob is the gob encoding of a MetricsCollection,
+// including its unexported fields.
+type metricsCollectionGob struct {
+	MaxAlignDist int
+	MaxX         int
+	MaxY         int
+	Fields       *metricsCollectionFields
+}
+
+// GobEncode implements gob.GobEncoder.
+func (mc *MetricsCollection) GobEncode() ([]byte, error) {
+	mc.mutex.Lock()
+	defer mc.mutex.Unlock()
+
+	var buf bytes.Buffer
+	err := gob.NewEncoder(&buf).Encode(&metricsCollectionGob{
+		MaxAlignDist: mc.maxAlignDist,
+		MaxX:         mc.maxX,
+		MaxY:         mc.maxY,
+		Fields:       (*metricsCollectionFields)(mc),
+	})
+	return buf.Bytes(), err
+}
+
+// GobDecode implements gob.GobDecoder. mc must be empty, e.g. created
+// by NewMetricsCollection.
+func (mc *MetricsCollection) GobDecode(data []byte) error {
+	mc.mutex.Lock()
+	defer mc.mutex.Unlock()
+
+	decoded := metricsCollectionGob{Fields: (*metricsCollectionFields)(mc)}
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&decoded); err != nil {
+		return err
+	}
+	mc.maxAlignDist = decoded.MaxAlignDist
+	mc.maxX = decoded.MaxX
+	mc.maxY = decoded.MaxY
+
+	// gob does not send empty maps and slices, so restore the ones
+	// that Merge and the metrics writers expect to be non-nil.
+	empty := NewMetricsCollection()
+	if mc.LibraryMetrics == nil {
+		mc.LibraryMetrics = empty.LibraryMetrics
+	}
+	if mc.ReadGroupMetrics == nil {
+		mc.ReadGroupMetrics = empty.ReadGroupMetrics
+	}
+	if mc.RegionMetrics == nil {
+		mc.RegionMetrics = empty.RegionMetrics
+	}
+	if mc.UnparseableNamesByReadGroup == nil {
+		mc.UnparseableNamesByReadGroup = empty.UnparseableNamesByReadGroup
+	}
+	if mc.ReferenceMetrics == nil {
+		mc.ReferenceMetrics = empty.ReferenceMetrics
+	}
+	if mc.CellMetrics == nil {
+		mc.CellMetrics = empty.CellMetrics
+	}
+	if mc.ShardMetrics == nil {
+		mc.ShardMetrics = empty.ShardMetrics
+	}
+	if mc.TileMetrics == nil {
+		mc.TileMetrics = empty.TileMetrics
+	}
+	if mc.UMIFamilySizes == nil {
+		mc.UMIFamilySizes = empty.UMIFamilySizes
+	}
+	if mc.UMIReads == nil {
+		mc.UMIReads = empty.UMIReads
+	}
+	if len(mc.OpticalDistance) != len(empty.OpticalDistance) {
+		mc.OpticalDistance = empty.OpticalDistance
+	}
+	if len(mc.OpticalDistanceOverflow) != len(empty.OpticalDistanceOverflow) {
+		mc.OpticalDistanceOverflow = empty.OpticalDistanceOverflow
+	}
+	if mc.HighCoverageIntervals == nil {
+		mc.HighCoverageIntervals = empty.HighCoverageIntervals
+	}
+	return nil
+}
+
+// coverageIntervalGob is the gob encoding of a coverageInterval.
+type coverageIntervalGob struct {
+	RefID        int
+	Start        int
+	End          int
+	MeanCoverage float64
+}
+
+// GobEncode implements gob.GobEncoder.
+func (c coverageInterval) GobEncode() ([]byte, error) {
+	var buf bytes.Buffer
+	err := gob.NewEncoder(&buf).Encode(coverageIntervalGob{c.refId, c.start, c.end, c.meanCoverage})
+	return buf.Bytes(), err
+}
+
+// GobDecode implements gob.GobDecoder.
+func (c *coverageInterval) GobDecode(data []byte) error {
+	var decoded coverageIntervalGob
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&decoded); err != nil {
+		return err
+	}
+	*c = coverageInterval{decoded.RefID, decoded.Start, decoded.End, decoded.MeanCoverage}
+	return nil
+}
+
+// EncodeMetricsCollection writes mc to w, e.g. so that a driver can
+// collect the metrics of runs on separate machines, decode them with
+// DecodeMetricsCollection, and combine them with
+// MetricsCollection.Merge.
+func EncodeMetricsCollection(w io.Writer, mc *MetricsCollection) error {
+	if err := gob.NewEncoder(w).Encode(mc); err != nil {
+		return errors.E(err, "error encoding metrics")
+	}
+	return nil
+}
+
+// DecodeMetricsCollection reads a MetricsCollection written by
+// EncodeMetricsCollection from r.
+func DecodeMetricsCollection(r io.Reader) (*MetricsCollection, error) {
+	mc := NewMetricsCollection()
+	if err := gob.NewDecoder(r).Decode(mc); err != nil {
+		return nil, errors.E(err, "error decoding metrics")
+	}
+	return mc, nil
+}
@@ -0,0 +1,218 @@
+// Copyright 2019 Grail Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package markduplicates
+
+import (
+	"bytes"
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// newTestMetricsCollection returns a MetricsCollection with every
+// kind of metric set, with values that depend on n.
+func newTestMetricsCollection(n int) *MetricsCollection {
+	mc := NewMetricsCollection()
+	mc.maxAlignDist = 10 * n
+	mc.maxX = 100 + n
+	mc.maxY = 200 - n
+	mc.AddDistance(2, n)
+	mc.AddDistance(5, 100*n)
+	mc.AddDistanceOverflow(9, int64(n))
+	mc.OpticalNamesExamined = int64(10 * n)
+	mc.UnparseableNames = int64(n)
+	mc.UnparseableNamesByReadGroup[fmt.Sprintf("rg%d", n%2)] = int64(n)
+	mc.NoLocationPairs = int64(n)
+	mc.CrossTilePairsSkipped = int64(2 * n)
+	mc.CappedDuplicateSets = int64(n)
+	mc.CappedDuplicatePairs = int64(100 * n)
+	mc.SecondaryReads = int64(n)
+	mc.SupplementaryReads = int64(n + 1)
+	mc.SecondarySupplementaryDups = int64(n)
+	mc.SecondarySupplementarySkipped = int64(2*n + 1)
+	mc.ExcludedFromDupAnalysis = int64(n + 2)
+	mc.MalformedTemplateReads = int64(n)
+	mc.MateMismatchReads = int64(2 * n)
+	mc.MissingQualityReads = int64(n + 1)
+	mc.UMIMissingReads = int64(n)
+	mc.UMIRescuedPairs = int64(n + 2)
+	mc.UMIRescuedUnpaired = 1
+	mc.DuplexFamilies = int64(n)
+	mc.SingleStrandFamilies = int64(n + 1)
+	mc.SingletonFamilies = 1
+	mc.UMIFamily(fmt.Sprintf("lib%d", n%2)).add(n+1, 0)
+	mc.UMIFamily("lib0").add(2000, 0)
+	mc.UMIReads[fmt.Sprintf("AC%d", n)] = int64(n)
+	mc.UMIReads["ACGT"] = 1
+	mc.UMICorrectedReads = int64(n)
+	mc.UMIAllowlistExact = int64(10 * n)
+	mc.UMIAllowlistCorrected = int64(n)
+	mc.UMIAllowlistAmbiguous = 1
+	mc.UMIAllowlistUnmatched = int64(n + 1)
+	mc.CellBarcodeMissingReads = int64(n + 3)
+	mc.Cell(fmt.Sprintf("CELL%d", n%2)).ReadsExamined = int64(10 * n)
+	mc.Cell("CELL0").Duplicates = int64(n)
+	mc.AddDuplicateSetSize(n, 0)
+	mc.AddDuplicateSetSize(2000, 0)
+	mc.InsertSizes = make([]InsertSizeCounts, n+1)
+	mc.InsertSizes[n] = InsertSizeCounts{int64(n), 1, int64(2 * n)}
+	mc.TransInsertSizes = InsertSizeCounts{1, 0, int64(n)}
+	mc.UnpairedInsertSizes = InsertSizeCounts{int64(n), 0, 1}
+	mc.Shard(n).WithinShardPairs = int64(n)
+	mc.Shard(0).DistantMatePairs = int64(n + 1)
+	mc.DistantMateDistances = make([]int64, n+1)
+	mc.DistantMateDistances[n] = int64(n)
+	mc.DistantMateTransPairs = 1
+	mc.Tile(TileKey{"1", 1, 1, fmt.Sprintf("11%02d", n)}).DuplicatePairs = int64(n)
+	mc.Tile(TileKey{"1", 1, 1, "1101"}).OpticalPairs = int64(n)
+	for _, m := range []*Metrics{mc.Get(fmt.Sprintf("lib%d", n%2)), mc.ReadGroup(fmt.Sprintf("rg%d", n)),
+		mc.Region("lib0")} {
+		m.UnpairedReads = 10 * n
+		m.ReadPairsExamined = 100 * n
+		m.SecondarySupplementary = n
+		m.UnmappedReads = n
+		m.UnpairedDups = n
+		m.ReadPairDups = 20 * n
+		m.ReadPairOpticalDups = 2 * n
+		m.ReadPairLibraryDups = 18 * n
+	}
+	mc.AddHighCovInterval(coverageInterval{refId: n, start: 10 * n, end: 20 * n, meanCoverage: float64(n)})
+	return mc
+}
+
+func TestMetricsCollectionEncoding(t *testing.T) {
+	for _, mc := range []*MetricsCollection{NewMetricsCollection(), newTestMetricsCollection(3)} {
+		var buf bytes.Buffer
+		assert.NoError(t, EncodeMetricsCollection(&buf, mc))
+		decoded, err := DecodeMetricsCollection(&buf)
+		assert.NoError(t, err)
+		assert.Equal(t, mc, decoded)
+
+		// A decoded MetricsCollection can be merged into.
+		decoded.Merge(newTestMetricsCollection(1))
+	}
+
+	_, err := DecodeMetricsCollection(bytes.NewReader([]byte("not metrics")))
+	assert.Error(t, err)
+}
+
+func TestMetricsCollectionMerge(t *testing.T) {
+	// (a + b) + c
+	left := newTestMetricsCollection(1)
+	left.Merge(newTestMetricsCollection(2))
+	left.Merge(newTestMetricsCollection(3))
+
+	// a + (b + c)
+	bc := newTestMetricsCollection(2)
+	bc.Merge(newTestMetricsCollection(3))
+	right := newTestMetricsCollection(1)
+	right.Merge(bc)
+	assert.Equal(t, left, right)
+
+	// Merging into an empty collection copies the metrics.
+	empty := NewMetricsCollection()
+	empty.Merge(newTestMetricsCollection(1))
+	assert.Equal(t, newTestMetricsCollection(1), empty)
+
+	assert.Equal(t, 30, left.maxAlignDist)
+	assert.Equal(t, 103, left.maxX)
+	assert.Equal(t, 199, left.maxY)
+	assert.Equal(t, []int64{0, 1, 1, 1, 0}, left.OpticalDistance[0][:5])
+	assert.Equal(t, int64(1), left.OpticalDistance[2][300])
+	assert.Equal(t, int64(6), left.OpticalDistanceOverflow[3])
+	assert.Equal(t, map[string]int64{"rg0": 2, "rg1": 4}, left.UnparseableNamesByReadGroup)
+	assert.Equal(t, []int64{0, 1, 1, 1}, left.DuplicateSetSizes)
+	assert.Equal(t, int64(3), left.DuplicateSetSizeOverflow)
+	assert.Equal(t, []InsertSizeCounts{{}, {1, 1, 2}, {2, 1, 4}, {3, 1, 6}}, left.InsertSizes)
+	assert.Equal(t, InsertSizeCounts{3, 0, 6}, left.TransInsertSizes)
+	assert.Equal(t, &ShardMetrics{DistantMatePairs: 9}, left.ShardMetrics[0])
+	assert.Equal(t, &ShardMetrics{WithinShardPairs: 2}, left.ShardMetrics[2])
+	assert.Equal(t, []int64{0, 1, 2, 3}, left.DistantMateDistances)
+	assert.Equal(t, int64(3), left.DistantMateTransPairs)
+	assert.Equal(t, int64(12), left.MateMismatchReads)
+	assert.Equal(t, int64(9), left.MissingQualityReads)
+	assert.Equal(t, int64(6), left.CappedDuplicateSets)
+	assert.Equal(t, int64(600), left.CappedDuplicatePairs)
+	assert.Equal(t, &TileMetrics{OpticalPairs: 6, DuplicatePairs: 1}, left.TileMetrics[TileKey{"1", 1, 1, "1101"}])
+	assert.Equal(t, 3, len(left.HighCoverageIntervals))
+	assert.Equal(t, 3, len(left.ReadGroupMetrics))
+
+	// Derived metrics are computed from the merged counters, not
+	// summed. lib1 has the metrics of collections 1 and 3.
+	lib1 := left.Get("lib1")
+	assert.Equal(t, 40, lib1.UnpairedReads)
+	assert.Equal(t, 400, lib1.ReadPairsExamined)
+	expected := Metrics{
+		UnpairedReads:          40,
+		ReadPairsExamined:      400,
+		SecondarySupplementary: 4,
+		UnmappedReads:          4,
+		UnpairedDups:           4,
+		ReadPairDups:           80,
+		ReadPairOpticalDups:    8,
+		ReadPairLibraryDups:    72,
+	}
+	assert.Equal(t, expected.String(), lib1.String())
+	assert.Equal(t, 60, left.Region("lib0").UnpairedReads)
+}
+
+// Test that workers that accumulate into private collections and
+// merge them into a shared one concurrently give the same metrics as
+// a serial merge. Run with -race to check that the per-read counters
+// are not shared.
+func TestMetricsCollectionConcurrentMerge(t *testing.T) {
+	const nWorkers = 32
+	hammer := func(mc *MetricsCollection, n int) {
+		for i := 0; i < 1000; i++ {
+			mc.AddDistance(i%10, i%(n+1))
+			mc.AddDistanceOverflow(i%10, 1)
+			mc.AddDuplicateSetSize(i%(n+2), 0)
+			mc.Tile(TileKey{"1", 1, 1, fmt.Sprintf("11%02d", i%5)}).DuplicatePairs++
+			mc.Get(fmt.Sprintf("lib%d", i%3)).ReadPairsExamined++
+			mc.Shard(i%4).WithinShardPairs++
+			mc.NoLocationPairs++
+		}
+	}
+
+	shared := NewMetricsCollection()
+	wg := sync.WaitGroup{}
+	for n := 0; n < nWorkers; n++ {
+		wg.Add(1)
+		go func(n int) {
+			defer wg.Done()
+			mc := newTestMetricsCollection(n)
+			hammer(mc, n)
+			shared.Merge(mc)
+			shared.AddHighCovInterval(coverageInterval{refId: n})
+		}(n)
+	}
+	wg.Wait()
+
+	expected := NewMetricsCollection()
+	for n := 0; n < nWorkers; n++ {
+		mc := newTestMetricsCollection(n)
+		hammer(mc, n)
+		expected.Merge(mc)
+		expected.AddHighCovInterval(coverageInterval{refId: n})
+	}
+
+	// HighCoverageIntervals are appended in the order of the merges.
+	assert.ElementsMatch(t, expected.HighCoverageIntervals, shared.HighCoverageIntervals)
+	expected.HighCoverageIntervals = nil
+	shared.HighCoverageIntervals = nil
+	assert.Equal(t, expected, shared)
+	assert.Equal(t, int64(nWorkers*(nWorkers-1)/2+nWorkers*1000), shared.NoLocationPairs)
+}
@@ -0,0 +1,383 @@
+// Copyright 2019 Grail Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package markduplicates
+
+import (
+	"context"
+	"encoding/json"
+	"sort"
+
+	"github.com/Schaudge/grailbase/errors"
+)
+
+// Version is the doppelmark version reported in the JSON metrics. It
+// can be set at build time with
+//
+//	-ldflags "-X github.com/Schaudge/doppelmark/markduplicates.Version=..."
+var Version = "dev"
+
+// metricsSchemaVersion is the version of the JSON metrics document.
+// It must be incremented whenever a field is renamed or removed.
+const metricsSchemaVersion = 1
+
+// jsonMetricsDocument is the JSON metrics document. Field names are
+// part of the schema and must not change without incrementing
+// metricsSchemaVersion.
+type jsonMetricsDocument struct {
+	SchemaVersion    int                   `json:"schema_version"`
+	Version          string                `json:"doppelmark_version"`
+	Opts             *Opts                 `json:"opts"`
+	Global           jsonGlobalMetrics     `json:"global"`
+	Libraries        []jsonMetricsRow      `json:"libraries"`
+	ReadGroups       []jsonMetricsRow      `json:"read_groups"`
+	Regions          []jsonMetricsRow      `json:"region_libraries"`
+	References       []jsonRefMetrics      `json:"references,omitempty"`
+	Cells            []jsonCellMetrics     `json:"cells,omitempty"`
+	Tiles            []jsonTileMetrics     `json:"tiles"`
+	OpticalHistogram []opticalHistogramRow `json:"optical_histogram"`
+
+	DuplicateSetSizes        []jsonDuplicateSetSize `json:"duplicate_set_sizes"`
+	DuplicateSetSizeOverflow int64                  `json:"duplicate_set_size_overflow"`
+	InsertSizes              []insertSizeRow        `json:"insert_sizes"`
+	GCContent                []gcContentRow         `json:"gc_content,omitempty"`
+	Flagstat                 *jsonFlagstat          `json:"flagstat,omitempty"`
+	UMIFamilySizes           []jsonUMIFamilySizes   `json:"umi_family_sizes,omitempty"`
+	Sharding                 jsonSharding           `json:"sharding"`
+}
+
+// jsonUMIFamilySizes is the UMI family size histogram of a library,
+// or of all libraries, with its non-empty bins.
+type jsonUMIFamilySizes struct {
+	Library  string                 `json:"library"`
+	Sizes    []jsonDuplicateSetSize `json:"sizes"`
+	Overflow int64                  `json:"overflow"`
+	Mean     float64                `json:"mean"`
+	Median   string                 `json:"median"`
+}
+
+// jsonDuplicateSetSize is a non-empty bin of the duplicate set size
+// histogram.
+type jsonDuplicateSetSize struct {
+	Size  int   `json:"size"`
+	Count int64 `json:"count"`
+}
+
+type jsonGlobalMetrics struct {
+	MaxAlignDist                int              `json:"max_alignment_distance"`
+	OpticalNamesExamined        int64            `json:"optical_names_examined"`
+	UnparseableNames            int64            `json:"unparseable_names"`
+	UnparseableNamesByReadGroup map[string]int64 `json:"unparseable_names_by_read_group"`
+	OpticalPixelDistances       map[string]int   `json:"optical_pixel_distance_by_read_group,omitempty"`
+	NoLocationPairs             int64            `json:"no_location_pairs"`
+	CrossTilePairsSkipped       int64            `json:"cross_tile_pairs_skipped"`
+	CappedDuplicateSets         int64            `json:"capped_duplicate_sets"`
+	CappedDuplicatePairs        int64            `json:"capped_duplicate_set_read_pairs"`
+
+	SecondaryReads                int64 `json:"secondary_reads"`
+	SupplementaryReads            int64 `json:"supplementary_reads"`
+	SecondarySupplementaryDups    int64 `json:"secondary_or_supplementary_duplicates"`
+	SecondarySupplementarySkipped int64 `json:"secondary_or_supplementary_skipped"`
+	ExcludedFromDupAnalysis       int64 `json:"excluded_from_dup_analysis"`
+	MalformedTemplateReads        int64 `json:"malformed_template_reads"`
+	MateMismatchReads             int64 `json:"mate_mismatch_reads"`
+	MissingQualityReads           int64 `json:"missing_quality_reads"`
+	ProtectedDuplicates           int64 `json:"protected_duplicates"`
+	FilteredReads                 int64 `json:"filtered_reads"`
+
+	TransPairsExamined  int64 `json:"trans_read_pairs_examined"`
+	TransPairDuplicates int64 `json:"trans_read_pair_duplicates"`
+
+	UMIMissingReads    int64 `json:"umi_missing_reads"`
+	UMIRescuedPairs    int64 `json:"umi_rescued_read_pair_sets"`
+	UMIRescuedUnpaired int64 `json:"umi_rescued_unpaired_sets"`
+
+	DuplexFamilies       int64 `json:"duplex_families"`
+	SingleStrandFamilies int64 `json:"single_strand_families"`
+	SingletonFamilies    int64 `json:"singleton_families"`
+
+	UMIFamilies          int64   `json:"umi_families"`
+	UMIFamilySizeMean    float64 `json:"umi_family_size_mean"`
+	UMIFamilySizeMedian  string  `json:"umi_family_size_median"`
+	DistinctUMIs         int     `json:"distinct_umis"`
+	UMICorrectedReads    int64   `json:"umi_corrected_reads"`
+	UMICorrectedFraction float64 `json:"umi_corrected_fraction"`
+
+	UMIAllowlistExact     int64 `json:"umi_allowlist_exact_reads"`
+	UMIAllowlistCorrected int64 `json:"umi_allowlist_corrected_reads"`
+	UMIAllowlistAmbiguous int64 `json:"umi_allowlist_ambiguous_reads"`
+	UMIAllowlistUnmatched int64 `json:"umi_allowlist_unmatched_reads"`
+
+	CellBarcodeMissingReads int64 `json:"cell_barcode_missing_reads"`
+}
+
+// jsonMetricsRow holds the Metrics of a library or read group, with
+// the same values as the text metrics file. EstimatedLibrarySize is
+// null if the library size cannot be estimated.
+type jsonMetricsRow struct {
+	Name                      string  `json:"name"`
+	UnpairedReadsExamined     int     `json:"unpaired_reads_examined"`
+	ReadPairsExamined         int     `json:"read_pairs_examined"`
+	SecondaryOrSupplementary  int     `json:"secondary_or_supplementary_reads"`
+	UnmappedReads             int     `json:"unmapped_reads"`
+	UnpairedReadDuplicates    int     `json:"unpaired_read_duplicates"`
+	ReadPairDuplicates        int     `json:"read_pair_duplicates"`
+	ReadPairOpticalDuplicates int     `json:"read_pair_optical_duplicates"`
+	ReadPairLibraryDuplicates int     `json:"read_pair_library_duplicates"`
+	PercentDuplication        float64 `json:"percent_duplication"`
+	EstimatedLibrarySize      *uint64 `json:"estimated_library_size"`
+}
+
+type jsonRefMetrics struct {
+	Name              string  `json:"name"`
+	ReadsExamined     int64   `json:"reads_examined"`
+	Duplicates        int64   `json:"duplicates"`
+	OpticalDuplicates int64   `json:"optical_duplicates"`
+	Rate              float64 `json:"rate"`
+}
+
+type jsonCellMetrics struct {
+	Barcode       string  `json:"barcode"`
+	ReadsExamined int64   `json:"reads_examined"`
+	Duplicates    int64   `json:"duplicates"`
+	Rate          float64 `json:"rate"`
+}
+
+// jsonSharding is the sharding section of the JSON metrics, see
+// shardingString.
+type jsonSharding struct {
+	Shards                []jsonShardMetrics        `json:"shards"`
+	WithinShardPairs      int64                     `json:"within_shard_pairs"`
+	DistantMatePairs      int64                     `json:"distant_mate_pairs"`
+	DistantMateDistances  []jsonDistantMateDistance `json:"distant_mate_distances"`
+	DistantMateTransPairs int64                     `json:"distant_mate_trans_pairs"`
+}
+
+type jsonShardMetrics struct {
+	Shard            int   `json:"shard"`
+	WithinShardPairs int64 `json:"within_shard_pairs"`
+	DistantMatePairs int64 `json:"distant_mate_pairs"`
+}
+
+type jsonDistantMateDistance struct {
+	Distance string `json:"distance"`
+	Pairs    int64  `json:"pairs"`
+}
+
+type jsonTileMetrics struct {
+	Lane           string  `json:"lane"`
+	Surface        int     `json:"surface"`
+	Swath          int     `json:"swath"`
+	Tile           string  `json:"tile"`
+	DuplicatePairs int64   `json:"duplicate_pairs"`
+	OpticalPairs   int64   `json:"optical_pairs"`
+	Rate           float64 `json:"rate"`
+}
+
+// jsonRow returns m as a jsonMetricsRow. Like String, the read pair
+// counts are halved.
+func (m *Metrics) jsonRow(name string) jsonMetricsRow {
+	row := jsonMetricsRow{
+		Name:                      name,
+		UnpairedReadsExamined:     m.UnpairedReads,
+		ReadPairsExamined:         m.ReadPairsExamined / 2,
+		SecondaryOrSupplementary:  m.SecondarySupplementary,
+		UnmappedReads:             m.UnmappedReads,
+		UnpairedReadDuplicates:    m.UnpairedDups,
+		ReadPairDuplicates:        m.ReadPairDups / 2,
+		ReadPairOpticalDuplicates: m.ReadPairOpticalDups / 2,
+		ReadPairLibraryDuplicates: m.ReadPairLibraryDups / 2,
+	}
+	if examined := m.UnpairedReads + m.ReadPairsExamined; examined > 0 {
+		row.PercentDuplication = 100 * float64(m.UnpairedDups+m.ReadPairDups) / float64(examined)
+	}
+	if librarySize, ok := m.EstimatedLibrarySize(); ok {
+		row.EstimatedLibrarySize = &librarySize
+	}
+	return row
+}
+
+// jsonRows returns the metrics in byName as jsonMetricsRows sorted by
+// name.
+func jsonRows(byName map[string]*Metrics) []jsonMetricsRow {
+	names := make([]string, 0, len(byName))
+	for name := range byName {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	rows := make([]jsonMetricsRow, 0, len(names))
+	for _, name := range names {
+		rows = append(rows, byName[name].jsonRow(name))
+	}
+	return rows
+}
+
+// newJSONMetricsDocument returns the JSON metrics document for
+// globalMetrics.
+func newJSONMetricsDocument(opts *Opts, globalMetrics *MetricsCollection) *jsonMetricsDocument {
+	doc := &jsonMetricsDocument{
+		SchemaVersion: metricsSchemaVersion,
+		Version:       Version,
+		Opts:          opts,
+		Global: jsonGlobalMetrics{
+			MaxAlignDist:                globalMetrics.maxAlignDist,
+			OpticalNamesExamined:        globalMetrics.OpticalNamesExamined,
+			UnparseableNames:            globalMetrics.UnparseableNames,
+			UnparseableNamesByReadGroup: globalMetrics.UnparseableNamesByReadGroup,
+			OpticalPixelDistances:       globalMetrics.OpticalPixelDistances,
+			NoLocationPairs:             globalMetrics.NoLocationPairs,
+			CrossTilePairsSkipped:       globalMetrics.CrossTilePairsSkipped,
+			CappedDuplicateSets:         globalMetrics.CappedDuplicateSets,
+			CappedDuplicatePairs:        globalMetrics.CappedDuplicatePairs,
+
+			SecondaryReads:                globalMetrics.SecondaryReads,
+			SupplementaryReads:            globalMetrics.SupplementaryReads,
+			SecondarySupplementaryDups:    globalMetrics.SecondarySupplementaryDups,
+			SecondarySupplementarySkipped: globalMetrics.SecondarySupplementarySkipped,
+			ExcludedFromDupAnalysis:       globalMetrics.ExcludedFromDupAnalysis,
+			MalformedTemplateReads:        globalMetrics.MalformedTemplateReads,
+			MateMismatchReads:             globalMetrics.MateMismatchReads,
+			MissingQualityReads:           globalMetrics.MissingQualityReads,
+			ProtectedDuplicates:           globalMetrics.ProtectedDuplicates,
+			FilteredReads:                 globalMetrics.FilteredReads,
+			TransPairsExamined:            globalMetrics.TransInsertSizes.total(),
+			TransPairDuplicates:           globalMetrics.TransInsertSizes.Duplicates,
+			UMIMissingReads:               globalMetrics.UMIMissingReads,
+			UMIRescuedPairs:               globalMetrics.UMIRescuedPairs,
+			UMIRescuedUnpaired:            globalMetrics.UMIRescuedUnpaired,
+			DuplexFamilies:                globalMetrics.DuplexFamilies,
+			SingleStrandFamilies:          globalMetrics.SingleStrandFamilies,
+			SingletonFamilies:             globalMetrics.SingletonFamilies,
+			CellBarcodeMissingReads:       globalMetrics.CellBarcodeMissingReads,
+		},
+		Libraries:        jsonRows(globalMetrics.LibraryMetrics),
+		ReadGroups:       jsonRows(globalMetrics.ReadGroupMetrics),
+		Regions:          jsonRows(globalMetrics.RegionMetrics),
+		Tiles:            []jsonTileMetrics{},
+		OpticalHistogram: opticalHistogramRows(opts, globalMetrics),
+
+		DuplicateSetSizes:        []jsonDuplicateSetSize{},
+		DuplicateSetSizeOverflow: globalMetrics.DuplicateSetSizeOverflow,
+		InsertSizes:              insertSizeRows(opts, globalMetrics),
+	}
+	for size, count := range globalMetrics.DuplicateSetSizes {
+		if count > 0 {
+			doc.DuplicateSetSizes = append(doc.DuplicateSetSizes, jsonDuplicateSetSize{size, count})
+		}
+	}
+	if opts.umiGrouping() {
+		total := globalMetrics.TotalUMIFamilySizes()
+		doc.Global.UMIFamilies = total.Families()
+		doc.Global.UMIFamilySizeMean = total.Mean()
+		doc.Global.UMIFamilySizeMedian = medianString(opts, &total)
+		doc.Global.DistinctUMIs = len(globalMetrics.UMIReads)
+		doc.Global.UMICorrectedReads = globalMetrics.UMICorrectedReads
+		doc.Global.UMICorrectedFraction = globalMetrics.UMICorrectedFraction()
+		doc.Global.UMIAllowlistExact = globalMetrics.UMIAllowlistExact
+		doc.Global.UMIAllowlistCorrected = globalMetrics.UMIAllowlistCorrected
+		doc.Global.UMIAllowlistAmbiguous = globalMetrics.UMIAllowlistAmbiguous
+		doc.Global.UMIAllowlistUnmatched = globalMetrics.UMIAllowlistUnmatched
+		addFamilySizes := func(library string, h *UMIFamilySizes) {
+			row := jsonUMIFamilySizes{library, []jsonDuplicateSetSize{}, h.Overflow, h.Mean(), medianString(opts, h)}
+			for size, count := range h.Sizes {
+				if count > 0 {
+					row.Sizes = append(row.Sizes, jsonDuplicateSetSize{size, count})
+				}
+			}
+			doc.UMIFamilySizes = append(doc.UMIFamilySizes, row)
+		}
+		addFamilySizes("ALL", &total)
+		for _, library := range sortedUMIFamilyLibraries(globalMetrics.UMIFamilySizes) {
+			addFamilySizes(library, globalMetrics.UMIFamilySizes[library])
+		}
+	}
+	total := globalMetrics.TotalShardMetrics()
+	doc.Sharding = jsonSharding{
+		Shards:                []jsonShardMetrics{},
+		WithinShardPairs:      total.WithinShardPairs,
+		DistantMatePairs:      total.DistantMatePairs,
+		DistantMateDistances:  []jsonDistantMateDistance{},
+		DistantMateTransPairs: globalMetrics.DistantMateTransPairs,
+	}
+	for _, shardIdx := range sortedShardIndexes(globalMetrics.ShardMetrics) {
+		m := globalMetrics.ShardMetrics[shardIdx]
+		doc.Sharding.Shards = append(doc.Sharding.Shards,
+			jsonShardMetrics{shardIdx, m.WithinShardPairs, m.DistantMatePairs})
+	}
+	for bin, count := range globalMetrics.DistantMateDistances {
+		if count > 0 {
+			doc.Sharding.DistantMateDistances = append(doc.Sharding.DistantMateDistances,
+				jsonDistantMateDistance{distanceDecadeName(bin), count})
+		}
+	}
+	if opts.GCMetrics {
+		doc.GCContent = gcContentRows(globalMetrics)
+	}
+	if opts.Flagstat {
+		doc.Flagstat = &jsonFlagstat{globalMetrics.InputFlagstat, globalMetrics.OutputFlagstat,
+			globalMetrics.RemovedFlagstat}
+	}
+	if opts.PerReferenceMetrics {
+		names := make([]string, 0, len(globalMetrics.ReferenceMetrics))
+		for name := range globalMetrics.ReferenceMetrics {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			m := globalMetrics.ReferenceMetrics[name]
+			doc.References = append(doc.References, jsonRefMetrics{name, m.ReadsExamined, m.Duplicates, m.OpticalDuplicates,
+				m.Rate()})
+		}
+	}
+	if opts.CellMetricsMax > 0 {
+		for _, barcode := range sortedCells(globalMetrics.CellMetrics) {
+			m := globalMetrics.CellMetrics[barcode]
+			doc.Cells = append(doc.Cells, jsonCellMetrics{barcode, m.ReadsExamined, m.Duplicates, m.Rate()})
+		}
+	}
+	for _, key := range sortedTileKeys(globalMetrics.TileMetrics) {
+		m := globalMetrics.TileMetrics[key]
+		doc.Tiles = append(doc.Tiles, jsonTileMetrics{
+			Lane:           key.Lane,
+			Surface:        key.Surface,
+			Swath:          key.Swath,
+			Tile:           key.TileName,
+			DuplicatePairs: m.DuplicatePairs,
+			OpticalPairs:   m.OpticalPairs,
+			Rate:           m.Rate(),
+		})
+	}
+	return doc
+}
+
+// writeJSONMetrics writes globalMetrics to opts.MetricsFile as a
+// single JSON document.
+func writeJSONMetrics(ctx context.Context, opts *Opts, globalMetrics *MetricsCollection) (err error) {
+	var f *outputFile
+	f, err = createOutput(ctx, opts.MetricsFile)
+	if err != nil {
+		return errors.E(err, "Couldn't create metrics file:", opts.MetricsFile)
+	}
+	defer func() {
+		if err2 := f.Close(ctx); err == nil && err2 != nil {
+			err = err2
+		}
+	}()
+
+	enc := json.NewEncoder(f)
+	enc.SetIndent("", "  ")
+	if err = enc.Encode(newJSONMetricsDocument(opts, globalMetrics)); err != nil {
+		return errors.E(err, "error writing to metrics file:", opts.MetricsFile)
+	}
+	return nil
+}
@@ -0,0 +1,117 @@
+// Copyright 2019 Grail Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package markduplicates
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/grailbio/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWriteJSONMetrics(t *testing.T) {
+	tempDir, cleanup := testutil.TempDir(t, "", "")
+	defer cleanup()
+
+	metrics := NewMetricsCollection()
+	metrics.maxAlignDist = 7
+	*metrics.Get("lib1") = Metrics{ReadPairsExamined: 2000000, ReadPairDups: 400000}
+	*metrics.ReadGroup("rg1") = Metrics{ReadPairsExamined: 2000000, ReadPairDups: 400000}
+	*metrics.ReadGroup(NoReadGroup) = Metrics{UnpairedReads: 3}
+	*metrics.Tile(TileKey{"1", 1, 1, "1101"}) = TileMetrics{DuplicatePairs: 4, OpticalPairs: 1}
+	metrics.AddDistance(2, 5)
+	metrics.AddDuplicateSetSize(2, 0)
+	metrics.AddDuplicateSetSize(2000, 0)
+	*metrics.Shard(1) = ShardMetrics{WithinShardPairs: 5, DistantMatePairs: 2}
+	metrics.DistantMateDistances = []int64{0, 0, 2}
+
+	opts := Opts{
+		BamFile:          "input.bam",
+		MetricsFile:      filepath.Join(tempDir, "metrics.json"),
+		MetricsFormat:    "json",
+		OpticalHistogram: "histogram.txt",
+		OpticalDetector:  &TileOpticalDetector{OpticalDistance: 100},
+	}
+	assert.NoError(t, WriteMetrics(context.Background(), &opts, metrics))
+
+	f, err := os.Open(opts.MetricsFile)
+	assert.NoError(t, err)
+	defer f.Close() // nolint: errcheck
+	dec := json.NewDecoder(f)
+	dec.UseNumber()
+	var doc map[string]interface{}
+	assert.NoError(t, dec.Decode(&doc))
+
+	assert.Equal(t, json.Number("1"), doc["schema_version"])
+	assert.Equal(t, "dev", doc["doppelmark_version"])
+	docOpts := doc["opts"].(map[string]interface{})
+	assert.Equal(t, "input.bam", docOpts["BamFile"])
+	assert.NotContains(t, docOpts, "OpticalDetector")
+	assert.Equal(t, json.Number("7"), doc["global"].(map[string]interface{})["max_alignment_distance"])
+
+	libraries := doc["libraries"].([]interface{})
+	assert.Equal(t, 1, len(libraries))
+	lib1 := libraries[0].(map[string]interface{})
+	assert.Equal(t, "lib1", lib1["name"])
+	assert.Equal(t, json.Number("1000000"), lib1["read_pairs_examined"])
+	assert.Equal(t, json.Number("200000"), lib1["read_pair_duplicates"])
+	assert.Equal(t, json.Number("2154184"), lib1["estimated_library_size"])
+
+	readGroups := doc["read_groups"].([]interface{})
+	assert.Equal(t, 2, len(readGroups))
+	noReadGroup := readGroups[0].(map[string]interface{})
+	assert.Equal(t, NoReadGroup, noReadGroup["name"])
+	assert.Equal(t, json.Number("3"), noReadGroup["unpaired_reads_examined"])
+	assert.Nil(t, noReadGroup["estimated_library_size"])
+	assert.Equal(t, "rg1", readGroups[1].(map[string]interface{})["name"])
+
+	assert.Equal(t, []interface{}{map[string]interface{}{
+		"lane":            "1",
+		"surface":         json.Number("1"),
+		"swath":           json.Number("1"),
+		"tile":            "1101",
+		"duplicate_pairs": json.Number("4"),
+		"optical_pairs":   json.Number("1"),
+		"rate":            json.Number("0.25"),
+	}}, doc["tiles"])
+	assert.Equal(t, []interface{}{map[string]interface{}{
+		"bin_lower":                 json.Number("5"),
+		"bin_upper":                 json.Number("6"),
+		"count":                     json.Number("1"),
+		"duplicate_set_size_bucket": "bagsize-2",
+	}}, doc["optical_histogram"])
+	assert.Equal(t, []interface{}{map[string]interface{}{
+		"size":  json.Number("2"),
+		"count": json.Number("1"),
+	}}, doc["duplicate_set_sizes"])
+	assert.Equal(t, json.Number("1"), doc["duplicate_set_size_overflow"])
+	assert.Equal(t, map[string]interface{}{
+		"shards": []interface{}{map[string]interface{}{
+			"shard":              json.Number("1"),
+			"within_shard_pairs": json.Number("5"),
+			"distant_mate_pairs": json.Number("2"),
+		}},
+		"within_shard_pairs": json.Number("5"),
+		"distant_mate_pairs": json.Number("2"),
+		"distant_mate_distances": []interface{}{map[string]interface{}{
+			"distance": "100-999",
+			"pairs":    json.Number("2"),
+		}},
+		"distant_mate_trans_pairs": json.Number("0"),
+	}, doc["sharding"])
+}
@@ -0,0 +1,135 @@
+// Copyright 2019 Grail Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package markduplicates
+
+import (
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+
+	"github.com/Schaudge/hts/sam"
+	"github.com/grailbio/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+// metricsOnlyRecords returns the records of a mix of duplicate
+// readpairs, optical duplicates, distant mates, secondary records, and
+// unmapped readpairs, in queryname grouped and coordinate sorted order.
+func metricsOnlyRecords() (queryname, coordinate []*sam.Record) {
+	rnd := rand.New(rand.NewSource(1))
+	for i := 0; i < 500; i++ {
+		// Few positions and flowcell locations make duplicates and
+		// optical duplicates.
+		name := fmt.Sprintf("T%d:::1:%d:%d:%d", i, 10+rnd.Intn(2), rnd.Intn(50), rnd.Intn(50))
+		pos := rnd.Intn(20) * 40
+		switch rnd.Intn(10) {
+		case 0:
+			queryname = append(queryname,
+				NewRecord(name, nil, -1, up1, -1, nil, nil),
+				NewRecord(name, nil, -1, up2, -1, nil, nil))
+		case 1, 2:
+			matePos := rnd.Intn(10) * 100
+			queryname = append(queryname,
+				NewRecord(name, chr1, pos, r1F, matePos, chr2, cigar0),
+				NewRecord(name, chr2, matePos, r2R, pos, chr1, cigar0))
+		case 3:
+			queryname = append(queryname,
+				NewRecord(name, chr1, pos, r1F, pos+50, chr1, cigar0),
+				NewRecord(name, chr1, pos+50, r2R, pos, chr1, cigar0),
+				NewRecord(name, chr2, pos, sec, pos+50, chr1, cigar0))
+		default:
+			queryname = append(queryname,
+				NewRecord(name, chr1, pos, r1F, pos+50, chr1, cigar0),
+				NewRecord(name, chr1, pos+50, r2R, pos, chr1, cigar0))
+		}
+	}
+	coordinate = make([]*sam.Record, len(queryname))
+	copy(coordinate, queryname)
+	sort.SliceStable(coordinate, func(i, j int) bool {
+		a, b := coordinate[i], coordinate[j]
+		if (a.Ref == nil) != (b.Ref == nil) {
+			return b.Ref == nil
+		}
+		if a.Ref != nil && a.Ref.ID() != b.Ref.ID() {
+			return a.Ref.ID() < b.Ref.ID()
+		}
+		return a.Pos < b.Pos
+	})
+	return queryname, coordinate
+}
+
+func TestMetricsOnly(t *testing.T) {
+	tests := []struct {
+		name   string
+		hd     string
+		format string
+	}{
+		{"coordinate bam", "", "bam"},
+		{"coordinate pam", "", "pam"},
+		{"queryname", "@HD\tVN:1.6\tSO:queryname\n", "bam"},
+	}
+
+	tempDir, cleanup := testutil.TempDir(t, "", "")
+	defer cleanup()
+	testIdx := 0
+	for _, test := range tests {
+		var metrics [2]*MetricsCollection
+		for i, metricsOnly := range []bool{false, true} {
+			queryname, coordinate := metricsOnlyRecords()
+			h, records := header, coordinate
+			if test.hd != "" {
+				h, records = newTestHeader(t, test.hd), queryname
+			}
+			opts := defaultOpts
+			opts.OutputPath = NewTestOutput(tempDir, testIdx, test.format)
+			opts.Format = test.format
+			opts.FlagSecondaryDups = true
+			opts.OpticalDetector = nil
+			opts.OpticalDuplicatePixelDistance = 100
+			opts.OpticalHistogram = filepath.Join(tempDir, "histogram.txt")
+			opts.MetricsOnly = metricsOnly
+			testIdx++
+			markDuplicates := &MarkDuplicates{
+				Provider: newTestProvider(t, h, records),
+				Opts:     &opts,
+			}
+			var err error
+			metrics[i], err = markDuplicates.Mark(nil)
+			assert.NoError(t, err, "test %s metrics-only %v", test.name, metricsOnly)
+			_, err = os.Stat(opts.OutputPath)
+			assert.Equal(t, metricsOnly, os.IsNotExist(err), "test %s metrics-only %v", test.name, metricsOnly)
+		}
+		if assert.NotNil(t, metrics[0], "test %s", test.name) {
+			assert.True(t, metrics[0].SecondarySupplementaryDups > 0, "test %s", test.name)
+		}
+		assert.Equal(t, metrics[0], metrics[1], "test %s", test.name)
+	}
+
+	opts := defaultOpts
+	opts.BamFile = "in.bam"
+	opts.MinBases = 1
+	opts.Format = "bam"
+	opts.ScavengeUmis = -1
+	opts.MetricsOnly = true
+	assert.NoError(t, validate(&opts))
+	opts.OutputPath = "out.bam"
+	assert.Error(t, validate(&opts))
+	opts.OutputPath = ""
+	opts.RemoveDups = true
+	opts.DuplicatesOutput = "dups.bam"
+	assert.Error(t, validate(&opts))
+}
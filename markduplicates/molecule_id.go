@@ -0,0 +1,92 @@
+// Copyright 2019 Grail Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package markduplicates
+
+import (
+	"fmt"
+
+	"github.com/Schaudge/grailbase/errors"
+	"github.com/Schaudge/grailbio/encoding/bam"
+	"github.com/Schaudge/hts/sam"
+)
+
+// Molecule IDs
+//
+// With Opts.EmitMITag, every template of a duplicate set is assigned
+// the same molecule ID, which is written as an MI tag to all records
+// of the template, including its secondary, supplementary and
+// unmapped records. The molecule ID of a set is the file index of the
+// left read of its primary readpair, like the DI tag, or the file
+// index of its primary read if the set has only mate-unmapped reads.
+// File indexes are global, so the IDs are unique and the same in
+// every run with the same input and options, regardless of sharding.
+//
+// With Opts.DuplexMITag, the MI tag is a string with a strand
+// suffix, "<id>/A" or "<id>/B", like fgbio's duplex molecule IDs. With
+// Opts.DuplexUMI, the suffix is /A for templates whose R1 UMI sorts
+// before their R2 UMI, otherwise for templates whose R1 is on the
+// forward strand, see isBStrand.
+//
+// The secondary and supplementary records of a template are tagged
+// only if they are in the padded shard of its primary reads.
+
+// moleculeTag returns the MI tag of template p of the duplicate set
+// with the given molecule id.
+func moleculeTag(opts *Opts, id uint64, p *readPair) (sam.Aux, error) {
+	var tag sam.Aux
+	var err error
+	if opts.DuplexMITag {
+		suffix := "A"
+		if isBStrand(opts, p) {
+			suffix = "B"
+		}
+		tag, err = sam.NewAux(miTag, fmt.Sprintf("%d/%s", id, suffix))
+	} else {
+		tag, err = sam.NewAux(miTag, int(id))
+	}
+	if err != nil {
+		return nil, errors.E(err, fmt.Sprintf("error creating MI tag for molecule %d", id))
+	}
+	return tag, nil
+}
+
+// addMoleculeTags adds the MI tag of each template of dupSet to
+// molecules, keyed by read name.
+func addMoleculeTags(opts *Opts, molecules map[string]sam.Aux, dupSet *duplicateSet,
+	singlesByName map[string]*readPair, pairsByName map[string]*readPair) (err error) {
+	var id uint64
+	if len(dupSet.pairs) > 0 {
+		id = pairsByName[dupSet.pairs[0]].leftFileIdx
+	} else if len(dupSet.singles) > 0 {
+		id = singlesByName[dupSet.singles[0]].leftFileIdx
+	}
+	for _, qname := range dupSet.pairs {
+		if molecules[qname], err = moleculeTag(opts, id, pairsByName[qname]); err != nil {
+			return err
+		}
+	}
+	for _, qname := range dupSet.singles {
+		if molecules[qname], err = moleculeTag(opts, id, singlesByName[qname]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// setMoleculeTag replaces any MI tag of r with tag.
+func setMoleculeTag(r *sam.Record, tag sam.Aux) {
+	checkRecord(r)
+	bam.ClearAuxTags(r, []sam.Tag{miTag})
+	r.AuxFields = append(growAux(r.AuxFields, 1), tag)
+}
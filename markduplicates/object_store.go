@@ -0,0 +1,546 @@
+// Copyright 2019 Grail Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package markduplicates
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Schaudge/grailbase/errors"
+	"github.com/Schaudge/grailbase/file"
+	"github.com/Schaudge/grailbase/ioctx"
+	"github.com/Schaudge/grailbase/log"
+	"github.com/Schaudge/grailbase/retry"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/client"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+)
+
+const (
+	// defaultS3Region is the region of the requests to an S3 endpoint
+	// if the session has none, and the hint of the bucket region
+	// lookups of AWS.
+	defaultS3Region = "us-east-1"
+	// gcsRegion is the signing region of the requests to GCS.
+	gcsRegion = "auto"
+
+	// remoteMaxRetries is the most retries of a failed request to a
+	// remote file, and of a read whose response fails after it
+	// started.
+	remoteMaxRetries = 10
+)
+
+// remoteRetryer retries the failed requests to remote files, e.g. on
+// throttling, 5xx responses and connection errors, with a jittered
+// exponential backoff. The parts of the uploads are retried by it
+// too, since aws-sdk-go buffers them.
+var remoteRetryer = client.DefaultRetryer{
+	NumMaxRetries:    remoteMaxRetries,
+	MinRetryDelay:    500 * time.Millisecond,
+	MaxRetryDelay:    30 * time.Second,
+	MinThrottleDelay: time.Second,
+	MaxThrottleDelay: time.Minute,
+}
+
+// remoteReadRetryPolicy is the backoff of the retries of a read whose
+// response fails after it started, which aws-sdk-go does not retry.
+// The read is resumed with a new ranged request at its offset.
+var remoteReadRetryPolicy = retry.MaxRetries(retry.Jitter(retry.Backoff(500*time.Millisecond, 30*time.Second, 2),
+	0.2), remoteMaxRetries)
+
+// objectStore is the file.Implementation of the s3:// and gs:// URLs.
+// It sends the requests of the S3 API to endpoint, or, if endpoint is
+// empty, to the AWS region of each bucket.
+type objectStore struct {
+	scheme   string
+	endpoint string
+	// region is the signing region of the requests to endpoint, or ""
+	// for that of session.
+	region  string
+	session *session.Session
+	// err is the error of the session, which every request fails
+	// with.
+	err error
+
+	mu sync.Mutex
+	// clients are the clients of the buckets.
+	clients map[string]s3iface.S3API
+}
+
+// newObjectStore returns the objectStore of scheme, which sends its
+// requests to endpoint with the session of configs.
+func newObjectStore(scheme, endpoint, region string, configs ...*aws.Config) *objectStore {
+	s := &objectStore{
+		scheme:   scheme,
+		endpoint: endpoint,
+		region:   region,
+		clients:  map[string]s3iface.S3API{},
+	}
+	s.session, s.err = session.NewSession(configs...)
+	if s.err == nil && endpoint != "" && region == "" && aws.StringValue(s.session.Config.Region) == "" {
+		s.region = defaultS3Region
+	}
+	return s
+}
+
+// String implements file.Implementation.
+func (s *objectStore) String() string { return s.scheme }
+
+// resolve returns the bucket and the key of path, and the client of the
+// bucket.
+func (s *objectStore) resolve(ctx context.Context, path string) (bucket, key string, c s3iface.S3API, err error) {
+	if s.err != nil {
+		return "", "", nil, s.err
+	}
+	scheme, suffix, err := file.ParsePath(path)
+	if err != nil {
+		return "", "", nil, err
+	}
+	if scheme != s.scheme {
+		return "", "", nil, errors.E(errors.Invalid, fmt.Sprintf("%s is not a %s:// URL", path, s.scheme))
+	}
+	bucket = suffix
+	if i := strings.Index(suffix, "/"); i >= 0 {
+		bucket, key = suffix[:i], suffix[i+1:]
+	}
+	if bucket == "" {
+		return "", "", nil, errors.E(errors.Invalid, fmt.Sprintf("%s has no bucket", path))
+	}
+
+	s.mu.Lock()
+	c = s.clients[bucket]
+	s.mu.Unlock()
+	if c != nil {
+		return bucket, key, c, nil
+	}
+	config := request.WithRetryer(&aws.Config{}, remoteRetryer)
+	if s.endpoint != "" {
+		config.Endpoint = aws.String(s.endpoint)
+		config.S3ForcePathStyle = aws.Bool(true)
+		if s.region != "" {
+			config.Region = aws.String(s.region)
+		}
+	} else {
+		region, err := s3manager.GetBucketRegion(ctx, s.session, bucket, defaultS3Region)
+		if err != nil {
+			return "", "", nil, errors.E(err, fmt.Sprintf("couldn't find the region of bucket %s", bucket))
+		}
+		config.Region = aws.String(region)
+	}
+	c = s3.New(s.session, config)
+	s.mu.Lock()
+	s.clients[bucket] = c
+	s.mu.Unlock()
+	return bucket, key, c, nil
+}
+
+// objectError returns err of a request for path, with the kind of its
+// status code.
+func objectError(err error, path string) error {
+	if failure, ok := err.(awserr.RequestFailure); ok {
+		switch failure.StatusCode() {
+		case http.StatusNotFound:
+			return errors.E(errors.NotExist, path, err)
+		case http.StatusForbidden:
+			return errors.E(errors.NotAllowed, path, err)
+		case http.StatusPreconditionFailed:
+			return errors.E(errors.Precondition, fmt.Sprintf("%s changed while it was read", path), err)
+		}
+	}
+	return errors.E(path, err)
+}
+
+// objectInfo is the file.Info of an object.
+type objectInfo struct {
+	size    int64
+	modTime time.Time
+	etag    string
+}
+
+// Size implements file.Info.
+func (info objectInfo) Size() int64 { return info.size }
+
+// ModTime implements file.Info.
+func (info objectInfo) ModTime() time.Time { return info.modTime }
+
+// head returns the objectInfo of the object of path.
+func head(ctx context.Context, c s3iface.S3API, path, bucket, key string) (objectInfo, error) {
+	output, err := c.HeadObjectWithContext(ctx, &s3.HeadObjectInput{Bucket: aws.String(bucket), Key: aws.String(key)})
+	if err != nil {
+		return objectInfo{}, objectError(err, path)
+	}
+	return objectInfo{
+		size:    aws.Int64Value(output.ContentLength),
+		modTime: aws.TimeValue(output.LastModified),
+		etag:    aws.StringValue(output.ETag),
+	}, nil
+}
+
+// Stat implements file.Implementation.
+func (s *objectStore) Stat(ctx context.Context, path string, _ ...file.Opts) (file.Info, error) {
+	bucket, key, c, err := s.resolve(ctx, path)
+	if err != nil {
+		return nil, err
+	}
+	info, err := head(ctx, c, path, bucket, key)
+	if err != nil {
+		return nil, err
+	}
+	return info, nil
+}
+
+// Open implements file.Implementation.
+func (s *objectStore) Open(ctx context.Context, path string, _ ...file.Opts) (file.File, error) {
+	bucket, key, c, err := s.resolve(ctx, path)
+	if err != nil {
+		return nil, err
+	}
+	info, err := head(ctx, c, path, bucket, key)
+	if err != nil {
+		return nil, err
+	}
+	return &objectFile{path: path, bucket: bucket, key: key, client: c, info: info}, nil
+}
+
+// Create implements file.Implementation. The object is uploaded as it
+// is written, in the parts of a multipart upload, or with a single
+// request if it is smaller than a part.
+func (s *objectStore) Create(ctx context.Context, path string, _ ...file.Opts) (file.File, error) {
+	bucket, key, c, err := s.resolve(ctx, path)
+	if err != nil {
+		return nil, err
+	}
+	reader, writer := io.Pipe()
+	f := &objectFile{path: path, bucket: bucket, key: key, client: c, writer: writer, uploaded: make(chan error, 1)}
+	uploader := s3manager.NewUploaderWithClient(c)
+	go func() {
+		_, err := uploader.UploadWithContext(ctx, &s3manager.UploadInput{
+			Bucket: aws.String(bucket),
+			Key:    aws.String(key),
+			Body:   reader,
+		})
+		if err != nil {
+			err = objectError(err, path)
+		}
+		// Fail the writes that follow a failed upload.
+		reader.CloseWithError(err) // nolint: errcheck
+		f.uploaded <- err
+	}()
+	return f, nil
+}
+
+// Remove implements file.Implementation.
+func (s *objectStore) Remove(ctx context.Context, path string) error {
+	bucket, key, c, err := s.resolve(ctx, path)
+	if err != nil {
+		return err
+	}
+	if _, err := c.DeleteObjectWithContext(ctx, &s3.DeleteObjectInput{Bucket: aws.String(bucket),
+		Key: aws.String(key)}); err != nil {
+		return objectError(err, path)
+	}
+	return nil
+}
+
+// Presign implements file.Implementation.
+func (s *objectStore) Presign(ctx context.Context, path, method string, expiry time.Duration) (string, error) {
+	bucket, key, c, err := s.resolve(ctx, path)
+	if err != nil {
+		return "", err
+	}
+	var req *request.Request
+	switch method {
+	case http.MethodGet:
+		req, _ = c.GetObjectRequest(&s3.GetObjectInput{Bucket: aws.String(bucket), Key: aws.String(key)})
+	case http.MethodPut:
+		req, _ = c.PutObjectRequest(&s3.PutObjectInput{Bucket: aws.String(bucket), Key: aws.String(key)})
+	case http.MethodDelete:
+		req, _ = c.DeleteObjectRequest(&s3.DeleteObjectInput{Bucket: aws.String(bucket), Key: aws.String(key)})
+	default:
+		return "", errors.E(errors.NotSupported, fmt.Sprintf("%s URLs cannot be presigned for %s", s.scheme, method))
+	}
+	return req.Presign(expiry)
+}
+
+// List implements file.Implementation.
+func (s *objectStore) List(ctx context.Context, path string, recursive bool) file.Lister {
+	l := &objectLister{ctx: ctx, dir: strings.TrimSuffix(path, "/")}
+	var key string
+	l.bucket, key, l.client, l.err = s.resolve(ctx, path)
+	if l.err != nil {
+		return l
+	}
+	if key != "" && !strings.HasSuffix(key, "/") {
+		// A path of an object lists only the object.
+		if info, err := head(ctx, l.client, path, l.bucket, key); err == nil {
+			l.entries = []objectEntry{{path: path, info: info}}
+			l.done = true
+			return l
+		}
+	}
+	l.input = &s3.ListObjectsV2Input{Bucket: aws.String(l.bucket)}
+	if key = strings.TrimSuffix(key, "/"); key != "" {
+		l.input.Prefix = aws.String(key + "/")
+	}
+	if !recursive {
+		l.input.Delimiter = aws.String("/")
+	}
+	return l
+}
+
+// objectEntry is an entry of an objectLister.
+type objectEntry struct {
+	path string
+	dir  bool
+	info objectInfo
+}
+
+// objectLister is the file.Lister of an objectStore, which lists the
+// objects a page of ListObjectsV2 at a time.
+type objectLister struct {
+	ctx     context.Context
+	client  s3iface.S3API
+	bucket  string
+	dir     string
+	input   *s3.ListObjectsV2Input
+	done    bool
+	entries []objectEntry
+	entry   objectEntry
+	err     error
+}
+
+// Scan implements file.Lister.
+func (l *objectLister) Scan() bool {
+	for len(l.entries) == 0 {
+		if l.err != nil || l.done {
+			return false
+		}
+		output, err := l.client.ListObjectsV2WithContext(l.ctx, l.input)
+		if err != nil {
+			l.err = objectError(err, l.dir)
+			return false
+		}
+		prefix := aws.StringValue(l.input.Prefix)
+		for _, p := range output.CommonPrefixes {
+			name := strings.TrimSuffix(strings.TrimPrefix(aws.StringValue(p.Prefix), prefix), "/")
+			l.entries = append(l.entries, objectEntry{path: l.dir + "/" + name, dir: true})
+		}
+		for _, o := range output.Contents {
+			l.entries = append(l.entries, objectEntry{
+				path: l.dir + "/" + strings.TrimPrefix(aws.StringValue(o.Key), prefix),
+				info: objectInfo{
+					size:    aws.Int64Value(o.Size),
+					modTime: aws.TimeValue(o.LastModified),
+					etag:    aws.StringValue(o.ETag),
+				},
+			})
+		}
+		l.input.ContinuationToken = output.NextContinuationToken
+		l.done = !aws.BoolValue(output.IsTruncated)
+	}
+	l.entry, l.entries = l.entries[0], l.entries[1:]
+	return true
+}
+
+// Err implements file.Lister.
+func (l *objectLister) Err() error { return l.err }
+
+// Path implements file.Lister.
+func (l *objectLister) Path() string { return l.entry.path }
+
+// IsDir implements file.Lister.
+func (l *objectLister) IsDir() bool { return l.entry.dir }
+
+// Info implements file.Lister.
+func (l *objectLister) Info() file.Info {
+	if l.entry.dir {
+		return nil
+	}
+	return l.entry.info
+}
+
+// objectFile is the file.File of an object, opened either for reading
+// or for writing.
+type objectFile struct {
+	path        string
+	bucket, key string
+	client      s3iface.S3API
+	info        objectInfo
+	// reader is the shared reader of Reader.
+	reader *objectReader
+
+	// writer is the pipe to the upload, and uploaded its result, of a
+	// file opened for writing.
+	writer   *io.PipeWriter
+	uploaded chan error
+}
+
+// String implements file.File.
+func (f *objectFile) String() string { return f.path }
+
+// Name implements file.File.
+func (f *objectFile) Name() string { return f.path }
+
+// Stat implements file.File.
+func (f *objectFile) Stat(ctx context.Context) (file.Info, error) {
+	if f.writer != nil {
+		return nil, errors.E(errors.NotSupported, fmt.Sprintf("%s is being written", f.path))
+	}
+	return f.info, nil
+}
+
+// Reader implements file.File.
+func (f *objectFile) Reader(ctx context.Context) io.ReadSeeker {
+	if f.reader == nil {
+		f.reader = &objectReader{file: f}
+	}
+	return ioctx.ToStdReadSeeker(ctx, f.reader)
+}
+
+// OffsetReader implements file.File.
+func (f *objectFile) OffsetReader(offset int64) ioctx.ReadCloser {
+	return &objectReader{file: f, offset: offset}
+}
+
+// Writer implements file.File.
+func (f *objectFile) Writer(ctx context.Context) io.Writer {
+	if f.writer == nil {
+		return errorWriter{errors.E(errors.NotSupported, fmt.Sprintf("%s is opened for reading", f.path))}
+	}
+	return f.writer
+}
+
+// Discard implements file.File. It aborts the upload, so that the
+// object is not created.
+func (f *objectFile) Discard(ctx context.Context) {
+	if f.writer == nil {
+		return
+	}
+	f.writer.CloseWithError(errors.E(errors.Canceled, fmt.Sprintf("%s is discarded", f.path))) // nolint: errcheck
+	<-f.uploaded
+}
+
+// Close implements file.File. For a file opened for writing, it
+// completes the upload and returns its error.
+func (f *objectFile) Close(ctx context.Context) error {
+	if f.writer == nil {
+		if f.reader != nil {
+			return f.reader.Close(ctx)
+		}
+		return nil
+	}
+	if err := f.writer.Close(); err != nil {
+		return err
+	}
+	return <-f.uploaded
+}
+
+// errorWriter is an io.Writer that fails with err.
+type errorWriter struct{ err error }
+
+func (w errorWriter) Write([]byte) (int, error) { return 0, w.err }
+
+// objectReader reads an object from offset, with a ranged GET that
+// is kept open while it is read sequentially, and that is restarted
+// at the offset after a seek or a failed read. The GETs require the
+// ETag of the object when it was opened, so that a read fails if the
+// object changes.
+type objectReader struct {
+	file   *objectFile
+	offset int64
+	body   io.ReadCloser
+}
+
+// Read implements ioctx.Reader.
+func (r *objectReader) Read(ctx context.Context, p []byte) (int, error) {
+	f := r.file
+	if r.offset >= f.info.size {
+		return 0, io.EOF
+	}
+	for retries := 0; ; retries++ {
+		if r.body == nil {
+			input := &s3.GetObjectInput{
+				Bucket: aws.String(f.bucket),
+				Key:    aws.String(f.key),
+				Range:  aws.String(fmt.Sprintf("bytes=%d-", r.offset)),
+			}
+			if f.info.etag != "" {
+				input.IfMatch = aws.String(f.info.etag)
+			}
+			output, err := f.client.GetObjectWithContext(ctx, input)
+			if err != nil {
+				return 0, objectError(err, f.path)
+			}
+			r.body = output.Body
+		}
+		n, err := r.body.Read(p)
+		r.offset += int64(n)
+		if err == nil {
+			return n, nil
+		}
+		r.body.Close() // nolint: errcheck
+		r.body = nil
+		if err == io.EOF && r.offset >= f.info.size {
+			return n, io.EOF
+		}
+		if n > 0 {
+			return n, nil
+		}
+		// The response failed after it started, e.g. with a reset
+		// connection or an early end, so it is resumed at the offset.
+		if waitErr := retry.Wait(ctx, remoteReadRetryPolicy, retries); waitErr != nil {
+			return 0, errors.E(fmt.Sprintf("read of %s at %d", f.path, r.offset), err)
+		}
+		log.Debug.Printf("resuming the read of %s at %d after: %v", f.path, r.offset, err)
+	}
+}
+
+// Seek implements ioctx.Seeker.
+func (r *objectReader) Seek(ctx context.Context, offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += r.offset
+	case io.SeekEnd:
+		offset += r.file.info.size
+	}
+	if offset < 0 {
+		return r.offset, errors.E(errors.Invalid, fmt.Sprintf("seek of %s to %d", r.file.path, offset))
+	}
+	if offset != r.offset && r.body != nil {
+		r.body.Close() // nolint: errcheck
+		r.body = nil
+	}
+	r.offset = offset
+	return offset, nil
+}
+
+// Close implements ioctx.Closer.
+func (r *objectReader) Close(ctx context.Context) error {
+	if r.body == nil {
+		return nil
+	}
+	err := r.body.Close()
+	r.body = nil
+	return err
+}
@@ -14,36 +14,65 @@
 package markduplicates
 
 import (
+	"container/heap"
+	"encoding/binary"
+	"fmt"
+	"hash/fnv"
 	"math"
-	"math/rand"
-	"sort"
+	"reflect"
+	"regexp"
 	"strconv"
 	"strings"
+	"sync"
 
-	"github.com/Schaudge/grailbase/log"
+	"github.com/Schaudge/hts/sam"
 )
 
 // PhysicalLocation describes a read's physical location on the flow
-// cell. Lane, Surface, Swatch, Section, and TileNumber together
-// specify which flowcell tile the read was found in. TileName is the
+// cell. Lane, Surface, Swath, Section, and TileNumber together
+// specify which flowcell tile the read was found in. LaneNumber is
+// Lane converted to an integer, or 0 if Lane is not numeric. TileName is the
 // 4 or 5 digit representation of the tile, e.g. 1203 means surface 1,
 // swath 2 and tile 3. 12304 means surface 1, swath 2, section 3, and
 // tile 4. X and Y describe the X and Y coordinates of the well within
-// the tile.
+// the tile. Flowcell and RunID identify the sequencing run; they are
+// empty when the read name does not contain them, e.g. for 5 field
+// Illumina read names. UMI is the UMI field of 8 field Illumina read
+// names, e.g. "AAC+CCG", and empty for other read names.
 type PhysicalLocation struct {
+	Flowcell   string
+	RunID      string
 	Lane       string
-	Surface    string
-	Swath      string
-	Section    string
+	LaneNumber int
+	Surface    int
+	Swath      int
+	Section    int
 	TileName   string
 	TileNumber int
 	X          int
 	Y          int
+	UMI        string
+}
+
+// TileID returns a single integer that identifies the tile of l
+// within its lane, for fast same-tile checks. The decimal digits of
+// the TileID are SWCTTTTTT, where S is the Surface, W the Swath, C the
+// Section, and TTTTTT the TileNumber zero padded to 6 digits, e.g.
+// tile 12304 has TileID 123000004. This encoding is stable, and
+// tiles are ordered by surface, then swath, section and tile number.
+func (l *PhysicalLocation) TileID() int {
+	return l.Surface*100000000 + l.Swath*10000000 + l.Section*1000000 + l.TileNumber
+}
+
+// setLane sets Lane to lane and LaneNumber to its integer value.
+func (l *PhysicalLocation) setLane(lane string) {
+	l.Lane = lane
+	l.LaneNumber, _ = strconv.Atoi(lane)
 }
 
 const (
-	// Illumina read names come in 3 varieties: 5, 7, and 8 columns.
-	// For 5 and 7 field read names, the last three fields are:
+	// Illumina read names come in 4 varieties: 5, 6, 7, and 8 columns.
+	// For 5, 6 and 7 field read names, the last three fields are:
 	// tileName, X and Y. For 8 field read names, the last four fields
 	// are tileName, X, Y, and UMI. These constants help keep track of
 	// which fields are what.
@@ -54,6 +83,13 @@ const (
 	// contains the tileName for 5 field read names.
 	IlluminaReadName5FieldsTileField = 2
 
+	// IlluminaReadName6Fields is the number of columns in a 6 field
+	// read name, as emitted by bcl-convert when the run id is omitted.
+	IlluminaReadName6Fields = 6
+	// IlluminaReadName6FieldsTileField is 0-based field number that
+	// contains the tileName for 6 field read names.
+	IlluminaReadName6FieldsTileField = 3
+
 	// IlluminaReadName7Fields is the number of columns in a 5 field read name.
 	IlluminaReadName7Fields = 7
 	// IlluminaReadName7FieldsTileField is 0-based field number that
@@ -67,74 +103,533 @@ const (
 	IlluminaReadName8FieldsTileField = 4
 )
 
-// addOpticalDistances adds the optical distances between readpairs in
-// duplicates to metrics. If opts.OpticalHistogramMax is >= 0, then
-// limit to the first opts.OpticalHistogramMax readpairs after sorting
-// by fileidx.
-func addOpticalDistances(opts *Opts, readGroupLibrary map[string]string,
-	originalDuplicates []DuplicateEntry, metrics *MetricsCollection) {
-
-	// First sort pairs by fileidx to ensure deterministic behavior.
-	duplicates := make([]DuplicateEntry, len(originalDuplicates))
-	copy(duplicates, originalDuplicates)
-	sort.Slice(duplicates, func(i, j int) bool {
-		return duplicates[i].FileIdx() < duplicates[j].FileIdx()
-	})
-
-	// If we are capping the number of duplicate readpairs in the
-	// optical histogram, then shuffle the reads so that the histogram
-	// has a random sampling of the flow cell positions.
-	if opts.OpticalHistogramMax >= 0 {
-		r := rand.New(rand.NewSource(int64(duplicates[0].FileIdx())))
-		r.Shuffle(len(duplicates), func(i, j int) {
-			duplicates[i], duplicates[j] = duplicates[j], duplicates[i]
+// dnbseqRe matches MGI/DNBSEQ read names. The long variant looks like
+// V300016728L1C001R0010001234, and the short variant, produced by
+// older BGISEQ instruments, separates the spot index with an
+// underscore, e.g. CL100025598L1C001R001_12345. The submatches are
+// flowcell, lane, FOV column, FOV row, and spot index.
+var dnbseqRe = regexp.MustCompile(`^([A-Z]+[0-9]+)L([0-9]+)C([0-9]{3})R([0-9]{3})_?([0-9]+)$`)
+
+var (
+	// noLocationPlatforms contains the @RG PL values of platforms
+	// whose read names carry no tile or X/Y information.
+	noLocationPlatforms = map[string]bool{
+		"PACBIO":   true,
+		"ONT":      true,
+		"NANOPORE": true,
+	}
+
+	// pacbioNameRe matches PacBio read names, e.g.
+	// m64011_190830_220126/1/ccs or m54006_160504_020705/4194370/0_1234.
+	pacbioNameRe = regexp.MustCompile(`^m[0-9A-Za-z]+_[0-9]+_[0-9]+/[0-9]+(/.*)?$`)
+	// nanoporeNameRe matches Oxford Nanopore read names, which are UUIDs.
+	nanoporeNameRe = regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{12}$`)
+
+	platformTag = sam.Tag{'P', 'L'}
+)
+
+// locationCache holds the result of parsing a readpair's name with
+// parser, see IndexedPair.location.
+type locationCache struct {
+	parsed   bool
+	parser   LocationParser
+	location PhysicalLocation
+	err      error
+}
+
+// sameParser returns true if a and b are the same LocationParser.
+// Parsers of types that cannot be compared are never the same.
+func sameParser(a, b LocationParser) bool {
+	if a == nil || b == nil {
+		return a == nil && b == nil
+	}
+	t := reflect.TypeOf(a)
+	return t == reflect.TypeOf(b) && t.Comparable() && a == b
+}
+
+// readGroupsWithoutLocation returns the set of read groups in header
+// whose platform (PL) is known to produce read names without a
+// physical location.
+func readGroupsWithoutLocation(header *sam.Header) map[string]bool {
+	rgs := make(map[string]bool)
+	for _, readGroup := range header.RGs() {
+		platform := strings.ToUpper(readGroup.Get(platformTag))
+		if noLocationPlatforms[platform] {
+			opticalLog.Printf("read group %s has platform %s, excluding it from optical analysis",
+				readGroup.Name(), platform)
+			rgs[readGroup.Name()] = true
+		}
+	}
+	return rgs
+}
+
+// hasNoLocation returns true if qname looks like a PacBio or Oxford
+// Nanopore read name, neither of which carry a physical location.
+func hasNoLocation(qname string) bool {
+	return pacbioNameRe.MatchString(qname) || nanoporeNameRe.MatchString(qname)
+}
+
+// TileKey identifies a tile for TileMetrics.
+type TileKey struct {
+	Lane     string
+	Surface  int
+	Swath    int
+	TileName string
+}
+
+// TileMetrics counts the duplicate readpairs on a tile, and how many
+// of them are optical duplicates.
+type TileMetrics struct {
+	DuplicatePairs int64
+	OpticalPairs   int64
+}
+
+// Rate returns the fraction of the duplicate readpairs that are
+// optical duplicates.
+func (m *TileMetrics) Rate() float64 {
+	if m.DuplicatePairs == 0 {
+		return 0
+	}
+	return float64(m.OpticalPairs) / float64(m.DuplicatePairs)
+}
+
+// addTileMetrics adds the duplicates in pairs, all except the primary
+// at bestIndex, to the TileMetrics of their tile. opticals holds the
+// names of the optical duplicates. Readpairs whose names cannot be
+// parsed are skipped.
+func addTileMetrics(opts *Opts, pairs []DuplicateEntry, bestIndex int, opticals []string,
+	metrics *MetricsCollection) {
+	optical := make(map[string]bool, len(opticals))
+	for _, name := range opticals {
+		optical[name] = true
+	}
+	for i, dup := range pairs {
+		if i == bestIndex || hasNoLocation(dup.Name()) {
+			continue
+		}
+		pair := dup.(IndexedPair)
+		location, err := pair.location(opts.LocationParser)
+		if err != nil {
+			continue
+		}
+		m := metrics.Tile(TileKey{
+			Lane:     location.Lane,
+			Surface:  location.Surface,
+			Swath:    location.Swath,
+			TileName: location.TileName,
 		})
+		m.DuplicatePairs++
+		if optical[pair.Left.R.Name] {
+			m.OpticalPairs++
+		}
 	}
+}
 
-	if len(opts.OpticalHistogram) > 0 {
+// addOpticalDistances adds the optical distances between readpairs in
+// duplicates to metrics. If opts.OpticalHistogramMax is >= 0, then
+// limit each grouping key to a pseudo-random sample of
+// opts.OpticalHistogramMax readpairs, see locationSample. The sample
+// is seeded by opts.OpticalHistogramSeed, or if that is 0, by the
+// lowest fileidx in duplicates. Readpairs whose names cannot be parsed
+// by opts.LocationParser are excluded from the histogram and counted
+// in metrics.UnparseableNames and metrics.UnparseableNamesByReadGroup.
+// Only readpairs of the same flowcell, lane, read group and
+// orientation are compared; readpairs whose names have no flowcell,
+// e.g. 5 field Illumina names, are grouped by read group and
+// orientation alone, across lanes. Readpairs from noLocationRGs, or
+// whose names look like they come from a platform without physical
+// locations, are excluded and counted in metrics.NoLocationPairs.
+// Only readpairs on the same tile, or on adjacent tiles if
+// opts.OpticalAdjacentTiles is set, are compared; the other pairs are
+// counted in metrics.CrossTilePairsSkipped. If
+// opts.OpticalHistogramMaxDistance is > 0, distances at or beyond it
+// are counted in metrics.OpticalDistanceOverflow instead of the
+// histogram. If scatter is non-nil, the sampled readpairs are also
+// written to scatter, with the readpairs named in opticals marked as
+// optical duplicates.
+func addOpticalDistances(opts *Opts, readGroups *readGroupTable, noLocationRGs map[string]bool,
+	duplicates []DuplicateEntry, opticals []string, scatter *opticalScatterWriter, metrics *MetricsCollection) {
+	addSampledOpticalDistances(opts, readGroups, noLocationRGs, len(duplicates), duplicates, opticals, scatter,
+		metrics)
+}
+
+// addSampledOpticalDistances is addOpticalDistances for duplicates, a
+// sample of a duplicate set of bagSize readpairs, see capDuplicateSet.
+// The distances are added to the histogram rows of bagSize.
+func addSampledOpticalDistances(opts *Opts, readGroups *readGroupTable, noLocationRGs map[string]bool,
+	bagSize int, duplicates []DuplicateEntry, opticals []string, scatter *opticalScatterWriter,
+	metrics *MetricsCollection) {
+	if opts.opticalHistogramEnabled() || scatter != nil {
 		type key struct {
-			lane           string
-			readGroup      string
-			readGroupFound bool
-			orientation    Orientation
+			flowcell    string
+			lane        string
+			readGroup   int
+			orientation Orientation
+		}
+		if readGroups == nil {
+			readGroups = newReadGroupTable(nil)
+		}
+		seed := opticalHistogramSeed(opts, duplicates)
+		optical := make(map[string]bool, len(opticals))
+		for _, name := range opticals {
+			optical[name] = true
 		}
-		m := map[key][]PhysicalLocation{}
+		m := map[key]*locationSample{}
 		for _, dup := range duplicates {
 			pair := dup.(IndexedPair)
-			location := ParseLocation(dup.Name())
-			readGroup, readGroupFound := getReadGroup(pair.Left.R)
+			readGroup := readGroups.get(pair.Left.R)
+			if (readGroup != readGroups.none && noLocationRGs[readGroup.tag]) || hasNoLocation(dup.Name()) {
+				metrics.NoLocationPairs++
+				continue
+			}
+			metrics.OpticalNamesExamined++
+			location, err := pair.location(opts.LocationParser)
+			if err != nil {
+				unparseableNameLog.printf(opticalLog, "excluding read from optical histogram: %v", err)
+				metrics.UnparseableNames++
+				metrics.UnparseableNamesByReadGroup[readGroup.tag]++
+				continue
+			}
 			orientation := GetR1R2Orientation(&pair)
 
-			k := key{
-				lane:           location.Lane,
-				readGroup:      readGroup,
-				readGroupFound: readGroupFound,
-				orientation:    orientation,
+			k := key{readGroup: readGroup.id, orientation: orientation}
+			if location.Flowcell != "" {
+				k.flowcell, k.lane = location.Flowcell, location.Lane
 			}
-			m[k] = append(m[k], location)
-		}
-		for _, locations := range m {
-			for i := 0; i < len(locations) &&
-				(opts.OpticalHistogramMax < 0 || i < opts.OpticalHistogramMax); i++ {
-				for j := i + 1; j < len(locations) &&
-					(opts.OpticalHistogramMax < 0 || j < opts.OpticalHistogramMax); j++ {
-					metrics.AddDistance(len(duplicates),
-						opticalDistance(&locations[i], &locations[j]))
+			sample, found := m[k]
+			if !found {
+				sample = &locationSample{max: opts.OpticalHistogramMax}
+				m[k] = sample
+			}
+			sample.add(sampledLocation{
+				priority: samplePriority(seed, dup.Name()),
+				location: location,
+				optical:  optical[dup.Name()],
+			})
+		}
+		samples := make([]*locationSample, 0, len(m))
+		total := 0
+		for _, sample := range m {
+			samples = append(samples, sample)
+			total += len(sample.sampled)
+		}
+		if opts.Parallelism > 1 && len(samples) > 1 && total >= minParallelOpticalLocations {
+			addKeyDistancesParallel(opts, bagSize, samples, scatter, metrics)
+		} else {
+			for _, sample := range samples {
+				addKeyDistances(opts, bagSize, sample, scatter, metrics)
+			}
+		}
+	}
+}
+
+// minParallelOpticalLocations is the smallest number of sampled
+// locations in a duplicate set for which addOpticalDistances spreads
+// the grouping keys over several workers.
+const minParallelOpticalLocations = 4096
+
+// addKeyDistancesParallel calls addKeyDistances for each sample on a
+// pool of opts.Parallelism workers. Each worker accumulates into its
+// own MetricsCollection, and these are merged into metrics at the end.
+func addKeyDistancesParallel(opts *Opts, bagSize int, samples []*locationSample, scatter *opticalScatterWriter,
+	metrics *MetricsCollection) {
+	sampleCh := make(chan *locationSample, len(samples))
+	for _, sample := range samples {
+		sampleCh <- sample
+	}
+	close(sampleCh)
+
+	nWorkers := opts.Parallelism
+	if nWorkers > len(samples) {
+		nWorkers = len(samples)
+	}
+	workerMetrics := make([]*MetricsCollection, nWorkers)
+	wg := sync.WaitGroup{}
+	for wi := 0; wi < nWorkers; wi++ {
+		workerMetrics[wi] = newOpticalDistanceCollection(metrics)
+		wg.Add(1)
+		go func(m *MetricsCollection) {
+			defer wg.Done()
+			for sample := range sampleCh {
+				addKeyDistances(opts, bagSize, sample, scatter, m)
+			}
+		}(workerMetrics[wi])
+	}
+	wg.Wait()
+	for _, m := range workerMetrics {
+		metrics.Merge(m)
+	}
+}
+
+// newOpticalDistanceCollection returns an empty MetricsCollection
+// that only holds optical distances, with histograms of the same
+// length as the ones in metrics, so that merging it into metrics
+// gives the same histograms as adding the distances to metrics
+// directly.
+func newOpticalDistanceCollection(metrics *MetricsCollection) *MetricsCollection {
+	mc := &MetricsCollection{
+		OpticalDistance:         make([][]int64, len(metrics.OpticalDistance)),
+		OpticalDistanceOverflow: make([]int64, len(metrics.OpticalDistanceOverflow)),
+	}
+	for i := range mc.OpticalDistance {
+		mc.OpticalDistance[i] = make([]int64, len(metrics.OpticalDistance[i]))
+	}
+	return mc
+}
+
+// addKeyDistances writes the sampled locations of a grouping key to
+// scatter, if it is non-nil, and adds the distances between them to
+// metrics if the optical histogram is enabled.
+func addKeyDistances(opts *Opts, bagSize int, sample *locationSample, scatter *opticalScatterWriter,
+	metrics *MetricsCollection) {
+	if scatter != nil {
+		scatter.write(bagSize, sample.sampled)
+	}
+	if !opts.opticalHistogramEnabled() {
+		return
+	}
+	locations := sample.locations()
+
+	// Optical duplicates can only occur within a tile, or across the
+	// seam of adjacent tiles, so only compare locations on the same
+	// tile, and on adjacent tiles if requested.
+	tiles := map[int][]PhysicalLocation{}
+	for _, location := range locations {
+		tileID := location.TileID()
+		tiles[tileID] = append(tiles[tileID], location)
+	}
+	compared := 0
+	added := int64(0)
+	metric, maxDistance := opts.OpticalDistanceMetric, opts.OpticalHistogramMaxDistance
+	for tileID, tile := range tiles {
+		added += addTileDistances(metrics, metric, bagSize, maxDistance, tile, nil)
+		compared += len(tile) * (len(tile) - 1) / 2
+		if next := tiles[tileID+1]; opts.OpticalAdjacentTiles && len(next) > 0 {
+			added += addTileDistances(metrics, metric, bagSize, maxDistance, tile, next)
+			compared += len(tile) * len(next)
+		}
+	}
+	if opts.OpticalHistogramMaxDistance > 0 {
+		metrics.AddDistanceOverflow(bagSize, int64(compared)-added)
+	}
+	n := len(locations)
+	metrics.CrossTilePairsSkipped += int64(n*(n-1)/2 - compared)
+}
+
+// opticalHistogramSeed returns the seed for sampling duplicates. This
+// is opts.OpticalHistogramSeed if it is non-zero, and otherwise the
+// lowest fileidx in duplicates.
+func opticalHistogramSeed(opts *Opts, duplicates []DuplicateEntry) int64 {
+	if opts.OpticalHistogramSeed != 0 {
+		return opts.OpticalHistogramSeed
+	}
+	seed := duplicates[0].FileIdx()
+	for _, dup := range duplicates[1:] {
+		if dup.FileIdx() < seed {
+			seed = dup.FileIdx()
+		}
+	}
+	return int64(seed)
+}
+
+// samplePriority returns a pseudo-random priority for the readpair
+// with the given name. The priority depends only on seed and name, so
+// a sample does not depend on the order of the input.
+func samplePriority(seed int64, name string) uint64 {
+	hasher := fnv.New64a()
+	binary.Write(hasher, binary.LittleEndian, seed) // nolint: errcheck
+	hasher.Write([]byte(name))                      // nolint: errcheck
+	return hasher.Sum64()
+}
+
+type sampledLocation struct {
+	priority uint64
+	location PhysicalLocation
+	optical  bool
+}
+
+// locationSample keeps the max locations with the lowest priorities in
+// a heap, or all of the locations if max is negative.
+type locationSample struct {
+	max     int
+	sampled []sampledLocation
+}
+
+func (s *locationSample) Len() int           { return len(s.sampled) }
+func (s *locationSample) Less(i, j int) bool { return s.sampled[i].priority > s.sampled[j].priority }
+func (s *locationSample) Swap(i, j int)      { s.sampled[i], s.sampled[j] = s.sampled[j], s.sampled[i] }
+func (s *locationSample) Push(x interface{}) { s.sampled = append(s.sampled, x.(sampledLocation)) }
+func (s *locationSample) Pop() interface{} {
+	x := s.sampled[len(s.sampled)-1]
+	s.sampled = s.sampled[:len(s.sampled)-1]
+	return x
+}
+
+func (s *locationSample) add(l sampledLocation) {
+	switch {
+	case s.max < 0:
+		s.sampled = append(s.sampled, l)
+	case len(s.sampled) < s.max:
+		heap.Push(s, l)
+	case s.max > 0 && l.priority < s.sampled[0].priority:
+		s.sampled[0] = l
+		heap.Fix(s, 0)
+	}
+}
+
+func (s *locationSample) locations() []PhysicalLocation {
+	locations := make([]PhysicalLocation, len(s.sampled))
+	for i := range s.sampled {
+		locations[i] = s.sampled[i].location
+	}
+	return locations
+}
+
+// addTileDistances adds the distances, measured with metric, between
+// the locations in a and the locations in b to metrics, or between
+// the pairs of locations in a if b is nil, and returns the number of
+// distances added. If maxDistance is > 0, only distances below
+// maxDistance are added, and the locations are bucketed into a grid
+// so that locations that are too far apart are never compared.
+func addTileDistances(metrics *MetricsCollection, metric DistanceMetric, bagSize, maxDistance int,
+	a, b []PhysicalLocation) int64 {
+	added := int64(0)
+	if maxDistance <= 0 {
+		for i := range a {
+			if b == nil {
+				for j := i + 1; j < len(a); j++ {
+					metrics.AddDistance(bagSize, metric.distance(&a[i], &a[j]))
+				}
+				added += int64(len(a) - i - 1)
+			} else {
+				for j := range b {
+					metrics.AddDistance(bagSize, metric.distance(&a[i], &b[j]))
 				}
+				added += int64(len(b))
+			}
+		}
+		return added
+	}
+
+	same := b == nil
+	if same {
+		b = a
+	}
+	grid := newLocationGrid(maxDistance, b)
+	for i := range a {
+		grid.neighbors(&a[i], func(j int) {
+			if same && j <= i {
+				return
+			}
+			if d := metric.distance(&a[i], &b[j]); d < maxDistance {
+				metrics.AddDistance(bagSize, d)
+				added++
+			}
+		})
+	}
+	return added
+}
+
+// locationGrid buckets locations into square cells of cellSize
+// pixels. Two locations that are less than cellSize apart are in the
+// same or in neighboring cells.
+type locationGrid struct {
+	cellSize int
+	cells    map[[2]int][]int
+}
+
+func newLocationGrid(cellSize int, locations []PhysicalLocation) *locationGrid {
+	g := &locationGrid{
+		cellSize: cellSize,
+		cells:    map[[2]int][]int{},
+	}
+	for i := range locations {
+		c := g.cell(&locations[i])
+		g.cells[c] = append(g.cells[c], i)
+	}
+	return g
+}
+
+func (g *locationGrid) cell(l *PhysicalLocation) [2]int {
+	return [2]int{floorDiv(l.X, g.cellSize), floorDiv(l.Y, g.cellSize)}
+}
+
+// neighbors calls fn with the index of every location in the same or a
+// neighboring cell as l.
+func (g *locationGrid) neighbors(l *PhysicalLocation, fn func(i int)) {
+	c := g.cell(l)
+	for dx := -1; dx <= 1; dx++ {
+		for dy := -1; dy <= 1; dy++ {
+			for _, i := range g.cells[[2]int{c[0] + dx, c[1] + dy}] {
+				fn(i)
 			}
 		}
 	}
 }
 
+func floorDiv(a, b int) int {
+	q := a / b
+	if a%b != 0 && a < 0 {
+		q--
+	}
+	return q
+}
+
+// DistanceMetric selects how the distance between two physical
+// locations is measured.
+type DistanceMetric string
+
+const (
+	// EuclideanDistance is the straight line distance between two
+	// locations, truncated to an integer.
+	EuclideanDistance DistanceMetric = "euclidean"
+	// PerAxisDistance is the larger of the X and Y distances between
+	// two locations. Two locations are within d of each other when
+	// both |dx| <= d and |dy| <= d, which is how picard compares
+	// locations. Points at (0,0) and (90,90) are 90 apart, but 127
+	// apart with EuclideanDistance.
+	PerAxisDistance DistanceMetric = "per-axis"
+)
+
+// ParseDistanceMetric returns the DistanceMetric named by s. The empty
+// string is accepted and means the default of each user of the metric.
+func ParseDistanceMetric(s string) (DistanceMetric, error) {
+	switch m := DistanceMetric(s); m {
+	case "", EuclideanDistance, PerAxisDistance:
+		return m, nil
+	}
+	return "", fmt.Errorf("unknown optical distance metric %q, must be %q or %q", s, EuclideanDistance, PerAxisDistance)
+}
+
+// distance returns the distance between a and b. The empty
+// DistanceMetric is EuclideanDistance.
+func (m DistanceMetric) distance(a, b *PhysicalLocation) int {
+	if m == PerAxisDistance {
+		dx, dy := abs(a.X-b.X), abs(a.Y-b.Y)
+		if dx > dy {
+			return dx
+		}
+		return dy
+	}
+	return opticalDistance(a, b)
+}
+
 func opticalDistance(a, b *PhysicalLocation) int {
 	return int(math.Sqrt(math.Pow(float64(a.X-b.X), 2.0) + math.Pow(float64(a.Y-b.Y), 2.0)))
 }
 
 // ParseLocation returns a physical location given an Illumina style
-// read name. The read name must have 5, 7, or 8 fields separated by
-// ':'. When there are 5 or 7 fields, the last three fields are
+// read name. The read name should have 5, 6, 7, or 8 fields separated
+// by ':'. When there are 5, 6 or 7 fields, the last three fields are
 // tileName, X and Y.  When there are 8 fields, the last four fields
-// are tileName, X, Y, and UMI.
+// are tileName, X, Y, and UMI; the UMI is set in the returned
+// location even if the other fields cannot be parsed. For any other
+// number of fields, the last three consecutive numeric fields are
+// taken to be tileName, X and Y, and the field before them the lane.
+// MGI/DNBSEQ read names are also accepted, see parseDNBSEQLocation.
+// Before parsing, qname is truncated at the first whitespace and a
+// trailing /1, /2, or /3 is removed, see normalizeName. ParseLocation
+// returns an error if qname does not match any of these formats.
 //
 // The tileName be formatted as a 4 or 5 digit Illumina tileName.
 // For a description of 4 digit tile numbers, see Appendix B, section Tile Numbering in
@@ -144,60 +639,218 @@ func opticalDistance(a, b *PhysicalLocation) int {
 // For a description of 5 digit tile numbers, see Appendix C, section Tile Numbering in
 //
 //	https://support.illumina.com/content/dam/illumina-support/documents/documentation/system_documentation/nextseq/nextseq-550-system-guide-15069765-05.pdf
-func ParseLocation(qname string) PhysicalLocation {
+func ParseLocation(qname string) (PhysicalLocation, error) {
+	qname = normalizeName(qname)
+	if m := dnbseqRe.FindStringSubmatch(qname); m != nil {
+		return parseDNBSEQLocation(qname, m)
+	}
+	return parseColonLocation(qname)
+}
+
+// parseColonLocation parses the ':' separated read name qname as
+// described in ParseLocation. qname must already be normalized.
+func parseColonLocation(qname string) (PhysicalLocation, error) {
+	var location PhysicalLocation
 	fields := strings.Split(qname, ":")
 	var tileIdx int
 	switch len(fields) {
 	case IlluminaReadName5Fields:
 		tileIdx = IlluminaReadName5FieldsTileField
+	case IlluminaReadName6Fields:
+		tileIdx = IlluminaReadName6FieldsTileField
 	case IlluminaReadName7Fields:
 		tileIdx = IlluminaReadName7FieldsTileField
 	case IlluminaReadName8Fields:
 		tileIdx = IlluminaReadName8FieldsTileField
 	default:
-		log.Fatalf("Could not parse name: %s, expected 5, 7, or 8 fields separated by ':'", qname)
+		tileIdx = lastNumericTriple(fields)
+		if tileIdx < 0 {
+			return location, fmt.Errorf("could not parse name: %s, expected 5, 6, 7, or 8 fields separated by ':'",
+				qname)
+		}
+	}
+
+	switch len(fields) {
+	case IlluminaReadName6Fields:
+		location.Flowcell = fields[1]
+	case IlluminaReadName7Fields, IlluminaReadName8Fields:
+		location.RunID = fields[1]
+		location.Flowcell = fields[2]
+	}
+	if len(fields) == IlluminaReadName8Fields {
+		location.UMI = fields[7]
+	}
+	location.setLane(fields[tileIdx-1])
+	err := setTileXY(&location, qname, fields[tileIdx], fields[tileIdx+1], fields[tileIdx+2])
+	return location, err
+}
+
+// normalizeName truncates qname at the first space or tab, which
+// removes comments such as barcodes, and then removes a trailing
+// read number suffix /1, /2, or /3 added by older tools.
+func normalizeName(qname string) string {
+	if i := strings.IndexAny(qname, " \t"); i >= 0 {
+		qname = qname[:i]
+	}
+	if n := len(qname); n >= 2 && qname[n-2] == '/' && qname[n-1] >= '1' && qname[n-1] <= '3' {
+		qname = qname[:n-2]
+	}
+	return qname
+}
+
+// lastNumericTriple returns the index of the first of the last three
+// consecutive fields that are all non-negative integers, or -1 if
+// there is no such triple. The returned index is always at least 1 so
+// that a lane field precedes the triple.
+func lastNumericTriple(fields []string) int {
+	isNumeric := func(s string) bool {
+		if len(s) == 0 {
+			return false
+		}
+		for i := 0; i < len(s); i++ {
+			if s[i] < '0' || s[i] > '9' {
+				return false
+			}
+		}
+		return true
+	}
+	for i := len(fields) - 3; i >= 1; i-- {
+		if isNumeric(fields[i]) && isNumeric(fields[i+1]) && isNumeric(fields[i+2]) {
+			return i
+		}
 	}
+	return -1
+}
 
-	var (
-		location PhysicalLocation
-		err      error
-	)
-	location.Lane = fields[tileIdx-1]
-	location.TileName = fields[tileIdx]
+// ParseLocationRegex returns a physical location given a read name
+// and a regular expression with three capture groups for the
+// tileName, X and Y, like picard's READ_NAME_REGEX. The tileName is
+// interpreted the same way as in ParseLocation. The Lane of the
+// returned location is always empty.
+func ParseLocationRegex(re *regexp.Regexp, qname string) (PhysicalLocation, error) {
+	var location PhysicalLocation
+	m := re.FindStringSubmatch(qname)
+	if len(m) != 4 {
+		return location, fmt.Errorf("could not parse name: %s, does not match read name regex %s", qname, re)
+	}
+	err := setTileXY(&location, qname, m[1], m[2], m[3])
+	return location, err
+}
 
-	location.X, err = strconv.Atoi(fields[tileIdx+1])
+// parseLocation parses qname with parser if it is non-nil, and with
+// ParseLocation otherwise.
+func parseLocation(parser LocationParser, qname string) (PhysicalLocation, error) {
+	if parser != nil {
+		return parser.Parse(qname)
+	}
+	return ParseLocation(qname)
+}
+
+// setTileXY sets the tile fields of location from tileName, and X
+// and Y from x and y. qname is used for error messages.
+func setTileXY(location *PhysicalLocation, qname, tileName, x, y string) error {
+	var err error
+	location.TileName = tileName
+
+	location.X, err = strconv.Atoi(x)
 	if err != nil {
-		log.Fatalf("Could not parse name: %s, could not convert x to integer: %v",
+		return fmt.Errorf("could not parse name: %s, could not convert x to integer: %v",
 			qname, err)
 	}
-	location.Y, err = strconv.Atoi(fields[tileIdx+2])
+	location.Y, err = strconv.Atoi(y)
 	if err != nil {
-		log.Fatalf("Could not parse name: %s, could not convert y to integer: %v",
+		return fmt.Errorf("could not parse name: %s, could not convert y to integer: %v",
 			qname, err)
 	}
 
-	if len(location.TileName) == 8 && strings.HasPrefix(location.TileName, "R") && strings.Contains(location.TileName, "C") {
+	if isGeneMindTile(location.TileName) {
 		// GeneMind sequencer fastq format
 		rowFOVIndex, err1 := strconv.Atoi(location.TileName[1:4])
 		colFOVIndex, err2 := strconv.Atoi(location.TileName[5:])
 		if err1 != nil || err2 != nil {
-			log.Fatalf("Could not parse GeneMind FOV name: %s", qname)
+			return fmt.Errorf("could not parse GeneMind FOV name: %s", qname)
 		}
 		location.TileNumber = 1000*rowFOVIndex + colFOVIndex
 	} else if TileName, _ := strconv.Atoi(location.TileName); TileName < 100000 {
 		if TileName > 9999 {
-			location.Surface = strconv.Itoa(TileName / 10000)
-			location.Swath = strconv.Itoa((TileName % 10000) / 1000)
-			location.Section = strconv.Itoa((TileName % 1000) / 100)
+			location.Surface = TileName / 10000
+			location.Swath = (TileName % 10000) / 1000
+			location.Section = (TileName % 1000) / 100
 			location.TileNumber = TileName % 100
 		} else {
-			location.Surface = strconv.Itoa(TileName / 1000)
-			location.Swath = strconv.Itoa((TileName % 1000) / 100)
+			location.Surface = TileName / 1000
+			location.Swath = (TileName % 1000) / 100
 			location.TileNumber = TileName % 100
 		}
 	} else {
-		log.Fatalf("Could not parse name: %s, unexpected tile name %s, expected 4 or 5 digits",
+		return fmt.Errorf("could not parse name: %s, unexpected tile name %s, expected 4 or 5 digits",
 			qname, location.TileName)
 	}
-	return location
+	return nil
+}
+
+// isGeneMindTile returns true if tileName is a GeneMind FOV name,
+// e.g. R012C045.
+func isGeneMindTile(tileName string) bool {
+	return len(tileName) == 8 && strings.HasPrefix(tileName, "R") && strings.Contains(tileName, "C")
+}
+
+// dnbseqSpotsPerRow is the number of spots in a row of a DNBSEQ FOV,
+// which are numbered row by row.
+const dnbseqSpotsPerRow = 1000
+
+// parseDNBSEQLocation returns the physical location of an MGI/DNBSEQ
+// read name, given the submatches of dnbseqRe. The C###R### fields
+// name the FOV, which plays the role of the tile. DNBSEQ names do
+// not carry pixel coordinates, so X and Y are the column and the row
+// of the spot index in the FOV, see dnbseqSpotsPerRow, and distances
+// are in units of the spot pitch.
+func parseDNBSEQLocation(qname string, m []string) (PhysicalLocation, error) {
+	var location PhysicalLocation
+	location.Flowcell = m[1]
+	location.setLane(m[2])
+	location.TileName = "C" + m[3] + "R" + m[4]
+
+	col, err := strconv.Atoi(m[3])
+	if err != nil {
+		return location, fmt.Errorf("could not parse DNBSEQ FOV column: %s: %v", qname, err)
+	}
+	row, err := strconv.Atoi(m[4])
+	if err != nil {
+		return location, fmt.Errorf("could not parse DNBSEQ FOV row: %s: %v", qname, err)
+	}
+	location.TileNumber = 1000*col + row
+
+	spot, err := strconv.Atoi(m[5])
+	if err != nil {
+		return location, fmt.Errorf("could not parse DNBSEQ spot index: %s: %v", qname, err)
+	}
+	location.X = spot % dnbseqSpotsPerRow
+	location.Y = spot / dnbseqSpotsPerRow
+	return location, nil
+}
+
+// defaultMaxUnparseableNameFraction is the default
+// Opts.MaxUnparseableNameFraction.
+const defaultMaxUnparseableNameFraction = 0.01
+
+// checkUnparseableNames returns an error if the fraction of read names
+// that could not be parsed by ParseLocation exceeds
+// opts.MaxUnparseableNameFraction.
+func checkUnparseableNames(opts *Opts, metrics *MetricsCollection) error {
+	if metrics.UnparseableNames == 0 {
+		return nil
+	}
+	fraction := float64(metrics.UnparseableNames) / float64(metrics.OpticalNamesExamined)
+	opticalLog.Printf("excluded %d of %d read names from the optical histogram because they could not be parsed",
+		metrics.UnparseableNames, metrics.OpticalNamesExamined)
+	max := opts.MaxUnparseableNameFraction
+	if max == 0 {
+		max = defaultMaxUnparseableNameFraction
+	}
+	if fraction > max {
+		return fmt.Errorf("%d of %d read names (%0.4f) could not be parsed, exceeds max-unparseable-name-fraction %v",
+			metrics.UnparseableNames, metrics.OpticalNamesExamined, fraction, max)
+	}
+	return nil
 }
@@ -18,7 +18,6 @@ import (
 	"strings"
 
 	"github.com/Schaudge/grailbase/log"
-	"github.com/Schaudge/grailbio/encoding/bam"
 	"github.com/Schaudge/grailbio/encoding/bampair"
 )
 
@@ -86,10 +85,24 @@ func (t sortingTable) Less(i, j int) bool {
 }
 
 // TileOpticalDetector detects optical duplicates with a tile. For two
-// reads to be optical duplicates, their tile, lane, surface, library,
-// and read orientations must be identical
+// reads to be optical duplicates, their flowcell, tile, lane, surface,
+// library, and read orientations must be identical
 type TileOpticalDetector struct {
 	OpticalDistance int
+
+	// OpticalDistanceByReadGroup, if non-nil, overrides
+	// OpticalDistance for the readpairs of its read groups, see
+	// optical_distance.go. If it is nil, Mark uses a copy of the
+	// detector with the distances of Opts.
+	OpticalDistanceByReadGroup map[string]int
+
+	// DistanceMetric is how OpticalDistance is compared to the
+	// distance between two reads. The default is PerAxisDistance.
+	DistanceMetric DistanceMetric
+
+	// LocationParser, if non-nil, is used to parse read names
+	// instead of ParseLocation.
+	LocationParser LocationParser
 }
 
 // GetRecordProcessor implements OpticalDetector.
@@ -104,14 +117,19 @@ func (t *TileOpticalDetector) RecordProcessorsDone() (int, int) {
 
 // Detect implements OpticalDetector.
 func (t *TileOpticalDetector) Detect(readGroupLibrary map[string]string, duplicates []DuplicateEntry, bestIndex int) []string {
+	return t.detect(newReadGroupTable(readGroupLibrary), duplicates, bestIndex)
+}
+
+// detect is Detect with the read groups and libraries of readGroups.
+func (t *TileOpticalDetector) detect(readGroups *readGroupTable, duplicates []DuplicateEntry, bestIndex int) []string {
 	// Split duplicates by tile number into batches before marking the
 	// optical duplicates.  We split by tile to reduce the cost of
 	// comparing each pair against the other pairs.
 	type batchKey struct {
+		flowcell        string
 		lane            string
 		tile            string
-		readGroup       string
-		readGroupFound  bool
+		readGroup       int
 		r1R2Orientation Orientation
 	}
 
@@ -121,13 +139,19 @@ func (t *TileOpticalDetector) Detect(readGroupLibrary map[string]string, duplica
 	duplicateNames := make([]string, 0)
 	for i, pair := range duplicates {
 		p := pair.(IndexedPair)
-		location := ParseLocation(pair.Name())
-		readGroup, readGroupFound := getReadGroup(p.Left.R)
+		location, err := p.location(t.LocationParser)
+		if err != nil {
+			// A pair without a physical location can never be an
+			// optical duplicate.
+			opticalLocationLog.printf(opticalLog, "skipping optical detection: %v", err)
+			continue
+		}
+		readGroup := readGroups.get(p.Left.R)
 		key := batchKey{
+			flowcell:        location.Flowcell,
 			lane:            location.Lane,
 			tile:            location.TileName,
-			readGroup:       readGroup,
-			readGroupFound:  readGroupFound,
+			readGroup:       readGroup.id,
 			r1R2Orientation: GetR1R2Orientation(&p),
 		}
 
@@ -141,12 +165,12 @@ func (t *TileOpticalDetector) Detect(readGroupLibrary map[string]string, duplica
 		}
 		batches[key] = append(batches[key],
 			sortingEntry{
-				library:      GetLibrary(readGroupLibrary, p.Left.R),
+				library:      readGroup.library,
 				leftRefId:    p.Left.R.Ref.ID(),
-				left5Pos:     bam.UnclippedFivePrimePosition(p.Left.R),
-				orientation:  orientationBytePair(bam.IsReversedRead(p.Left.R), bam.IsReversedRead(p.Right.R)),
+				left5Pos:     unclippedFivePrimePosition(p.Left.R),
+				orientation:  pairOrientation(p.Left.R, p.Right.R),
 				rightRefId:   p.Right.R.Ref.ID(),
-				right5Pos:    bam.UnclippedFivePrimePosition(p.Right.R),
+				right5Pos:    unclippedFivePrimePosition(p.Right.R),
 				leftFileIdx:  p.Left.FileIdx_,
 				rightFileIdx: p.Right.FileIdx_,
 				pair:         p,
@@ -155,76 +179,63 @@ func (t *TileOpticalDetector) Detect(readGroupLibrary map[string]string, duplica
 			})
 	}
 
-	// Mark optical duplicates for each tile at a time.
+	// Mark optical duplicates for each tile at a time. Like picard,
+	// pairs within the optical distance of each other are clustered
+	// transitively, so if A-B and B-C are within the distance, then
+	// A, B, and C are in the same cluster even if A-C is not. Each
+	// cluster keeps one pair, the primary if it is in the cluster,
+	// and the other pairs are optical duplicates.
 	for key, batch := range batches {
-		if log.At(log.Debug) && len(batch) > 1 {
-			log.Debug.Printf("optical batch size: %d, %v", len(batch), key)
+		if opticalLog.at(log.Debug) && len(batch) > 1 {
+			opticalLog.Debugf("optical batch size: %d, %v", len(batch), key)
 		}
 		sort.Sort(batch)
 		bestIdx := -1
-		foundOptical := false
 		if key == bestBatchKey {
-			// If this batch contains the primary pair, then compare
-			// all pairs against the primary first.
 			for i := range batch {
 				if batch[i].pair.Left.R.Name == bestName {
 					bestIdx = i
 					break
 				}
 			}
-			for i := range batch {
-				if bestIdx == i {
-					continue
-				}
-				if isOpticalDup(t.OpticalDistance, &batch[bestIdx].location, &batch[i].location) {
-					foundOptical = true
-					batch[i].duplicate = true
-					duplicateNames = append(duplicateNames, batch[i].pair.Left.R.Name)
-					if log.At(log.Debug) {
-						log.Debug.Printf("optical dups: %s %s (dup)", batch[bestIdx].pair.Left.R.Name,
-							batch[i].pair.Left.R.Name)
-					}
+		}
+
+		distance := t.distance(readGroups.info(key.readGroup).tag)
+		clusters := newUnionFind(len(batch))
+		for i := 0; i < len(batch); i++ {
+			for j := i + 1; j < len(batch); j++ {
+				if isOpticalDup(t.DistanceMetric, distance, &batch[i].location, &batch[j].location) {
+					clusters.union(i, j)
 				}
 			}
 		}
 
-		// Next, compare each pair with each other pair.
-		for i := 0; i < len(batch); i++ {
-			if i == bestIdx {
+		// The root of each cluster is its lowest index, which is the
+		// pair to keep unless the cluster contains the primary.
+		keep := make(map[int]int)
+		for i := range batch {
+			keep[clusters.find(i)] = clusters.find(i)
+		}
+		if bestIdx >= 0 {
+			keep[clusters.find(bestIdx)] = bestIdx
+		}
+		foundOptical := false
+		for i := range batch {
+			if keep[clusters.find(i)] == i {
 				continue
 			}
-			for j := i + 1; j < len(batch); j++ {
-				if j == bestIdx {
-					continue
-				}
-				if batch[i].duplicate && batch[j].duplicate {
-					continue
-				}
-				if isOpticalDup(t.OpticalDistance, &batch[i].location, &batch[j].location) {
-					if batch[j].duplicate {
-						foundOptical = true
-						batch[i].duplicate = true
-						duplicateNames = append(duplicateNames, batch[i].pair.Left.R.Name)
-						if log.At(log.Debug) {
-							log.Debug.Printf("optical dups: %s %s (dup)", batch[j].pair.Left.R.Name,
-								batch[i].pair.Left.R.Name)
-						}
-					} else {
-						foundOptical = true
-						batch[j].duplicate = true
-						duplicateNames = append(duplicateNames, batch[j].pair.Left.R.Name)
-						if log.At(log.Debug) {
-							log.Debug.Printf("optical dups: %s %s (dup)", batch[i].pair.Left.R.Name,
-								batch[j].pair.Left.R.Name)
-						}
-					}
-				}
+			foundOptical = true
+			batch[i].duplicate = true
+			duplicateNames = append(duplicateNames, batch[i].pair.Left.R.Name)
+			if opticalLog.at(log.Debug) {
+				opticalLog.Debugf("optical dups: %s %s (dup)", batch[keep[clusters.find(i)]].pair.Left.R.Name,
+					batch[i].pair.Left.R.Name)
 			}
 		}
-		if log.At(log.Debug) && foundOptical {
-			log.Debug.Printf("duplicate group:")
+		if opticalLog.at(log.Debug) && foundOptical {
+			opticalLog.Debugf("duplicate group:")
 			for i, e := range batch {
-				log.Debug.Printf("  names[%d] %s optical dup: %v, best: %v, entry: %v",
+				opticalLog.Debugf("  names[%d] %s optical dup: %v, best: %v, entry: %v",
 					i, e.pair.Left.R.Name, e.duplicate, i == bestIdx, e)
 			}
 		}
@@ -232,6 +243,41 @@ func (t *TileOpticalDetector) Detect(readGroupLibrary map[string]string, duplica
 	return duplicateNames
 }
 
-func isOpticalDup(opticalDistance int, a, b *PhysicalLocation) bool {
+// unionFind is a disjoint-set forest over the integers [0, n). The
+// root of each set is always its lowest member.
+type unionFind []int
+
+func newUnionFind(n int) unionFind {
+	u := make(unionFind, n)
+	for i := range u {
+		u[i] = i
+	}
+	return u
+}
+
+// find returns the root of the set that contains i.
+func (u unionFind) find(i int) int {
+	for u[i] != i {
+		u[i] = u[u[i]]
+		i = u[i]
+	}
+	return i
+}
+
+// union merges the sets that contain i and j.
+func (u unionFind) union(i, j int) {
+	ri, rj := u.find(i), u.find(j)
+	if ri < rj {
+		u[rj] = ri
+	} else if rj < ri {
+		u[ri] = rj
+	}
+}
+
+func isOpticalDup(metric DistanceMetric, opticalDistance int, a, b *PhysicalLocation) bool {
+	if metric == EuclideanDistance {
+		dx, dy := a.X-b.X, a.Y-b.Y
+		return dx*dx+dy*dy <= opticalDistance*opticalDistance
+	}
 	return abs(a.X-b.X) <= opticalDistance && abs(a.Y-b.Y) <= opticalDistance
 }
@@ -0,0 +1,162 @@
+// Copyright 2019 Grail Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package markduplicates
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"strconv"
+	"strings"
+
+	"github.com/Schaudge/grailbase/errors"
+	"github.com/Schaudge/grailbase/file"
+	"github.com/Schaudge/hts/sam"
+)
+
+// Optical distances by read group
+//
+// A BAM file can merge read groups sequenced on patterned flowcells,
+// whose optical duplicates are up to about 2500 pixels apart, with
+// read groups of unpatterned flowcells, for which picard's default of
+// 100 pixels applies. The optical distance of each read group is, in
+// order:
+//
+//   - its distance in Opts.OpticalPixelDistanceByReadGroup, which is
+//     read from Opts.OpticalDistanceMapFile,
+//   - patternedFlowcellDistance, with Opts.OpticalDistanceFromPlatform,
+//     if the PM or PL field of its @RG line names an instrument with
+//     patterned flowcells,
+//   - the OpticalDistance of the TileOpticalDetector, which is
+//     Opts.OpticalDuplicatePixelDistance for the default detector.
+
+// patternedFlowcellDistance is the optical distance of the read groups
+// of instruments with patterned flowcells, like picard's recommended
+// OPTICAL_DUPLICATE_PIXEL_DISTANCE for them.
+const patternedFlowcellDistance = 2500
+
+var (
+	// patternedFlowcellModels are the prefixes of the instrument
+	// models with patterned flowcells, lower case and without spaces.
+	patternedFlowcellModels = []string{"novaseq", "hiseqx", "hiseq3000", "hiseq4000"}
+
+	platformModelTag = sam.Tag{'P', 'M'}
+)
+
+// readOpticalDistanceMap reads the optical distance map file at path.
+func readOpticalDistanceMap(ctx context.Context, path string) (distances map[string]int, err error) {
+	in, err := file.Open(ctx, path)
+	if err != nil {
+		return nil, errors.E(err, "couldn't open optical distance map:", path)
+	}
+	defer func() {
+		if err2 := in.Close(ctx); err == nil && err2 != nil {
+			err = err2
+		}
+	}()
+	data, err := ioutil.ReadAll(in.Reader(ctx))
+	if err != nil {
+		return nil, errors.E(err, "couldn't read optical distance map:", path)
+	}
+	distances, err = parseOpticalDistanceMap(data)
+	if err != nil {
+		return nil, errors.E(err, "invalid optical distance map:", path)
+	}
+	return distances, nil
+}
+
+// parseOpticalDistanceMap returns the optical distances of the read
+// groups in data, one read group and its distance per line, separated
+// by whitespace. Empty lines are ignored.
+func parseOpticalDistanceMap(data []byte) (map[string]int, error) {
+	distances := make(map[string]int)
+	for i, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("line %d (%s) must have a read group and a distance", i+1, strings.TrimSpace(line))
+		}
+		if _, ok := distances[fields[0]]; ok {
+			return nil, fmt.Errorf("duplicate read group %s", fields[0])
+		}
+		distance, err := strconv.Atoi(fields[1])
+		if err != nil || distance < 0 {
+			return nil, fmt.Errorf("line %d (%s) must have a non-negative distance", i+1, strings.TrimSpace(line))
+		}
+		distances[fields[0]] = distance
+	}
+	return distances, nil
+}
+
+// hasPatternedFlowcell returns true if the PM or PL field of readGroup
+// names an instrument with patterned flowcells.
+func hasPatternedFlowcell(readGroup *sam.ReadGroup) bool {
+	for _, tag := range []sam.Tag{platformModelTag, platformTag} {
+		model := strings.ToLower(strings.Replace(readGroup.Get(tag), " ", "", -1))
+		for _, prefix := range patternedFlowcellModels {
+			if strings.HasPrefix(model, prefix) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// readGroupOpticalDistances returns the optical distances of the read
+// groups that do not use the distance of the optical detector: those
+// of opts.OpticalPixelDistanceByReadGroup, and with
+// opts.OpticalDistanceFromPlatform, those of the read groups of header
+// with patterned flowcells.
+func readGroupOpticalDistances(header *sam.Header, opts *Opts) map[string]int {
+	distances := make(map[string]int)
+	if opts.OpticalDistanceFromPlatform {
+		for _, readGroup := range header.RGs() {
+			if hasPatternedFlowcell(readGroup) {
+				distances[readGroup.Name()] = patternedFlowcellDistance
+			}
+		}
+	}
+	for readGroup, distance := range opts.OpticalPixelDistanceByReadGroup {
+		distances[readGroup] = distance
+	}
+	return distances
+}
+
+// distance returns the optical distance of the readpairs of readGroup.
+func (t *TileOpticalDetector) distance(readGroup string) int {
+	if distance, ok := t.OpticalDistanceByReadGroup[readGroup]; ok {
+		return distance
+	}
+	return t.OpticalDistance
+}
+
+// appliedOpticalDistances returns the optical distance that t applies
+// to each read group of header, and to those of
+// t.OpticalDistanceByReadGroup, or nil if t has no distances by read
+// group.
+func appliedOpticalDistances(header *sam.Header, t *TileOpticalDetector) map[string]int {
+	if len(t.OpticalDistanceByReadGroup) == 0 {
+		return nil
+	}
+	distances := make(map[string]int)
+	for _, readGroup := range header.RGs() {
+		distances[readGroup.Name()] = t.distance(readGroup.Name())
+	}
+	for readGroup, distance := range t.OpticalDistanceByReadGroup {
+		distances[readGroup] = distance
+	}
+	return distances
+}
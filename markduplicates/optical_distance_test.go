@@ -0,0 +1,156 @@
+// Copyright 2019 Grail Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package markduplicates
+
+import (
+	"context"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/Schaudge/grailbio/encoding/bamprovider"
+	"github.com/Schaudge/hts/sam"
+	"github.com/grailbio/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func opticalDistanceHeader(t *testing.T) *sam.Header {
+	return newTestHeader(t, "@RG\tID:nova\tPL:ILLUMINA\tPM:NovaSeq 6000\n"+
+		"@RG\tID:hiseq\tPL:ILLUMINA\tPM:HiSeq 2500\n"+
+		"@RG\tID:hiseqx\tPL:HiSeq X Ten\n")
+}
+
+func TestParseOpticalDistanceMap(t *testing.T) {
+	tests := []struct {
+		data     string
+		expected map[string]int
+		err      string
+	}{
+		{"rg1\t2500\n\nrg2 100\r\n", map[string]int{"rg1": 2500, "rg2": 100}, ""},
+		{"", map[string]int{}, ""},
+		{"rg1\t2500\nrg2\n", nil, "line 2 (rg2) must have a read group and a distance"},
+		{"rg1\t2500\nrg1\t100\n", nil, "duplicate read group rg1"},
+		{"rg1\tfar\n", nil, "line 1 (rg1\tfar) must have a non-negative distance"},
+		{"rg1\t-1\n", nil, "line 1 (rg1\t-1) must have a non-negative distance"},
+	}
+	for _, test := range tests {
+		distances, err := parseOpticalDistanceMap([]byte(test.data))
+		if test.err != "" {
+			assert.Error(t, err, "data %q", test.data)
+			if err != nil {
+				assert.Contains(t, err.Error(), test.err, "data %q", test.data)
+			}
+			continue
+		}
+		assert.NoError(t, err, "data %q", test.data)
+		assert.Equal(t, test.expected, distances, "data %q", test.data)
+	}
+}
+
+func TestReadGroupOpticalDistances(t *testing.T) {
+	h := opticalDistanceHeader(t)
+	assert.Equal(t, map[string]int{}, readGroupOpticalDistances(h, &Opts{}))
+	assert.Equal(t, map[string]int{"nova": 2500, "hiseqx": 2500},
+		readGroupOpticalDistances(h, &Opts{OpticalDistanceFromPlatform: true}))
+	assert.Equal(t, map[string]int{"nova": 2500, "hiseqx": 1000, "rg4": 50},
+		readGroupOpticalDistances(h, &Opts{
+			OpticalDistanceFromPlatform:     true,
+			OpticalPixelDistanceByReadGroup: map[string]int{"hiseqx": 1000, "rg4": 50},
+		}))
+
+	detector := &TileOpticalDetector{OpticalDistance: 100}
+	assert.Nil(t, appliedOpticalDistances(h, detector))
+	detector.OpticalDistanceByReadGroup = map[string]int{"nova": 2500, "rg4": 50}
+	assert.Equal(t, 2500, detector.distance("nova"))
+	assert.Equal(t, 100, detector.distance("hiseq"))
+	assert.Equal(t, 100, detector.distance(""))
+	assert.Equal(t, map[string]int{"nova": 2500, "hiseq": 100, "hiseqx": 100, "rg4": 50},
+		appliedOpticalDistances(h, detector))
+}
+
+// Test that the optical duplicates of each read group are found with
+// the distance of the read group, and that the distances are reported
+// in the metrics.
+func TestOpticalDistanceByReadGroup(t *testing.T) {
+	// The readpairs of each duplicate set are 1000 pixels apart on the
+	// same tile, so they are optical duplicates with the 2500 pixels of
+	// nova and hiseqx, but not with the 100 pixels of hiseq.
+	sets := []struct {
+		readGroup string
+		pos       int
+		dt        string
+	}{
+		{"nova", 100, "SQ"},
+		{"hiseq", 300, "LB"},
+		{"hiseqx", 500, "SQ"},
+	}
+	newRecords := func() []*sam.Record {
+		var records []*sam.Record
+		for _, set := range sets {
+			rg := NewAux("RG", set.readGroup)
+			names := []string{set.readGroup + "A:::1:10:1000:1000", set.readGroup + "B:::1:10:2000:1000"}
+			for _, name := range names {
+				records = append(records, NewRecordAux(name, chr1, set.pos, r1F, set.pos+100, chr1, cigar0, rg))
+			}
+			for _, name := range names {
+				records = append(records, NewRecordAux(name, chr1, set.pos+100, r2R, set.pos, chr1, cigar0, rg))
+			}
+		}
+		return records
+	}
+
+	tempDir, cleanup := testutil.TempDir(t, "", "")
+	defer cleanup()
+	for testIdx, format := range []string{"bam", "pam"} {
+		opts := defaultOpts
+		opts.OutputPath = NewTestOutput(tempDir, testIdx, format)
+		opts.Format = format
+		opts.ShardSize = 1000
+		opts.OpticalDetector = &TileOpticalDetector{OpticalDistance: 100}
+		opts.OpticalDistanceFromPlatform = true
+		opts.MetricsFile = filepath.Join(tempDir, format+".metrics.txt")
+
+		markDuplicates := &MarkDuplicates{
+			Provider: bamprovider.NewFakeProvider(opticalDistanceHeader(t), newRecords()),
+			Opts:     &opts,
+		}
+		actualMetrics, err := markDuplicates.Mark(nil)
+		if !assert.NoError(t, err, "format %s", format) {
+			continue
+		}
+
+		dtTags := map[string]string{}
+		for _, r := range ReadRecords(t, opts.OutputPath) {
+			if aux := r.AuxFields.Get(dtTag); aux != nil {
+				rg, _ := getReadGroup(r)
+				dtTags[rg] = aux.Value().(string)
+			}
+		}
+		for _, set := range sets {
+			assert.Equal(t, set.dt, dtTags[set.readGroup], "format %s, read group %s", format, set.readGroup)
+		}
+
+		expectedDistances := map[string]int{"nova": 2500, "hiseq": 100, "hiseqx": 2500}
+		assert.Equal(t, expectedDistances, actualMetrics.OpticalPixelDistances, "format %s", format)
+		doc := newJSONMetricsDocument(&opts, actualMetrics)
+		assert.Equal(t, expectedDistances, doc.Global.OpticalPixelDistances, "format %s", format)
+		if assert.NoError(t, WriteMetrics(context.Background(), &opts, actualMetrics), "format %s", format) {
+			contents, err := ioutil.ReadFile(opts.MetricsFile)
+			assert.NoError(t, err, "format %s", format)
+			assert.Contains(t, string(contents), "# optical pixel distance of read group 'hiseq': 100\n"+
+				"# optical pixel distance of read group 'hiseqx': 2500\n"+
+				"# optical pixel distance of read group 'nova': 2500\n", "format %s", format)
+		}
+	}
+}
@@ -0,0 +1,84 @@
+// Copyright 2019 Grail Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package markduplicates
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/Schaudge/grailbase/errors"
+)
+
+// opticalScatterWriter writes the flowcell locations of duplicate
+// readpairs to a tab separated file, for plotting where duplicates
+// fall on the flowcell. It is safe for concurrent use.
+type opticalScatterWriter struct {
+	path  string
+	f     *os.File
+	w     *bufio.Writer
+	err   error
+	mutex sync.Mutex
+}
+
+// newOpticalScatterWriter creates the scatter file at path and writes
+// its header.
+func newOpticalScatterWriter(path string) (*opticalScatterWriter, error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, errors.E(err, "Couldn't create optical scatter file:", path)
+	}
+	s := &opticalScatterWriter{
+		path: path,
+		f:    f,
+		w:    bufio.NewWriter(f),
+	}
+	_, s.err = s.w.WriteString("lane\ttile\tsurface\tswath\tx\ty\tduplicate_set_size\toptical\n")
+	return s, nil
+}
+
+// write writes a line for each location. bagSize is the size of the
+// duplicate set the locations came from.
+func (s *opticalScatterWriter) write(bagSize int, locations []sampledLocation) {
+	var b strings.Builder
+	for _, l := range locations {
+		fmt.Fprintf(&b, "%s\t%s\t%d\t%d\t%d\t%d\t%d\t%t\n", l.location.Lane, l.location.TileName,
+			l.location.Surface, l.location.Swath, l.location.X, l.location.Y, bagSize, l.optical)
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.err == nil {
+		_, s.err = s.w.WriteString(b.String())
+	}
+}
+
+// Close flushes and closes the scatter file, and returns the first
+// error encountered while writing it.
+func (s *opticalScatterWriter) Close() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.err == nil {
+		s.err = s.w.Flush()
+	}
+	if err := s.f.Close(); s.err == nil {
+		s.err = err
+	}
+	if s.err != nil {
+		return errors.E(s.err, "error writing to optical scatter file:", s.path)
+	}
+	return nil
+}
@@ -0,0 +1,518 @@
+// Copyright 2019 Grail Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package markduplicates
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"testing"
+
+	"github.com/grailbio/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseLocation(t *testing.T) {
+	tests := []struct {
+		qname    string
+		expected PhysicalLocation
+	}{
+		{
+			"A:::1:1203:10:20",
+			PhysicalLocation{Lane: "1", LaneNumber: 1, Surface: 1, Swath: 2, TileName: "1203",
+				TileNumber: 3, X: 10, Y: 20},
+		},
+		{
+			"M1:100:FC1:2:12304:11:21",
+			PhysicalLocation{Flowcell: "FC1", RunID: "100", Lane: "2", LaneNumber: 2, Surface: 1, Swath: 2,
+				Section: 3, TileName: "12304", TileNumber: 4, X: 11, Y: 21},
+		},
+		{
+			"M1:100:FC1:3:1101:12:22:ACGT+TTGA",
+			PhysicalLocation{Flowcell: "FC1", RunID: "100", Lane: "3", LaneNumber: 3, Surface: 1, Swath: 1,
+				TileName: "1101", TileNumber: 1, X: 12, Y: 22, UMI: "ACGT+TTGA"},
+		},
+		{
+			"A00123:H7GJ3DSXY:2:1101:10004:1000",
+			PhysicalLocation{Flowcell: "H7GJ3DSXY", Lane: "2", LaneNumber: 2, Surface: 1, Swath: 1,
+				TileName: "1101", TileNumber: 1, X: 10004, Y: 1000},
+		},
+		{
+			"VH00321:AAAW3KMM5:1:11102:23451:1063",
+			PhysicalLocation{Flowcell: "AAAW3KMM5", Lane: "1", LaneNumber: 1, Surface: 1, Swath: 1,
+				Section: 1, TileName: "11102", TileNumber: 2, X: 23451, Y: 1063},
+		},
+		{
+			// 9 fields, the trailing fields are not numeric.
+			"M1:100:FC1:3:1101:12:22:ACGT+TTGA:x",
+			PhysicalLocation{Lane: "3", LaneNumber: 3, Surface: 1, Swath: 1, TileName: "1101",
+				TileNumber: 1, X: 12, Y: 22},
+		},
+		{
+			"G:1:R012C045:13:23",
+			PhysicalLocation{Lane: "1", LaneNumber: 1, TileName: "R012C045", TileNumber: 12045, X: 13, Y: 23},
+		},
+		{
+			"V300016728L1C001R0010001234",
+			PhysicalLocation{Flowcell: "V300016728", Lane: "1", LaneNumber: 1, TileName: "C001R001",
+				TileNumber: 1001, X: 234, Y: 1},
+		},
+		{
+			"V300016728L4C012R0340123456",
+			PhysicalLocation{Flowcell: "V300016728", Lane: "4", LaneNumber: 4, TileName: "C012R034",
+				TileNumber: 12034, X: 456, Y: 123},
+		},
+		{
+			"CL100025598L2C003R045_12345",
+			PhysicalLocation{Flowcell: "CL100025598", Lane: "2", LaneNumber: 2, TileName: "C003R045",
+				TileNumber: 3045, X: 345, Y: 12},
+		},
+	}
+	for _, test := range tests {
+		location, err := ParseLocation(test.qname)
+		assert.NoError(t, err, test.qname)
+		assert.Equal(t, test.expected, location, test.qname)
+	}
+}
+
+func TestParseLocationErrors(t *testing.T) {
+	for _, qname := range []string{
+		"",
+		"A",
+		"A:B:C",
+		"A:B:C:D:E:F:G:H:I",
+		"1:2:3",
+		"A:::1:1203:x:20",
+		"A:::1:1203:10:y",
+		"A:::1:123456:10:20",
+		"G:1:RxxxCyyy:13:23",
+		"V300016728L1C001R001",
+		"V300016728C001R0010001234",
+	} {
+		_, err := ParseLocation(qname)
+		assert.Error(t, err, qname)
+	}
+}
+
+func TestDNBSEQNeighbouringRows(t *testing.T) {
+	// Spots 1234 and 2235 are in neighbouring rows of the FOV, although
+	// their indexes are 1001 apart, and spot 1999 is at the other end
+	// of the row of 1234.
+	a, err := ParseLocation("V300016728L1C001R0010001234")
+	assert.NoError(t, err)
+	b, err := ParseLocation("V300016728L1C001R0010002235")
+	assert.NoError(t, err)
+	c, err := ParseLocation("V300016728L1C001R0010001999")
+	assert.NoError(t, err)
+	assert.Equal(t, 1, opticalDistance(&a, &b))
+	assert.Equal(t, 765, opticalDistance(&a, &c))
+}
+
+func TestCheckUnparseableNames(t *testing.T) {
+	metrics := NewMetricsCollection()
+	opts := Opts{MaxUnparseableNameFraction: 0.01}
+	assert.NoError(t, checkUnparseableNames(&opts, metrics))
+
+	metrics.OpticalNamesExamined = 1000
+	metrics.UnparseableNames = 10
+	assert.NoError(t, checkUnparseableNames(&opts, metrics))
+
+	metrics.UnparseableNames = 11
+	assert.Error(t, checkUnparseableNames(&opts, metrics))
+
+	// The zero value of the option is the default fraction.
+	opts.MaxUnparseableNameFraction = 0
+	assert.Error(t, checkUnparseableNames(&opts, metrics))
+	metrics.UnparseableNames = 10
+	assert.NoError(t, checkUnparseableNames(&opts, metrics))
+}
+
+func TestHasNoLocation(t *testing.T) {
+	for _, qname := range []string{
+		"m64011_190830_220126/1/ccs",
+		"m54006_160504_020705/4194370/0_1234",
+		"0a4c2bd2-8c2f-4e1d-9f4b-6a1f3e6c7d8e",
+	} {
+		assert.True(t, hasNoLocation(qname), qname)
+	}
+	for _, qname := range []string{
+		"A:::1:1203:10:20",
+		"V300016728L1C001R0010001234",
+		"m64011",
+	} {
+		assert.False(t, hasNoLocation(qname), qname)
+	}
+}
+
+func TestParseLocationRegex(t *testing.T) {
+	re := regexp.MustCompile(`^read_[0-9]+_([0-9]+)_([0-9]+)_([0-9]+)$`)
+	tests := []struct {
+		qname    string
+		expected PhysicalLocation
+	}{
+		{
+			"read_17_1203_10_20",
+			PhysicalLocation{Surface: 1, Swath: 2, TileName: "1203", TileNumber: 3, X: 10, Y: 20},
+		},
+		{
+			"read_18_12304_11_21",
+			PhysicalLocation{Surface: 1, Swath: 2, Section: 3, TileName: "12304", TileNumber: 4,
+				X: 11, Y: 21},
+		},
+	}
+	for _, test := range tests {
+		location, err := ParseLocationRegex(re, test.qname)
+		assert.NoError(t, err, test.qname)
+		assert.Equal(t, test.expected, location, test.qname)
+	}
+
+	for _, qname := range []string{
+		"A:::1:1203:10:20",
+		"read_19_123456_10_20",
+		"read_20_1203_10",
+	} {
+		_, err := ParseLocationRegex(re, qname)
+		assert.Error(t, err, qname)
+	}
+}
+
+func TestParseLocationNormalizesName(t *testing.T) {
+	expected := PhysicalLocation{Flowcell: "FLOW", RunID: "1", Lane: "1", LaneNumber: 1, Surface: 2,
+		Swath: 1, TileName: "2104", TileNumber: 4, X: 12345, Y: 67890}
+	for _, qname := range []string{
+		"MACHINE:1:FLOW:1:2104:12345:67890",
+		"MACHINE:1:FLOW:1:2104:12345:67890/1",
+		"MACHINE:1:FLOW:1:2104:12345:67890/2",
+		"MACHINE:1:FLOW:1:2104:12345:67890/3",
+		"MACHINE:1:FLOW:1:2104:12345:67890 1:N:0:ACGTACGT",
+		"MACHINE:1:FLOW:1:2104:12345:67890\tBC:Z:ACGTACGT",
+		"MACHINE:1:FLOW:1:2104:12345:67890/1 1:N:0:ACGTACGT",
+	} {
+		location, err := ParseLocation(qname)
+		assert.NoError(t, err, qname)
+		assert.Equal(t, expected, location, qname)
+	}
+
+	r1, err := ParseLocation("MACHINE:1:FLOW:1:2104:12345:67890/1")
+	assert.NoError(t, err)
+	r2, err := ParseLocation("MACHINE:1:FLOW:1:2104:12345:67890/2")
+	assert.NoError(t, err)
+	assert.Equal(t, 0, opticalDistance(&r1, &r2))
+
+	location, err := ParseLocation("V300016728L1C001R0010001234/1")
+	assert.NoError(t, err)
+	assert.Equal(t, PhysicalLocation{Flowcell: "V300016728", Lane: "1", LaneNumber: 1,
+		TileName: "C001R001", TileNumber: 1001, X: 234, Y: 1}, location)
+
+	_, err = ParseLocation("MACHINE:1:FLOW:1:2104:12345:67890/4")
+	assert.Error(t, err)
+}
+
+func benchmarkOpticalDistances(b *testing.B, cached bool) {
+	pairs := make([]DuplicateEntry, 0, 100)
+	for i := 0; i < 100; i++ {
+		name := fmt.Sprintf("M1:100:FC1:1:1101:%d:%d", i, 2*i)
+		pairs = append(pairs, IndexedPair{
+			Left:  IndexedSingle{NewRecord(name, chr1, 0, r1F, 100, chr1, cigar0), uint64(2 * i)},
+			Right: IndexedSingle{NewRecord(name, chr1, 100, r2R, 0, chr1, cigar0), uint64(2*i + 1)},
+		})
+	}
+	opts := Opts{OpticalHistogram: "optical-histogram.txt", OpticalHistogramMax: -1}
+	detector := TileOpticalDetector{OpticalDistance: 2500}
+	metrics := NewMetricsCollection()
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if cached {
+			// Start each iteration with an empty cache, as in a new shard.
+			for j := range pairs {
+				p := pairs[j].(IndexedPair)
+				p.loc = &locationCache{}
+				pairs[j] = p
+			}
+		}
+		detector.Detect(nil, pairs, 0)
+		addOpticalDistances(&opts, nil, nil, pairs, nil, nil, metrics)
+	}
+}
+
+func BenchmarkOpticalDistancesUncached(b *testing.B) { benchmarkOpticalDistances(b, false) }
+func BenchmarkOpticalDistancesCached(b *testing.B)   { benchmarkOpticalDistances(b, true) }
+
+func TestTileID(t *testing.T) {
+	tests := []struct {
+		qname    string
+		expected int
+	}{
+		{"A:::1:1203:10:20", 120000003},
+		{"A:::1:2104:10:20", 210000004},
+		{"A:::1:12304:10:20", 123000004},
+		{"A:::1:22616:10:20", 226000016},
+		{"G:1:R012C045:13:23", 12045},
+	}
+	for _, test := range tests {
+		location, err := ParseLocation(test.qname)
+		assert.NoError(t, err, test.qname)
+		assert.Equal(t, test.expected, location.TileID(), test.qname)
+	}
+
+	a, _ := ParseLocation("A:::1:1203:10:20")
+	b, _ := ParseLocation("A:::2:1203:99:99")
+	c, _ := ParseLocation("A:::1:1204:10:20")
+	assert.Equal(t, a.TileID(), b.TileID())
+	assert.True(t, a.TileID() < c.TileID())
+}
+
+func randomLocations(r *rand.Rand, n, width int) []PhysicalLocation {
+	locations := make([]PhysicalLocation, n)
+	for i := range locations {
+		locations[i] = PhysicalLocation{X: r.Intn(width), Y: r.Intn(width)}
+	}
+	return locations
+}
+
+func TestAddTileDistancesGrid(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	for _, maxDistance := range []int{1, 10, 100, 2500} {
+		a := randomLocations(r, 500, 3000)
+		b := randomLocations(r, 300, 3000)
+		for _, test := range []struct {
+			metric DistanceMetric
+			other  []PhysicalLocation
+		}{
+			{EuclideanDistance, nil},
+			{EuclideanDistance, b},
+			{PerAxisDistance, nil},
+			{PerAxisDistance, b},
+		} {
+			other := test.other
+			bruteForce := NewMetricsCollection()
+			total := addTileDistances(bruteForce, test.metric, 2, 0, a, other)
+			grid := NewMetricsCollection()
+			added := addTileDistances(grid, test.metric, 2, maxDistance, a, other)
+
+			var below int64
+			for d := 0; d < maxDistance; d++ {
+				assert.Equal(t, bruteForce.OpticalDistance[0][d], grid.OpticalDistance[0][d],
+					"maxDistance %d distance %d", maxDistance, d)
+				below += bruteForce.OpticalDistance[0][d]
+			}
+			assert.Equal(t, below, added, "maxDistance %d", maxDistance)
+			for d := maxDistance; d < len(grid.OpticalDistance[0]); d++ {
+				assert.Equal(t, int64(0), grid.OpticalDistance[0][d])
+			}
+			assert.True(t, total >= added)
+		}
+	}
+}
+
+func TestOpticalHistogramMaxDistance(t *testing.T) {
+	var pairs []DuplicateEntry
+	for i, xy := range [][2]int{{0, 0}, {0, 5}, {0, 50}, {3000, 3000}} {
+		name := fmt.Sprintf("A:::1:1101:%d:%d", xy[0], xy[1])
+		pairs = append(pairs, IndexedPair{
+			Left:  IndexedSingle{NewRecord(name, chr1, 0, r1F, 100, chr1, cigar0), uint64(2 * i)},
+			Right: IndexedSingle{NewRecord(name, chr1, 100, r2R, 0, chr1, cigar0), uint64(2*i + 1)},
+			loc:   &locationCache{},
+		})
+	}
+	opts := Opts{OpticalHistogram: "optical-histogram.txt", OpticalHistogramMax: -1, OpticalHistogramMaxDistance: 10}
+	metrics := NewMetricsCollection()
+	addOpticalDistances(&opts, nil, nil, pairs, nil, nil, metrics)
+
+	// Of the 6 distances, only 0-5 is below 10.
+	assert.Equal(t, int64(1), metrics.OpticalDistance[1][5])
+	assert.Equal(t, []int64{0, 5, 0, 0}, metrics.OpticalDistanceOverflow)
+	var total int64
+	for _, count := range metrics.OpticalDistance[1] {
+		total += count
+	}
+	assert.Equal(t, int64(1), total)
+}
+
+// benchmarkTileDistances compares 200k locations on a single tile, as
+// in a high-duplication amplicon library. The brute force version
+// takes on the order of a minute per iteration.
+func benchmarkTileDistances(b *testing.B, maxDistance int) {
+	locations := randomLocations(rand.New(rand.NewSource(1)), 200000, 30000)
+	metrics := NewMetricsCollection()
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		addTileDistances(metrics, EuclideanDistance, 8, maxDistance, locations, nil)
+	}
+}
+
+func BenchmarkTileDistancesBruteForce(b *testing.B) { benchmarkTileDistances(b, 0) }
+func BenchmarkTileDistancesGrid(b *testing.B)       { benchmarkTileDistances(b, 100) }
+
+func TestDistanceMetric(t *testing.T) {
+	a := PhysicalLocation{X: 0, Y: 0}
+	b := PhysicalLocation{X: 90, Y: 90}
+	assert.Equal(t, 127, EuclideanDistance.distance(&a, &b))
+	assert.Equal(t, 127, DistanceMetric("").distance(&a, &b))
+	assert.Equal(t, 90, PerAxisDistance.distance(&a, &b))
+
+	assert.False(t, isOpticalDup(EuclideanDistance, 100, &a, &b))
+	assert.True(t, isOpticalDup(PerAxisDistance, 100, &a, &b))
+	assert.True(t, isOpticalDup("", 100, &a, &b))
+
+	for _, s := range []string{"", "euclidean", "per-axis"} {
+		m, err := ParseDistanceMetric(s)
+		assert.NoError(t, err)
+		assert.Equal(t, DistanceMetric(s), m)
+	}
+	_, err := ParseDistanceMetric("manhattan")
+	assert.Error(t, err)
+}
+
+func TestWriteOpticalHistogramFile(t *testing.T) {
+	tempDir, cleanup := testutil.TempDir(t, "", "")
+	defer cleanup()
+
+	metrics := NewMetricsCollection()
+	metrics.AddDistance(2, 5)
+	metrics.AddDistance(2, 5)
+	metrics.AddDistance(8, 0)
+	metrics.AddDistanceOverflow(3, 4)
+
+	opts := Opts{
+		OpticalHistogramFile:        filepath.Join(tempDir, "histogram.tsv"),
+		OpticalHistogramMaxDistance: 100,
+	}
+	assert.NoError(t, writeOpticalHistogramFile(context.Background(), &opts, metrics))
+	contents, err := ioutil.ReadFile(opts.OpticalHistogramFile)
+	assert.NoError(t, err)
+	assert.Equal(t, "bin_lower\tbin_upper\tcount\tduplicate_set_size_bucket\n"+
+		"5\t6\t2\tbagsize-2\n"+
+		"100\t-1\t4\tbagsize3-4\n"+
+		"0\t1\t1\tbagsize8-\n", string(contents))
+
+	opts.OpticalHistogramFile = filepath.Join(tempDir, "histogram.json")
+	opts.OpticalHistogramFormat = "json"
+	assert.NoError(t, writeOpticalHistogramFile(context.Background(), &opts, metrics))
+	contents, err = ioutil.ReadFile(opts.OpticalHistogramFile)
+	assert.NoError(t, err)
+	var rows []opticalHistogramRow
+	assert.NoError(t, json.Unmarshal(contents, &rows))
+	assert.Equal(t, []opticalHistogramRow{
+		{5, 6, 2, "bagsize-2"},
+		{100, -1, 4, "bagsize3-4"},
+		{0, 1, 1, "bagsize8-"},
+	}, rows)
+
+	// Rewriting replaces the file with identical contents, and leaves
+	// no temporary files behind.
+	assert.NoError(t, writeOpticalHistogramFile(context.Background(), &opts, metrics))
+	rewritten, err := ioutil.ReadFile(opts.OpticalHistogramFile)
+	assert.NoError(t, err)
+	assert.Equal(t, contents, rewritten)
+	files, err := ioutil.ReadDir(tempDir)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(files))
+}
+
+// BenchmarkAddOpticalDistancesSampled samples 2000 of a set of 1M
+// duplicates, which only keeps the sampled locations in memory.
+func BenchmarkAddOpticalDistancesSampled(b *testing.B) {
+	pairs := make([]DuplicateEntry, 0, 1000000)
+	for i := 0; i < cap(pairs); i++ {
+		name := fmt.Sprintf("M1:100:FC1:1:1101:%d:%d", i%30000, i/30000)
+		pairs = append(pairs, IndexedPair{
+			Left:  IndexedSingle{NewRecord(name, chr1, 0, r1F, 100, chr1, cigar0), uint64(2 * i)},
+			Right: IndexedSingle{NewRecord(name, chr1, 100, r2R, 0, chr1, cigar0), uint64(2*i + 1)},
+			loc:   &locationCache{},
+		})
+	}
+	opts := Opts{OpticalHistogram: "optical-histogram.txt", OpticalHistogramMax: 2000}
+	metrics := NewMetricsCollection()
+	addOpticalDistances(&opts, nil, nil, pairs, nil, nil, metrics)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		addOpticalDistances(&opts, nil, nil, pairs, nil, nil, metrics)
+	}
+}
+
+func TestLocationSample(t *testing.T) {
+	locations := randomLocations(rand.New(rand.NewSource(1)), 100, 1000)
+	priorities := make([]uint64, len(locations))
+	for i := range priorities {
+		priorities[i] = samplePriority(7, fmt.Sprint(i))
+	}
+
+	var samples [][]PhysicalLocation
+	for _, order := range [][]int{rand.New(rand.NewSource(2)).Perm(100), rand.New(rand.NewSource(3)).Perm(100)} {
+		sample := locationSample{max: 10}
+		for _, i := range order {
+			sample.add(sampledLocation{priority: priorities[i], location: locations[i]})
+		}
+		sampled := sample.locations()
+		assert.Equal(t, 10, len(sampled))
+		sort.Slice(sampled, func(i, j int) bool {
+			return sampled[i].X < sampled[j].X || (sampled[i].X == sampled[j].X && sampled[i].Y < sampled[j].Y)
+		})
+		samples = append(samples, sampled)
+	}
+	assert.Equal(t, samples[0], samples[1])
+
+	all := locationSample{max: -1}
+	none := locationSample{max: 0}
+	for i := range locations {
+		all.add(sampledLocation{priority: priorities[i], location: locations[i]})
+		none.add(sampledLocation{priority: priorities[i], location: locations[i]})
+	}
+	assert.Equal(t, locations, all.locations())
+	assert.Equal(t, 0, len(none.locations()))
+}
+
+func TestOpticalDistancesParallel(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	var pairs []DuplicateEntry
+	for i := 0; i < 6000; i++ {
+		name := fmt.Sprintf("M1:100:FC1:%d:110%d:%d:%d", 1+i%4, 1+r.Intn(3), r.Intn(20000), r.Intn(20000))
+		pairs = append(pairs, IndexedPair{
+			Left:  IndexedSingle{NewRecord(name, chr1, 0, r1F, 100, chr1, cigar0), uint64(2 * i)},
+			Right: IndexedSingle{NewRecord(name, chr1, 100, r2R, 0, chr1, cigar0), uint64(2*i + 1)},
+			loc:   &locationCache{},
+		})
+	}
+
+	for _, maxDistance := range []int{0, 1000} {
+		var results []*MetricsCollection
+		for _, parallelism := range []int{1, 4} {
+			opts := Opts{
+				OpticalHistogram:            "optical-histogram.txt",
+				OpticalHistogramMax:         -1,
+				OpticalHistogramMaxDistance: maxDistance,
+				OpticalAdjacentTiles:        true,
+				Parallelism:                 parallelism,
+			}
+			metrics := NewMetricsCollection()
+			addOpticalDistances(&opts, nil, nil, pairs, nil, nil, metrics)
+			results = append(results, metrics)
+		}
+		assert.Equal(t, results[0].OpticalDistance, results[1].OpticalDistance)
+		assert.Equal(t, results[0].OpticalDistanceOverflow, results[1].OpticalDistanceOverflow)
+		assert.Equal(t, results[0].CrossTilePairsSkipped, results[1].CrossTilePairsSkipped)
+		assert.True(t, results[0].CrossTilePairsSkipped > 0)
+	}
+}
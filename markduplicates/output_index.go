@@ -0,0 +1,400 @@
+// Copyright 2019 Grail Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package markduplicates
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sort"
+
+	"github.com/Schaudge/grailbio/encoding/bamprovider"
+	"github.com/Schaudge/hts/bam"
+	"github.com/Schaudge/hts/bgzf"
+	"github.com/Schaudge/hts/csi"
+	"github.com/Schaudge/hts/sam"
+)
+
+// The coordinate sorted BAM output is indexed as it is written, so
+// that it does not have to be read again by samtools index. The
+// bytes of the output are also written to a pipe, whose BGZF blocks
+// are decompressed and indexed with the same virtual offsets as
+// samtools index would find in the file. The output bytes do not
+// change. The index is written next to the output, to
+// Opts.OutputPath.bai or Opts.OutputPath.csi, when the output is
+// closed.
+
+// Values of Opts.IndexFormat.
+const (
+	indexFormatBAI  = "bai"
+	indexFormatCSI  = "csi"
+	indexFormatNone = "none"
+)
+
+const (
+	// baiMaxLen is the largest reference length that a BAI index
+	// can index.
+	baiMaxLen = 1 << 29
+	// csiMinShift is the CSI min_shift of samtools index -c.
+	csiMinShift = 14
+)
+
+// outputIndexFormat returns the format of the index of the coordinate
+// sorted output, or of each file of Opts.SplitOutputByReference, or
+// "none" if the output is not indexed because it is written to stdout
+// or is pam. If Opts.IndexFormat is not set, the
+// index is CSI if a reference of header is longer than a BAI index
+// allows, and BAI otherwise. Queryname grouped output is never
+// indexed.
+func outputIndexFormat(opts *Opts, header *sam.Header) string {
+	if opts.IndexFormat == indexFormatNone || (isStdout(opts.OutputPath) && opts.SplitOutputByReference == "") ||
+		bamprovider.ParseFileType(opts.Format) != bamprovider.BAM {
+		return indexFormatNone
+	}
+	if opts.IndexFormat != "" {
+		return opts.IndexFormat
+	}
+	for _, ref := range header.Refs() {
+		if ref.Len() > baiMaxLen {
+			return indexFormatCSI
+		}
+	}
+	return indexFormatBAI
+}
+
+// csiDepth returns the CSI depth of an index of the references of
+// header, the number of levels of bins above min_shift needed to
+// cover the longest reference, like samtools index -c.
+func csiDepth(header *sam.Header) int {
+	var maxLen int64
+	for _, ref := range header.Refs() {
+		if int64(ref.Len()) > maxLen {
+			maxLen = int64(ref.Len())
+		}
+	}
+	maxLen += 256
+	depth := 0
+	for span := int64(1) << csiMinShift; maxLen > span; span <<= 3 {
+		depth++
+	}
+	return depth
+}
+
+// csiBin returns the CSI bin of the interval [beg, end), like htslib's
+// hts_reg2bin.
+func csiBin(beg, end int64, minShift, depth int) uint32 {
+	end--
+	s := uint(minShift)
+	t := int64((1<<(uint(depth)*3))-1) / 7
+	for l := depth; l > 0; l-- {
+		if beg>>s == end>>s {
+			return uint32(t + beg>>s)
+		}
+		s += 3
+		t -= 1 << (uint(l-1) * 3)
+	}
+	return 0
+}
+
+// bamIndex is the index of a coordinate sorted BAM, which is built
+// from its records in file order.
+type bamIndex interface {
+	// add indexes r, which is stored at c of the BAM.
+	add(r *sam.Record, c bgzf.Chunk) error
+	// write writes the index to w.
+	write(w io.Writer) error
+}
+
+// newBAMIndex returns an empty index of format, indexFormatBAI or
+// indexFormatCSI, for a BAM with header.
+func newBAMIndex(format string, header *sam.Header) bamIndex {
+	if format == indexFormatCSI {
+		return &csiIndex{index: csi.New(csiMinShift, csiDepth(header))}
+	}
+	return &baiIndex{refs: make([]baiRef, len(header.Refs()))}
+}
+
+// indexBAM reads the coordinate sorted BAM from in, and returns its
+// index of format.
+func indexBAM(in io.Reader, format string, header *sam.Header) (bamIndex, error) {
+	reader, err := bam.NewReader(in, 1)
+	if err != nil {
+		return nil, err
+	}
+	idx := newBAMIndex(format, header)
+	for {
+		r, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if err := idx.add(r, reader.LastChunk()); err != nil {
+			return nil, fmt.Errorf("record %s: %v, check that the BAM is coordinate sorted", r.Name, err)
+		}
+	}
+	return idx, nil
+}
+
+// isPlaced returns true if r has a reference and a position, and so
+// is in the bins of the index, even if it is unmapped.
+func isPlaced(r *sam.Record) bool {
+	return r.Ref != nil && r.Pos >= 0
+}
+
+// csiIndex is a CSI index, built by hts.
+type csiIndex struct {
+	index *csi.Index
+}
+
+func (x *csiIndex) add(r *sam.Record, c bgzf.Chunk) (err error) {
+	// hts panics on some inputs that it cannot index.
+	defer func() {
+		if p := recover(); p != nil {
+			err = fmt.Errorf("%v", p)
+		}
+	}()
+	placed := isPlaced(r)
+	return x.index.Add(r, c, placed && r.Flags&sam.Unmapped == 0, placed)
+}
+
+func (x *csiIndex) write(w io.Writer) error {
+	return csi.WriteTo(w, x.index)
+}
+
+const (
+	// baiMagic starts a BAI index.
+	baiMagic = "BAI\x01"
+	// baiMetaBin is the pseudo-bin of the BAI index, which holds the
+	// span and the read counts of a reference.
+	baiMetaBin = 37450
+	// baiDepth is the number of levels of bins above csiMinShift
+	// in a BAI index.
+	baiDepth = 5
+)
+
+// baiIndex is a BAI index, as written by samtools index. It does not
+// use the index builder of hts, which panics on valid inputs that
+// have overlapping records across a boundary of the linear index.
+type baiIndex struct {
+	refs []baiRef
+	// noCoor is the number of records without a reference or a
+	// position.
+	noCoor uint64
+	// lastRef and lastPos are those of the last placed record, to
+	// check the sort order.
+	lastRef, lastPos int
+}
+
+// baiRef is the index of a reference of a BAI index.
+type baiRef struct {
+	// bins holds the chunks of each bin.
+	bins map[uint32][]bgzf.Chunk
+	// intervals holds the offset of the first record that overlaps
+	// each window of 1<<csiMinShift bases. A zero offset is unset.
+	intervals []bgzf.Offset
+	// span is that of all the records of the reference.
+	span     bgzf.Chunk
+	mapped   uint64
+	unmapped uint64
+}
+
+func (x *baiIndex) add(r *sam.Record, c bgzf.Chunk) error {
+	if !isPlaced(r) {
+		x.noCoor++
+		return nil
+	}
+	refID := r.Ref.ID()
+	if refID < 0 || refID >= len(x.refs) {
+		return fmt.Errorf("reference %s is not in the header", r.Ref.Name())
+	}
+	if r.Pos >= baiMaxLen || r.End() > baiMaxLen {
+		return fmt.Errorf("position %d is beyond the %d bases that a BAI index allows", r.Pos, baiMaxLen)
+	}
+	if x.lastRef > refID || (x.lastRef == refID && x.lastPos > r.Pos) {
+		return fmt.Errorf("position %s:%d is before the previous record", r.Ref.Name(), r.Pos)
+	}
+	x.lastRef, x.lastPos = refID, r.Pos
+
+	ref := &x.refs[refID]
+	beg, end := r.Pos, r.End()
+	if end <= beg {
+		end = beg + 1
+	}
+	bin := csiBin(int64(beg), int64(end), csiMinShift, baiDepth)
+	if ref.bins == nil {
+		ref.bins = make(map[uint32][]bgzf.Chunk)
+		ref.span = c
+	}
+	// Records that follow each other in a bin extend its last chunk.
+	chunks := ref.bins[bin]
+	if n := len(chunks); n > 0 && chunks[n-1].End == c.Begin {
+		chunks[n-1].End = c.End
+	} else {
+		ref.bins[bin] = append(chunks, c)
+	}
+	ref.span.End = c.End
+
+	for w := beg >> csiMinShift; w <= (end-1)>>csiMinShift; w++ {
+		for len(ref.intervals) <= w {
+			ref.intervals = append(ref.intervals, bgzf.Offset{})
+		}
+		if ref.intervals[w] == (bgzf.Offset{}) {
+			ref.intervals[w] = c.Begin
+		}
+	}
+	if r.Flags&sam.Unmapped == 0 {
+		ref.mapped++
+	} else {
+		ref.unmapped++
+	}
+	return nil
+}
+
+func (x *baiIndex) write(w io.Writer) error {
+	b := bufio.NewWriter(w)
+	if _, err := b.WriteString(baiMagic); err != nil {
+		return err
+	}
+	buf := make([]byte, 8)
+	writeInt := func(v uint64, n int) {
+		if n == 4 {
+			binary.LittleEndian.PutUint32(buf, uint32(v))
+		} else {
+			binary.LittleEndian.PutUint64(buf, v)
+		}
+		b.Write(buf[:n]) // nolint: errcheck
+	}
+	writeInt(uint64(len(x.refs)), 4)
+	for _, ref := range x.refs {
+		if ref.bins == nil {
+			writeInt(0, 4)
+			writeInt(0, 4)
+			continue
+		}
+		bins := make([]uint32, 0, len(ref.bins))
+		for bin := range ref.bins {
+			bins = append(bins, bin)
+		}
+		sort.Slice(bins, func(i, j int) bool { return bins[i] < bins[j] })
+		writeInt(uint64(len(bins)+1), 4)
+		for _, bin := range bins {
+			writeInt(uint64(bin), 4)
+			writeInt(uint64(len(ref.bins[bin])), 4)
+			for _, c := range ref.bins[bin] {
+				writeInt(virtualOffset(c.Begin), 8)
+				writeInt(virtualOffset(c.End), 8)
+			}
+		}
+		writeInt(baiMetaBin, 4)
+		writeInt(2, 4)
+		writeInt(virtualOffset(ref.span.Begin), 8)
+		writeInt(virtualOffset(ref.span.End), 8)
+		writeInt(ref.mapped, 8)
+		writeInt(ref.unmapped, 8)
+
+		// A window without records starts where the previous window
+		// does, like samtools index.
+		writeInt(uint64(len(ref.intervals)), 4)
+		last := ref.span.Begin
+		for _, offset := range ref.intervals {
+			if offset != (bgzf.Offset{}) {
+				last = offset
+			}
+			writeInt(virtualOffset(last), 8)
+		}
+	}
+	writeInt(x.noCoor, 8)
+	return b.Flush()
+}
+
+// virtualOffset returns the BGZF virtual file offset of o.
+func virtualOffset(o bgzf.Offset) uint64 {
+	return uint64(o.File)<<16 | uint64(o.Block)
+}
+
+// outputIndexer builds the index of the output from a copy of its
+// bytes.
+type outputIndexer struct {
+	format string
+	path   string
+	pipe   *io.PipeWriter
+	done   chan error
+}
+
+// newOutputIndexer returns an outputIndexer that writes an index of
+// format to path, and starts indexing the bytes written to Writer.
+func newOutputIndexer(format, path string, header *sam.Header) *outputIndexer {
+	pr, pw := io.Pipe()
+	x := &outputIndexer{
+		format: format,
+		path:   path,
+		pipe:   pw,
+		done:   make(chan error, 1),
+	}
+	go func() {
+		err := x.index(pr, header)
+		// Drain the pipe, so that the output can still be written
+		// after an error.
+		io.Copy(ioutil.Discard, pr) // nolint: errcheck
+		x.done <- err
+	}()
+	return x
+}
+
+// Writer returns a writer that writes to w, and to the indexer.
+func (x *outputIndexer) Writer(w io.Writer) io.Writer {
+	return io.MultiWriter(w, x.pipe)
+}
+
+// index reads the output BAM from in, and writes its index to x.path.
+// A panic while indexing is returned as an error, so that it does not
+// end the process from the indexing goroutine.
+func (x *outputIndexer) index(in io.Reader, header *sam.Header) (err error) {
+	defer func() {
+		if p := recover(); p != nil {
+			err = fmt.Errorf("%v", p)
+		}
+	}()
+	idx, err := indexBAM(in, x.format, header)
+	if err != nil {
+		return err
+	}
+	ctx := context.Background()
+	out, err := createOutput(ctx, x.path)
+	if err != nil {
+		return err
+	}
+	if err := idx.write(out); err != nil {
+		out.Close(ctx) // nolint: errcheck
+		return err
+	}
+	return out.Close(ctx)
+}
+
+// Close waits until the output written to Writer is indexed, and the
+// index is written.
+func (x *outputIndexer) Close() error {
+	if err := x.pipe.Close(); err != nil {
+		return err
+	}
+	if err := <-x.done; err != nil {
+		return fmt.Errorf("couldn't index the output %s: %v", x.path, err)
+	}
+	return nil
+}
@@ -0,0 +1,251 @@
+// Copyright 2019 Grail Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package markduplicates
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"testing"
+
+	"github.com/Schaudge/grailbio/encoding/bamprovider"
+	"github.com/Schaudge/hts/bam"
+	"github.com/Schaudge/hts/bgzf"
+	"github.com/Schaudge/hts/csi"
+	"github.com/Schaudge/hts/sam"
+	"github.com/grailbio/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOutputIndexFormat(t *testing.T) {
+	longRef, err := sam.NewReference("chrL", "", "", baiMaxLen+1, nil, nil)
+	assert.NoError(t, err)
+	longHeader, err := sam.NewHeader(nil, []*sam.Reference{longRef})
+	assert.NoError(t, err)
+
+	for _, test := range []struct {
+		indexFormat string
+		outputPath  string
+		splitOutput string
+		format      string
+		header      *sam.Header
+		expected    string
+	}{
+		{"", "out.bam", "", "bam", header, "bai"},
+		{"", "out.bam", "", "bam", longHeader, "csi"},
+		{"csi", "out.bam", "", "bam", header, "csi"},
+		{"bai", "out.bam", "", "bam", header, "bai"},
+		{"none", "out.bam", "", "bam", header, "none"},
+		{"", "", "", "bam", header, "none"},
+		{"", "-", "", "bam", header, "none"},
+		{"", "out.pam", "", "pam", header, "none"},
+		{"", "", "out/{ref}.bam", "bam", header, "bai"},
+		{"none", "", "out/{ref}.bam", "bam", header, "none"},
+	} {
+		opts := &Opts{IndexFormat: test.indexFormat, OutputPath: test.outputPath,
+			SplitOutputByReference: test.splitOutput, Format: test.format}
+		assert.Equal(t, test.expected, outputIndexFormat(opts, test.header), "opts %+v", opts)
+	}
+}
+
+func TestCSIBin(t *testing.T) {
+	// With min_shift 14 and depth 5, the bins are those of BAI.
+	for _, test := range []struct {
+		beg, end int64
+	}{
+		{0, 1},
+		{0, 1 << 14},
+		{100, 20000},
+		{1 << 20, 1<<20 + 100},
+		{1<<26 - 10, 1<<26 + 10},
+	} {
+		r := &sam.Record{Pos: int(test.beg), Cigar: sam.Cigar{sam.NewCigarOp(sam.CigarMatch, int(test.end-test.beg))}}
+		assert.Equal(t, uint32(r.Bin()), csiBin(test.beg, test.end, csiMinShift, 5), "[%d, %d)", test.beg, test.end)
+	}
+
+	// The depth covers the longest reference, plus 256.
+	assert.Equal(t, 0, csiDepth(header))
+	ref, err := sam.NewReference("chrL", "", "", 1<<30, nil, nil)
+	assert.NoError(t, err)
+	longHeader, err := sam.NewHeader(nil, []*sam.Reference{ref})
+	assert.NoError(t, err)
+	assert.Equal(t, 6, csiDepth(longHeader))
+}
+
+func TestBAIIndex(t *testing.T) {
+	ref, err := sam.NewReference("chrT", "", "", 100000, nil, nil)
+	assert.NoError(t, err)
+	h, err := sam.NewHeader(nil, []*sam.Reference{ref})
+	assert.NoError(t, err)
+	cigar := []sam.CigarOp{sam.NewCigarOp(sam.CigarMatch, 100)}
+
+	// The records overlap each other across the boundary of the
+	// first two windows of the linear index, and an unmapped read
+	// without a position follows them.
+	var records []*sam.Record
+	for i, pos := range []int{16300, 16310, 16320, 16400, 50000} {
+		records = append(records, NewRecord(fmt.Sprintf("R%d:::1:10:1:1", i), ref, pos, r1F, -1, nil, cigar))
+	}
+	unplaced := NewRecord("U:::1:10:1:1", nil, -1, sam.Unmapped, -1, nil, nil)
+	records = append(records, unplaced)
+
+	write := func(records []*sam.Record) []byte {
+		var buf bytes.Buffer
+		w, err := bam.NewWriter(&buf, h, 1)
+		assert.NoError(t, err)
+		for _, r := range records {
+			assert.NoError(t, w.Write(r))
+		}
+		assert.NoError(t, w.Close())
+		return buf.Bytes()
+	}
+	data := write(records)
+	idx, err := indexBAM(bytes.NewReader(data), indexFormatBAI, h)
+	assert.NoError(t, err)
+	var indexData bytes.Buffer
+	assert.NoError(t, idx.write(&indexData))
+
+	index, err := bam.ReadIndex(&indexData)
+	assert.NoError(t, err)
+	stats, ok := index.ReferenceStats(0)
+	assert.True(t, ok)
+	assert.Equal(t, uint64(5), stats.Mapped)
+	unmapped, ok := index.Unmapped()
+	assert.True(t, ok)
+	assert.Equal(t, uint64(1), unmapped)
+
+	for _, test := range []struct {
+		beg, end int
+		expected []string
+	}{
+		{16390, 16400, []string{"R0:::1:10:1:1", "R1:::1:10:1:1", "R2:::1:10:1:1"}},
+		{16400, 16401, []string{"R1:::1:10:1:1", "R2:::1:10:1:1", "R3:::1:10:1:1"}},
+		{20000, 60000, []string{"R4:::1:10:1:1"}},
+	} {
+		chunks, err := index.Chunks(ref, test.beg, test.end)
+		assert.NoError(t, err)
+		reader, err := bam.NewReader(bytes.NewReader(data), 1)
+		assert.NoError(t, err)
+		iter, err := bam.NewIterator(reader, chunks)
+		assert.NoError(t, err)
+		var names []string
+		for iter.Next() {
+			r := iter.Record()
+			if r.Ref != nil && r.Start() < test.end && r.End() > test.beg {
+				names = append(names, r.Name)
+			}
+		}
+		assert.NoError(t, iter.Close())
+		assert.Equal(t, test.expected, names, "[%d, %d)", test.beg, test.end)
+	}
+
+	// An unsorted BAM is an error.
+	_, err = indexBAM(bytes.NewReader(write([]*sam.Record{records[1], records[0]})), indexFormatBAI, h)
+	assert.Error(t, err)
+}
+
+func TestOutputIndex(t *testing.T) {
+	// B is a duplicate of A.
+	records := func() []*sam.Record {
+		return []*sam.Record{
+			NewRecord("A:::1:10:1:1", chr1, 0, r1F, 50, chr1, cigar0),
+			NewRecord("B:::1:10:1:1", chr1, 0, r1F, 50, chr1, cigar0),
+			NewRecord("A:::1:10:1:1", chr1, 50, r2R, 0, chr1, cigar0),
+			NewRecord("B:::1:10:1:1", chr1, 50, r2R, 0, chr1, cigar0),
+			NewRecord("C:::1:10:3:3", chr1, 200, r1F, 350, chr1, cigar0),
+			NewRecord("D:::1:10:5:5", chr1, 345, r1F, 600, chr1, cigar0),
+			NewRecord("C:::1:10:3:3", chr1, 350, r2R, 200, chr1, cigar0),
+			NewRecord("D:::1:10:5:5", chr1, 600, r2R, 345, chr1, cigar0),
+			NewRecord("E:::1:10:7:7", chr2, 100, r1F, 200, chr2, cigar0),
+			NewRecord("E:::1:10:7:7", chr2, 200, r2R, 100, chr2, cigar0),
+		}
+	}
+
+	tempDir, cleanup := testutil.TempDir(t, "", "")
+	defer cleanup()
+	var unindexed []byte
+	for testIdx, indexFormat := range []string{"none", "bai", "csi"} {
+		opts := defaultOpts
+		opts.OutputPath = NewTestOutput(tempDir, testIdx, "bam")
+		opts.Format = "bam"
+		opts.IndexFormat = indexFormat
+		markDuplicates := &MarkDuplicates{
+			Provider: bamprovider.NewFakeProvider(header, records()),
+			Opts:     &opts,
+		}
+		_, err := markDuplicates.Mark(nil)
+		assert.NoError(t, err, "index format %s", indexFormat)
+
+		// Indexing does not change the output.
+		output, err := ioutil.ReadFile(opts.OutputPath)
+		assert.NoError(t, err)
+		if indexFormat == "none" {
+			unindexed = output
+			for _, ext := range []string{".bai", ".csi"} {
+				_, err := os.Stat(opts.OutputPath + ext)
+				assert.True(t, os.IsNotExist(err), "index format %s", indexFormat)
+			}
+			continue
+		}
+		assert.Equal(t, unindexed, output, "index format %s", indexFormat)
+
+		// Fetch the records that overlap chr1:300-400 with the index.
+		in, err := os.Open(opts.OutputPath)
+		assert.NoError(t, err)
+		reader, err := bam.NewReader(in, 1)
+		assert.NoError(t, err)
+		indexIn, err := os.Open(opts.OutputPath + "." + indexFormat)
+		assert.NoError(t, err)
+		var chunks []bgzf.Chunk
+		if indexFormat == "bai" {
+			index, err := bam.ReadIndex(indexIn)
+			assert.NoError(t, err)
+			chunks, err = index.Chunks(reader.Header().Refs()[0], 300, 400)
+			assert.NoError(t, err)
+		} else {
+			index, err := csi.ReadFrom(indexIn)
+			assert.NoError(t, err)
+			chunks = index.Chunks(0, 300, 400)
+		}
+		assert.NoError(t, indexIn.Close())
+
+		iter, err := bam.NewIterator(reader, chunks)
+		assert.NoError(t, err)
+		var names []string
+		for iter.Next() {
+			r := iter.Record()
+			if r.Ref.ID() == 0 && r.Start() < 400 && r.End() > 300 {
+				names = append(names, r.Name)
+			}
+		}
+		assert.NoError(t, iter.Error())
+		assert.NoError(t, iter.Close())
+		assert.NoError(t, in.Close())
+		sort.Strings(names)
+		assert.Equal(t, []string{"C:::1:10:3:3", "D:::1:10:5:5"}, names, "index format %s", indexFormat)
+	}
+
+	// Queryname grouped output and stdout cannot be indexed.
+	opts := defaultOpts
+	opts.OutputPath = NewTestOutput(tempDir, 3, "bam")
+	opts.Format = "bam"
+	opts.IndexFormat = "bai"
+	assert.Error(t, checkQuerynameOpts(&opts))
+	opts.OutputPath = stdioPath
+	opts.MinBases = 1
+	opts.BamFile = "in.bam"
+	assert.Error(t, validate(&opts))
+}
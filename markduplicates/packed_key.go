@@ -0,0 +1,182 @@
+// Copyright 2019 Grail Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package markduplicates
+
+// duplicateIndex looks up the entries of a duplicateKey for every read
+// of a shard, and the strings of the key, its library and cell
+// barcode, make it large and slow to hash. So most keys are packed in
+// two uint64s instead, with the library replaced by its index in a
+// libraryInterner:
+//
+//	hi: library index (16 bits) | leftRefId+1 (15 bits) | leftPos+1 (31 bits)
+//	lo: rightRefId+1 (15 bits) | rightPos+1 (31 bits) | Orientation (3 bits) | Strand+1 (2 bits)
+//
+// The IDs and positions are offset by one so that the -1 of the right
+// read of a fragment packs as 0. A key that does not fit falls back to
+// the wide duplicateKey: one with a cell barcode, a reference ID of
+// 2^15-1 or more, a position below -1 or of 2^31-1 or more, or the
+// library of a shard with more than 2^16 libraries. Whether a key is
+// packed depends only on the key, so each key is always in the same
+// map.
+
+const (
+	packedLibraryBits = 16
+	packedRefBits     = 15
+	packedPosBits     = 31
+	packedOrientBits  = 3
+	packedStrandBits  = 2
+
+	maxPackedLibraries = 1 << packedLibraryBits
+)
+
+// packedKey is a duplicateKey packed in two uint64s, see packKey.
+type packedKey struct {
+	hi, lo uint64
+}
+
+// libraryInterner assigns each library the index that packs it in a
+// packedKey.
+type libraryInterner struct {
+	indexes map[string]uint16
+	names   []string
+	// last and lastIndex are the library of the previous lookup, since
+	// the reads of a shard are mostly of one library, and a string
+	// compares faster than it hashes.
+	last      string
+	lastIndex uint16
+	hasLast   bool
+}
+
+func newLibraryInterner() *libraryInterner {
+	return &libraryInterner{indexes: make(map[string]uint16)}
+}
+
+// index returns the index of library, assigning it the next index if
+// it has none. It returns false if library has no index and all the
+// indexes are assigned.
+func (l *libraryInterner) index(library string) (uint16, bool) {
+	if l.hasLast && library == l.last {
+		return l.lastIndex, true
+	}
+	idx, ok := l.indexes[library]
+	if !ok {
+		if len(l.names) >= maxPackedLibraries {
+			return 0, false
+		}
+		idx = uint16(len(l.names))
+		l.indexes[library] = idx
+		l.names = append(l.names, library)
+	}
+	l.last, l.lastIndex, l.hasLast = library, idx, true
+	return idx, true
+}
+
+// fits returns true if v+1 packs in bits bits.
+func fits(v, bits int) bool {
+	return v >= -1 && v+1 < 1<<uint(bits)
+}
+
+// packKey returns the packedKey of k, and false if k does not fit one.
+func packKey(libraries *libraryInterner, k *duplicateKey) (packedKey, bool) {
+	if k.cell != "" ||
+		!fits(k.leftRefId, packedRefBits) || !fits(k.leftPos, packedPosBits) ||
+		!fits(k.rightRefId, packedRefBits) || !fits(k.rightPos, packedPosBits) ||
+		k.Orientation >= 1<<packedOrientBits || !fits(int(k.Strand), packedStrandBits) {
+		return packedKey{}, false
+	}
+	lib, ok := libraries.index(k.library)
+	if !ok {
+		return packedKey{}, false
+	}
+	hi := uint64(lib)<<(packedRefBits+packedPosBits) |
+		uint64(k.leftRefId+1)<<packedPosBits |
+		uint64(k.leftPos+1)
+	lo := uint64(k.rightRefId+1)<<(packedPosBits+packedOrientBits+packedStrandBits) |
+		uint64(k.rightPos+1)<<(packedOrientBits+packedStrandBits) |
+		uint64(k.Orientation)<<packedStrandBits |
+		uint64(k.Strand+1)
+	return packedKey{hi, lo}, true
+}
+
+// unpack returns the duplicateKey of k.
+func (k packedKey) unpack(libraries *libraryInterner) duplicateKey {
+	field := func(v uint64, shift, bits int) uint64 {
+		return (v >> uint(shift)) & (1<<uint(bits) - 1)
+	}
+	return duplicateKey{
+		leftRefId:   int(field(k.hi, packedPosBits, packedRefBits)) - 1,
+		leftPos:     int(field(k.hi, 0, packedPosBits)) - 1,
+		rightRefId:  int(field(k.lo, packedPosBits+packedOrientBits+packedStrandBits, packedRefBits)) - 1,
+		rightPos:    int(field(k.lo, packedOrientBits+packedStrandBits, packedPosBits)) - 1,
+		Orientation: Orientation(field(k.lo, packedStrandBits, packedOrientBits)),
+		Strand:      strand(int(field(k.lo, 0, packedStrandBits)) - 1),
+		library:     libraries.names[field(k.hi, packedRefBits+packedPosBits, packedLibraryBits)],
+	}
+}
+
+// duplicateEntries maps the duplicateKeys of a duplicateIndex to their
+// entries, with the keys that fit packed, and the others wide.
+type duplicateEntries struct {
+	libraries *libraryInterner
+	packed    map[packedKey][]DuplicateEntry
+	wide      map[duplicateKey][]DuplicateEntry
+}
+
+func newDuplicateEntries() *duplicateEntries {
+	return &duplicateEntries{
+		libraries: newLibraryInterner(),
+		packed:    make(map[packedKey][]DuplicateEntry),
+		wide:      make(map[duplicateKey][]DuplicateEntry),
+	}
+}
+
+// add appends e to the entries of k.
+func (d *duplicateEntries) add(k duplicateKey, e DuplicateEntry) {
+	if p, ok := packKey(d.libraries, &k); ok {
+		d.packed[p] = append(d.packed[p], e)
+		return
+	}
+	d.wide[k] = append(d.wide[k], e)
+}
+
+// get returns the entries of k, and false if it has none.
+func (d *duplicateEntries) get(k duplicateKey) ([]DuplicateEntry, bool) {
+	if p, ok := packKey(d.libraries, &k); ok {
+		entries, ok := d.packed[p]
+		return entries, ok
+	}
+	entries, ok := d.wide[k]
+	return entries, ok
+}
+
+// remove removes the entries of k.
+func (d *duplicateEntries) remove(k duplicateKey) {
+	if p, ok := packKey(d.libraries, &k); ok {
+		delete(d.packed, p)
+		return
+	}
+	delete(d.wide, k)
+}
+
+// keys returns the keys of d, unpacked.
+func (d *duplicateEntries) keys() []duplicateKey {
+	keys := make([]duplicateKey, 0, len(d.packed)+len(d.wide))
+	for p := range d.packed {
+		keys = append(keys, p.unpack(d.libraries))
+	}
+	for k := range d.wide {
+		keys = append(keys, k)
+	}
+	return keys
+}
@@ -0,0 +1,158 @@
+// Copyright 2019 Grail Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package markduplicates
+
+import (
+	"sort"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPackKey(t *testing.T) {
+	tests := []struct {
+		key    duplicateKey
+		packed bool
+	}{
+		{duplicateKey{0, 0, 0, 0, ff, 0, "", "lib"}, true},
+		{duplicateKey{1, 100, 2, 300, rf, -1, "", "lib"}, true},
+		{duplicateKey{3, 100, -1, -1, r, 1, "", ""}, true},
+		{duplicateKey{1<<15 - 2, 1<<31 - 2, 1<<15 - 2, 1<<31 - 2, rr, 1, "", "other"}, true},
+		{duplicateKey{0, -1, -1, -1, f, 0, "", "lib"}, true},
+		{duplicateKey{0, 10, -1, -1, f, 0, "AACC", "lib"}, false},
+		{duplicateKey{1<<15 - 1, 10, -1, -1, f, 0, "", "lib"}, false},
+		{duplicateKey{0, 1<<31 - 1, -1, -1, f, 0, "", "lib"}, false},
+		{duplicateKey{0, -2, -1, -1, f, 0, "", "lib"}, false},
+		{duplicateKey{0, 10, 0, 20, Orientation(8), 0, "", "lib"}, false},
+	}
+	libraries := newLibraryInterner()
+	seen := map[packedKey]duplicateKey{}
+	for _, test := range tests {
+		p, ok := packKey(libraries, &test.key)
+		if !assert.Equal(t, test.packed, ok, "key %v", &test.key) || !ok {
+			continue
+		}
+		assert.Equal(t, test.key, p.unpack(libraries), "key %v", &test.key)
+		_, dup := seen[p]
+		assert.False(t, dup, "key %v", &test.key)
+		seen[p] = test.key
+	}
+}
+
+func TestLibraryInterner(t *testing.T) {
+	libraries := newLibraryInterner()
+	for i := 0; i < maxPackedLibraries; i++ {
+		idx, ok := libraries.index(strconv.Itoa(i))
+		assert.True(t, ok)
+		assert.Equal(t, uint16(i), idx)
+	}
+	idx, ok := libraries.index("0")
+	assert.True(t, ok)
+	assert.Equal(t, uint16(0), idx)
+	_, ok = libraries.index("one too many")
+	assert.False(t, ok)
+
+	// The keys of a library without an index are wide.
+	entries := &duplicateEntries{
+		libraries: libraries,
+		packed:    make(map[packedKey][]DuplicateEntry),
+		wide:      make(map[duplicateKey][]DuplicateEntry),
+	}
+	k := duplicateKey{0, 10, -1, -1, f, 0, "", "one too many"}
+	entries.add(k, IndexedSingle{FileIdx_: 1})
+	assert.Len(t, entries.wide, 1)
+	got, ok := entries.get(k)
+	assert.True(t, ok)
+	assert.Len(t, got, 1)
+}
+
+func TestDuplicateEntries(t *testing.T) {
+	keys := []duplicateKey{
+		{0, 10, 0, 200, fr, 0, "", "lib1"},
+		{0, 10, -1, -1, f, 0, "", "lib1"},
+		{0, 10, -1, -1, f, 0, "", "lib2"},
+		{0, 10, -1, -1, f, 0, "AACC", "lib1"},
+		{1 << 16, 10, -1, -1, r, 0, "", "lib1"},
+	}
+	entries := newDuplicateEntries()
+	for i, k := range keys {
+		for j := 0; j <= i; j++ {
+			entries.add(k, IndexedSingle{FileIdx_: uint64(j)})
+		}
+	}
+	assert.Len(t, entries.packed, 3)
+	assert.Len(t, entries.wide, 2)
+	for i, k := range keys {
+		got, ok := entries.get(k)
+		assert.True(t, ok, "key %v", &k)
+		assert.Len(t, got, i+1, "key %v", &k)
+	}
+	sorted := sortedKeys(entries)
+	expected := append([]duplicateKey{}, keys...)
+	sort.Slice(expected, func(i, j int) bool { return expected[i].less(&expected[j]) })
+	assert.Equal(t, expected, sorted)
+
+	for _, k := range keys {
+		entries.remove(k)
+		_, ok := entries.get(k)
+		assert.False(t, ok, "key %v", &k)
+	}
+	assert.Empty(t, entries.keys())
+}
+
+// benchmarkKeys returns the keys of n synthetic readpairs, with
+// duplicate sets of about 4 readpairs across 4 libraries.
+func benchmarkKeys(n int) []duplicateKey {
+	libraries := []string{"lib1", "lib2", "lib3", "lib4"}
+	keys := make([]duplicateKey, n)
+	for i := range keys {
+		set := i / 4
+		keys[i] = duplicateKey{set % 24, set, set % 24, set + 300, fr, 0, "", libraries[set%len(libraries)]}
+	}
+	return keys
+}
+
+// BenchmarkDuplicateKeysWide and BenchmarkDuplicateKeysPacked insert
+// the keys of b.N reads in a map, and look them up again, so that
+// -benchtime 100000000x measures a 100M read input.
+func BenchmarkDuplicateKeysWide(b *testing.B) {
+	keys := benchmarkKeys(b.N)
+	b.ReportAllocs()
+	b.ResetTimer()
+	entries := make(map[duplicateKey][]DuplicateEntry)
+	for _, k := range keys {
+		entries[k] = append(entries[k], nil)
+	}
+	for _, k := range keys {
+		if _, ok := entries[k]; !ok {
+			b.Fatal("missing key")
+		}
+	}
+}
+
+func BenchmarkDuplicateKeysPacked(b *testing.B) {
+	keys := benchmarkKeys(b.N)
+	b.ReportAllocs()
+	b.ResetTimer()
+	entries := newDuplicateEntries()
+	for _, k := range keys {
+		entries.add(k, nil)
+	}
+	for _, k := range keys {
+		if _, ok := entries.get(k); !ok {
+			b.Fatal("missing key")
+		}
+	}
+}
@@ -0,0 +1,154 @@
+// Copyright 2019 Grail Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package markduplicates
+
+import (
+	"fmt"
+
+	"github.com/Schaudge/hts/sam"
+)
+
+// PairScorer scores the templates of a duplicate set. The template
+// with the highest score is the primary; ties are broken as
+// configured by Opts.PrimarySelection, and finally by file index, so
+// the primary does not depend on the order of the duplicate set.
+//
+// Mate-unmapped reads are scored as an IndexedPair whose Right.R is
+// nil.
+type PairScorer interface {
+	Score(p *IndexedPair) int64
+}
+
+// Names of the built-in PairScorers, see ParsePairScorer.
+const (
+	baseQScorerName        = "baseq"
+	fileIdxScorerName      = "fileidx"
+	mapQScorerName         = "mapq"
+	mappedLengthScorerName = "mapped-length"
+	editDistanceScorerName = "nm"
+)
+
+// BaseQScorer scores a template by the sum of its base qualities that
+// are at least 15, like picard. It is the default PairScorer.
+type BaseQScorer struct{}
+
+// Score implements PairScorer.
+func (BaseQScorer) Score(p *IndexedPair) int64 {
+	return int64(p.BaseQScore())
+}
+
+// FileIdxScorer gives every template the same score, so that the
+// primary is the template that comes first in the input.
+type FileIdxScorer struct{}
+
+// Score implements PairScorer.
+func (FileIdxScorer) Score(p *IndexedPair) int64 {
+	return 0
+}
+
+// MapQScorer scores a template by the sum of its mapping qualities.
+type MapQScorer struct{}
+
+// Score implements PairScorer.
+func (MapQScorer) Score(p *IndexedPair) int64 {
+	var score int64
+	for _, r := range p.records() {
+		score += int64(r.MapQ)
+	}
+	return score
+}
+
+// MappedLengthScorer scores a template by the total length of the
+// reference that its reads are aligned to.
+type MappedLengthScorer struct{}
+
+// Score implements PairScorer.
+func (MappedLengthScorer) Score(p *IndexedPair) int64 {
+	var score int64
+	for _, r := range p.records() {
+		refLength, _ := recordCigar(r).Lengths()
+		score += int64(refLength)
+	}
+	return score
+}
+
+// EditDistanceScorer scores a template by minus the sum of the NM
+// edit distances of its reads, so that the template with the fewest
+// mismatches is the primary. Reads without an NM tag count as 0.
+type EditDistanceScorer struct{}
+
+// Score implements PairScorer.
+func (EditDistanceScorer) Score(p *IndexedPair) int64 {
+	var score int64
+	for _, r := range p.records() {
+		aux := r.AuxFields.Get(sam.NewTag("NM"))
+		if aux == nil {
+			continue
+		}
+		switch nm := aux.Value().(type) {
+		case int8:
+			score -= int64(nm)
+		case uint8:
+			score -= int64(nm)
+		case int16:
+			score -= int64(nm)
+		case uint16:
+			score -= int64(nm)
+		case int32:
+			score -= int64(nm)
+		case uint32:
+			score -= int64(nm)
+		}
+	}
+	return score
+}
+
+// ParsePairScorer returns the built-in PairScorer named by s: "baseq"
+// (or the empty string), "fileidx", "mapq", "mapped-length" or "nm".
+func ParsePairScorer(s string) (PairScorer, error) {
+	switch s {
+	case "", baseQScorerName:
+		return BaseQScorer{}, nil
+	case fileIdxScorerName:
+		return FileIdxScorer{}, nil
+	case mapQScorerName:
+		return MapQScorer{}, nil
+	case mappedLengthScorerName:
+		return MappedLengthScorer{}, nil
+	case editDistanceScorerName:
+		return EditDistanceScorer{}, nil
+	}
+	return nil, fmt.Errorf("unknown primary scorer %q, must be %q, %q, %q, %q or %q", s, baseQScorerName,
+		fileIdxScorerName, mapQScorerName, mappedLengthScorerName, editDistanceScorerName)
+}
+
+// records returns the mapped reads of p.
+func (p IndexedPair) records() []*sam.Record {
+	if p.Right.R == nil {
+		return []*sam.Record{p.Left.R}
+	}
+	return []*sam.Record{p.Left.R, p.Right.R}
+}
+
+// scoreEntry returns the score of e, an IndexedPair or an
+// IndexedSingle, with scorer.
+func scoreEntry(scorer PairScorer, e DuplicateEntry) int64 {
+	switch e := e.(type) {
+	case IndexedPair:
+		return scorer.Score(&e)
+	case IndexedSingle:
+		return scorer.Score(&IndexedPair{Left: e})
+	}
+	return int64(e.BaseQScore())
+}
@@ -0,0 +1,141 @@
+// Copyright 2019 Grail Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package markduplicates
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/Schaudge/hts/sam"
+	"github.com/stretchr/testify/assert"
+)
+
+// lastScorer prefers the templates that come last in the input.
+type lastScorer struct{}
+
+func (lastScorer) Score(p *IndexedPair) int64 {
+	return int64(p.FileIdx())
+}
+
+// scorerRecord returns a read with the given qualities, mapping
+// quality, cigar and NM edit distance.
+func scorerRecord(name string, pos int, flags sam.Flags, matePos int, qual string, mapQ byte, cigar sam.Cigar,
+	nm int) *sam.Record {
+	r := NewRecordSeq(name, chr1, pos, flags, matePos, chr1, cigar, strings.Repeat("A", len(qual)), qual)
+	r.MapQ = mapQ
+	r.AuxFields = append(r.AuxFields, NewAux("NM", nm))
+	return r
+}
+
+func TestPairScorers(t *testing.T) {
+	cigar5M := sam.Cigar{sam.NewCigarOp(sam.CigarMatch, 5)}
+	// A comes first, B has the highest base qualities and the fewest
+	// edits, and C has the highest mapping qualities and longest
+	// alignments.
+	var entries []DuplicateEntry
+	for i, template := range []struct {
+		name  string
+		qual  string
+		mapQ  byte
+		cigar sam.Cigar
+		nm    int
+	}{
+		{"A", "FF", 40, cigar2M, 2},
+		{"B", "GG", 30, cigar2M, 1},
+		{"C", "\x05\x05", 60, cigar5M, 5},
+	} {
+		left := scorerRecord(template.name, 0, r1F, 10, template.qual, template.mapQ, template.cigar, template.nm)
+		right := scorerRecord(template.name, 10, r2R, 0, template.qual, template.mapQ, template.cigar, template.nm)
+		entries = append(entries, IndexedPair{
+			Left:  IndexedSingle{left, uint64(2 * i)},
+			Right: IndexedSingle{right, uint64(2*i + 1)},
+		})
+	}
+	reversed := []DuplicateEntry{entries[2], entries[1], entries[0]}
+
+	for _, test := range []struct {
+		scorer   PairScorer
+		expected string
+	}{
+		{nil, "B"},
+		{BaseQScorer{}, "B"},
+		{FileIdxScorer{}, "A"},
+		{MapQScorer{}, "C"},
+		{MappedLengthScorer{}, "C"},
+		{EditDistanceScorer{}, "B"},
+		{lastScorer{}, "C"},
+	} {
+		opts := &Opts{PairScorer: test.scorer}
+		assert.Equal(t, test.expected, entries[choosePrimary(opts, entries)].Name(), "scorer %T", test.scorer)
+		// The primary does not depend on the order of the entries.
+		assert.Equal(t, test.expected, reversed[choosePrimary(opts, reversed)].Name(), "scorer %T", test.scorer)
+	}
+
+	// Singles are scored as pairs without a right read.
+	single := IndexedSingle{scorerRecord("S", 0, s1F, 0, "FF", 10, cigar5M, 1), 6}
+	assert.Equal(t, int64(10), scoreEntry(MapQScorer{}, single))
+	assert.Equal(t, int64(5), scoreEntry(MappedLengthScorer{}, single))
+	assert.Equal(t, int64(-1), scoreEntry(EditDistanceScorer{}, single))
+}
+
+func TestParsePairScorer(t *testing.T) {
+	for _, test := range []struct {
+		name     string
+		expected PairScorer
+	}{
+		{"", BaseQScorer{}},
+		{"baseq", BaseQScorer{}},
+		{"fileidx", FileIdxScorer{}},
+		{"mapq", MapQScorer{}},
+		{"mapped-length", MappedLengthScorer{}},
+		{"nm", EditDistanceScorer{}},
+	} {
+		scorer, err := ParsePairScorer(test.name)
+		assert.NoError(t, err, "name %q", test.name)
+		assert.Equal(t, test.expected, scorer, "name %q", test.name)
+	}
+	_, err := ParsePairScorer("length")
+	assert.Error(t, err)
+}
+
+func TestPrimaryScorer(t *testing.T) {
+	// A has higher base qualities, and B a higher mapping quality.
+	records := func() []*sam.Record {
+		return []*sam.Record{
+			scorerRecord("A:::1:10:1:1", 0, r1F, 10, "GG", 20, cigar2M, 0),
+			scorerRecord("B:::1:10:1:1", 0, r1F, 10, "FF", 60, cigar2M, 0),
+			scorerRecord("A:::1:10:1:1", 10, r2R, 0, "GG", 20, cigar2M, 0),
+			scorerRecord("B:::1:10:1:1", 10, r2R, 0, "FF", 60, cigar2M, 0),
+		}
+	}
+	mapQ := defaultOpts
+	mapQ.PrimaryScorer = mapQScorerName
+	custom := defaultOpts
+	custom.PairScorer = lastScorer{}
+
+	for _, test := range []struct {
+		opts Opts
+		dups []bool
+	}{
+		{defaultOpts, []bool{false, true, false, true}},
+		{mapQ, []bool{true, false, true, false}},
+		{custom, []bool{true, false, true, false}},
+	} {
+		var trecords []TestRecord
+		for i, r := range records() {
+			trecords = append(trecords, TestRecord{R: r, DupFlag: test.dups[i]})
+		}
+		RunTestCases(t, header, []TestCase{{trecords, test.opts}})
+	}
+}
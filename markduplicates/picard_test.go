@@ -0,0 +1,118 @@
+// Copyright 2019 Grail Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package markduplicates
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/Schaudge/grailbio/encoding/bamprovider"
+	"github.com/Schaudge/hts/bam"
+	"github.com/Schaudge/hts/sam"
+	"github.com/grailbio/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+// readPicardMetrics returns the DuplicationMetrics of library in a
+// picard metrics file, by column.
+func readPicardMetrics(t *testing.T, path, library string) map[string]int {
+	data, err := ioutil.ReadFile(path)
+	assert.NoError(t, err)
+	lines := strings.Split(string(data), "\n")
+	for i, line := range lines {
+		if !strings.HasPrefix(line, "## METRICS CLASS") || i+1 >= len(lines) {
+			continue
+		}
+		columns := strings.Split(lines[i+1], "\t")
+		for _, row := range lines[i+2:] {
+			values := strings.Split(row, "\t")
+			if row == "" || values[0] != library {
+				continue
+			}
+			metrics := map[string]int{}
+			for j, column := range columns {
+				// PERCENT_DUPLICATION is not a count.
+				if n, err := strconv.Atoi(values[j]); err == nil {
+					metrics[column] = n
+				}
+			}
+			return metrics
+		}
+	}
+	t.Fatalf("no metrics of library %s in %s", library, path)
+	return nil
+}
+
+// Test the duplicate and optical duplicate counts of
+// testdata/picard_optical.bam against those of picard, in
+// testdata/picard_optical.metrics. Its sets are: a chain of three
+// readpairs within 100 pixels with a fourth farther away on the same
+// tile, a readpair with its duplicate on another tile, a set of three
+// with one optical duplicate, and a readpair without duplicates.
+func TestPicardOpticalDuplicates(t *testing.T) {
+	readFixture := func() (*sam.Header, []*sam.Record) {
+		f, err := os.Open("testdata/picard_optical.bam")
+		assert.NoError(t, err)
+		defer f.Close() // nolint: errcheck
+		reader, err := bam.NewReader(f, 1)
+		assert.NoError(t, err)
+		var records []*sam.Record
+		for {
+			r, err := reader.Read()
+			if err == io.EOF {
+				break
+			}
+			assert.NoError(t, err)
+			records = append(records, r)
+		}
+		return reader.Header(), records
+	}
+	picard := readPicardMetrics(t, "testdata/picard_optical.metrics", "Unknown Library")
+
+	tempDir, cleanup := testutil.TempDir(t, "", "")
+	defer cleanup()
+	for testIdx, format := range []string{"bam", "pam"} {
+		fixtureHeader, records := readFixture()
+		opts := defaultOpts
+		opts.OutputPath = NewTestOutput(tempDir, testIdx, format)
+		opts.Format = format
+		opts.OpticalDetector = nil
+		opts.OpticalDuplicatePixelDistance = 100
+
+		markDuplicates := &MarkDuplicates{
+			Provider: bamprovider.NewFakeProvider(fixtureHeader, records),
+			Opts:     &opts,
+		}
+		actualMetrics, err := markDuplicates.Mark(nil)
+		if !assert.NoError(t, err, "format %s", format) {
+			continue
+		}
+		m := actualMetrics.LibraryMetrics["Unknown Library"]
+		if !assert.NotNil(t, m, "format %s", format) {
+			continue
+		}
+		assert.Equal(t, picard["READ_PAIRS_EXAMINED"], m.ReadPairsExamined/2, "format %s", format)
+		assert.Equal(t, picard["READ_PAIR_DUPLICATES"], m.ReadPairDups/2, "format %s", format)
+		assert.Equal(t, picard["READ_PAIR_OPTICAL_DUPLICATES"], m.ReadPairOpticalDups/2, "format %s", format)
+		assert.Equal(t, picard["READ_PAIR_DUPLICATES"]-picard["READ_PAIR_OPTICAL_DUPLICATES"],
+			m.ReadPairLibraryDups/2, "format %s", format)
+		librarySize, ok := m.EstimatedLibrarySize()
+		assert.True(t, ok, "format %s", format)
+		assert.Equal(t, picard["ESTIMATED_LIBRARY_SIZE"], int(librarySize), "format %s", format)
+	}
+}
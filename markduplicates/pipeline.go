@@ -0,0 +1,419 @@
+// Copyright 2019 Grail Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package markduplicates
+
+import (
+	"context"
+	"fmt"
+	"runtime"
+	"sync"
+
+	"github.com/Schaudge/grailbase/errors"
+	"github.com/Schaudge/grailbio/encoding/bam"
+	"github.com/Schaudge/hts/sam"
+)
+
+// generateBAM marks the shards with a pipeline of three pools of
+// goroutines, connected by bounded channels:
+//
+//   - Opts.ReadParallelism readers read the records of the shards from
+//     the provider, which inflates their BGZF blocks.
+//   - Opts.ComputeParallelism markers mark the duplicates of the shards
+//     that are read, with processShard.
+//   - Opts.WriteParallelism writers compress the marked records, each
+//     shard with Opts.CompressionThreads goroutines, and add them to the
+//     output, and the duplicates output, if any.
+//
+// Each channel holds as many shards as the stage that takes them from
+// it has goroutines, so a slow stage blocks the stages before it, and
+// the depths of the channels, see Progress, show which stage is the
+// bottleneck. The bamWriter of the output writes the shards in
+// order, and blocks the writer of a shard while its queue is full,
+// which would deadlock if the writers all held later shards than the
+// next one. So the shards enter the pipeline through a shardWindow of
+// Opts.QueueLength shards, which keeps the shards that are added to the
+// output, but not written yet, within its queue.
+//
+// The unmapped shard, which can be very large, is not read ahead: its
+// marker reads it from the provider, and passes its records to its
+// writer through a channel as it reads them, so that they are not held
+// in memory. It is started first, and outside of the window.
+//
+// With Opts.MaxMemoryMB, the dispatcher also waits for the memoryBudget
+// before it passes a shard to the readers, see memory_budget.go.
+
+// streamLength is the capacity of the channel of the records of the
+// unmapped shard.
+const streamLength = 1024
+
+// readParallelism returns Opts.ReadParallelism, or a quarter of
+// GOMAXPROCS if it is 0.
+func (o *Opts) readParallelism() int {
+	if o.ReadParallelism > 0 {
+		return o.ReadParallelism
+	}
+	return maxInt(1, runtime.GOMAXPROCS(0)/4)
+}
+
+// computeParallelism returns Opts.ComputeParallelism, or
+// Opts.Parallelism if it is 0.
+func (o *Opts) computeParallelism() int {
+	if o.ComputeParallelism > 0 {
+		return o.ComputeParallelism
+	}
+	return maxInt(1, o.Parallelism)
+}
+
+// writeParallelism returns Opts.WriteParallelism, or half of
+// GOMAXPROCS if it is 0.
+func (o *Opts) writeParallelism() int {
+	if o.WriteParallelism > 0 {
+		return o.WriteParallelism
+	}
+	return maxInt(1, runtime.GOMAXPROCS(0)/2)
+}
+
+func maxInt(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+// pipelineShard is a shard that passes through the pipeline.
+type pipelineShard struct {
+	// seq is the index of the shard in the order of the window, or -1
+	// for the unmapped shard.
+	seq   int
+	shard bam.Shard
+	// records are the records of the shard once it is read, and the
+	// records to write once it is marked.
+	records []*sam.Record
+	// bytes is the estimated memory of the records read.
+	bytes int64
+	// stream passes the records of the unmapped shard to its writer
+	// instead of records.
+	stream chan *sam.Record
+}
+
+// shardRecords iterates over the records that a reader read, as a
+// bamprovider.Iterator.
+type shardRecords struct {
+	records []*sam.Record
+	record  *sam.Record
+}
+
+// Scan moves to the next record, and returns false at the end.
+func (s *shardRecords) Scan() bool {
+	if len(s.records) == 0 {
+		return false
+	}
+	s.record = s.records[0]
+	s.records[0] = nil
+	s.records = s.records[1:]
+	return true
+}
+
+// Record returns the record of the last Scan.
+func (s *shardRecords) Record() *sam.Record { return s.record }
+
+// Err returns nil, since the records were read already.
+func (s *shardRecords) Err() error { return nil }
+
+// Close returns nil.
+func (s *shardRecords) Close() error { return nil }
+
+// shardWindow admits the shards into the pipeline in order, each once
+// the shards more than its size before it are added to the output.
+type shardWindow struct {
+	size  int
+	mutex sync.Mutex
+	cond  *sync.Cond
+	added []bool
+	// pending are the estimated bytes of the output of the shards that
+	// are added, but wait in the queue of the writer for an earlier
+	// shard.
+	pending []int64
+	// next is the first shard not added to the output yet.
+	next int
+}
+
+func newShardWindow(size, shards int) *shardWindow {
+	w := &shardWindow{size: size, added: make([]bool, shards), pending: make([]int64, shards)}
+	w.cond = sync.NewCond(&w.mutex)
+	return w
+}
+
+// admit waits until shard seq is in the window.
+func (w *shardWindow) admit(seq int) {
+	w.mutex.Lock()
+	for seq >= w.next+w.size {
+		w.cond.Wait()
+	}
+	w.mutex.Unlock()
+}
+
+// done records that shard seq is added to the output, with pending
+// estimated bytes. It returns the pending bytes of the shards that no
+// longer wait for an earlier shard, seq included.
+func (w *shardWindow) done(seq int, pending int64) (written int64) {
+	w.mutex.Lock()
+	w.added[seq] = true
+	w.pending[seq] = pending
+	for w.next < len(w.added) && w.added[w.next] {
+		written += w.pending[w.next]
+		w.next++
+	}
+	w.cond.Broadcast()
+	w.mutex.Unlock()
+	return written
+}
+
+// readShard reads the records of ps from the provider, and accounts
+// them to m.memory.
+func (m *MarkDuplicates) readShard(ctx context.Context, ps *pipelineShard) error {
+	iter := m.Provider.NewIterator(ps.shard)
+	defer func() { m.memory.add(shardRecordsMemory, ps.bytes) }()
+	for iter.Scan() {
+		if len(ps.records)%cancelCheckInterval == 0 {
+			if err := cancelled(ctx); err != nil {
+				iter.Close() // nolint: errcheck
+				return err
+			}
+		}
+		r := iter.Record()
+		ps.records = append(ps.records, r)
+		ps.bytes += recordBytes(r)
+	}
+	if err := iter.Close(); err != nil {
+		return fmt.Errorf("close shard %d: %v", ps.shard.ShardIdx, err)
+	}
+	return nil
+}
+
+// markShards marks shards, and the unmapped shard if it is not nil,
+// with the pipeline, and adds them to writer, or to m.split if it is
+// not nil, and the duplicates to dups if it is not nil. The first
+// error, or the cancellation of ctx, is returned. After it, the
+// remaining shards are written empty, because the writer writes the
+// shards in order and would wait for them.
+func (m *MarkDuplicates) markShards(ctx context.Context, writer *bamWriter, dups *duplicatesOutput,
+	unmapped *bam.Shard, shards []bam.Shard) error {
+	readers, markers, writers := m.Opts.readParallelism(), m.Opts.computeParallelism(), m.Opts.writeParallelism()
+	shardLog.Debugf("creating %d readers, %d markers and %d writers", readers, markers, writers)
+	readCh := make(chan *pipelineShard, readers)
+	markCh := make(chan *pipelineShard, markers)
+	writeCh := make(chan *pipelineShard, writers)
+	m.progress.setQueues(func() (read, mark, write QueueDepth) {
+		return QueueDepth{len(readCh), cap(readCh)}, QueueDepth{len(markCh), cap(markCh)},
+			QueueDepth{len(writeCh), cap(writeCh)}
+	})
+	defer m.progress.setQueues(nil)
+	window := newShardWindow(m.Opts.QueueLength, len(shards))
+	e := errors.Once{}
+
+	go func() {
+		defer close(readCh)
+		if unmapped != nil {
+			readCh <- &pipelineShard{seq: -1, shard: *unmapped}
+		}
+		for seq, shard := range shards {
+			window.admit(seq)
+			m.memory.admitShard()
+			readCh <- &pipelineShard{seq: seq, shard: shard}
+		}
+	}()
+
+	var readGroup sync.WaitGroup
+	for i := 0; i < readers; i++ {
+		readGroup.Add(1)
+		go func() {
+			defer readGroup.Done()
+			for ps := range readCh {
+				if ps.seq >= 0 && e.Err() == nil {
+					e.Set(m.readShard(ctx, ps))
+				}
+				markCh <- ps
+			}
+		}()
+	}
+	go func() {
+		readGroup.Wait()
+		close(markCh)
+	}()
+
+	var markGroup sync.WaitGroup
+	for i := 0; i < markers; i++ {
+		markGroup.Add(1)
+		go func(worker int) {
+			defer markGroup.Done()
+			for ps := range markCh {
+				m.markPipelineShard(ctx, &e, ps, worker, writeCh)
+			}
+		}(i)
+	}
+	go func() {
+		markGroup.Wait()
+		close(writeCh)
+	}()
+
+	// unmappedOutput is the estimated output of the unmapped shard,
+	// which waits in the queue of the writer until all the shards are
+	// added.
+	var unmappedOutput int64
+	var writeGroup sync.WaitGroup
+	for i := 0; i < writers; i++ {
+		writeGroup.Add(1)
+		go func() {
+			defer writeGroup.Done()
+			var compressor recordCompressor
+			if m.split != nil {
+				compressor = m.split.newCompressor()
+			} else {
+				compressor = newShardCompressor(writer, m.Opts.compressionThreads())
+			}
+			var dupCompressor *shardCompressor
+			if dups != nil {
+				dupCompressor = dups.newCompressor()
+			}
+			for ps := range writeCh {
+				output := m.writePipelineShard(&e, ps, compressor, dupCompressor)
+				if ps.seq < 0 {
+					unmappedOutput = output
+					continue
+				}
+				written := window.done(ps.seq, output)
+				m.memory.add(shardRecordsMemory, -ps.bytes)
+				m.memory.add(pendingOutputMemory, output-written)
+				m.memory.shardDone()
+			}
+		}()
+	}
+	writeGroup.Wait()
+	m.memory.add(pendingOutputMemory, -unmappedOutput)
+	return e.Err()
+}
+
+// markPipelineShard marks ps, and passes it to writeCh. The unmapped
+// shard is passed to writeCh first, and its records are streamed to it
+// as they are marked. After an error, ps is passed on without records.
+func (m *MarkDuplicates) markPipelineShard(ctx context.Context, e *errors.Once, ps *pipelineShard, worker int,
+	writeCh chan<- *pipelineShard) {
+	shardLog.forShard(ps.shard).Debugf("starting shard")
+	if ps.seq < 0 {
+		ps.stream = make(chan *sam.Record, streamLength)
+		writeCh <- ps
+		defer close(ps.stream)
+		e.Set(cancelled(ctx))
+		if e.Err() != nil {
+			return
+		}
+		iter := m.Provider.NewIterator(ps.shard)
+		e.Set(m.processShard(ctx, iter, ps.shard, worker, func(r *sam.Record) error {
+			ps.stream <- r
+			return nil
+		}))
+		if err := iter.Close(); err != nil {
+			e.Set(fmt.Errorf("close shard %d: %v", ps.shard.ShardIdx, err))
+		}
+		return
+	}
+
+	records := ps.records
+	ps.records = nil
+	e.Set(cancelled(ctx))
+	if e.Err() == nil {
+		err := m.processShard(ctx, &shardRecords{records: records}, ps.shard, worker, func(r *sam.Record) error {
+			ps.records = append(ps.records, r)
+			return nil
+		})
+		if err != nil {
+			e.Set(err)
+			ps.records = nil
+		}
+	}
+	writeCh <- ps
+}
+
+// writePipelineShard adds the records of ps to the output shard of
+// compressor, or of dupCompressor for the duplicates if it is not nil,
+// and returns the estimated bytes of the output. The output of the
+// unmapped shard is accounted to m.memory as it is compressed. After an
+// error, the shard is written empty. With Opts.Flagstat, the records are
+// counted as output, or as removed if they go to dupCompressor.
+func (m *MarkDuplicates) writePipelineShard(e *errors.Once, ps *pipelineShard, compressor recordCompressor,
+	dupCompressor *shardCompressor) (output int64) {
+	streamed := ps.stream != nil
+	started := true
+	if err := compressor.startShard(ps.shard.ShardIdx, streamed); err != nil {
+		e.Set(fmt.Errorf("could not create bam shard: %v", err))
+		started = false
+	}
+	if dupCompressor != nil {
+		if err := dupCompressor.startShard(ps.shard.ShardIdx, true); err != nil {
+			e.Set(fmt.Errorf("could not create duplicates bam shard: %v", err))
+			started = false
+		}
+	}
+	var flagstatOutput, flagstatRemoved FlagstatCounts
+	add := func(r *sam.Record) {
+		if !started || e.Err() != nil {
+			return
+		}
+		var c recordCompressor = compressor
+		counts := &flagstatOutput
+		if dupCompressor != nil && (r.Flags&sam.Duplicate) != 0 {
+			c, counts = dupCompressor, &flagstatRemoved
+		}
+		if m.Opts.Flagstat {
+			counts.add(r)
+		}
+		output += recordBytes(r) / outputCompression
+		e.Set(c.addRecord(r))
+	}
+	if streamed {
+		// The stream is drained even after an error, so that its
+		// marker does not block.
+		var accounted int64
+		for r := range ps.stream {
+			add(r)
+			if output-accounted >= 1<<20 {
+				m.memory.add(pendingOutputMemory, output-accounted)
+				accounted = output
+			}
+		}
+		m.memory.add(pendingOutputMemory, output-accounted)
+	} else {
+		for _, r := range ps.records {
+			add(r)
+		}
+		ps.records = nil
+	}
+	if m.Opts.Flagstat {
+		m.globalMetrics.mergeOutputFlagstat(&flagstatOutput, &flagstatRemoved)
+	}
+	if !started {
+		return output
+	}
+	if err := compressor.closeShard(); err != nil {
+		e.Set(fmt.Errorf("close shard compressor %d: %v", ps.shard.ShardIdx, err))
+	}
+	if dupCompressor != nil {
+		if err := dupCompressor.closeShard(); err != nil {
+			e.Set(fmt.Errorf("close duplicates shard compressor %d: %v", ps.shard.ShardIdx, err))
+		}
+	}
+	shardLog.forShard(ps.shard).Debugf("finished shard")
+	return output
+}
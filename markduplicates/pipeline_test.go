@@ -0,0 +1,109 @@
+// Copyright 2019 Grail Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package markduplicates
+
+import (
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Schaudge/grailbio/encoding/bamprovider"
+	"github.com/Schaudge/hts/sam"
+	"github.com/grailbio/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestShardWindow(t *testing.T) {
+	w := newShardWindow(2, 4)
+	w.admit(0)
+	w.admit(1)
+	admitted := make(chan int, 2)
+	go func() {
+		w.admit(2)
+		admitted <- 2
+		w.admit(3)
+		admitted <- 3
+	}()
+	// Shard 2 waits for shard 0, not for shard 1.
+	assert.Equal(t, int64(0), w.done(1, 10))
+	select {
+	case <-admitted:
+		t.Fatal("shard 2 admitted before shard 0 is done")
+	case <-time.After(10 * time.Millisecond):
+	}
+	// Shard 1 is written with shard 0.
+	assert.Equal(t, int64(15), w.done(0, 5))
+	assert.Equal(t, 2, <-admitted)
+	assert.Equal(t, int64(7), w.done(2, 7))
+	assert.Equal(t, 3, <-admitted)
+}
+
+func TestPipeline(t *testing.T) {
+	ref, err := sam.NewReference("chrD", "", "", 3000000, nil, nil)
+	assert.NoError(t, err)
+	h, err := sam.NewHeader(nil, []*sam.Reference{ref})
+	assert.NoError(t, err)
+	tempDir, cleanup := testutil.TempDir(t, "", "")
+	defer cleanup()
+
+	tests := []struct {
+		readers, markers, writers, queueLength, compressionThreads int
+	}{
+		{1, 1, 1, 10, 1},
+		{1, 1, 1, 1, 1},
+		{3, 2, 4, 2, 1},
+		{2, 4, 1, 1, 3},
+		{0, 0, 0, 5, 2},
+	}
+	var expected, expectedDups []string
+	for testIdx, test := range tests {
+		name := fmt.Sprintf("%+v", test)
+		opts := defaultOpts
+		opts.OutputPath = NewTestOutput(tempDir, testIdx, "bam")
+		opts.DuplicatesOutput = filepath.Join(tempDir, fmt.Sprintf("duplicates%d.bam", testIdx))
+		opts.RemoveDups = true
+		opts.Format = "bam"
+		opts.ShardSize = 10000
+		opts.ReadParallelism = test.readers
+		opts.ComputeParallelism = test.markers
+		opts.WriteParallelism = test.writers
+		opts.QueueLength = test.queueLength
+		opts.CompressionThreads = test.compressionThreads
+		markDuplicates := &MarkDuplicates{
+			Provider: bamprovider.NewFakeProvider(h, shardingRecords(ref)),
+			Opts:     &opts,
+		}
+		_, err := markDuplicates.Mark(nil)
+		if !assert.NoError(t, err, "test %s", name) {
+			continue
+		}
+
+		// The output is the same with any pipeline.
+		var actual, actualDups []string
+		for _, r := range ReadRecords(t, opts.OutputPath) {
+			actual = append(actual, fmt.Sprintf("%s %d %d %v", r.Name, r.Pos, r.Flags, r.AuxFields))
+		}
+		for _, r := range ReadRecords(t, opts.DuplicatesOutput) {
+			actualDups = append(actualDups, fmt.Sprintf("%s %d %d %v", r.Name, r.Pos, r.Flags, r.AuxFields))
+		}
+		assert.NotEmpty(t, actualDups, "test %s", name)
+		if expected == nil {
+			expected, expectedDups = actual, actualDups
+		} else {
+			assert.Equal(t, expected, actual, "test %s", name)
+			assert.Equal(t, expectedDups, actualDups, "test %s", name)
+		}
+	}
+}
@@ -0,0 +1,75 @@
+// Copyright 2019 Grail Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package markduplicates
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/Schaudge/hts/sam"
+)
+
+// programName is the PN and, if it is not used yet, the ID of the @PG
+// line that Mark adds to the header of the output.
+const programName = "doppelmark"
+
+// programHeader returns header with a @PG line for doppelmark, like
+// picard MarkDuplicates adds: its ID is "doppelmark", or
+// "doppelmark.1", "doppelmark.2", ... if that is already used, VN is
+// Version, CL is commandLine, and PP is the tail of the chain of the
+// programs of header, the last program that is not the PP of another.
+// If the chain forks, the tail is the last of its tails in the header.
+// The other lines of header, including the @CO lines, are kept in
+// order.
+func programHeader(header *sam.Header, commandLine string) (*sam.Header, error) {
+	text, err := header.MarshalText()
+	if err != nil {
+		return nil, err
+	}
+	var ids []string
+	used := make(map[string]bool)
+	previous := make(map[string]bool)
+	for _, line := range strings.Split(string(text), "\n") {
+		if !strings.HasPrefix(line, "@PG\t") {
+			continue
+		}
+		for _, field := range strings.Split(line, "\t")[1:] {
+			switch {
+			case strings.HasPrefix(field, "ID:"):
+				id := field[len("ID:"):]
+				ids = append(ids, id)
+				used[id] = true
+			case strings.HasPrefix(field, "PP:"):
+				previous[field[len("PP:"):]] = true
+			}
+		}
+	}
+
+	id := programName
+	for i := 1; used[id]; i++ {
+		id = programName + "." + strconv.Itoa(i)
+	}
+	pg := []string{"@PG", "ID:" + id, "PN:" + programName, "VN:" + Version}
+	if commandLine != "" {
+		pg = append(pg, "CL:"+strings.Replace(commandLine, "\t", " ", -1))
+	}
+	for i := len(ids) - 1; i >= 0; i-- {
+		if !previous[ids[i]] {
+			pg = append(pg, "PP:"+ids[i])
+			break
+		}
+	}
+	text = append(text, []byte(strings.Join(pg, "\t")+"\n")...)
+	return sam.NewHeader(text, nil)
+}
@@ -0,0 +1,90 @@
+// Copyright 2019 Grail Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package markduplicates
+
+import (
+	"testing"
+
+	"github.com/Schaudge/grailbio/encoding/bamprovider"
+	"github.com/Schaudge/hts/sam"
+	"github.com/grailbio/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestProgramHeader(t *testing.T) {
+	for _, test := range []struct {
+		text     string
+		id       string
+		previous string
+	}{
+		// No @PG lines.
+		{"@HD\tVN:1.6\tSO:coordinate\n", "doppelmark", ""},
+		// A single program.
+		{"@PG\tID:bwa\tPN:bwa\n", "doppelmark", "bwa"},
+		// A chain.
+		{"@PG\tID:bwa\tPN:bwa\n@PG\tID:sort\tPN:samtools\tPP:bwa\n", "doppelmark", "sort"},
+		// A forked chain: the last tail is chosen.
+		{"@PG\tID:bwa\tPN:bwa\n@PG\tID:sort\tPN:samtools\tPP:bwa\n@PG\tID:view\tPN:samtools\tPP:bwa\n",
+			"doppelmark", "view"},
+		// doppelmark already ran.
+		{"@PG\tID:doppelmark\tPN:doppelmark\n@PG\tID:doppelmark.1\tPN:doppelmark\tPP:doppelmark\n",
+			"doppelmark.2", "doppelmark.1"},
+	} {
+		h, err := programHeader(newTestHeader(t, test.text+"@CO\tfirst\n@CO\tsecond\n"), "doppelmark -bam in.bam")
+		assert.NoError(t, err, "header %q", test.text)
+		progs := h.Progs()
+		if !assert.NotEmpty(t, progs, "header %q", test.text) {
+			continue
+		}
+		pg := progs[len(progs)-1]
+		assert.Equal(t, test.id, pg.UID(), "header %q", test.text)
+		assert.Equal(t, "doppelmark", pg.Name(), "header %q", test.text)
+		assert.Equal(t, Version, pg.Version(), "header %q", test.text)
+		assert.Equal(t, "doppelmark -bam in.bam", pg.Command(), "header %q", test.text)
+		assert.Equal(t, test.previous, pg.Previous(), "header %q", test.text)
+		assert.Equal(t, []string{"first", "second"}, h.Comments, "header %q", test.text)
+		assert.Equal(t, len(header.Refs()), len(h.Refs()), "header %q", test.text)
+	}
+}
+
+func TestProgramOutput(t *testing.T) {
+	tempDir, cleanup := testutil.TempDir(t, "", "")
+	defer cleanup()
+	for testIdx, format := range []string{"bam", "pam"} {
+		opts := defaultOpts
+		opts.OutputPath = NewTestOutput(tempDir, testIdx, format)
+		opts.Format = format
+		opts.CommandLine = "doppelmark -bam in.bam"
+		markDuplicates := &MarkDuplicates{
+			Provider: bamprovider.NewFakeProvider(newTestHeader(t, "@PG\tID:bwa\tPN:bwa\n"), []*sam.Record{
+				NewRecord("A:::1:10:1:1", chr1, 0, r1F, 50, chr1, cigar0),
+				NewRecord("A:::1:10:1:1", chr1, 50, r2R, 0, chr1, cigar0),
+			}),
+			Opts: &opts,
+		}
+		_, err := markDuplicates.Mark(nil)
+		assert.NoError(t, err, "format %s", format)
+
+		p := bamprovider.NewProvider(opts.OutputPath)
+		h, err := p.GetHeader()
+		assert.NoError(t, err, "format %s", format)
+		progs := h.Progs()
+		if assert.Equal(t, 2, len(progs), "format %s", format) {
+			assert.Equal(t, "doppelmark", progs[1].UID(), "format %s", format)
+			assert.Equal(t, "bwa", progs[1].Previous(), "format %s", format)
+			assert.Equal(t, opts.CommandLine, progs[1].Command(), "format %s", format)
+		}
+		assert.NoError(t, p.Close())
+	}
+}
@@ -0,0 +1,278 @@
+// Copyright 2019 Grail Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package markduplicates
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/Schaudge/hts/sam"
+)
+
+// With Opts.ProgressInterval, Mark logs its progress every interval:
+// the shards that are marked, the records read and written, the
+// position of the last record read, the records read per second since
+// the marking of the shards started, and an ETA. The records of the
+// input are estimated from its BAI index, if it has one, and without it
+// there is no ETA. The records in the padding of a shard, and those
+// read while scanning for distant mates, are not counted. The progress
+// is logged, so it never goes to the output on stdout. With
+// Opts.ProgressFunc, each Progress is also passed to it, and once more
+// when Mark is done. While the shards of a BAM output are marked, it
+// also has the depths of the queues between the stages of the
+// pipeline: a queue that is full feeds the stage that is the
+// bottleneck, see pipeline.go.
+
+// QueueDepth is the number of shards in a queue, and its capacity.
+type QueueDepth struct {
+	Len, Cap int
+}
+
+// Progress is the progress of Mark, see Opts.ProgressInterval.
+type Progress struct {
+	// ShardsDone and Shards are the numbers of shards that are marked,
+	// and of all the shards. Queryname grouped input is one shard.
+	ShardsDone, Shards int
+	// RecordsRead and RecordsWritten are the records read and written
+	// so far.
+	RecordsRead, RecordsWritten int64
+	// Position is the position of the last record read, as
+	// "ref:pos" with a 1-based pos, or "*" for an unmapped record.
+	Position string
+	// TotalRecords is the estimated number of records of the input,
+	// or 0 if it is not known.
+	TotalRecords int64
+	// Elapsed is the time since Mark started.
+	Elapsed time.Duration
+	// RecordsPerSecond is the rate of RecordsRead since the marking of
+	// the shards started.
+	RecordsPerSecond float64
+	// ETA is the estimated time until all records are read, or 0 if
+	// TotalRecords is not known.
+	ETA time.Duration
+	// Done is true for the last Progress, when Mark is done.
+	Done bool
+	// ReadQueue, MarkQueue and WriteQueue are the shards waiting to be
+	// read, marked and written by the pipeline of the BAM output. They
+	// are zero outside of it.
+	ReadQueue, MarkQueue, WriteQueue QueueDepth
+}
+
+// String returns p as a log line.
+func (p Progress) String() string {
+	s := fmt.Sprintf("shards %d/%d, records read %d, written %d, position %s, %.0f records/s, elapsed %v",
+		p.ShardsDone, p.Shards, p.RecordsRead, p.RecordsWritten, p.Position, p.RecordsPerSecond,
+		p.Elapsed.Round(time.Second))
+	if p.TotalRecords > 0 {
+		s += fmt.Sprintf(", %.1f%% of about %d records, ETA %v",
+			100*float64(p.RecordsRead)/float64(p.TotalRecords), p.TotalRecords, p.ETA.Round(time.Second))
+	}
+	if p.WriteQueue.Cap > 0 {
+		s += fmt.Sprintf(", queues read %d/%d, mark %d/%d, write %d/%d", p.ReadQueue.Len, p.ReadQueue.Cap,
+			p.MarkQueue.Len, p.MarkQueue.Cap, p.WriteQueue.Len, p.WriteQueue.Cap)
+	}
+	return s
+}
+
+// progressTracker accumulates the progress of Mark. It is safe for
+// concurrent use.
+type progressTracker struct {
+	start        time.Time
+	totalRecords int64
+	shards       int64
+	shardsDone   int64
+	read         int64
+	written      int64
+
+	mutex     sync.Mutex
+	markStart time.Time
+	position  string
+	// queues, if not nil, returns the depths of the queues of the
+	// pipeline.
+	queues func() (read, mark, write QueueDepth)
+}
+
+// newProgressTracker returns a tracker of an input of about
+// totalRecords records, or of an unknown number if it is 0.
+func newProgressTracker(totalRecords int64) *progressTracker {
+	return &progressTracker{start: time.Now(), totalRecords: totalRecords, position: "*"}
+}
+
+// setShards sets the number of shards, when their marking starts.
+func (t *progressTracker) setShards(n int) {
+	atomic.StoreInt64(&t.shards, int64(n))
+	t.mutex.Lock()
+	t.markStart = time.Now()
+	t.mutex.Unlock()
+}
+
+// add adds the read and written records, where r, if non-nil, is the
+// last record read. It does nothing if t is nil.
+func (t *progressTracker) add(read, written int64, r *sam.Record) {
+	if t == nil {
+		return
+	}
+	atomic.AddInt64(&t.read, read)
+	atomic.AddInt64(&t.written, written)
+	if r == nil {
+		return
+	}
+	position := "*"
+	if r.Ref != nil {
+		position = fmt.Sprintf("%s:%d", r.Ref.Name(), r.Pos+1)
+	}
+	t.mutex.Lock()
+	t.position = position
+	t.mutex.Unlock()
+}
+
+// setQueues sets the function that returns the depths of the queues of
+// the pipeline, or clears it if queues is nil. It does nothing if t is
+// nil.
+func (t *progressTracker) setQueues(queues func() (read, mark, write QueueDepth)) {
+	if t == nil {
+		return
+	}
+	t.mutex.Lock()
+	t.queues = queues
+	t.mutex.Unlock()
+}
+
+// shardDone counts a marked shard. It does nothing if t is nil.
+func (t *progressTracker) shardDone() {
+	if t == nil {
+		return
+	}
+	atomic.AddInt64(&t.shardsDone, 1)
+}
+
+// progress returns the current progress.
+func (t *progressTracker) progress() Progress {
+	now := time.Now()
+	t.mutex.Lock()
+	markStart, position, queues := t.markStart, t.position, t.queues
+	t.mutex.Unlock()
+	p := Progress{
+		ShardsDone:     int(atomic.LoadInt64(&t.shardsDone)),
+		Shards:         int(atomic.LoadInt64(&t.shards)),
+		RecordsRead:    atomic.LoadInt64(&t.read),
+		RecordsWritten: atomic.LoadInt64(&t.written),
+		Position:       position,
+		TotalRecords:   t.totalRecords,
+		Elapsed:        now.Sub(t.start),
+	}
+	if queues != nil {
+		p.ReadQueue, p.MarkQueue, p.WriteQueue = queues()
+	}
+	if !markStart.IsZero() && now.After(markStart) {
+		p.RecordsPerSecond = float64(p.RecordsRead) / now.Sub(markStart).Seconds()
+	}
+	if p.TotalRecords > 0 && p.RecordsPerSecond > 0 && p.RecordsRead < p.TotalRecords {
+		p.ETA = time.Duration(float64(p.TotalRecords-p.RecordsRead) / p.RecordsPerSecond * float64(time.Second))
+	}
+	return p
+}
+
+// shardProgress counts the records of a shard, and adds them to its
+// tracker every cancelCheckInterval records read, so that the workers
+// do not contend for the tracker on each record.
+type shardProgress struct {
+	tracker       *progressTracker
+	read, written int64
+}
+
+// addRead counts r as read.
+func (p *shardProgress) addRead(r *sam.Record) {
+	p.read++
+	if p.read == cancelCheckInterval {
+		p.flush(r)
+	}
+}
+
+// flush adds the counted records to the tracker, where r, if non-nil,
+// is the last record read.
+func (p *shardProgress) flush(r *sam.Record) {
+	p.tracker.add(p.read, p.written, r)
+	p.read, p.written = 0, 0
+}
+
+// estimateTotalRecords returns the number of records of the input
+// estimated from its BAI index Opts.IndexFile, or 0 if it has none.
+func (m *MarkDuplicates) estimateTotalRecords(ctx context.Context) int64 {
+	if m.stream != nil || isStdin(m.Opts.BamFile) || len(inputPaths(m.Opts.BamFile)) != 1 || m.Opts.IndexFile == "" {
+		return 0
+	}
+	index, err := readIndex(ctx, m.Opts.IndexFile)
+	if err != nil {
+		shardLog.Debugf("no ETA: %v", err)
+		return 0
+	}
+	var total uint64
+	for id := 0; id < index.NumRefs(); id++ {
+		if stats, ok := index.ReferenceStats(id); ok {
+			total += stats.Mapped + stats.Unmapped
+		}
+	}
+	if unmapped, ok := index.Unmapped(); ok {
+		total += unmapped
+	}
+	return int64(total)
+}
+
+// startProgress starts reporting the progress of m every
+// Opts.ProgressInterval, and returns a function that stops it and
+// reports the final progress.
+func (m *MarkDuplicates) startProgress(ctx context.Context) (stop func()) {
+	if m.Opts.ProgressInterval <= 0 && m.Opts.ProgressFunc == nil {
+		m.progress = newProgressTracker(0)
+		return func() {}
+	}
+	m.progress = newProgressTracker(m.estimateTotalRecords(ctx))
+	report := func(p Progress) {
+		if m.Opts.ProgressInterval > 0 {
+			shardLog.Printf("progress: %v", p)
+		}
+		if m.Opts.ProgressFunc != nil {
+			m.Opts.ProgressFunc(p)
+		}
+	}
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	if m.Opts.ProgressInterval > 0 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ticker := time.NewTicker(m.Opts.ProgressInterval)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-ticker.C:
+					report(m.progress.progress())
+				case <-done:
+					return
+				}
+			}
+		}()
+	}
+	return func() {
+		close(done)
+		wg.Wait()
+		p := m.progress.progress()
+		p.Done = true
+		report(p)
+	}
+}
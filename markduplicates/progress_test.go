@@ -0,0 +1,132 @@
+// Copyright 2019 Grail Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package markduplicates
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Schaudge/hts/sam"
+	"github.com/grailbio/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestProgress(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	var coordinate []*sam.Record
+	for i := 0; i < 1500; i++ {
+		name := fmt.Sprintf("T%d:::1:10:%d:%d", i, rnd.Intn(5000), rnd.Intn(5000))
+		pos := rnd.Intn(chr1.Len() - 100)
+		coordinate = append(coordinate,
+			NewRecord(name, chr1, pos, r1F, pos+50, chr1, cigar0),
+			NewRecord(name, chr1, pos+50, r2R, pos, chr1, cigar0))
+	}
+	queryname := make([]*sam.Record, len(coordinate))
+	copy(queryname, coordinate)
+	sort.SliceStable(coordinate, func(i, j int) bool {
+		return coordinate[i].Pos < coordinate[j].Pos
+	})
+
+	tests := []struct {
+		name    string
+		header  *sam.Header
+		records []*sam.Record
+		format  string
+		shards  int
+	}{
+		// The fake provider has one shard, and the unmapped shard is
+		// added to it.
+		{"coordinate bam", header, coordinate, "bam", 2},
+		{"coordinate pam", header, coordinate, "pam", 2},
+		{"queryname", querynameHeader(t, "@HD\tVN:1.6\tSO:queryname\n"), queryname, "bam", 1},
+	}
+
+	tempDir, cleanup := testutil.TempDir(t, "", "")
+	defer cleanup()
+	for testIdx, test := range tests {
+		var (
+			mutex    sync.Mutex
+			progress []Progress
+		)
+		opts := defaultOpts
+		opts.OutputPath = NewTestOutput(tempDir, testIdx, test.format)
+		opts.Format = test.format
+		opts.ProgressInterval = time.Millisecond
+		opts.ProgressFunc = func(p Progress) {
+			mutex.Lock()
+			progress = append(progress, p)
+			mutex.Unlock()
+		}
+		markDuplicates := &MarkDuplicates{
+			Provider: newTestProvider(t, test.header, test.records),
+			Opts:     &opts,
+		}
+		_, err := markDuplicates.Mark(nil)
+		assert.NoError(t, err, "test %s", test.name)
+
+		// Only the last progress is done, and it counts every record.
+		if !assert.NotEmpty(t, progress, "test %s", test.name) {
+			continue
+		}
+		last := progress[len(progress)-1]
+		for _, p := range progress[:len(progress)-1] {
+			assert.False(t, p.Done, "test %s", test.name)
+			assert.True(t, p.RecordsRead <= last.RecordsRead, "test %s", test.name)
+		}
+		assert.True(t, last.Done, "test %s", test.name)
+		assert.Equal(t, test.shards, last.Shards, "test %s", test.name)
+		assert.Equal(t, test.shards, last.ShardsDone, "test %s", test.name)
+		assert.Equal(t, int64(len(test.records)), last.RecordsRead, "test %s", test.name)
+		assert.Equal(t, int64(len(test.records)), last.RecordsWritten, "test %s", test.name)
+		// The fake provider has no index, so there is no ETA.
+		assert.Equal(t, int64(0), last.TotalRecords, "test %s", test.name)
+		assert.Equal(t, time.Duration(0), last.ETA, "test %s", test.name)
+	}
+
+	opts := validOpts()
+	opts.ProgressInterval = -time.Second
+	err := validate(&opts)
+	var optsErr *OptsError
+	if assert.True(t, errors.As(err, &optsErr), "%v", err) {
+		assert.Len(t, optsErr.Problems, 1, "%v", err)
+		assert.Contains(t, err.Error(), "progress-interval must be non-negative")
+	}
+}
+
+func TestProgressString(t *testing.T) {
+	p := Progress{
+		ShardsDone:       3,
+		Shards:           10,
+		RecordsRead:      2500,
+		RecordsWritten:   2000,
+		Position:         "chr1:1001",
+		Elapsed:          90 * time.Second,
+		RecordsPerSecond: 25,
+	}
+	assert.Equal(t, "shards 3/10, records read 2500, written 2000, position chr1:1001, 25 records/s, elapsed 1m30s",
+		p.String())
+	p.TotalRecords = 10000
+	p.ETA = 300 * time.Second
+	assert.Equal(t, "shards 3/10, records read 2500, written 2000, position chr1:1001, 25 records/s, elapsed 1m30s, "+
+		"25.0% of about 10000 records, ETA 5m0s", p.String())
+	p.TotalRecords = 0
+	p.ReadQueue, p.MarkQueue, p.WriteQueue = QueueDepth{0, 2}, QueueDepth{4, 4}, QueueDepth{1, 8}
+	assert.Equal(t, "shards 3/10, records read 2500, written 2000, position chr1:1001, 25 records/s, elapsed 1m30s, "+
+		"queues read 0/2, mark 4/4, write 1/8", p.String())
+}
@@ -0,0 +1,329 @@
+// Copyright 2019 Grail Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package markduplicates
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/Schaudge/grailbase/errors"
+	"github.com/Schaudge/grailbase/vcontext"
+	"github.com/Schaudge/grailbio/encoding/bam"
+	"github.com/Schaudge/grailbio/encoding/bampair"
+	"github.com/Schaudge/grailbio/encoding/bamprovider"
+	"github.com/Schaudge/hts/sam"
+)
+
+// Aligners write their output grouped by read name, so Mark also
+// accepts queryname grouped input, with a header that has SO:queryname
+// or GO:query, or with Opts.InputOrder "queryname". The records of a
+// template are then adjacent, so the readpairs are built directly as
+// the input is read once, as a BAM stream in file order, without
+// sharding it or scanning it for distant mates. The duplicate sets of
+// the whole input are resolved at once with the same duplicateIndex as
+// a shard, and the records are written in the input order, so the
+// output stays queryname grouped. All the records are held in memory
+// until they are written.
+
+// Values of Opts.InputOrder.
+const (
+	inputOrderCoordinate = "coordinate"
+	inputOrderQueryname  = "queryname"
+)
+
+// inputOrder returns the order of the input with header, "coordinate"
+// or "queryname". A header without SO and GO has the order of
+// opts.InputOrder, or "coordinate" if it is not set. Otherwise the
+// header must be coordinate sorted or queryname grouped, and agree
+// with opts.InputOrder if it is set.
+func inputOrder(opts *Opts, header *sam.Header) (string, error) {
+	var order string
+	switch {
+	case header.SortOrder == sam.Coordinate:
+		order = inputOrderCoordinate
+	case header.SortOrder == sam.QueryName || header.GroupOrder == sam.GroupQuery:
+		order = inputOrderQueryname
+	case header.SortOrder == sam.UnknownOrder && header.GroupOrder == sam.GroupUnspecified:
+		if opts.InputOrder == "" {
+			return inputOrderCoordinate, nil
+		}
+		return opts.InputOrder, nil
+	case len(header.Refs()) == 0 && opts.InputOrder == "":
+		// Without references, as in an unaligned BAM, all the reads
+		// are unmapped, so they can be in any order.
+		return inputOrderCoordinate, nil
+	default:
+		return "", fmt.Errorf("input must be coordinate sorted or queryname grouped, but its header has SO:%v GO:%v",
+			header.SortOrder, header.GroupOrder)
+	}
+	if opts.InputOrder != "" && opts.InputOrder != order {
+		return "", fmt.Errorf("input-order is %s, but the input header has SO:%v GO:%v", opts.InputOrder,
+			header.SortOrder, header.GroupOrder)
+	}
+	return order, nil
+}
+
+// checkQuerynameOpts returns an error if opts cannot be used with
+// queryname grouped input.
+func checkQuerynameOpts(opts *Opts) error {
+	if bamprovider.ParseFileType(opts.Format) != bamprovider.BAM {
+		return fmt.Errorf("queryname grouped input requires bam output, not %s", opts.Format)
+	}
+	if opts.CoverageMax > 0 {
+		return fmt.Errorf("coverage-max cannot be used with queryname grouped input")
+	}
+	if opts.DuplicatesOutput != "" {
+		return fmt.Errorf("duplicates-output cannot be used with queryname grouped input")
+	}
+	if opts.Regions != "" {
+		return fmt.Errorf("regions cannot be used with queryname grouped input")
+	}
+	if opts.IndexFormat == indexFormatBAI || opts.IndexFormat == indexFormatCSI {
+		return fmt.Errorf("queryname grouped output cannot be indexed, set output-index-format to none")
+	}
+	return nil
+}
+
+// markQueryname marks the duplicates of queryname grouped input, and
+// writes the output in the input order.
+func (m *MarkDuplicates) markQueryname(ctx context.Context, header *sam.Header) error {
+	if err := checkQuerynameOpts(m.Opts); err != nil {
+		return err
+	}
+	shard := bam.UniversalShard(header)
+	var processor bampair.RecordProcessor
+	if m.Opts.OpticalDetector != nil {
+		processor = m.Opts.OpticalDetector.GetRecordProcessor()
+	}
+	if m.Opts.FlagSecondaryDups {
+		m.secondaryDups = newSecondaryDupTable()
+	}
+
+	var matcher duplicateMatcher = newDuplicateIndex(0, header, m.readGroupLibrary, m.readGroups, m.noLocationRGs,
+		m.Opts, m.umiCorrector, m.umiAllowlist, m.scatter)
+	mc := NewMetricsCollection()
+	pairsByName := make(map[string]*readPair)
+	singlesByName := make(map[string]*readPair)
+	malformed := make(map[string]bool)
+	mismatched := make(map[string]bool)
+	var records []*sam.Record
+
+	m.progress.setShards(1)
+	progress := &shardProgress{tracker: m.progress}
+	iter, err := m.querynameInput(ctx)
+	if err != nil {
+		return err
+	}
+	if m.filter != nil {
+		iter = &groupFilterIterator{recordIterator: iter, filter: m.filter, collector: m.filtered}
+	}
+	for fileIdx := uint64(0); iter.Scan(); fileIdx++ {
+		if fileIdx%cancelCheckInterval == 0 {
+			if err := cancelled(ctx); err != nil {
+				return err
+			}
+		}
+		r := iter.Record()
+		progress.addRead(r)
+		if m.Opts.Flagstat {
+			mc.InputFlagstat.add(r)
+		}
+		m.Opts.clearExisting(r)
+		if err := checkUmis(m.Opts, r); err != nil {
+			return err
+		}
+		if processor != nil {
+			if err := processor.Process(shard, r); err != nil {
+				return err
+			}
+		}
+		updateMetrics(m.Opts, m.readGroups, m.metricsRegions, m.umiAllowlist, m.filtered, mc, r)
+		records = append(records, r)
+
+		switch {
+		case (r.Flags & (sam.Secondary | sam.Supplementary)) != 0:
+			if m.secondaryDups != nil {
+				m.secondaryDups.templates[templateKey(r)] = true
+			}
+		case (r.Flags & sam.Unmapped) != 0:
+			// Unmapped records are passed through.
+		case m.hasNoMappedMate(r) && m.Opts.excludedFromDups(r):
+			mc.ExcludedFromDupAnalysis++
+		case m.hasNoMappedMate(r):
+			singlesByName[r.Name] = &readPair{left: r, leftFileIdx: fileIdx}
+			matcher.insertSingleton(r, fileIdx)
+		case mismatched[r.Name]:
+			mc.MateMismatchReads++
+		default:
+			pair, ok := pairsByName[r.Name]
+			if !ok {
+				pairsByName[r.Name] = &readPair{left: r, leftFileIdx: fileIdx}
+				continue
+			}
+			if pair.isExtra(r) {
+				if err := m.extraRead(&shard, r, mc, malformed); err != nil {
+					return err
+				}
+				continue
+			}
+			if mismatch := mateMismatch(pair.left, r); mismatch != "" {
+				if err := m.mismatchedMates(&shard, pair.left, r, mismatch, mc, mismatched); err != nil {
+					return err
+				}
+				delete(pairsByName, r.Name)
+				continue
+			}
+			if err := pair.addRead(r, fileIdx); err != nil {
+				return err
+			}
+			if m.Opts.addsMateTags() {
+				if err := addPairMateTags(m.Opts, &shard, pair); err != nil {
+					return err
+				}
+			}
+			if m.Opts.excludedFromDups(pair.left) || m.Opts.excludedFromDups(pair.right) {
+				mc.ExcludedFromDupAnalysis += 2
+				continue
+			}
+			matcher.insertPair(pair.left, pair.right, pair.leftFileIdx, pair.rightFileIdx)
+			mc.addMatedPair(shard.ShardIdx, pair, false)
+		}
+	}
+	if err := iter.Close(); err != nil {
+		return err
+	}
+	progress.flush(nil)
+	if processor != nil {
+		processor.Close(shard)
+		m.globalMetrics.maxX, m.globalMetrics.maxY = m.Opts.OpticalDetector.RecordProcessorsDone()
+	}
+	for name, pair := range pairsByName {
+		if pair.right == nil {
+			return errors.E(ErrMissingMate, fmt.Sprintf("could not find the mate of %s, check that the input is queryname grouped", name))
+		}
+	}
+
+	var molecules map[string]sam.Aux
+	if m.Opts.EmitMITag && !m.Opts.MetricsOnly {
+		molecules = make(map[string]sam.Aux)
+	}
+	var duplicates map[string]bool
+	if m.secondaryDups != nil {
+		duplicates = make(map[string]bool)
+	}
+	var unmappedMateDups map[string]bool
+	if m.Opts.FlagUnmappedMates {
+		unmappedMateDups = make(map[string]bool)
+	}
+	dupMetrics, err := flagDuplicates(m.Opts, &shard, m.readGroups, m.metricsRegions, singlesByName, pairsByName,
+		matcher, molecules, duplicates, unmappedMateDups, m.dupSetReport, m.hotspots, m.gc)
+	if err != nil {
+		return err
+	}
+	mc.Merge(dupMetrics)
+	if m.secondaryDups != nil {
+		m.secondaryDups.addDuplicates(duplicates)
+	}
+
+	output := records[:0]
+	for _, r := range records {
+		if tag, ok := molecules[r.Name]; ok {
+			setMoleculeTag(r, tag)
+		}
+		if m.secondaryDups != nil && (r.Flags&(sam.Secondary|sam.Supplementary)) != 0 {
+			m.secondaryDups.flag(m.Opts, r, mc)
+		}
+		if unmappedMateDups[r.Name] {
+			flagUnmappedMate(m.Opts, r)
+		}
+		m.protectDuplicate(r, mc)
+		if !m.Opts.RemoveDups || (r.Flags&sam.Duplicate) == 0 {
+			output = append(output, r)
+		} else {
+			if m.Opts.Flagstat {
+				mc.RemovedFlagstat.add(r)
+			}
+			putRecord(r)
+		}
+	}
+	if err := cancelled(ctx); err != nil {
+		return err
+	}
+	m.globalMetrics.Merge(mc)
+	if m.Opts.MetricsOnly {
+		for _, r := range output {
+			putRecord(r)
+		}
+		progress.tracker.shardDone()
+		return nil
+	}
+	if err := m.writeRecords(header, output); err != nil {
+		return err
+	}
+	progress.written = int64(len(output))
+	progress.flush(nil)
+	progress.tracker.shardDone()
+	return nil
+}
+
+// writeRecords writes records to the output, Opts.OutputPath, or
+// stdout if it is not set, as a BAM file of one shard. The records are
+// returned to the free pool as they are written, and counted for
+// Opts.Flagstat.
+func (m *MarkDuplicates) writeRecords(header *sam.Header, records []*sam.Record) (err error) {
+	ctx := vcontext.Background()
+	var outputStream io.Writer = os.Stdout
+	if m.output != nil {
+		outputStream = m.output
+	} else if !isStdout(m.Opts.OutputPath) {
+		out, err := createOutput(ctx, m.Opts.OutputPath)
+		if err != nil {
+			return fmt.Errorf("couldn't create output file %s: %v", m.Opts.OutputPath, err)
+		}
+		defer func() {
+			if err2 := out.Close(ctx); err == nil && err2 != nil {
+				err = fmt.Errorf("close %s: %v", m.Opts.OutputPath, err2)
+			}
+		}()
+		outputStream = out
+	}
+	header, err = programHeader(header, m.Opts.CommandLine)
+	if err != nil {
+		return err
+	}
+	writer, err := newBAMWriter(m.Opts, outputStream, header)
+	if err != nil {
+		return fmt.Errorf("couldn't create bam writer for %s: %v", m.Opts.OutputPath, err)
+	}
+	compressor := newShardCompressor(writer, m.Opts.compressionThreads())
+	if err := compressor.startShard(0, false); err != nil {
+		return err
+	}
+	var flagstatOutput FlagstatCounts
+	for _, r := range records {
+		if m.Opts.Flagstat {
+			flagstatOutput.add(r)
+		}
+		if err := compressor.addRecord(r); err != nil {
+			return err
+		}
+	}
+	m.globalMetrics.mergeOutputFlagstat(&flagstatOutput, &FlagstatCounts{})
+	if err := compressor.closeShard(); err != nil {
+		return err
+	}
+	return writer.Close()
+}
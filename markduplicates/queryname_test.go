@@ -0,0 +1,133 @@
+// Copyright 2019 Grail Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package markduplicates
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/Schaudge/grailbio/encoding/bamprovider"
+	"github.com/Schaudge/hts/sam"
+	"github.com/grailbio/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+// querynameHeader returns a header with chr1 and chr2 and the given
+// @HD line.
+func querynameHeader(t *testing.T, hd string) *sam.Header {
+	return newTestHeader(t, hd)
+}
+
+// newTestProvider returns a provider of records with header. The
+// iterators of a fake provider require coordinate sorted records, so
+// queryname grouped records are written to a BAM file instead, which
+// markQueryname reads as a stream.
+func newTestProvider(t *testing.T, header *sam.Header, records []*sam.Record) bamprovider.Provider {
+	if order, err := inputOrder(&Opts{}, header); err != nil || order != inputOrderQueryname {
+		return bamprovider.NewFakeProvider(header, records)
+	}
+	tempDir, cleanup := testutil.TempDir(t, "", "")
+	t.Cleanup(cleanup)
+	path := filepath.Join(tempDir, "queryname.bam")
+	writeTestBAM(t, path, header, records)
+	return bamprovider.NewProvider(path)
+}
+
+func TestInputOrder(t *testing.T) {
+	for _, test := range []struct {
+		hd         string
+		inputOrder string
+		expected   string
+	}{
+		{"", "", "coordinate"},
+		{"", "queryname", "queryname"},
+		{"@HD\tVN:1.6\tSO:coordinate\n", "", "coordinate"},
+		{"@HD\tVN:1.6\tSO:coordinate\n", "coordinate", "coordinate"},
+		{"@HD\tVN:1.6\tSO:coordinate\n", "queryname", ""},
+		{"@HD\tVN:1.6\tSO:queryname\n", "", "queryname"},
+		{"@HD\tVN:1.6\tSO:unsorted\tGO:query\n", "", "queryname"},
+		{"@HD\tVN:1.6\tSO:queryname\n", "coordinate", ""},
+		{"@HD\tVN:1.6\tSO:unsorted\n", "", ""},
+		{"@HD\tVN:1.6\tSO:unsorted\tGO:reference\n", "", ""},
+	} {
+		order, err := inputOrder(&Opts{InputOrder: test.inputOrder}, querynameHeader(t, test.hd))
+		if test.expected == "" {
+			assert.Error(t, err, "header %q input order %q", test.hd, test.inputOrder)
+			continue
+		}
+		assert.NoError(t, err, "header %q input order %q", test.hd, test.inputOrder)
+		assert.Equal(t, test.expected, order, "header %q input order %q", test.hd, test.inputOrder)
+	}
+}
+
+func TestQuerynameDuplicates(t *testing.T) {
+	// B is a duplicate of A, and has a secondary record. D is a
+	// mate-unmapped duplicate of C, and F is a duplicate of E, whose
+	// reads are on different references.
+	records := func() []*sam.Record {
+		return []*sam.Record{
+			NewRecord("A:::1:10:1:1", chr1, 0, r1F, 500, chr1, cigar0),
+			NewRecord("A:::1:10:1:1", chr1, 500, r2R, 0, chr1, cigar0),
+			NewRecord("B:::1:10:1:1", chr1, 500, r2R, 0, chr1, cigar0),
+			NewRecord("B:::1:10:1:1", chr1, 0, r1F, 500, chr1, cigar0),
+			NewRecord("B:::1:10:1:1", chr2, 100, sec, 500, chr1, cigar0),
+			NewRecord("C:::1:10:1:1", chr1, 300, s1F, 300, chr1, cigar0),
+			NewRecord("C:::1:10:1:1", chr1, 300, u2, 300, chr1, cigar0),
+			NewRecord("D:::1:10:1:1", chr1, 300, s1F, 300, chr1, cigar0),
+			NewRecord("D:::1:10:1:1", chr1, 300, u2, 300, chr1, cigar0),
+			NewRecord("E:::1:10:1:1", chr1, 700, r1F, 50, chr2, cigar0),
+			NewRecord("E:::1:10:1:1", chr2, 50, r2R, 700, chr1, cigar0),
+			NewRecord("F:::1:10:1:1", chr1, 700, r1F, 50, chr2, cigar0),
+			NewRecord("F:::1:10:1:1", chr2, 50, r2R, 700, chr1, cigar0),
+		}
+	}
+	expectedDups := []bool{false, false, true, true, true, false, false, true, false, false, false, true, true}
+
+	tempDir, cleanup := testutil.TempDir(t, "", "")
+	defer cleanup()
+	for testIdx, hd := range []string{"@HD\tVN:1.6\tSO:queryname\n", "@HD\tVN:1.6\tSO:unsorted\tGO:query\n"} {
+		input := records()
+		opts := defaultOpts
+		opts.OutputPath = NewTestOutput(tempDir, testIdx, "bam")
+		opts.Format = "bam"
+		opts.FlagSecondaryDups = true
+
+		markDuplicates := &MarkDuplicates{
+			Provider: newTestProvider(t, querynameHeader(t, hd), input),
+			Opts:     &opts,
+		}
+		actualMetrics, err := markDuplicates.Mark(nil)
+		assert.NoError(t, err, "header %q", hd)
+		assert.Equal(t, int64(1), actualMetrics.SecondarySupplementaryDups, "header %q", hd)
+
+		// The output is in the input order.
+		actualRecords := ReadRecords(t, opts.OutputPath)
+		assert.Equal(t, len(input), len(actualRecords), "header %q", hd)
+		for i, r := range actualRecords {
+			assert.Equal(t, input[i].Name, r.Name, "header %q", hd)
+			assert.Equal(t, expectedDups[i], (r.Flags&sam.Duplicate) != 0, "header %q record %v", hd, r)
+		}
+	}
+
+	// The output of queryname grouped input must be bam.
+	opts := defaultOpts
+	opts.OutputPath = NewTestOutput(tempDir, 2, "pam")
+	opts.Format = "pam"
+	markDuplicates := &MarkDuplicates{
+		Provider: newTestProvider(t, querynameHeader(t, "@HD\tVN:1.6\tSO:queryname\n"), records()),
+		Opts:     &opts,
+	}
+	_, err := markDuplicates.Mark(nil)
+	assert.Error(t, err)
+}
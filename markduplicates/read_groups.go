@@ -0,0 +1,123 @@
+// Copyright 2019 Grail Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package markduplicates
+
+import (
+	"sort"
+	"sync"
+
+	"github.com/Schaudge/hts/sam"
+)
+
+// Interned read groups
+//
+// Every read is keyed by its read group and library: for the duplicate
+// keys, the metrics, and the optical grouping. getReadGroup returns a
+// new string for each call, and GetLibrary hashes it again, so these
+// lookups were a large share of the allocations per read. A
+// readGroupTable resolves the bytes of the RG tag of a read to a
+// readGroupInfo, with a small integer id and the read group and
+// library strings, built once from the read groups of the header and
+// Opts.LibraryMap. The optical grouping keys hold the id, and the
+// strings that key the metrics are shared by all the reads of a read
+// group. Read groups that are not in the header are added to the table
+// the first time they are seen, with the library GetLibrary would give
+// them.
+
+// readGroupInfo is a read group of a readGroupTable.
+type readGroupInfo struct {
+	// id is the index of the read group in the table.
+	id int
+	// tag is the RG tag of the reads of the read group, or "" for the
+	// reads without one, and name is tag or NoReadGroup.
+	tag, name string
+	// library is the library of the read group, as GetLibrary.
+	library string
+}
+
+// readGroupTable resolves the RG tags of reads to readGroupInfos. It is
+// safe for concurrent use.
+type readGroupTable struct {
+	readGroupLibrary map[string]string
+	// none is the read group of the reads without an RG tag, and known
+	// the read groups of readGroupLibrary. They are not modified after
+	// newReadGroupTable.
+	none  *readGroupInfo
+	known map[string]*readGroupInfo
+	// infos has the read groups by id, and unknown the read groups
+	// that are not in readGroupLibrary.
+	mutex   sync.Mutex
+	infos   []*readGroupInfo
+	unknown map[string]*readGroupInfo
+}
+
+// newReadGroupTable returns a table of the read groups of
+// readGroupLibrary, see readGroupLibraries. readGroupLibrary may be
+// nil.
+func newReadGroupTable(readGroupLibrary map[string]string) *readGroupTable {
+	t := &readGroupTable{
+		readGroupLibrary: readGroupLibrary,
+		known:            make(map[string]*readGroupInfo, len(readGroupLibrary)),
+		unknown:          make(map[string]*readGroupInfo),
+	}
+	t.none = t.newInfo("", NoReadGroup)
+	names := make([]string, 0, len(readGroupLibrary))
+	for name := range readGroupLibrary {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		t.known[name] = t.newInfo(name, name)
+	}
+	return t
+}
+
+// newInfo adds the read group of the reads with the RG tag tag to
+// t.infos.
+func (t *readGroupTable) newInfo(tag, name string) *readGroupInfo {
+	library := t.readGroupLibrary[name]
+	if library == "" {
+		library = unknownLibrary
+	}
+	info := &readGroupInfo{id: len(t.infos), tag: tag, name: name, library: library}
+	t.infos = append(t.infos, info)
+	return info
+}
+
+// get returns the read group of r. It does not allocate for the read
+// groups of the header.
+func (t *readGroupTable) get(r *sam.Record) *readGroupInfo {
+	tag, found := readGroupBytes(r)
+	if !found {
+		return t.none
+	}
+	if info, ok := t.known[string(tag)]; ok {
+		return info
+	}
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if info, ok := t.unknown[string(tag)]; ok {
+		return info
+	}
+	info := t.newInfo(string(tag), string(tag))
+	t.unknown[info.tag] = info
+	return info
+}
+
+// info returns the read group with the given id.
+func (t *readGroupTable) info(id int) *readGroupInfo {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return t.infos[id]
+}
@@ -0,0 +1,78 @@
+// Copyright 2019 Grail Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package markduplicates
+
+import (
+	"testing"
+
+	"github.com/Schaudge/hts/sam"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReadGroupTable(t *testing.T) {
+	readGroupLibrary := readGroupLibraries(libraryHeader(t), &Opts{
+		DefaultLibrary: "libX",
+		LibraryMap:     map[string]string{"rg4": "lib4"},
+	})
+	table := newReadGroupTable(readGroupLibrary)
+	records := []*sam.Record{
+		NewRecordAux("A", chr1, 0, r1F, 10, chr1, cigar0, NewAux("RG", "rg1")),
+		NewRecordAux("B", chr1, 0, r1F, 10, chr1, cigar0, NewAux("RG", "rg3")),
+		NewRecordAux("C", chr1, 0, r1F, 10, chr1, cigar0, NewAux("RG", "rg4")),
+		NewRecordAux("D", chr1, 0, r1F, 10, chr1, cigar0, NewAux("RG", "rg5")),
+		NewRecord("E", chr1, 0, r1F, 10, chr1, cigar0),
+	}
+	// The table has the same read groups and libraries as
+	// readGroupOrDefault and GetLibrary.
+	for _, r := range records {
+		readGroup := table.get(r)
+		tag, _ := getReadGroup(r)
+		assert.Equal(t, tag, readGroup.tag, "read %s", r.Name)
+		assert.Equal(t, readGroupOrDefault(r), readGroup.name, "read %s", r.Name)
+		assert.Equal(t, GetLibrary(readGroupLibrary, r), readGroup.library, "read %s", r.Name)
+		assert.Equal(t, readGroup, table.info(readGroup.id), "read %s", r.Name)
+	}
+
+	// The reads of a read group, known or not, share an id, and the
+	// reads without a read group have id 0.
+	assert.Equal(t, 0, table.get(records[4]).id)
+	assert.Equal(t, table.get(records[0]).id, table.get(NewRecordAux("F", chr1, 0, r1F, 10, chr1, cigar0,
+		NewAux("RG", "rg1"))).id)
+	unknown := table.get(records[3])
+	assert.Equal(t, len(readGroupLibrary)+1, unknown.id)
+	assert.Equal(t, unknown, table.get(NewRecordAux("G", chr1, 0, r1F, 10, chr1, cigar0, NewAux("RG", "rg5"))))
+	assert.Equal(t, "Unknown Library", unknown.library)
+}
+
+// BenchmarkReadGroupLibrary compares the allocations of the read group
+// and library lookups of GetLibrary and of a readGroupTable.
+func BenchmarkReadGroupLibrary(b *testing.B) {
+	readGroupLibrary := map[string]string{"rg1": "lib1", "rg2": "lib2", NoReadGroup: unknownLibrary}
+	r := NewRecordAux("A", chr1, 0, r1F, 10, chr1, cigar0, NewAux("RG", "rg2"))
+	b.Run("GetLibrary", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			_ = readGroupOrDefault(r)
+			_ = GetLibrary(readGroupLibrary, r)
+		}
+	})
+	b.Run("readGroupTable", func(b *testing.B) {
+		table := newReadGroupTable(readGroupLibrary)
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			readGroup := table.get(r)
+			_, _ = readGroup.name, readGroup.library
+		}
+	})
+}
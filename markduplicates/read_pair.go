@@ -16,7 +16,7 @@ package markduplicates
 import (
 	"fmt"
 
-	"github.com/Schaudge/grailbase/log"
+	"github.com/Schaudge/grailbase/errors"
 	"github.com/Schaudge/grailbio/encoding/bam"
 	"github.com/Schaudge/hts/sam"
 )
@@ -39,6 +39,21 @@ type readPair struct {
 	// those values with a global fileIdx before finishing.
 	leftFileIdx  uint64
 	rightFileIdx uint64
+
+	// fetched is true if the mate of the first read of the pair was
+	// fetched through the index from outside Opts.Regions, see
+	// MarkDuplicates.fetchMate.
+	fetched bool
+}
+
+// countedIn returns true if p is counted in the metrics of shard: the
+// shard of its left read, or of its other read if the left read was
+// fetched from outside Opts.Regions.
+func (p *readPair) countedIn(shard *bam.Shard) bool {
+	if p.fetched && p.right != nil && !shard.RecordInPaddedShard(p.left) {
+		return shard.RecordInShard(p.right)
+	}
+	return shard.RecordInShard(p.left)
 }
 
 func (p *readPair) String() string {
@@ -46,20 +61,49 @@ func (p *readPair) String() string {
 		p.right.Ref.Name(), p.right.Pos, p.rightFileIdx)
 }
 
-func (p *readPair) addRead(newRead *sam.Record, fileIdx uint64) {
-	// Complete the pair, and adjust left and right order if necessary.
+// isExtra returns true if r is an extra primary record of the template
+// of p: p already has two reads, or a read with the same read number
+// as r.
+func (p *readPair) isExtra(r *sam.Record) bool {
 	if p.right != nil {
-		log.Fatalf("Tried to add third read %s %d to readPair", newRead.Name, newRead.Flags)
+		return true
+	}
+	const readNumber = sam.Read1 | sam.Read2
+	return (p.left.Flags & readNumber) == (r.Flags & readNumber)
+}
+
+// mateMismatch returns why r and mate, primary mapped records with the
+// same name, are not mates of each other, or "" if they are: one is R1
+// and the other R2, and the reference and position of each are the
+// mate reference and position of the other. Records of two templates
+// given the same name, e.g. when merging BAMs, usually are not.
+func mateMismatch(r, mate *sam.Record) string {
+	const readNumber = sam.Read1 | sam.Read2
+	switch {
+	case r.Flags&readNumber == 0 || r.Flags&readNumber == readNumber ||
+		r.Flags&readNumber == mate.Flags&readNumber || mate.Flags&readNumber == 0:
+		return fmt.Sprintf("flags %d and %d are not of an R1 and an R2", r.Flags, mate.Flags)
+	case r.MateRef.ID() != mate.Ref.ID() || r.MatePos != mate.Pos:
+		return fmt.Sprintf("the mate of %s:%d is at %s:%d, not %s:%d", r.Ref.Name(), r.Pos,
+			r.MateRef.Name(), r.MatePos, mate.Ref.Name(), mate.Pos)
+	case mate.MateRef.ID() != r.Ref.ID() || mate.MatePos != r.Pos:
+		return fmt.Sprintf("the mate of %s:%d is at %s:%d, not %s:%d", mate.Ref.Name(), mate.Pos,
+			mate.MateRef.Name(), mate.MatePos, r.Ref.Name(), r.Pos)
+	}
+	return ""
+}
+
+// addRead completes p with newRead, the mate of p.left. It returns an
+// error wrapping ErrMalformedTemplate if newRead is an extra read of
+// the template, see isExtra.
+func (p *readPair) addRead(newRead *sam.Record, fileIdx uint64) error {
+	// Complete the pair, and adjust left and right order if necessary.
+	if p.isExtra(newRead) {
+		return errors.E(ErrMalformedTemplate, fmt.Sprintf("tried to add read %s %d to the readpair of %s %d",
+			newRead.Name, newRead.Flags, p.left.Name, p.left.Flags))
 	}
 
-	// Order left and right by:
-	//  1) refId
-	//  2) unclipped position
-	//  3) fileIdx
-	if newRead.Ref.ID() < p.left.Ref.ID() ||
-		(newRead.Ref.ID() == p.left.Ref.ID() && bam.UnclippedFivePrimePosition(newRead) < bam.UnclippedFivePrimePosition(p.left)) ||
-		(newRead.Ref.ID() == p.left.Ref.ID() && bam.UnclippedFivePrimePosition(newRead) == bam.UnclippedFivePrimePosition(p.left) &&
-			fileIdx < p.leftFileIdx) {
+	if readBefore(newRead, fileIdx, p.left, p.leftFileIdx) {
 		p.right = p.left
 		p.rightFileIdx = p.leftFileIdx
 		p.left = newRead
@@ -68,4 +112,31 @@ func (p *readPair) addRead(newRead *sam.Record, fileIdx uint64) {
 		p.right = newRead
 		p.rightFileIdx = fileIdx
 	}
+	return nil
+}
+
+// readBefore returns true if the read a, at fileIdx aFileIdx, is the
+// left read of its readpair with its mate b, at bFileIdx. The reads are
+// ordered by:
+//  1. refId
+//  2. unclipped position
+//  3. fileIdx
+//  4. read number, R1 before R2
+//
+// The fileIdx of both reads is the same when the indices are
+// synthesized, e.g. for merged inputs, and the read number then keeps
+// the order from depending on which read arrives first. Mates have the
+// same name, so their names never break a tie.
+func readBefore(a *sam.Record, aFileIdx uint64, b *sam.Record, bFileIdx uint64) bool {
+	if a.Ref.ID() != b.Ref.ID() {
+		return a.Ref.ID() < b.Ref.ID()
+	}
+	if aPos, bPos := unclippedFivePrimePosition(a), unclippedFivePrimePosition(b); aPos != bPos {
+		return aPos < bPos
+	}
+	if aFileIdx != bFileIdx {
+		return aFileIdx < bFileIdx
+	}
+	const readNumber = sam.Read1 | sam.Read2
+	return a.Flags&readNumber < b.Flags&readNumber
 }
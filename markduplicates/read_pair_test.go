@@ -0,0 +1,140 @@
+// Copyright 2019 Grail Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package markduplicates
+
+import (
+	"testing"
+
+	"github.com/Schaudge/hts/sam"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReadPairAddRead(t *testing.T) {
+	tests := []struct {
+		// r1 is forward at position 100, and r2 reverse at r2Pos.
+		r1Cigar string
+		r2Pos   int
+		r2Cigar string
+		// r1Left is true if r1 is the left read, e.g. if its file
+		// index is lower and the 5' positions are equal.
+		r1Left bool
+	}{
+		// The 5' positions are 95 and 94.
+		{"5H3I95M", 85, "10M", false},
+		// The 5' positions are both 95.
+		{"5H3I95M", 86, "10M", true},
+		{"5H3I95M", 84, "7M3I5H", true},
+		{"3I2S95M", 86, "5M5S", false},
+		// The 5' positions are 98 and 99.
+		{"2S3I95M", 90, "8M2H", true},
+	}
+	for _, test := range tests {
+		r1Cigar, err := sam.ParseCigar([]byte(test.r1Cigar))
+		assert.NoError(t, err)
+		r2Cigar, err := sam.ParseCigar([]byte(test.r2Cigar))
+		assert.NoError(t, err)
+		r1 := NewRecord("A", chr1, 100, r1F, test.r2Pos, chr1, r1Cigar)
+		r2 := NewRecord("A", chr1, test.r2Pos, r2R, 100, chr1, r2Cigar)
+
+		// The assignment does not depend on the order the reads are
+		// added in.
+		for _, p := range []*readPair{
+			{left: r1, leftFileIdx: 1},
+			{left: r2, leftFileIdx: 2},
+		} {
+			if p.left == r1 {
+				assert.NoError(t, p.addRead(r2, 2))
+			} else {
+				assert.NoError(t, p.addRead(r1, 1))
+			}
+			if test.r1Left {
+				assert.Equal(t, []*sam.Record{r1, r2}, []*sam.Record{p.left, p.right}, "test %+v", test)
+				assert.Equal(t, []uint64{1, 2}, []uint64{p.leftFileIdx, p.rightFileIdx}, "test %+v", test)
+			} else {
+				assert.Equal(t, []*sam.Record{r2, r1}, []*sam.Record{p.left, p.right}, "test %+v", test)
+				assert.Equal(t, []uint64{2, 1}, []uint64{p.leftFileIdx, p.rightFileIdx}, "test %+v", test)
+			}
+		}
+	}
+}
+
+// Test that the reads of a readpair with the same file index, as
+// synthesized for merged inputs, are ordered the same way whichever
+// arrives first.
+func TestReadPairAddReadSameFileIdx(t *testing.T) {
+	tests := []struct {
+		name   string
+		r1, r2 *sam.Record
+		r1Left bool
+	}{
+		{"FF", NewRecord("A", chr1, 100, r1F, 100, chr1, cigar0), NewRecord("A", chr1, 100, r2F, 100, chr1, cigar0), true},
+		{"RR", NewRecord("A", chr1, 91, r1R, 91, chr1, cigar0), NewRecord("A", chr1, 91, r2R, 91, chr1, cigar0), true},
+		{"FR", NewRecord("A", chr1, 100, r1F, 91, chr1, cigar0), NewRecord("A", chr1, 91, r2R, 100, chr1, cigar0), true},
+		{"RF", NewRecord("A", chr1, 91, r1R, 100, chr1, cigar0), NewRecord("A", chr1, 100, r2F, 91, chr1, cigar0), true},
+		// The position decides before the read number.
+		{"R2 first", NewRecord("A", chr1, 200, r1F, 100, chr1, cigar0), NewRecord("A", chr1, 100, r2F, 200, chr1, cigar0), false},
+	}
+	for _, test := range tests {
+		var states []readPair
+		for _, reads := range [][2]*sam.Record{{test.r1, test.r2}, {test.r2, test.r1}} {
+			p := &readPair{left: reads[0], leftFileIdx: 5}
+			assert.NoError(t, p.addRead(reads[1], 5), "test %s", test.name)
+			if test.r1Left {
+				assert.Equal(t, []*sam.Record{test.r1, test.r2}, []*sam.Record{p.left, p.right}, "test %s", test.name)
+			} else {
+				assert.Equal(t, []*sam.Record{test.r2, test.r1}, []*sam.Record{p.left, p.right}, "test %s", test.name)
+			}
+			states = append(states, *p)
+		}
+		assert.Equal(t, states[0], states[1], "test %s", test.name)
+		assert.Equal(t, pairKey(states[0].left, states[0].right, 0, "", "lib"),
+			pairKey(states[1].left, states[1].right, 0, "", "lib"), "test %s", test.name)
+	}
+}
+
+func TestMateMismatch(t *testing.T) {
+	r1 := NewRecord("A", chr1, 100, r1F, 200, chr2, cigar0)
+	tests := []struct {
+		name     string
+		mate     *sam.Record
+		mismatch bool
+	}{
+		{"mate", NewRecord("A", chr2, 200, r2R, 100, chr1, cigar0), false},
+		{"second R1", NewRecord("A", chr2, 200, r1R, 100, chr1, cigar0), true},
+		{"no read number", NewRecord("A", chr2, 200, sam.Paired|sam.Reverse, 100, chr1, cigar0), true},
+		{"other position", NewRecord("A", chr2, 201, r2R, 100, chr1, cigar0), true},
+		{"other reference", NewRecord("A", chr1, 200, r2R, 100, chr1, cigar0), true},
+		{"other mate position", NewRecord("A", chr2, 200, r2R, 101, chr1, cigar0), true},
+		{"other mate reference", NewRecord("A", chr2, 200, r2R, 100, chr2, cigar0), true},
+	}
+	for _, test := range tests {
+		assert.Equal(t, test.mismatch, mateMismatch(r1, test.mate) != "", "test %s", test.name)
+		assert.Equal(t, test.mismatch, mateMismatch(test.mate, r1) != "", "test %s, reversed", test.name)
+	}
+}
+
+func TestReadPairAddReadErrors(t *testing.T) {
+	r1 := NewRecord("A", chr1, 100, r1F, 200, chr1, cigar0)
+	r2 := NewRecord("A", chr1, 200, r2R, 100, chr1, cigar0)
+
+	// A second R1.
+	p := &readPair{left: r1, leftFileIdx: 1}
+	assert.ErrorIs(t, p.addRead(NewRecord("A", chr1, 200, r1F, 100, chr1, cigar0), 2), ErrMalformedTemplate)
+
+	// A third read.
+	p = &readPair{left: r1, leftFileIdx: 1}
+	assert.NoError(t, p.addRead(r2, 2))
+	assert.ErrorIs(t, p.addRead(NewRecord("A", chr1, 300, r2R, 100, chr1, cigar0), 3), ErrMalformedTemplate)
+	assert.Equal(t, []*sam.Record{r1, r2}, []*sam.Record{p.left, p.right})
+}
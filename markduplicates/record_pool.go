@@ -0,0 +1,110 @@
+// Copyright 2019 Grail Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package markduplicates
+
+import (
+	"sync"
+
+	"github.com/Schaudge/hts/sam"
+)
+
+// The records of a shard come from the free pool of sam, and every
+// record that Mark reads is returned to it with putRecord once it is
+// no longer needed:
+//
+//   - The records that are written are returned by the writer once they
+//     are marshalled: by shardCompressor as it adds them to the BAM
+//     output, and by the callback of generatePAM.
+//   - The records of a shard that are not written (those of the
+//     padding, the removed duplicates and those of Opts.MetricsOnly),
+//     and those dropped by Opts.CoverageMax, are returned by
+//     processShard, and by markQueryname for the queryname input.
+//   - The records of the secondary duplicates pass are returned once
+//     their duplicates are found.
+//
+// A few records are retained and left to the garbage collector
+// instead: the clones of the distant mates, which share their fields
+// with the records of the distant mate table, and the records of a
+// shard that fails, which may still be held by its writer.
+//
+// With the recordpoison build tag, putRecord poisons the records
+// instead of returning them, and checkRecord panics on a poisoned
+// record, to catch their use after they are returned:
+//
+//	go test -tags recordpoison ./markduplicates
+
+// auxSliceCap is the number of tags of the tag slices of auxPool,
+// enough for the tags of a record and those that Mark adds.
+const auxSliceCap = 15
+
+// auxPoolMark marks the tag slices of auxPool. It is stored in a slot
+// past the auxSliceCap tags of each slice, which the tags never
+// reach, so that a slice of auxPool is told apart from one of the
+// reader, or of a test, even if they have the same capacity.
+var auxPoolMark = sam.Aux("\x00auxPool")
+
+// auxPool holds the tag slices that growAux gives the records that Mark
+// tags, so that appending the tags does not allocate.
+var auxPool = sync.Pool{
+	New: func() interface{} {
+		aux := make([]sam.Aux, auxSliceCap+1)
+		aux[auxSliceCap] = auxPoolMark
+		aux = aux[:0]
+		return &aux
+	},
+}
+
+// isPoolAux returns true if aux is a slice of auxPool.
+func isPoolAux(aux []sam.Aux) bool {
+	if cap(aux) != auxSliceCap+1 {
+		return false
+	}
+	mark := aux[:auxSliceCap+1][auxSliceCap]
+	return len(mark) == len(auxPoolMark) && &mark[0] == &auxPoolMark[0]
+}
+
+// growAux returns aux with room to append n tags. Unless aux is
+// already a slice of auxPool with that room, the tags are copied to
+// one, so that appending to a record never writes to the tags of
+// another record that shares them, such as the clone of a distant
+// mate.
+func growAux(aux []sam.Aux, n int) []sam.Aux {
+	if len(aux)+n > auxSliceCap {
+		grown := make([]sam.Aux, len(aux), len(aux)+n)
+		copy(grown, aux)
+		return grown
+	}
+	if isPoolAux(aux) {
+		return aux
+	}
+	grown := (*auxPool.Get().(*[]sam.Aux))[:len(aux)]
+	copy(grown, aux)
+	return grown
+}
+
+// releaseAux returns the tags of r to auxPool if they are a slice of
+// it, and clears them. The record itself is not returned.
+func releaseAux(r *sam.Record) {
+	aux := []sam.Aux(r.AuxFields)
+	r.AuxFields = nil
+	if !isPoolAux(aux) {
+		return
+	}
+	aux = aux[:auxSliceCap]
+	for i := range aux {
+		aux[i] = nil
+	}
+	aux = aux[:0]
+	auxPool.Put(&aux)
+}
@@ -0,0 +1,45 @@
+// Copyright 2019 Grail Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build recordpoison
+// +build recordpoison
+
+package markduplicates
+
+import (
+	"fmt"
+
+	"github.com/Schaudge/hts/sam"
+)
+
+// poisonedName is the name of the records that putRecord poisons.
+const poisonedName = "poisoned-by-putRecord"
+
+// putRecord poisons r instead of returning it to the free pool, so that
+// checkRecord, and the checks of the tests, see any later use of it.
+// It panics if r is poisoned already.
+func putRecord(r *sam.Record) {
+	if r.Name == poisonedName {
+		panic("record returned to the free pool twice")
+	}
+	releaseAux(r)
+	*r = sam.Record{Name: poisonedName, Pos: -1, MatePos: -1, Flags: sam.Unmapped | sam.Duplicate}
+}
+
+// checkRecord panics if r was poisoned by putRecord.
+func checkRecord(r *sam.Record) {
+	if r.Name == poisonedName {
+		panic(fmt.Sprintf("record %p used after it was returned to the free pool", r))
+	}
+}
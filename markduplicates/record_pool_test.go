@@ -0,0 +1,139 @@
+// Copyright 2019 Grail Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package markduplicates
+
+import (
+	"fmt"
+	"path/filepath"
+	"testing"
+
+	"github.com/Schaudge/doppelmark/simulate"
+	"github.com/Schaudge/grailbio/encoding/bamprovider"
+	"github.com/Schaudge/hts/sam"
+	"github.com/grailbio/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGrowAux(t *testing.T) {
+	// The tags of a shared slice are copied before they are appended to.
+	shared := make([]sam.Aux, 1, 4)
+	shared[0] = NewAux("XA", 1)
+	grown := growAux(shared, 2)
+	assert.True(t, isPoolAux(grown))
+	assert.Equal(t, shared, grown)
+	grown = append(grown, NewAux("XB", 2))
+	assert.Equal(t, []sam.Aux{NewAux("XA", 1)}, shared[:1])
+	assert.Equal(t, []sam.Aux{nil}, shared[1:2])
+
+	// A slice of auxPool with room is kept, and one without room is
+	// replaced.
+	again := growAux(grown, 1)
+	assert.True(t, &grown[0] == &again[0])
+	full := make([]sam.Aux, auxSliceCap-1)
+	assert.False(t, isPoolAux(growAux(full, 2)))
+	assert.Equal(t, auxSliceCap+1, cap(growAux(full, 2)))
+
+	// A slice of the reader with the capacity of a slice of auxPool
+	// is not one, and is copied.
+	reader := make([]sam.Aux, auxSliceCap, auxSliceCap+1)
+	for i := range reader {
+		reader[i] = NewAux("XA", i)
+	}
+	assert.False(t, isPoolAux(reader))
+	copied := growAux(reader[:auxSliceCap-1], 1)
+	assert.False(t, &reader[0] == &copied[0])
+
+	// releaseAux clears the tags of a record, and returns them to
+	// auxPool, whose slices are grown again.
+	r := NewRecordAux("A", chr1, 0, r1F, 10, chr1, cigar0, NewAux("XA", 1))
+	r.AuxFields = growAux(r.AuxFields, 1)
+	releaseAux(r)
+	assert.Nil(t, r.AuxFields)
+	for i := 0; i < 4; i++ {
+		r.AuxFields = append(growAux(r.AuxFields, 1), NewAux("XA", i))
+		assert.Equal(t, 1, len(r.AuxFields))
+		releaseAux(r)
+	}
+}
+
+// TestRecordLifecycle marks a simulated BAM with each of the outputs, so
+// that with the recordpoison build tag, any use of a record after it
+// is returned to the free pool panics.
+func TestRecordLifecycle(t *testing.T) {
+	tempDir, cleanup := testutil.TempDir(t, "", "")
+	defer cleanup()
+	simOpts := simulate.DefaultOpts
+	simOpts.Pairs = 1000
+	simOpts.ReferenceLength = 50000
+	simOpts.InterchromosomalFraction = 0.1
+	simOpts.SecondaryFraction = 0.05
+	simOpts.SupplementaryFraction = 0.05
+	input, expected, _ := simulated(t, tempDir, simOpts)
+	h, records := readSimulated(t, input)
+	duplicates := 0
+	for _, dup := range expected {
+		if dup {
+			duplicates++
+		}
+	}
+
+	tests := []struct {
+		name   string
+		modify func(*Opts)
+	}{
+		{"bam", func(o *Opts) {}},
+		{"compression threads", func(o *Opts) { o.CompressionThreads = 3 }},
+		{"pam", func(o *Opts) { o.Format = "pam" }},
+		{"secondary dups", func(o *Opts) { o.FlagSecondaryDups = true }},
+		{"molecule tags", func(o *Opts) { o.EmitMITag = true }},
+		{"remove dups", func(o *Opts) {
+			o.RemoveDups = true
+			o.DuplicatesOutput = "duplicates"
+		}},
+		{"metrics only", func(o *Opts) { o.MetricsOnly = true }},
+	}
+	for testIdx, test := range tests {
+		opts := defaultOpts
+		opts.Format = "bam"
+		opts.ShardSize = 5000
+		opts.Padding = 500
+		test.modify(&opts)
+		opts.OutputPath = NewTestOutput(tempDir, testIdx, opts.Format)
+		if opts.DuplicatesOutput != "" {
+			opts.DuplicatesOutput = filepath.Join(tempDir, fmt.Sprintf("duplicates%d.bam", testIdx))
+		}
+		markDuplicates := &MarkDuplicates{
+			Provider: bamprovider.NewFakeProvider(h, records),
+			Opts:     &opts,
+		}
+		_, err := markDuplicates.Mark(nil)
+		if !assert.NoError(t, err, "test %s", test.name) || opts.MetricsOnly {
+			continue
+		}
+
+		// Each read of the duplicate readpairs is flagged once, in the
+		// output or the duplicates output.
+		output := ReadRecords(t, opts.OutputPath)
+		if opts.DuplicatesOutput != "" {
+			output = append(output, ReadRecords(t, opts.DuplicatesOutput)...)
+		}
+		flagged := 0
+		for _, r := range output {
+			if r.Flags&(sam.Secondary|sam.Supplementary) == 0 && r.Flags&sam.Duplicate != 0 {
+				flagged++
+			}
+		}
+		assert.Equal(t, 2*duplicates, flagged, "test %s", test.name)
+	}
+}
@@ -0,0 +1,97 @@
+// Copyright 2019 Grail Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package markduplicates
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/Schaudge/grailbio/encoding/bam"
+	"github.com/Schaudge/hts/sam"
+)
+
+// unmappedReference is the ReferenceMetrics key of unmapped reads.
+const unmappedReference = "*"
+
+// ReferenceMetrics contains the duplication metrics of a reference.
+type ReferenceMetrics struct {
+	// ReadsExamined is the number of primary reads examined.
+	ReadsExamined int64
+
+	// Duplicates is the number of those reads that were marked as
+	// duplicates.
+	Duplicates int64
+
+	// OpticalDuplicates is the number of the duplicates that are
+	// optical duplicates. The rest are PCR duplicates.
+	OpticalDuplicates int64
+}
+
+// Rate returns the fraction of the reads examined that are
+// duplicates.
+func (m *ReferenceMetrics) Rate() float64 {
+	if m.ReadsExamined == 0 {
+		return 0
+	}
+	return float64(m.Duplicates) / float64(m.ReadsExamined)
+}
+
+// Reference returns ReferenceMetrics for the given reference name. If
+// there is no ReferenceMetrics for the reference yet, create one and
+// return it.
+func (mc *MetricsCollection) Reference(name string) *ReferenceMetrics {
+	m, found := mc.ReferenceMetrics[name]
+	if found {
+		return m
+	}
+	m = &ReferenceMetrics{}
+	mc.ReferenceMetrics[name] = m
+	return m
+}
+
+// leftmostReferenceName returns the name of the reference of the
+// leftmost read of r's readpair, which is r's own reference if r has
+// no mapped mate. It returns unmappedReference if r is unmapped.
+func leftmostReferenceName(r *sam.Record) string {
+	if r.Ref == nil || (r.Flags&sam.Unmapped) != 0 {
+		return unmappedReference
+	}
+	if !bam.HasNoMappedMate(r) && r.MateRef != nil && r.MateRef.ID() < r.Ref.ID() {
+		return r.MateRef.Name()
+	}
+	return r.Ref.Name()
+}
+
+// referenceMetricsString returns the per-reference metrics as a tab
+// separated table sorted by reference name, with the unmapped reads
+// last.
+func referenceMetricsString(referenceMetrics map[string]*ReferenceMetrics) string {
+	names := make([]string, 0, len(referenceMetrics))
+	for name := range referenceMetrics {
+		if name != unmappedReference {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	if _, found := referenceMetrics[unmappedReference]; found {
+		names = append(names, unmappedReference)
+	}
+	s := "REFERENCE\tREADS_EXAMINED\tDUPLICATES\tOPTICAL_DUPLICATES\tPERCENT_DUPLICATION\n"
+	for _, name := range names {
+		m := referenceMetrics[name]
+		s += fmt.Sprintf("%s\t%d\t%d\t%d\t%0.6f\n", name, m.ReadsExamined, m.Duplicates, m.OpticalDuplicates,
+			100*m.Rate())
+	}
+	return s
+}
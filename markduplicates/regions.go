@@ -0,0 +1,201 @@
+// Copyright 2019 Grail Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package markduplicates
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/Schaudge/grailbase/errors"
+	"github.com/Schaudge/grailbase/file"
+	"github.com/Schaudge/grailbase/intervalmap"
+	"github.com/Schaudge/hts/sam"
+)
+
+// regionMap associates each refId to an intervalmap containing the
+// merged regions of interest on that reference.
+type regionMap map[int]*intervalmap.T
+
+// readRegionsBED reads the BED file at path and returns its regions
+// as a regionMap for the references in header.
+func readRegionsBED(ctx context.Context, path string, header *sam.Header) (regionMap, error) {
+	intervals, err := readBEDIntervals(ctx, path, header)
+	if err != nil {
+		return nil, err
+	}
+	return newRegionMap(intervals), nil
+}
+
+// readBEDIntervals reads the BED file at path and returns its merged
+// intervals on each reference of header, see parseBEDIntervals.
+func readBEDIntervals(ctx context.Context, path string, header *sam.Header) (intervals map[int][]intervalmap.Interval, err error) {
+	in, err := file.Open(ctx, path)
+	if err != nil {
+		return nil, errors.E(err, "couldn't open regions BED file:", path)
+	}
+	defer func() {
+		if err2 := in.Close(ctx); err == nil && err2 != nil {
+			err = err2
+		}
+	}()
+	intervals, err = parseBEDIntervals(in.Reader(ctx), header)
+	if err != nil {
+		return nil, errors.E(err, "couldn't parse regions BED file:", path)
+	}
+	return intervals, nil
+}
+
+// parseRegionsBED parses the BED records of r as a regionMap, see
+// parseBEDIntervals.
+func parseRegionsBED(r io.Reader, header *sam.Header) (regionMap, error) {
+	intervals, err := parseBEDIntervals(r, header)
+	if err != nil {
+		return nil, err
+	}
+	return newRegionMap(intervals), nil
+}
+
+// parseBEDIntervals parses BED records with at least three columns
+// from r, and returns the intervals of each reference ID. Columns
+// after the third are ignored, as are empty lines and comment, track,
+// and browser lines. Overlapping and abutting regions are merged.
+// Regions on references that are not in header are skipped, so reads
+// on those references are off-target.
+func parseBEDIntervals(r io.Reader, header *sam.Header) (map[int][]intervalmap.Interval, error) {
+	refIDs := make(map[string]int, len(header.Refs()))
+	for _, ref := range header.Refs() {
+		refIDs[ref.Name()] = ref.ID()
+	}
+
+	intervals := make(map[int][]intervalmap.Interval)
+	unknownRefs := make(map[string]bool)
+	scanner := bufio.NewScanner(r)
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") ||
+			strings.HasPrefix(line, "track") || strings.HasPrefix(line, "browser") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) < 3 {
+			return nil, errors.E(errors.Invalid, fmt.Sprintf("line %d has fewer than 3 columns: %s", lineNum, line))
+		}
+		start, err := strconv.ParseInt(fields[1], 10, 64)
+		if err != nil {
+			return nil, errors.E(errors.Invalid, err, fmt.Sprintf("line %d has an invalid start: %s", lineNum, line))
+		}
+		end, err := strconv.ParseInt(fields[2], 10, 64)
+		if err != nil {
+			return nil, errors.E(errors.Invalid, err, fmt.Sprintf("line %d has an invalid end: %s", lineNum, line))
+		}
+		if start < 0 || end < start {
+			return nil, errors.E(errors.Invalid, fmt.Sprintf("line %d has an invalid interval: %s", lineNum, line))
+		}
+		refID, ok := refIDs[fields[0]]
+		if !ok {
+			unknownRefs[fields[0]] = true
+			continue
+		}
+		if start == end {
+			continue
+		}
+		intervals[refID] = append(intervals[refID], intervalmap.Interval{Start: start, Limit: end})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	for name := range unknownRefs {
+		shardLog.Printf("skipping regions on reference %s, which is not in the BAM header", name)
+	}
+
+	for refID, refIntervals := range intervals {
+		intervals[refID] = mergeIntervals(refIntervals)
+	}
+	return intervals, nil
+}
+
+// newRegionMap returns the regionMap of the merged intervals of each
+// reference ID.
+func newRegionMap(intervals map[int][]intervalmap.Interval) regionMap {
+	rm := make(regionMap)
+	for refID, refIntervals := range intervals {
+		entries := make([]intervalmap.Entry, 0, len(refIntervals))
+		for _, interval := range refIntervals {
+			entries = append(entries, intervalmap.Entry{Interval: interval})
+		}
+		rm[refID] = intervalmap.New(entries)
+	}
+	return rm
+}
+
+// mergeIntervals sorts intervals and merges the ones that overlap or
+// abut. It modifies intervals in place.
+func mergeIntervals(intervals []intervalmap.Interval) []intervalmap.Interval {
+	sort.Slice(intervals, func(i, j int) bool {
+		return intervals[i].Start < intervals[j].Start
+	})
+	merged := intervals[:0]
+	for _, interval := range intervals {
+		if n := len(merged); n > 0 && interval.Start <= merged[n-1].Limit {
+			if interval.Limit > merged[n-1].Limit {
+				merged[n-1].Limit = interval.Limit
+			}
+			continue
+		}
+		merged = append(merged, interval)
+	}
+	return merged
+}
+
+// overlapsRecord returns true if the alignment of r, from its position
+// to its end, overlaps a region. Unmapped records never overlap a
+// region.
+func (rm regionMap) overlapsRecord(r *sam.Record) bool {
+	if r.Ref == nil || (r.Flags&sam.Unmapped) != 0 {
+		return false
+	}
+	regions := rm[r.Ref.ID()]
+	if regions == nil {
+		return false
+	}
+	start, end := int64(r.Start()), int64(r.End())
+	if end <= start {
+		end = start + 1
+	}
+	entries := make([]*intervalmap.Entry, 0, 1)
+	regions.Get(intervalmap.Interval{Start: start, Limit: end}, &entries)
+	return len(entries) > 0
+}
+
+// containsRecord returns true if the unclipped 5' position of r,
+// clamped to its reference, overlaps a region. Unmapped records are
+// never in a region.
+func (rm regionMap) containsRecord(r *sam.Record) bool {
+	if r.Ref == nil || (r.Flags&sam.Unmapped) != 0 {
+		return false
+	}
+	regions := rm[r.Ref.ID()]
+	if regions == nil {
+		return false
+	}
+	pos := int64(clampedFivePrimePosition(r))
+	entries := make([]*intervalmap.Entry, 0, 1)
+	regions.Get(intervalmap.Interval{Start: pos, Limit: pos + 1}, &entries)
+	return len(entries) > 0
+}
@@ -0,0 +1,149 @@
+// Copyright 2019 Grail Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package markduplicates
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/Schaudge/grailbase/intervalmap"
+	"github.com/Schaudge/hts/sam"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMergeIntervals(t *testing.T) {
+	tests := []struct {
+		intervals []intervalmap.Interval
+		expected  []intervalmap.Interval
+	}{
+		{
+			[]intervalmap.Interval{},
+			[]intervalmap.Interval{},
+		},
+		{
+			[]intervalmap.Interval{{Start: 10, Limit: 20}, {Start: 0, Limit: 5}},
+			[]intervalmap.Interval{{Start: 0, Limit: 5}, {Start: 10, Limit: 20}},
+		},
+		{
+			// Overlapping, contained, and abutting intervals.
+			[]intervalmap.Interval{{Start: 10, Limit: 20}, {Start: 15, Limit: 30}, {Start: 16, Limit: 18},
+				{Start: 30, Limit: 35}, {Start: 40, Limit: 50}},
+			[]intervalmap.Interval{{Start: 10, Limit: 35}, {Start: 40, Limit: 50}},
+		},
+	}
+	for _, test := range tests {
+		assert.Equal(t, test.expected, mergeIntervals(test.intervals))
+	}
+}
+
+func TestParseRegionsBED(t *testing.T) {
+	bed := "# comment\n" +
+		"track name=panel\n" +
+		"browser position chr1:1-100\n" +
+		"\n" +
+		"chr1\t10\t20\n" +
+		"chr1\t15\t30\ttarget1\t0\t+\n" +
+		"chr2\t100\t200\ttarget2\n" +
+		"chrX\t0\t1000\n"
+	regions, err := parseRegionsBED(strings.NewReader(bed), header)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(regions))
+
+	tests := []struct {
+		record   *sam.Record
+		expected bool
+	}{
+		{NewRecord("A", chr1, 9, r1F, 100, chr1, cigar0), false},
+		{NewRecord("A", chr1, 10, r1F, 100, chr1, cigar0), true},
+		{NewRecord("A", chr1, 29, r1F, 100, chr1, cigar0), true},
+		{NewRecord("A", chr1, 30, r1F, 100, chr1, cigar0), false},
+		// Soft clipping is included in the unclipped 5' position.
+		{NewRecord("A", chr1, 30, r1F, 100, chr1, cigarSoft1), true},
+		// The 5' position of a reverse read is at its end.
+		{NewRecord("A", chr1, 15, r2R, 100, chr1, cigar0), true},
+		{NewRecord("A", chr1, 30, r2R, 100, chr1, cigar0), false},
+		{NewRecord("A", chr2, 150, r1F, 100, chr1, cigar0), true},
+		{NewRecord("A", chr2, 15, r1F, 100, chr1, cigar0), false},
+		{NewRecord("A", chr1, 15, u2, 15, chr1, cigar0), false},
+		{NewRecord("A", nil, -1, up1, -1, nil, nil), false},
+	}
+	for _, test := range tests {
+		assert.Equal(t, test.expected, regions.containsRecord(test.record), "record %v", test.record)
+	}
+
+	var empty regionMap
+	assert.False(t, empty.containsRecord(NewRecord("A", chr1, 15, r1F, 100, chr1, cigar0)))
+}
+
+func TestForRecord(t *testing.T) {
+	regions, err := parseRegionsBED(strings.NewReader("chr1\t10\t20\n"), header)
+	assert.NoError(t, err)
+	mc := NewMetricsCollection()
+	readGroups := newReadGroupTable(nil)
+	r := NewRecord("A", chr1, 15, r1F, 100, chr1, cigar0)
+
+	metrics, n := mc.forRecord(readGroups, regions, r)
+	assert.Equal(t, 3, n)
+	assert.Equal(t, mc.Region("Unknown Library"), metrics[2])
+	metrics, n = mc.forRecord(readGroups, nil, r)
+	assert.Equal(t, 2, n)
+	assert.Equal(t, mc.Get("Unknown Library"), metrics[0])
+
+	// Counting a record outside of the regions does not allocate.
+	allocs := testing.AllocsPerRun(100, func() {
+		metrics, n := mc.forRecord(readGroups, nil, r)
+		metrics[n-1].ReadPairsExamined++
+	})
+	assert.Equal(t, 0.0, allocs)
+}
+
+func TestOverlapsRecord(t *testing.T) {
+	regions, err := parseRegionsBED(strings.NewReader("chr1\t100\t110\nchr2\t50\t51\n"), header)
+	assert.NoError(t, err)
+
+	tests := []struct {
+		record   *sam.Record
+		expected bool
+	}{
+		{NewRecord("A", chr1, 80, r1F, 200, chr1, cigar0), false},
+		// The alignment of cigar0 is 10 bases long, whatever the strand.
+		{NewRecord("A", chr1, 90, r1F, 200, chr1, cigar0), false},
+		{NewRecord("A", chr1, 91, r1F, 200, chr1, cigar0), true},
+		{NewRecord("A", chr1, 91, r2R, 200, chr1, cigar0), true},
+		{NewRecord("A", chr1, 105, r1F, 200, chr1, cigar100M), true},
+		{NewRecord("A", chr1, 110, r2R, 200, chr1, cigar0), false},
+		// Soft clipped bases are not part of the alignment.
+		{NewRecord("A", chr1, 110, r2R, 200, chr1, cigarSoft1), false},
+		{NewRecord("A", chr2, 45, r1F, 200, chr1, cigar0), true},
+		{NewRecord("A", chr2, 51, r1F, 200, chr1, cigar0), false},
+		{NewRecord("A", chr1, 100, u2, 100, chr1, cigar0), false},
+		{NewRecord("A", nil, -1, up1, -1, nil, nil), false},
+	}
+	for _, test := range tests {
+		assert.Equal(t, test.expected, regions.overlapsRecord(test.record), "record %v", test.record)
+	}
+}
+
+func TestParseRegionsBEDErrors(t *testing.T) {
+	for _, bed := range []string{
+		"chr1\t10\n",
+		"chr1\tten\t20\n",
+		"chr1\t10\ttwenty\n",
+		"chr1\t20\t10\n",
+		"chr1\t-1\t10\n",
+	} {
+		_, err := parseRegionsBED(strings.NewReader(bed), header)
+		assert.Error(t, err, "bed %q", bed)
+	}
+}
@@ -0,0 +1,178 @@
+// Copyright 2019 Grail Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package markduplicates
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+
+	"github.com/Schaudge/grailbase/errors"
+	"github.com/Schaudge/grailbase/file"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+)
+
+// Remote files
+//
+// The input BAM and its index, the output BAM or PAM and its index,
+// the files of the split output, the duplicates output, the metrics,
+// and the histograms may be s3:// URLs once RegisterS3 has been
+// called, and gs:// URLs once RegisterGCS has been called, which the
+// doppelmark command does at startup. They are read and written with
+// grailbase/file, through an objectStore, which speaks the S3 API to
+// AWS, to an S3 compatible server such as MinIO, or to the XML API of
+// GCS. The input is read with ranged GETs, and can be sharded through
+// its index like a local file, and the outputs are streamed as
+// multipart uploads.
+//
+// The failed requests are retried up to remoteMaxRetries times with a
+// jittered exponential backoff, see remoteRetryer, and so are the
+// reads whose response fails after it started, which are resumed at
+// their offset. The credentials of s3:// URLs are those of the default
+// AWS provider chain: the environment, the shared credentials file,
+// and the instance or task role. Those of gs:// URLs are the HMAC key
+// of a service account in GCS_HMAC_ACCESS_ID and GCS_HMAC_SECRET.
+//
+// The uploads are checked when they are closed: the size of the object
+// must be the number of bytes written to it, see outputFile. The reads
+// require the ETag of the object when it was opened, so a read fails
+// if the object changes while it is read.
+//
+// The scratch files, e.g. the disk shards of the distant mates, are
+// always local, and so are the reports that are written as the shards
+// are marked, see remoteOptionProblems.
+
+// s3Registration and gcsRegistration guard the registrations of the
+// s3 and gs schemes, which can only be registered once per process.
+var s3Registration, gcsRegistration sync.Once
+
+const (
+	s3Scheme  = "s3"
+	gcsScheme = "gs"
+	// gcsEndpoint is the endpoint of the XML API of GCS.
+	gcsEndpoint = "https://storage.googleapis.com"
+)
+
+// RegisterS3 registers the s3:// scheme with grailbase/file. If
+// endpoint is non-empty, the requests are sent to it instead of AWS,
+// with path style addressing, e.g. to a MinIO or LocalStack server.
+// Only the endpoint of the first call is used.
+func RegisterS3(endpoint string) {
+	s3Registration.Do(func() {
+		file.RegisterImplementation(s3Scheme, func() file.Implementation {
+			return newObjectStore(s3Scheme, endpoint, "")
+		})
+	})
+}
+
+// RegisterGCS registers the gs:// scheme with grailbase/file. The
+// requests are sent to the XML API of GCS, or to endpoint if it is
+// non-empty, signed with the HMAC key in the GCS_HMAC_ACCESS_ID and
+// GCS_HMAC_SECRET environment variables. Only the endpoint of the
+// first call is used.
+func RegisterGCS(endpoint string) {
+	gcsRegistration.Do(func() {
+		if endpoint == "" {
+			endpoint = gcsEndpoint
+		}
+		file.RegisterImplementation(gcsScheme, func() file.Implementation {
+			id, secret := os.Getenv("GCS_HMAC_ACCESS_ID"), os.Getenv("GCS_HMAC_SECRET")
+			if id == "" || secret == "" {
+				return &objectStore{scheme: gcsScheme, err: errors.E(errors.NotAllowed,
+					"gs:// URLs require the HMAC key of GCS_HMAC_ACCESS_ID and GCS_HMAC_SECRET")}
+			}
+			return newObjectStore(gcsScheme, endpoint, gcsRegion, &aws.Config{
+				Credentials: credentials.NewStaticCredentials(id, secret, ""),
+			})
+		})
+	})
+}
+
+// isRemotePath returns true if path is a URL, rather than a local
+// path.
+func isRemotePath(path string) bool {
+	scheme, _, err := file.ParsePath(path)
+	return err == nil && scheme != ""
+}
+
+// remoteOptionProblems returns the problems of the paths of opts that
+// cannot be URLs.
+func (opts *Opts) remoteOptionProblems() []error {
+	var problems []error
+	// These are written with os.Create as the shards are marked, or
+	// are scratch space.
+	for _, option := range []struct{ name, path string }{
+		{"scratch-dir", opts.ScratchDir},
+		{"optical-scatter", opts.OpticalScatterFile},
+		{"duplicate-set-report", opts.DuplicateSetReport},
+		{"hotspot-bed", opts.HotspotBED},
+		{"shard-manifest", opts.ShardManifestFile},
+		{"verify-disagreements", opts.VerifyDisagreements},
+	} {
+		if isRemotePath(option.path) {
+			problems = append(problems, fmt.Errorf("%s must be a local path: %s", option.name, option.path))
+		}
+	}
+	return problems
+}
+
+// outputFile is an output created with file.Create, which counts the
+// bytes written to it, so that Close can check that a remote file has
+// all of them.
+type outputFile struct {
+	path    string
+	f       file.File
+	w       io.Writer
+	written int64
+}
+
+// createOutput creates the output at path, a local path or a URL.
+func createOutput(ctx context.Context, path string) (*outputFile, error) {
+	f, err := file.Create(ctx, path)
+	if err != nil {
+		return nil, err
+	}
+	return &outputFile{path: path, f: f, w: f.Writer(ctx)}, nil
+}
+
+// Write implements io.Writer.
+func (o *outputFile) Write(p []byte) (int, error) {
+	n, err := o.w.Write(p)
+	o.written += int64(n)
+	return n, err
+}
+
+// Close closes the output. For a remote output, which is only
+// complete once it is closed, it then checks that its size is the
+// number of bytes written.
+func (o *outputFile) Close(ctx context.Context) error {
+	if err := o.f.Close(ctx); err != nil {
+		return err
+	}
+	if !isRemotePath(o.path) {
+		return nil
+	}
+	info, err := file.Stat(ctx, o.path)
+	if err != nil {
+		return errors.E(err, "couldn't check the upload of", o.path)
+	}
+	if info.Size() != o.written {
+		return errors.E(errors.Integrity, fmt.Sprintf("upload of %s has %d bytes, but %d were written", o.path,
+			info.Size(), o.written))
+	}
+	return nil
+}
@@ -0,0 +1,249 @@
+// Copyright 2019 Grail Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package markduplicates
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Schaudge/grailbase/errors"
+	"github.com/Schaudge/grailbase/file"
+	"github.com/Schaudge/grailbase/retry"
+	"github.com/Schaudge/grailbio/encoding/bamprovider"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	"github.com/grailbio/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRemoteOptionProblems(t *testing.T) {
+	opts := validOpts()
+	opts.BamFile = "gs://bucket/in.bam"
+	opts.OutputPath = "s3://bucket/out.bam"
+	opts.MetricsFile = "gs://bucket/metrics.txt"
+	assert.Empty(t, opts.remoteOptionProblems())
+	opts.ScratchDir = "gs://bucket/tmp"
+	opts.ShardManifestFile = "s3://bucket/manifest.tsv"
+	assert.Len(t, opts.remoteOptionProblems(), 2)
+}
+
+// errReader is an io.Reader that fails with err.
+type errReader struct{ err error }
+
+func (r errReader) Read([]byte) (int, error) { return 0, r.err }
+
+// flakyS3 serves the ranged GETs of an object with data and etag,
+// whose bodies fail after failAfter bytes.
+type flakyS3 struct {
+	s3iface.S3API
+	data      []byte
+	etag      string
+	failAfter int
+	gets      int
+}
+
+func (s *flakyS3) GetObjectWithContext(_ aws.Context, input *s3.GetObjectInput,
+	_ ...request.Option) (*s3.GetObjectOutput, error) {
+	s.gets++
+	if aws.StringValue(input.IfMatch) != s.etag {
+		return nil, awserr.NewRequestFailure(awserr.New("PreconditionFailed", "etag mismatch", nil),
+			http.StatusPreconditionFailed, "")
+	}
+	var offset int
+	if _, err := fmt.Sscanf(aws.StringValue(input.Range), "bytes=%d-", &offset); err != nil {
+		return nil, err
+	}
+	var body io.Reader = bytes.NewReader(s.data[offset:])
+	if len(s.data)-offset > s.failAfter {
+		body = io.MultiReader(bytes.NewReader(s.data[offset:offset+s.failAfter]),
+			errReader{errors.New("connection reset by peer")})
+	}
+	return &s3.GetObjectOutput{Body: ioutil.NopCloser(body)}, nil
+}
+
+func TestObjectReader(t *testing.T) {
+	defer func(policy retry.Policy) { remoteReadRetryPolicy = policy }(remoteReadRetryPolicy)
+	remoteReadRetryPolicy = retry.MaxRetries(retry.Backoff(time.Millisecond, time.Millisecond, 1), 2)
+	ctx := context.Background()
+	data := make([]byte, 1000)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	newFile := func(client *flakyS3) *objectFile {
+		return &objectFile{path: "s3://bucket/key", bucket: "bucket", key: "key", client: client,
+			info: objectInfo{size: int64(len(data)), etag: "etag"}}
+	}
+
+	// The reads whose responses fail are resumed at their offset.
+	client := &flakyS3{data: data, etag: "etag", failAfter: 300}
+	f := newFile(client)
+	actual, err := ioutil.ReadAll(f.Reader(ctx))
+	assert.NoError(t, err)
+	assert.Equal(t, data, actual)
+	assert.Equal(t, 4, client.gets)
+
+	// A seek starts a new range.
+	client.gets = 0
+	reader := f.Reader(ctx)
+	_, err = reader.Seek(900, io.SeekStart)
+	assert.NoError(t, err)
+	actual, err = ioutil.ReadAll(reader)
+	assert.NoError(t, err)
+	assert.Equal(t, data[900:], actual)
+	assert.Equal(t, 1, client.gets)
+	assert.NoError(t, f.Close(ctx))
+
+	// A read of an object that changed fails.
+	_, err = ioutil.ReadAll(newFile(&flakyS3{data: data, etag: "changed", failAfter: 300}).Reader(ctx))
+	assert.True(t, errors.Is(errors.Precondition, err), "error %v", err)
+
+	// A response that fails before any bytes are read is retried only
+	// so many times.
+	_, err = ioutil.ReadAll(newFile(&flakyS3{data: data, etag: "etag", failAfter: 0}).Reader(ctx))
+	assert.Error(t, err)
+}
+
+func TestOutputFile(t *testing.T) {
+	tempDir, cleanup := testutil.TempDir(t, "", "")
+	defer cleanup()
+	ctx := context.Background()
+	path := filepath.Join(tempDir, "out.txt")
+
+	out, err := createOutput(ctx, path)
+	if !assert.NoError(t, err) {
+		return
+	}
+	_, err = fmt.Fprintf(out, "%s\t%d\n", "chr1", 100)
+	assert.NoError(t, err)
+	assert.NoError(t, out.Close(ctx))
+	assert.Equal(t, int64(9), out.written)
+	contents, err := ioutil.ReadFile(path)
+	assert.NoError(t, err)
+	assert.Equal(t, "chr1\t100\n", string(contents))
+}
+
+// copyFile copies src to dst, either of which may be a URL.
+func copyFile(ctx context.Context, t *testing.T, src, dst string) {
+	in, err := file.Open(ctx, src)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer in.Close(ctx) // nolint: errcheck
+	out, err := createOutput(ctx, dst)
+	if !assert.NoError(t, err) {
+		return
+	}
+	_, err = io.Copy(out, in.Reader(ctx))
+	assert.NoError(t, err)
+	assert.NoError(t, out.Close(ctx))
+}
+
+// Test marking an indexed input in S3 into an output and metrics in
+// S3. The test needs an S3 server, e.g. MinIO or LocalStack, and runs
+// only if DOPPELMARK_TEST_S3_ENDPOINT is its endpoint and
+// DOPPELMARK_TEST_S3_BUCKET an existing bucket, as in the tests
+// workflow. The credentials are taken from the environment, e.g.
+// AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY, and AWS_REGION.
+func TestS3(t *testing.T) {
+	endpoint, bucket := os.Getenv("DOPPELMARK_TEST_S3_ENDPOINT"), os.Getenv("DOPPELMARK_TEST_S3_BUCKET")
+	if endpoint == "" || bucket == "" {
+		t.Skip("DOPPELMARK_TEST_S3_ENDPOINT and DOPPELMARK_TEST_S3_BUCKET are not set")
+	}
+	RegisterS3(endpoint)
+	testRemote(t, "s3://"+bucket)
+}
+
+// Test marking an indexed input in GCS into an output and metrics in
+// GCS. The test runs only if DOPPELMARK_TEST_GCS_BUCKET is an existing
+// bucket, of GCS, or of the S3 compatible server at
+// DOPPELMARK_TEST_GCS_ENDPOINT, and GCS_HMAC_ACCESS_ID and
+// GCS_HMAC_SECRET its HMAC key.
+func TestGCS(t *testing.T) {
+	bucket := os.Getenv("DOPPELMARK_TEST_GCS_BUCKET")
+	if bucket == "" {
+		t.Skip("DOPPELMARK_TEST_GCS_BUCKET is not set")
+	}
+	RegisterGCS(os.Getenv("DOPPELMARK_TEST_GCS_ENDPOINT"))
+	testRemote(t, "gs://"+bucket)
+}
+
+// testRemote marks an indexed input at a URL under bucketURL into an
+// output and metrics under it, and compares them to those of the local
+// input.
+func testRemote(t *testing.T, bucketURL string) {
+	ctx := context.Background()
+	tempDir, cleanup := testutil.TempDir(t, "", "")
+	defer cleanup()
+	_, path := writeHighCoverageBAM(t, tempDir, 2000)
+	prefix := fmt.Sprintf("%s/doppelmark-test-%d/", bucketURL, time.Now().UnixNano())
+	copyFile(ctx, t, path, prefix+"in.bam")
+	copyFile(ctx, t, path+".bai", prefix+"in.bam.bai")
+	defer func() {
+		for _, name := range []string{"in.bam", "in.bam.bai", "out.bam", "metrics.txt"} {
+			file.Remove(ctx, prefix+name) // nolint: errcheck
+		}
+	}()
+
+	// The input is sharded through its index, so it is read with
+	// ranged requests.
+	newOpts := func(bamFile, outputPath, metricsFile string) *Opts {
+		opts := defaultOpts
+		opts.BamFile = bamFile
+		opts.IndexFile = bamFile + ".bai"
+		opts.OutputPath = outputPath
+		opts.MetricsFile = metricsFile
+		opts.Format = "bam"
+		opts.IndexFormat = indexFormatNone
+		opts.ShardSize = 100000
+		opts.Padding = 1000
+		opts.MinBases = 1000
+		opts.TargetReadsPerShard = 1000
+		opts.ScavengeUmis = -1
+		return &opts
+	}
+	mark := func(opts *Opts) error {
+		provider := bamprovider.NewProvider(opts.BamFile, bamprovider.ProviderOpts{Index: opts.IndexFile})
+		defer provider.Close() // nolint: errcheck
+		return SetupAndMark(ctx, provider, opts)
+	}
+	localOpts := newOpts(path, filepath.Join(tempDir, "local.bam"), filepath.Join(tempDir, "local.txt"))
+	if !assert.NoError(t, mark(localOpts)) {
+		return
+	}
+	remoteOpts := newOpts(prefix+"in.bam", prefix+"out.bam", prefix+"metrics.txt")
+	if !assert.NoError(t, mark(remoteOpts)) {
+		return
+	}
+
+	outputPath, metricsPath := filepath.Join(tempDir, "remote.bam"), filepath.Join(tempDir, "remote.txt")
+	copyFile(ctx, t, remoteOpts.OutputPath, outputPath)
+	copyFile(ctx, t, remoteOpts.MetricsFile, metricsPath)
+	assert.Equal(t, ReadRecords(t, localOpts.OutputPath), ReadRecords(t, outputPath))
+	localMetrics, err := ioutil.ReadFile(localOpts.MetricsFile)
+	assert.NoError(t, err)
+	remoteMetrics, err := ioutil.ReadFile(metricsPath)
+	assert.NoError(t, err)
+	assert.Equal(t, string(localMetrics), string(remoteMetrics))
+}
@@ -0,0 +1,180 @@
+// Copyright 2019 Grail Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package markduplicates
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/Schaudge/grailbase/errors"
+	"github.com/Schaudge/grailbio/encoding/bam"
+	"github.com/Schaudge/grailbio/encoding/bampair"
+	"github.com/Schaudge/hts/sam"
+)
+
+// With Opts.FlagSecondaryDups, the secondary and supplementary
+// records of duplicate reads are flagged as duplicates too. Such a
+// record may be in a different shard than its primary read, e.g. the
+// supplementary record of a split read on another chromosome, and it
+// may come before its primary read. So Mark resolves them in three
+// steps:
+//
+//  1. While scanning for distant mates, secondaryScanner collects the
+//     templates of all secondary and supplementary records.
+//  2. If there are any, resolveSecondaryDups marks the duplicates of
+//     every mapped shard without writing anything, and saves which of
+//     those templates are duplicates.
+//  3. processShard then flags the secondary and supplementary records
+//     of the duplicate templates when it writes them.
+//
+// A template is a read of a readpair, identified by its name and read
+// number, so the supplementary records of R1 follow R1 and those of
+// R2 follow R2.
+
+// templateKey returns the key of the template of r, its name and read
+// number.
+func templateKey(r *sam.Record) string {
+	switch {
+	case (r.Flags & sam.Read1) != 0:
+		return r.Name + "/1"
+	case (r.Flags & sam.Read2) != 0:
+		return r.Name + "/2"
+	}
+	return r.Name
+}
+
+// secondaryDupTable holds the templates of the secondary and
+// supplementary records, and which of them are duplicates.
+type secondaryDupTable struct {
+	mutex sync.Mutex
+	// templates are the templateKeys of the secondary and
+	// supplementary records.
+	templates map[string]bool
+	// duplicates are the templateKeys in templates whose primary reads
+	// are duplicates. It is complete, and read without locking, once
+	// resolveSecondaryDups returns.
+	duplicates map[string]bool
+}
+
+func newSecondaryDupTable() *secondaryDupTable {
+	return &secondaryDupTable{
+		templates:  make(map[string]bool),
+		duplicates: make(map[string]bool),
+	}
+}
+
+// addDuplicates saves the templateKeys in duplicates that have
+// secondary or supplementary records.
+func (t *secondaryDupTable) addDuplicates(duplicates map[string]bool) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	for key := range duplicates {
+		if t.templates[key] {
+			t.duplicates[key] = true
+		}
+	}
+}
+
+// flag flags r, a secondary or supplementary record, as a duplicate if
+// its template is a duplicate, and counts it in
+// mc.SecondarySupplementaryDups if it was not flagged already. In
+// Opts.TagOnlyMode, r is not flagged.
+func (t *secondaryDupTable) flag(opts *Opts, r *sam.Record, mc *MetricsCollection) {
+	if opts.TagOnlyMode || (r.Flags&sam.Duplicate) != 0 || !t.duplicates[templateKey(r)] {
+		return
+	}
+	r.Flags |= sam.Duplicate
+	mc.SecondarySupplementaryDups++
+}
+
+// secondaryScanner collects the templates of the secondary and
+// supplementary records of a shard from within GetDistantMates.
+type secondaryScanner struct {
+	table     *secondaryDupTable
+	templates []string
+}
+
+func (s *secondaryScanner) Process(shard bam.Shard, r *sam.Record) error {
+	if (r.Flags&(sam.Secondary|sam.Supplementary)) != 0 && shard.RecordInShard(r) {
+		s.templates = append(s.templates, templateKey(r))
+	}
+	return nil
+}
+
+func (s *secondaryScanner) Close(_ bam.Shard) {
+	s.table.mutex.Lock()
+	defer s.table.mutex.Unlock()
+	for _, key := range s.templates {
+		s.table.templates[key] = true
+	}
+	s.templates = nil
+}
+
+// resolveSecondaryDups marks the duplicates of every mapped shard
+// without writing records or metrics, and saves the duplicate
+// templates of m.secondaryDups. processShard releases the distant
+// mates of each shard, so this scans the input for distant mates
+// again.
+func (m *MarkDuplicates) resolveSecondaryDups(ctx context.Context) error {
+	distantMates, _, err := bampair.GetDistantMates(m.Provider, m.shardList, m.distantMatesOpts(),
+		[]func() bampair.RecordProcessor{func() bampair.RecordProcessor {
+			return &cancelCheck{ctx: ctx}
+		}})
+	if cancelErr := cancelled(ctx); cancelErr != nil {
+		if err == nil {
+			distantMates.Close() // nolint: errcheck
+		}
+		return cancelErr
+	}
+	if err != nil {
+		return fmt.Errorf("failed while scanning for distant mates: %v", err)
+	}
+	writeMates := m.distantMates
+	m.distantMates = distantMates
+	defer func() {
+		m.distantMates = writeMates
+	}()
+
+	shardChannel := make(chan bam.Shard, len(m.shardList))
+	for _, shard := range m.shardList {
+		// The unmapped shard has no duplicates.
+		if shard.StartRef != nil {
+			shardChannel <- shard
+		}
+	}
+	close(shardChannel)
+
+	e := errors.Once{}
+	wg := sync.WaitGroup{}
+	for wi := 0; wi < m.Opts.computeParallelism(); wi++ {
+		wg.Add(1)
+		go func(worker int) {
+			defer wg.Done()
+			for shard := range shardChannel {
+				// After an error, the remaining shards are skipped.
+				e.Set(cancelled(ctx))
+				if e.Err() != nil {
+					continue
+				}
+				iter := m.Provider.NewIterator(shard)
+				e.Set(m.processShard(ctx, iter, shard, worker, nil))
+				e.Set(iter.Close())
+			}
+		}(wi)
+	}
+	wg.Wait()
+	e.Set(distantMates.Close())
+	return e.Err()
+}
@@ -0,0 +1,214 @@
+// Copyright 2019 Grail Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package markduplicates
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Schaudge/grailbase/errors"
+	"github.com/Schaudge/grailbase/file"
+	"github.com/Schaudge/grailbio/encoding/bam"
+	"github.com/Schaudge/hts/sam"
+)
+
+// Shard manifest
+//
+// With Opts.ShardManifestFile, Mark writes a tab separated row for each
+// shard of coordinate sorted input once the output is written: the
+// boundaries of the shard, its padding, and the number of records of
+// the shard and of its duplicates, with the wall time that marking it
+// took. The records are those in the shard without its padding, so
+// they add up to the records of the input. The boundaries are those of
+// bam.Shard, with "*" as the reference of the unmapped shard.
+//
+// With Opts.ShardManifestInput, Mark uses the shards of a manifest
+// instead of generating them, so a later run, of another version or
+// with other options, marks the same shards, and their rows can be
+// compared to find the shard whose output differs. Only the boundary
+// columns are read. The statistics are gathered on the side of the
+// metrics, so the manifest changes neither the output nor the metrics.
+
+// shardManifestHeader is the header line of Opts.ShardManifestFile.
+const shardManifestHeader = "shard\tstart_ref\tstart\tstart_seq\tend_ref\tend\tend_seq\tpadding\trecords\tduplicates\twall_seconds\n"
+
+// shardManifestBoundaryFields is the number of leading columns of a
+// manifest row that define its shard.
+const shardManifestBoundaryFields = 8
+
+// shardStats are the statistics of a shard in the shard manifest.
+type shardStats struct {
+	records    int64
+	duplicates int64
+	wallTime   time.Duration
+}
+
+// addShardStats saves the statistics of the shard with index
+// shardIdx for the shard manifest.
+func (m *MarkDuplicates) addShardStats(shardIdx int, stats shardStats) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if m.shardStats == nil {
+		m.shardStats = make(map[int]shardStats)
+	}
+	m.shardStats[shardIdx] = stats
+}
+
+// manifestRefName returns the name of ref in the shard manifest.
+func manifestRefName(ref *sam.Reference) string {
+	if ref == nil {
+		return "*"
+	}
+	return ref.Name()
+}
+
+// writeShardManifest writes the shards of m to Opts.ShardManifestFile,
+// if it is set.
+func (m *MarkDuplicates) writeShardManifest() error {
+	if m.Opts.ShardManifestFile == "" {
+		return nil
+	}
+	return writeShardManifestFile(m.Opts.ShardManifestFile, m.shardList, m.shardStats)
+}
+
+// writeShardManifestFile writes the rows of shards, with their
+// statistics in stats, to the shard manifest at path.
+func writeShardManifestFile(path string, shards []bam.Shard, stats map[int]shardStats) (err error) {
+	var f *os.File
+	f, err = os.Create(path)
+	if err != nil {
+		return errors.E(err, "Couldn't create shard manifest:", path)
+	}
+	defer func() {
+		if err2 := f.Close(); err == nil && err2 != nil {
+			err = err2
+		}
+	}()
+	w := bufio.NewWriter(f)
+	if _, err = w.WriteString(shardManifestHeader); err != nil {
+		return err
+	}
+	for _, shard := range shards {
+		s := stats[shard.ShardIdx]
+		if _, err = fmt.Fprintf(w, "%d\t%s\t%d\t%d\t%s\t%d\t%d\t%d\t%d\t%d\t%.3f\n", shard.ShardIdx,
+			manifestRefName(shard.StartRef), shard.Start, shard.StartSeq,
+			manifestRefName(shard.EndRef), shard.End, shard.EndSeq, shard.Padding,
+			s.records, s.duplicates, s.wallTime.Seconds()); err != nil {
+			return err
+		}
+	}
+	return w.Flush()
+}
+
+// readShardManifest reads the shards of the shard manifest at path.
+func readShardManifest(ctx context.Context, path string, header *sam.Header) (shards []bam.Shard, err error) {
+	in, err := file.Open(ctx, path)
+	if err != nil {
+		return nil, errors.E(err, "couldn't open shard manifest:", path)
+	}
+	defer func() {
+		if err2 := in.Close(ctx); err == nil && err2 != nil {
+			err = err2
+		}
+	}()
+	data, err := ioutil.ReadAll(in.Reader(ctx))
+	if err != nil {
+		return nil, errors.E(err, "couldn't read shard manifest:", path)
+	}
+	shards, err = parseShardManifest(data, header)
+	if err != nil {
+		return nil, errors.E(err, "invalid shard manifest:", path)
+	}
+	return shards, nil
+}
+
+// parseShardManifest returns the shards of the rows of data, a shard
+// manifest of input with header. The shards must be numbered from 0,
+// and ordered without overlaps. The header line and empty lines are
+// ignored.
+func parseShardManifest(data []byte, header *sam.Header) ([]bam.Shard, error) {
+	refs := make(map[string]*sam.Reference, len(header.Refs()))
+	for _, ref := range header.Refs() {
+		refs[ref.Name()] = ref
+	}
+	parseRef := func(name string) (*sam.Reference, error) {
+		if name == "*" {
+			return nil, nil
+		}
+		ref, ok := refs[name]
+		if !ok {
+			return nil, fmt.Errorf("reference %s is not in the header", name)
+		}
+		return ref, nil
+	}
+
+	var shards []bam.Shard
+	for i, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimRight(line, "\r")
+		if line == "" || (i == 0 && line+"\n" == shardManifestHeader) {
+			continue
+		}
+		fields := strings.Split(line, "\t")
+		if len(fields) < shardManifestBoundaryFields {
+			return nil, fmt.Errorf("line %d (%s) must have at least %d columns", i+1, line, shardManifestBoundaryFields)
+		}
+		var ints [6]int
+		for j, field := range []string{fields[0], fields[2], fields[3], fields[5], fields[6], fields[7]} {
+			n, err := strconv.Atoi(field)
+			if err != nil || n < 0 {
+				return nil, fmt.Errorf("line %d (%s) must have non-negative integer boundaries", i+1, line)
+			}
+			ints[j] = n
+		}
+		startRef, err := parseRef(fields[1])
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", i+1, err)
+		}
+		endRef, err := parseRef(fields[4])
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", i+1, err)
+		}
+		shard := bam.Shard{
+			StartRef: startRef,
+			Start:    ints[1],
+			StartSeq: ints[2],
+			EndRef:   endRef,
+			End:      ints[3],
+			EndSeq:   ints[4],
+			Padding:  ints[5],
+			ShardIdx: ints[0],
+		}
+		if shard.ShardIdx != len(shards) {
+			return nil, fmt.Errorf("line %d has shard %d, expected shard %d", i+1, shard.ShardIdx, len(shards))
+		}
+		r := bam.ShardToCoordRange(shard)
+		if r.Limit.LT(r.Start) {
+			return nil, fmt.Errorf("shard %d ends before it starts", shard.ShardIdx)
+		}
+		if n := len(shards); n > 0 && r.Start.LT(bam.ShardToCoordRange(shards[n-1]).Limit) {
+			return nil, fmt.Errorf("shard %d overlaps shard %d", shard.ShardIdx, n-1)
+		}
+		shards = append(shards, shard)
+	}
+	if len(shards) == 0 {
+		return nil, fmt.Errorf("no shards")
+	}
+	return shards, nil
+}
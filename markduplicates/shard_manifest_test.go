@@ -0,0 +1,151 @@
+// Copyright 2019 Grail Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package markduplicates
+
+import (
+	"io/ioutil"
+	"math"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	gbam "github.com/Schaudge/grailbio/encoding/bam"
+	"github.com/Schaudge/grailbio/encoding/bamprovider"
+	"github.com/Schaudge/hts/sam"
+	"github.com/grailbio/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseShardManifest(t *testing.T) {
+	tests := []struct {
+		data     string
+		expected []gbam.Shard
+		err      string
+	}{
+		{
+			shardManifestHeader +
+				"0\tchr1\t0\t0\tchr1\t500\t0\t10\t5\t2\t0.001\n" +
+				"1\tchr1\t500\t0\tchr2\t100\t3\t10\t1\t0\t0.001\n" +
+				"\n" +
+				"2\t*\t0\t0\t*\t0\t0\t10\n",
+			[]gbam.Shard{
+				{StartRef: chr1, EndRef: chr1, Start: 0, End: 500, Padding: 10, ShardIdx: 0},
+				{StartRef: chr1, EndRef: chr2, Start: 500, End: 100, EndSeq: 3, Padding: 10, ShardIdx: 1},
+				{Padding: 10, ShardIdx: 2},
+			},
+			"",
+		},
+		{shardManifestHeader, nil, "no shards"},
+		{"0\tchr1\t0\t0\tchr1\t500\t0\n", nil, "must have at least 8 columns"},
+		{"0\tchr1\t0\t0\tchrX\t500\t0\t10\n", nil, "reference chrX is not in the header"},
+		{"0\tchr1\t-1\t0\tchr1\t500\t0\t10\n", nil, "must have non-negative integer boundaries"},
+		{"1\tchr1\t0\t0\tchr1\t500\t0\t10\n", nil, "line 1 has shard 1, expected shard 0"},
+		{"0\tchr1\t500\t0\tchr1\t100\t0\t10\n", nil, "shard 0 ends before it starts"},
+		{"0\tchr1\t0\t0\tchr1\t500\t0\t10\n1\tchr1\t400\t0\tchr1\t1000\t0\t10\n", nil,
+			"shard 1 overlaps shard 0"},
+	}
+	for _, test := range tests {
+		shards, err := parseShardManifest([]byte(test.data), header)
+		if test.err != "" {
+			assert.Error(t, err, "data %q", test.data)
+			if err != nil {
+				assert.Contains(t, err.Error(), test.err, "data %q", test.data)
+			}
+			continue
+		}
+		assert.NoError(t, err, "data %q", test.data)
+		assert.Equal(t, test.expected, shards, "data %q", test.data)
+	}
+}
+
+// Test that the manifest has the shards of a run with their records
+// and duplicates, and that a run with the manifest as its input marks
+// the same shards, with the same output.
+func TestShardManifest(t *testing.T) {
+	shards := []gbam.Shard{
+		{StartRef: chr1, EndRef: chr1, Start: 0, End: 500, Padding: 10, ShardIdx: 0},
+		{StartRef: chr1, EndRef: chr1, Start: 500, End: 1000, Padding: 10, ShardIdx: 1},
+		{StartRef: chr2, EndRef: chr2, Start: 0, End: 2000, Padding: 10, ShardIdx: 2},
+		{StartRef: nil, EndRef: nil, Start: 0, End: math.MaxInt32, Padding: 10, ShardIdx: 3},
+	}
+	// A and B are duplicates in shard 0, D's reads are in shards 0 and
+	// 1, V is in shard 2, and U is unmapped.
+	records := []*sam.Record{
+		NewRecord("A:::1:10:1:1", chr1, 10, r1F, 100, chr1, cigar0),
+		NewRecord("B:::1:20:1:1", chr1, 10, r1F, 100, chr1, cigar0),
+		NewRecord("A:::1:10:1:1", chr1, 100, r2R, 10, chr1, cigar0),
+		NewRecord("B:::1:20:1:1", chr1, 100, r2R, 10, chr1, cigar0),
+		NewRecord("D:::1:30:1:1", chr1, 400, r1F, 700, chr1, cigar0),
+		NewRecord("D:::1:30:1:1", chr1, 700, r2R, 400, chr1, cigar0),
+		NewRecord("V:::1:40:1:1", chr2, 50, r1F, 60, chr2, cigar0),
+		NewRecord("V:::1:40:1:1", chr2, 60, r2R, 50, chr2, cigar0),
+		NewRecord("U:::1:50:1:1", nil, -1, up1, -1, nil, nil),
+		NewRecord("U:::1:50:1:1", nil, -1, up2, -1, nil, nil),
+	}
+	// The records and duplicates of each shard.
+	expectedStats := [][2]string{{"5", "2"}, {"1", "0"}, {"2", "0"}, {"2", "0"}}
+
+	tempDir, cleanup := testutil.TempDir(t, "", "")
+	defer cleanup()
+	manifest := filepath.Join(tempDir, "shards.tsv")
+	opts := defaultOpts
+	opts.OutputPath = NewTestOutput(tempDir, 0, "bam")
+	opts.Format = "bam"
+	opts.ShardManifestFile = manifest
+	markDuplicates := &MarkDuplicates{
+		Provider: bamprovider.NewFakeProvider(header, records),
+		Opts:     &opts,
+	}
+	_, err := markDuplicates.Mark(shards)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	data, err := ioutil.ReadFile(manifest)
+	assert.NoError(t, err)
+	lines := strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+	if assert.Equal(t, len(shards)+1, len(lines)) {
+		assert.Equal(t, shardManifestHeader, lines[0]+"\n")
+		for i, line := range lines[1:] {
+			fields := strings.Split(line, "\t")
+			assert.Equal(t, 11, len(fields), "line %s", line)
+			assert.Equal(t, expectedStats[i], [2]string{fields[8], fields[9]}, "line %s", line)
+		}
+	}
+	parsed, err := parseShardManifest(data, header)
+	assert.NoError(t, err)
+	assert.Equal(t, shards, parsed)
+
+	rerunOpts := defaultOpts
+	rerunOpts.OutputPath = NewTestOutput(tempDir, 1, "bam")
+	rerunOpts.Format = "bam"
+	rerunOpts.ShardSize = 100
+	rerunOpts.Padding = 50
+	rerunOpts.ShardManifestInput = manifest
+	rerun := &MarkDuplicates{
+		Provider: bamprovider.NewFakeProvider(header, records),
+		Opts:     &rerunOpts,
+	}
+	_, err = rerun.Mark(nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, shards, rerun.shardList)
+	expected, actual := ReadRecords(t, opts.OutputPath), ReadRecords(t, rerunOpts.OutputPath)
+	if assert.Equal(t, len(expected), len(actual)) {
+		for i := range expected {
+			assert.Equal(t, expected[i].String(), actual[i].String())
+		}
+	}
+}
@@ -0,0 +1,136 @@
+// Copyright 2019 Grail Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package markduplicates
+
+import (
+	"fmt"
+	"sort"
+)
+
+// ShardMetrics counts how the readpairs of a shard were mated. Each
+// readpair is counted in the shard of its left read.
+type ShardMetrics struct {
+	// WithinShardPairs is the number of readpairs whose reads were
+	// both in the padded shard.
+	WithinShardPairs int64
+
+	// DistantMatePairs is the number of readpairs whose mate was
+	// found in the distant mate table.
+	DistantMatePairs int64
+}
+
+// Shard returns ShardMetrics for the given shard index. If there is
+// no ShardMetrics for the shard yet, create one and return it.
+func (mc *MetricsCollection) Shard(shardIdx int) *ShardMetrics {
+	m, found := mc.ShardMetrics[shardIdx]
+	if found {
+		return m
+	}
+	m = &ShardMetrics{}
+	mc.ShardMetrics[shardIdx] = m
+	return m
+}
+
+// TotalShardMetrics returns the sum of the per-shard metrics.
+func (mc *MetricsCollection) TotalShardMetrics() ShardMetrics {
+	var total ShardMetrics
+	for _, m := range mc.ShardMetrics {
+		total.WithinShardPairs += m.WithinShardPairs
+		total.DistantMatePairs += m.DistantMatePairs
+	}
+	return total
+}
+
+// addMatedPair counts p in the ShardMetrics of shardIdx. If distant is
+// true, p was mated through the distant mate table, and the distance
+// between its reads is added to DistantMateDistances, or to
+// DistantMateTransPairs if they are on different references.
+func (mc *MetricsCollection) addMatedPair(shardIdx int, p *readPair, distant bool) {
+	m := mc.Shard(shardIdx)
+	if !distant {
+		m.WithinShardPairs++
+		return
+	}
+	m.DistantMatePairs++
+	if p.left.Ref.ID() != p.right.Ref.ID() {
+		mc.DistantMateTransPairs++
+		return
+	}
+	bin := distanceDecade(abs(p.right.Pos - p.left.Pos))
+	if bin >= len(mc.DistantMateDistances) {
+		temp := make([]int64, bin+1)
+		copy(temp, mc.DistantMateDistances)
+		mc.DistantMateDistances = temp
+	}
+	mc.DistantMateDistances[bin]++
+}
+
+// distanceDecade returns the number of decimal digits of d minus one,
+// so distances in [10^i, 10^(i+1)) are in bin i, and 0 is in bin 0.
+func distanceDecade(d int) int {
+	bin := 0
+	for d >= 10 {
+		d /= 10
+		bin++
+	}
+	return bin
+}
+
+// distanceDecadeName returns the name of bin i of
+// DistantMateDistances, e.g. "1000-9999".
+func distanceDecadeName(i int) string {
+	if i == 0 {
+		return "0-9"
+	}
+	lower := 1
+	for j := 0; j < i; j++ {
+		lower *= 10
+	}
+	return fmt.Sprintf("%d-%d", lower, 10*lower-1)
+}
+
+// sortedShardIndexes returns the shard indexes in shards in increasing
+// order.
+func sortedShardIndexes(shards map[int]*ShardMetrics) []int {
+	indexes := make([]int, 0, len(shards))
+	for shardIdx := range shards {
+		indexes = append(indexes, shardIdx)
+	}
+	sort.Ints(indexes)
+	return indexes
+}
+
+// shardingString returns the sharding section of the metrics file: the
+// readpairs mated within each shard and through the distant mate
+// table, and the distribution of the reference distance between
+// distant mates.
+func shardingString(globalMetrics *MetricsCollection) string {
+	s := "# sharding\n"
+	s += "SHARD\tWITHIN_SHARD_PAIRS\tDISTANT_MATE_PAIRS\n"
+	for _, shardIdx := range sortedShardIndexes(globalMetrics.ShardMetrics) {
+		m := globalMetrics.ShardMetrics[shardIdx]
+		s += fmt.Sprintf("%d\t%d\t%d\n", shardIdx, m.WithinShardPairs, m.DistantMatePairs)
+	}
+	total := globalMetrics.TotalShardMetrics()
+	s += fmt.Sprintf("ALL\t%d\t%d\n", total.WithinShardPairs, total.DistantMatePairs)
+
+	s += "\nDISTANT_MATE_DISTANCE\tPAIRS\n"
+	for bin, count := range globalMetrics.DistantMateDistances {
+		if count > 0 {
+			s += fmt.Sprintf("%s\t%d\n", distanceDecadeName(bin), count)
+		}
+	}
+	s += fmt.Sprintf("trans\t%d\n", globalMetrics.DistantMateTransPairs)
+	return s
+}
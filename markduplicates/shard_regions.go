@@ -0,0 +1,214 @@
+// Copyright 2019 Grail Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package markduplicates
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/Schaudge/grailbase/errors"
+	"github.com/Schaudge/grailbase/intervalmap"
+	"github.com/Schaudge/grailbio/biopb"
+	"github.com/Schaudge/grailbio/encoding/bam"
+	"github.com/Schaudge/grailbio/encoding/bamprovider"
+	"github.com/Schaudge/hts/sam"
+)
+
+// With Opts.Regions, Mark processes only the given regions of the
+// genome: each merged region is split into shards of at most
+// regionShardBases bases, padded by Opts.Padding, and the reads of the
+// shards are read through the index of the input. The output has the
+// reads of the shards, and the metrics count just those reads. There
+// is no unmapped shard, so unmapped reads without a position are not
+// in the output.
+//
+// A read in the regions whose mate is outside all of the shards,
+// including their padding, is paired with its mate fetched through the
+// index, so that the readpair is marked like it would be in the whole
+// genome. The fetched mate is neither written to the output nor
+// counted in the metrics, and the readpair is counted in the shard of
+// the read in the regions. The scan for the distant mates reads the
+// shards through a regionMatesProvider, which leaves those mates out.
+
+// regionShardBases is the largest number of bases of a shard of
+// Opts.Regions.
+const regionShardBases = 1000000
+
+// readRegions returns the merged intervals of each reference ID of
+// regions, which is a BED file if it ends with ".bed", and otherwise
+// a comma separated list of samtools style regions, see
+// parseRegionStrings.
+func readRegions(ctx context.Context, regions string, header *sam.Header) (map[int][]intervalmap.Interval, error) {
+	if strings.HasSuffix(regions, ".bed") {
+		return readBEDIntervals(ctx, regions, header)
+	}
+	return parseRegionStrings(regions, header)
+}
+
+// parseRegionStrings parses a comma separated list of regions
+// "ref", "ref:beg", or "ref:beg-end", with 1-based inclusive
+// coordinates like samtools, and returns the merged intervals of each
+// reference ID. "ref" is all of ref, and "ref:beg" is ref from beg to
+// its end.
+func parseRegionStrings(regions string, header *sam.Header) (map[int][]intervalmap.Interval, error) {
+	refs := make(map[string]*sam.Reference, len(header.Refs()))
+	for _, ref := range header.Refs() {
+		refs[ref.Name()] = ref
+	}
+	intervals := make(map[int][]intervalmap.Interval)
+	for _, region := range strings.Split(regions, ",") {
+		region = strings.TrimSpace(region)
+		if region == "" {
+			continue
+		}
+		name, coords := region, ""
+		if i := strings.LastIndex(region, ":"); i >= 0 && refs[region] == nil {
+			name, coords = region[:i], region[i+1:]
+		}
+		ref, ok := refs[name]
+		if !ok {
+			return nil, errors.E(errors.Invalid, "region", region, "is on a reference that is not in the BAM header")
+		}
+		start, end := int64(0), int64(ref.Len())
+		if coords != "" {
+			begStr, endStr := coords, ""
+			if i := strings.Index(coords, "-"); i >= 0 {
+				begStr, endStr = coords[:i], coords[i+1:]
+			}
+			beg, err := strconv.ParseInt(begStr, 10, 64)
+			if err != nil {
+				return nil, errors.E(errors.Invalid, err, "region", region, "has an invalid start")
+			}
+			start = beg - 1
+			if endStr != "" {
+				if end, err = strconv.ParseInt(endStr, 10, 64); err != nil {
+					return nil, errors.E(errors.Invalid, err, "region", region, "has an invalid end")
+				}
+			}
+		}
+		if start < 0 || end <= start || end > int64(ref.Len()) {
+			return nil, errors.E(errors.Invalid, fmt.Sprintf("region %s is not within 1-%d", region, ref.Len()))
+		}
+		intervals[ref.ID()] = append(intervals[ref.ID()], intervalmap.Interval{Start: start, Limit: end})
+	}
+	if len(intervals) == 0 {
+		return nil, errors.E(errors.Invalid, "no regions in", regions)
+	}
+	for refID, refIntervals := range intervals {
+		intervals[refID] = mergeIntervals(refIntervals)
+	}
+	return intervals, nil
+}
+
+// regionShards returns the shards of Opts.Regions, in the order of the
+// references of header, and then by position.
+func regionShards(ctx context.Context, opts *Opts, header *sam.Header) ([]bam.Shard, error) {
+	intervals, err := readRegions(ctx, opts.Regions, header)
+	if err != nil {
+		return nil, err
+	}
+	var shards []bam.Shard
+	for _, ref := range header.Refs() {
+		for _, interval := range intervals[ref.ID()] {
+			for start := int(interval.Start); start < int(interval.Limit); start += regionShardBases {
+				end := start + regionShardBases
+				if end > int(interval.Limit) {
+					end = int(interval.Limit)
+				}
+				shards = append(shards, bam.Shard{
+					StartRef: ref,
+					EndRef:   ref,
+					Start:    start,
+					End:      end,
+					Padding:  opts.Padding,
+					ShardIdx: len(shards),
+				})
+			}
+		}
+	}
+	if len(shards) == 0 {
+		return nil, errors.E(errors.Invalid, "no regions of", opts.Regions, "are on the references of the BAM header")
+	}
+	shardLog.Printf("processing %d shards of regions %s", len(shards), opts.Regions)
+	return shards, nil
+}
+
+// fetchMate returns the primary mate of r read through the index of
+// the input, or nil if it is not found. It is used for the mates that
+// are outside all of the shards of Opts.Regions.
+func (m *MarkDuplicates) fetchMate(r *sam.Record) (*sam.Record, error) {
+	iter := m.Provider.NewIterator(bam.Shard{
+		StartRef: r.MateRef,
+		EndRef:   r.MateRef,
+		Start:    r.MatePos,
+		End:      r.MatePos + 1,
+		ShardIdx: -1,
+	})
+	var mate *sam.Record
+	for iter.Scan() {
+		c := iter.Record()
+		if mate == nil && c.Name == r.Name && c.Pos == r.MatePos &&
+			(c.Flags&(sam.Secondary|sam.Supplementary)) == 0 &&
+			(c.Flags&(sam.Read1|sam.Read2)) != (r.Flags&(sam.Read1|sam.Read2)) {
+			mate = c
+		}
+	}
+	if err := iter.Close(); err != nil {
+		return nil, errors.E(err, fmt.Sprintf("error fetching the mate of %s at %s:%d", r.Name, r.MateRef.Name(), r.MatePos))
+	}
+	return mate, nil
+}
+
+// regionMatesProvider is a bamprovider.Provider for the scan for the
+// distant mates of the shards of Opts.Regions. Its iterators flag the
+// primary reads whose mates are outside all of the shards as having an
+// unmapped mate, because the scan looks up the shard of every mapped
+// mate. Their mates are fetched with fetchMate instead. The records of
+// the scan are not written, so the flags of the output are unchanged.
+type regionMatesProvider struct {
+	bamprovider.Provider
+	shards []bam.Shard
+}
+
+// NewIterator implements bamprovider.Provider.
+func (p *regionMatesProvider) NewIterator(shard bam.Shard) bamprovider.Iterator {
+	return &regionMatesIterator{Iterator: p.Provider.NewIterator(shard), shards: p.shards}
+}
+
+// regionMatesIterator is an iterator of a regionMatesProvider.
+type regionMatesIterator struct {
+	bamprovider.Iterator
+	shards []bam.Shard
+}
+
+// Record returns the record of the last Scan.
+func (it *regionMatesIterator) Record() *sam.Record {
+	r := it.Iterator.Record()
+	if pairedMate(r) && !coordInShards(it.shards, bam.MateCoordFromSAMRecord(r, 0)) {
+		r.Flags |= sam.MateUnmapped
+	}
+	return r
+}
+
+// coordInShards returns true if coord is in one of shards, without
+// their padding. The shards are sorted by position.
+func coordInShards(shards []bam.Shard, coord biopb.Coord) bool {
+	i := sort.Search(len(shards), func(i int) bool {
+		return coord.LT(bam.NewCoord(shards[i].EndRef, shards[i].End, 0))
+	})
+	return i < len(shards) && shards[i].CoordInShard(0, coord)
+}
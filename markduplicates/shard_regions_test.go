@@ -0,0 +1,149 @@
+// Copyright 2019 Grail Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package markduplicates
+
+import (
+	"context"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/Schaudge/grailbase/intervalmap"
+	"github.com/Schaudge/grailbio/encoding/bamprovider"
+	"github.com/Schaudge/hts/sam"
+	"github.com/grailbio/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseRegionStrings(t *testing.T) {
+	tests := []struct {
+		regions  string
+		expected map[int][]intervalmap.Interval
+		err      bool
+	}{
+		{"chr1", map[int][]intervalmap.Interval{0: {{Start: 0, Limit: 1000}}}, false},
+		{"chr1:101-200", map[int][]intervalmap.Interval{0: {{Start: 100, Limit: 200}}}, false},
+		{"chr2:1001", map[int][]intervalmap.Interval{1: {{Start: 1000, Limit: 2000}}}, false},
+		{
+			"chr2:500-600, chr1:1-10,chr2:550-700",
+			map[int][]intervalmap.Interval{0: {{Start: 0, Limit: 10}}, 1: {{Start: 499, Limit: 700}}},
+			false,
+		},
+		{"chrX:1-10", nil, true},
+		{"chr1:0-10", nil, true},
+		{"chr1:10-5", nil, true},
+		{"chr1:1-1001", nil, true},
+		{"chr1:a-10", nil, true},
+		{"", nil, true},
+	}
+	for _, test := range tests {
+		intervals, err := parseRegionStrings(test.regions, header)
+		if test.err {
+			assert.Error(t, err, "regions %s", test.regions)
+			continue
+		}
+		assert.NoError(t, err, "regions %s", test.regions)
+		assert.Equal(t, test.expected, intervals, "regions %s", test.regions)
+	}
+}
+
+func TestRegionShards(t *testing.T) {
+	ref, err := sam.NewReference("chrD", "", "", 3000000, nil, nil)
+	assert.NoError(t, err)
+	h, err := sam.NewHeader(nil, []*sam.Reference{ref})
+	assert.NoError(t, err)
+
+	tempDir, cleanup := testutil.TempDir(t, "", "")
+	defer cleanup()
+	bed := filepath.Join(tempDir, "regions.bed")
+	assert.NoError(t, ioutil.WriteFile(bed, []byte("chrD\t2500000\t2600000\nchrD\t0\t1500000\n"), 0644))
+
+	opts := defaultOpts
+	opts.Padding = 10
+	for _, regions := range []string{bed, "chrD:2500001-2600000,chrD:1-1500000"} {
+		opts.Regions = regions
+		shards, err := regionShards(context.Background(), &opts, h)
+		assert.NoError(t, err, "regions %s", regions)
+		assert.Equal(t, 3, len(shards), "regions %s", regions)
+		for i, expected := range [][2]int{{0, 1000000}, {1000000, 1500000}, {2500000, 2600000}} {
+			assert.Equal(t, ref, shards[i].StartRef)
+			assert.Equal(t, ref, shards[i].EndRef)
+			assert.Equal(t, expected, [2]int{shards[i].Start, shards[i].End}, "regions %s", regions)
+			assert.Equal(t, 10, shards[i].Padding)
+			assert.Equal(t, i, shards[i].ShardIdx)
+		}
+	}
+}
+
+func TestMarkRegions(t *testing.T) {
+	h := newTestHeader(t, "")
+	ref1, ref2 := h.Refs()[0], h.Refs()[1]
+	records := []*sam.Record{
+		// C's mate is outside the regions, and it is left of C.
+		NewRecord("C:::1:10:1:1", ref1, 100, r1F, 300, ref2, cigar0),
+		NewRecord("D:::1:10:2:2", ref1, 900, r1F, 1500, ref2, cigar0),
+		NewRecord("A:::1:10:3:3", ref2, 100, r1F, 200, ref2, cigar0),
+		NewRecord("B:::1:10:4:4", ref2, 100, r1F, 200, ref2, cigar0),
+		NewRecord("A:::1:10:3:3", ref2, 200, r2R, 100, ref2, cigar0),
+		NewRecord("B:::1:10:4:4", ref2, 200, r2R, 100, ref2, cigar0),
+		NewRecord("C:::1:10:1:1", ref2, 300, r2R, 100, ref1, cigar0),
+		NewRecord("D:::1:10:2:2", ref2, 1500, r2R, 900, ref1, cigar0),
+		NewRecord("U:::1:10:5:5", nil, -1, up1, -1, nil, nil),
+		NewRecord("U:::1:10:5:5", nil, -1, up2, -1, nil, nil),
+	}
+
+	tempDir, cleanup := testutil.TempDir(t, "", "")
+	defer cleanup()
+	opts := defaultOpts
+	opts.OutputPath = filepath.Join(tempDir, "out.bam")
+	opts.Format = "bam"
+	opts.Padding = 10
+	opts.Regions = "chr2:1-500"
+	markDuplicates := &MarkDuplicates{
+		Provider: bamprovider.NewFakeProvider(h, records),
+		Opts:     &opts,
+	}
+	metrics, err := markDuplicates.Mark(nil)
+	assert.NoError(t, err)
+
+	// The output has just the reads of the regions.
+	output := ReadRecords(t, opts.OutputPath)
+	var names []string
+	for _, r := range output {
+		assert.Equal(t, ref2.Name(), r.Ref.Name(), "record %v", r)
+		names = append(names, r.Name)
+		if r.Name[0] == 'B' {
+			assert.NotEqual(t, sam.Flags(0), r.Flags&sam.Duplicate, "record %v", r)
+		} else {
+			assert.Equal(t, sam.Flags(0), r.Flags&sam.Duplicate, "record %v", r)
+		}
+	}
+	assert.Equal(t, []string{"A:::1:10:3:3", "B:::1:10:4:4", "A:::1:10:3:3", "B:::1:10:4:4", "C:::1:10:1:1"}, names)
+
+	// The metrics count just the reads of the regions, and C once.
+	lib := metrics.LibraryMetrics["Unknown Library"]
+	assert.Equal(t, 5, lib.ReadPairsExamined)
+	assert.Equal(t, 2, lib.ReadPairDups)
+	assert.Equal(t, int64(1), metrics.DistantMateTransPairs)
+
+	opts = defaultOpts
+	opts.BamFile = "in.bam"
+	opts.Format = "bam"
+	opts.MinBases = 1
+	opts.ScavengeUmis = -1
+	opts.Regions = "chr1"
+	assert.NoError(t, validate(&opts))
+	opts.Format = "pam"
+	assert.Error(t, validate(&opts))
+}
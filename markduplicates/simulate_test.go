@@ -0,0 +1,152 @@
+// Copyright 2019 Grail Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package markduplicates
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/Schaudge/doppelmark/simulate"
+	"github.com/Schaudge/grailbio/encoding/bamprovider"
+	"github.com/Schaudge/hts/bam"
+	"github.com/Schaudge/hts/sam"
+	"github.com/grailbio/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+// readSimulated returns the header and the records of the BAM at path.
+func readSimulated(t testing.TB, path string) (*sam.Header, []*sam.Record) {
+	in, err := os.Open(path)
+	assert.NoError(t, err)
+	defer in.Close() // nolint: errcheck
+	reader, err := bam.NewReader(in, 1)
+	assert.NoError(t, err)
+	var records []*sam.Record
+	for {
+		r, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		assert.NoError(t, err)
+		records = append(records, r)
+	}
+	return reader.Header(), records
+}
+
+// simulated generates a BAM in dir with simOpts, and returns its path,
+// whether each readpair is a duplicate by name, and the number of
+// optical duplicates.
+func simulated(t testing.TB, dir string, simOpts simulate.Opts) (path string, expected map[string]bool, optical int) {
+	path = filepath.Join(dir, simOpts.NameFormat+".bam")
+	out, err := os.Create(path)
+	assert.NoError(t, err)
+	var truth bytes.Buffer
+	assert.NoError(t, simulate.Generate(simOpts, out, &truth))
+	assert.NoError(t, out.Close())
+
+	expected = map[string]bool{}
+	for _, row := range strings.Split(strings.TrimSpace(truth.String()), "\n")[1:] {
+		fields := strings.Split(row, "\t")
+		expected[fields[0]] = fields[3] == "true"
+		if fields[4] == "true" {
+			optical++
+		}
+	}
+	return path, expected, optical
+}
+
+// TestSimulated scores the duplicates of simulated BAMs against their
+// truth.
+func TestSimulated(t *testing.T) {
+	tempDir, cleanup := testutil.TempDir(t, "", "")
+	defer cleanup()
+	for testIdx, format := range []string{simulate.NameIllumina7, simulate.NameGeneMind, simulate.NameMGI} {
+		simOpts := simulate.DefaultOpts
+		simOpts.Pairs = 2000
+		simOpts.ReferenceLength = 100000
+		simOpts.NameFormat = format
+		simOpts.InterchromosomalFraction = 0.1
+		simOpts.SecondaryFraction = 0.05
+		simOpts.SupplementaryFraction = 0.05
+		input, expected, expectedOptical := simulated(t, tempDir, simOpts)
+		h, records := readSimulated(t, input)
+		opts := defaultOpts
+		opts.OutputPath = NewTestOutput(tempDir, testIdx, "bam")
+		opts.Format = "bam"
+		opts.ShardSize = 100000
+		opts.Padding = 1000
+		opts.OpticalDetector = nil
+		opts.OpticalDuplicatePixelDistance = simOpts.OpticalDistance
+		markDuplicates := &MarkDuplicates{
+			Provider: bamprovider.NewFakeProvider(h, records),
+			Opts:     &opts,
+		}
+		metrics, err := markDuplicates.Mark(nil)
+		if !assert.NoError(t, err, "format %s", format) {
+			continue
+		}
+
+		wrong := 0
+		for _, r := range ReadRecords(t, opts.OutputPath) {
+			if r.Flags&(sam.Secondary|sam.Supplementary) != 0 {
+				continue
+			}
+			if expected[r.Name] != (r.Flags&sam.Duplicate != 0) {
+				wrong++
+			}
+		}
+		assert.Equal(t, 0, wrong, "format %s", format)
+		// The optical duplicates of the metrics are counted by read.
+		if lib := metrics.LibraryMetrics["Unknown Library"]; assert.NotNil(t, lib, "format %s", format) {
+			assert.Equal(t, 2*expectedOptical, lib.ReadPairOpticalDups, "format %s", format)
+		}
+	}
+}
+
+// BenchmarkMark marks the duplicates of a simulated BAM end to end,
+// and reports the allocations of each run.
+func BenchmarkMark(b *testing.B) {
+	tempDir, cleanup := testutil.TempDir(b, "", "")
+	defer cleanup()
+	simOpts := simulate.DefaultOpts
+	simOpts.Pairs = 20000
+	simOpts.ReferenceLength = 1000000
+	simOpts.InterchromosomalFraction = 0.05
+	input, _, _ := simulated(b, tempDir, simOpts)
+	h, records := readSimulated(b, input)
+
+	opts := defaultOpts
+	opts.OutputPath = filepath.Join(tempDir, "output.bam")
+	opts.Format = "bam"
+	opts.ShardSize = 100000
+	opts.Padding = 1000
+	opts.OpticalDetector = nil
+	opts.OpticalDuplicatePixelDistance = simOpts.OpticalDistance
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		runOpts := opts
+		markDuplicates := &MarkDuplicates{
+			Provider: bamprovider.NewFakeProvider(h, records),
+			Opts:     &runOpts,
+		}
+		if _, err := markDuplicates.Mark(nil); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
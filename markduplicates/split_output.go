@@ -0,0 +1,260 @@
+// Copyright 2019 Grail Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package markduplicates
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/Schaudge/hts/sam"
+)
+
+// Output split by reference
+//
+// With Opts.SplitOutputByReference, the output of coordinate sorted
+// input is written to one BAM file per reference instead of to
+// Opts.OutputPath, in the same pass. The path of each file is the
+// template with splitOutputRef replaced by the name of its reference,
+// and the records without a reference are written to the "unmapped"
+// file. Each file has the full header, and is indexed like the output.
+//
+// A record goes to the file of its own reference, so the reads of a
+// readpair whose mates are on different references are in different
+// files, and an unmapped read placed at its mate is in the file of its
+// mate. The metrics are those of the whole input, as without the
+// split.
+//
+// Every file is written by each writer of the pipeline, with a
+// compressor per file, so the number of files is bounded by
+// Opts.SplitOutputMaxFiles, 64 if it is zero: when the header has more
+// references, the SplitOutputMaxFiles-2 longest references have their
+// own files, the first in the header among those of the same length,
+// and the others, usually the small unplaced and alternate contigs,
+// share the "other" file, wherever they are in the header.
+
+// splitOutputRef is the placeholder of the reference in the template
+// of Opts.SplitOutputByReference.
+const splitOutputRef = "{ref}"
+
+// defaultSplitOutputMaxFiles is the most files of the split output if
+// Opts.SplitOutputMaxFiles is zero.
+const defaultSplitOutputMaxFiles = 64
+
+const (
+	// splitOutputOther is the name of the file of the references
+	// beyond Opts.SplitOutputMaxFiles.
+	splitOutputOther = "other"
+	// splitOutputUnmapped is the name of the file of the records
+	// without a reference.
+	splitOutputUnmapped = "unmapped"
+)
+
+// splitOutputMaxFiles returns Opts.SplitOutputMaxFiles, or its
+// default if it is zero.
+func (o *Opts) splitOutputMaxFiles() int {
+	if o.SplitOutputMaxFiles == 0 {
+		return defaultSplitOutputMaxFiles
+	}
+	return o.SplitOutputMaxFiles
+}
+
+// splitOutputNames returns the names of the files of the references of
+// header, and the index in names of the file of each reference by ID.
+// The files of the references are in the order of the header, followed
+// by the other file, if any, and the unmapped file.
+func splitOutputNames(opts *Opts, header *sam.Header) (names []string, files []int, err error) {
+	refs := header.Refs()
+	maxFiles := opts.splitOutputMaxFiles()
+	own := make([]bool, len(refs))
+	byLength := make([]int, len(refs))
+	for i := range byLength {
+		byLength[i] = i
+	}
+	if len(refs)+1 > maxFiles {
+		sort.SliceStable(byLength, func(i, j int) bool {
+			return refs[byLength[i]].Len() > refs[byLength[j]].Len()
+		})
+		byLength = byLength[:maxFiles-2]
+	}
+	for _, i := range byLength {
+		own[i] = true
+	}
+	files = make([]int, len(refs))
+	for i, ref := range refs {
+		if own[i] {
+			files[i] = len(names)
+			names = append(names, ref.Name())
+		}
+	}
+	if len(byLength) < len(refs) {
+		for i := range refs {
+			if !own[i] {
+				files[i] = len(names)
+			}
+		}
+		names = append(names, splitOutputOther)
+	}
+	names = append(names, splitOutputUnmapped)
+	seen := make(map[string]bool)
+	for _, name := range names {
+		if seen[name] {
+			return nil, nil, fmt.Errorf("split-output-by-reference: reference %s has the name of another output", name)
+		}
+		seen[name] = true
+	}
+	return names, files, nil
+}
+
+// splitFile is one of the files of a splitOutput.
+type splitFile struct {
+	path    string
+	out     *outputFile
+	indexer *outputIndexer
+	writer  *bamWriter
+}
+
+// close waits for the records of f to be written, and closes it and its
+// index.
+func (f *splitFile) close(ctx context.Context) error {
+	err := f.writer.Close()
+	if f.indexer != nil {
+		if err2 := f.indexer.Close(); err == nil {
+			err = err2
+		}
+	}
+	if err2 := f.out.Close(ctx); err == nil {
+		err = err2
+	}
+	if err != nil {
+		return fmt.Errorf("couldn't write %s: %v", f.path, err)
+	}
+	return nil
+}
+
+// splitOutput writes the files of Opts.SplitOutputByReference.
+type splitOutput struct {
+	files []*splitFile
+	// refFiles is the index in files of the file of each reference by
+	// ID. The unmapped file is last.
+	refFiles []int
+	// indexFormat is the format of the index of each file.
+	indexFormat string
+}
+
+// newSplitOutput creates the files of Opts.SplitOutputByReference, with
+// header.
+func newSplitOutput(ctx context.Context, opts *Opts, header *sam.Header) (*splitOutput, error) {
+	names, refFiles, err := splitOutputNames(opts, header)
+	if err != nil {
+		return nil, err
+	}
+	s := &splitOutput{refFiles: refFiles, indexFormat: outputIndexFormat(opts, header)}
+	for _, name := range names {
+		f := &splitFile{path: strings.Replace(opts.SplitOutputByReference, splitOutputRef, name, -1)}
+		if f.out, err = createOutput(ctx, f.path); err != nil {
+			s.close(ctx) // nolint: errcheck
+			return nil, fmt.Errorf("couldn't create split output %s: %v", f.path, err)
+		}
+		var w io.Writer = f.out
+		if s.indexFormat != indexFormatNone {
+			f.indexer = newOutputIndexer(s.indexFormat, f.path+"."+s.indexFormat, header)
+			w = f.indexer.Writer(w)
+		}
+		if f.writer, err = newBAMWriter(opts, w, header); err != nil {
+			if f.indexer != nil {
+				f.indexer.Close() // nolint: errcheck
+			}
+			f.out.Close(ctx) // nolint: errcheck
+			s.close(ctx)     // nolint: errcheck
+			return nil, fmt.Errorf("couldn't create bam writer for %s: %v", f.path, err)
+		}
+		s.files = append(s.files, f)
+	}
+	return s, nil
+}
+
+// paths returns the paths of the files of s and their indexes.
+func (s *splitOutput) paths() []string {
+	var paths []string
+	for _, f := range s.files {
+		paths = append(paths, f.path)
+		if s.indexFormat != indexFormatNone {
+			paths = append(paths, f.path+"."+s.indexFormat)
+		}
+	}
+	return paths
+}
+
+// newCompressor returns a compressor of a writer of the pipeline, which
+// writes each record to the file of its reference.
+func (s *splitOutput) newCompressor() *splitCompressor {
+	c := &splitCompressor{split: s}
+	for _, f := range s.files {
+		c.compressors = append(c.compressors, newShardCompressor(f.writer, 1))
+	}
+	return c
+}
+
+// close waits for the records to be written, and closes the files. It
+// returns the first error.
+func (s *splitOutput) close(ctx context.Context) error {
+	var err error
+	for _, f := range s.files {
+		if err2 := f.close(ctx); err == nil {
+			err = err2
+		}
+	}
+	return err
+}
+
+// splitCompressor is the recordCompressor of a splitOutput. Each shard
+// is started and closed in every file, so that the shards of each file
+// are complete, and most of them are empty.
+type splitCompressor struct {
+	split       *splitOutput
+	compressors []*shardCompressor
+}
+
+// startShard implements recordCompressor. The records are always
+// compressed as they are added.
+func (c *splitCompressor) startShard(shardIdx int, stream bool) error {
+	for _, compressor := range c.compressors {
+		if err := compressor.startShard(shardIdx, true); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// addRecord implements recordCompressor.
+func (c *splitCompressor) addRecord(r *sam.Record) error {
+	file := len(c.compressors) - 1
+	if r.Ref != nil {
+		file = c.split.refFiles[r.Ref.ID()]
+	}
+	return c.compressors[file].addRecord(r)
+}
+
+// closeShard implements recordCompressor.
+func (c *splitCompressor) closeShard() error {
+	for _, compressor := range c.compressors {
+		if err := compressor.closeShard(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
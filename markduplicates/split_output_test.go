@@ -0,0 +1,152 @@
+// Copyright 2019 Grail Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package markduplicates
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/Schaudge/grailbio/encoding/bamprovider"
+	"github.com/Schaudge/hts/sam"
+	"github.com/grailbio/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSplitOutputNames(t *testing.T) {
+	// Each header has its own references, since a reference belongs
+	// to a single header.
+	lengths := map[string]int{"chr1": 1000, "chr2": 2000, "chr2b": 2000, "chr3": 3000, "chrM": 16, "chrUn": 100,
+		"unmapped": 100}
+	newHeader := func(names ...string) *sam.Header {
+		var refs []*sam.Reference
+		for _, name := range names {
+			ref, err := sam.NewReference(name, "", "", lengths[name], nil, nil)
+			assert.NoError(t, err)
+			refs = append(refs, ref)
+		}
+		h, err := sam.NewHeader(nil, refs)
+		assert.NoError(t, err)
+		return h
+	}
+	manyHeader := newHeader("chr1", "chr2", "chr3", "chrUn")
+
+	for _, test := range []struct {
+		maxFiles      int
+		expectedNames []string
+		expectedFiles []int
+	}{
+		{64, []string{"chr1", "chr2", "chr3", "chrUn", "unmapped"}, []int{0, 1, 2, 3}},
+		{0, []string{"chr1", "chr2", "chr3", "chrUn", "unmapped"}, []int{0, 1, 2, 3}},
+		{5, []string{"chr1", "chr2", "chr3", "chrUn", "unmapped"}, []int{0, 1, 2, 3}},
+		// chr1 is shorter than chr2 and chr3.
+		{4, []string{"chr2", "chr3", "other", "unmapped"}, []int{2, 0, 1, 2}},
+		{3, []string{"chr3", "other", "unmapped"}, []int{1, 1, 0, 1}},
+		{2, []string{"other", "unmapped"}, []int{0, 0, 0, 0}},
+	} {
+		names, files, err := splitOutputNames(&Opts{SplitOutputMaxFiles: test.maxFiles}, manyHeader)
+		assert.NoError(t, err, "max files %d", test.maxFiles)
+		assert.Equal(t, test.expectedNames, names, "max files %d", test.maxFiles)
+		assert.Equal(t, test.expectedFiles, files, "max files %d", test.maxFiles)
+	}
+
+	// The longest references have their own files wherever they are
+	// in the header, and the first of those of the same length.
+	unorderedHeader := newHeader("chrM", "chrUn", "chr2", "chr1", "chr2b")
+	names, files, err := splitOutputNames(&Opts{SplitOutputMaxFiles: 4}, unorderedHeader)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"chr2", "chr2b", "other", "unmapped"}, names)
+	assert.Equal(t, []int{2, 2, 0, 2, 1}, files)
+	names, files, err = splitOutputNames(&Opts{SplitOutputMaxFiles: 3}, unorderedHeader)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"chr2", "other", "unmapped"}, names)
+	assert.Equal(t, []int{1, 1, 0, 1, 1}, files)
+
+	// A reference cannot share the file of another output.
+	clashHeader := newHeader("chr1", "unmapped")
+	_, _, err = splitOutputNames(&Opts{SplitOutputMaxFiles: 64}, clashHeader)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "reference unmapped")
+	}
+}
+
+func TestSplitOutput(t *testing.T) {
+	// T is a readpair with mates on chr1 and chr2, and M a read whose
+	// unmapped mate is placed at it.
+	records := func() []*sam.Record {
+		return []*sam.Record{
+			NewRecord("A:::1:10:1:1", chr1, 10, r1F, 100, chr1, cigar0),
+			NewRecord("B:::1:10:2:2", chr1, 10, r1F, 100, chr1, cigar0),
+			NewRecord("A:::1:10:1:1", chr1, 100, r2R, 10, chr1, cigar0),
+			NewRecord("B:::1:10:2:2", chr1, 100, r2R, 10, chr1, cigar0),
+			NewRecord("T:::1:10:3:3", chr1, 200, r1F, 50, chr2, cigar0),
+			NewRecord("C:::1:10:4:4", chr2, 20, r1F, 150, chr2, cigar0),
+			NewRecord("T:::1:10:3:3", chr2, 50, r2R, 200, chr1, cigar0),
+			NewRecord("C:::1:10:4:4", chr2, 150, r2R, 20, chr2, cigar0),
+			NewRecord("M:::1:10:5:5", chr2, 300, s1F, 300, chr2, cigar0),
+			NewRecord("M:::1:10:5:5", chr2, 300, u2, 300, chr2, cigar0),
+			NewRecord("U:::1:10:6:6", nil, -1, up1, -1, nil, cigar0),
+			NewRecord("U:::1:10:6:6", nil, -1, up2, -1, nil, cigar0),
+		}
+	}
+
+	tempDir, cleanup := testutil.TempDir(t, "", "")
+	defer cleanup()
+	for testIdx, test := range []struct {
+		maxFiles int
+		// expected are the names of the records of each file.
+		expected map[string]string
+	}{
+		{64, map[string]string{"chr1": "ABABT", "chr2": "CTCMM", "unmapped": "UU"}},
+		{2, map[string]string{"other": "ABABTCTCMM", "unmapped": "UU"}},
+	} {
+		opts := defaultOpts
+		opts.Format = "bam"
+		opts.SplitOutputByReference = filepath.Join(tempDir, fmt.Sprintf("split%d", testIdx), "{ref}.bam")
+		opts.SplitOutputMaxFiles = test.maxFiles
+		opts.ShardSize = 1000
+		assert.NoError(t, os.MkdirAll(filepath.Dir(opts.SplitOutputByReference), 0755))
+
+		markDuplicates := &MarkDuplicates{
+			Provider: bamprovider.NewFakeProvider(header, records()),
+			Opts:     &opts,
+		}
+		_, err := markDuplicates.Mark(nil)
+		if !assert.NoError(t, err, "max files %d", test.maxFiles) {
+			continue
+		}
+
+		paths, err := filepath.Glob(filepath.Join(filepath.Dir(opts.SplitOutputByReference), "*.bam"))
+		assert.NoError(t, err)
+		assert.Len(t, paths, len(test.expected), "max files %d", test.maxFiles)
+		for name, expected := range test.expected {
+			path := strings.Replace(opts.SplitOutputByReference, "{ref}", name, -1)
+			var names []string
+			for _, r := range ReadRecords(t, path) {
+				names = append(names, r.Name[:1])
+				// B is the duplicate of A, in whichever file it is.
+				assert.Equal(t, r.Name[0] == 'B', (r.Flags&sam.Duplicate) != 0, "file %s, record %v", name, r)
+				if name != "unmapped" && name != "other" {
+					assert.Equal(t, name, r.Ref.Name(), "file %s, record %v", name, r)
+				}
+			}
+			assert.Equal(t, expected, strings.Join(names, ""), "max files %d, file %s", test.maxFiles, name)
+			// Each file is indexed like the output.
+			_, err := os.Stat(path + ".bai")
+			assert.NoError(t, err, "max files %d, file %s", test.maxFiles, name)
+		}
+	}
+}
@@ -0,0 +1,241 @@
+// Copyright 2019 Grail Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package markduplicates
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/Schaudge/grailbase/errors"
+	"github.com/Schaudge/grailbase/file"
+	"github.com/Schaudge/grailbase/vcontext"
+	"github.com/Schaudge/grailbio/encoding/bamprovider"
+	"github.com/Schaudge/hts/bam"
+	"github.com/Schaudge/hts/sam"
+)
+
+// The input and output paths may be "-" for stdin and stdout, so that
+// Mark can run in a pipeline such as "bwa mem ... | samtools sort |
+// doppelmark | samtools view -C". Logs are always written to stderr.
+// stdin can only be read once, from start to end, so:
+//
+//   - Queryname grouped input is marked as it is read, see
+//     markQueryname.
+//   - Coordinate sorted input is copied to an indexed BAM file in
+//     Opts.ScratchDir first, because the shards are read more than
+//     once and at random positions. The copy is removed when Mark is
+//     done.
+//
+// The output to stdout must be BAM.
+
+// stdioPath is the path of stdin as the input, and of stdout as the
+// output.
+const stdioPath = "-"
+
+// isStdin returns true if the input path is stdin.
+func isStdin(path string) bool {
+	return path == stdioPath || path == "/dev/stdin"
+}
+
+// isStdout returns true if the output path is stdout, including the
+// empty path.
+func isStdout(path string) bool {
+	return path == "" || path == stdioPath || path == "/dev/stdout"
+}
+
+// recordIterator is the part of bamprovider.Iterator that
+// markQueryname uses, so that it can also read a bamStream.
+type recordIterator interface {
+	Scan() bool
+	Record() *sam.Record
+	Close() error
+}
+
+// bamStream reads the records of a BAM stream once, in order.
+type bamStream struct {
+	reader *bam.Reader
+	// in is the file of the stream, if it is read from a file.
+	in     file.File
+	record *sam.Record
+	err    error
+}
+
+// Scan reads the next record, and returns false at the end of the
+// stream or on error.
+func (s *bamStream) Scan() bool {
+	r, err := s.reader.Read()
+	if err != nil {
+		if err != io.EOF {
+			s.err = err
+		}
+		return false
+	}
+	s.record = r
+	return true
+}
+
+// Record returns the last record read by Scan.
+func (s *bamStream) Record() *sam.Record {
+	return s.record
+}
+
+// Close returns the error of Scan, if any.
+func (s *bamStream) Close() error {
+	if err := s.reader.Close(); err != nil && s.err == nil {
+		s.err = err
+	}
+	if s.in != nil {
+		if err := s.in.Close(vcontext.Background()); err != nil && s.err == nil {
+			s.err = err
+		}
+	}
+	return s.err
+}
+
+// querynameInput returns the records of the queryname grouped input in
+// file order. The iterators of a provider require coordinate sorted
+// records, so the input is read as a BAM stream: m.stream, or the file
+// of a BAMProvider.
+func (m *MarkDuplicates) querynameInput(ctx context.Context) (recordIterator, error) {
+	if m.stream != nil {
+		return m.stream, nil
+	}
+	provider, ok := m.Provider.(*bamprovider.BAMProvider)
+	if !ok {
+		return nil, fmt.Errorf("queryname grouped input must be read from a bam file or stream")
+	}
+	in, err := file.Open(ctx, provider.Path)
+	if err != nil {
+		return nil, err
+	}
+	reader, err := bam.NewReader(in.Reader(ctx), 1)
+	if err != nil {
+		in.Close(ctx) // nolint: errcheck
+		return nil, errors.E(err, "couldn't read", provider.Path)
+	}
+	return &bamStream{reader: reader, in: in}, nil
+}
+
+// getHeader returns the header of the input.
+func (m *MarkDuplicates) getHeader() (*sam.Header, error) {
+	if m.stream != nil {
+		return m.stream.reader.Header(), nil
+	}
+	return m.Provider.GetHeader()
+}
+
+// openStdin prepares to read the input from stdin. Queryname grouped
+// input is streamed, and coordinate sorted input is copied to an
+// indexed BAM file, which cleanup removes.
+func (m *MarkDuplicates) openStdin() (cleanup func(), err error) {
+	return m.openStream(os.Stdin, false)
+}
+
+// openStream prepares to read the input from the BAM stream in, like
+// openStdin, but if inMemory is true, coordinate sorted input is read
+// into memory instead of being copied to a file.
+func (m *MarkDuplicates) openStream(in io.Reader, inMemory bool) (cleanup func(), err error) {
+	reader, err := bam.NewReader(in, 1)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't read bam input: %v", err)
+	}
+	order, err := inputOrder(m.Opts, reader.Header())
+	if err != nil {
+		return nil, err
+	}
+	if order == inputOrderQueryname {
+		m.stream = &bamStream{reader: reader}
+		return func() {}, nil
+	}
+	if inMemory {
+		var records []*sam.Record
+		stream := &bamStream{reader: reader}
+		for stream.Scan() {
+			records = append(records, stream.Record())
+		}
+		if err := stream.Close(); err != nil {
+			return nil, fmt.Errorf("couldn't read bam input: %v", err)
+		}
+		m.Provider = bamprovider.NewFakeProvider(reader.Header(), records)
+		return func() {}, nil
+	}
+
+	dir, err := ioutil.TempDir(m.Opts.ScratchDir, "stdin")
+	if err != nil {
+		return nil, err
+	}
+	path := filepath.Join(dir, "input.bam")
+	ioLog.Printf("copying coordinate sorted input from stdin to %s", path)
+	if err := writeIndexedBAM(reader.Header(), &bamStream{reader: reader}, path); err != nil {
+		os.RemoveAll(dir) // nolint: errcheck
+		return nil, err
+	}
+	m.Provider = bamprovider.NewProvider(path, bamprovider.ProviderOpts{Index: path + ".bai"})
+	return func() {
+		if err := os.RemoveAll(dir); err != nil {
+			ioLog.Errorf("couldn't remove %s: %v", dir, err)
+		}
+	}, nil
+}
+
+// writeIndexedBAM writes the records of iter, which must be coordinate
+// sorted, to the BAM file path with header, and writes its index to
+// path.bai.
+func writeIndexedBAM(header *sam.Header, iter recordIterator, path string) error {
+	out, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	writer, err := bam.NewWriter(out, header, 1)
+	if err != nil {
+		return err
+	}
+	for iter.Scan() {
+		if err := writer.Write(iter.Record()); err != nil {
+			return err
+		}
+	}
+	if err := iter.Close(); err != nil {
+		return fmt.Errorf("couldn't read the input: %v", err)
+	}
+	if err := writer.Close(); err != nil {
+		return err
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+
+	in, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer in.Close() // nolint: errcheck
+	index, err := indexBAM(in, indexFormatBAI, header)
+	if err != nil {
+		return fmt.Errorf("couldn't index the input: %v", err)
+	}
+	indexOut, err := os.Create(path + ".bai")
+	if err != nil {
+		return err
+	}
+	if err := index.write(indexOut); err != nil {
+		indexOut.Close() // nolint: errcheck
+		return err
+	}
+	return indexOut.Close()
+}
@@ -0,0 +1,96 @@
+// Copyright 2019 Grail Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package markduplicates
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/Schaudge/hts/bam"
+	"github.com/Schaudge/hts/sam"
+	"github.com/grailbio/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+// writeTestBAM writes records to the BAM file path.
+func writeTestBAM(t *testing.T, path string, header *sam.Header, records []*sam.Record) {
+	out, err := os.Create(path)
+	assert.NoError(t, err)
+	writer, err := bam.NewWriter(out, header, 1)
+	assert.NoError(t, err)
+	for _, r := range records {
+		assert.NoError(t, writer.Write(r))
+	}
+	assert.NoError(t, writer.Close())
+	assert.NoError(t, out.Close())
+}
+
+func TestStdin(t *testing.T) {
+	// B is a duplicate of A.
+	coordinate := []*sam.Record{
+		NewRecord("A:::1:10:1:1", chr1, 0, r1F, 50, chr1, cigar0),
+		NewRecord("B:::1:10:1:1", chr1, 0, r1F, 50, chr1, cigar0),
+		NewRecord("A:::1:10:1:1", chr1, 50, r2R, 0, chr1, cigar0),
+		NewRecord("B:::1:10:1:1", chr1, 50, r2R, 0, chr1, cigar0),
+	}
+	queryname := []*sam.Record{coordinate[0], coordinate[2], coordinate[1], coordinate[3]}
+
+	tempDir, cleanup := testutil.TempDir(t, "", "")
+	defer cleanup()
+	stdin := os.Stdin
+	defer func() {
+		os.Stdin = stdin
+	}()
+	for testIdx, test := range []struct {
+		hd           string
+		records      []*sam.Record
+		expectedDups []bool
+	}{
+		// Coordinate sorted input is copied to an indexed file.
+		{"@HD\tVN:1.6\tSO:coordinate\n", coordinate, []bool{false, true, false, true}},
+		// Queryname grouped input is streamed.
+		{"@HD\tVN:1.6\tSO:queryname\n", queryname, []bool{false, false, true, true}},
+	} {
+		inputPath := filepath.Join(tempDir, "input.bam")
+		writeTestBAM(t, inputPath, querynameHeader(t, test.hd), test.records)
+		in, err := os.Open(inputPath)
+		assert.NoError(t, err)
+		os.Stdin = in
+
+		opts := defaultOpts
+		opts.BamFile = stdioPath
+		opts.OutputPath = NewTestOutput(tempDir, testIdx, "bam")
+		opts.Format = "bam"
+		opts.ScratchDir = tempDir
+		opts.MinBases = 1
+		assert.NoError(t, SetupAndMark(context.Background(), nil, &opts), "header %q", test.hd)
+		assert.NoError(t, in.Close())
+
+		actualRecords := ReadRecords(t, opts.OutputPath)
+		assert.Equal(t, len(test.records), len(actualRecords), "header %q", test.hd)
+		for i, r := range actualRecords {
+			assert.Equal(t, test.records[i].Name, r.Name, "header %q", test.hd)
+			assert.Equal(t, test.expectedDups[i], (r.Flags&sam.Duplicate) != 0, "header %q record %v", test.hd, r)
+		}
+	}
+
+	// pam cannot be written to stdout.
+	opts := defaultOpts
+	opts.BamFile = stdioPath
+	opts.OutputPath = stdioPath
+	opts.Format = "pam"
+	assert.Error(t, validate(&opts))
+}
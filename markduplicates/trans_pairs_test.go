@@ -0,0 +1,150 @@
+// Copyright 2019 Grail Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package markduplicates
+
+import (
+	"context"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	gbam "github.com/Schaudge/grailbio/encoding/bam"
+	"github.com/Schaudge/grailbio/encoding/bamprovider"
+	"github.com/Schaudge/hts/sam"
+	"github.com/grailbio/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPairKey(t *testing.T) {
+	tests := []struct {
+		name string
+		a, b *sam.Record
+		key  duplicateKey
+	}{
+		{
+			"same reference",
+			NewRecord("A:::1:10:1:1", chr1, 100, r1F, 300, chr1, cigar0),
+			NewRecord("A:::1:10:1:1", chr1, 300, r2R, 100, chr1, cigar0),
+			duplicateKey{0, 100, 0, 309, fr, 0, "", "lib"},
+		},
+		{
+			"trans",
+			NewRecord("T:::1:10:1:1", chr1, 100, r1F, 200, chr2, cigar0),
+			NewRecord("T:::1:10:1:1", chr2, 200, r2R, 100, chr1, cigar0),
+			duplicateKey{0, 100, 1, 209, fr, 0, "", "lib"},
+		},
+		{
+			// The read on the lower reference is on the left, even
+			// with the higher position.
+			"trans, higher position on the lower reference",
+			NewRecord("T:::1:10:1:1", chr1, 500, r1F, 50, chr2, cigar0),
+			NewRecord("T:::1:10:1:1", chr2, 50, r2R, 500, chr1, cigar0),
+			duplicateKey{0, 500, 1, 59, fr, 0, "", "lib"},
+		},
+		{
+			"trans, read 1 on the higher reference",
+			NewRecord("T:::1:10:1:1", chr2, 200, r1R, 100, chr1, cigar0),
+			NewRecord("T:::1:10:1:1", chr1, 100, r2F, 200, chr2, cigar0),
+			duplicateKey{0, 100, 1, 209, fr, 0, "", "lib"},
+		},
+	}
+	for _, test := range tests {
+		for _, reads := range [][2]*sam.Record{{test.a, test.b}, {test.b, test.a}} {
+			left, right := orderPair(IndexedSingle{reads[0], 1}, IndexedSingle{reads[1], 2})
+			assert.Equal(t, test.key, pairKey(left.R, right.R, 0, "", "lib"),
+				"test %s, first read %v", test.name, reads[0])
+		}
+	}
+}
+
+// Test that trans readpairs, mated through the distant mate table,
+// are duplicates of the readpairs with both reads at the same
+// positions, whichever of their reads is read 1.
+func TestTransPairs(t *testing.T) {
+	// A, B, C and D support the same translocation, from chr1:100 to
+	// chr2:200, with read 1 of D on chr2. E has its chr2 read at
+	// another position. F and G have their chr2 read at a lower
+	// position than their chr1 read. The readpairs are on different
+	// tiles, so none are optical duplicates.
+	records := []*sam.Record{
+		NewRecord("A:::1:10:1:1", chr1, 100, r1F, 200, chr2, cigar0),
+		NewRecord("B:::1:20:1:1", chr1, 100, r1F, 200, chr2, cigar0),
+		NewRecord("C:::1:30:1:1", chr1, 100, r1F, 200, chr2, cigar0),
+		NewRecord("D:::1:40:1:1", chr1, 100, r2F, 200, chr2, cigar0),
+		NewRecord("E:::1:50:1:1", chr1, 100, r1F, 300, chr2, cigar0),
+		NewRecord("F:::1:60:1:1", chr1, 500, r1F, 50, chr2, cigar0),
+		NewRecord("G:::1:70:1:1", chr1, 500, r1F, 50, chr2, cigar0),
+		NewRecord("F:::1:60:1:1", chr2, 50, r2R, 500, chr1, cigar0),
+		NewRecord("G:::1:70:1:1", chr2, 50, r2R, 500, chr1, cigar0),
+		NewRecord("A:::1:10:1:1", chr2, 200, r2R, 100, chr1, cigar0),
+		NewRecord("B:::1:20:1:1", chr2, 200, r2R, 100, chr1, cigar0),
+		NewRecord("C:::1:30:1:1", chr2, 200, r2R, 100, chr1, cigar0),
+		NewRecord("D:::1:40:1:1", chr2, 200, r1R, 100, chr1, cigar0),
+		NewRecord("E:::1:50:1:1", chr2, 300, r2R, 100, chr1, cigar0),
+	}
+	sets := [][]string{{"A", "B", "C", "D"}, {"E"}, {"F", "G"}}
+
+	tempDir, cleanup := testutil.TempDir(t, "", "")
+	defer cleanup()
+	for testIdx, format := range []string{"bam", "pam"} {
+		opts := defaultOpts
+		opts.OutputPath = NewTestOutput(tempDir, testIdx, format)
+		opts.Format = format
+		opts.MetricsFile = filepath.Join(tempDir, format+".metrics.txt")
+
+		markDuplicates := &MarkDuplicates{
+			Provider: bamprovider.NewFakeProvider(header, records),
+			Opts:     &opts,
+		}
+		// The fake provider has a single shard, without distant mates.
+		shards, err := gbam.GetPositionBasedShards(header, opts.ShardSize, opts.Padding, true)
+		assert.NoError(t, err)
+		actualMetrics, err := markDuplicates.Mark(shards)
+		if !assert.NoError(t, err, "format %s", format) {
+			continue
+		}
+
+		// Both reads of a readpair have the same flag, and each set
+		// has one representative.
+		duplicates := map[string]bool{}
+		for _, r := range ReadRecords(t, opts.OutputPath) {
+			duplicate := r.Flags&sam.Duplicate != 0
+			if previous, ok := duplicates[r.Name[:1]]; ok {
+				assert.Equal(t, previous, duplicate, "format %s, record %v", format, r)
+			}
+			duplicates[r.Name[:1]] = duplicate
+		}
+		for _, set := range sets {
+			representatives := 0
+			for _, name := range set {
+				if !duplicates[name] {
+					representatives++
+				}
+			}
+			assert.Equal(t, 1, representatives, "format %s, set %v", format, set)
+		}
+
+		assert.Equal(t, int64(7), actualMetrics.DistantMateTransPairs, "format %s", format)
+		assert.Equal(t, InsertSizeCounts{4, 0, 3}, actualMetrics.TransInsertSizes, "format %s", format)
+		doc := newJSONMetricsDocument(&opts, actualMetrics)
+		assert.Equal(t, int64(7), doc.Global.TransPairsExamined, "format %s", format)
+		assert.Equal(t, int64(4), doc.Global.TransPairDuplicates, "format %s", format)
+		if assert.NoError(t, WriteMetrics(context.Background(), &opts, actualMetrics), "format %s", format) {
+			contents, err := ioutil.ReadFile(opts.MetricsFile)
+			assert.NoError(t, err, "format %s", format)
+			assert.Contains(t, string(contents), "# trans readpairs: 7 examined, 4 duplicates\n",
+				"format %s", format)
+		}
+	}
+}
@@ -0,0 +1,202 @@
+// Copyright 2019 Grail Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package markduplicates
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	"github.com/Schaudge/grailbase/errors"
+	"github.com/Schaudge/grailbase/file"
+)
+
+// Values of Opts.UMIUnmatchedPolicy.
+const (
+	umiUnmatchedRaw  = "raw"
+	umiUnmatchedDrop = "drop"
+)
+
+// umiMatch is how a UMI matched the UMI allowlist.
+type umiMatch int
+
+const (
+	// umiMatchExact is a UMI in the allowlist.
+	umiMatchExact umiMatch = iota
+	// umiMatchCorrected is a UMI at Hamming distance 1 from exactly
+	// one allowlist UMI.
+	umiMatchCorrected
+	// umiMatchAmbiguous is a UMI at Hamming distance 1 from more than
+	// one allowlist UMI.
+	umiMatchAmbiguous
+	// umiMatchUnmatched is a UMI that is not within Hamming distance
+	// 1 of any allowlist UMI.
+	umiMatchUnmatched
+)
+
+// umiAllowlist corrects UMIs to a fixed set of UMIs.
+type umiAllowlist struct {
+	umis map[string]bool
+	// neighbors maps each UMI at Hamming distance 1 from an
+	// allowlist UMI to that UMI, or to "" if it is at distance 1 from
+	// several allowlist UMIs.
+	neighbors map[string]string
+}
+
+// readUMIAllowlist reads the UMI allowlist file at path.
+func readUMIAllowlist(ctx context.Context, path string) (umis []string, err error) {
+	in, err := file.Open(ctx, path)
+	if err != nil {
+		return nil, errors.E(err, "couldn't open umi allowlist:", path)
+	}
+	defer func() {
+		if err2 := in.Close(ctx); err == nil && err2 != nil {
+			err = err2
+		}
+	}()
+	data, err := ioutil.ReadAll(in.Reader(ctx))
+	if err != nil {
+		return nil, errors.E(err, "couldn't read umi allowlist:", path)
+	}
+	umis, err = parseUMIAllowlist(data)
+	if err != nil {
+		return nil, errors.E(err, "invalid umi allowlist:", path)
+	}
+	return umis, nil
+}
+
+// parseUMIAllowlist returns the UMIs in data, one per line. Empty
+// lines are ignored, and the UMIs are uppercased. It returns an error
+// if the allowlist is invalid, see checkUMIAllowlist.
+func parseUMIAllowlist(data []byte) ([]string, error) {
+	var umis []string
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line != "" {
+			umis = append(umis, strings.ToUpper(line))
+		}
+	}
+	if err := checkUMIAllowlist(umis); err != nil {
+		return nil, err
+	}
+	return umis, nil
+}
+
+// checkUMIAllowlist returns an error if umis is empty, or has
+// duplicate UMIs, UMIs of different lengths, or UMIs with bases other
+// than A, C, G and T.
+func checkUMIAllowlist(umis []string) error {
+	if len(umis) == 0 {
+		return fmt.Errorf("umi allowlist is empty")
+	}
+	seen := make(map[string]bool, len(umis))
+	for i, umi := range umis {
+		if strings.Trim(umi, "ACGT") != "" {
+			return fmt.Errorf("umi allowlist entry %d (%s) has bases other than A, C, G and T", i+1, umi)
+		}
+		if len(umi) != len(umis[0]) {
+			return fmt.Errorf("umi allowlist entry %d (%s) has length %d, but entry 1 (%s) has length %d",
+				i+1, umi, len(umi), umis[0], len(umis[0]))
+		}
+		if seen[umi] {
+			return fmt.Errorf("umi allowlist has duplicate entry %s", umi)
+		}
+		seen[umi] = true
+	}
+	return nil
+}
+
+// newUMIAllowlist returns an umiAllowlist of umis, which must be valid
+// according to checkUMIAllowlist.
+func newUMIAllowlist(umis []string) *umiAllowlist {
+	a := &umiAllowlist{
+		umis:      make(map[string]bool, len(umis)),
+		neighbors: make(map[string]string),
+	}
+	for _, umi := range umis {
+		a.umis[umi] = true
+	}
+	for _, umi := range umis {
+		neighbor := []byte(umi)
+		for i := range neighbor {
+			for _, base := range []byte("ACGTN") {
+				if base == umi[i] {
+					continue
+				}
+				neighbor[i] = base
+				key := string(neighbor)
+				if other, found := a.neighbors[key]; found && other != umi {
+					a.neighbors[key] = ""
+				} else {
+					a.neighbors[key] = umi
+				}
+			}
+			neighbor[i] = umi[i]
+		}
+	}
+	return a
+}
+
+// match returns the allowlist UMI of umi, and how umi matched it. The
+// returned UMI is umi itself if it is ambiguous or unmatched.
+func (a *umiAllowlist) match(umi string) (string, umiMatch) {
+	if a.umis[umi] {
+		return umi, umiMatchExact
+	}
+	corrected, found := a.neighbors[umi]
+	if !found {
+		return umi, umiMatchUnmatched
+	}
+	if corrected == "" {
+		return umi, umiMatchAmbiguous
+	}
+	return corrected, umiMatchCorrected
+}
+
+// correct returns the allowlist UMIs of the non-empty UMIs in umis.
+// With opts.UMIUnmatchedPolicy "drop", found is false if a UMI is
+// ambiguous or unmatched, so that its entry is grouped like entries
+// without UMIs. Otherwise those UMIs are kept as they are.
+func (a *umiAllowlist) correct(opts *Opts, umis ...string) (corrected []string, found bool) {
+	corrected = make([]string, len(umis))
+	for i, umi := range umis {
+		if umi == "" {
+			continue
+		}
+		var m umiMatch
+		corrected[i], m = a.match(umi)
+		if (m == umiMatchAmbiguous || m == umiMatchUnmatched) && opts.UMIUnmatchedPolicy == umiUnmatchedDrop {
+			return nil, false
+		}
+	}
+	return corrected, true
+}
+
+// count counts umi, the UMI of a read, in the allowlist metrics of mc.
+func (a *umiAllowlist) count(mc *MetricsCollection, umi string) {
+	if umi == "" {
+		return
+	}
+	switch _, m := a.match(umi); m {
+	case umiMatchExact:
+		mc.UMIAllowlistExact++
+	case umiMatchCorrected:
+		mc.UMIAllowlistCorrected++
+	case umiMatchAmbiguous:
+		mc.UMIAllowlistAmbiguous++
+	case umiMatchUnmatched:
+		mc.UMIAllowlistUnmatched++
+	}
+}
@@ -0,0 +1,150 @@
+// Copyright 2019 Grail Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package markduplicates
+
+import (
+	"testing"
+
+	"github.com/Schaudge/grailbio/encoding/bamprovider"
+	"github.com/Schaudge/hts/sam"
+	"github.com/grailbio/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseUMIAllowlist(t *testing.T) {
+	tests := []struct {
+		data     string
+		expected []string
+		err      string
+	}{
+		{"AAC\nCCG\n\ngtt\n", []string{"AAC", "CCG", "GTT"}, ""},
+		{"AAC\r\nCCG\r\n", []string{"AAC", "CCG"}, ""},
+		{"", nil, "umi allowlist is empty"},
+		{"AAC\nCCG\nAAC\n", nil, "duplicate entry AAC"},
+		{"AAC\nCCGT\n", nil, "entry 2 (CCGT) has length 4, but entry 1 (AAC) has length 3"},
+		{"AAC\nCNG\n", nil, "entry 2 (CNG) has bases other than A, C, G and T"},
+	}
+	for _, test := range tests {
+		umis, err := parseUMIAllowlist([]byte(test.data))
+		if test.err != "" {
+			assert.Error(t, err, "data %q", test.data)
+			if err != nil {
+				assert.Contains(t, err.Error(), test.err, "data %q", test.data)
+			}
+			continue
+		}
+		assert.NoError(t, err, "data %q", test.data)
+		assert.Equal(t, test.expected, umis, "data %q", test.data)
+	}
+}
+
+func TestUMIAllowlistMatch(t *testing.T) {
+	allowlist := newUMIAllowlist([]string{"AAAA", "AAAT", "CCCC"})
+	tests := []struct {
+		umi       string
+		corrected string
+		match     umiMatch
+	}{
+		{"AAAA", "AAAA", umiMatchExact},
+		{"AAAT", "AAAT", umiMatchExact},
+		{"CCCA", "CCCC", umiMatchCorrected},
+		{"CCNC", "CCCC", umiMatchCorrected},
+		// AAAC and AAAN are at distance 1 from both AAAA and AAAT.
+		{"AAAC", "AAAC", umiMatchAmbiguous},
+		{"AAAN", "AAAN", umiMatchAmbiguous},
+		{"GGGG", "GGGG", umiMatchUnmatched},
+		{"CCC", "CCC", umiMatchUnmatched},
+	}
+	for _, test := range tests {
+		corrected, match := allowlist.match(test.umi)
+		assert.Equal(t, test.corrected, corrected, "umi %s", test.umi)
+		assert.Equal(t, test.match, match, "umi %s", test.umi)
+	}
+}
+
+// umiAllowlistRecords returns readpairs with an allowlist UMI (A), a
+// UMI that is corrected to A's (B), an unmatched UMI (C), and no UMI
+// (D).
+func umiAllowlistRecords() []*sam.Record {
+	return []*sam.Record{
+		NewRecordAux("A:::1:10:1:1", chr1, 0, r1F, 10, chr1, cigar0, NewAux("RX", "AAA")),
+		NewRecordAux("B:::1:10:1:1", chr1, 0, r1F, 10, chr1, cigar0, NewAux("RX", "AAT")),
+		NewRecordAux("C:::1:10:1:1", chr1, 0, r1F, 10, chr1, cigar0, NewAux("RX", "TTT")),
+		NewRecord("D:::1:10:1:1", chr1, 0, r1F, 10, chr1, cigar0),
+		NewRecordAux("A:::1:10:1:1", chr1, 10, r2R, 0, chr1, cigar0, NewAux("RX", "AAA")),
+		NewRecordAux("B:::1:10:1:1", chr1, 10, r2R, 0, chr1, cigar0, NewAux("RX", "AAT")),
+		NewRecordAux("C:::1:10:1:1", chr1, 10, r2R, 0, chr1, cigar0, NewAux("RX", "TTT")),
+		NewRecord("D:::1:10:1:1", chr1, 10, r2R, 0, chr1, cigar0),
+	}
+}
+
+func TestUmiAllowlist(t *testing.T) {
+	raw := defaultOpts
+	raw.UMITag = "RX"
+	raw.UMIAllowlist = []string{"AAA", "CCC", "GGG"}
+	drop := raw
+	drop.UMIUnmatchedPolicy = umiUnmatchedDrop
+
+	// B is a duplicate of A after correction. With the "raw" policy,
+	// C is grouped by its own UMI. With "drop", it is grouped with D,
+	// which has no UMI.
+	for _, test := range []struct {
+		opts Opts
+		dups []bool
+	}{
+		{raw, []bool{false, true, false, false, false, true, false, false}},
+		{drop, []bool{false, true, false, true, false, true, false, true}},
+	} {
+		var trecords []TestRecord
+		for i, r := range umiAllowlistRecords() {
+			trecords = append(trecords, TestRecord{R: r, DupFlag: test.dups[i]})
+		}
+		RunTestCases(t, header, []TestCase{{trecords, test.opts}})
+	}
+}
+
+func TestUmiAllowlistMetrics(t *testing.T) {
+	tempDir, cleanup := testutil.TempDir(t, "", "")
+	defer cleanup()
+	for testIdx, format := range []string{"bam", "pam"} {
+		opts := defaultOpts
+		opts.OutputPath = NewTestOutput(tempDir, testIdx, format)
+		opts.Format = format
+		opts.UMITag = "RX"
+		opts.UMIAllowlist = []string{"AAA", "CCC", "GGG"}
+
+		markDuplicates := &MarkDuplicates{
+			Provider: bamprovider.NewFakeProvider(header, umiAllowlistRecords()),
+			Opts:     &opts,
+		}
+		actualMetrics, err := markDuplicates.Mark(nil)
+		assert.NoError(t, err)
+		assert.Equal(t, int64(2), actualMetrics.UMIAllowlistExact, "format %s", format)
+		assert.Equal(t, int64(2), actualMetrics.UMIAllowlistCorrected, "format %s", format)
+		assert.Equal(t, int64(0), actualMetrics.UMIAllowlistAmbiguous, "format %s", format)
+		assert.Equal(t, int64(2), actualMetrics.UMIAllowlistUnmatched, "format %s", format)
+		assert.Equal(t, int64(2), actualMetrics.UMICorrectedReads, "format %s", format)
+	}
+
+	// An invalid allowlist is an error.
+	opts := defaultOpts
+	opts.UMITag = "RX"
+	opts.UMIAllowlist = []string{"AAA", "CC"}
+	markDuplicates := &MarkDuplicates{
+		Provider: bamprovider.NewFakeProvider(header, umiAllowlistRecords()),
+		Opts:     &opts,
+	}
+	_, err := markDuplicates.Mark(nil)
+	assert.Error(t, err)
+}
@@ -0,0 +1,105 @@
+// Copyright 2019 Grail Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package markduplicates
+
+import (
+	"sort"
+)
+
+// Values of Opts.UMICorrection.
+const (
+	umiCorrectionNone        = "none"
+	umiCorrectionCluster     = "cluster"
+	umiCorrectionDirectional = "directional"
+)
+
+// umiHamming returns the number of mismatches between the UMIs of a
+// and b, or -1 if their UMIs have different lengths.
+func umiHamming(a, b *umiKey) int {
+	if len(a.leftUmi) != len(b.leftUmi) || len(a.rightUmi) != len(b.rightUmi) {
+		return -1
+	}
+	dist := 0
+	for i := 0; i < len(a.leftUmi); i++ {
+		if a.leftUmi[i] != b.leftUmi[i] {
+			dist++
+		}
+	}
+	for i := 0; i < len(a.rightUmi); i++ {
+		if a.rightUmi[i] != b.rightUmi[i] {
+			dist++
+		}
+	}
+	return dist
+}
+
+// clusterUmis merges the entries of the keys in positionKeys, which
+// are all at the same position, into clusters of UMIs that are
+// probably sequencing errors of each other, like umi_tools. The
+// entries of each cluster are moved to the key of its most frequent
+// UMI in umiToGroup.
+//
+// Starting from the most frequent UMI that is not in a cluster yet, a
+// cluster grows by adding the UMIs at Hamming distance 1 from a UMI in
+// the cluster. With method umiCorrectionDirectional, a UMI with count
+// n is only added from a UMI with count at least 2n-1, so that two
+// frequent UMIs are kept apart. With umiCorrectionCluster, every UMI
+// at distance 1 is added. Keys whose entries are not grouped, because
+// a UMI contains N or is missing, are not clustered.
+func clusterUmis(method string, positionKeys map[umiKey]bool, umiToGroup map[umiKey][]DuplicateEntry) {
+	keys := make([]umiKey, 0, len(positionKeys))
+	for k := range positionKeys {
+		if _, ok := umiToGroup[k]; ok && !k.isSplit() {
+			keys = append(keys, k)
+		}
+	}
+	if len(keys) < 2 {
+		return
+	}
+	count := make(map[umiKey]int, len(keys))
+	for _, k := range keys {
+		count[k] = len(umiToGroup[k])
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if count[keys[i]] != count[keys[j]] {
+			return count[keys[i]] > count[keys[j]]
+		}
+		return keys[i].less(&keys[j])
+	})
+
+	clustered := make(map[umiKey]bool, len(keys))
+	for _, root := range keys {
+		if clustered[root] {
+			continue
+		}
+		clustered[root] = true
+		queue := []umiKey{root}
+		for len(queue) > 0 {
+			cur := queue[0]
+			queue = queue[1:]
+			for _, other := range keys {
+				if clustered[other] || umiHamming(&cur, &other) != 1 {
+					continue
+				}
+				if method == umiCorrectionDirectional && count[cur] < 2*count[other]-1 {
+					continue
+				}
+				clustered[other] = true
+				queue = append(queue, other)
+				umiToGroup[root] = append(umiToGroup[root], umiToGroup[other]...)
+				delete(umiToGroup, other)
+			}
+		}
+	}
+}
@@ -0,0 +1,113 @@
+// Copyright 2019 Grail Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package markduplicates
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/Schaudge/grailbio/encoding/bamprovider"
+	"github.com/Schaudge/hts/sam"
+	"github.com/grailbio/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUmiHamming(t *testing.T) {
+	key := func(left, right string) *umiKey {
+		return &umiKey{leftUmi: left, rightUmi: right}
+	}
+	assert.Equal(t, 0, umiHamming(key("AAAA", "CC"), key("AAAA", "CC")))
+	assert.Equal(t, 1, umiHamming(key("AAAA", "CC"), key("AAAT", "CC")))
+	assert.Equal(t, 2, umiHamming(key("AAAA", "CC"), key("AAAT", "CG")))
+	assert.Equal(t, -1, umiHamming(key("AAAA", "CC"), key("AAA", "CC")))
+	assert.Equal(t, -1, umiHamming(key("AAAA", ""), key("", "AAAA")))
+}
+
+func TestUmiCorrection(t *testing.T) {
+	// 100 readpairs at the same position. AAAA is dominant, and AAAT,
+	// AACA, and CAAA are 1-error satellites of it. CCCC and CCCA are
+	// at distance 1 from each other with equal counts, and GGGG is
+	// far from every other UMI. The UMIs are those of R1, and every R2
+	// has the UMI TTTT, so that the UMIs of a satellite differ in one
+	// base.
+	umiCounts := []struct {
+		umi   string
+		count int
+	}{
+		{"AAAA", 80},
+		{"AAAT", 4},
+		{"AACA", 3},
+		{"CAAA", 2},
+		{"CCCC", 5},
+		{"CCCA", 5},
+		{"GGGG", 1},
+	}
+	var r1s, r2s []*sam.Record
+	for _, c := range umiCounts {
+		for i := 0; i < c.count; i++ {
+			name := fmt.Sprintf("%s%02d:::1:10:%d:1", c.umi, i, 100*len(r1s))
+			umis := c.umi + "-TTTT"
+			r1s = append(r1s, NewRecordAux(name, chr1, 0, r1F, 10, chr1, cigar0, NewAux("RX", umis)))
+			r2s = append(r2s, NewRecordAux(name, chr1, 10, r2R, 0, chr1, cigar0, NewAux("RX", umis)))
+		}
+	}
+	assert.Equal(t, 100, len(r1s))
+	records := append(r1s, r2s...)
+
+	tempDir, cleanup := testutil.TempDir(t, "", "")
+	defer cleanup()
+	testIdx := 0
+	for _, test := range []struct {
+		correction string
+		molecules  int
+	}{
+		{"", 7},
+		{umiCorrectionNone, 7},
+		// The satellites merge into AAAA, but CCCC and CCCA stay apart.
+		{umiCorrectionDirectional, 4},
+		// Every UMI at distance 1 merges.
+		{umiCorrectionCluster, 3},
+	} {
+		for _, format := range []string{"bam", "pam"} {
+			opts := defaultOpts
+			opts.OutputPath = NewTestOutput(tempDir, testIdx, format)
+			opts.Format = format
+			opts.UMITag = "RX"
+			opts.UMICorrection = test.correction
+			testIdx++
+
+			markDuplicates := &MarkDuplicates{
+				Provider: bamprovider.NewFakeProvider(header, records),
+				Opts:     &opts,
+			}
+			actualMetrics, err := markDuplicates.Mark(nil)
+			assert.NoError(t, err)
+			lib := actualMetrics.Get("Unknown Library")
+			assert.Equal(t, 2*(100-test.molecules), lib.ReadPairDups,
+				"correction %s format %s", test.correction, format)
+			assert.Equal(t, int64(test.molecules-1), actualMetrics.UMIRescuedPairs,
+				"correction %s format %s", test.correction, format)
+
+			// Every non-duplicate readpair is the primary of a
+			// molecule.
+			molecules := 0
+			for _, r := range ReadRecords(t, opts.OutputPath) {
+				if (r.Flags&sam.Read1) != 0 && (r.Flags&sam.Duplicate) == 0 {
+					molecules++
+				}
+			}
+			assert.Equal(t, test.molecules, molecules, "correction %s format %s", test.correction, format)
+		}
+	}
+}
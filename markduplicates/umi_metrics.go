@@ -0,0 +1,226 @@
+// Copyright 2019 Grail Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package markduplicates
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/Schaudge/grailbio/encoding/bam"
+)
+
+// UMIFamilySizes is a histogram of the sizes of UMI families, the
+// duplicate sets formed when grouping by UMI. The size of a family is
+// its number of templates, i.e. readpairs and mate-unmapped reads.
+type UMIFamilySizes struct {
+	// Sizes[n] is the number of families of n templates.
+	Sizes []int64
+
+	// Overflow is the number of families larger than
+	// Opts.DuplicateSetSizeMax.
+	Overflow int64
+
+	// Templates is the number of templates in all families, including
+	// the overflow families.
+	Templates int64
+}
+
+// add counts a family of the given size, in Overflow if size is larger
+// than max.
+func (h *UMIFamilySizes) add(size, max int) {
+	if max <= 0 {
+		max = defaultDuplicateSetSizeMax
+	}
+	h.Templates += int64(size)
+	if size > max {
+		h.Overflow++
+		return
+	}
+	if size >= len(h.Sizes) {
+		temp := make([]int64, size+1)
+		copy(temp, h.Sizes)
+		h.Sizes = temp
+	}
+	h.Sizes[size]++
+}
+
+// merge adds the counts in other to h.
+func (h *UMIFamilySizes) merge(other *UMIFamilySizes) {
+	if len(h.Sizes) < len(other.Sizes) {
+		temp := make([]int64, len(other.Sizes))
+		copy(temp, h.Sizes)
+		h.Sizes = temp
+	}
+	for size, count := range other.Sizes {
+		h.Sizes[size] += count
+	}
+	h.Overflow += other.Overflow
+	h.Templates += other.Templates
+}
+
+// Families returns the number of families.
+func (h *UMIFamilySizes) Families() int64 {
+	n := h.Overflow
+	for _, count := range h.Sizes {
+		n += count
+	}
+	return n
+}
+
+// Mean returns the mean family size, or 0 if there are no families.
+func (h *UMIFamilySizes) Mean() float64 {
+	families := h.Families()
+	if families == 0 {
+		return 0
+	}
+	return float64(h.Templates) / float64(families)
+}
+
+// Median returns the median family size, the lower one for an even
+// number of families. It returns false if there are no families or if
+// the median is an overflow family, whose size is not known.
+func (h *UMIFamilySizes) Median() (int, bool) {
+	half := (h.Families() + 1) / 2
+	if half == 0 {
+		return 0, false
+	}
+	var n int64
+	for size, count := range h.Sizes {
+		n += count
+		if n >= half {
+			return size, true
+		}
+	}
+	return 0, false
+}
+
+// UMIFamily returns UMIFamilySizes for the given library. If there is
+// no UMIFamilySizes for library yet, create one and return it.
+func (mc *MetricsCollection) UMIFamily(library string) *UMIFamilySizes {
+	h, found := mc.UMIFamilySizes[library]
+	if found {
+		return h
+	}
+	h = &UMIFamilySizes{}
+	mc.UMIFamilySizes[library] = h
+	return h
+}
+
+// TotalUMIFamilySizes returns the sum of the per-library UMI family
+// size histograms.
+func (mc *MetricsCollection) TotalUMIFamilySizes() UMIFamilySizes {
+	var total UMIFamilySizes
+	for _, h := range mc.UMIFamilySizes {
+		total.merge(h)
+	}
+	return total
+}
+
+// addUMIFamily counts dupSet in the UMI family size histogram of the
+// library of its primary, if the primary's left read is in shard.
+func (mc *MetricsCollection) addUMIFamily(opts *Opts, shard *bam.Shard, readGroups *readGroupTable,
+	dupSet *duplicateSet, singlesByName map[string]*readPair, pairsByName map[string]*readPair) {
+	var primary *readPair
+	if len(dupSet.pairs) > 0 {
+		primary = pairsByName[dupSet.pairs[0]]
+	} else if len(dupSet.singles) > 0 {
+		primary = singlesByName[dupSet.singles[0]]
+	}
+	if primary == nil || !primary.countedIn(shard) {
+		return
+	}
+	library := readGroups.get(primary.left).library
+	mc.UMIFamily(library).add(len(dupSet.pairs)+len(dupSet.singles), opts.DuplicateSetSizeMax)
+}
+
+// UMICorrectedFraction returns the fraction of the reads with UMIs
+// whose UMIs were corrected.
+func (mc *MetricsCollection) UMICorrectedFraction() float64 {
+	var reads int64
+	for _, n := range mc.UMIReads {
+		reads += n
+	}
+	if reads == 0 {
+		return 0
+	}
+	return float64(mc.UMICorrectedReads) / float64(reads)
+}
+
+// medianString returns the median of h, or ">max" if it is an
+// overflow family, or "NA" if there are no families.
+func medianString(opts *Opts, h *UMIFamilySizes) string {
+	if median, ok := h.Median(); ok {
+		return fmt.Sprintf("%d", median)
+	}
+	if h.Families() == 0 {
+		return "NA"
+	}
+	max := opts.DuplicateSetSizeMax
+	if max <= 0 {
+		max = defaultDuplicateSetSizeMax
+	}
+	return fmt.Sprintf(">%d", max)
+}
+
+// sortedUMIFamilyLibraries returns the libraries of families in
+// increasing order.
+func sortedUMIFamilyLibraries(families map[string]*UMIFamilySizes) []string {
+	libraries := make([]string, 0, len(families))
+	for library := range families {
+		libraries = append(libraries, library)
+	}
+	sort.Strings(libraries)
+	return libraries
+}
+
+// umiFamilyString returns the UMI section of the metrics file: the
+// summary of the UMIs and family sizes, followed by the family size
+// histogram of all libraries, and of each library if there are
+// several, as a tab separated table.
+func umiFamilyString(opts *Opts, globalMetrics *MetricsCollection) string {
+	total := globalMetrics.TotalUMIFamilySizes()
+	s := fmt.Sprintf("# UMI families: %d, mean size %0.6f, median size %s\n", total.Families(), total.Mean(),
+		medianString(opts, &total))
+	s += fmt.Sprintf("# distinct UMIs: %d\n", len(globalMetrics.UMIReads))
+	if opts.umiCorrectionEnabled() {
+		s += fmt.Sprintf("# reads with corrected UMIs: %d (%0.6f)\n", globalMetrics.UMICorrectedReads,
+			globalMetrics.UMICorrectedFraction())
+	}
+	if opts.UMIAllowlist != nil {
+		s += fmt.Sprintf("# reads with allowlist UMIs: %d exact, %d corrected, %d ambiguous, %d unmatched\n",
+			globalMetrics.UMIAllowlistExact, globalMetrics.UMIAllowlistCorrected,
+			globalMetrics.UMIAllowlistAmbiguous, globalMetrics.UMIAllowlistUnmatched)
+	}
+
+	max := opts.DuplicateSetSizeMax
+	if max <= 0 {
+		max = defaultDuplicateSetSizeMax
+	}
+	s += "LIBRARY\tUMI_FAMILY_SIZE\tCOUNT\n"
+	addRows := func(library string, h *UMIFamilySizes) {
+		for size, count := range h.Sizes {
+			if count > 0 {
+				s += fmt.Sprintf("%s\t%d\t%d\n", library, size, count)
+			}
+		}
+		s += fmt.Sprintf("%s\t>%d\t%d\n", library, max, h.Overflow)
+	}
+	addRows("ALL", &total)
+	if len(globalMetrics.UMIFamilySizes) > 1 {
+		for _, library := range sortedUMIFamilyLibraries(globalMetrics.UMIFamilySizes) {
+			addRows(library, globalMetrics.UMIFamilySizes[library])
+		}
+	}
+	return s
+}
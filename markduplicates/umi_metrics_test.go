@@ -0,0 +1,96 @@
+// Copyright 2019 Grail Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package markduplicates
+
+import (
+	"testing"
+
+	"github.com/Schaudge/grailbio/encoding/bamprovider"
+	"github.com/Schaudge/hts/sam"
+	"github.com/grailbio/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUMIFamilySizes(t *testing.T) {
+	opts := &Opts{DuplicateSetSizeMax: 3}
+	tests := []struct {
+		sizes    []int
+		expected UMIFamilySizes
+		mean     float64
+		median   string
+	}{
+		{nil, UMIFamilySizes{}, 0, "NA"},
+		{[]int{1, 1, 2, 5}, UMIFamilySizes{[]int64{0, 2, 1}, 1, 9}, 2.25, "1"},
+		{[]int{2, 3, 3}, UMIFamilySizes{[]int64{0, 0, 1, 2}, 0, 8}, 8.0 / 3, "3"},
+		{[]int{5, 5, 1}, UMIFamilySizes{[]int64{0, 1}, 2, 11}, 11.0 / 3, ">3"},
+	}
+	for _, test := range tests {
+		var h UMIFamilySizes
+		for _, size := range test.sizes {
+			h.add(size, opts.DuplicateSetSizeMax)
+		}
+		assert.Equal(t, test.expected, h, "sizes %v", test.sizes)
+		assert.Equal(t, int64(len(test.sizes)), h.Families(), "sizes %v", test.sizes)
+		assert.InDelta(t, test.mean, h.Mean(), 1e-9, "sizes %v", test.sizes)
+		assert.Equal(t, test.median, medianString(opts, &h), "sizes %v", test.sizes)
+	}
+}
+
+func TestUmiFamilyMetrics(t *testing.T) {
+	// A and B are a family of 2, C a family of 1, and D, E, F and G a
+	// family of 4 after G's R1 UMI TTA is corrected to TTT.
+	records := []*sam.Record{
+		NewRecordAux("A:::1:10:1:1", chr1, 0, r1F, 10, chr1, cigar0, NewAux("RX", "AAC-AAC")),
+		NewRecordAux("B:::1:10:1:1", chr1, 0, r1F, 10, chr1, cigar0, NewAux("RX", "AAC-AAC")),
+		NewRecordAux("C:::1:10:1:1", chr1, 0, r1F, 10, chr1, cigar0, NewAux("RX", "GGG-GGG")),
+		NewRecordAux("A:::1:10:1:1", chr1, 10, r2R, 0, chr1, cigar0, NewAux("RX", "AAC-AAC")),
+		NewRecordAux("B:::1:10:1:1", chr1, 10, r2R, 0, chr1, cigar0, NewAux("RX", "AAC-AAC")),
+		NewRecordAux("C:::1:10:1:1", chr1, 10, r2R, 0, chr1, cigar0, NewAux("RX", "GGG-GGG")),
+		NewRecordAux("D:::1:10:1:1", chr1, 100, r1F, 110, chr1, cigar0, NewAux("RX", "TTT-TTT")),
+		NewRecordAux("E:::1:10:1:1", chr1, 100, r1F, 110, chr1, cigar0, NewAux("RX", "TTT-TTT")),
+		NewRecordAux("F:::1:10:1:1", chr1, 100, r1F, 110, chr1, cigar0, NewAux("RX", "TTT-TTT")),
+		NewRecordAux("G:::1:10:1:1", chr1, 100, r1F, 110, chr1, cigar0, NewAux("RX", "TTA-TTT")),
+		NewRecordAux("D:::1:10:1:1", chr1, 110, r2R, 100, chr1, cigar0, NewAux("RX", "TTT-TTT")),
+		NewRecordAux("E:::1:10:1:1", chr1, 110, r2R, 100, chr1, cigar0, NewAux("RX", "TTT-TTT")),
+		NewRecordAux("F:::1:10:1:1", chr1, 110, r2R, 100, chr1, cigar0, NewAux("RX", "TTT-TTT")),
+		NewRecordAux("G:::1:10:1:1", chr1, 110, r2R, 100, chr1, cigar0, NewAux("RX", "TTA-TTT")),
+	}
+
+	tempDir, cleanup := testutil.TempDir(t, "", "")
+	defer cleanup()
+	for testIdx, format := range []string{"bam", "pam"} {
+		opts := defaultOpts
+		opts.OutputPath = NewTestOutput(tempDir, testIdx, format)
+		opts.Format = format
+		opts.UMITag = "RX"
+		opts.UMICorrection = umiCorrectionDirectional
+
+		markDuplicates := &MarkDuplicates{
+			Provider: bamprovider.NewFakeProvider(header, records),
+			Opts:     &opts,
+		}
+		actualMetrics, err := markDuplicates.Mark(nil)
+		assert.NoError(t, err)
+		total := actualMetrics.TotalUMIFamilySizes()
+		assert.Equal(t, []int64{0, 1, 1, 0, 1}, total.Sizes, "format %s", format)
+		assert.Equal(t, []string{"Unknown Library"}, sortedUMIFamilyLibraries(actualMetrics.UMIFamilySizes),
+			"format %s", format)
+		assert.Equal(t, map[string]int64{"AAC": 4, "GGG": 2, "TTT": 7, "TTA": 1}, actualMetrics.UMIReads,
+			"format %s", format)
+		assert.Equal(t, int64(2), actualMetrics.UMICorrectedReads, "format %s", format)
+		assert.InDelta(t, 2.0/14, actualMetrics.UMICorrectedFraction(), 1e-9, "format %s", format)
+		assert.Contains(t, umiFamilyString(&opts, actualMetrics),
+			"# UMI families: 3, mean size 2.333333, median size 2\n# distinct UMIs: 4\n", "format %s", format)
+	}
+}
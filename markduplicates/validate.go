@@ -14,41 +14,453 @@
 package markduplicates
 
 import (
+	"context"
 	"fmt"
+	"strings"
 
+	"github.com/Schaudge/grailbase/file"
+	"github.com/Schaudge/grailbase/log"
 	"github.com/Schaudge/grailbio/encoding/bamprovider"
 )
 
+// OptsError is the error of invalid options, with all their problems.
+type OptsError struct {
+	Problems []error
+}
+
+// Error returns the problems of e, one per line if there are several.
+func (e *OptsError) Error() string {
+	if len(e.Problems) == 1 {
+		return "invalid options: " + e.Problems[0].Error()
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "invalid options, %d problems:", len(e.Problems))
+	for _, problem := range e.Problems {
+		b.WriteString("\n  ")
+		b.WriteString(problem.Error())
+	}
+	return b.String()
+}
+
+// Unwrap returns the problems of e.
+func (e *OptsError) Unwrap() []error {
+	return e.Problems
+}
+
+// newOptsError returns an *OptsError of problems, or nil if there are
+// none.
+func newOptsError(problems []error) error {
+	if len(problems) == 0 {
+		return nil
+	}
+	return &OptsError{Problems: problems}
+}
+
+// Validate checks opts before any input is read, so that contradictory
+// options fail right away instead of hours into a run: the ranges of
+// the values, the combinations of the options, and that the input, its
+// index if it is needed, and the other files that are read exist. It
+// returns an *OptsError with all the problems, or nil. opts is not
+// modified.
+func (opts *Opts) Validate() error {
+	problems := opts.check()
+	problems = append(problems, opts.checkFiles(context.Background())...)
+	return newOptsError(problems)
+}
+
+// validate checks opts like Validate, but not the files, since the
+// input of Run and RunProvider is not a file, and sets the default
+// IndexFile.
 func validate(opts *Opts) error {
+	if err := newOptsError(opts.check()); err != nil {
+		return err
+	}
+	if opts.IndexFile == "" {
+		opts.IndexFile = opts.BamFile + ".bai"
+	}
+	return nil
+}
+
+// validTag returns true if tag is a valid name of an aux tag.
+func validTag(tag string) bool {
+	isLetter := func(c byte) bool { return (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') }
+	return len(tag) == 2 && isLetter(tag[0]) && (isLetter(tag[1]) || (tag[1] >= '0' && tag[1] <= '9'))
+}
+
+// checkFiles returns the problems of the files that opts reads.
+func (opts *Opts) checkFiles(ctx context.Context) []error {
+	type input struct{ option, path string }
+	var inputs []input
+	paths := inputPaths(opts.BamFile)
+	if !isStdin(opts.BamFile) {
+		for _, path := range paths {
+			// A PAM input is a directory of shards.
+			if bamprovider.GuessFileType(path) != bamprovider.PAM {
+				inputs = append(inputs, input{"bam", path})
+			}
+		}
+		// The index is needed to shard by reads or regions.
+		if opts.IndexFile != "" {
+			inputs = append(inputs, input{"index", opts.IndexFile})
+		} else if len(paths) == 1 && (opts.TargetReadsPerShard > 0 || opts.Regions != "") {
+			inputs = append(inputs, input{"index", paths[0] + ".bai"})
+		}
+	}
+	if strings.HasSuffix(opts.Regions, ".bed") {
+		inputs = append(inputs, input{"regions", opts.Regions})
+	}
+	for _, in := range []input{
+		{"umi-file", opts.UmiFile},
+		{"umi-allowlist", opts.UMIAllowlistFile},
+		{"library-map", opts.LibraryMapFile},
+		{"optical-distance-map", opts.OpticalDistanceMapFile},
+		{"shard-manifest-input", opts.ShardManifestInput},
+		{"metrics-regions-bed", opts.MetricsRegionsBED},
+		{"protected-regions-bed", opts.ProtectedRegionsBED},
+		{"gc-reference", opts.GCReference},
+		{"verify-against", opts.VerifyAgainst},
+	} {
+		if in.path != "" {
+			inputs = append(inputs, in)
+		}
+	}
+	if opts.GCReference != "" {
+		inputs = append(inputs, input{"gc-reference index", opts.GCReference + ".fai"})
+	}
+	var problems []error
+	for _, in := range inputs {
+		if _, err := file.Stat(ctx, in.path); err != nil {
+			problems = append(problems, fmt.Errorf("%s %s cannot be read: %v", in.option, in.path, err))
+		}
+	}
+	return problems
+}
+
+// check returns the problems of the values and combinations of opts.
+func (opts *Opts) check() []error {
+	var problems []error
+	add := func(format string, args ...interface{}) {
+		problems = append(problems, fmt.Errorf(format, args...))
+	}
+
 	if opts.BamFile == "" {
-		return fmt.Errorf("you must specify a bam file with --bam")
+		add("you must specify a bam file with --bam")
+	}
+	if isStdin(opts.BamFile) && opts.IndexFile != "" && opts.IndexFile != opts.BamFile+".bai" {
+		add("index is set, but the input is stdin, which has no index")
 	}
 	if opts.ShardSize <= 0 {
-		return fmt.Errorf("shard-size must be non-zero")
+		add("shard-size must be non-zero")
 	}
 	if opts.Padding < 0 {
-		return fmt.Errorf("padding must be non-negative")
+		add("padding must be non-negative")
 	}
-	if opts.Padding >= opts.ShardSize {
-		return fmt.Errorf("padding must be less than shard-size")
+	if opts.ShardSize > 0 && opts.Padding >= opts.ShardSize {
+		add("padding must be less than shard-size")
 	}
 	if opts.MinBases <= 0 {
-		return fmt.Errorf("min-bases should be positive")
+		add("min-bases should be positive")
 	}
-	if opts.IndexFile == "" {
-		opts.IndexFile = opts.BamFile + ".bai"
+	if opts.CompressionLevel < -1 || opts.CompressionLevel > 9 {
+		add("compression-level must be between -1 and 9: %d", opts.CompressionLevel)
+	}
+	if opts.Uncompressed && opts.CompressionLevel > 0 {
+		add("compression-level %d cannot be set for uncompressed output", opts.CompressionLevel)
+	}
+	if opts.TargetReadsPerShard < 0 {
+		add("target-reads-per-shard must be non-negative")
+	}
+	if opts.TargetReadsPerShard > 0 {
+		if bamprovider.ParseFileType(opts.Format) != bamprovider.BAM {
+			add("target-reads-per-shard requires bam output, not %s", opts.Format)
+		}
+		if isStdin(opts.BamFile) || len(inputPaths(opts.BamFile)) > 1 {
+			add("target-reads-per-shard requires a single indexed bam file")
+		}
+		if opts.Regions != "" {
+			add("target-reads-per-shard and regions cannot both be set")
+		}
+	}
+	if opts.ShardManifestInput != "" && (opts.Regions != "" || opts.TargetReadsPerShard > 0) {
+		add("shard-manifest-input cannot be set with regions or target-reads-per-shard")
+	}
+	if opts.Parallelism <= 0 {
+		add("parallelism must be positive")
+	}
+	if opts.ReadParallelism < 0 {
+		add("read-parallelism must be non-negative")
+	}
+	if opts.ComputeParallelism < 0 {
+		add("compute-parallelism must be non-negative")
+	}
+	if opts.WriteParallelism < 0 {
+		add("write-parallelism must be non-negative")
+	}
+	if opts.QueueLength <= 0 {
+		add("queue-length must be positive")
+	}
+	if opts.CoverageMax < 0 {
+		add("coverage-max must be non-negative")
+	}
+	if opts.DiskMateShards < 0 {
+		add("disk-mate-shards must be non-negative")
+	}
+	if opts.MaxDistantMateMemoryMB < 0 {
+		add("max-distant-mate-memory-mb must be non-negative")
+	}
+	if opts.MaxMemoryMB < 0 {
+		add("max-memory-mb must be non-negative")
 	}
-	if len(opts.UmiFile) > 0 && !opts.UseUmis {
-		return fmt.Errorf("umi-file is set, but use-umis is false")
+	if opts.CompressionThreads < 0 {
+		add("compression-threads must be non-negative")
 	}
-	if opts.ScavengeUmis > -1 && !opts.UseUmis {
-		return fmt.Errorf("scavenge-umis is set, but use-umis is false")
+	if opts.UMITag != "" && !validTag(opts.UMITag) {
+		add("umi-tag must be a letter and a letter or digit: %q", opts.UMITag)
 	}
-	if opts.ScavengeUmis > -1 && opts.UmiFile == "" {
-		return fmt.Errorf("scavenge-umis is set, but umi-file is empty")
+	if opts.UMISource != "" && opts.UMISource != umiSourceTag && opts.UMISource != umiSourceQname {
+		add("unknown umi-source %s", opts.UMISource)
+	}
+	switch opts.UMICorrection {
+	case "", umiCorrectionNone:
+	case umiCorrectionCluster, umiCorrectionDirectional:
+		if !opts.umiGrouping() {
+			add("umi-correction is set, but use-umis is false and there is no umi-tag or umi-source")
+		}
+	default:
+		add("unknown umi-correction %s", opts.UMICorrection)
+	}
+	if opts.RequireUMI && !opts.umiCanBeMissing() {
+		add("require-umi is set, but use-umis is true or there is no umi-tag or umi-source")
+	}
+	if opts.DuplexUMI && !opts.umiGrouping() {
+		add("duplex-umi is set, but use-umis is false and there is no umi-tag or umi-source")
+	}
+	if opts.DuplexUMI && opts.StrandSpecific {
+		add("duplex-umi and strand-specific cannot both be set")
+	}
+	switch opts.UMIUnmatchedPolicy {
+	case "", umiUnmatchedRaw, umiUnmatchedDrop:
+	default:
+		add("unknown umi-unmatched-policy %s", opts.UMIUnmatchedPolicy)
+	}
+	if opts.UMIAllowlistFile != "" && !opts.umiGrouping() {
+		add("umi-allowlist is set, but use-umis is false and there is no umi-tag or umi-source")
+	}
+	if opts.UMIAllowlistFile != "" && opts.UmiFile != "" {
+		add("umi-allowlist and umi-file cannot both be set")
+	}
+	switch opts.ExistingDuplicateHandling {
+	case "", existingDupsClear:
+	case existingDupsPreserve, existingDupsUnion:
+		if opts.ClearExisting {
+			add("clear-existing and existing-duplicate-handling %s cannot both be set",
+				opts.ExistingDuplicateHandling)
+		}
+	default:
+		add("unknown existing-duplicate-handling %s", opts.ExistingDuplicateHandling)
+	}
+	if opts.MetricsOnly {
+		if !isStdout(opts.OutputPath) {
+			add("metrics-only and output cannot both be set")
+		}
+		if opts.DuplicatesOutput != "" {
+			add("metrics-only and duplicates-output cannot both be set")
+		}
+		if opts.Flagstat {
+			add("metrics-only and flagstat cannot both be set")
+		}
+	} else if bamprovider.ParseFileType(opts.Format) == bamprovider.PAM && isStdout(opts.OutputPath) &&
+		opts.SplitOutputByReference == "" {
+		add("pam output cannot be written to stdout, set output to a path")
+	}
+	if opts.SplitOutputByReference != "" {
+		if !strings.Contains(opts.SplitOutputByReference, splitOutputRef) {
+			add("split-output-by-reference must contain %s: %s", splitOutputRef, opts.SplitOutputByReference)
+		}
+		if opts.MetricsOnly {
+			add("metrics-only and split-output-by-reference cannot both be set")
+		}
+		if !isStdout(opts.OutputPath) {
+			add("output and split-output-by-reference cannot both be set")
+		}
+		if bamprovider.ParseFileType(opts.Format) != bamprovider.BAM {
+			add("split-output-by-reference requires bam output, not %s", opts.Format)
+		}
+		if opts.InputOrder == inputOrderQueryname {
+			add("split-output-by-reference requires coordinate sorted input")
+		}
+		if opts.VerifyAgainst != "" {
+			add("verify-against and split-output-by-reference cannot both be set")
+		}
+		if opts.splitOutputMaxFiles() < 2 {
+			add("split-output-max-files must be at least 2: %d", opts.SplitOutputMaxFiles)
+		}
+	}
+	if opts.FilterExpression != "" {
+		if _, err := parseFilter(opts.FilterExpression); err != nil {
+			add("%v", err)
+		}
+		// The mates of the reads of the regions are fetched outside
+		// the filtered scans.
+		if opts.Regions != "" {
+			add("filter-expression and regions cannot both be set")
+		}
+	}
+	if opts.VerifyAgainst != "" {
+		switch {
+		case opts.MetricsOnly:
+			add("verify-against and metrics-only cannot both be set")
+		case isStdout(opts.OutputPath) || bamprovider.ParseFileType(opts.Format) != bamprovider.BAM:
+			add("verify-against requires bam output to a path")
+		}
+		if opts.TagOnlyMode {
+			add("verify-against and tag-only cannot both be set")
+		}
+		if opts.InputOrder == inputOrderQueryname {
+			add("verify-against requires coordinate sorted input")
+		}
+	} else if opts.VerifyDisagreements != "" {
+		add("verify-disagreements is set, but verify-against is not")
+	}
+	switch opts.InputOrder {
+	case "", inputOrderCoordinate, inputOrderQueryname:
+	default:
+		add("unknown input-order %s", opts.InputOrder)
+	}
+	switch opts.IndexFormat {
+	case "", indexFormatNone:
+	case indexFormatBAI, indexFormatCSI:
+		if bamprovider.ParseFileType(opts.Format) != bamprovider.BAM ||
+			(isStdout(opts.OutputPath) && opts.SplitOutputByReference == "") {
+			add("output-index-format %s requires bam output to a path", opts.IndexFormat)
+		}
+	default:
+		add("unknown output-index-format %s", opts.IndexFormat)
+	}
+	switch opts.TaggingPolicy {
+	case "", taggingPolicyAll:
+	case taggingPolicyNone, taggingPolicyOptical:
+		if opts.TagDups {
+			add("tag-duplicates and tagging-policy %s cannot both be set", opts.TaggingPolicy)
+		}
+	default:
+		add("unknown tagging-policy %s", opts.TaggingPolicy)
+	}
+	if opts.TagRepresentative && !opts.tagDupSets() {
+		add("tag-representative requires tag-duplicates or tagging-policy all")
+	}
+	for _, tag := range opts.ClearTags {
+		if !validTag(tag) {
+			add("clear-tags must be a letter and a letter or digit: %q", tag)
+		}
+	}
+	if opts.MinMAPQForDup < 0 || opts.MinMAPQForDup > 255 {
+		add("min-mapq-for-dup must be between 0 and 255: %d", opts.MinMAPQForDup)
+	}
+	switch opts.PrimarySelection {
+	case "", primarySelectionFileIdx, primarySelectionBaseQ:
+	default:
+		add("unknown primary-selection %s", opts.PrimarySelection)
+	}
+	if _, err := ParsePairScorer(opts.PrimaryScorer); err != nil {
+		problems = append(problems, err)
+	}
+	if opts.TagOnlyMode && opts.RemoveDups {
+		add("tag-only and remove-dups cannot both be set")
+	}
+	if opts.DuplicatesOutput != "" {
+		if !opts.RemoveDups {
+			add("duplicates-output requires remove-dups")
+		}
+		if opts.taggingPolicy() != taggingPolicyAll {
+			add("duplicates-output requires tag-duplicates or tagging-policy all")
+		}
+		if bamprovider.ParseFileType(opts.Format) != bamprovider.BAM {
+			add("duplicates-output requires bam output, not %s", opts.Format)
+		}
+	}
+	if opts.Regions != "" {
+		if bamprovider.ParseFileType(opts.Format) != bamprovider.BAM {
+			add("regions requires bam output, not %s", opts.Format)
+		}
+		if isStdin(opts.BamFile) {
+			add("regions requires an indexed bam file, not stdin")
+		}
+	}
+	if opts.DuplexMITag && !opts.EmitMITag {
+		add("duplex-mi-tag is set, but emit-mi-tag is false")
+	}
+	if opts.OverwriteMateTags && !opts.AddMateTags {
+		add("overwrite-mate-tags is set, but add-mate-tags is false")
+	}
+	if opts.CellBarcodeTag != "" && !validTag(opts.CellBarcodeTag) {
+		add("cell-barcode-tag must be a letter and a letter or digit: %q", opts.CellBarcodeTag)
+	}
+	if opts.CellMetricsMax < 0 {
+		add("cell-metrics-max must be non-negative")
+	}
+	if opts.ProgressInterval < 0 {
+		add("progress-interval must be non-negative")
+	}
+	if _, err := parseLogLevel(opts.LogLevel, log.Info); err != nil {
+		add("%v", err)
+	}
+	if opts.LogFormat != "" && opts.LogFormat != logFormatText && opts.LogFormat != logFormatJSON {
+		add("log-format must be text or json: %q", opts.LogFormat)
+	}
+	if opts.CellMetricsMax > 0 && opts.CellBarcodeTag == "" {
+		add("cell-metrics-max is set, but there is no cell-barcode-tag")
+	}
+	if opts.GCReference != "" && !opts.GCMetrics {
+		add("gc-reference is set, but gc-metrics is false")
+	}
+	if len(opts.UmiFile) > 0 && !opts.umiGrouping() {
+		add("umi-file is set, but use-umis is false and umi-tag is empty")
+	}
+	if opts.ScavengeUmis > 0 && !opts.umiGrouping() {
+		add("scavenge-umis is set, but use-umis is false and umi-tag is empty")
+	}
+	if opts.ScavengeUmis > 0 && opts.UmiFile == "" {
+		add("scavenge-umis is set, but umi-file is empty")
+	}
+	if opts.opticalHistogramEnabled() && (opts.OpticalHistogramMax == 0 || opts.OpticalHistogramMax < -1) {
+		add("optical-histogram-max must be positive, or -1 for no limit, when an optical histogram is written: %d",
+			opts.OpticalHistogramMax)
+	}
+	if opts.OpticalHistogramMaxDistance < 0 {
+		add("optical-histogram-max-distance must be non-negative")
+	}
+	if opts.MaxDuplicateSetSize < 0 {
+		add("max-duplicate-set-size must be non-negative")
+	}
+	if opts.HotspotBED != "" && opts.HotspotMinSetSize <= 0 {
+		add("hotspot-min-set-size must be positive")
+	}
+	if opts.OpticalDuplicatePixelDistance < 0 {
+		add("optical-duplicate-pixel-distance must be non-negative")
+	}
+	if opts.MaxUnparseableNameFraction < 0 || opts.MaxUnparseableNameFraction > 1 {
+		add("max-unparseable-name-fraction must be between 0 and 1: %v", opts.MaxUnparseableNameFraction)
+	}
+	if _, err := ParseDistanceMetric(string(opts.OpticalDistanceMetric)); err != nil {
+		problems = append(problems, err)
+	}
+	if opts.MetricsFormat != "" && opts.MetricsFormat != "text" && opts.MetricsFormat != "json" {
+		add("unknown metrics-format %s", opts.MetricsFormat)
+	}
+	if opts.OpticalHistogramFormat != "" && opts.OpticalHistogramFormat != "tsv" &&
+		opts.OpticalHistogramFormat != "json" {
+		add("unknown optical-histogram-format %s", opts.OpticalHistogramFormat)
+	}
+	for i, bound := range opts.InsertSizeBins {
+		if bound <= 0 || (i > 0 && bound <= opts.InsertSizeBins[i-1]) {
+			add("insert-size-bins must be positive and increasing: %v", opts.InsertSizeBins)
+			break
+		}
 	}
 	if bamprovider.ParseFileType(opts.Format) == bamprovider.Unknown {
-		return fmt.Errorf("unknown outputformat %s", opts.Format)
+		add("unknown outputformat %s", opts.Format)
 	}
-	return nil
+	problems = append(problems, opts.remoteOptionProblems()...)
+	return problems
 }
@@ -0,0 +1,249 @@
+// Copyright 2019 Grail Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package markduplicates
+
+import (
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/grailbio/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+// validOpts returns options that pass validate.
+func validOpts() Opts {
+	opts := defaultOpts
+	opts.BamFile = "in.bam"
+	opts.MinBases = 1
+	opts.Format = "bam"
+	opts.ScavengeUmis = -1
+	return opts
+}
+
+func TestValidate(t *testing.T) {
+	opts := validOpts()
+	assert.NoError(t, validate(&opts))
+	assert.Equal(t, "in.bam.bai", opts.IndexFile)
+
+	tests := []struct {
+		name     string
+		modify   func(*Opts)
+		expected string
+	}{
+		{"no input", func(o *Opts) { o.BamFile = "" }, "--bam"},
+		{"zero shard size", func(o *Opts) { o.ShardSize = 0 }, "shard-size must be non-zero"},
+		{"negative padding", func(o *Opts) { o.Padding = -1 }, "padding must be non-negative"},
+		{"padding over shard size", func(o *Opts) { o.Padding = o.ShardSize }, "padding must be less than shard-size"},
+		{"zero min bases", func(o *Opts) { o.MinBases = 0 }, "min-bases"},
+		{"compression level", func(o *Opts) { o.CompressionLevel = 10 }, "compression-level"},
+		{"zero parallelism", func(o *Opts) { o.Parallelism = 0 }, "parallelism must be positive"},
+		{"negative read parallelism", func(o *Opts) { o.ReadParallelism = -1 }, "read-parallelism"},
+		{"negative compute parallelism", func(o *Opts) { o.ComputeParallelism = -1 }, "compute-parallelism"},
+		{"negative write parallelism", func(o *Opts) { o.WriteParallelism = -1 }, "write-parallelism"},
+		{"negative max memory", func(o *Opts) { o.MaxMemoryMB = -1 }, "max-memory-mb"},
+		{"zero queue length", func(o *Opts) { o.QueueLength = 0 }, "queue-length must be positive"},
+		{"negative coverage max", func(o *Opts) { o.CoverageMax = -1 }, "coverage-max"},
+		{"negative disk mate shards", func(o *Opts) { o.DiskMateShards = -1 }, "disk-mate-shards"},
+		{"short umi tag", func(o *Opts) { o.UMITag = "R" }, "umi-tag"},
+		{"umi tag starting with a digit", func(o *Opts) { o.UMITag = "1X" }, "umi-tag"},
+		{"empty clear tag", func(o *Opts) { o.ClearTags = []string{"DI", ""} }, "clear-tags"},
+		{"bad cell barcode tag", func(o *Opts) { o.CellBarcodeTag = "C-" }, "cell-barcode-tag"},
+		{"overwrite mate tags", func(o *Opts) { o.OverwriteMateTags = true }, "add-mate-tags"},
+		{"tag only and remove duplicates", func(o *Opts) {
+			o.TagOnlyMode = true
+			o.RemoveDups = true
+		}, "tag-only and remove-dups"},
+		{"reads per shard of stdin", func(o *Opts) {
+			o.BamFile = stdioPath
+			o.TargetReadsPerShard = 1000
+		}, "target-reads-per-shard requires a single indexed bam file"},
+		{"regions of stdin", func(o *Opts) {
+			o.BamFile = stdioPath
+			o.Regions = "chr1"
+		}, "regions requires an indexed bam file"},
+		{"index of stdin", func(o *Opts) {
+			o.BamFile = stdioPath
+			o.IndexFile = "in.bam.bai"
+		}, "index is set, but the input is stdin"},
+		{"optical histogram of no readpairs", func(o *Opts) {
+			o.OpticalHistogram = "histogram.txt"
+			o.OpticalHistogramMax = 0
+		}, "optical-histogram-max"},
+		{"negative optical histogram distance", func(o *Opts) { o.OpticalHistogramMaxDistance = -1 },
+			"optical-histogram-max-distance"},
+		{"negative optical pixel distance", func(o *Opts) { o.OpticalDuplicatePixelDistance = -1 },
+			"optical-duplicate-pixel-distance"},
+		{"unparseable name fraction", func(o *Opts) { o.MaxUnparseableNameFraction = 2 },
+			"max-unparseable-name-fraction"},
+		{"metrics only with output", func(o *Opts) {
+			o.MetricsOnly = true
+			o.OutputPath = "out.bam"
+		}, "metrics-only and output"},
+		{"pam to stdout", func(o *Opts) { o.Format = "pam" }, "pam output cannot be written to stdout"},
+		{"duplicates output without removal", func(o *Opts) { o.DuplicatesOutput = "dups.bam" },
+			"duplicates-output requires remove-dups"},
+		{"unknown format", func(o *Opts) { o.Format = "cram" }, "unknown outputformat"},
+		{"decreasing insert size bins", func(o *Opts) { o.InsertSizeBins = []int{100, 50} }, "insert-size-bins"},
+		{"negative progress interval", func(o *Opts) { o.ProgressInterval = -time.Second }, "progress-interval"},
+		{"unknown log level", func(o *Opts) { o.LogLevel = "info,optical=verbose" }, "unknown log level verbose"},
+		{"unknown log component", func(o *Opts) { o.LogLevel = "reads=debug" }, "unknown log component reads"},
+		{"verify against stdout", func(o *Opts) { o.VerifyAgainst = "theirs.bam" },
+			"verify-against requires bam output to a path"},
+		{"verify against tag only", func(o *Opts) {
+			o.VerifyAgainst = "theirs.bam"
+			o.OutputPath = "out.bam"
+			o.TagOnlyMode = true
+		}, "verify-against and tag-only"},
+		{"verify disagreements without verify against", func(o *Opts) { o.VerifyDisagreements = "disagreements.tsv" },
+			"verify-disagreements"},
+		{"unknown log format", func(o *Opts) { o.LogFormat = "xml" }, "log-format"},
+		{"gcs scratch dir", func(o *Opts) { o.ScratchDir = "gs://bucket/tmp" }, "scratch-dir must be a local path"},
+		{"remote scratch dir", func(o *Opts) { o.ScratchDir = "s3://bucket/tmp" },
+			"scratch-dir must be a local path"},
+		{"remote optical scatter", func(o *Opts) { o.OpticalScatterFile = "s3://bucket/scatter.tsv" },
+			"optical-scatter must be a local path"},
+		{"split output without ref", func(o *Opts) {
+			o.SplitOutputByReference = "out.bam"
+			o.SplitOutputMaxFiles = 64
+		}, "split-output-by-reference must contain {ref}"},
+		{"split output and output", func(o *Opts) {
+			o.SplitOutputByReference = "out/{ref}.bam"
+			o.SplitOutputMaxFiles = 64
+			o.OutputPath = "out.bam"
+		}, "output and split-output-by-reference"},
+		{"split output of queryname input", func(o *Opts) {
+			o.SplitOutputByReference = "out/{ref}.bam"
+			o.SplitOutputMaxFiles = 64
+			o.InputOrder = inputOrderQueryname
+		}, "split-output-by-reference requires coordinate sorted input"},
+		{"split output to one file", func(o *Opts) {
+			o.SplitOutputByReference = "out/{ref}.bam"
+			o.SplitOutputMaxFiles = 1
+		}, "split-output-max-files"},
+		{"invalid filter expression", func(o *Opts) { o.FilterExpression = "mapq >=" },
+			"unexpected end of expression"},
+		{"filter expression with unknown field", func(o *Opts) { o.FilterExpression = "mapping_quality > 20" },
+			"unknown field mapping_quality"},
+		{"filter expression and regions", func(o *Opts) {
+			o.FilterExpression = "mapq > 20"
+			o.Regions = "chr1:1-1000"
+		}, "filter-expression and regions"},
+		{"gc reference without gc metrics", func(o *Opts) { o.GCReference = "ref.fa" },
+			"gc-reference is set, but gc-metrics is false"},
+		{"flagstat without output", func(o *Opts) {
+			o.MetricsOnly = true
+			o.Flagstat = true
+		}, "metrics-only and flagstat"},
+	}
+	for _, test := range tests {
+		opts := validOpts()
+		test.modify(&opts)
+		err := validate(&opts)
+		var optsErr *OptsError
+		if assert.True(t, errors.As(err, &optsErr), "test %s: %v", test.name, err) {
+			assert.Len(t, optsErr.Problems, 1, "test %s: %v", test.name, err)
+			assert.Contains(t, err.Error(), test.expected, "test %s", test.name)
+		}
+	}
+
+	// The inputs and outputs may be s3:// URLs.
+	opts = validOpts()
+	opts.BamFile = "s3://bucket/in.bam"
+	opts.OutputPath = "s3://bucket/out.bam"
+	opts.MetricsFile = "s3://bucket/metrics.txt"
+	assert.NoError(t, validate(&opts))
+	assert.Equal(t, "s3://bucket/in.bam.bai", opts.IndexFile)
+
+	// The split output is indexed without an output path.
+	opts = validOpts()
+	opts.SplitOutputByReference = "out/{ref}.bam"
+	opts.SplitOutputMaxFiles = 64
+	opts.IndexFormat = indexFormatCSI
+	assert.NoError(t, validate(&opts))
+	// A zero split-output-max-files is its default.
+	opts.SplitOutputMaxFiles = 0
+	assert.NoError(t, validate(&opts))
+
+	// All the problems are reported, one per line.
+	opts = validOpts()
+	opts.ShardSize = 0
+	opts.Parallelism = 0
+	opts.UMITag = "R"
+	err := validate(&opts)
+	var optsErr *OptsError
+	if assert.True(t, errors.As(err, &optsErr)) {
+		assert.Len(t, optsErr.Problems, 3)
+		assert.Len(t, strings.Split(err.Error(), "\n"), 4)
+	}
+}
+
+func TestValidateFiles(t *testing.T) {
+	tempDir, cleanup := testutil.TempDir(t, "", "")
+	defer cleanup()
+	bamPath := filepath.Join(tempDir, "in.bam")
+
+	opts := validOpts()
+	opts.BamFile = bamPath
+	err := opts.Validate()
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "bam "+bamPath)
+
+	assert.NoError(t, ioutil.WriteFile(bamPath, nil, 0644))
+	assert.NoError(t, opts.Validate())
+	// Validate does not set the defaults.
+	assert.Equal(t, "", opts.IndexFile)
+
+	// The index is needed by the regions, which are a missing BED file,
+	// and so is the UMI file.
+	opts.Regions = filepath.Join(tempDir, "regions.bed")
+	opts.UseUmis = true
+	opts.UmiFile = filepath.Join(tempDir, "umis.txt")
+	err = opts.Validate()
+	var optsErr *OptsError
+	if assert.True(t, errors.As(err, &optsErr)) {
+		assert.Len(t, optsErr.Problems, 3, "%v", err)
+	}
+	assert.Contains(t, err.Error(), "index "+bamPath+".bai")
+	assert.Contains(t, err.Error(), "regions "+opts.Regions)
+	assert.Contains(t, err.Error(), "umi-file "+opts.UmiFile)
+
+	// The protected regions are read by Mark.
+	opts.Regions = ""
+	opts.UseUmis = false
+	opts.UmiFile = ""
+	opts.ProtectedRegionsBED = filepath.Join(tempDir, "protected.bed")
+	err = opts.Validate()
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "protected-regions-bed "+opts.ProtectedRegionsBED)
+	}
+
+	// The GC reference needs its index.
+	opts.ProtectedRegionsBED = ""
+	opts.GCMetrics = true
+	opts.GCReference = filepath.Join(tempDir, "ref.fa")
+	assert.NoError(t, ioutil.WriteFile(opts.GCReference, []byte(">chr1\nACGT\n"), 0644))
+	err = opts.Validate()
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "gc-reference index "+opts.GCReference+".fai")
+	}
+
+	// The input of stdin is not checked.
+	opts = validOpts()
+	opts.BamFile = stdioPath
+	assert.NoError(t, opts.Validate())
+}
@@ -0,0 +1,464 @@
+// Copyright 2019 Grail Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package markduplicates
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/Schaudge/grailbase/errors"
+	"github.com/Schaudge/grailbase/file"
+	"github.com/Schaudge/hts/bam"
+	"github.com/Schaudge/hts/sam"
+)
+
+// With Opts.VerifyAgainst, Mark compares the duplicate flags of its
+// output with those of a reference BAM of the same reads, marked by
+// another tool such as picard, when it is done. Both are coordinate
+// sorted, and they are streamed side by side: only the records of one
+// position are held in memory. A record of the output matches the
+// record of the reference at the same position with the same name,
+// read number, and secondary and supplementary flags. Only the flags
+// and the DS tag are compared, so the reference may have other tags.
+// The unplaced unmapped reads at the end of the files, which are never
+// duplicates, are not compared.
+//
+// The disagreements are broken down by the size of their duplicate
+// set, the DS tag of the output or else of the reference, and by
+// cause. A disagreement within duplicate sets of the same size in both
+// files is a tie-break of the representative, and one within sets of
+// different sizes, or within a set in only one file, is a difference
+// of the set membership. Without the DS tags, e.g. with tagging-policy
+// none, or picard without TAG_DUPLICATE_SET_MEMBERS, the cause is
+// unknown.
+
+// The causes of Verification.DisagreementsByCause.
+const (
+	verifyCauseTieBreaking   = "tie-breaking"
+	verifyCauseSetMembership = "set-membership"
+	verifyCauseUnknown       = "unknown"
+)
+
+// verifyDisagreementsHeader is the header line of
+// Opts.VerifyDisagreements.
+const verifyDisagreementsHeader = "qname\tread\tref\tpos\tours_dup\ttheirs_dup\tours_set_size\ttheirs_set_size\n"
+
+// Verification is the comparison of the duplicate flags of the output
+// with those of Opts.VerifyAgainst.
+type Verification struct {
+	// BothDup, OnlyOurs, OnlyTheirs and Neither are the numbers of
+	// matched records that are flagged as duplicates in both files,
+	// only in the output, only in the reference, and in neither.
+	BothDup, OnlyOurs, OnlyTheirs, Neither int64
+	// UnmatchedOurs and UnmatchedTheirs are the numbers of records of
+	// the output and of the reference without a match in the other.
+	UnmatchedOurs, UnmatchedTheirs int64
+	// DisagreementsBySetSize breaks OnlyOurs and OnlyTheirs down by the
+	// size of their duplicate set, or 0 if neither file has it.
+	DisagreementsBySetSize map[int64]int64
+	// DisagreementsByCause breaks OnlyOurs and OnlyTheirs down by
+	// cause: tie-breaking, set-membership, or unknown.
+	DisagreementsByCause map[string]int64
+}
+
+// Agreement returns the fraction of the matched records whose
+// duplicate flags agree.
+func (v *Verification) Agreement() float64 {
+	matched := v.BothDup + v.OnlyOurs + v.OnlyTheirs + v.Neither
+	if matched == 0 {
+		return 1
+	}
+	return float64(v.BothDup+v.Neither) / float64(matched)
+}
+
+// String returns v as a log line.
+func (v *Verification) String() string {
+	s := fmt.Sprintf("agreement %.4f%%, both duplicates %d, only ours %d, only theirs %d, neither %d, "+
+		"unmatched ours %d, theirs %d", 100*v.Agreement(), v.BothDup, v.OnlyOurs, v.OnlyTheirs, v.Neither,
+		v.UnmatchedOurs, v.UnmatchedTheirs)
+	if v.OnlyOurs+v.OnlyTheirs == 0 {
+		return s
+	}
+	var causes []string
+	for _, cause := range []string{verifyCauseTieBreaking, verifyCauseSetMembership, verifyCauseUnknown} {
+		if n := v.DisagreementsByCause[cause]; n > 0 {
+			causes = append(causes, fmt.Sprintf("%s %d", cause, n))
+		}
+	}
+	var sizes []int64
+	for size := range v.DisagreementsBySetSize {
+		sizes = append(sizes, size)
+	}
+	sort.Slice(sizes, func(i, j int) bool { return sizes[i] < sizes[j] })
+	var bySize []string
+	for _, size := range sizes {
+		bySize = append(bySize, fmt.Sprintf("%d:%d", size, v.DisagreementsBySetSize[size]))
+	}
+	return fmt.Sprintf("%s; disagreements by cause: %s; by set size: %s", s, strings.Join(causes, ", "),
+		strings.Join(bySize, " "))
+}
+
+// verifyKey matches the records of a position.
+type verifyKey struct {
+	name string
+	// read is 1 or 2 for the first or second read of a pair, or 0.
+	read int
+	// class is the secondary and supplementary flags.
+	class sam.Flags
+}
+
+func newVerifyKey(r *sam.Record) verifyKey {
+	key := verifyKey{name: r.Name, class: r.Flags & (sam.Secondary | sam.Supplementary)}
+	switch {
+	case r.Flags&sam.Read1 != 0:
+		key.read = 1
+	case r.Flags&sam.Read2 != 0:
+		key.read = 2
+	}
+	return key
+}
+
+// setSize returns the DS tag of r, if it has one.
+func setSize(r *sam.Record) (int64, bool) {
+	aux := r.AuxFields.Get(dsTag)
+	if aux == nil {
+		return 0, false
+	}
+	switch v := aux.Value().(type) {
+	case int8:
+		return int64(v), true
+	case uint8:
+		return int64(v), true
+	case int16:
+		return int64(v), true
+	case uint16:
+		return int64(v), true
+	case int32:
+		return int64(v), true
+	case uint32:
+		return int64(v), true
+	}
+	return 0, false
+}
+
+// positionReader reads the records of a coordinate sorted BAM one
+// position at a time.
+type positionReader struct {
+	path   string
+	stream *bamStream
+	// next is the next record, or nil at the end of the placed
+	// records.
+	next       *sam.Record
+	refID, pos int
+}
+
+func newPositionReader(path string, stream *bamStream) *positionReader {
+	p := &positionReader{path: path, stream: stream, refID: -1, pos: -1}
+	p.advance()
+	return p
+}
+
+func (p *positionReader) advance() {
+	p.next = nil
+	if p.stream.Scan() && p.stream.Record().Ref != nil {
+		p.next = p.stream.Record()
+	}
+}
+
+// read returns the records of the next position, or nil at the end of
+// the placed records.
+func (p *positionReader) read() ([]*sam.Record, error) {
+	if p.next == nil {
+		return nil, nil
+	}
+	refID, pos := p.next.Ref.ID(), p.next.Pos
+	if refID < p.refID || (refID == p.refID && pos < p.pos) {
+		return nil, fmt.Errorf("%s is not coordinate sorted: %s at %s:%d", p.path, p.next.Name,
+			p.next.Ref.Name(), pos+1)
+	}
+	var records []*sam.Record
+	for p.next != nil && p.next.Ref.ID() == refID && p.next.Pos == pos {
+		records = append(records, p.next)
+		p.advance()
+	}
+	p.refID, p.pos = refID, pos
+	return records, nil
+}
+
+// comparePositions compares the positions of the records of a and b,
+// where nil is after every position.
+func comparePositions(a, b []*sam.Record) int {
+	switch {
+	case a == nil && b == nil:
+		return 0
+	case a == nil:
+		return 1
+	case b == nil:
+		return -1
+	}
+	ra, rb := a[0], b[0]
+	if ra.Ref.ID() != rb.Ref.ID() {
+		return ra.Ref.ID() - rb.Ref.ID()
+	}
+	return ra.Pos - rb.Pos
+}
+
+// verifier accumulates a Verification.
+type verifier struct {
+	v Verification
+	// oursTagged and theirsTagged are true if the output and the
+	// reference have DS tags.
+	oursTagged, theirsTagged bool
+	// disagreements are counted by the files that have a DS tag:
+	// both with the same size, both with different sizes, only
+	// ours, only theirs, or neither.
+	sameSize, differentSize, oursOnly, theirsOnly, untagged int64
+	// w, if non-nil, is where the disagreements are written.
+	w *bufio.Writer
+}
+
+// compare compares the records of ours and theirs at the same
+// position.
+func (vr *verifier) compare(ours, theirs []*sam.Record) error {
+	byKey := make(map[verifyKey]*sam.Record, len(theirs))
+	for _, r := range theirs {
+		key := newVerifyKey(r)
+		if _, ok := byKey[key]; ok {
+			vr.v.UnmatchedTheirs++
+			continue
+		}
+		byKey[key] = r
+	}
+	for _, r := range ours {
+		key := newVerifyKey(r)
+		t, ok := byKey[key]
+		if !ok {
+			vr.v.UnmatchedOurs++
+			continue
+		}
+		delete(byKey, key)
+		if err := vr.compareRecords(key, r, t); err != nil {
+			return err
+		}
+	}
+	vr.v.UnmatchedTheirs += int64(len(byKey))
+	return nil
+}
+
+// compareRecords compares ours and theirs, the matching records of key.
+func (vr *verifier) compareRecords(key verifyKey, ours, theirs *sam.Record) error {
+	oursSize, oursOK := setSize(ours)
+	theirsSize, theirsOK := setSize(theirs)
+	vr.oursTagged = vr.oursTagged || oursOK
+	vr.theirsTagged = vr.theirsTagged || theirsOK
+
+	oursDup, theirsDup := ours.Flags&sam.Duplicate != 0, theirs.Flags&sam.Duplicate != 0
+	switch {
+	case oursDup && theirsDup:
+		vr.v.BothDup++
+		return nil
+	case !oursDup && !theirsDup:
+		vr.v.Neither++
+		return nil
+	case oursDup:
+		vr.v.OnlyOurs++
+	default:
+		vr.v.OnlyTheirs++
+	}
+
+	size := theirsSize
+	if oursOK {
+		size = oursSize
+	}
+	vr.v.DisagreementsBySetSize[size]++
+	switch {
+	case oursOK && theirsOK && oursSize == theirsSize:
+		vr.sameSize++
+	case oursOK && theirsOK:
+		vr.differentSize++
+	case oursOK:
+		vr.oursOnly++
+	case theirsOK:
+		vr.theirsOnly++
+	default:
+		vr.untagged++
+	}
+
+	if vr.w == nil {
+		return nil
+	}
+	_, err := fmt.Fprintf(vr.w, "%s\t%d\t%s\t%d\t%t\t%t\t%d\t%d\n", key.name, key.read, ours.Ref.Name(), ours.Pos+1,
+		oursDup, theirsDup, oursSize, theirsSize)
+	return err
+}
+
+// finish returns the Verification, with the causes of the
+// disagreements. A set in only one file is a difference of the set
+// membership only if the other file has DS tags at all.
+func (vr *verifier) finish() *Verification {
+	v := vr.v
+	v.DisagreementsByCause = map[string]int64{}
+	add := func(cause string, n int64) {
+		if n > 0 {
+			v.DisagreementsByCause[cause] += n
+		}
+	}
+	add(verifyCauseTieBreaking, vr.sameSize)
+	add(verifyCauseSetMembership, vr.differentSize)
+	if vr.theirsTagged {
+		add(verifyCauseSetMembership, vr.oursOnly)
+	} else {
+		add(verifyCauseUnknown, vr.oursOnly)
+	}
+	if vr.oursTagged {
+		add(verifyCauseSetMembership, vr.theirsOnly)
+	} else {
+		add(verifyCauseUnknown, vr.theirsOnly)
+	}
+	add(verifyCauseUnknown, vr.untagged)
+	return &v
+}
+
+// openBAM opens the BAM at path, and returns a stream of its records
+// and a function that closes it.
+func openBAM(ctx context.Context, path string) (*bamStream, func() error, error) {
+	in, err := file.Open(ctx, path)
+	if err != nil {
+		return nil, nil, err
+	}
+	reader, err := bam.NewReader(in.Reader(ctx), 1)
+	if err != nil {
+		in.Close(ctx) // nolint: errcheck
+		return nil, nil, err
+	}
+	stream := &bamStream{reader: reader}
+	return stream, func() error {
+		err := stream.Close()
+		if err2 := in.Close(ctx); err == nil {
+			err = err2
+		}
+		return err
+	}, nil
+}
+
+// verify compares the duplicate flags of the output of opts with
+// those of opts.VerifyAgainst, and writes their disagreements to
+// opts.VerifyDisagreements if it is set.
+func verify(ctx context.Context, opts *Opts) (_ *Verification, err error) {
+	ours, closeOurs, err := openBAM(ctx, opts.OutputPath)
+	if err != nil {
+		return nil, errors.E(err, "Couldn't read the output for verification:", opts.OutputPath)
+	}
+	defer func() {
+		if err2 := closeOurs(); err == nil && err2 != nil {
+			err = err2
+		}
+	}()
+	theirs, closeTheirs, err := openBAM(ctx, opts.VerifyAgainst)
+	if err != nil {
+		return nil, errors.E(err, "Couldn't read verify-against:", opts.VerifyAgainst)
+	}
+	defer func() {
+		if err2 := closeTheirs(); err == nil && err2 != nil {
+			err = err2
+		}
+	}()
+	if err := checkSameReferences(ours.reader.Header(), theirs.reader.Header()); err != nil {
+		return nil, fmt.Errorf("verify-against %s: %v", opts.VerifyAgainst, err)
+	}
+
+	vr := &verifier{v: Verification{DisagreementsBySetSize: map[int64]int64{}}}
+	if opts.VerifyDisagreements != "" {
+		f, err := os.Create(opts.VerifyDisagreements)
+		if err != nil {
+			return nil, errors.E(err, "Couldn't create verify-disagreements:", opts.VerifyDisagreements)
+		}
+		defer func() {
+			if err2 := f.Close(); err == nil && err2 != nil {
+				err = err2
+			}
+		}()
+		vr.w = bufio.NewWriter(f)
+		if _, err := vr.w.WriteString(verifyDisagreementsHeader); err != nil {
+			return nil, err
+		}
+	}
+
+	oursReader := newPositionReader(opts.OutputPath, ours)
+	theirsReader := newPositionReader(opts.VerifyAgainst, theirs)
+	a, err := oursReader.read()
+	if err != nil {
+		return nil, err
+	}
+	b, err := theirsReader.read()
+	if err != nil {
+		return nil, err
+	}
+	for positions := 0; a != nil || b != nil; positions++ {
+		if positions%cancelCheckInterval == 0 {
+			if err := cancelled(ctx); err != nil {
+				return nil, err
+			}
+		}
+		c := comparePositions(a, b)
+		switch {
+		case c < 0:
+			vr.v.UnmatchedOurs += int64(len(a))
+		case c > 0:
+			vr.v.UnmatchedTheirs += int64(len(b))
+		default:
+			if err := vr.compare(a, b); err != nil {
+				return nil, err
+			}
+		}
+		if c <= 0 {
+			if a, err = oursReader.read(); err != nil {
+				return nil, err
+			}
+		}
+		if c >= 0 {
+			if b, err = theirsReader.read(); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if vr.w != nil {
+		if err := vr.w.Flush(); err != nil {
+			return nil, err
+		}
+	}
+	v := vr.finish()
+	metricsLog.Printf("verification against %s: %v", opts.VerifyAgainst, v)
+	return v, nil
+}
+
+// checkSameReferences returns an error if ours and theirs do not have
+// the same references in the same order.
+func checkSameReferences(ours, theirs *sam.Header) error {
+	oursRefs, theirsRefs := ours.Refs(), theirs.Refs()
+	if len(oursRefs) != len(theirsRefs) {
+		return fmt.Errorf("it has %d references, but the output has %d", len(theirsRefs), len(oursRefs))
+	}
+	for i, ref := range oursRefs {
+		if ref.Name() != theirsRefs[i].Name() || ref.Len() != theirsRefs[i].Len() {
+			return fmt.Errorf("its reference %d is %s of length %d, but that of the output is %s of length %d",
+				i, theirsRefs[i].Name(), theirsRefs[i].Len(), ref.Name(), ref.Len())
+		}
+	}
+	return nil
+}
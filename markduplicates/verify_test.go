@@ -0,0 +1,144 @@
+// Copyright 2019 Grail Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package markduplicates
+
+import (
+	"context"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/Schaudge/grailbio/encoding/bamprovider"
+	"github.com/Schaudge/hts/sam"
+	"github.com/grailbio/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestVerify(t *testing.T) {
+	dup := sam.Duplicate
+	ours := []*sam.Record{
+		NewRecordAux("A", chr1, 10, r1F|dup, 100, chr1, cigar0, NewAux("DS", 2)),
+		NewRecordAux("B", chr1, 10, r1F, 100, chr1, cigar0, NewAux("DS", 2)),
+		NewRecordAux("C", chr1, 20, r1F|dup, 100, chr1, cigar0, NewAux("DS", 3)),
+		NewRecord("D", chr1, 30, r2R|dup, 0, chr1, cigar0),
+		NewRecord("E", chr1, 40, r1F, 100, chr1, cigar0),
+		NewRecord("F", chr1, 50, r1F, 100, chr1, cigar0),
+		NewRecord("U", nil, -1, up1, -1, nil, nil),
+	}
+	theirs := []*sam.Record{
+		// The same records at a position may be in another order.
+		NewRecordAux("B", chr1, 10, r1F|dup, 100, chr1, cigar0, NewAux("DS", 2)),
+		NewRecordAux("A", chr1, 10, r1F, 100, chr1, cigar0, NewAux("DS", 2)),
+		NewRecord("C", chr1, 20, r1F, 100, chr1, cigar0),
+		NewRecordAux("D", chr1, 30, r2R|dup, 0, chr1, cigar0, NewAux("XX", "extra")),
+		NewRecord("E", chr1, 40, r1F, 100, chr1, cigar0),
+		NewRecord("G", chr2, 5, r1F, 100, chr2, cigar0),
+		NewRecord("V", nil, -1, up1, -1, nil, nil),
+	}
+	tempDir, cleanup := testutil.TempDir(t, "", "")
+	defer cleanup()
+	opts := defaultOpts
+	opts.OutputPath = filepath.Join(tempDir, "ours.bam")
+	opts.VerifyAgainst = filepath.Join(tempDir, "theirs.bam")
+	opts.VerifyDisagreements = filepath.Join(tempDir, "disagreements.tsv")
+	writeTestBAM(t, opts.OutputPath, header, ours)
+	writeTestBAM(t, opts.VerifyAgainst, header, theirs)
+
+	v, err := verify(context.Background(), &opts)
+	assert.NoError(t, err)
+	assert.Equal(t, &Verification{
+		BothDup:                1,
+		OnlyOurs:               2,
+		OnlyTheirs:             1,
+		Neither:                1,
+		UnmatchedOurs:          1,
+		UnmatchedTheirs:        1,
+		DisagreementsBySetSize: map[int64]int64{2: 2, 3: 1},
+		DisagreementsByCause:   map[string]int64{verifyCauseTieBreaking: 2, verifyCauseSetMembership: 1},
+	}, v)
+	assert.Equal(t, 0.4, v.Agreement())
+
+	data, err := ioutil.ReadFile(opts.VerifyDisagreements)
+	assert.NoError(t, err)
+	assert.Equal(t, verifyDisagreementsHeader+
+		"A\t1\tchr1\t11\ttrue\tfalse\t2\t2\n"+
+		"B\t1\tchr1\t11\tfalse\ttrue\t2\t2\n"+
+		"C\t1\tchr1\t21\ttrue\tfalse\t3\t0\n", string(data))
+
+	// Without DS tags in the reference, the causes are unknown.
+	for _, r := range theirs {
+		r.AuxFields = nil
+	}
+	writeTestBAM(t, opts.VerifyAgainst, header, theirs)
+	v, err = verify(context.Background(), &opts)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]int64{verifyCauseUnknown: 3}, v.DisagreementsByCause)
+
+	// The references must be the same.
+	otherRef, err := sam.NewReference("chr2", "", "", 2000, nil, nil)
+	assert.NoError(t, err)
+	other, err := sam.NewHeader(nil, []*sam.Reference{otherRef})
+	assert.NoError(t, err)
+	writeTestBAM(t, opts.VerifyAgainst, other, nil)
+	_, err = verify(context.Background(), &opts)
+	assert.Error(t, err)
+
+	// A missing input is an error.
+	opts.VerifyAgainst = filepath.Join(tempDir, "missing.bam")
+	_, err = verify(context.Background(), &opts)
+	assert.Error(t, err)
+}
+
+func TestVerifyAgainstOwnOutput(t *testing.T) {
+	// B is a duplicate of A.
+	records := func() []*sam.Record {
+		return []*sam.Record{
+			NewRecord("A:::1:10:1:1", chr1, 0, r1F, 50, chr1, cigar0),
+			NewRecord("B:::1:10:1:1", chr1, 0, r1F, 50, chr1, cigar0),
+			NewRecord("A:::1:10:1:1", chr1, 50, r2R, 0, chr1, cigar0),
+			NewRecord("B:::1:10:1:1", chr1, 50, r2R, 0, chr1, cigar0),
+		}
+	}
+	tempDir, cleanup := testutil.TempDir(t, "", "")
+	defer cleanup()
+
+	opts := defaultOpts
+	opts.OutputPath = filepath.Join(tempDir, "first.bam")
+	opts.Format = "bam"
+	markDuplicates := &MarkDuplicates{
+		Provider: bamprovider.NewFakeProvider(header, records()),
+		Opts:     &opts,
+	}
+	_, err := markDuplicates.Mark(nil)
+	assert.NoError(t, err)
+
+	second := defaultOpts
+	second.OutputPath = filepath.Join(tempDir, "second.bam")
+	second.Format = "bam"
+	second.VerifyAgainst = opts.OutputPath
+	markDuplicates = &MarkDuplicates{
+		Provider: bamprovider.NewFakeProvider(header, records()),
+		Opts:     &second,
+	}
+	metrics, err := markDuplicates.Mark(nil)
+	if assert.NoError(t, err) && assert.NotNil(t, metrics.Verification) {
+		v := metrics.Verification
+		assert.Equal(t, int64(2), v.BothDup)
+		assert.Equal(t, int64(2), v.Neither)
+		assert.Equal(t, int64(0), v.OnlyOurs+v.OnlyTheirs+v.UnmatchedOurs+v.UnmatchedTheirs)
+		assert.Equal(t, 1.0, v.Agreement())
+		assert.False(t, strings.Contains(v.String(), "disagreements"))
+	}
+}
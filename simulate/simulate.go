@@ -0,0 +1,533 @@
+// Copyright 2019 Grail Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package simulate generates coordinate sorted BAMs of duplicate
+// readpairs, for benchmarking doppelmark and testing it on scenarios
+// that are tedious to write by hand, and a truth file of the
+// duplicates to score its accuracy with.
+//
+// The readpairs are generated in duplicate sets: a set of one is a
+// readpair without duplicates, and the readpairs of a larger set have
+// the same positions and orientation. Distinct sets never share the 5'
+// position of a read, so the duplicates are exactly the readpairs of
+// the sets but their representative. The representative has the
+// highest base qualities, so that it is the primary of its set under
+// the default scoring. A duplicate is optical if it is within
+// OpticalDistance pixels of the representative, on the same tile; the
+// other duplicates are on tiles of their own. The records are not
+// flagged as duplicates.
+//
+// The records are held in memory until they are sorted, so a BAM of
+// millions of readpairs takes a few GB.
+package simulate
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"math/rand"
+	"sort"
+	"strings"
+
+	"github.com/Schaudge/hts/bam"
+	"github.com/Schaudge/hts/sam"
+)
+
+// The read name formats of Opts.NameFormat.
+const (
+	// NameIllumina5 names look like SIM:1:1101:12345:6789, with the
+	// lane, tile, X and Y.
+	NameIllumina5 = "illumina5"
+	// NameIllumina7 names look like SIM:1:FC1:1:1101:12345:6789, with
+	// the run and the flowcell before the lane.
+	NameIllumina7 = "illumina7"
+	// NameIllumina8 names are NameIllumina7 names with the UMI as the
+	// eighth field, or N if there are no UMIs.
+	NameIllumina8 = "illumina8"
+	// NameGeneMind names look like G:1:R012C045:12345:6789, whose tile
+	// is an FOV name.
+	NameGeneMind = "genemind"
+	// NameMGI names look like V300000001L1C001R0010001234, with the
+	// lane, the FOV column and row, and the spot index, which numbers
+	// the spots of the FOV row by row, mgiSpotsPerRow to a row.
+	NameMGI = "mgi"
+)
+
+// NameFormats are the read name formats of Opts.NameFormat.
+var NameFormats = []string{NameIllumina5, NameIllumina7, NameIllumina8, NameGeneMind, NameMGI}
+
+// TruthHeader is the header line of the truth file. It has a row for
+// each readpair, in the order of the sets: its name, the index and
+// size of its set, whether it is a duplicate and an optical duplicate,
+// and whether its UMI differs from that of its set.
+const TruthHeader = "qname\tset_id\tset_size\tduplicate\toptical\tumi_error\n"
+
+// Opts are the parameters of Generate.
+type Opts struct {
+	// Seed seeds the random numbers, so that the same Opts generate
+	// the same BAM.
+	Seed int64
+	// Pairs is the number of readpairs.
+	Pairs int
+	// References and ReferenceLength are the number of references and
+	// their length.
+	References      int
+	ReferenceLength int
+	// ReadLength is the length of the reads.
+	ReadLength int
+	// DuplicationRate is the expected fraction of the readpairs that
+	// are duplicates, like picard's PERCENT_DUPLICATION.
+	DuplicationRate float64
+	// SetSizeMean is the mean size of the duplicate sets of more than
+	// one readpair, whose sizes are geometrically distributed above 2,
+	// and SetSizeMax is their maximum size.
+	SetSizeMean float64
+	SetSizeMax  int
+	// OpticalFraction is the fraction of the duplicates that are
+	// optical duplicates, within OpticalDistance pixels of their
+	// representative.
+	OpticalFraction float64
+	OpticalDistance int
+	// InterchromosomalFraction is the fraction of the sets whose reads
+	// are on different references.
+	InterchromosomalFraction float64
+	// UMILength, if > 0, is the length of the UMIs of the sets, in the
+	// RX tag, and UMIErrorRate is the probability that a base of the
+	// UMI of a readpair differs from that of its set.
+	UMILength    int
+	UMIErrorRate float64
+	// NameFormat is the format of the read names, one of NameFormats.
+	NameFormat string
+	// SecondaryFraction and SupplementaryFraction are the fractions of
+	// the readpairs with a secondary and a supplementary record of
+	// their first read, elsewhere in the genome.
+	SecondaryFraction     float64
+	SupplementaryFraction float64
+}
+
+// DefaultOpts are the default parameters of Generate.
+var DefaultOpts = Opts{
+	Seed:            1,
+	Pairs:           10000,
+	References:      2,
+	ReferenceLength: 1000000,
+	ReadLength:      100,
+	DuplicationRate: 0.2,
+	SetSizeMean:     3,
+	SetSizeMax:      40,
+	OpticalFraction: 0.1,
+	OpticalDistance: 100,
+	NameFormat:      NameIllumina7,
+}
+
+// The layout of the flowcell: tiles is the number of tiles of a lane,
+// and the coordinates are in [minCoord, maxCoord).
+const (
+	lanes    = 4
+	tiles    = 200
+	minCoord = 1000
+	maxCoord = 30000
+	// An MGI FOV has mgiRows rows of mgiSpotsPerRow spots, like the
+	// FOVs that markduplicates parses.
+	mgiSpotsPerRow = 1000
+	mgiRows        = 10000
+)
+
+// Validate returns an error if opts cannot be generated.
+func (opts *Opts) Validate() error {
+	var problems []string
+	add := func(format string, args ...interface{}) {
+		problems = append(problems, fmt.Sprintf(format, args...))
+	}
+	if opts.Pairs <= 0 {
+		add("pairs must be positive")
+	}
+	if opts.References <= 0 {
+		add("references must be positive")
+	}
+	if opts.ReadLength <= 0 {
+		add("read-length must be positive")
+	}
+	if opts.ReferenceLength < 4*opts.ReadLength {
+		add("reference-length must be at least 4 read lengths")
+	} else if int64(opts.References)*int64(opts.ReferenceLength-4*opts.ReadLength) < 4*int64(opts.Pairs) {
+		add("the references are too short for %d readpairs", opts.Pairs)
+	}
+	if opts.DuplicationRate < 0 || opts.DuplicationRate >= 1 {
+		add("duplication-rate must be in [0, 1)")
+	}
+	if opts.SetSizeMean < 2 {
+		add("set-size-mean must be at least 2")
+	}
+	if opts.SetSizeMax < 2 || opts.SetSizeMax >= tiles {
+		add("set-size-max must be in [2, %d)", tiles)
+	}
+	if opts.OpticalDistance < 2 && opts.OpticalFraction > 0 {
+		add("optical-distance must be at least 2")
+	}
+	if opts.InterchromosomalFraction > 0 && opts.References < 2 {
+		add("interchromosomal-fraction requires at least 2 references")
+	}
+	if opts.UMILength < 0 {
+		add("umi-length must be non-negative")
+	}
+	for _, f := range []struct {
+		name  string
+		value float64
+	}{
+		{"optical-fraction", opts.OpticalFraction},
+		{"interchromosomal-fraction", opts.InterchromosomalFraction},
+		{"umi-error-rate", opts.UMIErrorRate},
+		{"secondary-fraction", opts.SecondaryFraction},
+		{"supplementary-fraction", opts.SupplementaryFraction},
+	} {
+		if f.value < 0 || f.value > 1 {
+			add("%s must be in [0, 1]", f.name)
+		}
+	}
+	known := false
+	for _, format := range NameFormats {
+		known = known || opts.NameFormat == format
+	}
+	if !known {
+		add("name-format must be one of %s", strings.Join(NameFormats, ", "))
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("invalid simulation options: %s", strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// location is the position of a readpair on the flowcell.
+type location struct {
+	lane, tile, x, y int
+}
+
+// generator generates the readpairs of Generate.
+type generator struct {
+	opts    *Opts
+	rnd     *rand.Rand
+	refs    []*sam.Reference
+	records []*sam.Record
+	truth   *bufio.Writer
+	// used are the 5' positions of the reads, as ref<<32 | pos, and
+	// names the read names, so that distinct sets never collide.
+	used  map[int64]bool
+	names map[string]bool
+}
+
+// Generate writes a BAM of opts to out, and its truth file, see
+// TruthHeader, to truth.
+func Generate(opts Opts, out, truth io.Writer) error {
+	if err := opts.Validate(); err != nil {
+		return err
+	}
+	g := &generator{
+		opts:  &opts,
+		rnd:   rand.New(rand.NewSource(opts.Seed)),
+		truth: bufio.NewWriter(truth),
+		used:  map[int64]bool{},
+		names: map[string]bool{},
+	}
+	for i := 0; i < opts.References; i++ {
+		ref, err := sam.NewReference(fmt.Sprintf("chr%d", i+1), "", "", opts.ReferenceLength, nil, nil)
+		if err != nil {
+			return err
+		}
+		g.refs = append(g.refs, ref)
+	}
+	header, err := sam.NewHeader([]byte("@HD\tVN:1.6\tSO:coordinate\n"), g.refs)
+	if err != nil {
+		return err
+	}
+	if _, err := g.truth.WriteString(TruthHeader); err != nil {
+		return err
+	}
+
+	// A set is a duplicate set with probability dupSetRate, so that
+	// the expected fraction of duplicates is DuplicationRate.
+	dupSetRate := opts.DuplicationRate / ((1 - opts.DuplicationRate) * (opts.SetSizeMean - 1))
+	for setID, pairs := 0, 0; pairs < opts.Pairs; setID++ {
+		size := 1
+		if g.rnd.Float64() < dupSetRate {
+			size = g.setSize()
+		}
+		if size > opts.Pairs-pairs {
+			size = opts.Pairs - pairs
+		}
+		if err := g.addSet(setID, size); err != nil {
+			return err
+		}
+		pairs += size
+	}
+	if err := g.truth.Flush(); err != nil {
+		return err
+	}
+
+	sort.SliceStable(g.records, func(i, j int) bool {
+		a, b := g.records[i], g.records[j]
+		if a.Ref.ID() != b.Ref.ID() {
+			return a.Ref.ID() < b.Ref.ID()
+		}
+		return a.Pos < b.Pos
+	})
+	writer, err := bam.NewWriter(out, header, 1)
+	if err != nil {
+		return err
+	}
+	for _, r := range g.records {
+		if err := writer.Write(r); err != nil {
+			writer.Close() // nolint: errcheck
+			return err
+		}
+	}
+	return writer.Close()
+}
+
+// setSize returns the size of a duplicate set of more than one
+// readpair.
+func (g *generator) setSize() int {
+	size := 2
+	if mean := g.opts.SetSizeMean - 2; mean > 0 {
+		// The number of failures before the first success of trials
+		// that succeed with probability 1/(1+mean).
+		size += int(math.Floor(math.Log(1-g.rnd.Float64()) / math.Log(mean/(1+mean))))
+	}
+	if size > g.opts.SetSizeMax {
+		size = g.opts.SetSizeMax
+	}
+	return size
+}
+
+// positions returns the references and positions of the left and
+// right reads of a set, whose 5' positions are not used by another
+// set.
+func (g *generator) positions() (ref1, pos1, ref2, pos2 int) {
+	readLen := g.opts.ReadLength
+	for {
+		ref1 = g.rnd.Intn(len(g.refs))
+		pos1 = g.rnd.Intn(g.opts.ReferenceLength - 4*readLen)
+		if g.rnd.Float64() < g.opts.InterchromosomalFraction {
+			ref2 = (ref1 + 1 + g.rnd.Intn(len(g.refs)-1)) % len(g.refs)
+			pos2 = g.rnd.Intn(g.opts.ReferenceLength - readLen)
+		} else {
+			ref2 = ref1
+			pos2 = pos1 + g.rnd.Intn(2*readLen)
+		}
+		// The right read is reversed, so its 5' position is its end.
+		left, right := int64(ref1)<<32|int64(pos1), int64(ref2)<<32|int64(pos2+readLen-1)
+		if !g.used[left] && !g.used[right] && left != right {
+			g.used[left], g.used[right] = true, true
+			return
+		}
+	}
+}
+
+// addSet adds the readpairs of a set of size, and their rows of the
+// truth file.
+func (g *generator) addSet(setID, size int) error {
+	ref1, pos1, ref2, pos2 := g.positions()
+	// The left read is the first read of the pair, or the second.
+	leftRead, rightRead := sam.Read1, sam.Read2
+	if g.rnd.Intn(2) == 0 {
+		leftRead, rightRead = rightRead, leftRead
+	}
+	umi := g.umi()
+	rep := location{lane: 1 + g.rnd.Intn(lanes), tile: g.rnd.Intn(tiles)}
+	rep.x, rep.y = g.coords()
+	seq := g.bases(g.opts.ReadLength)
+
+	for k := 0; k < size; k++ {
+		loc, optical := rep, false
+		if k > 0 {
+			if g.rnd.Float64() < g.opts.OpticalFraction {
+				optical = true
+			} else {
+				// A tile of its own within the set.
+				loc.tile = (rep.tile + k) % tiles
+			}
+		}
+		pairUMI := g.umiWithErrors(umi)
+		name := g.name(&loc, optical, rep, pairUMI)
+
+		// The representative has the highest base qualities.
+		qual := byte(40)
+		if k > 0 {
+			qual = 30
+		}
+		flags := sam.Paired | sam.ProperPair
+		if ref1 != ref2 {
+			flags = sam.Paired
+		}
+		tlen := 0
+		if ref1 == ref2 {
+			tlen = pos2 + g.opts.ReadLength - pos1
+		}
+		left := g.record(name, flags|leftRead|sam.MateReverse, ref1, pos1, ref2, pos2, tlen, seq, qual, pairUMI)
+		right := g.record(name, flags|rightRead|sam.Reverse, ref2, pos2, ref1, pos1, -tlen, seq, qual, pairUMI)
+		g.records = append(g.records, left, right)
+
+		first := left
+		if leftRead != sam.Read1 {
+			first = right
+		}
+		for _, extra := range []struct {
+			flag     sam.Flags
+			fraction float64
+		}{
+			{sam.Secondary, g.opts.SecondaryFraction},
+			{sam.Supplementary, g.opts.SupplementaryFraction},
+		} {
+			if g.rnd.Float64() >= extra.fraction {
+				continue
+			}
+			ref := g.rnd.Intn(len(g.refs))
+			pos := g.rnd.Intn(g.opts.ReferenceLength - g.opts.ReadLength)
+			r := g.record(name, (first.Flags&^(sam.Reverse|sam.ProperPair))|extra.flag, ref, pos,
+				first.MateRef.ID(), first.MatePos, 0, seq, qual, pairUMI)
+			g.records = append(g.records, r)
+		}
+
+		if _, err := fmt.Fprintf(g.truth, "%s\t%d\t%d\t%t\t%t\t%t\n", name, setID, size, k > 0, optical,
+			pairUMI != umi); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// coords returns random X and Y coordinates.
+func (g *generator) coords() (int, int) {
+	if g.opts.NameFormat == NameMGI {
+		return g.rnd.Intn(mgiSpotsPerRow), g.rnd.Intn(mgiRows)
+	}
+	return minCoord + g.rnd.Intn(maxCoord-minCoord), minCoord + g.rnd.Intn(maxCoord-minCoord)
+}
+
+// clamp returns v limited to [0, n).
+func clamp(v, n int) int {
+	if v < 0 {
+		return 0
+	}
+	if v >= n {
+		return n - 1
+	}
+	return v
+}
+
+// name returns the unique read name of a readpair at loc. If optical,
+// loc is moved to a random location within OpticalDistance of rep,
+// otherwise its coordinates are moved if its name is already used.
+func (g *generator) name(loc *location, optical bool, rep location, umi string) string {
+	for {
+		if optical {
+			// Within OpticalDistance along both axes together. MGI
+			// spots are kept in the FOV, which only brings them
+			// closer to rep.
+			d := g.opts.OpticalDistance / 2
+			loc.x = rep.x - d + g.rnd.Intn(2*d+1)
+			loc.y = rep.y - d + g.rnd.Intn(2*d+1)
+			if g.opts.NameFormat == NameMGI {
+				loc.x, loc.y = clamp(loc.x, mgiSpotsPerRow), clamp(loc.y, mgiRows)
+			}
+		}
+		name := g.format(*loc, umi)
+		if !g.names[name] {
+			g.names[name] = true
+			return name
+		}
+		if !optical {
+			loc.x, loc.y = g.coords()
+		}
+	}
+}
+
+// format returns the read name of loc in Opts.NameFormat.
+func (g *generator) format(loc location, umi string) string {
+	// Illumina tiles are 1101-1150, 1201-1250, 2101-2150 and 2201-2250.
+	illuminaTile := 1000*(1+loc.tile/100) + 100*(1+loc.tile%100/50) + 1 + loc.tile%50
+	switch g.opts.NameFormat {
+	case NameIllumina5:
+		return fmt.Sprintf("SIM:%d:%d:%d:%d", loc.lane, illuminaTile, loc.x, loc.y)
+	case NameIllumina7:
+		return fmt.Sprintf("SIM:1:FC1:%d:%d:%d:%d", loc.lane, illuminaTile, loc.x, loc.y)
+	case NameIllumina8:
+		if umi == "" {
+			umi = "N"
+		}
+		return fmt.Sprintf("SIM:1:FC1:%d:%d:%d:%d:%s", loc.lane, illuminaTile, loc.x, loc.y, umi)
+	case NameGeneMind:
+		// 20 FOV rows of 10 columns.
+		return fmt.Sprintf("G:%d:R%03dC%03d:%d:%d", loc.lane, 1+loc.tile/10, 1+loc.tile%10, loc.x, loc.y)
+	}
+	// 10 FOV columns of 20 rows.
+	return fmt.Sprintf("V300000001L%dC%03dR%03d%07d", loc.lane, 1+loc.tile/20, 1+loc.tile%20,
+		loc.y*mgiSpotsPerRow+loc.x)
+}
+
+// record returns a mapped record of a readpair.
+func (g *generator) record(name string, flags sam.Flags, ref, pos, mateRef, matePos, tlen int, seq []byte,
+	qual byte, umi string) *sam.Record {
+	r := &sam.Record{
+		Name:    name,
+		Ref:     g.refs[ref],
+		Pos:     pos,
+		MapQ:    60,
+		Cigar:   sam.Cigar{sam.NewCigarOp(sam.CigarMatch, g.opts.ReadLength)},
+		Flags:   flags,
+		MateRef: g.refs[mateRef],
+		MatePos: matePos,
+		TempLen: tlen,
+		Seq:     sam.NewSeq(seq),
+		Qual:    make([]byte, g.opts.ReadLength),
+	}
+	for i := range r.Qual {
+		r.Qual[i] = qual
+	}
+	if umi != "" {
+		aux, err := sam.NewAux(sam.NewTag("RX"), umi)
+		if err != nil {
+			panic(err)
+		}
+		r.AuxFields = append(r.AuxFields, aux)
+	}
+	return r
+}
+
+// bases returns n random bases.
+func (g *generator) bases(n int) []byte {
+	b := make([]byte, n)
+	for i := range b {
+		b[i] = "ACGT"[g.rnd.Intn(4)]
+	}
+	return b
+}
+
+// umi returns the UMI of a set, or "" without UMIs.
+func (g *generator) umi() string {
+	return string(g.bases(g.opts.UMILength))
+}
+
+// umiWithErrors returns umi with each base replaced by another with
+// probability Opts.UMIErrorRate.
+func (g *generator) umiWithErrors(umi string) string {
+	b := []byte(umi)
+	for i := range b {
+		if g.rnd.Float64() < g.opts.UMIErrorRate {
+			b[i] = strings.Replace("ACGT", string(b[i]), "", 1)[g.rnd.Intn(3)]
+		}
+	}
+	return string(b)
+}
@@ -0,0 +1,131 @@
+// Copyright 2019 Grail Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package simulate
+
+import (
+	"bytes"
+	"io"
+	"math"
+	"strings"
+	"testing"
+
+	"github.com/Schaudge/hts/bam"
+	"github.com/Schaudge/hts/sam"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGenerate(t *testing.T) {
+	for _, format := range NameFormats {
+		opts := DefaultOpts
+		opts.NameFormat = format
+		opts.InterchromosomalFraction = 0.1
+		opts.UMILength = 8
+		opts.UMIErrorRate = 0.01
+		opts.SecondaryFraction = 0.05
+		opts.SupplementaryFraction = 0.05
+		var out, truth bytes.Buffer
+		if !assert.NoError(t, Generate(opts, &out, &truth), "format %s", format) {
+			continue
+		}
+
+		// The truth has a row per readpair, with unique names.
+		lines := strings.Split(strings.TrimSpace(truth.String()), "\n")
+		assert.Equal(t, strings.TrimSpace(TruthHeader), lines[0], "format %s", format)
+		rows := lines[1:]
+		assert.Len(t, rows, opts.Pairs, "format %s", format)
+		names := map[string]bool{}
+		duplicates, optical := 0, 0
+		for _, row := range rows {
+			fields := strings.Split(row, "\t")
+			names[fields[0]] = true
+			if fields[3] == "true" {
+				duplicates++
+			}
+			if fields[4] == "true" {
+				optical++
+			}
+		}
+		assert.Len(t, names, opts.Pairs, "format %s", format)
+		rate := float64(duplicates) / float64(opts.Pairs)
+		assert.True(t, math.Abs(rate-opts.DuplicationRate) < 0.03, "format %s rate %v", format, rate)
+		assert.True(t, optical > 0 && optical < duplicates, "format %s", format)
+
+		// The BAM is coordinate sorted, with two primary records per
+		// readpair.
+		reader, err := bam.NewReader(&out, 1)
+		if !assert.NoError(t, err, "format %s", format) {
+			continue
+		}
+		assert.Equal(t, sam.Coordinate, reader.Header().SortOrder, "format %s", format)
+		primaries, extras := 0, 0
+		var last *sam.Record
+		for {
+			r, err := reader.Read()
+			if err == io.EOF {
+				break
+			}
+			if !assert.NoError(t, err, "format %s", format) {
+				break
+			}
+			if last != nil {
+				assert.True(t, last.Ref.ID() < r.Ref.ID() || (last.Ref.ID() == r.Ref.ID() && last.Pos <= r.Pos),
+					"format %s", format)
+			}
+			last = r
+			assert.True(t, names[r.Name], "format %s", format)
+			assert.Equal(t, sam.Flags(0), r.Flags&sam.Duplicate, "format %s", format)
+			if r.Flags&(sam.Secondary|sam.Supplementary) != 0 {
+				extras++
+			} else {
+				primaries++
+			}
+		}
+		assert.Equal(t, 2*opts.Pairs, primaries, "format %s", format)
+		assert.True(t, extras > 0, "format %s", format)
+	}
+}
+
+func TestGenerateDeterministic(t *testing.T) {
+	var out1, truth1, out2, truth2 bytes.Buffer
+	assert.NoError(t, Generate(DefaultOpts, &out1, &truth1))
+	assert.NoError(t, Generate(DefaultOpts, &out2, &truth2))
+	assert.Equal(t, out1.Bytes(), out2.Bytes())
+	assert.Equal(t, truth1.String(), truth2.String())
+}
+
+func TestValidate(t *testing.T) {
+	opts := DefaultOpts
+	assert.NoError(t, opts.Validate())
+	tests := []struct {
+		name   string
+		modify func(*Opts)
+	}{
+		{"no pairs", func(o *Opts) { o.Pairs = 0 }},
+		{"duplication rate", func(o *Opts) { o.DuplicationRate = 1 }},
+		{"set size mean", func(o *Opts) { o.SetSizeMean = 1 }},
+		{"set size max", func(o *Opts) { o.SetSizeMax = 1000 }},
+		{"short references", func(o *Opts) { o.ReferenceLength = 1000 }},
+		{"interchromosomal with one reference", func(o *Opts) {
+			o.References = 1
+			o.InterchromosomalFraction = 0.1
+		}},
+		{"umi error rate", func(o *Opts) { o.UMIErrorRate = 2 }},
+		{"name format", func(o *Opts) { o.NameFormat = "pacbio" }},
+	}
+	for _, test := range tests {
+		opts := DefaultOpts
+		test.modify(&opts)
+		assert.Error(t, opts.Validate(), "test %s", test.name)
+	}
+}